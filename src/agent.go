@@ -2,18 +2,28 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reagent/api"
 	"reagent/apps"
 	"reagent/benchmark"
+	"reagent/bundle"
 	"reagent/common"
 	"reagent/config"
 	"reagent/container"
+	"reagent/daemonconfig"
 	"reagent/diskguard"
 	"reagent/filesystem"
+	"reagent/imagesign"
+	"reagent/localrouter"
 	"reagent/logging"
 	"reagent/messenger"
 	"reagent/messenger/topics"
 	"reagent/network"
+	"reagent/peerimage"
 	"reagent/persistence"
 	"reagent/privilege"
 	"reagent/release"
@@ -23,12 +33,22 @@ import (
 	"reagent/terminal"
 	"reagent/tunnel"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// bundleScanInterval is how often the bundle directories are scanned; a
+// bundle is installed one scan after it has stopped growing.
+const bundleScanInterval = 10 * time.Second
+
+// dataRooted is a container runtime that reports where it keeps its data.
+type dataRooted interface {
+	DataRootDir(ctx context.Context) (string, error)
+}
+
 type Agent struct {
 	Container       container.Container
 	Messenger       messenger.Messenger
@@ -41,6 +61,11 @@ type Agent struct {
 	LogManager      *logging.LogManager
 	TerminalManager *terminal.TerminalManager
 	TunnelManager   tunnel.TunnelManager
+	TrafficMeter    *tunnel.TrafficMeter
+	LocalRouter     *localrouter.LocalRouter
+	DaemonConfig    *daemonconfig.Manager
+	PeerImages      *peerimage.Server
+	PeerImageKey    *peerimage.Key
 	Filesystem      *filesystem.Filesystem
 	AppManager      *apps.AppManager
 	StateObserver   *apps.StateObserver
@@ -62,6 +87,18 @@ func (agent *Agent) Shutdown(timeout time.Duration) {
 		if agent.Messenger != nil {
 			agent.Messenger.Close()
 		}
+		err := agent.TrafficMeter.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to persist tunnel traffic counters")
+		}
+		err = agent.LocalRouter.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to close local WAMP router")
+		}
+		err = agent.PeerImages.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to stop serving app images on the LAN")
+		}
 		if agent.Database != nil {
 			err := agent.Database.Close()
 			if err != nil {
@@ -119,6 +156,20 @@ func (agent *Agent) OnConnect(reconnect bool) error {
 		agent.AppManager.StateMachine.SetAppCredKey(appCredKey)
 	}
 
+	// The key the devices of the swarm share app images on the LAN with. A
+	// device moved to another swarm reconnects above and gets its new key
+	// here. Never fatal: without it images come from the registry.
+	if agent.PeerImageKey != nil {
+		keyCtx, cancelKey := context.WithTimeout(context.Background(), time.Second*10)
+		peerImageKey, keyErr := peerimage.FetchKey(keyCtx, agent.Messenger)
+		cancelKey()
+		if keyErr != nil {
+			log.Error().Err(keyErr).Msg("could not fetch the peer image key; app images are not shared on the LAN")
+		} else {
+			agent.PeerImageKey.Set(peerImageKey)
+		}
+	}
+
 	log.Info().Msg("Updating Remote Device Status ...")
 	// Never fatal. A rejected status write is recoverable (the next heartbeat
 	// retries, and a reconnect re-runs the metadata refresh above), but exiting
@@ -129,6 +180,16 @@ func (agent *Agent) OnConnect(reconnect bool) error {
 		log.Error().Stack().Err(err).Msg("failed to update remote device status")
 	}
 
+	// Pre-warm the privilege cache before the handlers are reachable, so the
+	// first privileged calls after a (re)connect need no backend round trip.
+	// Never fatal: without it privileges are checked live.
+	syncCtx, cancelSync := context.WithTimeout(context.Background(), time.Second*10)
+	err = agent.External.Privilege.Sync(syncCtx)
+	cancelSync()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to sync privilege grants")
+	}
+
 	// Register all endpoints early so terminal/system commands are available
 	// even if Docker is not running - allows remote debugging
 	log.Debug().Msg("Registering all endpoints...")
@@ -145,14 +206,21 @@ func (agent *Agent) OnConnect(reconnect bool) error {
 		terminal.ReregisterControlTopics(agent.Messenger)
 	}
 
+	// The same for what the local router bridges for the apps, and the
+	// publishes it spooled while the session was down go up now.
+	agent.LocalRouter.Reattach()
+
 	// frpc is delivered on every supported platform: embedded on Linux/macOS,
 	// downloaded (separate signed binary) on Windows. If it can't be acquired
 	// or won't connect, SuperviseStart settles the device into an
 	// unavailable-but-alive state — the agent and app starts are unaffected.
+	// The native backend is in-process and needs no binary.
 	if !reconnect {
-		err = agent.System.DownloadFrpIfNotExists()
-		if err != nil {
-			log.Error().Stack().Err(err).Msg("failed to acquire frp tunnel client")
+		if tunnel.Backend(agent.Config) == tunnel.BackendFrp {
+			err = agent.System.DownloadFrpIfNotExists(context.Background())
+			if err != nil {
+				log.Error().Stack().Err(err).Msg("failed to acquire frp tunnel client")
+			}
 		}
 
 		log.Info().Msg("Starting TunnelManager ...")
@@ -189,6 +257,19 @@ func (agent *Agent) OnConnect(reconnect bool) error {
 	<-agent.daemonReady
 	log.Info().Msg("Docker Daemon is available")
 
+	// Apply the daemon settings before the apps are synced below, so a
+	// restart they need does not interrupt that. Never fatal: the daemon keeps
+	// running with the settings it has.
+	if agent.DaemonConfig != nil {
+		log.Info().Msg("Syncing Docker daemon settings ...")
+		syncCtx, cancelSync := context.WithTimeout(context.Background(), time.Second*10)
+		err = agent.DaemonConfig.Sync(syncCtx)
+		cancelSync()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to sync Docker daemon settings")
+		}
+	}
+
 	// Step 1: Fetch requested app states from backend
 	log.Info().Msg("Fetching requested app states from backend...")
 	remotePayloads, err := agent.AppManager.AppStore.FetchRequestedAppStates()
@@ -289,13 +370,13 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 
 	// setup the agent struct with a dummy/offline implementation of the messenger
 	dummyMessenger := messenger.NewOffline(generalConfig)
-	container, err := container.NewDocker(generalConfig)
+	container, err := container.New(generalConfig)
 	if err != nil {
-		log.Fatal().Stack().Err(err).Msg("failed to setup docker")
+		log.Fatal().Stack().Err(err).Msg("failed to setup container runtime")
 	}
 
 	filesystem := filesystem.New()
-	tunnelManager, err := tunnel.NewFrpTunnelManager(dummyMessenger, generalConfig)
+	tunnelManager, err := tunnel.NewTunnelManager(dummyMessenger, generalConfig)
 	if err != nil {
 		log.Fatal().Stack().Err(err).Msg("failed to init tunnel manager")
 	}
@@ -305,6 +386,95 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 	stateObserver := apps.NewObserver(container, &appStore, &logManager)
 	stateMachine := apps.NewStateMachine(container, &logManager, &stateObserver, &filesystem)
 	appManager := apps.NewAppManager(&stateMachine, &appStore, &stateObserver, tunnelManager)
+
+	// Fail closed: an agent asked to run only signed images must not fall back
+	// to running them unverified because a key file is unreadable.
+	imagePolicy, err := imagesign.NewPolicy(splitFileList(cliArgs.ImageSigningKeys), splitFileList(cliArgs.ImageSigningRoots))
+	if err != nil {
+		log.Fatal().Stack().Err(err).Msg("failed to load the image signing keys")
+	}
+	stateMachine.SetImagePolicy(imagePolicy)
+
+	// Advertise the device and its app ports on the LAN, so they can be found
+	// on networks without internet where the tunnel URLs are useless. Started
+	// here rather than on connect for exactly that reason.
+	var lanAdvertiser *tunnel.LANAdvertiser
+	lanAdvertising := false
+	if cliArgs.AdvertiseMDNS {
+		lanAdvertiser = tunnel.NewLANAdvertiser(generalConfig)
+		err = lanAdvertiser.Start()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to start mDNS advertisement, app ports are not discoverable on the LAN")
+		} else {
+			lanAdvertising = true
+		}
+		appManager.SetLANAdvertiser(lanAdvertiser)
+	}
+
+	// Share app images with the devices around, found over mDNS like the
+	// device itself. Whatever a device is served is checked against the
+	// registry the image comes from, so fetching is on by default; serving
+	// exposes the images on the LAN and is opt-in. Both sign and check the
+	// requests with the key of the swarm, fetched on connect.
+	var peerImageKey *peerimage.Key
+	if cliArgs.AdvertiseMDNS && (cliArgs.PeerImages || cliArgs.PeerImagePort != 0) {
+		peerImageKey = &peerimage.Key{}
+	}
+
+	if cliArgs.AdvertiseMDNS && cliArgs.PeerImages {
+		deviceKey := generalConfig.ReswarmConfig.DeviceKey
+		stateMachine.SetImagePeers(peerimage.NewFetcher(container, peerimage.Discover(deviceKey), cliArgs.DownloadDir, peerImageKey, deviceKey))
+	}
+
+	// Serving needs the advertisement: no device could find the images
+	// without it.
+	var peerImageServer *peerimage.Server
+	if cliArgs.AdvertiseMDNS && cliArgs.PeerImagePort != 0 && !lanAdvertising {
+		log.Error().Msg("not serving app images to the devices on the LAN, the mDNS advertisement did not start")
+	} else if cliArgs.AdvertiseMDNS && cliArgs.PeerImagePort != 0 {
+		peerImageServer, err = peerimage.NewServer(container, filepath.Join(cliArgs.AgentDir, "peer-images"), peerImageKey)
+		if err == nil {
+			err = peerImageServer.Start(cliArgs.PeerImageAddress, cliArgs.PeerImagePort)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to serve app images to the devices on the LAN")
+			peerImageServer = nil
+		} else {
+			lanAdvertiser.AdvertiseImages(uint16(cliArgs.PeerImagePort))
+		}
+	}
+
+	// Count the traffic of metered tunnels. The counters live in the agent
+	// directory, so monthly quotas hold across restarts.
+	trafficMeter := tunnel.NewTrafficMeter(filepath.Join(cliArgs.AgentDir, tunnel.TrafficFileName))
+	trafficMeter.Start()
+	appManager.SetTrafficMeter(trafficMeter)
+
+	// The counters are served without authentication, so only to the device
+	// itself unless -metricsAddress says otherwise.
+	if cliArgs.MetricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", trafficMeter)
+		metricsAddress := net.JoinHostPort(cliArgs.MetricsAddress, fmt.Sprint(cliArgs.MetricsPort))
+		safe.Go(func() {
+			err := http.ListenAndServe(metricsAddress, mux)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to serve tunnel traffic metrics")
+			}
+		})
+	}
+
+	// A router of our own the apps can publish to while the uplink is down.
+	// It authenticates them with their app credentials, so it can only come
+	// up once the app manager can resolve them.
+	var localRouter *localrouter.LocalRouter
+	if cliArgs.LocalRouterPort != 0 {
+		localRouter, err = localrouter.New(generalConfig, appManager.ResolveAppCredential, dummyMessenger)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to start local WAMP router, apps have to connect to the cloud directly")
+		}
+	}
+
 	terminalManager := terminal.NewTerminalManager(dummyMessenger, container)
 
 	var networkInstance network.Network
@@ -337,7 +507,9 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 		// partition (e.g. /apps/docker), not the /var/lib/docker default.
 		var dataRoot string
 		infoCtx, cancelInfo := context.WithTimeout(context.Background(), 10*time.Second)
-		if root, err := container.DataRootDir(infoCtx); err != nil {
+		if rooted, ok := container.(dataRooted); !ok {
+			log.Warn().Msg("diskguard: container runtime does not report its data-root, using default")
+		} else if root, err := rooted.DataRootDir(infoCtx); err != nil {
 			log.Warn().Err(err).Msg("diskguard: could not resolve docker data-root, using default")
 		} else {
 			dataRoot = root
@@ -389,6 +561,10 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 				}
 				return wanted, nil
 			},
+			// Abort the builds in flight, their layers would fill the disk further.
+			OnEmergency: func() {
+				stateMachine.AbortBuilds(diskguard.ErrEmergency)
+			},
 			// On recovery, reinstate the apps' requested states (which were
 			// stopped/blocked during the emergency).
 			OnRecover: func() {
@@ -471,6 +647,23 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 		})
 	}
 
+	// Install the app bundles put into the bundles directory or brought on a
+	// USB stick, once the daemon can load their images.
+	bundleDirs := bundle.Dirs(cliArgs.AppsDirectory, cliArgs.BundleDirs)
+	err = os.MkdirAll(bundleDirs[0], 0o755)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create the app bundles directory")
+	}
+	safe.Go(func() {
+		<-daemonReady
+		bundleWatcher := bundle.Watcher{
+			Dirs:     bundleDirs,
+			Interval: bundleScanInterval,
+			Import:   appManager.ImportBundle,
+		}
+		bundleWatcher.Run(context.Background())
+	})
+
 	// try to establish the main session
 	mainSocketConfig := messenger.SocketConfig{
 		SetupTestament:    true,
@@ -486,9 +679,9 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 	benchmark.OnConnectInitAfterConnection = time.Now()
 	benchmark.SocketConnectionInit = time.Now()
 
-	mainSession, err := messenger.NewWampSession(generalConfig, &mainSocketConfig, container, nil)
+	mainSession, err := messenger.NewSession(generalConfig, &mainSocketConfig, container)
 	if err != nil {
-		log.Fatal().Stack().Err(err).Msg("failed to setup wamp connection")
+		log.Fatal().Stack().Err(err).Msgf("failed to setup %s connection", messenger.Transport(generalConfig))
 	}
 
 	benchmark.TimeTillSocketConnection = time.Since(benchmark.SocketConnectionInit)
@@ -504,6 +697,7 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 	terminalManager.InitUnregisterWatcher()
 	logManager.SetMessenger(mainSession)
 	tunnelManager.SetMessenger(mainSession)
+	localRouter.SetMessenger(mainSession)
 	// The appliance's appstore registry keeps its blobs on this same disk, and
 	// removed apps' blobs otherwise wait on the registry's debounced sweep.
 	// Give the diskguard a direct lever: an immediate registry garbage
@@ -531,21 +725,46 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 	}
 	// Let the tunnel manager re-fetch frpc if it is found missing at runtime
 	// (e.g. antivirus quarantined it) instead of crash-looping on a gone file.
-	tunnelManager.SetReacquireFrpc(systemAPI.DownloadFrpIfNotExists)
+	if frpTunnelManager, ok := tunnelManager.(*tunnel.FrpTunnelManager); ok {
+		frpTunnelManager.SetReacquireFrpc(func() error {
+			return systemAPI.DownloadFrpIfNotExists(context.Background())
+		})
+	}
 	// Report per-device tunnel capability on the heartbeat, so the UI reflects
 	// it live without a dedicated get_agent_metadata call.
 	mainSession.SetTunnelCapableFunc(tunnelManager.TunnelCapable)
 	privilege := privilege.NewPrivilege(mainSession, generalConfig)
 
+	// The Docker daemon settings the backend manages, e.g. registry mirrors.
+	// Podman has no daemon.json. Restarting the daemon stops the app
+	// containers, so the apps are reconciled after a restart like on startup.
+	var daemonConfig *daemonconfig.Manager
+	if runtime.GOOS == "linux" && isDockerDaemon(container) {
+		daemonConfig = daemonconfig.NewManager(mainSession, generalConfig, container, filepath.Join(cliArgs.AgentDir, daemonconfig.StateFileName), func() {
+			err := stateObserver.CorrectAppStates(true)
+			if err != nil {
+				log.Error().Stack().Err(err).Msg("failed to correct app states after the Docker daemon restart")
+			}
+
+			err = appManager.EnsureLocalRequestedStates()
+			if err != nil {
+				log.Error().Stack().Err(err).Msg("failed to ensure app states after the Docker daemon restart")
+			}
+		})
+	}
+
 	external := api.External{
 		Container:       container,
 		Messenger:       mainSession,
 		LogMessenger:    mainSession,
 		Database:        database,
+		AuditLog:        database.AuditLog(time.Duration(cliArgs.AuditLogDays) * 24 * time.Hour),
 		Network:         networkInstance,
 		Privilege:       &privilege,
 		Filesystem:      &filesystem,
 		TunnelManager:   tunnelManager,
+		LANAdvertiser:   lanAdvertiser,
+		TrafficMeter:    trafficMeter,
 		System:          &systemAPI,
 		AppManager:      appManager,
 		TerminalManager: &terminalManager,
@@ -561,6 +780,11 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 		Network:         networkInstance,
 		TerminalManager: &terminalManager,
 		TunnelManager:   tunnelManager,
+		TrafficMeter:    trafficMeter,
+		LocalRouter:     localRouter,
+		DaemonConfig:    daemonConfig,
+		PeerImages:      peerImageServer,
+		PeerImageKey:    peerImageKey,
 		AppManager:      appManager,
 		StateObserver:   &stateObserver,
 		StateMachine:    &stateMachine,
@@ -584,3 +808,23 @@ func NewAgent(generalConfig *config.Config) (agent *Agent) {
 
 	return agent
 }
+
+// splitFileList splits a comma separated list of files given on the command
+// line.
+func splitFileList(list string) []string {
+	var files []string
+	for _, file := range strings.Split(list, ",") {
+		file = strings.TrimSpace(file)
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// isDockerDaemon reports whether c is the Docker daemon, which reads
+// daemon.json, rather than Podman.
+func isDockerDaemon(c container.Container) bool {
+	_, ok := c.(*container.Docker)
+	return ok
+}
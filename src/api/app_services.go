@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"reagent/apps"
+	"reagent/common"
+	"reagent/messenger"
+)
+
+func (ex *External) startAppServiceHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	return ex.controlAppService(ctx, response, apps.ServiceStart)
+}
+
+func (ex *External) stopAppServiceHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	return ex.controlAppService(ctx, response, apps.ServiceStop)
+}
+
+func (ex *External) restartAppServiceHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	return ex.controlAppService(ctx, response, apps.ServiceRestart)
+}
+
+// controlAppService applies action to the service of a compose app named by
+// the call's {app_key, stage, service}.
+func (ex *External) controlAppService(ctx context.Context, response messenger.Result, action string) (*messenger.InvokeResult, error) {
+	argsDict, err := firstArgDict(response.Arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	appKey, ok := common.ToUint64(argsDict["app_key"])
+	if !ok {
+		return nil, fmt.Errorf("invalid value for app_key")
+	}
+
+	stage, _ := argsDict["stage"].(string)
+	if stage != string(common.DEV) && stage != string(common.PROD) {
+		return nil, fmt.Errorf("invalid value for stage")
+	}
+
+	service, _ := argsDict["service"].(string)
+	if service == "" {
+		return nil, fmt.Errorf("invalid value for service")
+	}
+
+	err = ex.AppManager.ControlComposeService(ctx, common.Stage(stage), appKey, service, action)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messenger.InvokeResult{}, nil
+}
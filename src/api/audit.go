@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reagent/common"
+	"reagent/errdefs"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"reagent/persistence"
+	"reagent/privilege"
+	"reagent/safe"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxAuditArgument is how much of a single string argument the audit log
+// keeps; file contents, scripts and the like are cut off.
+const maxAuditArgument = 256
+
+// maxAuditArguments bounds the recorded arguments of one operation as a whole.
+const maxAuditArguments = 4096
+
+// redacted replaces argument values whose key names a credential.
+const redacted = "[REDACTED]"
+
+var sensitiveArgumentKeys = []string{"password", "passphrase", "secret", "token", "psk", "credential", "private", "cookie"}
+
+// audited records every invocation of handler in the audit log: who called
+// topic (as resolved by wrapDetails), the privilege checked, the redacted
+// arguments, the outcome and how long it took.
+func (ex *External) audited(topic topics.Topic, handler RegistrationHandler) RegistrationHandler {
+	return func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+		if ex.AuditLog == nil {
+			return handler(ctx, response)
+		}
+
+		if response.Details == nil {
+			response.Details = common.Dict{}
+		}
+
+		entry := persistence.AuditEntry{
+			Timestamp:    time.Now(),
+			Topic:        string(topic),
+			CallerAuthID: fmt.Sprint(response.Details["caller_authid"]),
+			Arguments:    auditArguments(response.Arguments, response.ArgumentsKw),
+		}
+
+		result, err := handler(ctx, response)
+
+		entry.Duration = time.Since(entry.Timestamp).Milliseconds()
+		entry.Privilege, _ = response.Details[privilege.CheckedDetailsKey].(string)
+		if accountKey, parseErr := strconv.ParseUint(fmt.Sprint(response.Details["caller_authid"]), 10, 64); parseErr == nil {
+			entry.RequestorAccountKey = accountKey
+		}
+
+		switch {
+		case err == nil:
+			entry.Outcome = persistence.AuditSuccess
+		case errdefs.IsInsufficientPrivileges(err), errdefs.IsRateLimited(err), errdefs.IsConcurrencyLimitReached(err):
+			// The topic policy turned the call away before it ran.
+			entry.Outcome = persistence.AuditDenied
+			entry.Error = err.Error()
+		default:
+			entry.Outcome = persistence.AuditFailed
+			entry.Error = err.Error()
+		}
+
+		safe.Go(func() {
+			if recordErr := ex.AuditLog.Record(entry); recordErr != nil {
+				log.Error().Err(recordErr).Msgf("Failed to record %s in the audit log", topic)
+			}
+		})
+
+		return result, err
+	}
+}
+
+// auditArguments renders the arguments of an invocation for the audit log,
+// with credentials redacted and long values cut off.
+func auditArguments(args []interface{}, kwargs common.Dict) string {
+	if len(args) == 0 && len(kwargs) == 0 {
+		return ""
+	}
+
+	payload := map[string]interface{}{}
+	if len(args) > 0 {
+		payload["args"] = redactArgument(args)
+	}
+	if len(kwargs) > 0 {
+		payload["kwargs"] = redactArgument(map[string]interface{}(kwargs))
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		unencodable, _ := json.Marshal(map[string]string{"unencodable": err.Error()})
+		return string(unencodable)
+	}
+
+	if len(encoded) > maxAuditArguments {
+		return truncatedArguments(string(encoded))
+	}
+	return string(encoded)
+}
+
+// truncatedArguments stands in for recorded arguments beyond
+// maxAuditArguments: JSON still, holding as much of their start as fits.
+func truncatedArguments(encoded string) string {
+	for keep := maxAuditArguments / 2; keep > 0; keep /= 2 {
+		marker, err := json.Marshal(map[string]interface{}{
+			"truncated": true,
+			"bytes":     len(encoded),
+			"prefix":    truncateUTF8(encoded, keep),
+		})
+		if err == nil && len(marker) <= maxAuditArguments {
+			return string(marker)
+		}
+	}
+	return fmt.Sprintf(`{"truncated":true,"bytes":%d}`, len(encoded))
+}
+
+// truncateUTF8 cuts value to at most size bytes without splitting a
+// character.
+func truncateUTF8(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
+
+func redactArgument(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return redactDict(typed)
+	case common.Dict:
+		return redactDict(typed)
+	case []interface{}:
+		redactedList := make([]interface{}, len(typed))
+		for i, item := range typed {
+			redactedList[i] = redactArgument(item)
+		}
+		return redactedList
+	case string:
+		if len(typed) > maxAuditArgument {
+			return fmt.Sprintf("%s… (%d bytes)", truncateUTF8(typed, maxAuditArgument), len(typed))
+		}
+		return typed
+	default:
+		return value
+	}
+}
+
+func redactDict(dict map[string]interface{}) map[string]interface{} {
+	redactedDict := make(map[string]interface{}, len(dict))
+	for key, value := range dict {
+		if isSensitiveArgument(key) {
+			redactedDict[key] = redacted
+			continue
+		}
+		redactedDict[key] = redactArgument(value)
+	}
+	return redactedDict
+}
+
+func isSensitiveArgument(key string) bool {
+	lowerKey := strings.ToLower(key)
+	for _, sensitive := range sensitiveArgumentKeys {
+		if strings.Contains(lowerKey, sensitive) {
+			return true
+		}
+	}
+	return false
+}
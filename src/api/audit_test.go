@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"reagent/common"
+	"reagent/errdefs"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"reagent/persistence"
+	"reagent/testutil/builders"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuditLog(t *testing.T) *persistence.AuditLog {
+	t.Helper()
+
+	cfg := builders.DefaultTestConfig()
+	cfg.CommandLineArguments.DatabaseFileName = filepath.Join(t.TempDir(), "audit.db")
+	db, err := persistence.NewSQLiteDb(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Init())
+	t.Cleanup(func() { _ = db.Close() })
+
+	return db.AuditLog(0)
+}
+
+// awaitAuditEntry waits for the single entry audited asynchronously.
+func awaitAuditEntry(t *testing.T, audit *persistence.AuditLog) persistence.AuditEntry {
+	t.Helper()
+
+	var entries []persistence.AuditEntry
+	require.Eventually(t, func() bool {
+		var err error
+		entries, err = audit.Query(persistence.AuditQuery{})
+		return err == nil && len(entries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	return entries[0]
+}
+
+func TestAudited(t *testing.T) {
+	t.Run("records the resolved caller, privilege and redacted arguments", func(t *testing.T) {
+		details, m := grantPrivilege(true)
+		audit := newTestAuditLog(t)
+		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m), AuditLog: audit}
+
+		handler := ex.audited(topics.AddWiFiConfiguration, wrapDetails(func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+			_, err := ex.Privilege.Check("NETWORK", response.Details)
+			return &messenger.InvokeResult{}, err
+		}))
+
+		_, err := handler(context.Background(), messenger.Result{
+			Details: details,
+			Arguments: []interface{}{map[string]interface{}{
+				"ssid":     "office",
+				"password": "hunter2",
+				"notes":    strings.Repeat("x", 1000),
+			}},
+		})
+		require.NoError(t, err)
+
+		entry := awaitAuditEntry(t, audit)
+		assert.Equal(t, string(topics.AddWiFiConfiguration), entry.Topic)
+		assert.Equal(t, "999", entry.CallerAuthID)
+		assert.Equal(t, uint64(999), entry.RequestorAccountKey)
+		assert.Equal(t, "NETWORK", entry.Privilege)
+		assert.Equal(t, persistence.AuditSuccess, entry.Outcome)
+		assert.Contains(t, entry.Arguments, `"ssid":"office"`)
+		assert.Contains(t, entry.Arguments, `"password":"[REDACTED]"`)
+		assert.NotContains(t, entry.Arguments, "hunter2")
+		assert.Contains(t, entry.Arguments, "(1000 bytes)")
+	})
+
+	t.Run("resolves system callers through wrapDetails", func(t *testing.T) {
+		audit := newTestAuditLog(t)
+		ex := &External{AuditLog: audit}
+
+		handler := ex.audited(topics.SystemReboot, wrapDetails(func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+			return &messenger.InvokeResult{}, nil
+		}))
+		_, err := handler(context.Background(), messenger.Result{
+			Details:     common.Dict{"caller_authid": "system"},
+			ArgumentsKw: common.Dict{"requestor_account_key": "42"},
+		})
+		require.NoError(t, err)
+
+		entry := awaitAuditEntry(t, audit)
+		assert.Equal(t, "system", entry.CallerAuthID)
+		assert.Equal(t, uint64(42), entry.RequestorAccountKey)
+	})
+
+	for _, tc := range []struct {
+		name    string
+		err     error
+		outcome persistence.AuditOutcome
+	}{
+		{"records denials", errdefs.InsufficientPrivileges(errors.New("no")), persistence.AuditDenied},
+		{"records failures", errors.New("disk full"), persistence.AuditFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			audit := newTestAuditLog(t)
+			ex := &External{AuditLog: audit}
+
+			handler := ex.audited(topics.WriteToFile, func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+				return nil, tc.err
+			})
+			_, err := handler(context.Background(), messenger.Result{Details: common.Dict{"caller_authid": "7"}})
+			require.ErrorIs(t, err, tc.err)
+
+			entry := awaitAuditEntry(t, audit)
+			assert.Equal(t, tc.outcome, entry.Outcome)
+			assert.Equal(t, tc.err.Error(), entry.Error)
+		})
+	}
+}
+
+func TestQueryAuditLogHandler(t *testing.T) {
+	audit := newTestAuditLog(t)
+	now := time.Now()
+	require.NoError(t, audit.Record(persistence.AuditEntry{Timestamp: now.Add(-2 * time.Hour), Topic: "reboot", CallerAuthID: "12", RequestorAccountKey: 12, Outcome: persistence.AuditSuccess}))
+	require.NoError(t, audit.Record(persistence.AuditEntry{Timestamp: now, Topic: "write_file", CallerAuthID: "13", RequestorAccountKey: 13, Outcome: persistence.AuditDenied}))
+
+	t.Run("filters the entries", func(t *testing.T) {
+		ex := &External{Config: testConfig(), Privilege: priv(t, true), AuditLog: audit}
+
+		res, err := ex.queryAuditLogHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"since": "1h", "outcome": "denied"}},
+		})
+		require.NoError(t, err)
+
+		payload := res.Arguments[0].(common.Dict)
+		entries := payload["entries"].([]persistence.AuditEntry)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "write_file", entries[0].Topic)
+	})
+
+	t.Run("exports JSON lines", func(t *testing.T) {
+		ex := &External{Config: testConfig(), Privilege: priv(t, true), AuditLog: audit}
+
+		res, err := ex.queryAuditLogHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"format": "jsonl"}},
+		})
+		require.NoError(t, err)
+
+		payload := res.Arguments[0].(common.Dict)
+		assert.Len(t, strings.Split(strings.TrimSpace(payload["jsonl"].(string)), "\n"), 2)
+		assert.Equal(t, false, payload["more"])
+	})
+
+	t.Run("exports a page after the entry given", func(t *testing.T) {
+		ex := &External{Config: testConfig(), Privilege: priv(t, true), AuditLog: audit}
+
+		res, err := ex.queryAuditLogHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"format": "jsonl", "limit": uint64(1)}},
+		})
+		require.NoError(t, err)
+		first := res.Arguments[0].(common.Dict)
+		assert.Contains(t, first["jsonl"], `"topic":"reboot"`)
+		assert.Equal(t, true, first["more"])
+
+		res, err = ex.queryAuditLogHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"format": "jsonl", "after": first["after"]}},
+		})
+		require.NoError(t, err)
+		second := res.Arguments[0].(common.Dict)
+		assert.Contains(t, second["jsonl"], `"topic":"write_file"`)
+		assert.NotContains(t, second["jsonl"], `"topic":"reboot"`)
+		assert.Equal(t, false, second["more"])
+	})
+
+	t.Run("requires MAINTAIN", func(t *testing.T) {
+		details, m := grantPrivilege(false)
+		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m), AuditLog: audit}
+
+		_, err := ex.handler(topics.QueryAuditLog)(context.Background(), messenger.Result{Details: details})
+		assert.True(t, errdefs.IsInsufficientPrivileges(err))
+	})
+}
+
+func TestAuditArgumentsTruncation(t *testing.T) {
+	t.Run("a long argument is cut between characters", func(t *testing.T) {
+		arguments := auditArguments([]interface{}{"a" + strings.Repeat("é", maxAuditArgument)}, nil)
+
+		var payload map[string][]string
+		require.NoError(t, json.Unmarshal([]byte(arguments), &payload))
+		require.Len(t, payload["args"], 1)
+		assert.True(t, utf8.ValidString(payload["args"][0]))
+		assert.Contains(t, payload["args"][0], fmt.Sprintf("(%d bytes)", 1+2*maxAuditArgument))
+	})
+
+	t.Run("arguments beyond the bound are kept as JSON", func(t *testing.T) {
+		args := make([]interface{}, 0, 64)
+		for range 64 {
+			args = append(args, strings.Repeat("ü\"", 60))
+		}
+
+		arguments := auditArguments(args, nil)
+		assert.LessOrEqual(t, len(arguments), maxAuditArguments)
+
+		var marker struct {
+			Truncated bool   `json:"truncated"`
+			Bytes     int    `json:"bytes"`
+			Prefix    string `json:"prefix"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(arguments), &marker))
+		assert.True(t, marker.Truncated)
+		assert.Greater(t, marker.Bytes, maxAuditArguments)
+		assert.True(t, utf8.ValidString(marker.Prefix))
+		assert.True(t, strings.HasPrefix(marker.Prefix, `{"args":["ü\"`))
+	})
+}
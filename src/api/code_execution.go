@@ -45,7 +45,7 @@ func (ex *External) codeExecutionHandler(ctx context.Context, response messenger
 
 	commandTimeout := uint64(1000)
 	if argsDict["timeout"] != nil {
-		commandTimeout, ok = argsDict["timeout"].(uint64)
+		commandTimeout, ok = common.ToUint64(argsDict["timeout"])
 		if !ok {
 			return nil, fmt.Errorf("the timeout param should be an uint64")
 		}
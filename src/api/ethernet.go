@@ -4,20 +4,10 @@ import (
 	"context"
 	"errors"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/messenger"
 )
 
 func (ex *External) listEthernetDevices(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to list ethernet devices"))
-	}
-
 	ethernetDevices, err := ex.Network.ListEthernetDevices()
 	if err != nil {
 		return nil, err
@@ -38,15 +28,6 @@ func (ex *External) listEthernetDevices(ctx context.Context, response messenger.
 }
 
 func (ex *External) updateIPConfigHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("NETWORK", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to update ip config"))
-	}
-
 	if response.Arguments == nil {
 		return nil, errors.New("failed to parse args, payload is missing")
 	}
@@ -92,7 +73,7 @@ func (ex *External) updateIPConfigHandler(ctx context.Context, response messenge
 	}
 
 	prefixKw := payload["prefix"]
-	prefix, ok := prefixKw.(uint64)
+	prefix, ok := common.ToUint64(prefixKw)
 	if !ok {
 		return nil, errors.New("failed to parse prefix parameter")
 	}
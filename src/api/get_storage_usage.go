@@ -2,22 +2,11 @@ package api
 
 import (
 	"context"
-	"errors"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/messenger"
 )
 
 func (ex *External) getStorageDataHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to get storage data"))
-	}
-
 	stats := common.GetStats()
 
 	result := common.Dict{
@@ -11,6 +11,10 @@ func (ex *External) getTunnelState(ctx context.Context, response messenger.Resul
 		return nil, err
 	}
 
+	// LAN URLs are answered locally, they work even when the tunnel does not
+	state = ex.LANAdvertiser.ApplyLANURLs(state)
+	state = ex.TrafficMeter.ApplyTraffic(state)
+
 	return &messenger.InvokeResult{
 		Arguments: []interface{}{state},
 	}, nil
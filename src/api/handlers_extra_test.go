@@ -173,7 +173,7 @@ func TestGetAppLogHistoryHandler(t *testing.T) {
 			Privilege:  newPrivilege(testConfig(), m),
 		}
 
-		res, err := ex.getAppLogHistoryHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.GetAppLogHistory)(context.Background(), messenger.Result{
 			Details:   details,
 			Arguments: []interface{}{map[string]interface{}{"containerName": "prod_1_logapp"}},
 		})
@@ -270,7 +270,7 @@ func TestUpdateSystemPrivilegeGate(t *testing.T) {
 		{
 			name: "getOSReleaseHandler",
 			call: func(ex *External) (*messenger.InvokeResult, error) {
-				return ex.getOSReleaseHandler(context.Background(), messenger.Result{
+				return ex.handler(topics.GetOSRelease)(context.Background(), messenger.Result{
 					Details: common.Dict{"caller_authid": "999"},
 				})
 			},
@@ -278,7 +278,7 @@ func TestUpdateSystemPrivilegeGate(t *testing.T) {
 		{
 			name: "downloadOSUpdateHandler",
 			call: func(ex *External) (*messenger.InvokeResult, error) {
-				return ex.downloadOSUpdateHandler(context.Background(), messenger.Result{
+				return ex.handler(topics.DownloadOSUpdate)(context.Background(), messenger.Result{
 					Details: common.Dict{"caller_authid": "999"},
 				})
 			},
@@ -286,7 +286,7 @@ func TestUpdateSystemPrivilegeGate(t *testing.T) {
 		{
 			name: "installOSUpdateHandler",
 			call: func(ex *External) (*messenger.InvokeResult, error) {
-				return ex.installOSUpdateHandler(context.Background(), messenger.Result{
+				return ex.handler(topics.InstallOSUpdate)(context.Background(), messenger.Result{
 					Details: common.Dict{"caller_authid": "999"},
 				})
 			},
@@ -336,19 +336,19 @@ func TestTerminalManagementPrivilegeGate(t *testing.T) {
 		{
 			name: "startTerminalSessHandler",
 			call: func(ex *External, r messenger.Result) (*messenger.InvokeResult, error) {
-				return ex.startTerminalSessHandler(context.Background(), r)
+				return ex.handler(topics.StartTerminalSession)(context.Background(), r)
 			},
 		},
 		{
 			name: "stopTerminalSession",
 			call: func(ex *External, r messenger.Result) (*messenger.InvokeResult, error) {
-				return ex.stopTerminalSession(context.Background(), r)
+				return ex.handler(topics.StopTerminalSession)(context.Background(), r)
 			},
 		},
 		{
 			name: "requestTerminalSessHandler",
 			call: func(ex *External, r messenger.Result) (*messenger.InvokeResult, error) {
-				return ex.requestTerminalSessHandler(context.Background(), r)
+				return ex.handler(topics.RequestTerminalSession)(context.Background(), r)
 			},
 		},
 	}
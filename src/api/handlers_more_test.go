@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"os"
@@ -64,6 +65,32 @@ func TestListContainersHandler(t *testing.T) {
 		assert.Equal(t, containers, got)
 	})
 
+	t.Run("adds the service states of the compose apps", func(t *testing.T) {
+		cont := mocks.NewContainer(t)
+		containers := []dockertypes.Container{
+			{ID: "abc123", Names: []string{"/app_one"}, State: "running"},
+			{
+				ID:     "def456",
+				Names:  []string{"/prod_7_stack_compose-db-1"},
+				Labels: map[string]string{"com.docker.compose.project": "prod_7_stack_compose", "com.docker.compose.service": "db"},
+				State:  "exited",
+				Status: "Exited (1) 3 seconds ago",
+			},
+		}
+		cont.EXPECT().GetContainers(mock.Anything).Return(containers, nil).Once()
+
+		ex := &External{Container: cont, Privilege: priv(t, true)}
+
+		res, err := ex.listContainersHandler(context.Background(), messenger.Result{
+			Details: systemDetails(),
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, map[string][]common.ServiceState{
+			"prod_7_stack_compose": {{Service: "db", Container: "prod_7_stack_compose-db-1", State: "exited", ExitCode: 1}},
+		}, res.ArgumentsKw["compose_services"])
+	})
+
 	t.Run("propagates container error", func(t *testing.T) {
 		cont := mocks.NewContainer(t)
 		cont.EXPECT().GetContainers(mock.Anything).Return(nil, errors.New("docker down")).Once()
@@ -84,7 +111,7 @@ func TestListContainersHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Container: cont, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.listContainersHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.ListContainers)(context.Background(), messenger.Result{
 			Details: details,
 		})
 
@@ -158,7 +185,7 @@ func TestGetImagesHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Container: cont, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.getImagesHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.GetImages)(context.Background(), messenger.Result{
 			Details: details,
 		})
 
@@ -175,7 +202,7 @@ func TestGetImagesHandler(t *testing.T) {
 func TestPruneImageHandler(t *testing.T) {
 	t.Run("all=true runs a full system prune and returns its output", func(t *testing.T) {
 		cont := mocks.NewContainer(t)
-		cont.EXPECT().PruneSystem().Return("reclaimed 1GB", nil).Once()
+		cont.EXPECT().PruneSystem(mock.Anything).Return("reclaimed 1GB", nil).Once()
 
 		ex := &External{Container: cont, Privilege: priv(t, true)}
 
@@ -224,7 +251,7 @@ func TestPruneImageHandler(t *testing.T) {
 
 	t.Run("propagates PruneSystem error", func(t *testing.T) {
 		cont := mocks.NewContainer(t)
-		cont.EXPECT().PruneSystem().Return("", errors.New("prune boom")).Once()
+		cont.EXPECT().PruneSystem(mock.Anything).Return("", errors.New("prune boom")).Once()
 
 		ex := &External{Container: cont, Privilege: priv(t, true)}
 
@@ -284,7 +311,7 @@ func TestPruneImageHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Container: cont, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.pruneImageHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.PruneImages)(context.Background(), messenger.Result{
 			Details:   details,
 			Arguments: []interface{}{map[string]interface{}{"all": true}},
 		})
@@ -302,6 +329,14 @@ func TestPruneImageHandler(t *testing.T) {
 // handler returns the base dict WITHOUT the version-comparison keys.
 // =============================================================================
 
+// endpointMessenger is a messenger that failed over to another endpoint.
+type endpointMessenger struct {
+	messenger.Messenger
+	endpoint string
+}
+
+func (m endpointMessenger) Endpoint() string { return m.endpoint }
+
 func TestGetAgentMetadataHandler(t *testing.T) {
 	t.Run("returns base metadata dict when privileged", func(t *testing.T) {
 		cfg := testConfig()
@@ -340,11 +375,29 @@ func TestGetAgentMetadataHandler(t *testing.T) {
 		assert.NotContains(t, dict, "latestAgentVersion")
 	})
 
+	t.Run("reports the device endpoint in use", func(t *testing.T) {
+		cfg := testConfig()
+		ex := &External{
+			Config:    cfg,
+			System:    newSystem(cfg),
+			Privilege: priv(t, true),
+			Messenger: endpointMessenger{Messenger: fakes.NewMessenger(), endpoint: "wss://backup.example.com/ws"},
+		}
+
+		res, err := ex.getAgentMetadataHandler(context.Background(), messenger.Result{
+			Details: systemDetails(),
+		})
+
+		require.NoError(t, err)
+		dict := res.Arguments[0].(common.Dict)
+		assert.Equal(t, "wss://backup.example.com/ws", dict["endpoint"])
+	})
+
 	t.Run("denies unprivileged caller", func(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.getAgentMetadataHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.GetAgentMetaData)(context.Background(), messenger.Result{
 			Details: details,
 		})
 
@@ -358,7 +411,7 @@ func TestGetAgentMetadataHandler(t *testing.T) {
 		m.SetCallError(string(topics.CheckPrivilege), errors.New("rpc boom"))
 		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.getAgentMetadataHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.GetAgentMetaData)(context.Background(), messenger.Result{
 			Details: common.Dict{"caller_authid": "999"},
 		})
 
@@ -441,6 +494,38 @@ func TestWriteToFileHandler(t *testing.T) {
 		assert.Equal(t, payload, got)
 	})
 
+	t.Run("writes binary data chunks to disk", func(t *testing.T) {
+		buildDir := t.TempDir()
+		ex, fs := newWriteEx(t, buildDir)
+
+		const containerName = "dev_101_binapp"
+		const fileName = "payload.bin"
+
+		require.NoError(t, fs.Write(filesystem.FileChunk{
+			ID:            "t2",
+			FileName:      fileName,
+			FilePath:      buildDir,
+			Data:          "BEGIN",
+			ContainerName: containerName,
+			Total:         6,
+		}))
+
+		// as bytes with a binary serialization, as NUL and base64 with JSON;
+		// the total may arrive as any integer type
+		for _, chunk := range []interface{}{[]byte{0x00, 0x01, 0x02}, "\x00" + base64.StdEncoding.EncodeToString([]byte{0x03, 0x04, 0x05})} {
+			res, err := ex.writeToFileHandler(context.Background(), messenger.Result{
+				Details:   systemDetails(),
+				Arguments: []interface{}{chunk, fileName, containerName, int64(6), "t2"},
+			})
+			require.NoError(t, err)
+			require.NotNil(t, res)
+		}
+
+		got, readErr := os.ReadFile(filepath.Join(buildDir, fileName))
+		require.NoError(t, readErr)
+		assert.Equal(t, []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, got)
+	})
+
 	t.Run("stale chunk ID is ignored and writes nothing", func(t *testing.T) {
 		// A chunk whose ID does not match the active transfer is silently
 		// dropped by Filesystem.Write (returns nil), and the handler reports
@@ -487,7 +572,7 @@ func TestWriteToFileHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.writeToFileHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.WriteToFile)(context.Background(), messenger.Result{
 			Details: details,
 			Arguments: []interface{}{
 				"BEGIN", "f", "c", uint64(0), "id",
@@ -511,6 +596,10 @@ func TestWriteToFileHandler(t *testing.T) {
 			name: "bad chunk type",
 			args: []interface{}{123, "f", "c", uint64(0), "id"},
 		},
+		{
+			name: "bad binary chunk",
+			args: []interface{}{"\x00not base64!", "f", "c", uint64(0), "id"},
+		},
 		{
 			name: "bad containerName type",
 			args: []interface{}{"BEGIN", "f", 123, uint64(0), "id"},
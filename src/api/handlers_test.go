@@ -180,7 +180,7 @@ func TestGetStorageDataHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.getStorageDataHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.GetStorageData)(context.Background(), messenger.Result{
 			Details: details,
 		})
 
@@ -194,7 +194,7 @@ func TestGetStorageDataHandler(t *testing.T) {
 		m.SetCallError(string(topics.CheckPrivilege), errors.New("rpc boom"))
 		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.getStorageDataHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.GetStorageData)(context.Background(), messenger.Result{
 			Details: common.Dict{"caller_authid": "999"},
 		})
 
@@ -284,7 +284,7 @@ func TestListEthernetDevices(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Network: net, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.listEthernetDevices(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.ListEthernetDevices)(context.Background(), messenger.Result{
 			Details: details,
 		})
 
@@ -362,7 +362,7 @@ func TestListWiFiNetworksHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Network: net, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.listWiFiNetworksHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.ListWiFiNetworks)(context.Background(), messenger.Result{
 			Details: details,
 		})
 
@@ -595,7 +595,7 @@ func TestRemoveWifiHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Network: net, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.removeWifiHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.RemoveWiFiConfiguration)(context.Background(), messenger.Result{
 			Details:   details,
 			Arguments: []interface{}{map[string]interface{}{"ssid": "x"}},
 		})
@@ -792,7 +792,7 @@ func TestUpdateIPConfigHandler(t *testing.T) {
 		{
 			name: "bad prefix type",
 			payload: map[string]interface{}{
-				"method": "manual", "mac": "m", "interfaceName": "i", "ipv4": "1.2.3.4", "prefix": "24",
+				"method": "manual", "mac": "m", "interfaceName": "i", "ipv4": "1.2.3.4", "prefix": "/24",
 			},
 		},
 	}
@@ -817,7 +817,7 @@ func TestUpdateIPConfigHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Network: net, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.updateIPConfigHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.UpdateIPv4Configuration)(context.Background(), messenger.Result{
 			Details: details,
 			Arguments: []interface{}{map[string]interface{}{
 				"method": "auto", "mac": "m", "interfaceName": "i",
@@ -830,6 +830,153 @@ func TestUpdateIPConfigHandler(t *testing.T) {
 	})
 }
 
+// =============================================================================
+// VPN handlers - listing without secrets, import parsing, uuid parsing
+// =============================================================================
+
+func TestListVPNConnectionsHandler(t *testing.T) {
+	t.Run("lists connections without secrets", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		net.EXPECT().ListVPNConnections().Return([]network.VPNConnection{
+			{UUID: "u-1", Name: "site", Type: network.VPNTypeWireGuard, Autoconnect: true, Active: true, State: "activated"},
+		}, nil).Once()
+
+		ex := &External{Network: net, Privilege: priv(t, true)}
+
+		res, err := ex.listVPNConnectionsHandler(context.Background(), messenger.Result{Details: systemDetails()})
+
+		require.NoError(t, err)
+		require.Len(t, res.Arguments, 1)
+
+		vpn := res.Arguments[0].(common.Dict)
+		assert.Equal(t, "u-1", vpn["uuid"])
+		assert.Equal(t, "wireguard", vpn["type"])
+		assert.Equal(t, "activated", vpn["state"])
+		assert.NotContains(t, vpn, "config")
+		assert.NotContains(t, vpn, "password")
+	})
+
+	t.Run("denies unprivileged caller", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		details, m := grantPrivilege(false)
+		ex := &External{Network: net, Privilege: newPrivilege(testConfig(), m)}
+
+		res, err := ex.handler(topics.ListVPNConnections)(context.Background(), messenger.Result{Details: details})
+
+		require.Error(t, err)
+		assert.Nil(t, res)
+		assert.True(t, errdefs.IsInsufficientPrivileges(err))
+	})
+}
+
+func TestImportVPNConnectionHandler(t *testing.T) {
+	t.Run("parses payload and imports", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		net.EXPECT().ImportVPNConnection(network.VPNConfiguration{
+			Name:     "site",
+			Type:     network.VPNTypeOpenVPN,
+			Config:   "client",
+			Username: "user",
+			Password: "secret",
+		}).Return(network.VPNConnection{UUID: "u-1", Name: "site", Type: network.VPNTypeOpenVPN, State: "inactive"}, nil).Once()
+
+		ex := &External{Network: net, Privilege: priv(t, true)}
+
+		res, err := ex.importVPNConnectionHandler(context.Background(), messenger.Result{
+			Details: systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{
+				"name": "site", "type": "openvpn", "config": "client", "username": "user", "password": "secret",
+			}},
+		})
+
+		require.NoError(t, err)
+		require.Len(t, res.Arguments, 1)
+		vpn := res.Arguments[0].(common.Dict)
+		assert.Equal(t, "u-1", vpn["uuid"])
+		assert.NotContains(t, vpn, "password")
+	})
+
+	parseErrCases := []struct {
+		name    string
+		payload interface{}
+	}{
+		{name: "non-dict arg", payload: 42},
+		{name: "missing name", payload: map[string]interface{}{"type": "wireguard", "config": "x"}},
+		{name: "bad type", payload: map[string]interface{}{"name": "n", "type": 1, "config": "x"}},
+		{name: "empty config", payload: map[string]interface{}{"name": "n", "type": "wireguard", "config": ""}},
+		{name: "bad password type", payload: map[string]interface{}{"name": "n", "type": "openvpn", "config": "x", "password": 1}},
+	}
+
+	for _, tc := range parseErrCases {
+		t.Run("rejects "+tc.name, func(t *testing.T) {
+			net := mocks.NewNetwork(t)
+			ex := &External{Network: net, Privilege: priv(t, true)}
+
+			res, err := ex.importVPNConnectionHandler(context.Background(), messenger.Result{
+				Details:   systemDetails(),
+				Arguments: []interface{}{tc.payload},
+			})
+
+			require.Error(t, err)
+			assert.Nil(t, res)
+		})
+	}
+}
+
+func TestVPNConnectionControlHandlers(t *testing.T) {
+	t.Run("activates by uuid", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		net.EXPECT().ActivateVPNConnection("u-1").Return(nil).Once()
+		ex := &External{Network: net, Privilege: priv(t, true)}
+
+		_, err := ex.activateVPNConnectionHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"uuid": "u-1"}},
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("deactivates by uuid", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		net.EXPECT().DeactivateVPNConnection("u-1").Return(nil).Once()
+		ex := &External{Network: net, Privilege: priv(t, true)}
+
+		_, err := ex.deactivateVPNConnectionHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"uuid": "u-1"}},
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("surfaces remove errors", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		net.EXPECT().RemoveVPNConnection("u-1").Return(errdefs.ErrNotFound).Once()
+		ex := &External{Network: net, Privilege: priv(t, true)}
+
+		_, err := ex.removeVPNConnectionHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{"uuid": "u-1"}},
+		})
+
+		assert.ErrorIs(t, err, errdefs.ErrNotFound)
+	})
+
+	t.Run("rejects missing uuid", func(t *testing.T) {
+		net := mocks.NewNetwork(t)
+		ex := &External{Network: net, Privilege: priv(t, true)}
+
+		res, err := ex.removeVPNConnectionHandler(context.Background(), messenger.Result{
+			Details:   systemDetails(),
+			Arguments: []interface{}{map[string]interface{}{}},
+		})
+
+		require.Error(t, err)
+		assert.Nil(t, res)
+	})
+}
+
 // priv builds a real Privilege wired to a fake messenger that answers the
 // check_privilege RPC with `granted`. A "system" caller short-circuits to
 // granted without an RPC, but tests pass systemDetails() for the happy path;
@@ -842,3 +989,112 @@ func priv(t *testing.T, granted bool) *privilege.Privilege {
 	}, nil)
 	return newPrivilege(testConfig(), m)
 }
+
+// =============================================================================
+// Numbers decoded by every WAMP serializer
+//
+// Which Go type a number arrives as depends on the serializer the session
+// negotiated: JSON and CBOR decode a non-negative integer to uint64, MessagePack
+// to uint64 or int64 depending on how the caller's encoder wrote it, and an
+// encoder that only knows doubles (JavaScript) sends a float64. Every handler
+// taking a number must accept all three.
+// =============================================================================
+
+var decodedNumbers = []struct {
+	name  string
+	value func(n uint64) interface{}
+}{
+	{name: "uint64", value: func(n uint64) interface{} { return n }},
+	{name: "int64", value: func(n uint64) interface{} { return int64(n) }},
+	{name: "float64", value: func(n uint64) interface{} { return float64(n) }},
+}
+
+func TestHandlersAcceptDecodedNumbers(t *testing.T) {
+	for _, number := range decodedNumbers {
+		t.Run("request_app_state keys as "+number.name, func(t *testing.T) {
+			payload, err := responseToTransitionPayload(testConfig(), messenger.Result{
+				ArgumentsKw: common.Dict{
+					"app_key":                  number.value(42),
+					"app_name":                 "test-app",
+					"stage":                    "PROD",
+					"target_state":             "RUNNING",
+					"release_key":              number.value(100),
+					"new_release_key":          number.value(101),
+					"requestor_account_key":    number.value(999),
+					"account_id":               number.value(998),
+					"device_owner_account_key": number.value(7),
+					"instance_key":             number.value(3),
+				},
+				Details: common.Dict{"caller_authid": "123"},
+			})
+
+			require.NoError(t, err)
+			assert.Equal(t, uint64(42), payload.AppKey)
+			assert.Equal(t, uint64(100), payload.ReleaseKey)
+			assert.Equal(t, uint64(101), payload.NewReleaseKey)
+			assert.Equal(t, uint64(999), payload.RequestorAccountKey)
+			assert.Equal(t, uint64(7), payload.DeviceOwnerAccountKey)
+			assert.Equal(t, uint64(3), payload.InstanceKey)
+		})
+
+		t.Run("wifi priority as "+number.name, func(t *testing.T) {
+			net := mocks.NewNetwork(t)
+			net.EXPECT().AddWiFi("", network.WiFiCredentials{Ssid: "N", Passwd: "p", Priority: 5}).Return(nil).Once()
+			ex := &External{Network: net, Privilege: priv(t, true)}
+
+			_, err := ex.addWiFiConfigurationHandler(context.Background(), messenger.Result{
+				Details: systemDetails(),
+				Arguments: []interface{}{map[string]interface{}{
+					"ssid": "N", "password": "p", "priority": number.value(5),
+				}},
+			})
+
+			require.NoError(t, err)
+		})
+
+		t.Run("ipv4 prefix as "+number.name, func(t *testing.T) {
+			net := mocks.NewNetwork(t)
+			net.EXPECT().SetIPv4Address("m", "i", "10.0.0.9", uint32(24)).Return(nil).Once()
+			ex := &External{Network: net, Privilege: priv(t, true)}
+
+			_, err := ex.updateIPConfigHandler(context.Background(), messenger.Result{
+				Details: systemDetails(),
+				Arguments: []interface{}{map[string]interface{}{
+					"method": "manual", "mac": "m", "interfaceName": "i", "ipv4": "10.0.0.9", "prefix": number.value(24),
+				}},
+			})
+
+			require.NoError(t, err)
+		})
+
+		t.Run("code execution timeout as "+number.name, func(t *testing.T) {
+			ex := &External{}
+
+			res, err := ex.codeExecutionHandler(context.Background(), messenger.Result{
+				Details: systemDetails(),
+				Arguments: []interface{}{map[string]interface{}{
+					"cmd": "true", "blocking": true, "timeout": number.value(500),
+				}},
+			})
+
+			require.NoError(t, err)
+			require.NotNil(t, res)
+		})
+	}
+
+	t.Run("a fractional or negative number is rejected", func(t *testing.T) {
+		for _, prefix := range []interface{}{float64(24.5), int64(-24)} {
+			net := mocks.NewNetwork(t)
+			ex := &External{Network: net, Privilege: priv(t, true)}
+
+			_, err := ex.updateIPConfigHandler(context.Background(), messenger.Result{
+				Details: systemDetails(),
+				Arguments: []interface{}{map[string]interface{}{
+					"method": "manual", "mac": "m", "interfaceName": "i", "ipv4": "10.0.0.9", "prefix": prefix,
+				}},
+			})
+
+			require.Error(t, err)
+		}
+	})
+}
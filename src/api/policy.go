@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reagent/errdefs"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"reagent/safe"
+	"sync"
+	"time"
+)
+
+// TopicPolicy declares what is enforced for a topic before its handler runs.
+// The zero value enforces nothing.
+type TopicPolicy struct {
+	// Privilege is the privilege the caller needs on the device.
+	Privilege string
+	// RateLimit bounds how often a single caller may invoke the topic.
+	RateLimit RateLimit
+	// MaxConcurrent bounds how many invocations run at once, across callers.
+	MaxConcurrent int
+	// Timeout bounds how long the caller waits for the handler. The handler's
+	// context is cancelled when it runs out.
+	Timeout time.Duration
+}
+
+// RateLimit allows Calls invocations per caller within Per, refilling evenly.
+type RateLimit struct {
+	Calls int
+	Per   time.Duration
+}
+
+// TopicHandler is an exposed topic's handler together with its policy.
+type TopicHandler struct {
+	Handler RegistrationHandler
+	Policy  TopicPolicy
+}
+
+// topicLimits is the state the policy of one topic keeps across invocations
+// (and across reconnects, which register the topics again).
+type topicLimits struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTopicLimits(policy TopicPolicy) *topicLimits {
+	limits := &topicLimits{buckets: make(map[string]*tokenBucket)}
+	if policy.MaxConcurrent > 0 {
+		limits.slots = make(chan struct{}, policy.MaxConcurrent)
+	}
+	return limits
+}
+
+// allow takes a token from caller's bucket, reporting whether there was one.
+// Buckets that have filled up again are dropped, so the map only holds the
+// callers that are actually being limited.
+func (limits *topicLimits) allow(caller string, rateLimit RateLimit, now time.Time) bool {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	capacity := float64(rateLimit.Calls)
+	refillPerSecond := capacity / rateLimit.Per.Seconds()
+
+	for key, bucket := range limits.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*refillPerSecond >= capacity {
+			delete(limits.buckets, key)
+		}
+	}
+
+	bucket, ok := limits.buckets[caller]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		limits.buckets[caller] = bucket
+	}
+
+	bucket.tokens = min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*refillPerSecond)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (ex *External) limitsFor(topic topics.Topic, policy TopicPolicy) *topicLimits {
+	limits, _ := ex.topicLimits.LoadOrStore(topic, newTopicLimits(policy))
+	return limits.(*topicLimits)
+}
+
+// enforce wraps handler in the checks its policy declares: per-caller rate
+// limit, privilege, concurrency and timeout, in that order, so a caller over
+// its limit costs no privilege check. It runs inside wrapDetails, so the
+// caller is the one wrapDetails resolved.
+func (ex *External) enforce(topic topics.Topic, topicHandler TopicHandler) RegistrationHandler {
+	policy := topicHandler.Policy
+	handler := topicHandler.Handler
+	limits := ex.limitsFor(topic, policy)
+
+	return func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+		caller := fmt.Sprint(response.Details["caller_authid"])
+
+		if policy.RateLimit.Calls > 0 && policy.RateLimit.Per > 0 && !limits.allow(caller, policy.RateLimit, time.Now()) {
+			return nil, errdefs.RateLimited(fmt.Errorf("%s may be called at most %d times per %s", topic, policy.RateLimit.Calls, policy.RateLimit.Per))
+		}
+
+		if policy.Privilege != "" {
+			privileged, err := ex.Privilege.Check(policy.Privilege, response.Details)
+			if err != nil {
+				// A failure to reach the privilege service is not a denial.
+				return nil, errdefs.PrivilegeCheckFailed(fmt.Errorf("could not verify privileges to call %s: %w", topic, err))
+			}
+
+			if !privileged {
+				return nil, errdefs.InsufficientPrivileges(fmt.Errorf("insufficient privileges to call %s, %s is required", topic, policy.Privilege))
+			}
+		}
+
+		if limits.slots != nil {
+			select {
+			case limits.slots <- struct{}{}:
+			default:
+				return nil, errdefs.ConcurrencyLimitReached(fmt.Errorf("%s is already running %d times, try again later", topic, policy.MaxConcurrent))
+			}
+		}
+		release := func() {
+			if limits.slots != nil {
+				<-limits.slots
+			}
+		}
+
+		if policy.Timeout <= 0 {
+			defer release()
+			return handler(ctx, response)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+
+		type outcome struct {
+			result *messenger.InvokeResult
+			err    error
+		}
+		done := make(chan outcome, 1)
+
+		// The handler keeps its concurrency slot until it actually returns,
+		// even if the caller stopped waiting for it.
+		safe.Go(func() {
+			defer release()
+			result, err := handler(ctx, response)
+			done <- outcome{result, err}
+		})
+
+		select {
+		case outcome := <-done:
+			return outcome.result, outcome.err
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, errdefs.TimedOut(fmt.Errorf("%s did not finish within %s", topic, policy.Timeout))
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
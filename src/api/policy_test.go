@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"reagent/common"
+	"reagent/errdefs"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"reagent/testutil/fakes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = topics.Topic("test.policy")
+
+func okHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	return &messenger.InvokeResult{}, nil
+}
+
+func TestEnforceRateLimit(t *testing.T) {
+	ex := &External{Privilege: priv(t, true)}
+	handler := ex.enforce(testTopic, TopicHandler{
+		Handler: okHandler,
+		Policy:  TopicPolicy{RateLimit: RateLimit{Calls: 2, Per: time.Hour}},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := handler(context.Background(), messenger.Result{Details: common.Dict{"caller_authid": "1"}})
+		require.NoError(t, err)
+	}
+
+	_, err := handler(context.Background(), messenger.Result{Details: common.Dict{"caller_authid": "1"}})
+	assert.True(t, errdefs.IsRateLimited(err))
+
+	// The limit is per caller.
+	_, err = handler(context.Background(), messenger.Result{Details: common.Dict{"caller_authid": "2"}})
+	assert.NoError(t, err)
+}
+
+func TestTopicLimitsAllowRefills(t *testing.T) {
+	limits := newTopicLimits(TopicPolicy{})
+	rateLimit := RateLimit{Calls: 2, Per: time.Minute}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.True(t, limits.allow("a", rateLimit, now))
+	assert.True(t, limits.allow("a", rateLimit, now))
+	assert.False(t, limits.allow("a", rateLimit, now))
+
+	// One token comes back every 30 seconds.
+	assert.False(t, limits.allow("a", rateLimit, now.Add(20*time.Second)))
+	assert.True(t, limits.allow("a", rateLimit, now.Add(31*time.Second)))
+
+	// Once a caller's bucket is full again it is forgotten.
+	limits.allow("b", rateLimit, now.Add(2*time.Minute))
+	assert.NotContains(t, limits.buckets, "a")
+}
+
+func TestEnforceRateLimitBeforePrivilege(t *testing.T) {
+	details, m := grantPrivilege(false)
+	ex := &External{Privilege: newPrivilege(testConfig(), m)}
+	handler := ex.enforce(testTopic, TopicHandler{
+		Handler: okHandler,
+		Policy:  TopicPolicy{Privilege: "READ", RateLimit: RateLimit{Calls: 1, Per: time.Hour}},
+	})
+
+	_, err := handler(context.Background(), messenger.Result{Details: details})
+	assert.True(t, errdefs.IsInsufficientPrivileges(err))
+
+	_, err = handler(context.Background(), messenger.Result{Details: details})
+	assert.True(t, errdefs.IsRateLimited(err))
+	assert.Equal(t, 1, m.GetCallCount())
+}
+
+func TestEnforcePrivilege(t *testing.T) {
+	t.Run("denies the caller", func(t *testing.T) {
+		details, m := grantPrivilege(false)
+		ex := &External{Privilege: newPrivilege(testConfig(), m)}
+		handler := ex.enforce(testTopic, TopicHandler{Handler: okHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}})
+
+		res, err := handler(context.Background(), messenger.Result{Details: details})
+
+		assert.Nil(t, res)
+		assert.True(t, errdefs.IsInsufficientPrivileges(err))
+		assert.Contains(t, err.Error(), "MAINTAIN is required")
+	})
+
+	t.Run("a failed lookup is not a denial", func(t *testing.T) {
+		m := fakes.NewMessenger()
+		m.SetCallError(string(topics.CheckPrivilege), errors.New("rpc boom"))
+		ex := &External{Privilege: newPrivilege(testConfig(), m)}
+		handler := ex.enforce(testTopic, TopicHandler{Handler: okHandler, Policy: TopicPolicy{Privilege: "MAINTAIN"}})
+
+		_, err := handler(context.Background(), messenger.Result{Details: common.Dict{"caller_authid": "999"}})
+
+		require.Error(t, err)
+		assert.False(t, errdefs.IsInsufficientPrivileges(err))
+		assert.True(t, errdefs.IsPrivilegeCheckFailed(err))
+	})
+}
+
+func TestEnforceMaxConcurrent(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ex := &External{}
+	handler := ex.enforce(testTopic, TopicHandler{
+		Handler: func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+			started <- struct{}{}
+			<-release
+			return &messenger.InvokeResult{}, nil
+		},
+		Policy: TopicPolicy{MaxConcurrent: 1},
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := handler(context.Background(), messenger.Result{Details: systemDetails()})
+		done <- err
+	}()
+	<-started
+
+	_, err := handler(context.Background(), messenger.Result{Details: systemDetails()})
+	assert.True(t, errdefs.IsConcurrencyLimitReached(err))
+
+	close(release)
+	require.NoError(t, <-done)
+
+	go func() { <-started }()
+	_, err = handler(context.Background(), messenger.Result{Details: systemDetails()})
+	assert.NoError(t, err)
+}
+
+func TestEnforceTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	ex := &External{}
+	handler := ex.enforce(testTopic, TopicHandler{
+		Handler: func(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+			// Ignores its context, so it outlives the caller's wait.
+			<-release
+			return &messenger.InvokeResult{}, nil
+		},
+		Policy: TopicPolicy{MaxConcurrent: 1, Timeout: 20 * time.Millisecond},
+	})
+
+	_, err := handler(context.Background(), messenger.Result{Details: systemDetails()})
+	assert.True(t, errdefs.IsTimedOut(err))
+
+	// The timed out handler still holds its slot.
+	_, err = handler(context.Background(), messenger.Result{Details: systemDetails()})
+	assert.True(t, errdefs.IsConcurrencyLimitReached(err))
+}
+
+func TestTopicHandlerMapPrivileges(t *testing.T) {
+	details, m := grantPrivilege(false)
+	ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
+
+	for topic, topicHandler := range ex.getTopicHandlerMap() {
+		if topicHandler.Policy.Privilege == "" {
+			continue
+		}
+
+		t.Run(string(topic), func(t *testing.T) {
+			res, err := ex.handler(topic)(context.Background(), messenger.Result{Details: common.Dict{"caller_authid": details["caller_authid"]}})
+
+			assert.Nil(t, res)
+			assert.True(t, errdefs.IsInsufficientPrivileges(err))
+		})
+	}
+}
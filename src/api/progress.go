@@ -0,0 +1,21 @@
+package api
+
+import (
+	"context"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// reportProgress sends progress of a long-running call as a progressive
+// result to its caller and, for callers that predate progressive results,
+// publishes it to topic as well.
+func (ex *External) reportProgress(ctx context.Context, topic string, progress common.Dict) {
+	ex.LogMessenger.Publish(topics.Topic(topic), []interface{}{progress}, nil, nil)
+
+	if err := messenger.SendProgress(ctx, []interface{}{progress}, nil); err != nil {
+		log.Debug().Err(err).Msgf("failed to send progress to the caller of %s", topic)
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/testutil/fakes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportProgress(t *testing.T) {
+	logMessenger := fakes.NewMessenger()
+	ex := &External{LogMessenger: logMessenger}
+	progress := common.Dict{"currentBytes": 10, "fileSize": 100}
+
+	var sent [][]interface{}
+	ctx := messenger.WithProgress(context.Background(), func(args []interface{}, kwargs common.Dict) error {
+		sent = append(sent, args)
+		return nil
+	})
+
+	ex.reportProgress(ctx, "re.mgmt.serial.download_os_update_progress", progress)
+
+	assert.Equal(t, [][]interface{}{{progress}}, sent, "the caller gets a progressive result")
+	publishes := logMessenger.GetPublishCalls()
+	require.Len(t, publishes, 1, "the progress topic still gets it")
+	assert.Equal(t, "re.mgmt.serial.download_os_update_progress", string(publishes[0].Topic))
+	assert.Equal(t, []interface{}{progress}, publishes[0].Args)
+}
@@ -7,20 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/messenger"
 )
 
 func (ex *External) pruneImageHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("MAINTAIN", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to prune images"))
-	}
-
 	args := response.Arguments
 	options := common.Dict{}
 
@@ -40,7 +30,7 @@ func (ex *External) pruneImageHandler(ctx context.Context, response messenger.Re
 		}
 
 		if all {
-			output, err := ex.Container.PruneSystem()
+			output, err := ex.Container.PruneSystem(ctx)
 			if err != nil {
 				return nil, err
 			}
@@ -49,7 +39,7 @@ func (ex *External) pruneImageHandler(ctx context.Context, response messenger.Re
 		}
 	}
 
-	_, err = ex.Container.PruneDanglingImages(ctx)
+	_, err := ex.Container.PruneDanglingImages(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/persistence"
+	"strings"
+	"time"
+)
+
+// queryAuditLogHandler returns the recorded remote operations, newest first.
+// Every argument is optional: since/until (RFC3339 or a relative duration like
+// the log queries), topic, requestor_account_key, outcome and limit. With
+// format "jsonl" it returns the log as JSON lines instead, oldest first, for
+// the caller to archive. That is a page at a time: the entries after the entry
+// ID given as after, up to limit, and the ID the next page starts after.
+func (ex *External) queryAuditLogHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	argsDict := map[string]interface{}{}
+	if len(response.Arguments) > 0 && response.Arguments[0] != nil {
+		if parsed, ok := response.Arguments[0].(map[string]interface{}); ok {
+			argsDict = parsed
+		} else {
+			return nil, fmt.Errorf("first param should be a dict")
+		}
+	}
+
+	if format, _ := argsDict["format"].(string); format == "jsonl" {
+		return ex.exportAuditLog(argsDict)
+	}
+
+	var err error
+	now := time.Now().UTC()
+	query := persistence.AuditQuery{}
+
+	if query.Since, err = optionalLogTime(argsDict, "since", now); err != nil {
+		return nil, err
+	}
+	if query.Until, err = optionalLogTime(argsDict, "until", now); err != nil {
+		return nil, err
+	}
+	if query.RequestorAccountKey, err = optionalUint64(argsDict, "requestor_account_key"); err != nil {
+		return nil, err
+	}
+
+	limit, err := optionalUint64(argsDict, "limit")
+	if err != nil {
+		return nil, err
+	}
+	query.Limit = int(min(limit, persistence.MaxAuditEntries))
+
+	if raw := argsDict["topic"]; raw != nil {
+		topic, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("the topic param should be a string")
+		}
+		query.Topic = topic
+	}
+
+	if raw := argsDict["outcome"]; raw != nil {
+		outcome, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("the outcome param should be a string")
+		}
+		query.Outcome = persistence.AuditOutcome(strings.ToUpper(outcome))
+	}
+
+	entries, err := ex.AuditLog.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := common.Dict{
+		"entries":     entries,
+		"returned":    len(entries),
+		"device_time": now.Format(time.RFC3339),
+	}
+
+	return &messenger.InvokeResult{Arguments: []interface{}{payload}}, nil
+}
+
+func (ex *External) exportAuditLog(argsDict map[string]interface{}) (*messenger.InvokeResult, error) {
+	after, err := optionalUint64(argsDict, "after")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := optionalUint64(argsDict, "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	var export bytes.Buffer
+	lastID, more, err := ex.AuditLog.Export(&export, persistence.AuditExport{
+		AfterID: int64(min(after, math.MaxInt64)),
+		Limit:   int(min(limit, persistence.MaxAuditExportEntries)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := common.Dict{
+		"jsonl": export.String(),
+		"after": lastID,
+		"more":  more,
+	}
+
+	return &messenger.InvokeResult{Arguments: []interface{}{payload}}, nil
+}
@@ -2,10 +2,8 @@ package api
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/logging"
 	"reagent/messenger"
 	"time"
@@ -20,22 +18,12 @@ import (
 // no app at all, and folding it into an app-addressed call would force a
 // container name onto a question that has none.
 //
-// It reads a bounded tail rather than the whole file, and checks the READ
-// privilege first. Both matter: reagent.log is capped at 100 MB with two
+// It reads a bounded tail rather than the whole file, and its topic policy
+// requires the READ privilege. Both matter: reagent.log is capped at 100 MB with two
 // backups (logging.SetupLogger), and nothing between the device and a browser
 // streams — a large result is fully buffered at every hop — so returning the
 // file whole was never safe.
 func (ex *External) queryDeviceLogsHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		// Not a denial — see queryAppLogsHandler.
-		return nil, fmt.Errorf("could not verify privileges: %w", err)
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to query device logs"))
-	}
-
 	// Every argument is optional: "show me what this device has been doing" is a
 	// complete question, so an empty argument list is valid.
 	argsDict := map[string]interface{}{}
@@ -47,6 +35,7 @@ func (ex *External) queryDeviceLogsHandler(ctx context.Context, response messeng
 		}
 	}
 
+	var err error
 	now := time.Now().UTC()
 
 	query := logging.AgentLogQuery{
@@ -172,7 +172,7 @@ func TestQueryAppLogsHandler(t *testing.T) {
 		cont := mocks.NewContainer(t)
 		ex := &External{LogManager: nil, Container: cont, Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.queryAppLogsHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.QueryAppLogs)(context.Background(), messenger.Result{
 			Details:   details,
 			Arguments: []interface{}{map[string]interface{}{"containerName": "prod_1_logapp"}},
 		})
@@ -271,7 +271,7 @@ func TestQueryDeviceLogsHandler(t *testing.T) {
 		details, m := grantPrivilege(false)
 		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.queryDeviceLogsHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.QueryDeviceLogs)(context.Background(), messenger.Result{
 			Details:   details,
 			Arguments: nil,
 		})
@@ -289,7 +289,7 @@ func TestQueryDeviceLogsHandler(t *testing.T) {
 		m.SetCallResponse(string(topics.CheckPrivilege), messenger.Result{}, errors.New("no route to the router"))
 		ex := &External{Config: testConfig(), Privilege: newPrivilege(testConfig(), m)}
 
-		res, err := ex.queryDeviceLogsHandler(context.Background(), messenger.Result{
+		res, err := ex.handler(topics.QueryDeviceLogs)(context.Background(), messenger.Result{
 			Details:   details,
 			Arguments: nil,
 		})
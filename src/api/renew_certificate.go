@@ -0,0 +1,31 @@
+package api
+
+import (
+	"context"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/safe"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func (ex *External) renewDeviceCertificateHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	notAfter, err := ex.System.RenewDeviceCertificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reconnect with the new certificate once the result is on its way, which
+	// also proves the endpoint accepts it.
+	safe.Go(func() {
+		time.Sleep(time.Second * 2)
+
+		log.Info().Msg("Reconnecting with the renewed device certificate")
+		ex.Messenger.Reconnect()
+	})
+
+	return &messenger.InvokeResult{
+		Arguments: []interface{}{common.Dict{"expires_at": notAfter.UTC().Format(time.RFC3339)}},
+	}, nil
+}
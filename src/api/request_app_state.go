@@ -8,7 +8,6 @@ import (
 	"reagent/errdefs"
 	"reagent/messenger"
 	"reagent/safe"
-	"strconv"
 
 	"github.com/rs/zerolog/log"
 )
@@ -67,6 +66,7 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	dockerCredentialsKw := kwargs["docker_credentials"]
 	instanceKeyKw := kwargs["instance_key"]
 	appCredEpochKw := kwargs["app_cred_epoch"]
+	buildKw := kwargs["build"]
 
 	var appKey uint64
 	var releaseKey uint64
@@ -94,10 +94,11 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	var dockerCompose map[string]interface{}
 	var newDockerCompose map[string]interface{}
 	var dockerCredentials map[string]common.DockerCredential
+	var build common.BuildSettings
 
 	// TODO: can be simplified with parser function, but unneccessary
 	if appKeyKw != nil {
-		appKey, ok = appKeyKw.(uint64)
+		appKey, ok = common.ToUint64(appKeyKw)
 		if !ok {
 			return common.TransitionPayload{}, fmt.Errorf("%w app_key", errdefs.ErrFailedToParse)
 		}
@@ -155,34 +156,16 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	}
 
 	if requestorAccountKeyKw != nil {
-		requestorAccountKey, ok = requestorAccountKeyKw.(uint64)
+		requestorAccountKey, ok = common.ToUint64(requestorAccountKeyKw)
 		if !ok {
-			requestorAccountKeyString, ok := requestorAccountKeyKw.(string)
-			if !ok {
-				return common.TransitionPayload{}, fmt.Errorf("%w requestorAccountKey", errdefs.ErrFailedToParse)
-			}
-
-			value, err := strconv.Atoi(requestorAccountKeyString)
-			if err != nil {
-				return common.TransitionPayload{}, err
-			}
-			requestorAccountKey = uint64(value)
+			return common.TransitionPayload{}, fmt.Errorf("%w requestorAccountKey", errdefs.ErrFailedToParse)
 		}
 	}
 
 	if requestorAccountKeyKw2 != nil {
-		requestorAccountKey2, ok = requestorAccountKeyKw2.(uint64)
+		requestorAccountKey2, ok = common.ToUint64(requestorAccountKeyKw2)
 		if !ok {
-			requestorAccountKeyString2, ok := requestorAccountKeyKw2.(string)
-			if !ok {
-				return common.TransitionPayload{}, fmt.Errorf("%w requestorAccountKey2", errdefs.ErrFailedToParse)
-			}
-
-			value, err := strconv.Atoi(requestorAccountKeyString2)
-			if err != nil {
-				return common.TransitionPayload{}, err
-			}
-			requestorAccountKey2 = uint64(value)
+			return common.TransitionPayload{}, fmt.Errorf("%w requestorAccountKey2", errdefs.ErrFailedToParse)
 		}
 	}
 
@@ -192,18 +175,9 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	// app owner (determine_registry_access in auth.ts requires app.account_key
 	// to match the JWT caller).
 	if deviceOwnerAccountKeyKw != nil {
-		deviceOwnerAccountKey, ok = deviceOwnerAccountKeyKw.(uint64)
+		deviceOwnerAccountKey, ok = common.ToUint64(deviceOwnerAccountKeyKw)
 		if !ok {
-			deviceOwnerAccountKeyString, ok := deviceOwnerAccountKeyKw.(string)
-			if !ok {
-				return common.TransitionPayload{}, fmt.Errorf("%w deviceOwnerAccountKey", errdefs.ErrFailedToParse)
-			}
-
-			value, err := strconv.Atoi(deviceOwnerAccountKeyString)
-			if err != nil {
-				return common.TransitionPayload{}, err
-			}
-			deviceOwnerAccountKey = uint64(value)
+			return common.TransitionPayload{}, fmt.Errorf("%w deviceOwnerAccountKey", errdefs.ErrFailedToParse)
 		}
 	}
 
@@ -211,14 +185,8 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	// a value the agent cannot parse must not block app syncs — apps then just
 	// miss the INSTANCE_KEY env until the next valid sync.
 	if instanceKeyKw != nil {
-		instanceKey, ok = instanceKeyKw.(uint64)
-		if !ok {
-			if instanceKeyString, isString := instanceKeyKw.(string); isString {
-				parsedInstanceKey, err := strconv.ParseUint(instanceKeyString, 10, 64)
-				if err == nil {
-					instanceKey = parsedInstanceKey
-				}
-			}
+		if parsed, parsedOk := common.ToUint64(instanceKeyKw); parsedOk {
+			instanceKey = parsed
 		}
 	}
 
@@ -234,25 +202,16 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	}
 
 	if releaseKeyKw != nil {
-		releaseKey, ok = releaseKeyKw.(uint64)
+		// due to a bug the release key can be stored as string, which
+		// ToUint64 accepts as well
+		releaseKey, ok = common.ToUint64(releaseKeyKw)
 		if !ok {
-			releaseKeyString, ok := releaseKeyKw.(string)
-			if !ok {
-				return common.TransitionPayload{}, fmt.Errorf("%w releaseKeyString", errdefs.ErrFailedToParse)
-			}
-
-			// due to a bug the release key can be stored as string...
-			parsedReleaseKey, err := strconv.ParseUint(releaseKeyString, 10, 64)
-			if err != nil {
-				return common.TransitionPayload{}, err
-			}
-
-			releaseKey = parsedReleaseKey
+			return common.TransitionPayload{}, fmt.Errorf("%w releaseKey", errdefs.ErrFailedToParse)
 		}
 	}
 
 	if newReleaseKeyKw != nil {
-		newReleaseKey, ok = newReleaseKeyKw.(uint64)
+		newReleaseKey, ok = common.ToUint64(newReleaseKeyKw)
 		if !ok {
 			return common.TransitionPayload{}, fmt.Errorf("%w newReleaseKey", errdefs.ErrFailedToParse)
 		}
@@ -362,6 +321,14 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 		}
 	}
 
+	if buildKw != nil {
+		var err error
+		build, err = parseBuildSettings(buildKw)
+		if err != nil {
+			return common.TransitionPayload{}, err
+		}
+	}
+
 	// callerAuthIDString := details["caller_authid"]
 
 	// callerAuthID, err := strconv.Atoi(callerAuthIDString.(string))
@@ -413,7 +380,68 @@ func responseToTransitionPayload(config *config.Config, result messenger.Result)
 	payload.CancelTransition = cancelTransition
 
 	payload.DockerCredentials = dockerCredentials
+	payload.Build = build
 
 	// registryToken is added before we transition state and is not part of the response payload
 	return payload, nil
 }
+
+// parseBuildSettings parses the "build" keyword argument:
+// {"target": "runtime", "platforms": ["linux/amd64", "linux/arm64"],
+// "secrets": ["NPM_TOKEN"], "cache": true}, every key optional.
+func parseBuildSettings(buildKw interface{}) (common.BuildSettings, error) {
+	buildMap, ok := buildKw.(map[string]interface{})
+	if !ok {
+		return common.BuildSettings{}, fmt.Errorf("%w build", errdefs.ErrFailedToParse)
+	}
+
+	var build common.BuildSettings
+	if targetKw := buildMap["target"]; targetKw != nil {
+		build.Target, ok = targetKw.(string)
+		if !ok {
+			return common.BuildSettings{}, fmt.Errorf("%w build target", errdefs.ErrFailedToParse)
+		}
+	}
+
+	if cacheKw := buildMap["cache"]; cacheKw != nil {
+		build.Cache, ok = cacheKw.(bool)
+		if !ok {
+			return common.BuildSettings{}, fmt.Errorf("%w build cache", errdefs.ErrFailedToParse)
+		}
+	}
+
+	var err error
+	build.Platforms, err = parseStringList(buildMap["platforms"], "build platforms")
+	if err != nil {
+		return common.BuildSettings{}, err
+	}
+
+	build.Secrets, err = parseStringList(buildMap["secrets"], "build secrets")
+	if err != nil {
+		return common.BuildSettings{}, err
+	}
+
+	return build, nil
+}
+
+func parseStringList(listKw interface{}, name string) ([]string, error) {
+	if listKw == nil {
+		return nil, nil
+	}
+
+	list, ok := listKw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errdefs.ErrFailedToParse, name)
+	}
+
+	values := make([]string, 0, len(list))
+	for _, entry := range list {
+		value, ok := entry.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w %s", errdefs.ErrFailedToParse, name)
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
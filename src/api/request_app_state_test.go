@@ -266,6 +266,26 @@ func TestResponseToTransitionPayload(t *testing.T) {
 		assert.Equal(t, "user2", payload.DockerCredentials["registry2.com"].Username)
 		assert.Equal(t, "pass2", payload.DockerCredentials["registry2.com"].Password)
 	})
+
+	t.Run("parses build settings", func(t *testing.T) {
+		response := createBasicWAMPResponse(42, "my-app", "DEV", "BUILT")
+		response.ArgumentsKw["build"] = map[string]interface{}{
+			"target":    "runtime",
+			"platforms": []interface{}{"linux/amd64", "linux/arm64"},
+			"secrets":   []interface{}{"NPM_TOKEN"},
+			"cache":     true,
+		}
+
+		payload, err := responseToTransitionPayload(cfg, response)
+
+		require.NoError(t, err)
+		assert.Equal(t, common.BuildSettings{
+			Target:    "runtime",
+			Platforms: []string{"linux/amd64", "linux/arm64"},
+			Secrets:   []string{"NPM_TOKEN"},
+			Cache:     true,
+		}, payload.Build)
+	})
 }
 
 // =============================================================================
@@ -455,6 +475,24 @@ func TestResponseToTransitionPayload_Errors(t *testing.T) {
 		assert.Contains(t, err.Error(), "docker compose")
 	})
 
+	t.Run("returns error for invalid build settings", func(t *testing.T) {
+		for _, build := range []interface{}{
+			"runtime",
+			map[string]interface{}{"target": 1},
+			map[string]interface{}{"platforms": "linux/amd64"},
+			map[string]interface{}{"secrets": []interface{}{1}},
+			map[string]interface{}{"cache": "yes"},
+		} {
+			response := createBasicWAMPResponse(42, "my-app", "DEV", "BUILT")
+			response.ArgumentsKw["build"] = build
+
+			_, err := responseToTransitionPayload(cfg, response)
+
+			require.Error(t, err, "%v", build)
+			assert.Contains(t, err.Error(), "build")
+		}
+	})
+
 	t.Run("returns error for invalid docker_credentials structure", func(t *testing.T) {
 		response := messenger.Result{
 			ArgumentsKw: common.Dict{
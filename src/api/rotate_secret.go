@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reagent/messenger"
+	"reagent/safe"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func (ex *External) rotateDeviceSecretHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	if len(response.Arguments) == 0 {
+		return nil, errors.New("failed to parse args, payload is missing")
+	}
+
+	payload, ok := response.Arguments[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("failed to parse payload")
+	}
+
+	encryptedSecret, ok := payload["encrypted_secret"].(string)
+	if !ok {
+		return nil, errors.New("failed to parse encrypted_secret parameter")
+	}
+
+	err := ex.System.RotateDeviceSecret(encryptedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate the device secret: %w", err)
+	}
+
+	// Reconnect with the new secret once the result is on its way; the
+	// outcome is confirmed to the backend from the new session.
+	safe.Go(func() {
+		time.Sleep(time.Second * 2)
+
+		log.Info().Msg("Reconnecting with the rotated device secret")
+		ex.Messenger.Reconnect()
+	})
+
+	return &messenger.InvokeResult{}, nil
+}
@@ -4,20 +4,10 @@ import (
 	"context"
 	"errors"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/messenger"
 )
 
 func (ex *External) startTerminalSessHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("DEVELOP", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to start a terminal session"))
-	}
-
 	if response.Arguments == nil {
 		return nil, errors.New("failed to parse args, payload is missing")
 	}
@@ -36,12 +26,12 @@ func (ex *External) startTerminalSessHandler(ctx context.Context, response messe
 	}
 
 	registrationIDKw := payload["registrationID"]
-	registrationID, ok := registrationIDKw.(uint64)
+	registrationID, ok := common.ToUint64(registrationIDKw)
 	if !ok {
 		return nil, errors.New("failed to parse registrationID")
 	}
 
-	err = ex.TerminalManager.StartTerminalSession(sessionID, registrationID)
+	err := ex.TerminalManager.StartTerminalSession(sessionID, registrationID)
 	if err != nil {
 		return nil, err
 	}
@@ -50,15 +40,6 @@ func (ex *External) startTerminalSessHandler(ctx context.Context, response messe
 }
 
 func (ex *External) stopTerminalSession(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("DEVELOP", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to start a terminal session"))
-	}
-
 	if response.Arguments == nil {
 		return nil, errors.New("failed to parse args, payload is missing")
 	}
@@ -76,7 +57,7 @@ func (ex *External) stopTerminalSession(ctx context.Context, response messenger.
 		return nil, errors.New("failed to parse sessionID")
 	}
 
-	err = ex.TerminalManager.StopTerminalSession(sessionID)
+	err := ex.TerminalManager.StopTerminalSession(sessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -85,15 +66,6 @@ func (ex *External) stopTerminalSession(ctx context.Context, response messenger.
 }
 
 func (ex *External) requestTerminalSessHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("DEVELOP", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to start a terminal session"))
-	}
-
 	if response.Arguments == nil {
 		return nil, errors.New("no args found")
 	}
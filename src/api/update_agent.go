@@ -2,24 +2,13 @@ package api
 
 import (
 	"context"
-	"errors"
 	"reagent/common"
 	"reagent/errdefs"
 	"reagent/filesystem"
 	"reagent/messenger"
-	"reagent/messenger/topics"
 )
 
 func (ex *External) updateReagent(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("MAINTAIN", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to update reagent"))
-	}
-
 	// reswarmModeEnabled, _ := filesystem.PathExists("/opt/reagent/reswarm-mode")
 	// if !reswarmModeEnabled {
 	// 	return nil, errors.New("cannot update on non reswarm-mode enabled system")
@@ -32,12 +21,10 @@ func (ex *External) updateReagent(ctx context.Context, response messenger.Result
 			"fileSize":     downloadProgress.TotalFileSize,
 		}
 
-		serialNumber := ex.Config.ReswarmConfig.SerialNumber
-		topic := common.BuildAgentUpdateProgress(serialNumber)
-		ex.LogMessenger.Publish(topics.Topic(topic), []interface{}{progress}, nil, nil)
+		ex.reportProgress(ctx, common.BuildAgentUpdateProgress(ex.Config.ReswarmConfig.SerialNumber), progress)
 	}
 
-	updateResult, err := ex.System.UpdateSystem(progressCallback, true)
+	updateResult, err := ex.System.UpdateSystem(ctx, progressCallback, true)
 	if err != nil {
 		if !errdefs.IsInProgress(err) {
 			return nil, err
@@ -2,28 +2,16 @@ package api
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/filesystem"
 	"reagent/messenger"
-	"reagent/messenger/topics"
 	"reagent/system"
 	"strings"
 )
 
 func (ex *External) getOSReleaseHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to get os release data"))
-	}
-
 	// current release information
 	osReleaseCurrent, err := system.GetOSReleaseCurrent()
 	if err != nil {
@@ -86,15 +74,6 @@ func (ex *External) getOSReleaseHandler(ctx context.Context, response messenger.
 }
 
 func (ex *External) downloadOSUpdateHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("MAINTAIN", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to update reswarmos"))
-	}
-
 	// prepare callback monitoring progress of download
 	progressCallback := func(dp filesystem.DownloadProgress) {
 		progress := common.Dict{
@@ -103,13 +82,11 @@ func (ex *External) downloadOSUpdateHandler(ctx context.Context, response messen
 			"fileSize":     dp.TotalFileSize,
 		}
 
-		serialNumber := ex.Config.ReswarmConfig.SerialNumber
-		topic := common.BuildDownloadOSUpdateProgress(serialNumber)
-		ex.LogMessenger.Publish(topics.Topic(topic), []interface{}{progress}, nil, nil)
+		ex.reportProgress(ctx, common.BuildDownloadOSUpdateProgress(ex.Config.ReswarmConfig.SerialNumber), progress)
 	}
 
-	// start downloading...
-	err = system.GetOSUpdate(progressCallback)
+	// start downloading, cancelling the call aborts the download
+	err := system.GetOSUpdate(ctx, progressCallback)
 	if err != nil {
 		return nil, err
 	}
@@ -118,15 +95,6 @@ func (ex *External) downloadOSUpdateHandler(ctx context.Context, response messen
 }
 
 func (ex *External) installOSUpdateHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("MAINTAIN", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to update reswarmos"))
-	}
-
 	// prepare callback monitoring progress of OS installation
 	progressCallback := func(operationName string, progressPercent uint64) {
 		progress := common.Dict{
@@ -134,13 +102,11 @@ func (ex *External) installOSUpdateHandler(ctx context.Context, response messeng
 			"progressPercent": progressPercent,
 		}
 
-		serialNumber := ex.Config.ReswarmConfig.SerialNumber
-		topic := common.BuildInstallOSUpdateProgress(serialNumber)
-		ex.LogMessenger.Publish(topics.Topic(topic), []interface{}{progress}, nil, nil)
+		ex.reportProgress(ctx, common.BuildInstallOSUpdateProgress(ex.Config.ReswarmConfig.SerialNumber), progress)
 	}
 
-	// start installing OS bundle...
-	err = system.InstallOSUpdate(progressCallback)
+	// start installing OS bundle, which RAUC cannot abort once started...
+	err := system.InstallOSUpdate(progressCallback)
 	if err != nil {
 		return nil, err
 	}
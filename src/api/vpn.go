@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/network"
+)
+
+func vpnConnectionToDict(vpn network.VPNConnection) common.Dict {
+	// never add key material or passwords here, this is sent to the backend as is
+	return common.Dict{
+		"uuid":        vpn.UUID,
+		"name":        vpn.Name,
+		"type":        string(vpn.Type),
+		"autoconnect": vpn.Autoconnect,
+		"active":      vpn.Active,
+		"state":       vpn.State,
+		"banner":      vpn.Banner,
+	}
+}
+
+func (ex *External) listVPNConnectionsHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	vpnConnections, err := ex.Network.ListVPNConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	vpnList := make([]interface{}, len(vpnConnections))
+	for i, vpn := range vpnConnections {
+		vpnList[i] = vpnConnectionToDict(vpn)
+	}
+
+	return &messenger.InvokeResult{Arguments: vpnList}, nil
+}
+
+func (ex *External) importVPNConnectionHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	payload := response.Arguments
+	if len(payload) == 0 {
+		return nil, errors.New("args for import vpn connection is empty")
+	}
+
+	vpnDict, ok := payload[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("argument 1 of args is not a dictionary type")
+	}
+
+	name, ok := vpnDict["name"].(string)
+	if !ok || name == "" {
+		return nil, errors.New("failed to parse name, invalid type")
+	}
+
+	vpnType, ok := vpnDict["type"].(string)
+	if !ok {
+		return nil, errors.New("failed to parse type, invalid type")
+	}
+
+	config, ok := vpnDict["config"].(string)
+	if !ok || config == "" {
+		return nil, errors.New("failed to parse config, invalid type")
+	}
+
+	var username string
+	var password string
+
+	if vpnDict["username"] != nil {
+		username, ok = vpnDict["username"].(string)
+		if !ok {
+			return nil, errors.New("failed to parse username, invalid type")
+		}
+	}
+
+	if vpnDict["password"] != nil {
+		password, ok = vpnDict["password"].(string)
+		if !ok {
+			return nil, errors.New("failed to parse password, invalid type")
+		}
+	}
+
+	vpn, err := ex.Network.ImportVPNConnection(network.VPNConfiguration{
+		Name:     name,
+		Type:     network.VPNType(vpnType),
+		Config:   config,
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &messenger.InvokeResult{Arguments: []interface{}{vpnConnectionToDict(vpn)}}, nil
+}
+
+func (ex *External) activateVPNConnectionHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	uuid, err := parseVPNConnectionUUID(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messenger.InvokeResult{}, ex.Network.ActivateVPNConnection(uuid)
+}
+
+func (ex *External) deactivateVPNConnectionHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	uuid, err := parseVPNConnectionUUID(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messenger.InvokeResult{}, ex.Network.DeactivateVPNConnection(uuid)
+}
+
+func (ex *External) removeVPNConnectionHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
+	uuid, err := parseVPNConnectionUUID(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messenger.InvokeResult{}, ex.Network.RemoveVPNConnection(uuid)
+}
+
+func parseVPNConnectionUUID(response messenger.Result) (string, error) {
+	payloadArg := response.Arguments
+	if len(payloadArg) == 0 {
+		return "", errors.New("args for vpn connection is empty")
+	}
+
+	payload, ok := payloadArg[0].(map[string]interface{})
+	if !ok {
+		return "", errors.New("argument 1 of args is not a dictionary type")
+	}
+
+	uuid, ok := payload["uuid"].(string)
+	if !ok || uuid == "" {
+		return "", errors.New("failed to parse uuid, invalid type")
+	}
+
+	return uuid, nil
+}
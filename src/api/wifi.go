@@ -4,21 +4,11 @@ import (
 	"context"
 	"errors"
 	"reagent/common"
-	"reagent/errdefs"
 	"reagent/messenger"
 	"reagent/network"
 )
 
 func (ex *External) listWiFiNetworksHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("READ", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to list wifi networks"))
-	}
-
 	wifis, err := ex.Network.ListWifiNetworks()
 	if err != nil {
 		return nil, err
@@ -63,15 +53,6 @@ func (ex *External) getCurrentIPAddresses(ctx context.Context, response messenge
 }
 
 func (ex *External) removeWifiHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("NETWORK", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to remove wifi config"))
-	}
-
 	payloadArg := response.Arguments
 	if len(payloadArg) == 0 {
 		return nil, errors.New("args for add wifi config is empty")
@@ -91,34 +72,14 @@ func (ex *External) removeWifiHandler(ctx context.Context, response messenger.Re
 }
 
 func (ex *External) wifiScanHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	// TODO: privilege check
-
 	return &messenger.InvokeResult{}, ex.Network.Scan()
 }
 
 func (ex *External) wifiRebootHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("NETWORK", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to restart wifi"))
-	}
-
 	return &messenger.InvokeResult{}, ex.Network.Reload()
 }
 
 func (ex *External) addWiFiConfigurationHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("NETWORK", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to add wifi config"))
-	}
-
 	payload := response.Arguments
 	if len(payload) == 0 {
 		return nil, errors.New("args for add wifi config is empty")
@@ -162,7 +123,7 @@ func (ex *External) addWiFiConfigurationHandler(ctx context.Context, response me
 		return nil, errors.New("failed to parse password, invalid type")
 	}
 
-	priority, ok := priorityArg.(uint64)
+	priority, ok := common.ToUint64(priorityArg)
 	if !ok {
 		return nil, errors.New("failed to parse priority, invalid type")
 	}
@@ -174,7 +135,7 @@ func (ex *External) addWiFiConfigurationHandler(ctx context.Context, response me
 		SecurityType: securityType,
 	}
 
-	err = ex.Network.AddWiFi(mac, wifiEntryPayload)
+	err := ex.Network.AddWiFi(mac, wifiEntryPayload)
 	if err != nil {
 		return nil, err
 	}
@@ -183,15 +144,6 @@ func (ex *External) addWiFiConfigurationHandler(ctx context.Context, response me
 }
 
 func (ex *External) selectWiFiNetworkHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("NETWORK", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges to select wifi network"))
-	}
-
 	payload := response.Arguments
 	if len(payload) == 0 {
 		return nil, errors.New("args for add wifi config is empty")
@@ -215,7 +167,7 @@ func (ex *External) selectWiFiNetworkHandler(ctx context.Context, response messe
 		return nil, errors.New("failed to parse mac, invalid type")
 	}
 
-	err = ex.Network.ActivateWiFi(mac, ssid)
+	err := ex.Network.ActivateWiFi(mac, ssid)
 	if err != nil {
 		return nil, err
 	}
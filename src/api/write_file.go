@@ -2,24 +2,19 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"reagent/errdefs"
+	"os"
+	"reagent/bundle"
+	"reagent/common"
 	"reagent/filesystem"
 	"reagent/messenger"
 	"reagent/safe"
+	"strings"
 )
 
 func (ex *External) writeToFileHandler(ctx context.Context, response messenger.Result) (*messenger.InvokeResult, error) {
-	privileged, err := ex.Privilege.Check("DEVELOP", response.Details)
-	if err != nil {
-		return nil, err
-	}
-
-	if !privileged {
-		return nil, errdefs.InsufficientPrivileges(errors.New("insufficient privileges write data to device"))
-	}
-
 	args := response.Arguments
 
 	// Matches file_transfer.ts payload
@@ -34,8 +29,25 @@ func (ex *External) writeToFileHandler(ctx context.Context, response messenger.R
 		return nil, errors.New("failed to parse name argument")
 	}
 
-	chunk, ok := chunkArg.(string)
-	if !ok {
+	// A data chunk is hex encoded text or, from backends that send it as
+	// bytes, the bytes themselves: as they are with a binary serialization, as
+	// NUL followed by base64 with JSON (the WAMP convention for binary data).
+	var chunk string
+	var binary []byte
+	switch typed := chunkArg.(type) {
+	case []byte:
+		binary = typed
+	case string:
+		if !strings.HasPrefix(typed, "\x00") {
+			chunk = typed
+			break
+		}
+		decoded, err := base64.StdEncoding.DecodeString(typed[1:])
+		if err != nil {
+			return nil, errors.New("failed to decode binary chunk argument")
+		}
+		binary = decoded
+	default:
 		return nil, errors.New("failed to parse chunk argument")
 	}
 
@@ -44,7 +56,7 @@ func (ex *External) writeToFileHandler(ctx context.Context, response messenger.R
 		return nil, errors.New("failed to parse containerName argument")
 	}
 
-	total, ok := totalArg.(uint64)
+	total, ok := common.ToUint64(totalArg)
 	if !ok {
 		return nil, errors.New("failed to parse total argument")
 	}
@@ -61,11 +73,12 @@ func (ex *External) writeToFileHandler(ctx context.Context, response messenger.R
 		FileName:      fileName,
 		FilePath:      fileDir,
 		Data:          chunk,
+		Binary:        binary,
 		ContainerName: containerName,
 		Total:         total,
 	}
 
-	err = ex.Filesystem.Write(fileChunk)
+	err := ex.Filesystem.Write(fileChunk)
 	if err != nil {
 		// Clean up the failed transfer and notify the app manager to reset state
 		ex.Filesystem.CleanupFailedTransfer(containerName)
@@ -82,6 +95,18 @@ func (ex *External) writeToFileHandler(ctx context.Context, response messenger.R
 		})
 
 		message = "Received first package on device!"
+	} else if fileChunk.Data == "END" && strings.HasSuffix(fileName, bundle.Extension) {
+		// An app bundle is installed as it is rather than built.
+		bundlePath := fileDir + "/" + fileName
+		safe.Go(func() {
+			err := ex.AppManager.ImportBundle(bundlePath)
+			if err != nil {
+				ex.LogManager.Write(containerName, fmt.Sprintf("Failed to install the app bundle: %s", err))
+			}
+			os.Remove(bundlePath)
+		})
+
+		message = "File transfer has finished, installing the app bundle..."
 	} else if fileChunk.Data == "END" {
 		message = "File transfer has finished, starting build..."
 	}
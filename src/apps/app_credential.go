@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"reagent/common"
 	"reagent/config"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -43,6 +45,27 @@ func appCredentialAuthID(serialNumber string, appKey uint64, stage common.Stage,
 	return fmt.Sprintf("app-%d-%s-e%d@%s", appKey, strings.ToLower(string(stage)), epoch, serialNumber)
 }
 
+var appCredentialAuthIDPattern = regexp.MustCompile(`^app-(\d+)-(dev|prod)-e(\d+)@(.+)$`)
+
+// parseAppCredentialAuthID is the inverse of appCredentialAuthID.
+func parseAppCredentialAuthID(authID string) (serialNumber string, appKey uint64, stage common.Stage, epoch uint64, ok bool) {
+	match := appCredentialAuthIDPattern.FindStringSubmatch(authID)
+	if match == nil {
+		return "", 0, "", 0, false
+	}
+
+	appKey, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return "", 0, "", 0, false
+	}
+	epoch, err = strconv.ParseUint(match[3], 10, 64)
+	if err != nil {
+		return "", 0, "", 0, false
+	}
+
+	return match[4], appKey, common.Stage(strings.ToUpper(match[2])), epoch, true
+}
+
 func appCredentialSecret(appCredKey string, serialNumber string, appKey uint64, stage common.Stage, epoch uint64) string {
 	msg := fmt.Sprintf("%s|%s|%d|%s|%d",
 		appCredMessagePrefix, serialNumber, appKey, strings.ToUpper(string(stage)), epoch)
@@ -71,3 +94,34 @@ func appCredential(cfg *config.Config, appCredKey string, payload common.Transit
 	return appCredentialAuthID(serial, payload.AppKey, payload.Stage, epoch),
 		appCredentialSecret(appCredKey, serial, payload.AppKey, payload.Stage, epoch)
 }
+
+// ResolveAppCredential returns the secret of an app credential authid, for
+// the local router to verify the app's CRA signature with. Only credentials
+// of apps installed on this device resolve. The epoch is taken from the
+// authid, as the agent does not keep the one it last handed out: an app can
+// only know the secrets of the epochs it was given, and the cloud still
+// rejects a rotated-out one for everything that is bridged.
+func (am *AppManager) ResolveAppCredential(authID string) (string, bool) {
+	serialNumber, appKey, stage, epoch, ok := parseAppCredentialAuthID(authID)
+	if !ok || epoch == 0 {
+		return "", false
+	}
+
+	cfg := am.StateMachine.Container.GetConfig()
+	if serialNumber != cfg.ReswarmConfig.SerialNumber {
+		return "", false
+	}
+
+	payload, err := am.AppStore.GetRequestedState(appKey, stage)
+	if err != nil || payload.AppKey != appKey {
+		return "", false
+	}
+	payload.AppCredEpoch = epoch
+
+	resolvedAuthID, secret := appCredential(cfg, am.StateMachine.AppCredKey(), payload)
+	if resolvedAuthID != authID {
+		return "", false
+	}
+
+	return secret, true
+}
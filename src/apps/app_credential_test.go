@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // The derivation MUST stay byte-identical to REaccounting's
@@ -64,3 +65,48 @@ func TestAppCredentialRequiresKeyAndSerial(t *testing.T) {
 func testConfigWithSerial(serial string) *config.Config {
 	return &config.Config{ReswarmConfig: &config.ReswarmConfig{SerialNumber: serial}}
 }
+
+func TestParseAppCredentialAuthID(t *testing.T) {
+	serial, appKey, stage, epoch, ok := parseAppCredentialAuthID("app-7-dev-e12@serial-x@y")
+	assert.True(t, ok)
+	assert.Equal(t, "serial-x@y", serial)
+	assert.Equal(t, uint64(7), appKey)
+	assert.Equal(t, common.DEV, stage)
+	assert.Equal(t, uint64(12), epoch)
+
+	for _, invalid := range []string{"", "serial-x", "app-7-test-e1@serial", "app-x-prod-e1@serial", "app-7-prod-e1@"} {
+		_, _, _, _, ok = parseAppCredentialAuthID(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+// The local router authenticates apps with the credentials the agent hands
+// them, so only those of installed apps may resolve.
+func TestResolveAppCredential(t *testing.T) {
+	am, _, _, st, _, cfg := amHarness(t)
+	serial := cfg.ReswarmConfig.SerialNumber
+	require.NotEmpty(t, serial)
+
+	require.NoError(t, st.UpdateLocalRequestedState(amPayload(7, "sensors", common.RUNNING, common.PROD)))
+
+	authID := appCredentialAuthID(serial, 7, common.PROD, 2)
+	_, ok := am.ResolveAppCredential(authID)
+	assert.False(t, ok, "nothing resolves before the per-device key is known")
+
+	am.StateMachine.SetAppCredKey("test-cred-key")
+
+	secret, ok := am.ResolveAppCredential(authID)
+	assert.True(t, ok)
+	assert.Equal(t, appCredentialSecret("test-cred-key", serial, 7, common.PROD, 2), secret)
+
+	for _, foreign := range []string{
+		appCredentialAuthID(serial, 7, common.DEV, 2),          // not installed in this stage
+		appCredentialAuthID(serial, 8, common.PROD, 1),         // not installed at all
+		appCredentialAuthID("other-serial", 7, common.PROD, 1), // another device's app
+		appCredentialAuthID(serial, 7, common.PROD, 0),
+		serial,
+	} {
+		_, ok = am.ResolveAppCredential(foreign)
+		assert.False(t, ok, foreign)
+	}
+}
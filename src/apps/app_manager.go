@@ -3,6 +3,7 @@ package apps
 import (
 	"context"
 	"fmt"
+	"reagent/codesign"
 	"reagent/common"
 	"reagent/errdefs"
 	"reagent/messenger/topics"
@@ -22,8 +23,12 @@ type AppManager struct {
 	StateObserver *StateObserver
 	tunnelManager tunnel.TunnelManager
 	hostPorts     *HostPortRegistry
+	lanAdvertiser *tunnel.LANAdvertiser
+	accessGuard   *tunnel.AccessGuard
+	trafficMeter  *tunnel.TrafficMeter
 	crashLoops    map[*CrashLoop]struct{}
 	crashLoopLock sync.Mutex
+	verifyBundle  func(data []byte, signature []byte) error
 }
 
 func NewAppManager(sm *StateMachine, as *store.AppStore, so *StateObserver, tm tunnel.TunnelManager) *AppManager {
@@ -34,12 +39,28 @@ func NewAppManager(sm *StateMachine, as *store.AppStore, so *StateObserver, tm t
 		tunnelManager: tm,
 		hostPorts:     NewHostPortRegistry(),
 		crashLoops:    make(map[*CrashLoop]struct{}),
+		verifyBundle:  codesign.VerifyDetached,
 	}
 
+	am.accessGuard = tunnel.NewAccessGuard(am.disableTunnel)
 	am.StateObserver.AppManager = &am
 	return &am
 }
 
+// SetLANAdvertiser wires the mDNS advertisement of app ports. Without one
+// (nil) app ports are only reachable through the tunnel URLs.
+func (am *AppManager) SetLANAdvertiser(lanAdvertiser *tunnel.LANAdvertiser) {
+	am.lanAdvertiser = lanAdvertiser
+}
+
+// SetTrafficMeter wires the accounting of metered tunnels. Without one (nil)
+// traffic policies are not enforced, except for their bandwidth limit.
+func (am *AppManager) SetTrafficMeter(trafficMeter *tunnel.TrafficMeter) {
+	am.trafficMeter = trafficMeter
+	am.accessGuard.SetTrafficMeter(trafficMeter)
+	trafficMeter.SetQuotaCallbacks(am.disableTunnel, am.restoreTunnels)
+}
+
 func (am *AppManager) syncPortState(payload common.TransitionPayload, app *common.App) error {
 	log.Debug().Str("app", payload.AppName).Msg("syncPortState called")
 	globalConfig := am.StateMachine.Container.GetConfig()
@@ -77,10 +98,12 @@ func (am *AppManager) syncPortState(payload common.TransitionPayload, app *commo
 	if len(portRules) == 0 {
 		// Nothing to reconcile or persist: the rule list this would write back
 		// is the one the cloud just sent us.
+		am.lanAdvertiser.SetAppEndpoints(payload.Stage, payload.AppKey, false, nil)
 		return nil
 	}
 
 	newPorts := make([]common.PortForwardRule, 0)
+	lanEndpoints := make([]tunnel.LANEndpoint, 0)
 
 	for _, portRule := range portRules {
 		subdomain := tunnel.CreateSubdomain(tunnel.Protocol(portRule.Protocol), uint64(globalConfig.ReswarmConfig.DeviceKey), payload.AppName, portRule.Port)
@@ -95,7 +118,32 @@ func (am *AppManager) syncPortState(payload common.TransitionPayload, app *commo
 			dialPort, dialPortKnown = am.resolveTunnelHostPort(payload, portRule)
 		}
 
-		if portRule.Active {
+		// The host port is reachable on the LAN whether or not the rule's
+		// tunnel is active. Rules with a LocalIP are not published on this host.
+		if dialPortKnown && portRule.LocalIP == "" {
+			lanEndpoints = append(lanEndpoints, tunnel.LANEndpoint{
+				AppName:  payload.AppName,
+				RuleName: portRule.RuleName,
+				Protocol: tunnel.Protocol(portRule.Protocol),
+				Port:     portRule.Port,
+				HostPort: dialPort,
+			})
+		}
+
+		// An expired share link is treated like a deactivated rule, so a sync
+		// after the expiry timer fired does not bring the tunnel back.
+		accessExpired := tunnel.AccessExpired(portRule.Access, time.Now())
+
+		// Likewise a tunnel that used up its monthly quota stays down until
+		// the next month.
+		if portRule.Traffic != nil {
+			am.trafficMeter.Track(payload.Stage, payload.AppKey, tunnelID, payload.AppName, portRule.Port, portRule.Traffic.MonthlyQuota)
+		} else {
+			am.trafficMeter.Untrack(tunnelID)
+		}
+		quotaExceeded := am.trafficMeter.QuotaExceeded(tunnelID)
+
+		if portRule.Active && !accessExpired && !quotaExceeded {
 			if tunnelsAvailable && (requestedState == common.RUNNING || curAppState == common.RUNNING) {
 				if !dialPortKnown {
 					// Fresh app that has not been started under managed ports
@@ -112,8 +160,35 @@ func (am *AppManager) syncPortState(payload common.TransitionPayload, app *commo
 						RemotePort: portRule.RemotePort,
 					}
 
+					if portRule.Traffic != nil && portRule.Traffic.BandwidthLimit != "" {
+						_, err := tunnel.ParseBandwidthLimit(portRule.Traffic.BandwidthLimit)
+						if err != nil {
+							// an invalid limit in the frpc config would take
+							// down every tunnel, not just this one
+							log.Error().Err(err).Str("tunnelID", tunnelID).Msg("Ignoring the bandwidth limit of the tunnel")
+						} else {
+							tunnelConfig.BandwidthLimit = portRule.Traffic.BandwidthLimit
+						}
+					}
+
+					// Point the tunnel at the access guard instead of the
+					// app when the rule's policy needs one, or its traffic
+					// is metered.
+					metered := portRule.Traffic != nil && am.trafficMeter != nil
+					tunnelConfig, accessErr := am.accessGuard.Apply(payload.Stage, payload.AppKey, portRule.Access, metered, tunnelConfig, tunnel.Backend(globalConfig))
+
 					tnl := am.tunnelManager.Get(tunnelID)
-					if tnl != nil && tnl.Config.LocalPort == dialPort {
+					if accessErr != nil {
+						// Fail closed: never expose a port whose policy
+						// cannot be enforced.
+						log.Error().Err(accessErr).Str("tunnelID", tunnelID).Msg("Refusing to expose port, its access policy cannot be enforced")
+						if tnl != nil {
+							err := am.tunnelManager.RemoveTunnel(tnl.Config)
+							if err != nil {
+								log.Error().Stack().Err(err).Msg("Failed to remove unprotected tunnel")
+							}
+						}
+					} else if tnl != nil && sameTunnelTarget(tnl.Config, tunnelConfig) {
 						log.Debug().Str("tunnelID", tunnelID).Msg("Tunnel already exists, skipping add")
 						// AddTunnel is skipped here, so take the live tunnel's
 						// config as the result: it holds the remote port frps
@@ -125,9 +200,10 @@ func (am *AppManager) syncPortState(payload common.TransitionPayload, app *commo
 					} else {
 						if tnl != nil {
 							// The app was republished on a different host
-							// port (e.g. reinstall); frpc must not keep
-							// dialing the stale one.
-							log.Info().Str("tunnelID", tunnelID).Uint64("oldPort", tnl.Config.LocalPort).Uint64("newPort", dialPort).Msg("Host port changed, replacing tunnel")
+							// port (e.g. reinstall), or its access policy
+							// changed; frpc must not keep dialing the stale
+							// target.
+							log.Info().Str("tunnelID", tunnelID).Uint64("oldPort", tnl.Config.LocalPort).Uint64("newPort", tunnelConfig.LocalPort).Msg("Tunnel target changed, replacing tunnel")
 							err := am.tunnelManager.RemoveTunnel(tnl.Config)
 							if err != nil {
 								log.Error().Stack().Err(err).Msg("Failed to remove outdated tunnel")
@@ -158,7 +234,14 @@ func (am *AppManager) syncPortState(payload common.TransitionPayload, app *commo
 				RemotePort: portRule.RemotePort,
 			}
 
-			log.Info().Str("tunnelID", tunnelID).Msg("Removing tunnel as it is not active")
+			if accessExpired {
+				log.Info().Str("tunnelID", tunnelID).Msg("Removing tunnel as its access has expired")
+			} else if quotaExceeded {
+				log.Info().Str("tunnelID", tunnelID).Msg("Removing tunnel as it exceeded its monthly traffic quota")
+			} else {
+				log.Info().Str("tunnelID", tunnelID).Msg("Removing tunnel as it is not active")
+			}
+			am.accessGuard.Release(tunnelID)
 			err := am.tunnelManager.RemoveTunnel(tunnelConfig)
 			if err != nil {
 				log.Error().Stack().Err(err).Msg("Failed to remove tunnel")
@@ -189,6 +272,10 @@ func (am *AppManager) syncPortState(payload common.TransitionPayload, app *commo
 	payload.Ports = np
 	am.tunnelManager.SaveRemotePorts(payload)
 
+	// Only advertised while running; the state observer toggles this as the
+	// app starts and stops.
+	am.lanAdvertiser.SetAppEndpoints(payload.Stage, payload.AppKey, curAppState == common.RUNNING, lanEndpoints)
+
 	// Live-update the bind-mounted env files ({NAME}.txt / {NAME}_CLOUD.txt)
 	// so running containers see fresh tunnel ports without a restart.
 	refreshRemotePortEnvFiles(globalConfig, payload.Stage, payload.AppName, newPorts)
@@ -213,6 +300,10 @@ func (am *AppManager) UpdateTunnelState() error {
 		return err
 	}
 
+	// tunnels disabled by their quota are reported too, so the backend
+	// learns why they are gone
+	tunnelStates = am.trafficMeter.ApplyTraffic(tunnelStates)
+
 	var args []interface{}
 	for _, tunnelState := range tunnelStates {
 		args = append(args, tunnelState)
@@ -222,6 +313,59 @@ func (am *AppManager) UpdateTunnelState() error {
 	return am.AppStore.Messenger.Publish(topics.Topic(updateTopic), args, nil, nil)
 }
 
+// disableTunnel tears down a tunnel whose access policy expired or that
+// exceeded its traffic quota. The rule stays as it is upstream; syncPortState
+// skips such rules, so the tunnel is not re-created until the policy is
+// renewed or the next month starts.
+func (am *AppManager) disableTunnel(tunnelID string) {
+	am.accessGuard.Release(tunnelID)
+
+	tnl := am.tunnelManager.Get(tunnelID)
+	if tnl == nil {
+		return
+	}
+
+	err := am.tunnelManager.RemoveTunnel(tnl.Config)
+	if err != nil {
+		log.Error().Stack().Err(err).Str("tunnelID", tunnelID).Msg("Failed to remove disabled tunnel")
+		return
+	}
+
+	err = am.UpdateTunnelState()
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to publish tunnel state after disabling a tunnel")
+	}
+}
+
+// restoreTunnels re-syncs the port rules of an app, bringing back tunnels a
+// new month lifted the quota block of.
+func (am *AppManager) restoreTunnels(stage common.Stage, appKey uint64) {
+	app, err := am.AppStore.GetApp(appKey, stage)
+	if err != nil || app == nil {
+		log.Error().Err(err).Uint64("appKey", appKey).Msg("Failed to get app to restore its tunnels")
+		return
+	}
+
+	payload, err := am.AppStore.GetRequestedState(appKey, stage)
+	if err != nil {
+		log.Error().Err(err).Uint64("appKey", appKey).Msg("Failed to get requested state to restore tunnels")
+		return
+	}
+
+	err = am.syncPortState(payload, app)
+	if err != nil {
+		log.Error().Err(err).Uint64("appKey", appKey).Msg("Failed to restore tunnels")
+	}
+}
+
+// sameTunnelTarget reports whether a live tunnel already dials what config
+// asks for, so it can be kept as it is.
+func sameTunnelTarget(live tunnel.TunnelConfig, config tunnel.TunnelConfig) bool {
+	return live.LocalPort == config.LocalPort && live.LocalIP == config.LocalIP &&
+		live.HTTPUser == config.HTTPUser && live.HTTPPassword == config.HTTPPassword &&
+		live.ProxyProtocol == config.ProxyProtocol && live.BandwidthLimit == config.BandwidthLimit
+}
+
 func (am *AppManager) RequestAppState(payload common.TransitionPayload) error {
 	app, err := am.AppStore.GetApp(payload.AppKey, payload.Stage)
 	if err != nil {
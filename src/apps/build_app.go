@@ -9,10 +9,12 @@ import (
 	"path/filepath"
 	"reagent/common"
 	"reagent/config"
+	"reagent/container"
 	"reagent/errdefs"
 	"reagent/filesystem"
 	"reagent/release"
 	"reagent/tunnel"
+	"slices"
 	"strings"
 
 	"github.com/docker/docker/api/types"
@@ -127,16 +129,21 @@ func deepCopyCompose(dockerCompose map[string]interface{}) (map[string]interface
 	return copied, nil
 }
 
+// composeAppDir returns the directory holding the compose and .env files of
+// an app in the given stage.
+func composeAppDir(cfg *config.Config, stage common.Stage, appName string) string {
+	targetDir := cfg.CommandLineArguments.AppsBuildDir
+	if stage == common.PROD {
+		targetDir = cfg.CommandLineArguments.AppsComposeDir
+	}
+	return targetDir + "/" + appName
+}
+
 func (sm *StateMachine) SetupComposeFiles(payload common.TransitionPayload, app *common.App, updatingApp bool) (string, error) {
 	config := sm.Container.GetConfig()
 
 	isProd := payload.Stage == common.PROD
-	targetDir := config.CommandLineArguments.AppsBuildDir
-	if isProd {
-		targetDir = config.CommandLineArguments.AppsComposeDir
-	}
-
-	targetAppDir := targetDir + "/" + app.AppName
+	targetAppDir := composeAppDir(config, payload.Stage, app.AppName)
 	dockerComposeFilePath := targetAppDir + "/" + DockerFileName
 	dotEnvFilePath := targetAppDir + "/" + DotEnvFileName
 
@@ -302,15 +309,12 @@ func (sm *StateMachine) buildDevComposeApp(payload common.TransitionPayload, app
 		return err
 	}
 
-	buildID := common.BuildDockerBuildID(app.AppKey, app.AppName)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	compose.RegisterBuildCancel(buildID, cancel)
-	defer compose.UnregisterBuildCancel(buildID)
+	ctx, done := sm.startBuild(app)
+	defer done()
 
 	buildOutput, buildCmd, err := compose.Build(ctx, dockerComposePath)
 	if err != nil {
-		return err
+		return sm.buildErr(ctx, err, topicForLogStream)
 	}
 
 	_, err = sm.LogManager.StreamLogsChannel(buildOutput, topicForLogStream)
@@ -320,7 +324,7 @@ func (sm *StateMachine) buildDevComposeApp(payload common.TransitionPayload, app
 
 	err = buildCmd.Wait()
 	if err != nil {
-		return err
+		return sm.buildErr(ctx, err, topicForLogStream)
 	}
 
 	if !releaseBuild {
@@ -369,23 +373,22 @@ func (sm *StateMachine) buildDevApp(payload common.TransitionPayload, app *commo
 	fileName := payload.AppName + "." + config.CommandLineArguments.CompressedBuildExtension
 	appFilesTar := buildsDir + "/" + fileName
 
+	// A Dockerfile.<arch> only serves the device's own architecture, builds
+	// for other platforms use the common one.
 	dockerFileName := "Dockerfile"
-	buildArch := release.GetBuildArch()
-	archSpecificDockerfile := fmt.Sprintf("Dockerfile.%s", buildArch)
-	_, err = filesystem.ReadFileInTgz(appFilesTar, archSpecificDockerfile)
-	if err == nil {
-		dockerFileName = archSpecificDockerfile
+	if len(payload.Build.Platforms) == 0 {
+		buildArch := release.GetBuildArch()
+		archSpecificDockerfile := fmt.Sprintf("Dockerfile.%s", buildArch)
+		_, err = filesystem.ReadFileInTgz(appFilesTar, archSpecificDockerfile)
+		if err == nil {
+			dockerFileName = archSpecificDockerfile
+		}
 	}
 
 	// need to specify that this is a release build on remote update
 	// this ensures that the dev release will be set to exists = true
 	// prod ready builds will not be set to exists until after they are pushed
 	app.ReleaseBuild = releaseBuild
-	buildOptions := types.ImageBuildOptions{
-		Tags:       []string{payload.RegistryImageName.Dev},
-		Dockerfile: dockerFileName,
-		BuildID:    common.BuildDockerBuildID(app.AppKey, app.AppName),
-	}
 
 	topicForLogStream := payload.ContainerName.Dev
 	if releaseBuild {
@@ -402,9 +405,46 @@ func (sm *StateMachine) buildDevApp(payload common.TransitionPayload, app *commo
 		return err
 	}
 
-	// TODO: figure out context for build?
-	reader, err := sm.Container.Build(context.Background(), appFilesTar, buildOptions)
+	ctx, done := sm.startBuild(app)
+	defer done()
+
+	if sm.Container.Buildx().Supported() {
+		return sm.buildDevAppWithBuildx(ctx, payload, app, appFilesTar, dockerFileName, topicForLogStream)
+	}
+
+	// The classic builder takes build args and a target stage, everything
+	// else needs BuildKit.
+	build := payload.Build
+	if len(build.Platforms) > 0 || len(build.Secrets) > 0 || build.Cache {
+		message := "Building for other platforms, with build secrets or with a build cache requires docker buildx, which is not available on this device"
+		writeErr := sm.LogManager.Write(topicForLogStream, message)
+		if writeErr != nil {
+			return writeErr
+		}
+		return errors.New("docker buildx is not available")
+	}
+
+	buildArgs, _ := buildEnvironment(payload)
+	buildOptions := types.ImageBuildOptions{
+		Tags:       []string{payload.RegistryImageName.Dev},
+		Dockerfile: dockerFileName,
+		BuildID:    common.BuildDockerBuildID(app.AppKey, app.AppName),
+		Target:     build.Target,
+		BuildArgs:  make(map[string]*string, len(buildArgs)),
+		// an aborted build leaves no intermediate containers behind
+		Remove:      true,
+		ForceRemove: true,
+	}
+	for name, value := range buildArgs {
+		buildOptions.BuildArgs[name] = &value
+	}
+
+	reader, err := sm.Container.Build(ctx, appFilesTar, buildOptions)
 	if err != nil {
+		if ctx.Err() != nil {
+			return sm.buildErr(ctx, err, topicForLogStream)
+		}
+
 		errorMessage := err.Error()
 		if errdefs.IsDockerfileCannotBeEmpty(err) {
 			errorMessage = "The Dockerfile cannot be empty, please fill out your Dockerfile"
@@ -427,6 +467,10 @@ func (sm *StateMachine) buildDevApp(payload common.TransitionPayload, app *commo
 	var buildMessage string
 	streamErr := sm.LogManager.StreamBlocking(topicForLogStream, common.BUILD, reader)
 	if streamErr != nil {
+		if ctx.Err() != nil {
+			return sm.buildErr(ctx, streamErr, topicForLogStream)
+		}
+
 		if errdefs.IsDockerStreamCanceled(streamErr) {
 			buildMessage = "The build stream was canceled"
 			writeErr := sm.LogManager.Write(topicForLogStream, buildMessage)
@@ -448,3 +492,148 @@ func (sm *StateMachine) buildDevApp(payload common.TransitionPayload, app *commo
 
 	return sm.setState(app, common.BUILT)
 }
+
+// buildDevAppWithBuildx builds the image with BuildKit. It runs once the app
+// is BUILDING, from the same build files the classic builder gets.
+func (sm *StateMachine) buildDevAppWithBuildx(ctx context.Context, payload common.TransitionPayload, app *common.App, appFilesTar string, dockerFileName string, topicForLogStream string) error {
+	build := payload.Build
+	if len(build.Platforms) > 1 && !app.ReleaseBuild {
+		message := "An image for several platforms cannot run on the device, it can only be built when publishing a release"
+		writeErr := sm.LogManager.Write(topicForLogStream, message)
+		if writeErr != nil {
+			return writeErr
+		}
+		return errors.New("multi-platform images can only be published")
+	}
+
+	err := sm.HandleRegistryLoginsWithDefault(payload)
+	if err != nil {
+		writeErr := sm.LogManager.Write(topicForLogStream, err.Error())
+		if writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	buildx := sm.Container.Buildx()
+
+	if len(build.Platforms) > 0 {
+		err = buildx.EnsureEmulators(ctx, build.Platforms)
+		if err != nil {
+			if ctx.Err() != nil {
+				return sm.buildErr(ctx, err, topicForLogStream)
+			}
+			writeErr := sm.LogManager.Write(topicForLogStream, err.Error())
+			if writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+	}
+
+	config := sm.Container.GetConfig()
+	contextDir := config.CommandLineArguments.AppsBuildDir + "/" + app.AppName + ".context"
+	err = os.RemoveAll(contextDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(contextDir)
+
+	err = filesystem.ExtractTarGz(appFilesTar, contextDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errdefs.DockerBuildFilesNotFound(err)
+		}
+		writeErr := sm.LogManager.Write(topicForLogStream, "Build files for app not found: "+err.Error())
+		if writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	buildArgs, buildSecrets := buildEnvironment(payload)
+	options := container.BuildxOptions{
+		Dockerfile: contextDir + "/" + dockerFileName,
+		Tags:       []string{payload.RegistryImageName.Dev},
+		Target:     build.Target,
+		BuildArgs:  buildArgs,
+		Secrets:    buildSecrets,
+		Platforms:  build.Platforms,
+	}
+
+	if build.Cache && payload.NewestVersion != "" {
+		options.CacheFrom = fmt.Sprintf("%s:%s", payload.RegistryImageName.Prod, payload.NewestVersion)
+	}
+
+	// The local image store cannot hold an image for several platforms, so the
+	// build pushes the release itself (see buildPushesRelease).
+	if buildPushesRelease(payload) {
+		options.Tags = []string{fmt.Sprintf("%s:%s", payload.RegistryImageName.Prod, payload.Version)}
+		options.Push = true
+	}
+
+	buildOutput, buildCmd, err := buildx.Build(ctx, contextDir, options)
+	if err != nil {
+		return sm.buildErr(ctx, err, topicForLogStream)
+	}
+
+	_, err = sm.LogManager.StreamLogsChannel(buildOutput, topicForLogStream)
+	if err != nil {
+		return err
+	}
+
+	err = buildCmd.Wait()
+	if err != nil {
+		return sm.buildErr(ctx, err, topicForLogStream)
+	}
+
+	err = sm.LogManager.Write(topicForLogStream, "Image built successfully")
+	if err != nil {
+		return err
+	}
+
+	return sm.setState(app, common.BUILT)
+}
+
+// buildPushesRelease reports whether publishing builds and pushes the release
+// in one go, as it has to for several platforms.
+func buildPushesRelease(payload common.TransitionPayload) bool {
+	return len(payload.Build.Platforms) > 1
+}
+
+// buildEnvironment turns the app's environment into build args, except for
+// the variables listed as build secrets, which it returns separately. Values
+// set for the app override the defaults of its environment template.
+func buildEnvironment(payload common.TransitionPayload) (map[string]string, map[string]string) {
+	environment := make(map[string]string)
+	for name, entry := range payload.EnvironmentTemplate {
+		if value := environmentValue(entry, "defaultValue"); value != nil {
+			environment[name] = fmt.Sprint(value)
+		}
+	}
+	for name, entry := range payload.EnvironmentVariables {
+		if value := environmentValue(entry, "value"); value != nil {
+			environment[name] = fmt.Sprint(value)
+		}
+	}
+
+	buildArgs := make(map[string]string)
+	buildSecrets := make(map[string]string)
+	for name, value := range environment {
+		if slices.Contains(payload.Build.Secrets, name) {
+			buildSecrets[name] = value
+		} else {
+			buildArgs[name] = value
+		}
+	}
+
+	return buildArgs, buildSecrets
+}
+
+func environmentValue(entry interface{}, key string) interface{} {
+	entryMap, ok := entry.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return entryMap[key]
+}
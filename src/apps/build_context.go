@@ -0,0 +1,151 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reagent/common"
+	"reagent/errdefs"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errBuildCanceled is the cause of a build canceled from the Studio.
+var errBuildCanceled = errors.New("the build was canceled")
+
+// errBuildTimedOut is the cause of a build that outlived -buildTimeout.
+var errBuildTimedOut = errors.New("the build timed out")
+
+// abortedBuildCleanupTimeout bounds each prune after an aborted build.
+const abortedBuildCleanupTimeout = 2 * time.Minute
+
+// buildIDKey holds the build ID in the context of a build.
+type buildIDKey struct{}
+
+// startBuild returns the context a build of the app runs under: canceled by
+// cancelBuild and AbortBuilds, and bounded by -buildTimeout. The returned func
+// must be called once the build is over.
+func (sm *StateMachine) startBuild(app *common.App) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	timeout := time.Duration(sm.Container.GetConfig().CommandLineArguments.BuildTimeout) * time.Minute
+	buildCtx := ctx
+	cancelTimeout := context.CancelFunc(func() {})
+	if timeout > 0 {
+		buildCtx, cancelTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w after %s", errBuildTimedOut, timeout))
+	}
+
+	buildID := common.BuildDockerBuildID(app.AppKey, app.AppName)
+	sm.buildCancelMutex.Lock()
+	sm.buildCancels[buildID] = cancel
+	sm.buildCancelMutex.Unlock()
+
+	return context.WithValue(buildCtx, buildIDKey{}, buildID), func() {
+		sm.buildCancelMutex.Lock()
+		delete(sm.buildCancels, buildID)
+		sm.buildCancelMutex.Unlock()
+
+		cancelTimeout()
+		cancel(nil)
+	}
+}
+
+// cancelBuildContext aborts the app's build, if one is in flight, with cause.
+func (sm *StateMachine) cancelBuildContext(app *common.App, cause error) {
+	buildID := common.BuildDockerBuildID(app.AppKey, app.AppName)
+	sm.buildCancelMutex.Lock()
+	cancel := sm.buildCancels[buildID]
+	sm.buildCancelMutex.Unlock()
+	if cancel != nil {
+		cancel(cause)
+	}
+}
+
+// AbortBuilds aborts every build in flight with cause, e.g. when the disk runs
+// full. The apps end up FAILED with cause in their build log.
+func (sm *StateMachine) AbortBuilds(cause error) {
+	sm.buildCancelMutex.Lock()
+	cancels := make([]context.CancelCauseFunc, 0, len(sm.buildCancels))
+	for _, cancel := range sm.buildCancels {
+		cancels = append(cancels, cancel)
+	}
+	sm.buildCancelMutex.Unlock()
+
+	for _, cancel := range cancels {
+		cancel(cause)
+	}
+}
+
+// buildErr classifies the error a build failed with. A build aborted through
+// its context gets its partial layers cleaned up and says why in the build
+// log. One canceled from the Studio is reported as a canceled stream, which
+// is not a failure; a timeout or an abort is.
+func (sm *StateMachine) buildErr(ctx context.Context, err error, topicForLogStream string) error {
+	if ctx.Err() == nil {
+		return err
+	}
+
+	cause := context.Cause(ctx)
+	sm.cleanupAbortedBuild(ctx)
+
+	message := "The build was aborted: " + cause.Error()
+	if errors.Is(cause, errBuildCanceled) {
+		message = "The build stream was canceled"
+	} else if errors.Is(cause, errBuildTimedOut) {
+		message = "The build was aborted: " + cause.Error() + ", the limit is set with -buildTimeout"
+	}
+
+	writeErr := sm.LogManager.Write(topicForLogStream, message)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if errors.Is(cause, errBuildCanceled) {
+		// this error will not cause a failed state and is handled upstream
+		return errdefs.DockerStreamCanceled(err)
+	}
+
+	return fmt.Errorf("%w: %w", cause, err)
+}
+
+// cleanupAbortedBuild removes what an aborted build leaves behind: the
+// untagged images of its finished steps and its build cache. Neither is
+// labelled with the build it belongs to, so the prunes take all dangling
+// images and build cache of the host. They are skipped while another build is
+// in flight, whose steps they would take away from under it; diskguard and
+// the next aborted build clean up what is left.
+func (sm *StateMachine) cleanupAbortedBuild(buildCtx context.Context) {
+	buildID, _ := buildCtx.Value(buildIDKey{}).(string)
+	if other, building := sm.otherBuild(buildID); building {
+		log.Info().Msgf("Not pruning after the aborted build, the build %s is in flight", other)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), abortedBuildCleanupTimeout)
+	defer cancel()
+	_, err := sm.Container.PruneDanglingImages(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prune the dangling images of an aborted build")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), abortedBuildCleanupTimeout)
+	defer cancel()
+	_, err = sm.Container.PruneBuildCache(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prune the build cache of an aborted build")
+	}
+}
+
+// otherBuild returns a build in flight other than buildID, if there is one.
+func (sm *StateMachine) otherBuild(buildID string) (string, bool) {
+	sm.buildCancelMutex.Lock()
+	defer sm.buildCancelMutex.Unlock()
+
+	for other := range sm.buildCancels {
+		if other != buildID {
+			return other, true
+		}
+	}
+	return "", false
+}
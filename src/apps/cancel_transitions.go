@@ -10,15 +10,10 @@ func (sm *StateMachine) cancelBuild(payload common.TransitionPayload, app *commo
 		return errors.New("cannot build prod apps")
 	}
 
-	buildID := common.BuildDockerBuildID(app.AppKey, app.AppName)
-
-	if payload.DockerCompose != nil {
-		compose := sm.Container.Compose()
-		compose.CancelBuild(buildID) // ignore error — build may have already finished
-		return sm.setState(app, common.REMOVED)
-	}
-
-	sm.Container.CancelStream(buildID)
+	// Every build runs under its own context, whether it is a compose, BuildKit
+	// or classic one; canceling it aborts the build on the daemon. The build may
+	// have already finished.
+	sm.cancelBuildContext(app, errBuildCanceled)
 
 	return sm.setState(app, common.REMOVED)
 }
@@ -45,9 +40,10 @@ func (sm *StateMachine) cancelPull(payload common.TransitionPayload, app *common
 		return sm.removeApp(payload, app)
 	}
 
+	// The stream of a running pull, the context of one waiting to be retried.
 	pullID := common.BuildDockerPullID(payload.AppKey, payload.AppName)
-
 	sm.Container.CancelStream(pullID)
+	sm.cancelComposeTransition(payload.Stage, payload.AppKey)
 
 	return sm.setState(app, common.REMOVED)
 }
@@ -71,6 +67,7 @@ func (sm *StateMachine) cancelActiveUpdate(payload common.TransitionPayload) {
 	} else {
 		pullID := common.BuildDockerPullID(payload.AppKey, payload.AppName)
 		sm.Container.CancelStream(pullID)
+		sm.cancelComposeTransition(payload.Stage, payload.AppKey)
 	}
 }
 
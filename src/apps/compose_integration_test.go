@@ -61,10 +61,11 @@ const composeITLongImage = "alpine:latest"
 //   - `jq` on PATH (Compose().Status pipes `compose ps` through jq).
 //
 // Any of these missing -> t.Skip, never a failure.
-func composeITDocker(t *testing.T) *container.Docker {
+func composeITDocker(t *testing.T) container.Container {
 	t.Helper()
 
-	docker, err := container.NewDocker(builders.DefaultTestConfig())
+	cfg := builders.NewTestConfigBuilder().WithContainerRuntime(os.Getenv("REAGENT_TEST_RUNTIME")).Build()
+	docker, err := container.New(cfg)
 	if err != nil {
 		t.Skipf("skipping: cannot construct docker client: %v", err)
 	}
@@ -109,7 +110,7 @@ func composeITAppName(t *testing.T) string {
 // against the REAL docker client and a temp-dir config (so SetupComposeFiles'
 // filesystem writes land somewhere isolated and writable). It mirrors the
 // structure of wiredRunBuildSM but swaps the mock for the live client.
-func composeITStateMachine(t *testing.T, docker *container.Docker) (*StateMachine, *StateObserver, *store.AppStore, *config.Config) {
+func composeITStateMachine(t *testing.T, docker container.Container) (*StateMachine, *StateObserver, *store.AppStore, *config.Config) {
 	t.Helper()
 
 	// Point every Apps* dir at a fresh temp dir. SetupComposeFiles writes the
@@ -0,0 +1,115 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reagent/common"
+	"reagent/errdefs"
+)
+
+// What ControlComposeService does to a service.
+const (
+	ServiceStart   = "start"
+	ServiceStop    = "stop"
+	ServiceRestart = "restart"
+)
+
+// ControlComposeService starts, stops or restarts a single service of a
+// running compose app, leaving its other services alone. The service states
+// the app publishes follow with the next tick of its state observer.
+//
+// Stopping the last running service is refused: the app would no longer run,
+// and the agent would bring it back up as a whole to reach its requested
+// state. Stop the app instead.
+func (am *AppManager) ControlComposeService(ctx context.Context, stage common.Stage, appKey uint64, service string, action string) error {
+	compose := am.StateMachine.Container.Compose()
+
+	var run func(ctx context.Context, dockerComposePath string, service string) error
+	switch action {
+	case ServiceStart:
+		run = compose.StartServiceContext
+	case ServiceStop:
+		run = compose.StopServiceContext
+	case ServiceRestart:
+		run = compose.RestartServiceContext
+	default:
+		return fmt.Errorf("unknown service action %q, use start, stop or restart", action)
+	}
+
+	payload, err := am.AppStore.GetRequestedState(appKey, stage)
+	if err != nil {
+		return err
+	}
+	if payload.DockerCompose == nil {
+		return fmt.Errorf("the app %s is not a compose app", payload.AppName)
+	}
+	services, _ := payload.DockerCompose["services"].(map[string]interface{})
+	if _, ok := services[service]; !ok {
+		return fmt.Errorf("the app %s has no service %s", payload.AppName, service)
+	}
+
+	app, err := am.AppStore.GetApp(appKey, stage)
+	if err != nil {
+		return err
+	}
+	if app == nil {
+		return fmt.Errorf("the app %s is not installed", payload.AppName)
+	}
+
+	// Hold the transition lock, so neither a transition nor the state
+	// observer acts on the app while the service changes under it.
+	if app.SecureTransition() {
+		return errdefs.InProgress(fmt.Errorf("the app %s is in a transition, try again later", payload.AppName))
+	}
+	defer app.UnlockTransition()
+
+	app.StateLock.Lock()
+	currentState := app.CurrentState
+	serviceStates := app.Services
+	app.StateLock.Unlock()
+
+	if currentState != common.RUNNING {
+		return fmt.Errorf("the app %s is not running", payload.AppName)
+	}
+	if action == ServiceStop && !runsWithout(serviceStates, service) {
+		return errors.New("the service is the last one running, stop the app instead")
+	}
+
+	if !compose.Supported {
+		return errdefs.DockerComposeNotSupported(errors.New("docker compose is not supported"))
+	}
+
+	config := am.StateMachine.Container.GetConfig()
+	targetDir := config.CommandLineArguments.AppsBuildDir
+	if stage == common.PROD {
+		targetDir = config.CommandLineArguments.AppsComposeDir
+	}
+	dockerComposePath := targetDir + "/" + app.AppName + "/" + DockerFileName
+
+	err = run(ctx, dockerComposePath, service)
+	if err != nil {
+		return err
+	}
+
+	containerName := common.BuildContainerName(stage, appKey, app.AppName)
+	am.StateMachine.LogManager.Write(containerName, fmt.Sprintf("The service %s was %s", service, serviceActionDone[action]))
+
+	return nil
+}
+
+var serviceActionDone = map[string]string{
+	ServiceStart:   "started",
+	ServiceStop:    "stopped",
+	ServiceRestart: "restarted",
+}
+
+// runsWithout reports whether another service than service is running.
+func runsWithout(services []common.ServiceState, service string) bool {
+	for _, state := range services {
+		if state.Service != service && state.State == "running" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package apps
+
+import (
+	"context"
+	"testing"
+
+	"reagent/common"
+	"reagent/container"
+	"reagent/errdefs"
+	"reagent/testutil/builders"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlComposeService(t *testing.T) {
+	seedComposeApp := func(t *testing.T) (*AppManager, *common.App) {
+		t.Helper()
+
+		am, mc, _, st, _, _ := amHarness(t)
+		mc.EXPECT().Compose().Return(&container.Compose{Supported: true}).Maybe()
+
+		payload := builders.BuildTransitionPayload("stack", common.RUNNING, common.PROD)
+		payload.AppKey = 7
+		payload.CurrentState = common.RUNNING
+		payload.DockerCompose = map[string]interface{}{"services": map[string]interface{}{
+			"db":  map[string]interface{}{"image": "postgres:15"},
+			"web": map[string]interface{}{"image": "acme/web:1"},
+		}}
+		app, err := st.AddApp(payload)
+		require.NoError(t, err)
+		require.NoError(t, st.UpdateLocalRequestedState(payload))
+
+		app.Services = []common.ServiceState{
+			{Service: "db", Container: "prod_7_stack_compose-db-1", State: "exited", ExitCode: 1},
+			{Service: "web", Container: "prod_7_stack_compose-web-1", State: "running"},
+		}
+		return am, app
+	}
+
+	t.Run("the last running service is not stopped", func(t *testing.T) {
+		am, _ := seedComposeApp(t)
+
+		err := am.ControlComposeService(context.Background(), common.PROD, 7, "web", ServiceStop)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "stop the app instead")
+	})
+
+	t.Run("a service the app does not have", func(t *testing.T) {
+		am, _ := seedComposeApp(t)
+
+		err := am.ControlComposeService(context.Background(), common.PROD, 7, "cache", ServiceRestart)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "has no service cache")
+	})
+
+	t.Run("an app in a transition is left alone", func(t *testing.T) {
+		am, app := seedComposeApp(t)
+		require.False(t, app.SecureTransition())
+		defer app.UnlockTransition()
+
+		err := am.ControlComposeService(context.Background(), common.PROD, 7, "db", ServiceStart)
+		assert.True(t, errdefs.IsInProgress(err))
+	})
+
+	t.Run("only a running app has its services controlled", func(t *testing.T) {
+		am, app := seedComposeApp(t)
+		app.CurrentState = common.PRESENT
+
+		err := am.ControlComposeService(context.Background(), common.PROD, 7, "db", ServiceStart)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is not running")
+	})
+
+	t.Run("an unknown action", func(t *testing.T) {
+		am, _ := seedComposeApp(t)
+
+		err := am.ControlComposeService(context.Background(), common.PROD, 7, "db", "kill")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,468 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reagent/common"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// composeUpdatePlan is the update of a running compose app service by service:
+// what is recreated, in which order, and which images that takes.
+type composeUpdatePlan struct {
+	// services are the services to create or recreate, dependencies first.
+	services []common.ServiceUpdate
+	// removed are the services the new definition no longer has.
+	removed []common.ServiceUpdate
+	// pull are the services whose image is new to the app or on a floating
+	// tag, which may point to a newer image than the one the app runs.
+	pull []string
+	// refresh are the unchanged services on a floating tag: they are brought
+	// up again after the pull, which recreates them only if their tag moved.
+	refresh []string
+}
+
+// updates returns the state of every service the plan touches.
+func (p composeUpdatePlan) updates() []common.ServiceUpdate {
+	updates := make([]common.ServiceUpdate, 0, len(p.services)+len(p.removed))
+	updates = append(updates, p.services...)
+	return append(updates, p.removed...)
+}
+
+// planComposeUpdate compares the compose definition an app runs with the one
+// it is updated to, per service. It reports false when the update cannot be
+// done service by service: when the networks, volumes or any other definition
+// the services share changed, or the services' dependencies form a cycle.
+//
+// A service is recreated when its definition changed, and so is an unchanged
+// one that would lose what it shares with it otherwise: the network, IPC or
+// PID namespace (`network_mode: service:…`), the volumes (`volumes_from`),
+// or its lifecycle (a `depends_on` with `restart: true`).
+//
+// Like the full update, the images of every service not pinned by digest are
+// pulled again, so a release on `:latest` or `:stable` picks up what the tag
+// points to now.
+func planComposeUpdate(oldCompose map[string]interface{}, newCompose map[string]interface{}) (composeUpdatePlan, bool) {
+	oldServices, ok := oldCompose["services"].(map[string]interface{})
+	if !ok {
+		return composeUpdatePlan{}, false
+	}
+	newServices, ok := newCompose["services"].(map[string]interface{})
+	if !ok {
+		return composeUpdatePlan{}, false
+	}
+
+	for _, key := range composeKeys(oldCompose, newCompose) {
+		if key == "services" || key == "name" || key == "version" {
+			continue
+		}
+		if !reflect.DeepEqual(oldCompose[key], newCompose[key]) {
+			return composeUpdatePlan{}, false
+		}
+	}
+
+	changes := make(map[string]common.ServiceChange)
+	for name, definition := range newServices {
+		previous, existed := oldServices[name]
+		switch {
+		case !existed:
+			changes[name] = common.SERVICE_ADDED
+		case serviceImage(previous) != serviceImage(definition):
+			changes[name] = common.SERVICE_IMAGE_CHANGED
+		case !reflect.DeepEqual(previous, definition):
+			changes[name] = common.SERVICE_CONFIG_CHANGED
+		}
+	}
+
+	for grown := true; grown; {
+		grown = false
+		for name, definition := range newServices {
+			if _, ok := changes[name]; ok {
+				continue
+			}
+			for _, dependency := range serviceDependencies(definition, true) {
+				if _, ok := changes[dependency]; ok {
+					changes[name] = common.SERVICE_DEPENDENCY_CHANGED
+					grown = true
+					break
+				}
+			}
+		}
+	}
+
+	order, ok := startOrder(newServices, changes)
+	if !ok {
+		return composeUpdatePlan{}, false
+	}
+
+	var plan composeUpdatePlan
+	for _, name := range order {
+		plan.services = append(plan.services, common.ServiceUpdate{Service: name, Change: changes[name], State: common.SERVICE_UPDATE_PENDING})
+
+		image := serviceImage(newServices[name])
+		change := changes[name]
+		if image != "" && (change == common.SERVICE_ADDED || change == common.SERVICE_IMAGE_CHANGED || !pinnedImage(image)) {
+			plan.pull = append(plan.pull, name)
+		}
+	}
+
+	for _, name := range composeKeys(newServices) {
+		if _, changed := changes[name]; changed {
+			continue
+		}
+		if image := serviceImage(newServices[name]); image != "" && !pinnedImage(image) {
+			plan.pull = append(plan.pull, name)
+			plan.refresh = append(plan.refresh, name)
+		}
+	}
+
+	for _, name := range composeKeys(oldServices) {
+		if _, ok := newServices[name]; !ok {
+			plan.removed = append(plan.removed, common.ServiceUpdate{Service: name, Change: common.SERVICE_REMOVED, State: common.SERVICE_UPDATE_PENDING})
+		}
+	}
+
+	return plan, true
+}
+
+// startOrder orders the given services so each comes after those it depends
+// on, by name otherwise. It reports false on a dependency cycle.
+func startOrder(services map[string]interface{}, changes map[string]common.ServiceChange) ([]string, bool) {
+	pending := make([]string, 0, len(changes))
+	for name := range changes {
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+
+	placed := make(map[string]bool, len(pending))
+	order := make([]string, 0, len(pending))
+	for len(pending) > 0 {
+		next := -1
+		for i, name := range pending {
+			ready := true
+			for _, dependency := range serviceDependencies(services[name], false) {
+				if _, changed := changes[dependency]; changed && !placed[dependency] && dependency != name {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, false
+		}
+
+		placed[pending[next]] = true
+		order = append(order, pending[next])
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+
+	return order, true
+}
+
+// serviceDependencies returns the services a service definition depends on.
+// With recreatedWith only those it has to be recreated with: the ones it
+// shares a namespace or volumes with, or that it is restarted with.
+func serviceDependencies(definition interface{}, recreatedWith bool) []string {
+	service, ok := definition.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var dependencies []string
+	for _, key := range []string{"network_mode", "ipc", "pid"} {
+		mode, _ := service[key].(string)
+		if dependency, ok := strings.CutPrefix(mode, "service:"); ok {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+
+	volumesFrom, _ := service["volumes_from"].([]interface{})
+	for _, entry := range volumesFrom {
+		source, _ := entry.(string)
+		if source == "" || strings.HasPrefix(source, "container:") {
+			continue
+		}
+		source, _, _ = strings.Cut(source, ":")
+		dependencies = append(dependencies, source)
+	}
+
+	switch dependsOn := service["depends_on"].(type) {
+	case []interface{}:
+		if recreatedWith {
+			break
+		}
+		for _, dependency := range dependsOn {
+			dependencies = append(dependencies, fmt.Sprint(dependency))
+		}
+	case map[string]interface{}:
+		for dependency, options := range dependsOn {
+			condition, _ := options.(map[string]interface{})
+			if recreatedWith && condition["restart"] != true {
+				continue
+			}
+			dependencies = append(dependencies, dependency)
+		}
+	}
+
+	return dependencies
+}
+
+func serviceImage(definition interface{}) string {
+	service, _ := definition.(map[string]interface{})
+	image, _ := service["image"].(string)
+	return image
+}
+
+// pinnedImage reports whether an image reference names its image by digest,
+// so pulling it again cannot bring a different image.
+func pinnedImage(image string) bool {
+	return strings.Contains(image, "@")
+}
+
+// composeKeys returns the keys of the given maps, sorted.
+func composeKeys(maps ...map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// updateComposeServices updates a running compose app in place: only the
+// images of the plan are pulled and only its services recreated, one at a
+// time, while the other services keep running. The progress of each service
+// is published with the app's state.
+//
+// Until the updated services run, a failure puts the previous compose files
+// back, so they keep describing the version the app is recorded at.
+func (sm *StateMachine) updateComposeServices(ctx context.Context, payload common.TransitionPayload, app *common.App, plan composeUpdatePlan) (err error) {
+	compose := sm.Container.Compose()
+	topicForLogStream := payload.ContainerName.Prod
+
+	updatedPayload := payload
+	updatedPayload.DockerCompose = payload.NewDockerCompose
+
+	appDir := composeAppDir(sm.Container.GetConfig(), payload.Stage, app.AppName)
+	previousFiles, err := snapshotComposeFiles(appDir+"/"+DockerFileName, appDir+"/"+DotEnvFileName)
+	if err != nil {
+		return err
+	}
+
+	updated := false
+	defer func() {
+		if err == nil || updated {
+			return
+		}
+		restoreErr := previousFiles.restore()
+		if restoreErr != nil {
+			log.Error().Err(restoreErr).Msgf("failed to restore the compose files of %s", payload.AppName)
+		}
+	}()
+
+	// Run the services by the digests their signatures were verified for;
+	// see runProdComposeApp.
+	if sm.imagePolicy != nil {
+		updatedPayload, err = sm.pinComposeImages(updatedPayload, app)
+		if err != nil {
+			return err
+		}
+	}
+
+	dockerComposePath, err := sm.SetupComposeFiles(updatedPayload, app, false)
+	if err != nil {
+		return err
+	}
+
+	err = sm.HandleRegistryLoginsWithDefault(payload)
+	if err != nil {
+		writeErr := sm.LogManager.Write(topicForLogStream, err.Error())
+		if writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	message := fmt.Sprintf("Updating %s to version %s: %d of its services change, the others keep running", payload.AppName, payload.NewestVersion, len(plan.services)+len(plan.removed))
+	err = sm.LogManager.Write(topicForLogStream, message)
+	if err != nil {
+		return err
+	}
+
+	if len(plan.pull) > 0 {
+		err = sm.pullComposeImages(ctx, updatedPayload, dockerComposePath, plan.pull)
+		if err != nil {
+			for _, service := range plan.pull {
+				sm.setServiceUpdateState(app, service, common.SERVICE_UPDATE_FAILED, err)
+			}
+			return err
+		}
+	}
+
+	for _, update := range plan.services {
+		sm.setServiceUpdateState(app, update.Service, common.SERVICE_UPDATE_UPDATING, nil)
+		sm.LogManager.Write(topicForLogStream, fmt.Sprintf("Updating the service %s (%s)...", update.Service, strings.ReplaceAll(string(update.Change), "_", " ")))
+
+		err = sm.upComposeService(ctx, dockerComposePath, topicForLogStream, update.Service)
+		if err != nil {
+			err = composeTransitionErr(ctx, err)
+			sm.setServiceUpdateState(app, update.Service, common.SERVICE_UPDATE_FAILED, err)
+			sm.LogManager.Write(topicForLogStream, fmt.Sprintf("Failed to update the service %s: %s", update.Service, err))
+			return err
+		}
+
+		sm.setServiceUpdateState(app, update.Service, common.SERVICE_UPDATE_DONE, nil)
+	}
+
+	for _, service := range plan.refresh {
+		err = sm.upComposeService(ctx, dockerComposePath, topicForLogStream, service)
+		if err != nil {
+			err = composeTransitionErr(ctx, err)
+			sm.LogManager.Write(topicForLogStream, fmt.Sprintf("Failed to update the service %s: %s", service, err))
+			return err
+		}
+	}
+
+	if len(plan.removed) > 0 {
+		for _, update := range plan.removed {
+			sm.setServiceUpdateState(app, update.Service, common.SERVICE_UPDATE_UPDATING, nil)
+		}
+
+		err = compose.RemoveOrphansContext(ctx, dockerComposePath)
+		state := common.SERVICE_UPDATE_DONE
+		if err != nil {
+			err = composeTransitionErr(ctx, err)
+			state = common.SERVICE_UPDATE_FAILED
+		}
+		for _, update := range plan.removed {
+			sm.setServiceUpdateState(app, update.Service, state, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	waitForRunningContext, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	runningSignal, errC := compose.WaitForRunning(waitForRunningContext, dockerComposePath, time.Second)
+	select {
+	case err = <-errC:
+		if err != nil {
+			sm.LogManager.Write(topicForLogStream, fmt.Sprintf("The app failed to run after the update, reason: %s", err.Error()))
+			return composeTransitionErr(ctx, err)
+		}
+	case <-runningSignal:
+	}
+	updated = true
+
+	message = fmt.Sprintf("Successfully updated the app: %s (Version: %s)", payload.AppName, payload.NewestVersion)
+	err = sm.LogManager.Write(topicForLogStream, message)
+	if err != nil {
+		return err
+	}
+
+	app.StateLock.Lock()
+	app.Version = payload.NewestVersion
+	app.ReleaseKey = payload.NewReleaseKey
+	app.UpdateStatus = common.PENDING_REMOTE_CONFIRMATION // set flag to make backend aware we updated
+	app.StateLock.Unlock()
+
+	err = sm.setState(app, common.RUNNING)
+	if err != nil {
+		return err
+	}
+
+	payload.DockerCompose = payload.NewDockerCompose
+	return sm.persistPostUpdateRequestedState(payload, app)
+}
+
+// composeFileSnapshot holds files of a compose app as they were before an
+// update rewrote them; a nil content is a file that did not exist.
+type composeFileSnapshot map[string][]byte
+
+func snapshotComposeFiles(paths ...string) (composeFileSnapshot, error) {
+	snapshot := make(composeFileSnapshot, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		snapshot[path] = content
+	}
+	return snapshot, nil
+}
+
+// restore puts every file of the snapshot back, removing those that did not
+// exist when it was taken.
+func (s composeFileSnapshot) restore() error {
+	var errs []error
+	for path, content := range s {
+		if content == nil {
+			err := os.Remove(path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		errs = append(errs, os.WriteFile(path, content, os.ModePerm))
+	}
+	return errors.Join(errs...)
+}
+
+// upComposeService creates or recreates a single service of the project,
+// streaming the CLI output to the app's log topic.
+func (sm *StateMachine) upComposeService(ctx context.Context, dockerComposePath string, logTopic string, service string) error {
+	outputChan, upCmd, err := sm.Container.Compose().UpServicesContext(ctx, dockerComposePath, service)
+	if err != nil {
+		return err
+	}
+
+	_, err = sm.LogManager.StreamLogsChannel(outputChan, logTopic)
+	if err != nil {
+		return err
+	}
+
+	return upCmd.Wait()
+}
+
+// setServiceUpdateState records how far the update of a service got and
+// publishes it. The publication is best effort: the next state update of the
+// app carries it too.
+func (sm *StateMachine) setServiceUpdateState(app *common.App, service string, state common.ServiceUpdateState, err error) {
+	app.StateLock.Lock()
+	for i := range app.ServiceUpdates {
+		if app.ServiceUpdates[i].Service != service {
+			continue
+		}
+		app.ServiceUpdates[i].State = state
+		app.ServiceUpdates[i].Error = ""
+		if err != nil {
+			app.ServiceUpdates[i].Error = err.Error()
+		}
+	}
+	app.StateLock.Unlock()
+
+	notifyErr := sm.StateObserver.NotifyRemote(app, common.UPDATING)
+	if notifyErr != nil {
+		log.Debug().Err(notifyErr).Msgf("failed to publish the update of the service %s", service)
+	}
+}
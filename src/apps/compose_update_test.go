@@ -0,0 +1,139 @@
+package apps
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"reagent/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func composeFromJSON(t *testing.T, definition string) map[string]interface{} {
+	t.Helper()
+
+	compose := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(definition), &compose))
+	return compose
+}
+
+func TestPlanComposeUpdate(t *testing.T) {
+	current := `{
+		"version": "3",
+		"services": {
+			"db": {"image": "postgres:15@sha256:d1", "volumes": ["data:/var/lib/postgresql/data"]},
+			"api": {"image": "acme/api:1@sha256:a1", "depends_on": ["db"]},
+			"web": {"image": "acme/web:1@sha256:b1", "depends_on": {"api": {"condition": "service_started"}}},
+			"proxy": {"image": "nginx:1@sha256:c1", "network_mode": "service:web"},
+			"worker": {"image": "acme/worker:1@sha256:e1", "depends_on": {"api": {"condition": "service_started", "restart": true}}}
+		},
+		"volumes": {"data": {}}
+	}`
+
+	t.Run("only the changed services and those bound to them are recreated", func(t *testing.T) {
+		updated := composeFromJSON(t, current)
+		services := updated["services"].(map[string]interface{})
+		services["api"].(map[string]interface{})["image"] = "acme/api:2@sha256:a2"
+		services["web"].(map[string]interface{})["environment"] = []interface{}{"DEBUG=1"}
+
+		plan, ok := planComposeUpdate(composeFromJSON(t, current), updated)
+		require.True(t, ok)
+
+		assert.Equal(t, []common.ServiceUpdate{
+			{Service: "api", Change: common.SERVICE_IMAGE_CHANGED, State: common.SERVICE_UPDATE_PENDING},
+			{Service: "web", Change: common.SERVICE_CONFIG_CHANGED, State: common.SERVICE_UPDATE_PENDING},
+			{Service: "proxy", Change: common.SERVICE_DEPENDENCY_CHANGED, State: common.SERVICE_UPDATE_PENDING},
+			{Service: "worker", Change: common.SERVICE_DEPENDENCY_CHANGED, State: common.SERVICE_UPDATE_PENDING},
+		}, plan.services, "db keeps running; the rest in dependency order")
+		assert.Equal(t, []string{"api"}, plan.pull, "only new images are pulled")
+		assert.Empty(t, plan.refresh)
+		assert.Empty(t, plan.removed)
+	})
+
+	t.Run("images on a floating tag are pulled again", func(t *testing.T) {
+		old := composeFromJSON(t, current)
+		old["services"].(map[string]interface{})["cache"] = map[string]interface{}{"image": "redis:latest"}
+		old["services"].(map[string]interface{})["web"].(map[string]interface{})["image"] = "acme/web:stable"
+		updated := composeFromJSON(t, current)
+		updated["services"].(map[string]interface{})["cache"] = map[string]interface{}{"image": "redis:latest"}
+		updated["services"].(map[string]interface{})["web"].(map[string]interface{})["image"] = "acme/web:stable"
+		updated["services"].(map[string]interface{})["web"].(map[string]interface{})["environment"] = []interface{}{"DEBUG=1"}
+
+		plan, ok := planComposeUpdate(old, updated)
+		require.True(t, ok)
+
+		assert.Equal(t, []common.ServiceUpdate{
+			{Service: "web", Change: common.SERVICE_CONFIG_CHANGED, State: common.SERVICE_UPDATE_PENDING},
+			{Service: "proxy", Change: common.SERVICE_DEPENDENCY_CHANGED, State: common.SERVICE_UPDATE_PENDING},
+		}, plan.services)
+		assert.Equal(t, []string{"web", "cache"}, plan.pull, "pinned images are not pulled again")
+		assert.Equal(t, []string{"cache"}, plan.refresh)
+	})
+
+	t.Run("added and removed services", func(t *testing.T) {
+		updated := composeFromJSON(t, current)
+		services := updated["services"].(map[string]interface{})
+		delete(services, "worker")
+		services["cache"] = map[string]interface{}{"image": "redis:7"}
+
+		plan, ok := planComposeUpdate(composeFromJSON(t, current), updated)
+		require.True(t, ok)
+
+		assert.Equal(t, []common.ServiceUpdate{
+			{Service: "cache", Change: common.SERVICE_ADDED, State: common.SERVICE_UPDATE_PENDING},
+		}, plan.services)
+		assert.Equal(t, []string{"cache"}, plan.pull)
+		assert.Equal(t, []common.ServiceUpdate{
+			{Service: "worker", Change: common.SERVICE_REMOVED, State: common.SERVICE_UPDATE_PENDING},
+		}, plan.removed)
+	})
+
+	t.Run("an unchanged definition recreates nothing", func(t *testing.T) {
+		plan, ok := planComposeUpdate(composeFromJSON(t, current), composeFromJSON(t, current))
+		require.True(t, ok)
+		assert.Empty(t, plan.updates())
+	})
+
+	t.Run("a change shared by the services takes a full update", func(t *testing.T) {
+		updated := composeFromJSON(t, current)
+		updated["volumes"] = map[string]interface{}{"data": map[string]interface{}{"driver": "nfs"}}
+
+		_, ok := planComposeUpdate(composeFromJSON(t, current), updated)
+		assert.False(t, ok)
+	})
+
+	t.Run("a dependency cycle takes a full update", func(t *testing.T) {
+		old := composeFromJSON(t, `{"services": {"a": {"image": "a:1", "depends_on": ["b"]}, "b": {"image": "b:1", "depends_on": ["a"]}}}`)
+		updated := composeFromJSON(t, `{"services": {"a": {"image": "a:2", "depends_on": ["b"]}, "b": {"image": "b:2", "depends_on": ["a"]}}}`)
+
+		_, ok := planComposeUpdate(old, updated)
+		assert.False(t, ok)
+	})
+
+	t.Run("no definition to compare with takes a full update", func(t *testing.T) {
+		_, ok := planComposeUpdate(nil, composeFromJSON(t, current))
+		assert.False(t, ok)
+	})
+}
+
+func TestComposeFileSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	composePath := filepath.Join(dir, DockerFileName)
+	dotEnvPath := filepath.Join(dir, DotEnvFileName)
+	require.NoError(t, os.WriteFile(composePath, []byte(`{"services": {}}`), 0o644))
+
+	snapshot, err := snapshotComposeFiles(composePath, dotEnvPath)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(composePath, []byte(`{"services": {"api": {}}}`), 0o644))
+	require.NoError(t, os.WriteFile(dotEnvPath, []byte("DEBUG=1"), 0o644))
+	require.NoError(t, snapshot.restore())
+
+	content, err := os.ReadFile(composePath)
+	require.NoError(t, err)
+	assert.Equal(t, `{"services": {}}`, string(content))
+	assert.NoFileExists(t, dotEnvPath, "a file the snapshot did not have is removed")
+}
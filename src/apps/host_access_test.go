@@ -95,6 +95,23 @@ func TestBuildDefaultEnvironmentVariablesTunnelRouting(t *testing.T) {
 	assert.Contains(t, instanceEnv, "INSTANCE_KEY=5")
 }
 
+// Apps only learn about the local router when the agent runs one.
+func TestBuildDefaultEnvironmentVariablesLocalRouter(t *testing.T) {
+	cfg := &config.Config{
+		ReswarmConfig:        &config.ReswarmConfig{Environment: "production"},
+		CommandLineArguments: &config.CommandLineArguments{},
+	}
+	app := &common.App{AppKey: 7, AppName: "myapp"}
+
+	for _, env := range buildDefaultEnvironmentVariables(cfg, common.TransitionPayload{}, common.PROD, app, "") {
+		assert.NotContains(t, env, "LOCAL_ROUTER_URL=")
+	}
+
+	cfg.CommandLineArguments.LocalRouterPort = 8090
+	assert.Contains(t, buildDefaultEnvironmentVariables(cfg, common.TransitionPayload{}, common.PROD, app, ""),
+		"LOCAL_ROUTER_URL=ws://host.docker.internal:8090/ws")
+}
+
 // The device's realm1 credential must never reach an app container: realm1's
 // swarm_device role is allow-all, so an app holding it could act as its own
 // device. Per-app credentials replace it — and are omitted entirely (never
@@ -0,0 +1,164 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reagent/common"
+	"reagent/errdefs"
+	"reagent/imagesign"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// imageVerificationTimeout bounds the signature check of an app's images.
+const imageVerificationTimeout = 2 * time.Minute
+
+// SetImagePolicy wires the signature policy PROD app images must satisfy
+// before they are run. Without one (nil) they run unverified.
+func (sm *StateMachine) SetImagePolicy(policy *imagesign.Policy) {
+	sm.imagePolicy = policy
+}
+
+// registryCredentials returns the registry logins of the app, the device's
+// own registry included, keyed by registry.
+func (sm *StateMachine) registryCredentials(payload common.TransitionPayload) map[string]common.DockerCredential {
+	config := sm.Container.GetConfig()
+
+	credentials := make(map[string]common.DockerCredential, len(payload.DockerCredentials)+1)
+	for server, credential := range payload.DockerCredentials {
+		credentials[server] = credential
+	}
+	credentials[config.ReswarmConfig.DockerRegistryURL] = common.DockerCredential{
+		Username: payload.RegisteryToken,
+		Password: config.ReswarmConfig.Secret,
+	}
+
+	return credentials
+}
+
+// verifyAppImages checks the signatures of the app's images under the image
+// policy and returns, per image, the reference pinned to the digest that was
+// verified; the app is run by those. An image on the device is checked by the
+// digest it was pulled as, one still to be pulled by the digest its tag points
+// to now. The outcome is kept on the app for its next state update, and a
+// failure is written to the app's log.
+func (sm *StateMachine) verifyAppImages(payload common.TransitionPayload, app *common.App, images []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), imageVerificationTimeout)
+	defer cancel()
+
+	credentials := sm.registryCredentials(payload)
+	pinned := make(map[string]string, len(images))
+	signatures := make([]common.ImageSignature, 0, len(images))
+
+	var verifyErr error
+	for _, image := range images {
+		signature := common.ImageSignature{Image: image}
+
+		digest, err := sm.imageDigest(ctx, image, credentials)
+		if err == nil {
+			signature, err = sm.imagePolicy.Verify(ctx, image, digest, credentials)
+		}
+		if err == nil {
+			pinned[image], err = imagesign.Pin(image, digest)
+		}
+
+		if err != nil {
+			signature.Error = err.Error()
+			signatures = append(signatures, signature)
+			verifyErr = err
+			break
+		}
+
+		signatures = append(signatures, signature)
+	}
+
+	app.StateLock.Lock()
+	app.ImageSignatures = signatures
+	app.StateLock.Unlock()
+
+	if verifyErr != nil {
+		message := fmt.Sprintf("The app was not started, its image signature could not be verified: %s", verifyErr)
+		writeErr := sm.LogManager.Write(payload.ContainerName.Prod, message)
+		if writeErr != nil {
+			log.Debug().Err(writeErr).Msg("failed to write the image signature error")
+		}
+		return nil, errdefs.ImageSignatureInvalid(verifyErr)
+	}
+
+	return pinned, nil
+}
+
+// imageDigest returns the digest the image is verified and run by: the one it
+// pins, the one it was pulled as, or else the one its tag points to.
+func (sm *StateMachine) imageDigest(ctx context.Context, image string, credentials map[string]common.DockerCredential) (string, error) {
+	if digest, ok := imagesign.Digest(image); ok {
+		return digest, nil
+	}
+
+	name, tag, err := imagesign.SplitTag(image)
+	if err != nil {
+		return "", err
+	}
+
+	local, err := sm.Container.GetImage(ctx, name, tag)
+	if err == nil {
+		digest, ok := imagesign.RepoDigest(image, local.RepoDigests)
+		if !ok {
+			return "", errors.New("the image was not pulled from a registry, it has no digest to verify")
+		}
+		return digest, nil
+	}
+	if !errdefs.IsImageNotFound(err) {
+		return "", err
+	}
+
+	return sm.imagePolicy.Resolve(ctx, image, credentials)
+}
+
+// pinComposeImages verifies the images of a compose app's services and
+// returns the payload with a definition that runs them by the verified
+// digests. The payload's own definition is left untouched.
+func (sm *StateMachine) pinComposeImages(payload common.TransitionPayload, app *common.App) (common.TransitionPayload, error) {
+	dockerCompose, err := deepCopyCompose(payload.DockerCompose)
+	if err != nil {
+		return payload, err
+	}
+
+	services, ok := dockerCompose["services"].(map[string]interface{})
+	if !ok {
+		return payload, errors.New("failed to infer services")
+	}
+
+	images := make([]string, 0, len(services))
+	for name, serviceInterface := range services {
+		service, ok := serviceInterface.(map[string]interface{})
+		if !ok {
+			return payload, errors.New("failed to infer service")
+		}
+
+		image, _ := service["image"].(string)
+		if image == "" {
+			return payload, fmt.Errorf("the service %s has no image whose signature could be verified", name)
+		}
+		if !slices.Contains(images, image) {
+			images = append(images, image)
+		}
+	}
+	slices.Sort(images)
+
+	pinned, err := sm.verifyAppImages(payload, app, images)
+	if err != nil {
+		return payload, err
+	}
+
+	for _, serviceInterface := range services {
+		service := serviceInterface.(map[string]interface{})
+		service["image"] = pinned[service["image"].(string)]
+	}
+
+	payload.DockerCompose = dockerCompose
+	return payload, nil
+}
@@ -0,0 +1,129 @@
+package apps
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"reagent/common"
+	"reagent/container"
+	"reagent/errdefs"
+	"reagent/imagesign"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// testImagePolicy returns a policy that trusts a freshly generated key.
+func testImagePolicy(t *testing.T) *imagesign.Policy {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644))
+
+	policy, err := imagesign.NewPolicy([]string{keyFile}, nil)
+	require.NoError(t, err)
+	return policy
+}
+
+func TestVerifyAppImages(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	t.Run("an image without a registry digest does not run", func(t *testing.T) {
+		am, mc, _, st, _, _ := amHarness(t)
+		am.StateMachine.SetImagePolicy(testImagePolicy(t))
+		app := amSeed(t, st, 1, "sensor", common.PRESENT, common.PROD)
+		payload := amPayload(1, "sensor", common.RUNNING, common.PROD)
+
+		mc.EXPECT().GetImage(mock.Anything, "registry.test/prod/sensor", "1.0.0").Return(container.ImageResult{ID: "sha256:local"}, nil).Once()
+
+		_, err := am.StateMachine.verifyAppImages(payload, app, []string{"registry.test/prod/sensor:1.0.0"})
+		require.Error(t, err)
+		assert.True(t, errdefs.IsImageSignatureInvalid(err))
+
+		require.Len(t, app.ImageSignatures, 1)
+		assert.Equal(t, "registry.test/prod/sensor:1.0.0", app.ImageSignatures[0].Image)
+		assert.False(t, app.ImageSignatures[0].Verified)
+		assert.Contains(t, app.ImageSignatures[0].Error, "no digest")
+	})
+
+	t.Run("an unreachable registry fails closed", func(t *testing.T) {
+		am, _, _, st, _, _ := amHarness(t)
+		am.StateMachine.SetImagePolicy(testImagePolicy(t))
+		app := amSeed(t, st, 1, "sensor", common.PRESENT, common.PROD)
+		payload := amPayload(1, "sensor", common.RUNNING, common.PROD)
+
+		// Pinned by digest: verified without looking at the local image.
+		image := "127.0.0.1:1/prod/sensor@" + digest
+		_, err := am.StateMachine.verifyAppImages(payload, app, []string{image})
+		require.Error(t, err)
+		assert.True(t, errdefs.IsImageSignatureInvalid(err))
+
+		require.Len(t, app.ImageSignatures, 1)
+		assert.Equal(t, digest, app.ImageSignatures[0].Digest)
+		assert.False(t, app.ImageSignatures[0].Verified)
+	})
+
+	t.Run("the pulled digest is the one verified", func(t *testing.T) {
+		am, mc, _, _, _, _ := amHarness(t)
+		am.StateMachine.SetImagePolicy(testImagePolicy(t))
+
+		mc.EXPECT().GetImage(mock.Anything, "registry.test/prod/sensor", "1.0.0").
+			Return(container.ImageResult{RepoDigests: []string{"registry.test/other@sha256:" + strings.Repeat("b", 64), "registry.test/prod/sensor@" + digest}}, nil).Once()
+
+		got, err := am.StateMachine.imageDigest(t.Context(), "registry.test/prod/sensor:1.0.0", nil)
+		require.NoError(t, err)
+		assert.Equal(t, digest, got)
+	})
+}
+
+func TestPinComposeImages(t *testing.T) {
+	t.Run("a service without an image cannot be verified", func(t *testing.T) {
+		am, _, _, st, _, _ := amHarness(t)
+		am.StateMachine.SetImagePolicy(testImagePolicy(t))
+		app := amSeed(t, st, 1, "stack", common.PRESENT, common.PROD)
+		payload := amPayload(1, "stack", common.RUNNING, common.PROD)
+		payload.DockerCompose = map[string]interface{}{
+			"services": map[string]interface{}{
+				"web": map[string]interface{}{"build": "."},
+			},
+		}
+
+		_, err := am.StateMachine.pinComposeImages(payload, app)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "web")
+	})
+
+	t.Run("the definition of the payload is left untouched", func(t *testing.T) {
+		am, mc, _, st, _, _ := amHarness(t)
+		am.StateMachine.SetImagePolicy(testImagePolicy(t))
+		app := amSeed(t, st, 1, "stack", common.PRESENT, common.PROD)
+		payload := amPayload(1, "stack", common.RUNNING, common.PROD)
+		payload.DockerCompose = map[string]interface{}{
+			"services": map[string]interface{}{
+				"web": map[string]interface{}{"image": "nginx:1.25"},
+			},
+		}
+
+		mc.EXPECT().GetImage(mock.Anything, "nginx", "1.25").Return(container.ImageResult{}, nil).Once()
+
+		_, err := am.StateMachine.pinComposeImages(payload, app)
+		require.Error(t, err)
+		assert.True(t, errdefs.IsImageSignatureInvalid(err))
+
+		web := payload.DockerCompose["services"].(map[string]interface{})["web"].(map[string]interface{})
+		assert.Equal(t, "nginx:1.25", web["image"])
+	})
+}
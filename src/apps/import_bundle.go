@@ -0,0 +1,180 @@
+package apps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reagent/bundle"
+	"reagent/common"
+	"reagent/release"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ImportBundle installs the app release in the bundle at bundlePath without a
+// registry: it verifies the bundle against the pinned signing roots, loads its
+// images into the daemon and registers the app as PRESENT at the bundled
+// release. A bundle of the release the app is already at is skipped; an app
+// that is running or in a transition is left alone.
+func (am *AppManager) ImportBundle(bundlePath string) error {
+	config := am.StateMachine.Container.GetConfig()
+
+	err := os.MkdirAll(config.CommandLineArguments.AppsBuildDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := os.MkdirTemp(config.CommandLineArguments.AppsBuildDir, "bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	manifest, err := bundle.Extract(bundlePath, stagingDir, am.verifyBundle)
+	if err != nil {
+		return err
+	}
+
+	sysInfo := release.GetSystemInfo()
+	if manifest.Architecture != "" && manifest.Architecture != sysInfo.Arch+sysInfo.Variant {
+		return fmt.Errorf("the bundle is built for %s, this device is %s", manifest.Architecture, sysInfo.Arch+sysInfo.Variant)
+	}
+
+	payload := common.BuildTransitionPayload(manifest.AppKey, manifest.AppName, 0, common.PROD,
+		common.PRESENT, common.PRESENT, manifest.ReleaseKey, manifest.ReleaseKey, config)
+	payload.Version = manifest.Version
+	payload.PresentVersion = manifest.Version
+	payload.NewestVersion = manifest.Version
+	payload.EnvironmentVariables = manifest.Environment
+	payload.EnvironmentTemplate = manifest.EnvironmentTemplate
+	payload.Ports = manifest.Ports
+
+	if manifest.Compose != nil {
+		composeData, err := os.ReadFile(filepath.Join(stagingDir, manifest.Compose.Path))
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(composeData, &payload.DockerCompose)
+		if err != nil {
+			return fmt.Errorf("invalid compose definition in the bundle: %w", err)
+		}
+	} else if len(manifest.Images) != 1 {
+		return errors.New("the bundle of a single-container app must hold exactly one image")
+	}
+
+	app, err := am.AppStore.GetApp(payload.AppKey, payload.Stage)
+	if err != nil {
+		return err
+	}
+
+	if app != nil {
+		if app.SecureTransition() {
+			return fmt.Errorf("the app %s is in a transition, import the bundle again later", payload.AppName)
+		}
+		defer app.UnlockTransition()
+
+		app.StateLock.Lock()
+		currentState := app.CurrentState
+		version := app.Version
+		app.StateLock.Unlock()
+
+		if version == manifest.Version && currentState == common.PRESENT {
+			log.Info().Msgf("the app %s is already at version %s, skipping the bundle", payload.AppName, manifest.Version)
+			return nil
+		}
+
+		if currentState != common.REMOVED && currentState != common.PRESENT && currentState != common.FAILED {
+			return fmt.Errorf("the app %s is %s, stop it before importing a bundle", payload.AppName, currentState)
+		}
+	}
+
+	topicForLogStream := payload.ContainerName.Prod
+	err = am.StateMachine.LogManager.Write(topicForLogStream, fmt.Sprintf("Installing the app %s (Version: %s) from a bundle...", payload.AppName, manifest.Version))
+	if err != nil {
+		return err
+	}
+
+	for _, image := range manifest.Images {
+		err = am.loadBundleImage(payload, filepath.Join(stagingDir, image.Path), manifest.Compose == nil)
+		if err != nil {
+			writeErr := am.StateMachine.LogManager.Write(topicForLogStream, fmt.Sprintf("Failed to load the image %s: %s", image.Path, err))
+			if writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+	}
+
+	if app == nil {
+		app, err = am.AppStore.AddApp(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.StateLock.Lock()
+	app.Version = manifest.Version
+	app.ReleaseKey = manifest.ReleaseKey
+	app.RequestedState = common.PRESENT
+	app.UpdateStatus = common.PENDING_REMOTE_CONFIRMATION
+	app.StateLock.Unlock()
+
+	err = am.AppStore.UpdateLocalRequestedState(payload)
+	if err != nil {
+		return err
+	}
+
+	err = am.StateObserver.NotifyLocal(app, common.PRESENT)
+	if err != nil {
+		return err
+	}
+
+	err = am.StateMachine.LogManager.Write(topicForLogStream, fmt.Sprintf("Succesfully installed the app: %s (Version: %s)", payload.AppName, manifest.Version))
+	if err != nil {
+		return err
+	}
+
+	// Offline the backend learns about the app once the device reconnects.
+	err = am.StateObserver.NotifyRemote(app, common.PRESENT)
+	if err != nil {
+		log.Debug().Err(err).Msgf("failed to report the imported app %s", payload.AppName)
+	}
+
+	return nil
+}
+
+// loadBundleImage loads a `docker save` archive of the bundle. The image of a
+// single-container app is tagged as the registry image of its release, the
+// name the app is run by.
+func (am *AppManager) loadBundleImage(payload common.TransitionPayload, archivePath string, tagAsApp bool) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	ctx := context.Background()
+	loaded, err := am.StateMachine.Container.LoadImage(ctx, archive)
+	if err != nil {
+		return err
+	}
+
+	if !tagAsApp {
+		return nil
+	}
+
+	if len(loaded) != 1 {
+		return fmt.Errorf("the archive holds %d images, expected the app's image only", len(loaded))
+	}
+
+	target := fmt.Sprintf("%s:%s", payload.RegistryImageName.Prod, payload.NewestVersion)
+	if loaded[0] == target {
+		return nil
+	}
+
+	return am.StateMachine.Container.Tag(ctx, loaded[0], target)
+}
@@ -0,0 +1,135 @@
+package apps
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"reagent/bundle"
+	"reagent/common"
+	"reagent/messenger/topics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestBundle writes a bundle of a single-container app holding one image
+// archive and returns its path. Its signature is "signature".
+func writeTestBundle(t *testing.T, manifest bundle.Manifest, image []byte) string {
+	t.Helper()
+
+	sum := sha256.Sum256(image)
+	manifest.Images = []bundle.File{{Path: "image.tar", SHA256: hex.EncodeToString(sum[:])}}
+	manifestData, err := json.Marshal(manifest)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "app"+bundle.Extension)
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	tarWriter := tar.NewWriter(file)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{"manifest.json", manifestData}, {"manifest.sig", []byte("signature")}, {"image.tar", image}} {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.data))}))
+		_, err = tarWriter.Write(entry.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+
+	return path
+}
+
+func TestImportBundle(t *testing.T) {
+	manifest := bundle.Manifest{AppKey: 77, AppName: "sensor", Version: "1.2.0", ReleaseKey: 12}
+
+	acceptSignature := func(data []byte, signature []byte) error {
+		if string(signature) != "signature" {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+
+	t.Run("loads the image and registers the app as PRESENT", func(t *testing.T) {
+		am, mc, _, st, msg, cfg := amHarness(t)
+		am.verifyBundle = acceptSignature
+
+		target := common.BuildTransitionPayload(77, "sensor", 0, common.PROD, common.PRESENT, common.PRESENT, 12, 12, cfg).RegistryImageName.Prod + ":1.2.0"
+		mc.EXPECT().LoadImage(mock.Anything, mock.Anything).Return([]string{"sensor:latest"}, nil).Once()
+		mc.EXPECT().Tag(mock.Anything, "sensor:latest", target).Return(nil).Once()
+
+		err := am.ImportBundle(writeTestBundle(t, manifest, []byte("image")))
+		require.NoError(t, err)
+
+		app, err := st.GetApp(77, common.PROD)
+		require.NoError(t, err)
+		require.NotNil(t, app)
+		assert.Equal(t, common.PRESENT, app.CurrentState)
+		assert.Equal(t, "1.2.0", app.Version)
+		assert.Equal(t, uint64(12), app.ReleaseKey)
+
+		requested, err := st.GetRequestedState(77, common.PROD)
+		require.NoError(t, err)
+		assert.Equal(t, common.PRESENT, requested.RequestedState)
+		assert.Equal(t, "1.2.0", requested.PresentVersion)
+
+		reported := false
+		for _, call := range msg.CallCalls {
+			reported = reported || call.Topic == topics.SetActualAppOnDeviceState
+		}
+		assert.True(t, reported, "the backend is told when it can be reached")
+	})
+
+	t.Run("skips a bundle of the release the app is at", func(t *testing.T) {
+		am, _, _, st, _, _ := amHarness(t)
+		am.verifyBundle = acceptSignature
+
+		app := amSeed(t, st, 77, "sensor", common.PRESENT, common.PROD)
+		app.Version = "1.2.0"
+
+		// the strict mock fails on any image load
+		err := am.ImportBundle(writeTestBundle(t, manifest, []byte("image")))
+		require.NoError(t, err)
+	})
+
+	t.Run("leaves a running app alone", func(t *testing.T) {
+		am, _, _, st, _, _ := amHarness(t)
+		am.verifyBundle = acceptSignature
+
+		amSeed(t, st, 77, "sensor", common.RUNNING, common.PROD)
+
+		err := am.ImportBundle(writeTestBundle(t, manifest, []byte("image")))
+		assert.ErrorContains(t, err, "stop it before importing")
+	})
+
+	t.Run("rejects a bundle with an invalid signature", func(t *testing.T) {
+		am, _, _, st, _, _ := amHarness(t)
+		am.verifyBundle = func([]byte, []byte) error { return errors.New("unknown signer") }
+
+		err := am.ImportBundle(writeTestBundle(t, manifest, []byte("image")))
+		assert.ErrorContains(t, err, "unknown signer")
+
+		app, err := st.GetApp(77, common.PROD)
+		require.NoError(t, err)
+		assert.Nil(t, app)
+	})
+
+	t.Run("rejects a bundle for another architecture", func(t *testing.T) {
+		am, _, _, _, _, _ := amHarness(t)
+		am.verifyBundle = acceptSignature
+
+		foreign := manifest
+		foreign.Architecture = "mips"
+
+		err := am.ImportBundle(writeTestBundle(t, foreign, []byte("image")))
+		assert.ErrorContains(t, err, "built for mips")
+	})
+}
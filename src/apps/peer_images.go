@@ -0,0 +1,73 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reagent/common"
+	"reagent/peerimage"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SetImagePeers wires the fetcher PROD app images are fetched with from the
+// devices on the LAN before they are pulled. Without one (nil) they are pulled
+// from their registry only.
+func (sm *StateMachine) SetImagePeers(fetcher *peerimage.Fetcher) {
+	sm.imagePeers = fetcher
+}
+
+// imagePeersEnabled reports whether images are fetched from peers. Not under
+// an image policy: an image loaded from a peer has no registry digest its
+// signature could be verified by.
+func (sm *StateMachine) imagePeersEnabled() bool {
+	return sm.imagePeers != nil && sm.imagePolicy == nil
+}
+
+// fetchFromPeers loads image from a device on the LAN and reports whether it
+// did. Any failure leaves the image to the pull from the registry.
+func (sm *StateMachine) fetchFromPeers(ctx context.Context, payload common.TransitionPayload, image string) bool {
+	topicForLogStream := payload.ContainerName.Prod
+
+	peer, err := sm.imagePeers.Fetch(ctx, image, sm.registryCredentials(payload))
+	if err != nil {
+		if !errors.Is(err, peerimage.ErrNoPeer) && ctx.Err() == nil {
+			log.Debug().Err(err).Msgf("failed to fetch %s from the LAN", image)
+			sm.LogManager.Write(topicForLogStream, fmt.Sprintf("Could not fetch %s from a device on the LAN, downloading it from the registry", image))
+		}
+		return false
+	}
+
+	sm.LogManager.Write(topicForLogStream, fmt.Sprintf("Fetched %s from %s on the LAN", image, peer.Name))
+	return true
+}
+
+// fetchComposeImagesFromPeers fetches the images of the given services (all
+// services when none are given) from the devices on the LAN and returns the
+// services still to be pulled; done is set when none are left.
+func (sm *StateMachine) fetchComposeImagesFromPeers(ctx context.Context, payload common.TransitionPayload, services []string) (remaining []string, done bool) {
+	composeServices, ok := payload.DockerCompose["services"].(map[string]interface{})
+	if !ok {
+		return services, false
+	}
+
+	if len(services) == 0 {
+		for serviceName := range composeServices {
+			services = append(services, serviceName)
+		}
+		sort.Strings(services)
+	}
+
+	for _, serviceName := range services {
+		service, _ := composeServices[serviceName].(map[string]interface{})
+		if service == nil || service["image"] == nil || !sm.fetchFromPeers(ctx, payload, fmt.Sprint(service["image"])) {
+			remaining = append(remaining, serviceName)
+		}
+		if ctx.Err() != nil {
+			return services, false
+		}
+	}
+
+	return remaining, len(remaining) == 0
+}
@@ -26,7 +26,30 @@ func (sm *StateMachine) publishApp(payload common.TransitionPayload, app *common
 		return err
 	}
 
-	err = sm.LogManager.Write(payload.PublishContainerName, "App build has finished, Starting to publish...")
+	// An image for several platforms was pushed by the build already.
+	if !buildPushesRelease(payload) {
+		err = sm.pushRelease(payload, app)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = sm.setState(app, common.PUBLISHED)
+	if err != nil {
+		return err
+	}
+
+	err = sm.LogManager.ClearLogHistory(payload.PublishContainerName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// pushRelease tags the image built for the device as the release and pushes it.
+func (sm *StateMachine) pushRelease(payload common.TransitionPayload, app *common.App) error {
+	err := sm.LogManager.Write(payload.PublishContainerName, "App build has finished, Starting to publish...")
 	if err != nil {
 		return err
 	}
@@ -82,16 +105,6 @@ func (sm *StateMachine) publishApp(payload common.TransitionPayload, app *common
 		return streamErr
 	}
 
-	err = sm.setState(app, common.PUBLISHED)
-	if err != nil {
-		return err
-	}
-
-	err = sm.LogManager.ClearLogHistory(payload.PublishContainerName)
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
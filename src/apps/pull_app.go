@@ -5,13 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"reagent/common"
-	"reagent/container"
 	"reagent/errdefs"
 )
 
 // pullComposeImages downloads the given services' images (all services when
 // none are given) via `docker compose pull`, streaming the CLI output to the
-// app's PROD log topic. ctx must be the context registered as the app's
+// app's PROD log topic. Images a device on the LAN has are fetched from it
+// instead. ctx must be the context registered as the app's
 // cancelable compose transition (registerComposeTransitionCancel): a cancel
 // kills the CLI process, and the kill surfaces as a canceled stream so
 // RequestAppState unwinds the transition as canceled rather than marking the
@@ -20,23 +20,35 @@ import (
 // before registration would be lost while the pull keeps running.
 func (sm *StateMachine) pullComposeImages(ctx context.Context, payload common.TransitionPayload, dockerComposePath string, services []string) error {
 	compose := sm.Container.Compose()
+	topicForLogStream := payload.ContainerName.Prod
 
-	pullOutput, pullCmd, err := compose.PullContext(ctx, dockerComposePath, services...)
-	if err != nil {
-		return composeTransitionErr(ctx, err)
+	if sm.imagePeersEnabled() {
+		var done bool
+		services, done = sm.fetchComposeImagesFromPeers(ctx, payload, services)
+		if done {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errdefs.DockerStreamCanceled(ctx.Err())
+		}
 	}
 
-	_, err = sm.LogManager.StreamLogsChannel(pullOutput, payload.ContainerName.Prod)
-	if err != nil {
-		return composeTransitionErr(ctx, err)
-	}
+	// A pull the connection dropped is retried; compose skips the images it
+	// already pulled and the daemon the layers it already has.
+	progress := sm.LogManager.NewPullProgress(topicForLogStream)
+	return sm.retryPull(ctx, topicForLogStream, progress, func() error {
+		pullOutput, pullCmd, err := compose.PullContext(ctx, dockerComposePath, services...)
+		if err != nil {
+			return err
+		}
 
-	err = pullCmd.Wait()
-	if err != nil {
-		return composeTransitionErr(ctx, err)
-	}
+		_, err = sm.LogManager.StreamLogsChannel(progress.Lines(pullOutput), topicForLogStream)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return pullCmd.Wait()
+	})
 }
 
 func (sm *StateMachine) pullComposeApp(payload common.TransitionPayload, app *common.App) error {
@@ -111,8 +123,6 @@ func (sm *StateMachine) pullApp(payload common.TransitionPayload, app *common.Ap
 		return sm.pullComposeApp(payload, app)
 	}
 
-	config := sm.Container.GetConfig()
-
 	if payload.Stage == common.DEV {
 		// cannot pull dev apps from registry
 		return errors.New("cannot pull dev apps")
@@ -144,30 +154,17 @@ func (sm *StateMachine) pullApp(payload common.TransitionPayload, app *common.Ap
 		return err
 	}
 
-	authConfig := container.AuthConfig{
-		Username: payload.RegisteryToken,
-		Password: config.ReswarmConfig.Secret,
-	}
-
-	fullImageNameWithVersion := fmt.Sprintf("%s:%s", payload.RegistryImageName.Prod, payload.NewestVersion)
-	pullOptions := container.PullOptions{
-		AuthConfig: authConfig,
-		PullID:     common.BuildDockerPullID(payload.AppKey, payload.AppName),
-	}
-
-	reader, err := sm.Container.Pull(context.Background(), fullImageNameWithVersion, pullOptions)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error occured while trying to pull the image: %s", err.Error())
-		sm.LogManager.Write(payload.ContainerName.Prod, errorMessage)
-		return err
-	}
-
-	err = sm.setState(app, common.DOWNLOADING)
-	if err != nil {
-		return err
-	}
+	// The pull's context lets a cancel reach a pull waiting to be retried too.
+	ctx, cancel := context.WithCancel(context.Background())
+	sm.registerComposeTransitionCancel(payload.Stage, payload.AppKey, cancel)
+	defer func() {
+		sm.clearComposeTransitionCancel(payload.Stage, payload.AppKey)
+		cancel()
+	}()
 
-	streamErr := sm.LogManager.StreamBlocking(payload.ContainerName.Prod, common.PULL, reader)
+	streamErr := sm.pullAppImage(ctx, payload, func() error {
+		return sm.setState(app, common.DOWNLOADING)
+	})
 	if streamErr != nil {
 		if errdefs.IsDockerStreamCanceled(streamErr) {
 			pullMessage := "The app download was canceled"
@@ -0,0 +1,140 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"reagent/common"
+	"reagent/container"
+	"reagent/errdefs"
+	"reagent/logging"
+	"strings"
+	"time"
+)
+
+// pullRetryDelays are the pauses before the retries of a pull a dropped
+// connection interrupted, one per retry. The daemon keeps the layers a pull
+// finished, so a retry only downloads the rest.
+var pullRetryDelays = []time.Duration{5 * time.Second, 15 * time.Second, 30 * time.Second, time.Minute}
+
+// retryablePullErrors are fragments of the errors a pull fails with when its
+// connection drops or the registry cannot be reached for a moment.
+var retryablePullErrors = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected EOF",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"Client.Timeout exceeded",
+	"no such host",
+	"network is unreachable",
+	"temporary failure in name resolution",
+	"server misbehaving",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+func isRetryablePullError(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, fragment := range retryablePullErrors {
+		if strings.Contains(message, strings.ToLower(fragment)) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPull runs pull until it succeeds or fails for a reason other than the
+// network, at most once more per entry of pullRetryDelays. A pull canceled
+// through ctx surfaces as a canceled stream, also while waiting to retry.
+func (sm *StateMachine) retryPull(ctx context.Context, topicForLogStream string, progress *logging.PullProgress, pull func() error) error {
+	attempts := len(pullRetryDelays) + 1
+	for attempt := 1; ; attempt++ {
+		err := pull()
+		if err == nil {
+			progress.Finish()
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return errdefs.DockerStreamCanceled(err)
+		}
+
+		if errdefs.IsDockerStreamCanceled(err) || attempt == attempts || !isRetryablePullError(err) {
+			return err
+		}
+
+		delay := pullRetryDelays[attempt-1]
+		message := fmt.Sprintf("The download was interrupted (%s), retrying in %s (attempt %d of %d)", err, delay, attempt+1, attempts)
+		writeErr := sm.LogManager.Write(topicForLogStream, message)
+		if writeErr != nil {
+			return writeErr
+		}
+
+		select {
+		case <-ctx.Done():
+			return errdefs.DockerStreamCanceled(ctx.Err())
+		case <-time.After(delay):
+		}
+
+		progress.Retrying(attempt + 1)
+	}
+}
+
+// pullAppImage pulls the newest version of a single-container app, retrying
+// when the connection drops, unless a device on the LAN has it (see
+// SetImagePeers). started is called once the registry has accepted the first
+// pull, or before the devices on the LAN are asked. ctx must be registered as the app's cancelable transition,
+// so that a cancel also reaches a pull waiting to be retried.
+func (sm *StateMachine) pullAppImage(ctx context.Context, payload common.TransitionPayload, started func() error) error {
+	config := sm.Container.GetConfig()
+	topicForLogStream := payload.ContainerName.Prod
+
+	fullImageNameWithVersion := fmt.Sprintf("%s:%s", payload.RegistryImageName.Prod, payload.NewestVersion)
+	pullOptions := container.PullOptions{
+		AuthConfig: container.AuthConfig{
+			Username: payload.RegisteryToken,
+			Password: config.ReswarmConfig.Secret,
+		},
+		PullID: common.BuildDockerPullID(payload.AppKey, payload.AppName),
+	}
+
+	if sm.imagePeersEnabled() {
+		if started != nil {
+			err := started()
+			started = nil
+			if err != nil {
+				return err
+			}
+		}
+
+		if sm.fetchFromPeers(ctx, payload, fullImageNameWithVersion) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errdefs.DockerStreamCanceled(ctx.Err())
+		}
+	}
+
+	progress := sm.LogManager.NewPullProgress(topicForLogStream)
+	return sm.retryPull(ctx, topicForLogStream, progress, func() error {
+		reader, err := sm.Container.Pull(ctx, fullImageNameWithVersion, pullOptions)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Error occured while trying to pull the image: %s", err.Error())
+			sm.LogManager.Write(topicForLogStream, errorMessage)
+			return err
+		}
+
+		if started != nil {
+			err = started()
+			started = nil
+			if err != nil {
+				reader.Close()
+				return err
+			}
+		}
+
+		return sm.LogManager.StreamBlocking(topicForLogStream, common.PULL, progress.Reader(reader))
+	})
+}
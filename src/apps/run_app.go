@@ -9,6 +9,7 @@ import (
 	"reagent/config"
 	reagentcontainer "reagent/container"
 	"reagent/errdefs"
+	"reagent/localrouter"
 	reagentnetwork "reagent/network"
 	"reagent/system"
 	"reagent/tunnel"
@@ -354,6 +355,15 @@ func (sm *StateMachine) runProdComposeApp(payload common.TransitionPayload, app
 		return err
 	}
 
+	// Run the services by the digests their signatures were verified for;
+	// the pull and compose up below then fetch exactly those.
+	if sm.imagePolicy != nil {
+		payload, err = sm.pinComposeImages(payload, app)
+		if err != nil {
+			return err
+		}
+	}
+
 	dockerComposePath, err := sm.SetupComposeFiles(payload, app, false)
 	if err != nil {
 		return err
@@ -702,6 +712,12 @@ func buildDefaultEnvironmentVariables(config *config.Config, payload common.Tran
 		)
 	}
 
+	// The agent's own router, for apps that want their publishes to survive
+	// an uplink outage. Apps log in with the APP_AUTH_ID credential above.
+	if config.CommandLineArguments != nil && config.CommandLineArguments.LocalRouterPort != 0 {
+		environmentVariables = append(environmentVariables, fmt.Sprintf("LOCAL_ROUTER_URL=%s", localrouter.URL(config.CommandLineArguments.LocalRouterPort)))
+	}
+
 	// Computed at container start: an IP change is reflected on the next app
 	// restart. LAN deployments are expected to use static IPs or DHCP
 	// reservations.
@@ -830,6 +846,14 @@ func (sm *StateMachine) computeContainerConfigs(payload common.TransitionPayload
 			}
 		}
 
+		if sm.imagePolicy != nil {
+			pinned, err := sm.verifyAppImages(payload, app, []string{fullImageNameWithTag})
+			if err != nil {
+				return nil, nil, err
+			}
+			fullImageNameWithTag = pinned[fullImageNameWithTag]
+		}
+
 		var missingDefaultEnvs []string
 		for _, templateEnvString := range environmentTemplateDefaults {
 			envStringSplit := strings.Split(templateEnvString, "=")
@@ -915,6 +939,26 @@ func (sm *StateMachine) computeContainerConfigs(payload common.TransitionPayload
 	return &containerConfig, &hostConfig, nil
 }
 
+// recreateContainer removes the container so that createContainer creates it
+// anew. It returns the ContainerNotFound error the creation goes on from.
+func (sm *StateMachine) recreateContainer(containerID string) error {
+	removeContainerContext, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	err := sm.Container.RemoveContainerByID(removeContainerContext, containerID, map[string]interface{}{"force": true})
+	if err != nil && !errdefs.IsContainerNotFound(err) {
+		return err
+	}
+
+	waitForRemovalContext, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	_, err = sm.Container.WaitForContainerByID(waitForRemovalContext, containerID, container.WaitConditionRemoved)
+	if err != nil && !errdefs.IsContainerNotFound(err) {
+		return err
+	}
+
+	return errdefs.ContainerNotFound(errors.New("container was recreated"))
+}
+
 func (sm *StateMachine) createContainer(payload common.TransitionPayload, app *common.App, cConfig *container.Config, hConfig *container.HostConfig) (string, error) {
 	var containerID string
 	var containerName string
@@ -928,27 +972,17 @@ func (sm *StateMachine) createContainer(payload common.TransitionPayload, app *c
 	getContainerContext, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
 	cont, err := sm.Container.GetContainer(getContainerContext, containerName)
-	if err == nil && sm.containerNetworkConfigOutdated(cont, hConfig, containerName) {
+	if err == nil && app.Stage == common.PROD && sm.imagePolicy != nil && cont.Image != cConfig.Image {
+		// The existing container may run an image that was never verified,
+		// or one its tag has since been moved off: run the verified digest.
+		log.Info().Str("container", containerName).Msg("Recreating container to run the verified image digest")
+		err = sm.recreateContainer(cont.ID)
+	} else if err == nil && sm.containerNetworkConfigOutdated(cont, hConfig, containerName) {
 		// Network mode and port bindings are immutable on an existing
 		// container: recreate to apply them (migrates pre-managed-port
 		// containers off host networking, and picks up reassigned ports).
 		log.Info().Str("container", containerName).Msg("Recreating container to apply updated network/port configuration")
-
-		removeContainerContext, cancel := context.WithTimeout(context.Background(), time.Second*30)
-		defer cancel()
-		err = sm.Container.RemoveContainerByID(removeContainerContext, cont.ID, map[string]interface{}{"force": true})
-		if err != nil && !errdefs.IsContainerNotFound(err) {
-			return "", err
-		}
-
-		waitForRemovalContext, cancel := context.WithTimeout(context.Background(), time.Second*30)
-		defer cancel()
-		_, err = sm.Container.WaitForContainerByID(waitForRemovalContext, cont.ID, container.WaitConditionRemoved)
-		if err != nil && !errdefs.IsContainerNotFound(err) {
-			return "", err
-		}
-
-		err = errdefs.ContainerNotFound(errors.New("container was recreated"))
+		err = sm.recreateContainer(cont.ID)
 	}
 	if err != nil {
 		if !errdefs.IsContainerNotFound(err) {
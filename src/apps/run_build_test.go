@@ -1,7 +1,9 @@
 package apps
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"path/filepath"
 	"strings"
@@ -13,6 +15,7 @@ import (
 	containerpkg "reagent/container"
 	"reagent/errdefs"
 	"reagent/logging"
+	"reagent/peerimage"
 	"reagent/store"
 	"reagent/testutil/builders"
 	"reagent/testutil/fakes"
@@ -77,6 +80,8 @@ func wiredRunBuildSM(t *testing.T) (*StateMachine, *mocks.Container, *store.AppS
 	cfg := runbuildTempConfig(t)
 
 	mockContainer.EXPECT().GetConfig().Return(cfg).Maybe()
+	// No buildx: single-container builds take the classic build API.
+	mockContainer.EXPECT().Buildx().Return(&containerpkg.Buildx{}).Maybe()
 
 	appStore := store.NewAppStore(db, msg)
 	observer := NewObserver(mockContainer, &appStore, nil)
@@ -559,6 +564,29 @@ func TestPullApp(t *testing.T) {
 		assert.Contains(t, states, common.PRESENT)
 	})
 
+	t.Run("without a device on the LAN that has the image, it is pulled", func(t *testing.T) {
+		sm, mc, st, msg, _ := wiredRunBuildSM(t)
+		sm.SetImagePeers(peerimage.NewFetcher(mc, func(ctx context.Context) ([]peerimage.Peer, error) { return nil, nil }, t.TempDir(), &peerimage.Key{}, 1))
+
+		app := seedApp(t, st, "pull-prod-peers", common.REMOVED, common.PROD)
+		payload := execPayload("pull-prod-peers", common.PRESENT, common.PROD)
+
+		mc.EXPECT().HandleRegistryLogins(mock.Anything).Return(nil).Once()
+		mc.EXPECT().
+			Pull(mock.Anything, mock.Anything, mock.Anything).
+			Return(fwdDockerStream(), nil).
+			Once()
+
+		fwdAllowLogs(mc)
+
+		err := sm.pullApp(payload, app)
+		require.NoError(t, err)
+
+		states := remoteStatesFor(msg)
+		assert.Contains(t, states, common.DOWNLOADING)
+		assert.Contains(t, states, common.PRESENT)
+	})
+
 	t.Run("rejects dev apps without touching the container", func(t *testing.T) {
 		sm, _, _, _, _ := wiredRunBuildSM(t)
 
@@ -634,6 +662,86 @@ func TestPullApp(t *testing.T) {
 		app.StateLock.Unlock()
 		assert.NotEqual(t, common.PRESENT, final)
 	})
+
+	t.Run("a pull the connection dropped is retried", func(t *testing.T) {
+		fwdFastPullRetries(t)
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "pull-prod-retry", common.REMOVED, common.PROD)
+		payload := execPayload("pull-prod-retry", common.PRESENT, common.PROD)
+
+		mc.EXPECT().HandleRegistryLogins(mock.Anything).Return(nil).Once()
+		mc.EXPECT().
+			Pull(mock.Anything, mock.Anything, mock.Anything).
+			Return(fwdErrorStream("read tcp 1.2.3.4:5->6.7.8.9:443: read: connection reset by peer"), nil).
+			Once()
+		mc.EXPECT().
+			Pull(mock.Anything, mock.Anything, mock.Anything).
+			Return(fwdDockerStream(), nil).
+			Once()
+
+		fwdAllowLogs(mc)
+
+		require.NoError(t, sm.pullApp(payload, app))
+
+		app.StateLock.Lock()
+		final := app.CurrentState
+		app.StateLock.Unlock()
+		assert.Equal(t, common.PRESENT, final)
+	})
+
+	t.Run("a pull that fails for good is not retried", func(t *testing.T) {
+		fwdFastPullRetries(t)
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "pull-prod-missing", common.REMOVED, common.PROD)
+		payload := execPayload("pull-prod-missing", common.PRESENT, common.PROD)
+
+		mc.EXPECT().HandleRegistryLogins(mock.Anything).Return(nil).Once()
+		mc.EXPECT().
+			Pull(mock.Anything, mock.Anything, mock.Anything).
+			Return(fwdErrorStream("manifest unknown"), nil).
+			Once()
+
+		fwdAllowLogs(mc)
+
+		err := sm.pullApp(payload, app)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "manifest unknown")
+	})
+
+	t.Run("a cancel reaches a pull waiting to be retried", func(t *testing.T) {
+		pullRetryDelays = []time.Duration{time.Minute}
+		t.Cleanup(func() { pullRetryDelays = defaultPullRetryDelays })
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "pull-prod-wait", common.REMOVED, common.PROD)
+		payload := execPayload("pull-prod-wait", common.PRESENT, common.PROD)
+
+		mc.EXPECT().HandleRegistryLogins(mock.Anything).Return(nil).Once()
+		mc.EXPECT().
+			Pull(mock.Anything, mock.Anything, mock.Anything).
+			RunAndReturn(func(ctx context.Context, image string, options containerpkg.PullOptions) (io.ReadCloser, error) {
+				time.AfterFunc(100*time.Millisecond, func() { sm.cancelComposeTransition(payload.Stage, payload.AppKey) })
+				return nil, errors.New("dial tcp: lookup registry.test: no such host")
+			}).
+			Once()
+
+		fwdAllowLogs(mc)
+
+		err := sm.pullApp(payload, app)
+		require.Error(t, err)
+		assert.True(t, errdefs.IsDockerStreamCanceled(err), "expected a DockerStreamCanceled error, got %v", err)
+	})
+}
+
+var defaultPullRetryDelays = pullRetryDelays
+
+// fwdFastPullRetries shortens the pauses between pull retries for the test.
+func fwdFastPullRetries(t *testing.T) {
+	t.Helper()
+	pullRetryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	t.Cleanup(func() { pullRetryDelays = defaultPullRetryDelays })
 }
 
 // fwdCanceledStream returns a reader whose Read fails with a "use of closed
@@ -801,6 +909,171 @@ func TestBuildApp(t *testing.T) {
 	})
 }
 
+func TestBuildAppSettings(t *testing.T) {
+	t.Run("classic build gets the environment as build args and the target", func(t *testing.T) {
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "build-args", common.REMOVED, common.DEV)
+		payload := execPayload("build-args", common.BUILT, common.DEV)
+		payload.EnvironmentTemplate = map[string]interface{}{
+			"GREETING": map[string]interface{}{"defaultValue": "hello"},
+			"LEVEL":    map[string]interface{}{"defaultValue": "info"},
+		}
+		payload.EnvironmentVariables = map[string]interface{}{
+			"LEVEL": map[string]interface{}{"value": "debug"},
+		}
+		payload.Build = common.BuildSettings{Target: "runtime"}
+
+		mc.EXPECT().
+			Build(mock.Anything, mock.Anything, mock.MatchedBy(func(options dockertypes.ImageBuildOptions) bool {
+				return options.Target == "runtime" &&
+					len(options.BuildArgs) == 2 &&
+					*options.BuildArgs["GREETING"] == "hello" &&
+					*options.BuildArgs["LEVEL"] == "debug"
+			})).
+			Return(fwdDockerStream(`{"stream":"built"}`), nil).
+			Once()
+
+		fwdAllowLogs(mc)
+
+		require.NoError(t, sm.buildApp(payload, app))
+	})
+
+	t.Run("BuildKit-only settings fail without buildx", func(t *testing.T) {
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "build-platforms", common.REMOVED, common.DEV)
+		payload := execPayload("build-platforms", common.BUILT, common.DEV)
+		payload.Build = common.BuildSettings{Platforms: []string{"linux/arm64"}}
+
+		fwdAllowLogs(mc)
+
+		err := sm.buildApp(payload, app)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "buildx")
+		mc.AssertNotCalled(t, "Build", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestBuildAbort(t *testing.T) {
+	// abortingBuild makes the classic build fail the way the docker client does
+	// once its context is canceled, after abort has canceled it.
+	abortingBuild := func(abort func()) func(ctx context.Context, path string, options dockertypes.ImageBuildOptions) (io.ReadCloser, error) {
+		return func(ctx context.Context, path string, options dockertypes.ImageBuildOptions) (io.ReadCloser, error) {
+			abort()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	}
+
+	expectCleanup := func(mc *mocks.Container) {
+		mc.EXPECT().PruneDanglingImages(mock.Anything).Return("", nil).Once()
+		mc.EXPECT().PruneBuildCache(mock.Anything).Return("", nil).Once()
+	}
+
+	t.Run("a canceled build is cleaned up and reported as canceled", func(t *testing.T) {
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "build-cancel", common.REMOVED, common.DEV)
+		payload := execPayload("build-cancel", common.BUILT, common.DEV)
+
+		mc.EXPECT().Build(mock.Anything, mock.Anything, mock.Anything).
+			RunAndReturn(abortingBuild(func() { sm.cancelBuildContext(app, errBuildCanceled) })).
+			Once()
+		expectCleanup(mc)
+		fwdAllowLogs(mc)
+
+		err := sm.buildApp(payload, app)
+		require.Error(t, err)
+		assert.True(t, errdefs.IsDockerStreamCanceled(err), "a canceled build does not fail the app")
+	})
+
+	t.Run("an aborted build is cleaned up and fails with the cause", func(t *testing.T) {
+		sm, mc, st, _, _ := wiredRunBuildSM(t)
+
+		app := seedApp(t, st, "build-abort", common.REMOVED, common.DEV)
+		payload := execPayload("build-abort", common.BUILT, common.DEV)
+
+		emergency := errors.New("disk emergency")
+		mc.EXPECT().Build(mock.Anything, mock.Anything, mock.Anything).
+			RunAndReturn(abortingBuild(func() { sm.AbortBuilds(emergency) })).
+			Once()
+		expectCleanup(mc)
+		fwdAllowLogs(mc)
+
+		err := sm.buildApp(payload, app)
+		require.ErrorIs(t, err, emergency)
+		assert.False(t, errdefs.IsDockerStreamCanceled(err))
+	})
+
+	t.Run("a timed out build fails", func(t *testing.T) {
+		sm, mc, _, _, _ := wiredRunBuildSM(t)
+
+		ctx, cancel := context.WithTimeoutCause(context.Background(), 0, fmt.Errorf("%w after 2h0m0s", errBuildTimedOut))
+		defer cancel()
+		expectCleanup(mc)
+
+		err := sm.buildErr(ctx, context.DeadlineExceeded, "build-timeout")
+		require.ErrorIs(t, err, errBuildTimedOut)
+		assert.False(t, errdefs.IsDockerStreamCanceled(err))
+	})
+
+	t.Run("a build that fails on its own is not cleaned up", func(t *testing.T) {
+		sm, _, _, _, _ := wiredRunBuildSM(t)
+
+		failure := errors.New("RUN step failed")
+		err := sm.buildErr(context.Background(), failure, "build-failure")
+		assert.Equal(t, failure, err)
+	})
+
+	t.Run("an aborted build does not prune under another build", func(t *testing.T) {
+		sm, _, _, _, _ := wiredRunBuildSM(t)
+
+		aborted := builders.BuildApp("build-aborted", common.BUILDING, common.DEV)
+		ctx, done := sm.startBuild(aborted)
+		defer done()
+		_, doneOther := sm.startBuild(builders.BuildApp("build-other", common.BUILDING, common.DEV))
+		defer doneOther()
+
+		sm.cancelBuildContext(aborted, errors.New("disk full"))
+
+		// no prune expected on the mock: it would fail the test
+		err := sm.buildErr(ctx, context.Canceled, "build-aborted")
+		require.Error(t, err)
+	})
+
+	t.Run("finished builds are forgotten", func(t *testing.T) {
+		sm, _, _, _, _ := wiredRunBuildSM(t)
+
+		app := builders.BuildApp("build-done", common.BUILDING, common.DEV)
+		ctx, done := sm.startBuild(app)
+		done()
+
+		sm.cancelBuildContext(app, errBuildCanceled)
+		assert.ErrorIs(t, context.Cause(ctx), context.Canceled)
+		assert.Empty(t, sm.buildCancels)
+	})
+}
+
+func TestBuildEnvironment(t *testing.T) {
+	payload := common.TransitionPayload{
+		EnvironmentTemplate: map[string]interface{}{
+			"NPM_TOKEN": map[string]interface{}{"defaultValue": "placeholder"},
+			"EMPTY":     map[string]interface{}{"defaultValue": nil},
+		},
+		EnvironmentVariables: map[string]interface{}{
+			"NPM_TOKEN": map[string]interface{}{"value": "s3cret"},
+			"PORT":      map[string]interface{}{"value": uint64(8080)},
+		},
+		Build: common.BuildSettings{Secrets: []string{"NPM_TOKEN"}},
+	}
+
+	buildArgs, buildSecrets := buildEnvironment(payload)
+
+	assert.Equal(t, map[string]string{"PORT": "8080"}, buildArgs)
+	assert.Equal(t, map[string]string{"NPM_TOKEN": "s3cret"}, buildSecrets)
+}
+
 // =============================================================================
 // publishApp (non-compose, dev) — build -> tag -> push -> PUBLISHED
 // =============================================================================
@@ -8,7 +8,9 @@ import (
 	"reagent/diskguard"
 	"reagent/errdefs"
 	"reagent/filesystem"
+	"reagent/imagesign"
 	"reagent/logging"
+	"reagent/peerimage"
 	"reagent/safe"
 	"sync"
 
@@ -33,6 +35,11 @@ type StateMachine struct {
 	composeTransitionCancels     map[string]context.CancelFunc
 	composeTransitionCancelMutex sync.Mutex
 
+	// buildCancels aborts the build in flight of each app, keyed by build ID
+	// (see startBuild).
+	buildCancels     map[string]context.CancelCauseFunc
+	buildCancelMutex sync.Mutex
+
 	// Per-device HMAC key for deriving each app's APP_AUTH_SECRET (cross-app
 	// data access). Fetched from the backend on connect and kept in memory
 	// ONLY — writing it into a container would let that app mint its
@@ -42,6 +49,14 @@ type StateMachine struct {
 	// outage cannot brick running apps.
 	appCredKey      string
 	appCredKeyMutex sync.RWMutex
+
+	// imagePolicy is the signature policy PROD app images are run under, nil
+	// while none is configured (see SetImagePolicy).
+	imagePolicy *imagesign.Policy
+
+	// imagePeers fetches PROD app images from the devices on the LAN before
+	// they are pulled, nil while that is off (see SetImagePeers).
+	imagePeers *peerimage.Fetcher
 }
 
 // SetAppCredKey stores the per-device app-credential key. Safe to call on
@@ -71,6 +86,7 @@ func NewStateMachine(container container.Container, logManager *logging.LogManag
 		Filesystem:               filesystem,
 		appStates:                appStates,
 		composeTransitionCancels: make(map[string]context.CancelFunc),
+		buildCancels:             make(map[string]context.CancelCauseFunc),
 	}
 }
 
@@ -79,7 +95,8 @@ func composeTransitionKey(stage common.Stage, appKey uint64) string {
 }
 
 // registerComposeTransitionCancel records the cancel func of an in-flight
-// cancelable compose transition so cancelUpdate/cancelPull can reach it.
+// cancelable compose transition, or of a single-container pull, so
+// cancelUpdate/cancelPull can reach it.
 func (sm *StateMachine) registerComposeTransitionCancel(stage common.Stage, appKey uint64, cancel context.CancelFunc) {
 	key := composeTransitionKey(stage, appKey)
 	sm.composeTransitionCancelMutex.Lock()
@@ -10,6 +10,7 @@ import (
 	"reagent/logging"
 	"reagent/safe"
 	"reagent/store"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
@@ -85,6 +86,11 @@ func (so *StateObserver) NotifyLocal(app *common.App, achievedState common.AppSt
 		return err
 	}
 
+	// Only running apps are advertised on the LAN
+	if so.AppManager != nil {
+		so.AppManager.lanAdvertiser.SetAppRunning(stage, appKey, achievedState == common.RUNNING)
+	}
+
 	// If app reached REMOVED state, check if backend requested removal before cleaning up database
 	if achievedState == common.REMOVED {
 		// Check what the backend requested
@@ -346,6 +352,7 @@ func (so *StateObserver) CorrectComposeAppState(requestedState common.Transition
 
 	app.StateLock.Lock()
 	currentAppState := app.CurrentState
+	app.Services = container.ComposeServiceStates(containers)
 	app.StateLock.Unlock()
 
 	var correctedAppState common.AppState
@@ -804,8 +811,12 @@ func (so *StateObserver) observeComposeAppState(observerCtx context.Context, sta
 				return
 			}
 
+			services := container.ComposeServiceStates(containers)
+
 			app.StateLock.Lock()
 			curAppState := app.CurrentState
+			servicesChanged := !reflect.DeepEqual(app.Services, services)
+			app.Services = services
 			app.StateLock.Unlock()
 
 			alreadyTransitioning := app.SecureTransition()
@@ -819,6 +830,16 @@ func (so *StateObserver) observeComposeAppState(observerCtx context.Context, sta
 				app.UnlockTransition()
 			}
 
+			// A service crashed, restarted or changed its health while the app
+			// as a whole kept its state; a change of the app's state below
+			// carries the services along.
+			if servicesChanged && latestAppState == curAppState {
+				err = so.NotifyRemote(app, curAppState)
+				if err != nil {
+					log.Warn().Err(err).Msgf("failed to publish the service states of compose app %s", composeAppName)
+				}
+			}
+
 			// status change detected
 			// always executed the state check on init
 			if lastKnownStatus == latestAppState && latestAppState == curAppState {
@@ -2,7 +2,9 @@ package apps
 
 import (
 	"errors"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"reagent/common"
 	"reagent/errdefs"
@@ -250,6 +252,183 @@ func TestSyncPortStatePersistsHostPortWithoutTunnels(t *testing.T) {
 	assert.Zero(t, savedRules[0].RemotePort, "no tunnel means no remote port")
 }
 
+// TestSyncPortStateAdvertisesLANEndpoints: the published host ports are
+// advertised over mDNS while the app runs — also without tunnels, which is
+// when the LAN address matters most — and withdrawn once it stops.
+func TestSyncPortStateAdvertisesLANEndpoints(t *testing.T) {
+	am, _, mockTunnel, appStore, _, cfg := amHarness(t)
+
+	mockTunnel.EXPECT().TunnelCapable().Return(false).Maybe()
+	mockTunnel.EXPECT().SaveRemotePorts(mock.Anything).Return(nil)
+
+	lanAdvertiser := tunnel.NewLANAdvertiser(cfg)
+	am.SetLANAdvertiser(lanAdvertiser)
+
+	app := amSeed(t, appStore, 15, "lanapp", common.RUNNING, common.PROD)
+	app.RequestedState = common.RUNNING
+
+	payload := amPayload(15, "lanapp", common.RUNNING, common.PROD)
+	ports, err := tunnel.PortForwardRuleToInterface([]common.PortForwardRule{
+		{RuleName: "web", Port: 8080, Protocol: "http", Active: true},
+		{RuleName: "plc", Port: 502, Protocol: "tcp", LocalIP: "192.168.1.50"},
+	})
+	require.NoError(t, err)
+	payload.Ports = ports
+
+	_, err = am.hostPorts.RecoverOrReserve(hostPortKey{Stage: common.PROD, AppKey: 15, Protocol: "tcp", Port: 8080}, 42001)
+	require.NoError(t, err)
+
+	require.NoError(t, am.syncPortState(payload, app))
+
+	endpoints := lanAdvertiser.Endpoints()
+	require.Len(t, endpoints, 1, "rules pointing away from the host are not advertised")
+	assert.Equal(t, "lanapp", endpoints[0].AppName)
+	assert.Equal(t, "web", endpoints[0].RuleName)
+	assert.Equal(t, uint64(8080), endpoints[0].Port)
+	assert.Equal(t, uint64(42001), endpoints[0].HostPort)
+	assert.Equal(t, "http://"+lanAdvertiser.Hostname()+":42001", endpoints[0].URL)
+
+	require.NoError(t, am.StateObserver.NotifyLocal(app, common.PRESENT))
+	assert.Empty(t, lanAdvertiser.Endpoints(), "stopped apps are not advertised")
+
+	require.NoError(t, am.StateObserver.NotifyLocal(app, common.RUNNING))
+	assert.Len(t, lanAdvertiser.Endpoints(), 1, "restarted apps are advertised again")
+}
+
+// TestSyncPortStateGuardsProtectedRules: a rule with an allow list gets a
+// tunnel to the access guard, which forwards to the managed host port, and an
+// unenforceable policy exposes nothing.
+func TestSyncPortStateGuardsProtectedRules(t *testing.T) {
+	am, _, mockTunnel, appStore, _, cfg := amHarness(t)
+
+	mockTunnel.EXPECT().TunnelCapable().Return(true).Maybe()
+
+	app := amSeed(t, appStore, 16, "guardedapp", common.RUNNING, common.PROD)
+	app.RequestedState = common.RUNNING
+	t.Cleanup(func() { am.accessGuard.ReleaseApp(common.PROD, 16) })
+
+	payload := amPayload(16, "guardedapp", common.RUNNING, common.PROD)
+	ports, err := tunnel.PortForwardRuleToInterface([]common.PortForwardRule{
+		{RuleName: "plc", Port: 502, Protocol: "tcp", Active: true, Access: &common.PortAccessPolicy{AllowedCIDRs: []string{"10.0.0.0/8"}}},
+		{RuleName: "ssh", Port: 22, Protocol: "tcp", Active: true, Access: &common.PortAccessPolicy{BasicAuth: &common.BasicAuthCredentials{Username: "u", Password: "p"}}},
+	})
+	require.NoError(t, err)
+	payload.Ports = ports
+
+	_, err = am.hostPorts.RecoverOrReserve(hostPortKey{Stage: common.PROD, AppKey: 16, Protocol: "tcp", Port: 502}, 42100)
+	require.NoError(t, err)
+	_, err = am.hostPorts.RecoverOrReserve(hostPortKey{Stage: common.PROD, AppKey: 16, Protocol: "tcp", Port: 22}, 42101)
+	require.NoError(t, err)
+
+	plcSubdomain := tunnel.CreateSubdomain(tunnel.TCP, uint64(cfg.ReswarmConfig.DeviceKey), "guardedapp", 502)
+	sshSubdomain := tunnel.CreateSubdomain(tunnel.TCP, uint64(cfg.ReswarmConfig.DeviceKey), "guardedapp", 22)
+
+	mockTunnel.EXPECT().Get(tunnel.CreateTunnelID(plcSubdomain, "tcp")).Return(nil).Once()
+	mockTunnel.EXPECT().Get(tunnel.CreateTunnelID(sshSubdomain, "tcp")).Return(nil).Once()
+	mockTunnel.EXPECT().AddTunnel(mock.Anything).RunAndReturn(func(conf tunnel.TunnelConfig) (tunnel.TunnelConfig, error) {
+		assert.Equal(t, plcSubdomain, conf.Subdomain, "basic auth on tcp cannot be enforced, so ssh is not exposed")
+		assert.Equal(t, "127.0.0.1", conf.LocalIP)
+		assert.NotEqual(t, uint64(42100), conf.LocalPort, "the tunnel dials the guard, not the app")
+		assert.True(t, conf.ProxyProtocol)
+		return conf, nil
+	}).Once()
+	mockTunnel.EXPECT().SaveRemotePorts(mock.Anything).Return(nil).Once()
+	mockTunnel.EXPECT().GetState().Return([]tunnel.TunnelState{}, nil).Once()
+
+	require.NoError(t, am.syncPortState(payload, app))
+}
+
+// TestSyncPortStateRemovesExpiredShareLinks: a rule whose access expired is
+// torn down like a deactivated one.
+func TestSyncPortStateRemovesExpiredShareLinks(t *testing.T) {
+	am, _, mockTunnel, appStore, _, cfg := amHarness(t)
+
+	mockTunnel.EXPECT().TunnelCapable().Return(true).Maybe()
+
+	app := amSeed(t, appStore, 17, "sharedapp", common.RUNNING, common.PROD)
+	app.RequestedState = common.RUNNING
+
+	expired := time.Now().Add(-time.Minute)
+	payload := amPayload(17, "sharedapp", common.RUNNING, common.PROD)
+	payload.Ports = spsPorts(t, common.PortForwardRule{
+		RuleName: "web", Port: 8080, Protocol: "http", Active: true,
+		Access: &common.PortAccessPolicy{Tokens: []common.AccessToken{{Token: "share-me", ExpiresAt: &expired}}},
+	})
+
+	_, err := am.hostPorts.RecoverOrReserve(hostPortKey{Stage: common.PROD, AppKey: 17, Protocol: "tcp", Port: 8080}, 42200)
+	require.NoError(t, err)
+
+	subdomain := tunnel.CreateSubdomain(tunnel.HTTP, uint64(cfg.ReswarmConfig.DeviceKey), "sharedapp", 8080)
+	mockTunnel.EXPECT().RemoveTunnel(mock.Anything).RunAndReturn(func(conf tunnel.TunnelConfig) error {
+		assert.Equal(t, subdomain, conf.Subdomain)
+		return nil
+	}).Once()
+	mockTunnel.EXPECT().SaveRemotePorts(mock.Anything).Return(nil).Once()
+	mockTunnel.EXPECT().GetState().Return([]tunnel.TunnelState{}, nil).Once()
+
+	require.NoError(t, am.syncPortState(payload, app))
+}
+
+// TestSyncPortStateEnforcesTrafficPolicy: a metered rule is fronted by the
+// agent with its bandwidth limit passed to frpc, and once the quota is used
+// up the tunnel goes away and stays away, reported as such upstream.
+func TestSyncPortStateEnforcesTrafficPolicy(t *testing.T) {
+	am, _, mockTunnel, appStore, msg, cfg := amHarness(t)
+
+	meter := tunnel.NewTrafficMeter(filepath.Join(t.TempDir(), tunnel.TrafficFileName))
+	am.SetTrafficMeter(meter)
+
+	mockTunnel.EXPECT().TunnelCapable().Return(true).Maybe()
+
+	app := amSeed(t, appStore, 18, "camapp", common.RUNNING, common.PROD)
+	app.RequestedState = common.RUNNING
+
+	payload := amPayload(18, "camapp", common.RUNNING, common.PROD)
+	payload.Ports = spsPorts(t, common.PortForwardRule{
+		RuleName: "stream", Port: 8080, Protocol: "http", Active: true,
+		Traffic: &common.PortTrafficPolicy{BandwidthLimit: "512KB", MonthlyQuota: 1000},
+	})
+
+	_, err := am.hostPorts.RecoverOrReserve(hostPortKey{Stage: common.PROD, AppKey: 18, Protocol: "tcp", Port: 8080}, 42300)
+	require.NoError(t, err)
+	t.Cleanup(func() { am.accessGuard.ReleaseApp(common.PROD, 18) })
+
+	subdomain := tunnel.CreateSubdomain(tunnel.HTTP, uint64(cfg.ReswarmConfig.DeviceKey), "camapp", 8080)
+	tunnelID := tunnel.CreateTunnelID(subdomain, "http")
+
+	mockTunnel.EXPECT().Get(tunnelID).Return(nil)
+	mockTunnel.EXPECT().AddTunnel(mock.Anything).RunAndReturn(func(conf tunnel.TunnelConfig) (tunnel.TunnelConfig, error) {
+		assert.Equal(t, "512KB", conf.BandwidthLimit)
+		assert.Equal(t, "127.0.0.1", conf.LocalIP)
+		assert.NotEqual(t, uint64(42300), conf.LocalPort, "frpc must dial the metering front, not the app")
+		return conf, nil
+	}).Once()
+	mockTunnel.EXPECT().SaveRemotePorts(mock.Anything).Return(nil)
+	mockTunnel.EXPECT().GetState().Return([]tunnel.TunnelState{}, nil)
+
+	require.NoError(t, am.syncPortState(payload, app))
+	assert.True(t, meter.Metered(tunnelID))
+
+	meter.Add(tunnelID, 600, 600)
+	require.True(t, meter.QuotaExceeded(tunnelID))
+
+	mockTunnel.EXPECT().RemoveTunnel(mock.Anything).RunAndReturn(func(conf tunnel.TunnelConfig) error {
+		assert.Equal(t, subdomain, conf.Subdomain)
+		return nil
+	}).Once()
+
+	require.NoError(t, am.syncPortState(payload, app))
+
+	calls := msg.GetPublishCalls()
+	require.NotEmpty(t, calls)
+	published := calls[len(calls)-1].Args
+	require.Len(t, published, 1)
+	state := published[0].(tunnel.TunnelState)
+	assert.Equal(t, "camapp", state.AppName)
+	assert.True(t, state.Error)
+	assert.True(t, state.Traffic.QuotaExceeded)
+}
+
 // TestSyncPortStateNoRulesIsANoop: an app that exposes nothing must not cost a
 // round trip on every state request.
 func TestSyncPortStateNoRulesIsANoop(t *testing.T) {
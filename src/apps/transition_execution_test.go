@@ -1,6 +1,7 @@
 package apps
 
 import (
+	"context"
 	"errors"
 	"path/filepath"
 	"testing"
@@ -387,16 +388,19 @@ func TestCancelHandlers(t *testing.T) {
 		assert.Contains(t, err.Error(), "cannot build prod apps")
 	})
 
-	t.Run("cancelBuild (dev, non-compose) cancels stream and sets REMOVED", func(t *testing.T) {
+	t.Run("cancelBuild (dev, non-compose) cancels the build context and sets REMOVED", func(t *testing.T) {
 		sm, mc, st, _ := wiredStateMachine(t)
 
 		app := seedApp(t, st, "cancel-build-dev", common.BUILDING, common.DEV)
 		payload := execPayload("cancel-build-dev", common.REMOVED, common.DEV)
 
-		mc.EXPECT().CancelStream(mock.Anything).Return(nil).Once()
+		mc.EXPECT().GetConfig().Return(builders.DefaultTestConfig()).Once()
+		ctx, done := sm.startBuild(app)
+		defer done()
 
 		err := sm.cancelBuild(payload, app)
 		require.NoError(t, err)
+		assert.ErrorIs(t, context.Cause(ctx), errBuildCanceled)
 
 		app.StateLock.Lock()
 		final := app.CurrentState
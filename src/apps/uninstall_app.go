@@ -24,6 +24,9 @@ func (sm *StateMachine) uninstallApp(payload common.TransitionPayload, app *comm
 	// Stop/restart keeps reservations so the app gets the same ports back.
 	if am := sm.StateObserver.AppManager; am != nil {
 		am.hostPorts.ReleaseApp(payload.Stage, payload.AppKey)
+		am.lanAdvertiser.RemoveApp(payload.Stage, payload.AppKey)
+		am.accessGuard.ReleaseApp(payload.Stage, payload.AppKey)
+		am.trafficMeter.UntrackApp(payload.Stage, payload.AppKey)
 	}
 
 	config := sm.Container.GetConfig()
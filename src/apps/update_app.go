@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"reagent/common"
-	"reagent/container"
 	"reagent/errdefs"
 	"time"
 
@@ -58,7 +57,6 @@ func (sm *StateMachine) updateApp(payload common.TransitionPayload, app *common.
 		}
 	}
 
-	config := sm.Container.GetConfig()
 	initMessage := fmt.Sprintf("Initialising download for the app: %s...", payload.AppName)
 	err = sm.LogManager.Write(payload.ContainerName.Prod, initMessage)
 	if err != nil {
@@ -80,26 +78,16 @@ func (sm *StateMachine) updateApp(payload common.TransitionPayload, app *common.
 		return err
 	}
 
-	authConfig := container.AuthConfig{
-		Username: payload.RegisteryToken,
-		Password: config.ReswarmConfig.Secret,
-	}
-
-	fullImageNameWithVersion := fmt.Sprintf("%s:%s", payload.RegistryImageName.Prod, payload.NewestVersion)
-	pullOptions := container.PullOptions{
-		AuthConfig: authConfig,
-		PullID:     common.BuildDockerPullID(payload.AppKey, payload.AppName),
-	}
-
-	log.Debug().Msgf("PULLING IMAGE: %s", fullImageNameWithVersion)
-	reader, err := sm.Container.Pull(context.Background(), fullImageNameWithVersion, pullOptions)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error occured while trying to pull the image: %s", err.Error())
-		sm.LogManager.Write(payload.ContainerName.Prod, errorMessage)
-		return err
-	}
+	// The pull's context lets a cancel reach a pull waiting to be retried too.
+	ctx, cancelPull := context.WithCancel(context.Background())
+	sm.registerComposeTransitionCancel(payload.Stage, payload.AppKey, cancelPull)
+	defer func() {
+		sm.clearComposeTransitionCancel(payload.Stage, payload.AppKey)
+		cancelPull()
+	}()
 
-	streamErr := sm.LogManager.StreamBlocking(payload.ContainerName.Prod, common.PULL, reader)
+	log.Debug().Msgf("PULLING IMAGE: %s:%s", payload.RegistryImageName.Prod, payload.NewestVersion)
+	streamErr := sm.pullAppImage(ctx, payload, nil)
 	if streamErr != nil {
 		if errdefs.IsDockerStreamCanceled(streamErr) {
 			pullMessage := "The update was canceled"
@@ -189,6 +177,20 @@ func (sm *StateMachine) updateComposeApp(payload common.TransitionPayload, app *
 		return errors.New("the app is already equal to the newest version")
 	}
 
+	// A running app that is to keep running is updated service by service,
+	// so the services the update does not change keep running through it.
+	// Otherwise, or when the services cannot be updated one by one, the
+	// project is taken down and installed anew.
+	plan, inPlace := planComposeUpdate(payload.DockerCompose, payload.NewDockerCompose)
+
+	app.StateLock.Lock()
+	inPlace = inPlace && app.CurrentState == common.RUNNING && app.RequestedState == common.RUNNING
+	app.ServiceUpdates = nil
+	if inPlace {
+		app.ServiceUpdates = plan.updates()
+	}
+	app.StateLock.Unlock()
+
 	err := sm.setState(app, common.UPDATING)
 	if err != nil {
 		return err
@@ -217,6 +219,10 @@ func (sm *StateMachine) updateComposeApp(payload common.TransitionPayload, app *
 		cancel()
 	}()
 
+	if inPlace {
+		return sm.updateComposeServices(ctx, payload, app, plan)
+	}
+
 	dockerComposePath, err := sm.SetupComposeFiles(payload, app, true)
 	if err != nil {
 		return err
@@ -251,19 +257,9 @@ func (sm *StateMachine) updateComposeApp(payload common.TransitionPayload, app *
 		return err
 	}
 
-	pullOutput, pullCmd, err := compose.PullContext(ctx, dockerComposePath)
-	if err != nil {
-		return composeTransitionErr(ctx, err)
-	}
-
-	_, err = sm.LogManager.StreamLogsChannel(pullOutput, payload.ContainerName.Prod)
+	err = sm.pullComposeImages(ctx, payload, dockerComposePath, nil)
 	if err != nil {
-		return composeTransitionErr(ctx, err)
-	}
-
-	err = pullCmd.Wait()
-	if err != nil {
-		return composeTransitionErr(ctx, err)
+		return err
 	}
 
 	pullMessage := fmt.Sprintf("Succesfully installed the app: %s (Version: %s)", payload.AppName, payload.NewestVersion)
@@ -0,0 +1,233 @@
+// Package bundle reads app bundles, the way an air-gapped device installs an
+// app without a registry. A bundle is a tar archive, optionally gzipped, of
+//
+//   - manifest.json: the app and release it holds, and the SHA-256 of every
+//     other file in the bundle
+//   - manifest.sig: a detached signature over manifest.json, by a signer under
+//     the pinned codesign roots (see codesign.VerifyDetached)
+//   - the `docker save` archives of the app's images
+//   - for compose apps, the compose definition as JSON
+//
+// in that order: the manifest comes first, so every file after it is checked
+// against it while it is extracted, and nothing unsigned is ever loaded.
+// Bundles reach the device through the file transfer channel, on a USB stick
+// or in a watched directory (see Watcher).
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Extension is the file extension of app bundles.
+const Extension = ".appbundle"
+
+const (
+	manifestName  = "manifest.json"
+	signatureName = "manifest.sig"
+)
+
+// maxManifestBytes caps the manifest and its signature, which are read into
+// memory.
+const maxManifestBytes = 1 << 20
+
+// File is a file in a bundle.
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes the app release a bundle holds.
+type Manifest struct {
+	AppKey     uint64 `json:"appKey"`
+	AppName    string `json:"appName"`
+	Version    string `json:"version"`
+	ReleaseKey uint64 `json:"releaseKey"`
+	// Architecture is the image architecture the bundle was built for, as in
+	// the device's image names (e.g. arm64, armv7). Empty bundles any.
+	Architecture string `json:"architecture,omitempty"`
+	// Images are `docker save` archives. A single-container app has exactly
+	// one, holding its image.
+	Images []File `json:"images"`
+	// Compose is the compose definition of a compose app.
+	Compose             *File          `json:"compose,omitempty"`
+	Environment         map[string]any `json:"environment,omitempty"`
+	EnvironmentTemplate map[string]any `json:"environmentTemplate,omitempty"`
+	Ports               []any          `json:"ports,omitempty"`
+}
+
+func (m *Manifest) files() []File {
+	files := append([]File{}, m.Images...)
+	if m.Compose != nil {
+		files = append(files, *m.Compose)
+	}
+	return files
+}
+
+func (m *Manifest) validate() error {
+	if m.AppKey == 0 || m.AppName == "" || m.Version == "" {
+		return errors.New("the manifest lacks the app key, name or version")
+	}
+
+	if len(m.Images) == 0 {
+		return errors.New("the manifest lists no images")
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range m.files() {
+		if !filepath.IsLocal(file.Path) || file.Path == manifestName || file.Path == signatureName {
+			return fmt.Errorf("invalid file path %q in the manifest", file.Path)
+		}
+		if seen[filepath.Clean(file.Path)] {
+			return fmt.Errorf("%s is listed twice in the manifest", file.Path)
+		}
+		seen[filepath.Clean(file.Path)] = true
+
+		if len(file.SHA256) != sha256.Size*2 {
+			return fmt.Errorf("invalid checksum for %s in the manifest", file.Path)
+		}
+	}
+
+	return nil
+}
+
+// Extract verifies the bundle at path and extracts its files into dir, which
+// must exist. verify checks the signature of the manifest. A bundle whose
+// signature or checksums do not match is rejected before any of its files
+// could be used; dir may hold some of them then.
+func Extract(path string, dir string, verify func(data []byte, signature []byte) error) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var archive io.Reader = reader
+	magic, err := reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		archive = gzipReader
+	}
+
+	tarReader := tar.NewReader(archive)
+
+	manifestData, err := readEntry(tarReader, manifestName)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := readEntry(tarReader, signatureName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verify(manifestData, signature)
+	if err != nil {
+		return nil, fmt.Errorf("the bundle signature is invalid: %w", err)
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	err = manifest.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]File)
+	for _, file := range manifest.files() {
+		pending[filepath.Clean(file.Path)] = file
+	}
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		name := filepath.Clean(header.Name)
+		listed, ok := pending[name]
+		if !ok || header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s is not listed in the manifest", header.Name)
+		}
+		delete(pending, name)
+
+		err = extractFile(tarReader, filepath.Join(dir, name), listed.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range pending {
+		return nil, fmt.Errorf("%s is missing from the bundle", name)
+	}
+
+	return &manifest, nil
+}
+
+// readEntry reads the next entry of the archive, which must be name.
+func readEntry(tarReader *tar.Reader, name string) ([]byte, error) {
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, fmt.Errorf("the bundle does not start with %s and %s: %w", manifestName, signatureName, err)
+	}
+
+	if filepath.Clean(header.Name) != name {
+		return nil, fmt.Errorf("the bundle does not start with %s and %s", manifestName, signatureName)
+	}
+
+	if header.Size > maxManifestBytes {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+
+	return io.ReadAll(io.LimitReader(tarReader, maxManifestBytes))
+}
+
+func extractFile(reader io.Reader, target string, checksum string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), reader)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return fmt.Errorf("the checksum of %s does not match the manifest", filepath.Base(target))
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,195 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	name string
+	data []byte
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeBundle writes the entries as a tar, gzipped if asked, and returns its
+// path.
+func writeBundle(t *testing.T, entries []entry, gzipped bool) string {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	for _, e := range entries {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.data))}))
+		_, err := tarWriter.Write(e.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+
+	data := buffer.Bytes()
+	if gzipped {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		_, err := gzipWriter.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gzipWriter.Close())
+		data = compressed.Bytes()
+	}
+
+	path := filepath.Join(t.TempDir(), "app"+Extension)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	return path
+}
+
+func manifestEntries(t *testing.T, manifest Manifest) []entry {
+	t.Helper()
+
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	return []entry{{manifestName, data}, {signatureName, []byte("signature")}}
+}
+
+func acceptSignature(data []byte, signature []byte) error {
+	if string(signature) != "signature" {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func TestExtract(t *testing.T) {
+	image := []byte("image archive")
+	compose := []byte(`{"services":{}}`)
+	manifest := Manifest{
+		AppKey:     7,
+		AppName:    "sensor",
+		Version:    "1.2.0",
+		ReleaseKey: 12,
+		Images:     []File{{Path: "images/sensor.tar", SHA256: checksum(image)}},
+		Compose:    &File{Path: "compose.json", SHA256: checksum(compose)},
+	}
+
+	for _, gzipped := range []bool{false, true} {
+		t.Run(fmt.Sprintf("extracts a valid bundle (gzipped: %v)", gzipped), func(t *testing.T) {
+			entries := append(manifestEntries(t, manifest), entry{"images/sensor.tar", image}, entry{"compose.json", compose})
+			path := writeBundle(t, entries, gzipped)
+			dir := t.TempDir()
+
+			extracted, err := Extract(path, dir, acceptSignature)
+			require.NoError(t, err)
+			assert.Equal(t, manifest, *extracted)
+
+			data, err := os.ReadFile(filepath.Join(dir, "images/sensor.tar"))
+			require.NoError(t, err)
+			assert.Equal(t, image, data)
+		})
+	}
+
+	t.Run("rejects a bad signature", func(t *testing.T) {
+		entries := append(manifestEntries(t, manifest), entry{"images/sensor.tar", image}, entry{"compose.json", compose})
+		entries[1].data = []byte("forged")
+		path := writeBundle(t, entries, false)
+
+		_, err := Extract(path, t.TempDir(), acceptSignature)
+		assert.ErrorContains(t, err, "signature is invalid")
+	})
+
+	t.Run("rejects a file that does not match its checksum", func(t *testing.T) {
+		entries := append(manifestEntries(t, manifest), entry{"images/sensor.tar", []byte("tampered")}, entry{"compose.json", compose})
+		path := writeBundle(t, entries, false)
+
+		_, err := Extract(path, t.TempDir(), acceptSignature)
+		assert.ErrorContains(t, err, "checksum of sensor.tar does not match")
+	})
+
+	t.Run("rejects an unlisted file", func(t *testing.T) {
+		entries := append(manifestEntries(t, manifest), entry{"images/sensor.tar", image}, entry{"compose.json", compose}, entry{"extra.sh", []byte("x")})
+		path := writeBundle(t, entries, false)
+
+		_, err := Extract(path, t.TempDir(), acceptSignature)
+		assert.ErrorContains(t, err, "extra.sh is not listed")
+	})
+
+	t.Run("rejects a missing file", func(t *testing.T) {
+		entries := append(manifestEntries(t, manifest), entry{"images/sensor.tar", image})
+		path := writeBundle(t, entries, false)
+
+		_, err := Extract(path, t.TempDir(), acceptSignature)
+		assert.ErrorContains(t, err, "compose.json is missing")
+	})
+
+	t.Run("rejects a bundle not starting with the manifest", func(t *testing.T) {
+		entries := append([]entry{{"images/sensor.tar", image}}, manifestEntries(t, manifest)...)
+		path := writeBundle(t, entries, false)
+
+		_, err := Extract(path, t.TempDir(), acceptSignature)
+		assert.ErrorContains(t, err, "does not start with manifest.json")
+	})
+
+	t.Run("rejects paths outside the target directory", func(t *testing.T) {
+		escaping := manifest
+		escaping.Images = []File{{Path: "../sensor.tar", SHA256: checksum(image)}}
+		escaping.Compose = nil
+		path := writeBundle(t, append(manifestEntries(t, escaping), entry{"../sensor.tar", image}), false)
+
+		_, err := Extract(path, t.TempDir(), acceptSignature)
+		assert.ErrorContains(t, err, "invalid file path")
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "user", "STICK")
+	require.NoError(t, os.MkdirAll(nested, 0o755))
+
+	var imported []string
+	watcher := Watcher{
+		Dirs:   []string{dir, filepath.Join(dir, "missing")},
+		Import: func(path string) error { imported = append(imported, path); return nil },
+	}
+
+	path := filepath.Join(nested, "app"+Extension)
+	require.NoError(t, os.WriteFile(path, []byte("partial"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(nested, "notes.txt"), []byte("x"), 0o644))
+
+	watcher.scan()
+	assert.Empty(t, imported, "a new bundle may still be copied")
+
+	require.NoError(t, os.WriteFile(path, []byte("partial, then complete"), 0o644))
+	watcher.scan()
+	assert.Empty(t, imported, "a bundle that grew is still being copied")
+
+	watcher.scan()
+	assert.Equal(t, []string{path}, imported)
+
+	watcher.scan()
+	assert.Len(t, imported, 1, "a bundle is imported once")
+
+	require.NoError(t, os.Remove(path))
+	watcher.scan()
+	require.NoError(t, os.WriteFile(path, []byte("partial, then complete"), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	watcher.scan()
+	watcher.scan()
+	assert.Len(t, imported, 2, "a bundle copied again is imported again")
+}
+
+func TestDirs(t *testing.T) {
+	assert.Equal(t, []string{"/apps/bundles", "/media", "/run/media"}, Dirs("/apps", "/media, /run/media,"))
+	assert.Equal(t, []string{"/apps/bundles"}, Dirs("/apps", ""))
+}
@@ -0,0 +1,146 @@
+package bundle
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// watchDepth is how deep below a watched directory bundles are looked for: a
+// USB stick is mounted at /media/<user>/<label>, a bundle may sit in a folder
+// on it.
+const watchDepth = 4
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watcher imports the bundles that appear in its directories. A bundle is
+// imported once it has stopped changing between two scans, so a bundle still
+// being copied is left alone. Each bundle is imported once per version of the
+// file, whether the import succeeds or not.
+type Watcher struct {
+	Dirs     []string
+	Interval time.Duration
+	Import   func(path string) error
+
+	settling map[string]fileStamp
+	handled  map[string]fileStamp
+}
+
+// Run scans the directories every Interval until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.scan()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) scan() {
+	if w.settling == nil {
+		w.settling = make(map[string]fileStamp)
+		w.handled = make(map[string]fileStamp)
+	}
+
+	found := make(map[string]fileStamp)
+	for _, dir := range w.Dirs {
+		for path, stamp := range findBundles(dir) {
+			found[path] = stamp
+		}
+	}
+
+	for path, stamp := range found {
+		if w.handled[path] == stamp {
+			continue
+		}
+
+		if w.settling[path] != stamp {
+			w.settling[path] = stamp
+			continue
+		}
+
+		delete(w.settling, path)
+		w.handled[path] = stamp
+
+		log.Info().Msgf("importing the app bundle %s", path)
+		err := w.Import(path)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to import the app bundle %s", path)
+		}
+	}
+
+	// a bundle that is removed and copied again is imported again
+	for path := range w.handled {
+		if _, ok := found[path]; !ok {
+			delete(w.handled, path)
+		}
+	}
+	for path := range w.settling {
+		if _, ok := found[path]; !ok {
+			delete(w.settling, path)
+		}
+	}
+}
+
+func findBundles(root string) map[string]fileStamp {
+	found := make(map[string]fileStamp)
+	rootDepth := strings.Count(filepath.Clean(root), string(filepath.Separator))
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// a missing directory, a mount point that went away
+			if entry != nil && entry.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			if strings.Count(path, string(filepath.Separator))-rootDepth >= watchDepth {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(entry.Name(), Extension) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		found[path] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+
+	return found
+}
+
+// Dirs returns the directories bundles are imported from: the bundles
+// directory under appsDir, which the agent creates, and the comma separated
+// extra ones, e.g. where USB sticks are mounted.
+func Dirs(appsDir string, extra string) []string {
+	dirs := []string{filepath.Join(appsDir, "bundles")}
+	for _, dir := range strings.Split(extra, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
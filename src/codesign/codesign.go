@@ -8,6 +8,9 @@
 // same origin as the binary and skipped when absent — so the pinned signature
 // is the real defense against a compromised distribution server.
 //
+// The same roots authenticate the app bundles an air-gapped device installs
+// from (VerifyDetached), which are signed by a leaf under them.
+//
 // Pinning is chainless with respect to the machine store: the signer must
 // chain to OUR embedded root, so a device that trusts many enterprise CAs
 // still won't accept a binary signed by a different one.
@@ -0,0 +1,89 @@
+package codesign
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+var (
+	// ErrNoPinnedRoot: no root is embedded that a signature could chain to.
+	ErrNoPinnedRoot = errors.New("no pinned IronFlock root is configured")
+	// ErrMalformedSignature: the signature file is not a certificate chain
+	// followed by a signature.
+	ErrMalformedSignature = errors.New("malformed signature")
+	// ErrSignatureMismatch: validly signed, but not this data.
+	ErrSignatureMismatch = errors.New("signature does not match the signed data")
+)
+
+// signatureBlockType is the PEM type of the signature in a detached signature.
+const signatureBlockType = "SIGNATURE"
+
+// VerifyDetached checks a detached signature over data, e.g. an app bundle's
+// manifest. The signature is PEM: the signer's certificate, the intermediates
+// it chains through and a SIGNATURE block holding the raw signature, made with
+// SHA-256 (ECDSA, RSA PKCS #1 v1.5) or Ed25519. The signer must chain to a
+// pinned root. Unlike Verify there is no transition period: without a pinned
+// root nothing verifies.
+func VerifyDetached(data []byte, signature []byte) error {
+	if len(pinnedRoots) == 0 {
+		return ErrNoPinnedRoot
+	}
+	return verifyDetached(pinnedRoots, data, signature)
+}
+
+func verifyDetached(roots []*x509.Certificate, data []byte, signature []byte) error {
+	var certs []*x509.Certificate
+	var rawSignature []byte
+
+	rest := signature
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return ErrMalformedSignature
+			}
+			certs = append(certs, cert)
+		case signatureBlockType:
+			rawSignature = block.Bytes
+		}
+	}
+
+	if len(certs) == 0 || len(rawSignature) == 0 {
+		return ErrMalformedSignature
+	}
+
+	leaf := certs[0]
+	err := verifyChainToPinnedRoots(roots, leaf, certs[1:])
+	if err != nil {
+		return err
+	}
+
+	var algorithm x509.SignatureAlgorithm
+	switch leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		algorithm = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		algorithm = x509.SHA256WithRSA
+	case ed25519.PublicKey:
+		algorithm = x509.PureEd25519
+	default:
+		return ErrMalformedSignature
+	}
+
+	if leaf.CheckSignature(algorithm, data, rawSignature) != nil {
+		return ErrSignatureMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package codesign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signDetached makes a detached signature over data with key, carrying the
+// given certificate chain (leaf first).
+func signDetached(t *testing.T, data []byte, key *ecdsa.PrivateKey, chain ...*x509.Certificate) []byte {
+	t.Helper()
+
+	digest := sha256.Sum256(data)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	var out []byte
+	for _, cert := range chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: signatureBlockType, Bytes: signature})...)
+}
+
+func TestVerifyDetached(t *testing.T) {
+	root, rootKey := mkCert(t, "IronFlock Root", true, nil, nil)
+	inter, interKey := mkCert(t, "IronFlock Intermediate", true, root, rootKey)
+	leaf, leafKey := mkCert(t, "IronFlock Bundles", false, inter, interKey)
+	roots := []*x509.Certificate{root}
+
+	manifest := []byte(`{"appName":"sensor","version":"1.2.0"}`)
+	signature := signDetached(t, manifest, leafKey, leaf, inter)
+
+	t.Run("accepts a signer under a pinned root", func(t *testing.T) {
+		assert.NoError(t, verifyDetached(roots, manifest, signature))
+	})
+
+	t.Run("rejects other data", func(t *testing.T) {
+		err := verifyDetached(roots, []byte(`{"appName":"sensor","version":"6.6.6"}`), signature)
+		assert.ErrorIs(t, err, ErrSignatureMismatch)
+	})
+
+	t.Run("rejects a foreign signer", func(t *testing.T) {
+		foreignRoot, foreignKey := mkCert(t, "Someone Else", true, nil, nil)
+		foreignLeaf, foreignLeafKey := mkCert(t, "Bundles", false, foreignRoot, foreignKey)
+
+		err := verifyDetached(roots, manifest, signDetached(t, manifest, foreignLeafKey, foreignLeaf))
+		assert.ErrorIs(t, err, ErrWrongSigner)
+	})
+
+	t.Run("rejects a signature without a chain", func(t *testing.T) {
+		err := verifyDetached(roots, manifest, signDetached(t, manifest, leafKey))
+		assert.ErrorIs(t, err, ErrMalformedSignature)
+
+		err = verifyDetached(roots, manifest, []byte("not pem"))
+		assert.ErrorIs(t, err, ErrMalformedSignature)
+	})
+}
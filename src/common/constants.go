@@ -8,6 +8,8 @@ import (
 type AppState string
 type Stage string
 type UpdateStatus string
+type ServiceChange string
+type ServiceUpdateState string
 type Environment string
 
 func IsCancelableState(appState AppState) bool {
@@ -162,6 +164,25 @@ const (
 	PENDING_REMOTE_CONFIRMATION UpdateStatus = "pending_remote_confirmation"
 )
 
+// Why a service of a compose app is recreated by an update.
+const (
+	SERVICE_ADDED         ServiceChange = "added"
+	SERVICE_REMOVED       ServiceChange = "removed"
+	SERVICE_IMAGE_CHANGED ServiceChange = "image_changed"
+	// SERVICE_CONFIG_CHANGED: the same image, run differently.
+	SERVICE_CONFIG_CHANGED ServiceChange = "config_changed"
+	// SERVICE_DEPENDENCY_CHANGED: unchanged itself, but it shares the network,
+	// volumes or lifecycle of a service that is recreated.
+	SERVICE_DEPENDENCY_CHANGED ServiceChange = "dependency_changed"
+)
+
+const (
+	SERVICE_UPDATE_PENDING  ServiceUpdateState = "pending"
+	SERVICE_UPDATE_UPDATING ServiceUpdateState = "updating"
+	SERVICE_UPDATE_DONE     ServiceUpdateState = "done"
+	SERVICE_UPDATE_FAILED   ServiceUpdateState = "failed"
+)
+
 const (
 	DEV  Stage = "DEV"
 	PROD Stage = "PROD"
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"reagent/config"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/semaphore"
@@ -44,8 +45,48 @@ type App struct {
 	ReleaseBuild        bool
 	Version             string
 	LastUpdated         Timestamp
-	TransitionLock      *semaphore.Weighted
-	StateLock           sync.Mutex
+	// ImageSignatures is the outcome of the last signature check of the app's
+	// images, nil while no image signature policy is configured.
+	ImageSignatures []ImageSignature
+	// ServiceUpdates is how the last update of a compose app went per
+	// service, nil unless it was updated service by service.
+	ServiceUpdates []ServiceUpdate
+	// Services is the state of each service of a compose app, as the state
+	// observer last saw it.
+	Services       []ServiceState
+	TransitionLock *semaphore.Weighted
+	StateLock      sync.Mutex
+}
+
+// ImageSignature is the signature check of an app image: by whom and in which
+// format the digest it runs as was signed, or why it could not be verified.
+type ImageSignature struct {
+	Image    string `json:"image"`
+	Digest   string `json:"digest,omitempty"`
+	Verified bool   `json:"verified"`
+	Format   string `json:"format,omitempty"`
+	Signer   string `json:"signer,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ServiceUpdate is the update of one service of a compose app: why it is
+// recreated (Change) and how far that got (State).
+type ServiceUpdate struct {
+	Service string             `json:"service"`
+	Change  ServiceChange      `json:"change"`
+	State   ServiceUpdateState `json:"state"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// ServiceState is the state of the container of one service of a compose app.
+// State is Docker's (running, exited, restarting, ...); ExitCode is only set
+// for an exited container, Health only for one with a health check.
+type ServiceState struct {
+	Service   string `json:"service"`
+	Container string `json:"container"`
+	State     string `json:"state"`
+	ExitCode  int64  `json:"exit_code"`
+	Health    string `json:"health,omitempty"`
 }
 
 func (app *App) SecureTransition() bool {
@@ -100,6 +141,62 @@ type PortForwardRule struct {
 	// round-trips through t_device_to_app.ports is just a stale cached hint.
 	// Injected into app containers as {RemotePortEnvironment}_CLOUD.
 	CloudRemotePort uint64 `json:"cloud_remote_port,omitempty"`
+	// Access restricts who may use the rule's tunnel. Nil leaves the tunnel
+	// open to anyone with the URL.
+	Access *PortAccessPolicy `json:"access,omitempty"`
+	// Traffic meters the rule's tunnel and optionally caps its bandwidth and
+	// monthly volume. Nil leaves the tunnel unmetered.
+	Traffic *PortTrafficPolicy `json:"traffic,omitempty"`
+}
+
+// PortAccessPolicy restricts a tunnel to clients from the allowed networks
+// that present the basic auth credentials or a valid token. Every part is
+// optional; an empty policy restricts nothing.
+type PortAccessPolicy struct {
+	BasicAuth    *BasicAuthCredentials `json:"basic_auth,omitempty"`
+	AllowedCIDRs []string              `json:"allowed_cidrs,omitempty"`
+	Tokens       []AccessToken         `json:"tokens,omitempty"`
+	// ExpiresAt tears the tunnel down at the given time, e.g. for a share
+	// link handed to a customer for a support session.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type BasicAuthCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// AccessToken grants access to an http tunnel when passed as the
+// access_token query parameter (share links) or as a bearer token.
+type AccessToken struct {
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PortTrafficPolicy limits the traffic of a tunnel, e.g. to spare a cellular
+// data plan. Both limits are optional; an empty policy only counts bytes.
+type PortTrafficPolicy struct {
+	// BandwidthLimit caps the throughput per direction, in frp notation:
+	// "512KB" or "2MB" per second.
+	BandwidthLimit string `json:"bandwidth_limit,omitempty"`
+	// MonthlyQuota disables the tunnel once this many bytes (in and out)
+	// passed it in the current calendar month (UTC), until the next one.
+	MonthlyQuota uint64 `json:"monthly_quota,omitempty"`
+}
+
+// BuildSettings are the optional BuildKit settings of a dev build or publish,
+// sent as the "build" keyword argument.
+type BuildSettings struct {
+	// Target is the stage of a multi-stage Dockerfile to build.
+	Target string
+	// Platforms to build for, e.g. linux/amd64 and linux/arm64. Foreign ones
+	// run under QEMU; more than one can only be published.
+	Platforms []string
+	// Secrets names the environment variables handed to the build as secrets
+	// instead of build args, which would end up in the image history.
+	Secrets []string
+	// Cache reuses the inline cache of the newest release.
+	Cache bool
 }
 
 // TransitionPayload provides the data used by the StateMachine to transition between states.
@@ -132,6 +229,7 @@ type TransitionPayload struct {
 	EnvironmentTemplate  map[string]any
 	DockerCompose        map[string]any
 	NewDockerCompose     map[string]any
+	Build                BuildSettings
 	Ports                []any
 	PublishContainerName string
 	RegisteryToken       string
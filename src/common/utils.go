@@ -241,6 +241,21 @@ func ParseExitCodeFromContainerStatus(status string) (int64, error) {
 	return exitCodeInt, nil
 }
 
+// ParseHealthFromContainerStatus reads the health check result off a
+// container's status ("Up 2 minutes (healthy)"): healthy, unhealthy or
+// starting, or empty for a container without a health check.
+func ParseHealthFromContainerStatus(status string) string {
+	switch {
+	case strings.Contains(status, "(healthy)"):
+		return "healthy"
+	case strings.Contains(status, "(unhealthy)"):
+		return "unhealthy"
+	case strings.Contains(status, "(health: starting)"):
+		return "starting"
+	}
+	return ""
+}
+
 func GetRandomFreePort() (port int, err error) {
 	var a *net.TCPAddr
 	if a, err = net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
@@ -217,6 +217,24 @@ func TestParseExitCodeFromContainerStatus(t *testing.T) {
 	}
 }
 
+func TestParseHealthFromContainerStatus(t *testing.T) {
+	tests := []struct {
+		status   string
+		expected string
+	}{
+		{"Up 2 minutes (healthy)", "healthy"},
+		{"Up 40 seconds (unhealthy)", "unhealthy"},
+		{"Up 3 seconds (health: starting)", "starting"},
+		{"Up 3 hours", ""},
+		{"Exited (1) About a minute ago", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ParseHealthFromContainerStatus(tt.status))
+		})
+	}
+}
+
 func TestOrdinal(t *testing.T) {
 	tests := []struct {
 		in       uint
@@ -39,21 +39,46 @@ type ReswarmConfig struct {
 	Authentication struct {
 		Key         string `json:"key"`
 		Certificate string `json:"certificate"`
+		// CACertificate pins the CA bundle (PEM) the device endpoint's server
+		// certificate has to chain to. Empty means the system roots.
+		CACertificate string `json:"ca_certificate,omitempty"`
+		// MutualTLS presents Certificate as client certificate to any
+		// endpoint. Legacy endpoints always get it.
+		MutualTLS bool `json:"mutual_tls,omitempty"`
+		// InsecureSkipVerify turns the server certificate verification off.
+		// Only for endpoints whose certificate cannot be verified otherwise.
+		InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
 	} `json:"authentication"`
-	SwarmOwnerName       string `json:"swarm_owner_name"`
-	ConfigPassphrase     string `json:"config_passphrase"`
-	DeviceEndpointURL    string `json:"device_endpoint_url"`
-	Environment          string `json:"environment,omitempty"`
-	DockerRegistryURL    string `json:"docker_registry_url"`
-	InsecureRegistries   string `json:"insecure-registries,omitempty"`
-	DockerMainRepository string `json:"docker_main_repository"`
-	ApplianceDomain      string `json:"appliance_domain,omitempty"`
+	SwarmOwnerName    string `json:"swarm_owner_name"`
+	ConfigPassphrase  string `json:"config_passphrase"`
+	DeviceEndpointURL string `json:"device_endpoint_url"`
+	// DeviceEndpointURLs are further endpoints the agent fails over to, in
+	// order, when device_endpoint_url cannot be reached.
+	DeviceEndpointURLs   []string `json:"device_endpoint_urls,omitempty"`
+	Environment          string   `json:"environment,omitempty"`
+	DockerRegistryURL    string   `json:"docker_registry_url"`
+	InsecureRegistries   string   `json:"insecure-registries,omitempty"`
+	DockerMainRepository string   `json:"docker_main_repository"`
+	ApplianceDomain      string   `json:"appliance_domain,omitempty"`
 	// UpdateURL, when set, overrides the --remoteUpdateURL base for OTA
 	// self-updates. Appliance-managed agents carry the appliance's
 	// registry-proxy /dl base here so their binary downloads route through
 	// instance-registry.ironflock.com instead of storage.googleapis.com.
 	// Cloud/field agents leave it empty and keep the default GCS bucket.
-	UpdateURL      string `json:"update_url,omitempty"`
+	UpdateURL string `json:"update_url,omitempty"`
+	// TunnelBackend selects how app ports are exposed: "frp" (the default,
+	// an frpc subprocess) or "native" (an in-process reverse tunnel to a
+	// relay, for devices where spawning frpc is not an option).
+	TunnelBackend string `json:"tunnel_backend,omitempty"`
+	// TunnelRelayURL overrides the ws(s):// relay the native backend dials.
+	// Empty means wss:// on the tunnel server host.
+	TunnelRelayURL string `json:"tunnel_relay_url,omitempty"`
+	// Transport selects how the agent reaches the backend: "wamp" (the
+	// default, over device_endpoint_url) or "mqtt" (MQTT 5 over
+	// mqtt_broker_url, for sites that only let MQTT out).
+	Transport string `json:"transport,omitempty"`
+	// MQTTBrokerURL is the mqtt:// or mqtts:// broker of the mqtt transport.
+	MQTTBrokerURL  string `json:"mqtt_broker_url,omitempty"`
 	ReswarmBaseURL string `json:"-"`
 }
 
@@ -77,6 +102,23 @@ type CommandLineArguments struct {
 	ShouldUpdateAgent          bool
 	PrettyLogging              bool
 	UseNetworkManager          bool
+	AdvertiseMDNS              bool
+	MetricsPort                uint
+	MetricsAddress             string
+	LocalRouterAddress         string
+	LocalRouterPort            uint
+	LocalRouterBridge          string
+	WampProxy                  string
+	WampSerialization          string
+	ContainerRuntime           string
+	AuditLogDays               uint
+	BuildTimeout               uint
+	BundleDirs                 string
+	ImageSigningKeys           string
+	ImageSigningRoots          string
+	PeerImages                 bool
+	PeerImageAddress           string
+	PeerImagePort              uint
 	LogFileLocation            string
 	ConfigFileLocation         string
 	DatabaseFileName           string
@@ -138,6 +180,23 @@ func GetCliArguments() (*CommandLineArguments, error) {
 	databaseFileName := flag.String("dbFileName", defaultDatabaseFileName, "defines the name used to persist the database file")
 	debugMessaging := flag.Bool("debugMessaging", false, "enables debug logs for messenging layer")
 	nmw := flag.Bool("nmw", true, "enables the agent to use the NetworkManager API on Linux machines")
+	mdns := flag.Bool("mdns", true, "advertises the device and its app ports on the local network via mDNS/DNS-SD")
+	metricsPort := flag.Uint("metricsPort", 0, "serves tunnel traffic counters in the Prometheus format on /metrics at this port (0 disables it)")
+	metricsAddress := flag.String("metricsAddress", "127.0.0.1", "address the metrics are served on; 0.0.0.0 or the address of an interface serves them to the network, without authentication")
+	localRouterAddress := flag.String("localRouterAddress", "", "address the local WAMP router listens on (default: the address of the docker0 bridge the apps reach it at, else 127.0.0.1)")
+	localRouterPort := flag.Uint("localRouterPort", 0, "runs a local WAMP router for the apps on this port (0 disables it)")
+	localRouterBridge := flag.String("localRouterBridge", "", "comma separated URI prefixes the local router bridges to the cloud")
+	wampProxy := flag.String("wampProxy", "", "proxy for the WAMP connection, http://[user:password@]host:port or socks5://[user:password@]host:port (default: HTTPS_PROXY/NO_PROXY from the environment)")
+	wampSerialization := flag.String("wampSerialization", "json", "serialization of the WAMP connection: json, msgpack, cbor or auto (MessagePack, then CBOR, then JSON, whichever the router accepts first)")
+	containerRuntime := flag.String("containerRuntime", "auto", "container runtime the apps run on: auto (Docker, unless only a Podman socket is found), docker or podman")
+	auditLogDays := flag.Uint("auditLogDays", 90, "days the audit log of remote operations is kept (0 keeps entries until the entry limit)")
+	buildTimeout := flag.Uint("buildTimeout", 120, "minutes an app build may take before it is aborted (0 means no timeout)")
+	bundleDirs := flag.String("bundleDirs", "/media,/run/media", "comma separated directories, besides <appsDir>/bundles, app bundles are installed from, e.g. where USB sticks are mounted")
+	imageSigningKeys := flag.String("imageSigningKeys", "", "comma separated PEM files of the public keys app images must be signed with (cosign)")
+	imageSigningRoots := flag.String("imageSigningRoots", "", "comma separated PEM files of the root certificates app image signing certificates must chain to (cosign, Notary v2)")
+	peerImages := flag.Bool("peerImages", true, "fetches app images from the devices on the local network that have them before pulling them from the registry (requires -mdns)")
+	peerImageAddress := flag.String("peerImageAddress", "", "address the app images are served to the devices of the swarm on, e.g. that of the plant network's interface (default: every interface)")
+	peerImagePort := flag.Uint("peerImagePort", 0, "serves the app images of the device, private ones included, to the devices of its swarm on the local network on this port (requires -mdns, 0 disables it)")
 	compressedBuildExtension := flag.String("compressedBuildExtension", "tgz", "sets the extension in which the compressed build files will be provided")
 	pingPongTimeout := flag.Uint("ppTimeout", 5000, "Sets the ping pong timeout of the client in milliseconds (0 means no timeout)")
 	responseTimeout := flag.Uint("respTimeout", 7000, "Sets the response timeout of the client in milliseconds")
@@ -171,18 +230,80 @@ func GetCliArguments() (*CommandLineArguments, error) {
 		ConnectionEstablishTimeout: *socketConnectionEstablishTimeout,
 		Arch:                       *arch,
 		UseNetworkManager:          *nmw,
+		AdvertiseMDNS:              *mdns,
+		MetricsPort:                *metricsPort,
+		MetricsAddress:             *metricsAddress,
+		LocalRouterAddress:         *localRouterAddress,
+		LocalRouterPort:            *localRouterPort,
+		LocalRouterBridge:          *localRouterBridge,
+		WampProxy:                  *wampProxy,
+		WampSerialization:          *wampSerialization,
+		ContainerRuntime:           *containerRuntime,
+		AuditLogDays:               *auditLogDays,
+		BuildTimeout:               *buildTimeout,
+		BundleDirs:                 *bundleDirs,
+		ImageSigningKeys:           *imageSigningKeys,
+		ImageSigningRoots:          *imageSigningRoots,
+		PeerImages:                 *peerImages,
+		PeerImageAddress:           *peerImageAddress,
+		PeerImagePort:              *peerImagePort,
 	}
 
 	return &cliArgs, nil
 }
 
+// SaveReswarmConfig writes the config to a temporary file and renames it over
+// path, so a crash mid-write cannot leave the device with half a config (and
+// half a key pair). The file holds the device secret and key: it is readable
+// by its owner only.
 func SaveReswarmConfig(path string, reswarmConfig *ReswarmConfig) error {
 	file, err := json.MarshalIndent(reswarmConfig, "", " ")
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, file, os.ModePerm)
+	tmpPath := path + ".tmp"
+	err = writeFileSynced(tmpPath, file, 0o600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// writeFileSynced writes data to a new file at path with perm and flushes it
+// to disk. A leftover file at path is removed first: opening it would keep its
+// mode.
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
 }
 
 // LoadReswarmConfig populates a ReswarmConfig struct from a given path
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"reagent/config"
@@ -231,6 +232,24 @@ func TestSaveReswarmConfig_OverwritesExisting(t *testing.T) {
 	assert.Equal(t, 2, reloaded.SwarmKey)
 }
 
+func TestSaveReswarmConfig_OwnerOnly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.flock")
+	// a leftover of an interrupted save does not pass its mode on
+	require.NoError(t, os.WriteFile(path+".tmp", []byte("{}"), 0o644))
+
+	require.NoError(t, config.SaveReswarmConfig(path, &config.ReswarmConfig{Secret: "super-secret"}))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.NoFileExists(t, path+".tmp")
+}
+
 func TestLoadReswarmConfig_MissingFile(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "does-not-exist.flock")
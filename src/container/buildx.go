@@ -0,0 +1,239 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// multiPlatformBuilder is the buildx builder multi-platform builds run on. The
+// default builder uses the daemon's image store, which cannot hold an image
+// for several platforms; a docker-container builder can and pushes it.
+const multiPlatformBuilder = "reagent"
+
+// binfmtImage registers the QEMU emulators cross-platform builds run under.
+const binfmtImage = "tonistiigi/binfmt"
+
+// BuildxOptions are the settings of a BuildKit image build.
+type BuildxOptions struct {
+	Dockerfile string
+	Tags       []string
+	// Target is the stage of a multi-stage Dockerfile to build, the last
+	// stage when empty.
+	Target    string
+	BuildArgs map[string]string
+	// Secrets are available to `RUN --mount=type=secret,id=<name>`. Their
+	// values reach the CLI through its environment, so they end up neither in
+	// the process list nor in the image. The variables are named by
+	// secretEnv, not after the secrets, so a secret named PATH or DOCKER_HOST
+	// does not change the environment the CLI itself runs in.
+	Secrets map[string]string
+	// CacheFrom is an image in a registry whose inline cache the build may
+	// reuse. The image built carries an inline cache of its own either way.
+	CacheFrom string
+	// Platforms are the platforms to build for, e.g. linux/arm64. Empty
+	// builds for the device's own platform.
+	Platforms []string
+	// Push pushes the image to its registry instead of loading it into the
+	// local image store, which is required for more than one platform.
+	Push bool
+}
+
+// secretEnvPrefix prefixes the environment variables build secrets are handed
+// to the CLI in.
+const secretEnvPrefix = "REAGENT_BUILD_SECRET_"
+
+// Buildx runs image builds through the BuildKit CLI plugin (docker buildx).
+type Buildx struct {
+	// binary is the CLI buildx is a subcommand of (docker when empty);
+	// tests point it at a script.
+	binary string
+
+	// probe makes the first call of Supported ask the CLI whether it has
+	// buildx, so the agent does not wait for an exec at startup. A Buildx
+	// without it is as supported as supported says.
+	probe     bool
+	probeOnce sync.Once
+	supported bool
+}
+
+func newBuildx(binary string) *Buildx {
+	return &Buildx{binary: binary, probe: true}
+}
+
+// Supported reports whether the CLI has buildx.
+func (b *Buildx) Supported() bool {
+	b.probeOnce.Do(func() {
+		if b.probe {
+			b.supported = exec.Command(b.cli(), "buildx", "version").Run() == nil
+		}
+	})
+	return b.supported
+}
+
+func (b *Buildx) cli() string {
+	if b.binary == "" {
+		return "docker"
+	}
+	return b.binary
+}
+
+// Build builds the image from contextDir and streams the build output on the
+// returned channel.
+func (b *Buildx) Build(ctx context.Context, contextDir string, options BuildxOptions) (chan string, *ComposeCmd, error) {
+	if !b.Supported() {
+		return nil, nil, errors.New("docker buildx is not available")
+	}
+
+	if len(options.Platforms) > 1 && !options.Push {
+		return nil, nil, errors.New("an image for several platforms can only be pushed, not loaded")
+	}
+
+	if len(options.Platforms) > 1 {
+		err := b.ensureBuilder(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, b.cli(), buildxArgs(contextDir, options)...)
+	cmd.Env = os.Environ()
+	for i, name := range slices.Sorted(maps.Keys(options.Secrets)) {
+		cmd.Env = append(cmd.Env, secretEnv(i)+"="+options.Secrets[name])
+	}
+	setPdeathsig(cmd)
+
+	return startCommand(cmd, "docker buildx", "build", true)
+}
+
+func buildxArgs(contextDir string, options BuildxOptions) []string {
+	args := []string{"buildx", "build", "--progress", "plain"}
+
+	if len(options.Platforms) > 1 {
+		args = append(args, "--builder", multiPlatformBuilder)
+	}
+
+	if options.Dockerfile != "" {
+		args = append(args, "--file", options.Dockerfile)
+	}
+
+	for _, tag := range options.Tags {
+		args = append(args, "--tag", tag)
+	}
+
+	if options.Target != "" {
+		args = append(args, "--target", options.Target)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(options.BuildArgs)) {
+		args = append(args, "--build-arg", name+"="+options.BuildArgs[name])
+	}
+
+	for i, name := range slices.Sorted(maps.Keys(options.Secrets)) {
+		args = append(args, "--secret", "id="+name+",env="+secretEnv(i))
+	}
+
+	if options.CacheFrom != "" {
+		args = append(args, "--cache-from", "type=registry,ref="+options.CacheFrom)
+	}
+	args = append(args, "--cache-to", "type=inline")
+
+	if len(options.Platforms) > 0 {
+		args = append(args, "--platform", strings.Join(options.Platforms, ","))
+	}
+
+	if options.Push {
+		args = append(args, "--push")
+	} else {
+		args = append(args, "--load")
+	}
+
+	return append(args, contextDir)
+}
+
+// secretEnv names the environment variable of the i-th secret in the sorted
+// order of their names.
+func secretEnv(i int) string {
+	return secretEnvPrefix + strconv.Itoa(i)
+}
+
+// ensureBuilder creates the multi-platform builder unless it already exists.
+func (b *Buildx) ensureBuilder(ctx context.Context) error {
+	err := exec.CommandContext(ctx, b.cli(), "buildx", "inspect", multiPlatformBuilder).Run()
+	if err == nil {
+		return nil
+	}
+
+	output, err := exec.CommandContext(ctx, b.cli(), "buildx", "create", "--name", multiPlatformBuilder, "--driver", "docker-container").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create the buildx builder %s: %w: %s", multiPlatformBuilder, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// EnsureEmulators registers QEMU emulators for the platforms in the list the
+// device cannot run natively, so BuildKit can execute their RUN steps.
+func (b *Buildx) EnsureEmulators(ctx context.Context, platforms []string) error {
+	missing := missingEmulators(platforms, runtime.GOARCH, exists)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	output, err := exec.CommandContext(ctx, b.cli(), "run", "--privileged", "--rm", binfmtImage, "--install", strings.Join(missing, ",")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to install emulators for %s: %w: %s", strings.Join(missing, ", "), err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// qemuNames maps architectures as platforms name them to the names of their
+// QEMU binfmt_misc entries.
+var qemuNames = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "i386",
+	"arm64":   "aarch64",
+	"arm":     "arm",
+	"riscv64": "riscv64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// missingEmulators returns the architectures of platforms that are neither
+// native nor have an emulator registered, in the form binfmt --install takes.
+func missingEmulators(platforms []string, native string, exists func(string) bool) []string {
+	var missing []string
+	for _, platform := range platforms {
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 {
+			continue
+		}
+
+		arch := parts[1]
+		if arch == native || (native == "arm64" && arch == "arm") {
+			continue
+		}
+
+		qemuName, ok := qemuNames[arch]
+		if !ok {
+			qemuName = arch
+		}
+		if exists("/proc/sys/fs/binfmt_misc/qemu-" + qemuName) {
+			continue
+		}
+
+		if !slices.Contains(missing, arch) {
+			missing = append(missing, arch)
+		}
+	}
+	return missing
+}
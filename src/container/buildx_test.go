@@ -0,0 +1,153 @@
+package container
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildxArgs(t *testing.T) {
+	t.Run("loads a single-platform image", func(t *testing.T) {
+		args := buildxArgs("/apps/build/app.context", BuildxOptions{
+			Dockerfile: "/apps/build/app.context/Dockerfile",
+			Tags:       []string{"registry/app:dev"},
+			Target:     "runtime",
+			BuildArgs:  map[string]string{"B": "2", "A": "1"},
+			Secrets:    map[string]string{"NPM_TOKEN": "s3cret"},
+			CacheFrom:  "registry/app-prod:1.2.0",
+		})
+
+		assert.Equal(t, []string{
+			"buildx", "build", "--progress", "plain",
+			"--file", "/apps/build/app.context/Dockerfile",
+			"--tag", "registry/app:dev",
+			"--target", "runtime",
+			"--build-arg", "A=1",
+			"--build-arg", "B=2",
+			"--secret", "id=NPM_TOKEN,env=REAGENT_BUILD_SECRET_0",
+			"--cache-from", "type=registry,ref=registry/app-prod:1.2.0",
+			"--cache-to", "type=inline",
+			"--load",
+			"/apps/build/app.context",
+		}, args)
+		assert.NotContains(t, strings.Join(args, " "), "s3cret", "secret values stay off the command line")
+	})
+
+	t.Run("pushes a multi-platform image from the container builder", func(t *testing.T) {
+		args := buildxArgs("/ctx", BuildxOptions{
+			Tags:      []string{"registry/app-prod:2.0.0"},
+			Platforms: []string{"linux/amd64", "linux/arm64"},
+			Push:      true,
+		})
+
+		joined := strings.Join(args, " ")
+		assert.Contains(t, joined, "--builder "+multiPlatformBuilder)
+		assert.Contains(t, joined, "--platform linux/amd64,linux/arm64")
+		assert.Contains(t, joined, "--push")
+		assert.NotContains(t, joined, "--load")
+	})
+}
+
+func TestMissingEmulators(t *testing.T) {
+	registered := map[string]bool{"/proc/sys/fs/binfmt_misc/qemu-riscv64": true}
+	exists := func(path string) bool { return registered[path] }
+
+	missing := missingEmulators([]string{"linux/amd64", "linux/arm64", "linux/arm/v7", "linux/arm64/v8", "linux/riscv64", "bogus"}, "amd64", exists)
+	assert.Equal(t, []string{"arm64", "arm"}, missing)
+
+	assert.Empty(t, missingEmulators([]string{"linux/arm/v7"}, "arm64", exists), "arm64 runs arm natively")
+}
+
+// newFakeBuildx returns a Buildx whose "docker" is the given shell script.
+func newFakeBuildx(t *testing.T, script string) *Buildx {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "fake-docker")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755))
+
+	return &Buildx{supported: true, binary: path}
+}
+
+func TestBuildxBuild(t *testing.T) {
+	t.Run("streams the output and hands secrets over in the environment", func(t *testing.T) {
+		buildx := newFakeBuildx(t, `echo "args: $*"; echo "token: $REAGENT_BUILD_SECRET_0"`)
+
+		output, cmd, err := buildx.Build(context.Background(), "/ctx", BuildxOptions{
+			Secrets: map[string]string{"NPM_TOKEN": "s3cret"},
+		})
+		require.NoError(t, err)
+
+		var lines []string
+		for line := range output {
+			lines = append(lines, line)
+		}
+		require.NoError(t, cmd.Wait())
+
+		require.Len(t, lines, 2)
+		assert.Contains(t, lines[0], "--secret id=NPM_TOKEN,env=REAGENT_BUILD_SECRET_0")
+		assert.Equal(t, "token: s3cret", lines[1])
+	})
+
+	t.Run("a secret does not replace a variable of the CLI", func(t *testing.T) {
+		buildx := newFakeBuildx(t, `echo "path: $PATH"; echo "secret: $REAGENT_BUILD_SECRET_0"`)
+
+		output, cmd, err := buildx.Build(context.Background(), "/ctx", BuildxOptions{
+			Secrets: map[string]string{"PATH": "/nowhere"},
+		})
+		require.NoError(t, err)
+
+		var lines []string
+		for line := range output {
+			lines = append(lines, line)
+		}
+		require.NoError(t, cmd.Wait())
+
+		require.Len(t, lines, 2)
+		assert.Equal(t, "path: "+os.Getenv("PATH"), lines[0])
+		assert.Equal(t, "secret: /nowhere", lines[1])
+	})
+
+	t.Run("a failure names buildx and quotes the output", func(t *testing.T) {
+		buildx := newFakeBuildx(t, `echo "failed to solve: target stage \"nope\" could not be found" >&2; exit 1`)
+
+		output, cmd, err := buildx.Build(context.Background(), "/ctx", BuildxOptions{Target: "nope"})
+		require.NoError(t, err)
+		for range output {
+		}
+
+		err = cmd.Wait()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "docker buildx build failed")
+		assert.Contains(t, err.Error(), `target stage "nope" could not be found`)
+	})
+
+	t.Run("several platforms cannot be loaded", func(t *testing.T) {
+		buildx := newFakeBuildx(t, `exit 0`)
+
+		_, _, err := buildx.Build(context.Background(), "/ctx", BuildxOptions{Platforms: []string{"linux/amd64", "linux/arm64"}})
+		assert.Error(t, err)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, _, err := (&Buildx{}).Build(context.Background(), "/ctx", BuildxOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("canceling the context kills the build", func(t *testing.T) {
+		buildx := newFakeBuildx(t, `exec sleep 30`)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		output, cmd, err := buildx.Build(ctx, "/ctx", BuildxOptions{})
+		require.NoError(t, err)
+
+		cancel()
+		for range output {
+		}
+		assert.Error(t, cmd.Wait())
+	})
+}
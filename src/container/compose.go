@@ -26,11 +26,9 @@ type Compose struct {
 	config    *config.Config
 	// binary is the CLI to invoke; empty means "docker". Swappable so tests can
 	// exercise the output/exit-code plumbing without a daemon.
-	binary                string
-	logStreamMap          map[string]*ComposeLog
-	composeProcessesMap   map[string]context.CancelFunc
-	composeProcessesMutex sync.Mutex
-	logStreamMapMutex     sync.Mutex
+	binary            string
+	logStreamMap      map[string]*ComposeLog
+	logStreamMapMutex sync.Mutex
 }
 
 type ComposeLog struct {
@@ -82,15 +80,21 @@ type Service struct {
 }
 
 func NewCompose(config *config.Config) Compose {
-	supported := IsComposeSupported()
+	return newCompose(config, "")
+}
+
+// newCompose runs compose as a subcommand of binary (docker when empty).
+func newCompose(config *config.Config, binary string) Compose {
+	if binary == "" {
+		binary = "docker"
+	}
 
 	return Compose{
-		Supported:             supported,
-		config:                config,
-		logStreamMap:          make(map[string]*ComposeLog),
-		composeProcessesMap:   make(map[string]context.CancelFunc),
-		composeProcessesMutex: sync.Mutex{},
-		logStreamMapMutex:     sync.Mutex{},
+		Supported:         isComposeSupported(binary),
+		config:            config,
+		binary:            binary,
+		logStreamMap:      make(map[string]*ComposeLog),
+		logStreamMapMutex: sync.Mutex{},
 	}
 }
 
@@ -177,18 +181,24 @@ func (t *composeOutputTail) String() string {
 }
 
 // ComposeError reports a `docker compose` invocation that exited non-zero,
-// naming the subcommand and quoting the tail of what the CLI printed.
+// naming the subcommand and quoting the tail of what the CLI printed. Tool
+// names the command for other CLI plugins run the same way (docker buildx).
 type ComposeError struct {
+	Tool       string
 	Subcommand string
 	Output     string
 	Err        error
 }
 
 func (e *ComposeError) Error() string {
+	tool := e.Tool
+	if tool == "" {
+		tool = "docker compose"
+	}
 	if e.Output == "" {
-		return fmt.Sprintf("docker compose %s failed: %s", e.Subcommand, e.Err)
+		return fmt.Sprintf("%s %s failed: %s", tool, e.Subcommand, e.Err)
 	}
-	return fmt.Sprintf("docker compose %s failed: %s: %s", e.Subcommand, e.Err, e.Output)
+	return fmt.Sprintf("%s %s failed: %s: %s", tool, e.Subcommand, e.Err, e.Output)
 }
 
 func (e *ComposeError) Unwrap() error {
@@ -198,6 +208,7 @@ func (e *ComposeError) Unwrap() error {
 // ComposeCmd is a running `docker compose` invocation.
 type ComposeCmd struct {
 	cmd        *exec.Cmd
+	tool       string
 	subcommand string
 	tail       *composeOutputTail
 	drained    chan struct{}
@@ -217,7 +228,7 @@ func (cc *ComposeCmd) Wait() error {
 		return nil
 	}
 
-	return &ComposeError{Subcommand: cc.subcommand, Output: cc.tail.String(), Err: err}
+	return &ComposeError{Tool: cc.tool, Subcommand: cc.subcommand, Output: cc.tail.String(), Err: err}
 }
 
 func (c *Compose) composeCommand(dockerComposePath string, providedArgs ...string) (chan string, *ComposeCmd, error) {
@@ -250,13 +261,19 @@ func (c *Compose) startComposeCommand(ctx context.Context, dockerComposePath str
 	finalArgs = append(finalArgs, "compose", "-f", dockerComposePath)
 	finalArgs = append(finalArgs, providedArgs...)
 
-	binary := c.binary
-	if binary == "" {
-		binary = "docker"
+	cmd := exec.CommandContext(ctx, c.cli(), finalArgs...)
+
+	subcommand := "compose"
+	if len(providedArgs) > 0 {
+		subcommand = providedArgs[0]
 	}
 
-	cmd := exec.CommandContext(ctx, binary, finalArgs...)
+	return startCommand(cmd, "", subcommand, streamed)
+}
 
+// startCommand starts cmd with its combined output drained into the tail and,
+// if streamed, the returned channel. tool and subcommand name it in errors.
+func startCommand(cmd *exec.Cmd, tool string, subcommand string, streamed bool) (chan string, *ComposeCmd, error) {
 	var outputChan chan string
 	if streamed {
 		outputChan = make(chan string, composeStreamBuffer)
@@ -275,13 +292,9 @@ func (c *Compose) startComposeCommand(ctx context.Context, dockerComposePath str
 		return nil, nil, err
 	}
 
-	subcommand := "compose"
-	if len(providedArgs) > 0 {
-		subcommand = providedArgs[0]
-	}
-
 	composeCmd := &ComposeCmd{
 		cmd:        cmd,
+		tool:       tool,
 		subcommand: subcommand,
 		tail:       &composeOutputTail{},
 		drained:    make(chan struct{}),
@@ -322,29 +335,6 @@ func (c *Compose) Build(ctx context.Context, dockerComposePath string) (chan str
 	return c.composeCommandContext(ctx, dockerComposePath, "build")
 }
 
-func (c *Compose) RegisterBuildCancel(buildID string, cancel context.CancelFunc) {
-	c.composeProcessesMutex.Lock()
-	c.composeProcessesMap[buildID] = cancel
-	c.composeProcessesMutex.Unlock()
-}
-
-func (c *Compose) UnregisterBuildCancel(buildID string) {
-	c.composeProcessesMutex.Lock()
-	delete(c.composeProcessesMap, buildID)
-	c.composeProcessesMutex.Unlock()
-}
-
-func (c *Compose) CancelBuild(buildID string) error {
-	c.composeProcessesMutex.Lock()
-	cancel := c.composeProcessesMap[buildID]
-	c.composeProcessesMutex.Unlock()
-	if cancel == nil {
-		return errors.New("no active compose build process found")
-	}
-	cancel()
-	return nil
-}
-
 func (c *Compose) Push(dockerComposePath string) (chan string, *ComposeCmd, error) {
 	return c.composeCommand(dockerComposePath, "push")
 }
@@ -388,6 +378,22 @@ func (c *Compose) UpNoBuild(dockerComposePath string) (chan string, *ComposeCmd,
 	return c.composeCommand(dockerComposePath, "up", "--remove-orphans", "-d", "--no-build")
 }
 
+// UpServicesContext brings up just the given services of a deployed app (see
+// UpNoBuild), recreating them if their definition changed. --no-deps leaves
+// the services they depend on alone, which the caller has to have running
+// already; the partial update of a compose app relies on this to keep the
+// unchanged services of a project running through the update.
+func (c *Compose) UpServicesContext(ctx context.Context, dockerComposePath string, services ...string) (chan string, *ComposeCmd, error) {
+	args := append([]string{"up", "-d", "--no-build", "--no-deps"}, services...)
+	return c.composeCommandContext(ctx, dockerComposePath, args...)
+}
+
+// RemoveOrphansContext removes the containers of the services the compose file
+// no longer has. --no-recreate keeps the services it does have as they are.
+func (c *Compose) RemoveOrphansContext(ctx context.Context, dockerComposePath string) error {
+	return c.run(ctx, dockerComposePath, "up", "-d", "--no-build", "--no-recreate", "--remove-orphans")
+}
+
 func (c *Compose) WaitForRunning(ctx context.Context, dockerComposePath string, pollingRate time.Duration) (<-chan struct{}, <-chan error) {
 	errC := make(chan error, 1)
 	runningC := make(chan struct{}, 1)
@@ -462,7 +468,11 @@ func (c *Compose) IsRunning(dockerComposePath string) (bool, error) {
 }
 
 func IsComposeSupported() bool {
-	cmd := exec.Command("docker", "compose")
+	return isComposeSupported("docker")
+}
+
+func isComposeSupported(binary string) bool {
+	cmd := exec.Command(binary, "compose")
 	_, err := cmd.CombinedOutput()
 	if err != nil {
 		return false
@@ -471,12 +481,23 @@ func IsComposeSupported() bool {
 	return true
 }
 
+func (c *Compose) cli() string {
+	if c.binary == "" {
+		return "docker"
+	}
+	return c.binary
+}
+
+func (c *Compose) isSupported() bool {
+	return isComposeSupported(c.cli())
+}
+
 // RefreshSupport re-evaluates compose support. Supported is latched at
 // construction, which can predate a late-starting daemon (Docker Desktop only
 // starts at user login on Windows), so the daemon-wait path re-checks once
 // Docker becomes available.
 func (c *Compose) RefreshSupport() {
-	c.Supported = IsComposeSupported()
+	c.Supported = c.isSupported()
 }
 
 func (c *Compose) Stop(dockerComposePath string) error {
@@ -517,6 +538,9 @@ type LogQuery struct {
 	Since      string
 	Until      string
 	Timestamps bool
+	// Service limits the logs of a compose project to one of its services.
+	// The Docker path has no services and ignores it.
+	Service string
 }
 
 // ComposeArgs renders the query as `docker compose logs` flags.
@@ -540,6 +564,9 @@ func (q LogQuery) ComposeArgs() []string {
 	if q.Until != "" {
 		args = append(args, "--until", q.Until)
 	}
+	if q.Service != "" {
+		args = append(args, q.Service)
+	}
 	return args
 }
 
@@ -566,9 +593,10 @@ func (q LogQuery) DockerOptions() common.Dict {
 // LogsByContainerName reads the logs of a whole compose project, addressed by
 // the agent's compose container name (`<stage>_<key>_<name>_compose`).
 //
-// Every service in the project is included, each line prefixed with its service
-// name — for a multi-container app that prefix is the only thing identifying
-// which service spoke, so it is deliberately kept. Output is CombinedOutput, so
+// Every service in the project is included unless the query names one, each
+// line prefixed with its service name — for a multi-container app that prefix
+// is the only thing identifying which service spoke, so it is deliberately
+// kept. Output is CombinedOutput, so
 // compose's own progress and warning text on stderr is interleaved with the
 // container output.
 func (c *Compose) LogsByContainerName(containerName string, query LogQuery) (io.ReadCloser, error) {
@@ -596,14 +624,9 @@ func (c *Compose) Logs(dockerComposePath string, query LogQuery) (io.ReadCloser,
 }
 
 func (c *Compose) logs(dockerComposePath string, query LogQuery) (io.ReadCloser, error) {
-	binary := c.binary
-	if binary == "" {
-		binary = "docker"
-	}
-
 	args := append([]string{"compose", "-f", dockerComposePath}, query.ComposeArgs()...)
 
-	output, err := exec.Command(binary, args...).CombinedOutput()
+	output, err := exec.Command(c.cli(), args...).CombinedOutput()
 	if err != nil {
 		return nil, err
 	}
@@ -630,7 +653,7 @@ func (c *Compose) LogStream(dockerComposePath string) (chan string, error) {
 
 	// c.logStreamMapMutex.Unlock()
 
-	cmd := exec.Command("docker", "compose", "-f", dockerComposePath, "logs", "-f")
+	cmd := exec.Command(c.cli(), "compose", "-f", dockerComposePath, "logs", "-f")
 	cmdReader, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -706,7 +729,7 @@ func (c *Compose) Status(dockerComposePath string) ([]ComposeStatus, error) {
 		return []ComposeStatus{}, nil
 	}
 
-	cmd := exec.Command("docker", "compose", "-f", dockerComposePath, "ps", "-a", "--format", "json")
+	cmd := exec.Command(c.cli(), "compose", "-f", dockerComposePath, "ps", "-a", "--format", "json")
 	output, err := cmd.Output()
 	if err != nil {
 		// A failing compose command (e.g. the project does not exist yet) must
@@ -777,7 +800,7 @@ func (c *Compose) List() ([]ComposeListEntry, error) {
 		return []ComposeListEntry{}, nil
 	}
 
-	cmd := exec.Command("docker", "compose", "ls", "-a", "--format", "json")
+	cmd := exec.Command(c.cli(), "compose", "ls", "-a", "--format", "json")
 	cmd.Stderr = cmd.Stdout
 
 	output, err := cmd.Output()
@@ -0,0 +1,78 @@
+package container
+
+import (
+	"context"
+	"reagent/common"
+	"sort"
+	"strings"
+)
+
+// ComposeServiceLabel is the label docker compose stamps on a container with
+// the name of the service it runs.
+const ComposeServiceLabel = "com.docker.compose.service"
+
+// ComposeServiceState returns the state of the service a container runs, from
+// what the container list reports of it; false for a container that is not
+// part of a compose project.
+func ComposeServiceState(labels map[string]string, names []string, state string, status string) (common.ServiceState, bool) {
+	service, ok := labels[ComposeServiceLabel]
+	if !ok {
+		return common.ServiceState{}, false
+	}
+
+	serviceState := common.ServiceState{
+		Service: service,
+		State:   state,
+		Health:  common.ParseHealthFromContainerStatus(status),
+	}
+	if len(names) > 0 {
+		serviceState.Container = strings.TrimPrefix(names[0], "/")
+	}
+	if state == "exited" {
+		exitCode, err := common.ParseExitCodeFromContainerStatus(status)
+		if err == nil {
+			serviceState.ExitCode = exitCode
+		}
+	}
+
+	return serviceState, true
+}
+
+// ComposeServiceStates returns the state of each service of a compose project
+// from the project's containers, by service and container name.
+func ComposeServiceStates(containers []ContainerResult) []common.ServiceState {
+	states := make([]common.ServiceState, 0, len(containers))
+	for _, cont := range containers {
+		state, ok := ComposeServiceState(cont.Labels, cont.Names, cont.State, cont.Status)
+		if !ok {
+			continue
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Service != states[j].Service {
+			return states[i].Service < states[j].Service
+		}
+		return states[i].Container < states[j].Container
+	})
+
+	return states
+}
+
+// StartServiceContext starts the stopped container of a single service.
+func (c *Compose) StartServiceContext(ctx context.Context, dockerComposePath string, service string) error {
+	return c.run(ctx, dockerComposePath, "start", service)
+}
+
+// StopServiceContext stops the container of a single service, leaving the
+// other services of the project running.
+func (c *Compose) StopServiceContext(ctx context.Context, dockerComposePath string, service string) error {
+	return c.run(ctx, dockerComposePath, "stop", service)
+}
+
+// RestartServiceContext restarts the container of a single service. It is not
+// recreated: a changed definition takes an update of the app.
+func (c *Compose) RestartServiceContext(ctx context.Context, dockerComposePath string, service string) error {
+	return c.run(ctx, dockerComposePath, "restart", service)
+}
@@ -0,0 +1,63 @@
+package container
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"reagent/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeServiceStates(t *testing.T) {
+	containers := []ContainerResult{
+		{
+			Names:  []string{"/prod_7_stack_compose-web-1"},
+			Labels: map[string]string{ComposeServiceLabel: "web"},
+			State:  "running",
+			Status: "Up 2 minutes (healthy)",
+		},
+		{
+			Names:    []string{"/prod_7_stack_compose-db-1"},
+			Labels:   map[string]string{ComposeServiceLabel: "db"},
+			State:    "exited",
+			Status:   "Exited (137) 5 seconds ago",
+			ExitCode: 137,
+		},
+		{
+			Names:  []string{"/prod_7_stack_compose-worker-1"},
+			Labels: map[string]string{ComposeServiceLabel: "worker"},
+			State:  "restarting",
+			Status: "Restarting (1) 2 seconds ago",
+		},
+		{
+			Names: []string{"/prod_8_plain"},
+			State: "running",
+		},
+	}
+
+	assert.Equal(t, []common.ServiceState{
+		{Service: "db", Container: "prod_7_stack_compose-db-1", State: "exited", ExitCode: 137},
+		{Service: "web", Container: "prod_7_stack_compose-web-1", State: "running", Health: "healthy"},
+		{Service: "worker", Container: "prod_7_stack_compose-worker-1", State: "restarting"},
+	}, ComposeServiceStates(containers), "by service, without the containers of other apps")
+}
+
+func TestComposeServiceCommands(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	c := newFakeComposeCompose(t, `echo "$@" >> `+argsFile)
+
+	require.NoError(t, c.StartServiceContext(context.Background(), "/apps/stack.json", "db"))
+	require.NoError(t, c.StopServiceContext(context.Background(), "/apps/stack.json", "db"))
+	require.NoError(t, c.RestartServiceContext(context.Background(), "/apps/stack.json", "db"))
+
+	args, err := os.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"compose -f /apps/stack.json start db\ncompose -f /apps/stack.json stop db\ncompose -f /apps/stack.json restart db\n",
+		string(args),
+	)
+}
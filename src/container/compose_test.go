@@ -442,3 +442,33 @@ func TestComposeLongOutputLineDoesNotStall(t *testing.T) {
 		t.Fatal("Wait blocked on an over-long output line")
 	}
 }
+
+// Every compose invocation must go through the CLI the Compose was set up
+// with, not a hardcoded "docker".
+func TestComposeQueriesUseTheConfiguredCLI(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	c := newFakeComposeCompose(t, `echo "$@" >> `+argsFile+`; echo "[]"`)
+
+	_, err := c.Status("/apps/stack.json")
+	require.NoError(t, err)
+
+	_, err = c.List()
+	require.NoError(t, err)
+
+	logChan, err := c.LogStream("/apps/stack.json")
+	require.NoError(t, err)
+	for range logChan {
+	}
+
+	_, err = c.Logs("/apps/stack.json", LogQuery{})
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(argsFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(args)), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "compose -f /apps/stack.json ps -a --format json", lines[0])
+	assert.Equal(t, "compose ls -a --format json", lines[1])
+	assert.Equal(t, "compose -f /apps/stack.json logs -f", lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], "compose -f /apps/stack.json logs"), lines[3])
+}
@@ -44,28 +44,39 @@ type DockerStream struct {
 }
 
 type Docker struct {
-	client         *client.Client
-	config         *config.Config
+	client *client.Client
+	config *config.Config
+	// cli is the command line tool for what the API does not cover (logins,
+	// prunes, compose): docker, or podman for Podman.
+	cli            string
 	compose        *Compose
+	buildx         *Buildx
 	activeStreams  map[string]*DockerStream
 	streamMapMutex sync.Mutex
 }
 
 func NewDocker(config *config.Config) (*Docker, error) {
-	client, err := newDockerClient()
-	activeBuilds := make(map[string]*DockerStream)
-
+	docker, err := newDocker(config, "docker", client.FromEnv)
 	if err != nil {
 		return nil, err
 	}
 
-	compose := NewCompose(config)
-	return &Docker{client: client, config: config, activeStreams: activeBuilds, compose: &compose}, nil
+	docker.buildx = newBuildx(docker.cli)
+	return docker, nil
 }
 
-// For now stick only with Docker as implementation
-func newDockerClient() (*client.Client, error) {
-	return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// newDocker connects to the Docker API with hostOpt, using cli for what the
+// API does not cover. The caller sets up how images are built.
+func newDocker(config *config.Config, cli string, hostOpt client.Opt) (*Docker, error) {
+	client, err := client.NewClientWithOpts(hostOpt, client.WithAPIVersionNegotiation())
+	activeBuilds := make(map[string]*DockerStream)
+
+	if err != nil {
+		return nil, err
+	}
+
+	compose := newCompose(config, cli)
+	return &Docker{client: client, config: config, cli: cli, activeStreams: activeBuilds, compose: &compose}, nil
 }
 
 func (docker *Docker) ListenForContainerEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
@@ -309,6 +320,7 @@ func (docker *Docker) GetImages(ctx context.Context, fullImageName string) ([]Im
 			Labels:      image.Labels,
 			Size:        image.Size,
 			RepoTags:    image.RepoTags,
+			RepoDigests: image.RepoDigests,
 		})
 	}
 
@@ -346,6 +358,7 @@ func (docker *Docker) GetImage(ctx context.Context, fullImageName string, tag st
 		Labels:      image.Labels,
 		Size:        image.Size,
 		RepoTags:    image.RepoTags,
+		RepoDigests: image.RepoDigests,
 	}, nil
 }
 
@@ -366,8 +379,10 @@ func (docker *Docker) PruneImages(ctx context.Context, options common.Dict) erro
 	return err
 }
 
-func (docker *Docker) PruneSystem() (string, error) {
-	cmd := exec.Command("docker", "system", "prune", "-af", "--volumes")
+// PruneSystem removes all unused containers, networks, images and volumes.
+// Cancelling ctx kills the prune.
+func (docker *Docker) PruneSystem(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, docker.cli, "system", "prune", "-af", "--volumes")
 	cmd.Stderr = cmd.Stdout
 	output, err := cmd.Output()
 	if err != nil {
@@ -378,7 +393,7 @@ func (docker *Docker) PruneSystem() (string, error) {
 }
 
 func (docker *Docker) PruneAllImages() (string, error) {
-	cmd := exec.Command("docker", "image", "prune", "-af")
+	cmd := exec.Command(docker.cli, "image", "prune", "-af")
 	cmd.Stderr = cmd.Stdout
 	output, err := cmd.Output()
 	if err != nil {
@@ -393,7 +408,7 @@ func (docker *Docker) PruneAllImages() (string, error) {
 // caller forever (observed live: it kept diskguard from ever reporting the
 // emergency).
 func (docker *Docker) PruneDanglingImages(ctx context.Context) (string, error) {
-	cmd := exec.CommandContext(ctx, "docker", "image", "prune", "-f")
+	cmd := exec.CommandContext(ctx, docker.cli, "image", "prune", "-f")
 	cmd.Stderr = cmd.Stdout
 	output, err := cmd.Output()
 	if err != nil {
@@ -440,7 +455,7 @@ func (docker *Docker) RemoveVolume(ctx context.Context, name string) error {
 // PruneBuildCache removes the dangling build cache (docker builder prune).
 // ctx bounds the run (see PruneDanglingImages).
 func (docker *Docker) PruneBuildCache(ctx context.Context) (string, error) {
-	cmd := exec.CommandContext(ctx, "docker", "builder", "prune", "-f")
+	cmd := exec.CommandContext(ctx, docker.cli, "builder", "prune", "-f")
 	cmd.Stderr = cmd.Stdout
 	output, err := cmd.Output()
 	if err != nil {
@@ -480,6 +495,7 @@ func (docker *Docker) ListImages(ctx context.Context, options map[string]interfa
 			Labels:      image.Labels,
 			Size:        image.Size,
 			RepoTags:    image.RepoTags,
+			RepoDigests: image.RepoDigests,
 		}
 		imageResults = append(imageResults, imageResult)
 	}
@@ -488,7 +504,7 @@ func (docker *Docker) ListImages(ctx context.Context, options map[string]interfa
 }
 
 func (c *Docker) dockerCommand(ctx context.Context, providedArgs ...string) (string, error) {
-	output, err := exec.CommandContext(ctx, "docker", providedArgs...).CombinedOutput()
+	output, err := exec.CommandContext(ctx, c.cli, providedArgs...).CombinedOutput()
 
 	return string(output), err
 }
@@ -1191,10 +1207,58 @@ func (docker *Docker) Tag(ctx context.Context, source string, target string) err
 	return docker.client.ImageTag(ctx, source, target)
 }
 
+// LoadImage loads the images of a `docker save` archive and returns the
+// references they were loaded as.
+func (docker *Docker) LoadImage(ctx context.Context, archive io.Reader) ([]string, error) {
+	response, err := docker.client.ImageLoad(ctx, archive, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var loaded []string
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		err := decoder.Decode(&message)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Error != "" {
+			return nil, errors.New(message.Error)
+		}
+
+		line := strings.TrimSpace(message.Stream)
+		if reference, ok := strings.CutPrefix(line, "Loaded image: "); ok {
+			loaded = append(loaded, reference)
+		} else if id, ok := strings.CutPrefix(line, "Loaded image ID: "); ok {
+			loaded = append(loaded, id)
+		}
+	}
+
+	return loaded, nil
+}
+
+// SaveImage exports images as a `docker save` archive.
+func (docker *Docker) SaveImage(ctx context.Context, images []string) (io.ReadCloser, error) {
+	return docker.client.ImageSave(ctx, images)
+}
+
 func (docker *Docker) Compose() *Compose {
 	return docker.compose
 }
 
+func (docker *Docker) Buildx() *Buildx {
+	return docker.buildx
+}
+
 // Build builds a Docker image using a tarfile as context
 func (docker *Docker) Build(ctx context.Context, compressedBuildFilesPath string, options types.ImageBuildOptions) (io.ReadCloser, error) {
 	dockerBuildContext, err := os.Open(compressedBuildFilesPath)
@@ -5,6 +5,7 @@ package container
 import (
 	"context"
 	"io"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -22,21 +23,24 @@ import (
 // needing a long-running process or network access at runtime.
 const integrationImage = "hello-world:latest"
 
-// newIntegrationDocker builds the REAL docker client and skips the test when no
-// reachable daemon is present, so 'just test-integration' stays green on hosts
-// without docker.
-func newIntegrationDocker(t *testing.T) *Docker {
+// newIntegrationRuntime builds the REAL container runtime the way the agent
+// does at startup and skips the test when no reachable daemon is present, so
+// 'just test-integration' stays green on hosts without one. The runtime is
+// detected unless REAGENT_TEST_RUNTIME names one (docker or podman), which is
+// how the same tests run against both.
+func newIntegrationRuntime(t *testing.T) Container {
 	t.Helper()
 
-	docker, err := NewDocker(builders.DefaultTestConfig())
+	cfg := builders.NewTestConfigBuilder().WithContainerRuntime(os.Getenv("REAGENT_TEST_RUNTIME")).Build()
+	docker, err := New(cfg)
 	if err != nil {
-		t.Skipf("skipping: cannot construct docker client: %v", err)
+		t.Skipf("skipping: cannot construct container runtime client: %v", err)
 	}
 
 	// WaitForDaemon pings the daemon; a short timeout keeps the skip fast when
 	// the socket is absent or unreachable.
 	if err := docker.WaitForDaemon(2 * time.Second); err != nil {
-		t.Skipf("skipping: docker daemon not available: %v", err)
+		t.Skipf("skipping: container runtime not available: %v", err)
 	}
 
 	return docker
@@ -53,7 +57,7 @@ func drain(t *testing.T, r io.ReadCloser) {
 }
 
 func TestIntegrationDockerPing(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -64,8 +68,28 @@ func TestIntegrationDockerPing(t *testing.T) {
 	assert.NotEmpty(t, ping.OSType, "daemon should report an OS type")
 }
 
+// TestIntegrationRuntimeDetection checks that startup picks the runtime asked
+// for, or with auto the one whose socket is present.
+func TestIntegrationRuntimeDetection(t *testing.T) {
+	docker := newIntegrationRuntime(t)
+
+	switch os.Getenv("REAGENT_TEST_RUNTIME") {
+	case RuntimePodman:
+		assert.IsType(t, &Podman{}, docker)
+	case RuntimeDocker:
+		assert.IsType(t, &Docker{}, docker)
+	default:
+		name, _ := detectRuntime("auto", os.Getenv, exists)
+		if name == RuntimePodman {
+			assert.IsType(t, &Podman{}, docker)
+		} else {
+			assert.IsType(t, &Docker{}, docker)
+		}
+	}
+}
+
 func TestIntegrationDockerListImagesAndContainers(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
@@ -86,7 +110,7 @@ func TestIntegrationDockerListImagesAndContainers(t *testing.T) {
 // remove image. Every created resource is cleaned up via t.Cleanup so the test
 // leaves the host as it found it.
 func TestIntegrationDockerRoundTrip(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	// Pull and the lifecycle calls each get their own bounded context, but the
 	// overall test budget is generous to allow a real registry pull.
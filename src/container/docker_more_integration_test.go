@@ -57,7 +57,7 @@ func buildTinyImageTar(t *testing.T, dockerfile string) string {
 
 // forceRemoveImage best-effort removes an image by reference, swallowing
 // "no such"/not-found errors so cleanup never fails a run on a shared daemon.
-func forceRemoveImage(docker *Docker, ref string) {
+func forceRemoveImage(docker Container, ref string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	_ = docker.RemoveImagesByName(ctx, ref, map[string]interface{}{"force": true})
@@ -65,7 +65,7 @@ func forceRemoveImage(docker *Docker, ref string) {
 
 // forceRemoveContainer best-effort removes a container by id, ignoring missing
 // containers so a partially-created test still cleans up.
-func forceRemoveContainer(docker *Docker, id string) {
+func forceRemoveContainer(docker Container, id string) {
 	if id == "" {
 		return
 	}
@@ -76,7 +76,7 @@ func forceRemoveContainer(docker *Docker, id string) {
 
 // pullImage pulls a base image and drains the progress stream so the operation
 // actually completes before the test proceeds.
-func pullImage(t *testing.T, docker *Docker, ref string) {
+func pullImage(t *testing.T, docker Container, ref string) {
 	t.Helper()
 	ctx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
 	defer cancel()
@@ -92,7 +92,7 @@ const busyboxImage = "busybox:latest"
 // built image. The build uses busybox as the base so it needs only a single
 // small pull and no network at build time.
 func TestIntegrationDockerBuildAndImageOps(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	// Build's base image must be present locally or pullable. busybox is tiny.
 	pullImage(t, docker, busyboxImage)
@@ -160,7 +160,7 @@ func TestIntegrationDockerBuildAndImageOps(t *testing.T) {
 // against the live daemon. Both must succeed; we don't assert on the amount
 // reclaimed because a shared daemon's dangling set is non-deterministic.
 func TestIntegrationDockerPruneImages(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
@@ -181,7 +181,7 @@ func TestIntegrationDockerPruneImages(t *testing.T) {
 // ListContainers (name filter). This exercises the filter-parsing path of
 // ListContainers with a real filters.Args value.
 func TestIntegrationDockerGetAndListContainersFiltering(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	pullImage(t, docker, busyboxImage)
 
@@ -247,7 +247,7 @@ func TestIntegrationDockerGetAndListContainersFiltering(t *testing.T) {
 // with a known non-zero code and asserts WaitForContainerByName resolves the
 // container by name and reports that exit code.
 func TestIntegrationDockerWaitForContainerByName(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	pullImage(t, docker, busyboxImage)
 
@@ -281,7 +281,7 @@ func TestIntegrationDockerWaitForContainerByName(t *testing.T) {
 // asserts the expected stdout. This exercises the GetContainer -> ExecCreate ->
 // ExecAttach path against a live daemon.
 func TestIntegrationDockerExecCommand(t *testing.T) {
-	docker := newIntegrationDocker(t)
+	docker := newIntegrationRuntime(t)
 
 	pullImage(t, docker, busyboxImage)
 
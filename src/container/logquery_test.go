@@ -64,6 +64,12 @@ func TestLogQueryComposeArgs(t *testing.T) {
 			"--until", "2026-08-04T09:15:00Z",
 		}, args)
 	})
+
+	t.Run("a service is named after the flags", func(t *testing.T) {
+		args := LogQuery{Tail: 50, Service: "db"}.ComposeArgs()
+
+		assert.Equal(t, []string{"logs", "--no-color", "--tail", "50", "db"}, args)
+	})
 }
 
 func TestLogsOptionsFromDict(t *testing.T) {
@@ -0,0 +1,46 @@
+package container
+
+import (
+	"context"
+	"os/exec"
+	"reagent/config"
+
+	"github.com/docker/docker/client"
+)
+
+// Podman runs the apps on Podman through its Docker-compatible REST API, so
+// everything the API covers is shared with Docker. The podman CLI stands in
+// for the docker CLI (logins, prunes, `podman compose`); it has to run as the
+// same user as the socket's service to see the same storage.
+type Podman struct {
+	*Docker
+}
+
+// NewPodman connects to the Podman service listening on host, e.g.
+// unix:///run/podman/podman.sock.
+func NewPodman(config *config.Config, host string) (*Podman, error) {
+	docker, err := newDocker(config, "podman", client.WithHost(host))
+	if err != nil {
+		return nil, err
+	}
+
+	// `podman buildx` is an alias of `podman build` that takes a different
+	// cache syntax, so builds go through the compatible build API instead:
+	// the Buildx is never supported, nothing asks the CLI.
+	docker.buildx = &Buildx{binary: "podman"}
+
+	return &Podman{Docker: docker}, nil
+}
+
+// PruneBuildCache removes the build cache. Podman has no `builder prune`, its
+// cache is pruned together with the dangling images.
+func (podman *Podman) PruneBuildCache(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, podman.cli, "image", "prune", "--build-cache", "-f")
+	cmd.Stderr = cmd.Stdout
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
@@ -0,0 +1,95 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reagent/config"
+	"runtime"
+)
+
+const (
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// Where the daemons listen by default. The rootless Podman socket is relative
+// to XDG_RUNTIME_DIR.
+const (
+	podmanRootSocket     = "/run/podman/podman.sock"
+	podmanRootlessSocket = "podman/podman.sock"
+	dockerSocket         = "/var/run/docker.sock"
+)
+
+// runtimeContainerd is refused by name: bare containerd (nerdctl) has no
+// Docker-compatible API the agent could run apps through.
+const runtimeContainerd = "containerd"
+
+// ValidateRuntime checks a runtime given with -containerRuntime.
+func ValidateRuntime(setting string) error {
+	switch setting {
+	case "", "auto", RuntimeDocker, RuntimePodman:
+		return nil
+	case runtimeContainerd:
+		return fmt.Errorf("containerd is not supported as a container runtime, install Docker or Podman")
+	}
+	return fmt.Errorf("unsupported container runtime %q, use auto, docker or podman", setting)
+}
+
+// New sets up the container runtime chosen with -containerRuntime, detecting
+// it when set to auto.
+func New(config *config.Config) (Container, error) {
+	name, host := detectRuntime(config.CommandLineArguments.ContainerRuntime, os.Getenv, exists)
+
+	if name == RuntimePodman {
+		return NewPodman(config, host)
+	}
+	return NewDocker(config)
+}
+
+// detectRuntime picks the runtime and, for Podman, the host to connect to.
+// Docker wins whenever there is any sign of it, so devices that have always
+// run Docker keep doing so; Podman is only picked when it is the sole runtime
+// found, or when asked for explicitly.
+func detectRuntime(setting string, getenv func(string) string, exists func(string) bool) (string, string) {
+	if runtime.GOOS == "windows" || setting == RuntimeDocker {
+		return RuntimeDocker, ""
+	}
+
+	podmanHost := podmanHost(getenv, exists)
+	if setting == RuntimePodman {
+		if podmanHost == "" {
+			podmanHost = "unix://" + podmanRootSocket
+		}
+		return RuntimePodman, podmanHost
+	}
+
+	if getenv("DOCKER_HOST") != "" || exists(dockerSocket) || podmanHost == "" {
+		return RuntimeDocker, ""
+	}
+	return RuntimePodman, podmanHost
+}
+
+// podmanHost returns the Podman service to connect to, or "" if none is found.
+func podmanHost(getenv func(string) string, exists func(string) bool) string {
+	if host := getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+
+	sockets := []string{podmanRootSocket}
+	if runtimeDir := getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		sockets = append(sockets, filepath.Join(runtimeDir, podmanRootlessSocket))
+	}
+
+	for _, socket := range sockets {
+		if exists(socket) {
+			return "unix://" + socket
+		}
+	}
+	return ""
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,66 @@
+package container
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectRuntime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows always runs Docker")
+	}
+
+	tests := []struct {
+		name     string
+		setting  string
+		env      map[string]string
+		files    []string
+		wantName string
+		wantHost string
+	}{
+		{name: "nothing found falls back to docker", setting: "auto", wantName: RuntimeDocker},
+		{name: "docker socket", setting: "auto", files: []string{dockerSocket}, wantName: RuntimeDocker},
+		{name: "docker wins over podman", setting: "auto", files: []string{dockerSocket, podmanRootSocket}, wantName: RuntimeDocker},
+		{name: "DOCKER_HOST wins over podman", setting: "", env: map[string]string{"DOCKER_HOST": "tcp://docker:2375"}, files: []string{podmanRootSocket}, wantName: RuntimeDocker},
+		{name: "rootful podman", setting: "auto", files: []string{podmanRootSocket}, wantName: RuntimePodman, wantHost: "unix:///run/podman/podman.sock"},
+		{
+			name:     "rootless podman",
+			setting:  "auto",
+			env:      map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000"},
+			files:    []string{"/run/user/1000/podman/podman.sock"},
+			wantName: RuntimePodman,
+			wantHost: "unix:///run/user/1000/podman/podman.sock",
+		},
+		{name: "CONTAINER_HOST", setting: "auto", env: map[string]string{"CONTAINER_HOST": "tcp://podman:8080"}, wantName: RuntimePodman, wantHost: "tcp://podman:8080"},
+		{name: "docker asked for", setting: "docker", files: []string{podmanRootSocket}, wantName: RuntimeDocker},
+		{name: "podman asked for", setting: "podman", files: []string{dockerSocket}, wantName: RuntimePodman, wantHost: "unix:///run/podman/podman.sock"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			exists := func(path string) bool {
+				for _, file := range tt.files {
+					if file == path {
+						return true
+					}
+				}
+				return false
+			}
+
+			name, host := detectRuntime(tt.setting, getenv, exists)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, tt.wantHost, host)
+		})
+	}
+}
+
+func TestValidateRuntime(t *testing.T) {
+	for _, setting := range []string{"", "auto", "docker", "podman"} {
+		assert.NoError(t, ValidateRuntime(setting), setting)
+	}
+	assert.ErrorContains(t, ValidateRuntime("containerd"), "containerd is not supported")
+	assert.Error(t, ValidateRuntime("nerdctl"))
+}
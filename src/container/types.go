@@ -42,6 +42,7 @@ type ImageResult struct {
 	Labels      map[string]string `json:"labels,omitempty"`
 	Size        int64             `json:"size,omitempty"`
 	RepoTags    []string          `json:"repoTags,omitempty"`
+	RepoDigests []string          `json:"repoDigests,omitempty"`
 }
 
 type TtyDimension struct {
@@ -91,6 +92,8 @@ type Container interface {
 	RemoveContainerByName(ctx context.Context, containerName string, options map[string]interface{}) error
 	RemoveContainerByID(ctx context.Context, containerID string, options map[string]interface{}) error
 	Tag(ctx context.Context, source string, target string) error
+	LoadImage(ctx context.Context, archive io.Reader) ([]string, error)
+	SaveImage(ctx context.Context, images []string) (io.ReadCloser, error)
 	Pull(ctx context.Context, imageName string, options PullOptions) (io.ReadCloser, error)
 	Push(ctx context.Context, imageName string, pushOptions PushOptions) (io.ReadCloser, error)
 	CreateContainer(ctx context.Context, cConfig container.Config, hConfig container.HostConfig, nConfig network.NetworkingConfig, containerName string) (string, error)
@@ -106,7 +109,8 @@ type Container interface {
 	RemoveImagesByName(ctx context.Context, imageName string, options map[string]interface{}) error
 	PruneImages(ctx context.Context, options common.Dict) error
 	Compose() *Compose
-	PruneSystem() (string, error)
+	Buildx() *Buildx
+	PruneSystem(ctx context.Context) (string, error)
 	PruneAllImages() (string, error)
 	PruneDanglingImages(ctx context.Context) (string, error)
 	PruneBuildCache(ctx context.Context) (string, error)
@@ -0,0 +1,146 @@
+// Package daemonconfig manages the part of the Docker daemon configuration
+// (/etc/docker/daemon.json) the agent is responsible for: registry mirrors,
+// insecure registries, container log options, default address pools and the
+// data-root. The settings come from the backend; the agent merges them into
+// daemon.json next to whatever else an operator keeps there.
+//
+// The agent owns a key from the moment it writes it, and records what it wrote
+// (see Manager). A key the backend stops setting is removed again, unless
+// someone changed it in the meantime: then it is theirs and left alone. Keys
+// the agent never wrote are never touched.
+//
+// Mirrors and insecure registries are picked up by a reload of the daemon. The
+// other keys take a restart, which stops every container for a moment; the
+// daemon is only restarted after `dockerd --validate` accepted the new file,
+// and the previous file is put back when the daemon does not come up with it.
+package daemonconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+// Path is where the Docker daemon reads its configuration from.
+const Path = "/etc/docker/daemon.json"
+
+// fileMu serializes the writers of daemon.json within the agent.
+var fileMu sync.Mutex
+
+// Update reads the daemon configuration at path, lets edit change it, and
+// writes it back if edit reports a change. A missing file is an empty
+// configuration. A file that is not valid JSON is left unchanged and fails the
+// update: rewriting it would drop whatever the operator meant to put there.
+func Update(path string, edit func(cfg map[string]interface{}) bool) (bool, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	cfg, _, err := read(path)
+	if err != nil {
+		return false, err
+	}
+	if !edit(cfg) {
+		return false, nil
+	}
+
+	data, err := marshal(cfg)
+	if err != nil {
+		return false, err
+	}
+	return true, write(path, data)
+}
+
+// EnsureLogRotation caps the container logs of the daemon at path, unless a
+// log driver or log options are configured already. It reports whether it
+// changed the file; like all log settings, the cap only applies to containers
+// created after the next daemon restart.
+func EnsureLogRotation(path string) (bool, error) {
+	return Update(path, ensureLogRotation)
+}
+
+func ensureLogRotation(cfg map[string]interface{}) bool {
+	changed := false
+	if cfg["log-driver"] == nil {
+		cfg["log-driver"] = "json-file"
+		changed = true
+	}
+	if cfg["log-opts"] == nil {
+		cfg["log-opts"] = map[string]interface{}{"max-size": "10m", "max-file": "3"}
+		changed = true
+	}
+	return changed
+}
+
+// read returns the configuration at path and the file it was parsed from.
+func read(path string) (map[string]interface{}, []byte, error) {
+	cfg := map[string]interface{}{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not valid JSON: %w", path, err)
+		}
+	}
+
+	return cfg, data, nil
+}
+
+func marshal(cfg map[string]interface{}) ([]byte, error) {
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// write replaces the file at path with data, through a rename so the daemon
+// never reads half a file.
+func write(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// normalize returns value as it reads back from JSON, so it compares equal to
+// what was parsed from daemon.json.
+func normalize(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized interface{}
+	err = json.Unmarshal(data, &normalized)
+	return normalized, err
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,250 @@
+package daemonconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"reagent/common"
+	"reagent/messenger/topics"
+	"reagent/testutil/builders"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend answers GetDaemonConfig with settings and delivers notices.
+type fakeBackend struct {
+	settings    interface{}
+	calls       int
+	subscribers map[topics.Topic]func(common.Result) error
+}
+
+func (b *fakeBackend) Subscribe(topic topics.Topic, cb func(common.Result) error, options common.Dict) error {
+	if b.subscribers == nil {
+		b.subscribers = make(map[topics.Topic]func(common.Result) error)
+	}
+	b.subscribers[topic] = cb
+	return nil
+}
+
+func (b *fakeBackend) Call(ctx context.Context, topic topics.Topic, args []interface{}, kwargs common.Dict, options common.Dict, progCb func(common.Result)) (common.Result, error) {
+	if topic != topics.GetDaemonConfig {
+		return common.Result{}, fmt.Errorf("unexpected call to %s", topic)
+	}
+	b.calls++
+	return common.Result{Arguments: []interface{}{b.settings}}, nil
+}
+
+// fakeDaemon comes up after a restart unless it is down.
+type fakeDaemon struct {
+	down bool
+}
+
+func (d *fakeDaemon) WaitForDaemon(retryTimeout ...time.Duration) error {
+	if d.down {
+		return errors.New("maxium retry timeout for docker daemon ping was exceeded")
+	}
+	return nil
+}
+
+type testManager struct {
+	*Manager
+	backend  *fakeBackend
+	daemon   *fakeDaemon
+	commands []string
+	restarts int
+}
+
+func newTestManager(t *testing.T, daemonJSON string) *testManager {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := builders.NewTestConfigBuilder().WithDeviceKey(7).Build()
+
+	tm := &testManager{backend: &fakeBackend{}, daemon: &fakeDaemon{}}
+	tm.Manager = NewManager(tm.backend, cfg, tm.daemon, filepath.Join(dir, StateFileName), func() { tm.restarts++ })
+	tm.path = filepath.Join(dir, "daemon.json")
+	tm.run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		tm.commands = append(tm.commands, strings.Join(append([]string{name}, args...), " "))
+		if name == "dockerd" {
+			return nil, exec.ErrNotFound
+		}
+		return nil, nil
+	}
+
+	if daemonJSON != "" {
+		require.NoError(t, os.WriteFile(tm.path, []byte(daemonJSON), 0o644))
+	}
+	return tm
+}
+
+func (tm *testManager) daemonJSON(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	data, err := os.ReadFile(tm.path)
+	require.NoError(t, err)
+	cfg := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &cfg))
+	return cfg
+}
+
+func TestApply(t *testing.T) {
+	t.Run("mirrors are merged next to the operator's keys and reloaded", func(t *testing.T) {
+		tm := newTestManager(t, `{"debug": true, "log-driver": "json-file"}`)
+
+		require.NoError(t, tm.Apply(t.Context(), Settings{RegistryMirrors: []string{"https://mirror.local"}}))
+
+		cfg := tm.daemonJSON(t)
+		assert.Equal(t, true, cfg["debug"])
+		assert.Equal(t, "json-file", cfg["log-driver"])
+		assert.Equal(t, []interface{}{"https://mirror.local"}, cfg["registry-mirrors"])
+		assert.Contains(t, tm.commands, "systemctl reload docker")
+		assert.NotContains(t, tm.commands, "systemctl restart docker")
+		assert.Zero(t, tm.restarts)
+
+		// nothing changed, nothing to do
+		tm.commands = nil
+		require.NoError(t, tm.Apply(t.Context(), Settings{RegistryMirrors: []string{"https://mirror.local"}}))
+		assert.Empty(t, tm.commands)
+	})
+
+	t.Run("keys the backend stops setting are removed unless someone changed them", func(t *testing.T) {
+		tm := newTestManager(t, `{"registry-mirrors": ["https://operator.local"]}`)
+
+		require.NoError(t, tm.Apply(t.Context(), Settings{
+			RegistryMirrors:     []string{"https://mirror.local"},
+			DefaultAddressPools: []AddressPool{{Base: "172.80.0.0/16", Size: 24}},
+		}))
+		cfg := tm.daemonJSON(t)
+		assert.Equal(t, []interface{}{"https://mirror.local"}, cfg["registry-mirrors"])
+		assert.Equal(t, []interface{}{map[string]interface{}{"base": "172.80.0.0/16", "size": float64(24)}}, cfg["default-address-pools"])
+
+		// an operator edits the pools by hand
+		cfg["default-address-pools"] = []interface{}{map[string]interface{}{"base": "10.10.0.0/16", "size": float64(24)}}
+		data, err := json.Marshal(cfg)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(tm.path, data, 0o644))
+
+		require.NoError(t, tm.Apply(t.Context(), Settings{}))
+		cfg = tm.daemonJSON(t)
+		assert.NotContains(t, cfg, "registry-mirrors")
+		assert.Contains(t, cfg, "default-address-pools")
+
+		// and it is theirs from now on
+		tm.commands = nil
+		require.NoError(t, tm.Apply(t.Context(), Settings{}))
+		assert.Contains(t, tm.daemonJSON(t), "default-address-pools")
+		assert.Empty(t, tm.commands)
+	})
+
+	t.Run("released log options fall back to the log rotation", func(t *testing.T) {
+		tm := newTestManager(t, "")
+
+		require.NoError(t, tm.Apply(t.Context(), Settings{LogOpts: map[string]string{"max-size": "50m"}}))
+		assert.Equal(t, map[string]interface{}{"max-size": "50m"}, tm.daemonJSON(t)["log-opts"])
+		assert.Contains(t, tm.commands, "systemctl restart docker")
+		assert.Equal(t, 1, tm.restarts, "the apps are reconciled after the restart")
+
+		require.NoError(t, tm.Apply(t.Context(), Settings{}))
+		assert.Equal(t, map[string]interface{}{"max-size": "10m", "max-file": "3"}, tm.daemonJSON(t)["log-opts"])
+	})
+
+	t.Run("the previous settings are restored when the daemon does not come up", func(t *testing.T) {
+		tm := newTestManager(t, `{"debug": true}`)
+		tm.daemon.down = true
+
+		err := tm.Apply(t.Context(), Settings{DataRoot: "/apps/docker"})
+		require.Error(t, err)
+		assert.Equal(t, map[string]interface{}{"debug": true}, tm.daemonJSON(t))
+		assert.Equal(t, []string{"systemctl restart docker", "systemctl restart docker"}, tm.commands[len(tm.commands)-2:])
+
+		// not owned, as it was not applied
+		tm.daemon.down = false
+		require.NoError(t, tm.Apply(t.Context(), Settings{}))
+		assert.Equal(t, map[string]interface{}{"debug": true}, tm.daemonJSON(t))
+	})
+
+	t.Run("settings the daemon rejects are not written", func(t *testing.T) {
+		tm := newTestManager(t, `{"debug": true}`)
+		tm.run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+			tm.commands = append(tm.commands, name)
+			if name == "dockerd" {
+				return []byte("invalid data-root"), errors.New("exit status 1")
+			}
+			return nil, nil
+		}
+
+		err := tm.Apply(t.Context(), Settings{DataRoot: "relative"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid data-root")
+		assert.Equal(t, map[string]interface{}{"debug": true}, tm.daemonJSON(t))
+		assert.Equal(t, []string{"dockerd"}, tm.commands)
+	})
+
+	t.Run("a daemon.json that is not JSON is left alone", func(t *testing.T) {
+		tm := newTestManager(t, `{"debug": true,`)
+
+		err := tm.Apply(t.Context(), Settings{RegistryMirrors: []string{"https://mirror.local"}})
+		require.Error(t, err)
+
+		data, err := os.ReadFile(tm.path)
+		require.NoError(t, err)
+		assert.Equal(t, `{"debug": true,`, string(data))
+		assert.Empty(t, tm.commands)
+	})
+
+	t.Run("the insecure registries of the device config are kept", func(t *testing.T) {
+		tm := newTestManager(t, "")
+		tm.config.ReswarmConfig.InsecureRegistries = "registry.local:5000"
+
+		require.NoError(t, tm.Apply(t.Context(), Settings{InsecureRegistries: []string{"mirror.local:5000", "registry.local:5000"}}))
+		assert.Equal(t, []interface{}{"registry.local:5000", "mirror.local:5000"}, tm.daemonJSON(t)["insecure-registries"])
+	})
+}
+
+func TestSync(t *testing.T) {
+	tm := newTestManager(t, "")
+	tm.backend.settings = map[string]interface{}{"registry_mirrors": []interface{}{"https://mirror.local"}}
+
+	require.NoError(t, tm.Sync(t.Context()))
+	assert.Equal(t, []interface{}{"https://mirror.local"}, tm.daemonJSON(t)["registry-mirrors"])
+
+	// a notice has the settings fetched again, whatever it carries
+	tm.backend.settings = nil
+	notice := tm.backend.subscribers[topics.Topic("reswarm.device.7.daemon_config_changed")]
+	require.NotNil(t, notice)
+	require.NoError(t, notice(common.Result{Arguments: []interface{}{map[string]interface{}{"data_root": "/elsewhere"}}}))
+
+	assert.Equal(t, 2, tm.backend.calls)
+	cfg := tm.daemonJSON(t)
+	assert.NotContains(t, cfg, "registry-mirrors")
+	assert.NotContains(t, cfg, "data-root")
+}
+
+func TestEnsureLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"log-driver": "journald"}`), 0o644))
+
+	changed, err := EnsureLogRotation(path)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	cfg := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &cfg))
+	assert.Equal(t, "journald", cfg["log-driver"], "an operator's log driver is kept")
+	assert.Equal(t, map[string]interface{}{"max-size": "10m", "max-file": "3"}, cfg["log-opts"])
+
+	changed, err = EnsureLogRotation(path)
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
@@ -0,0 +1,432 @@
+package daemonconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reagent/common"
+	"reagent/config"
+	"reagent/messenger/topics"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StateFileName is the file in the agent directory that records the keys the
+// agent wrote into daemon.json.
+const StateFileName = "daemon-config.json"
+
+const (
+	// restartTimeout bounds how long the daemon may take to come up again.
+	restartTimeout = 2 * time.Minute
+	// commandTimeout bounds systemctl and dockerd --validate.
+	commandTimeout = 3 * time.Minute
+	fetchTimeout   = 10 * time.Second
+)
+
+// reloadable are the keys the daemon applies on a reload, without a restart.
+var reloadable = map[string]bool{
+	"registry-mirrors":    true,
+	"insecure-registries": true,
+}
+
+// Settings are the daemon settings the backend manages. Unset fields leave
+// their daemon.json key to the operator.
+type Settings struct {
+	RegistryMirrors     []string          `json:"registry_mirrors,omitempty"`
+	InsecureRegistries  []string          `json:"insecure_registries,omitempty"`
+	LogDriver           string            `json:"log_driver,omitempty"`
+	LogOpts             map[string]string `json:"log_opts,omitempty"`
+	DefaultAddressPools []AddressPool     `json:"default_address_pools,omitempty"`
+	DataRoot            string            `json:"data_root,omitempty"`
+}
+
+// AddressPool is a range the daemon allocates the subnets of new networks
+// from, e.g. {"base": "172.80.0.0/16", "size": 24}.
+type AddressPool struct {
+	Base string `json:"base"`
+	Size int    `json:"size"`
+}
+
+// keys returns the daemon.json keys of the settings, nil for those not set.
+func (s Settings) keys() map[string]interface{} {
+	keys := map[string]interface{}{
+		"registry-mirrors":      nil,
+		"insecure-registries":   nil,
+		"log-driver":            nil,
+		"log-opts":              nil,
+		"default-address-pools": nil,
+		"data-root":             nil,
+	}
+
+	if len(s.RegistryMirrors) > 0 {
+		keys["registry-mirrors"] = s.RegistryMirrors
+	}
+	if len(s.InsecureRegistries) > 0 {
+		keys["insecure-registries"] = s.InsecureRegistries
+	}
+	if s.LogDriver != "" {
+		keys["log-driver"] = s.LogDriver
+	}
+	if len(s.LogOpts) > 0 {
+		keys["log-opts"] = s.LogOpts
+	}
+	if len(s.DefaultAddressPools) > 0 {
+		keys["default-address-pools"] = s.DefaultAddressPools
+	}
+	if s.DataRoot != "" {
+		keys["data-root"] = s.DataRoot
+	}
+
+	return keys
+}
+
+// Backend is the subset of the messenger the manager needs. The messenger
+// cannot be imported here: it reports the disk state of diskguard, which
+// writes daemon.json through this package.
+type Backend interface {
+	Subscribe(topic topics.Topic, cb func(common.Result) error, options common.Dict) error
+	Call(ctx context.Context, topic topics.Topic, args []interface{}, kwargs common.Dict, options common.Dict, progCb func(common.Result)) (common.Result, error)
+}
+
+// Daemon is the subset of the container layer the manager needs.
+type Daemon interface {
+	WaitForDaemon(retryTimeout ...time.Duration) error
+}
+
+// Manager applies the daemon settings of the backend to daemon.json and the
+// running daemon.
+type Manager struct {
+	backend   Backend
+	config    *config.Config
+	docker    Daemon
+	path      string
+	statePath string
+	onRestart func()
+
+	// run runs a command and returns its combined output.
+	run func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+	mu sync.Mutex
+}
+
+// NewManager returns a manager of the daemon configuration at Path that keeps
+// its record of the keys it owns at statePath. onRestart is called after the
+// daemon was restarted, to reconcile the apps whose containers it stopped.
+func NewManager(backend Backend, config *config.Config, docker Daemon, statePath string, onRestart func()) *Manager {
+	return &Manager{
+		backend:   backend,
+		config:    config,
+		docker:    docker,
+		path:      Path,
+		statePath: statePath,
+		onRestart: onRestart,
+		run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+			return exec.CommandContext(ctx, name, args...).CombinedOutput()
+		},
+	}
+}
+
+// Sync applies the settings the backend has for the device and subscribes to
+// its notice that they changed. Called on every connect. A notice carries no
+// settings: they are always fetched, so only what the backend answers is
+// applied.
+func (m *Manager) Sync(ctx context.Context) error {
+	deviceKey := uint64(m.config.ReswarmConfig.DeviceKey)
+	changedTopic := topics.Topic(fmt.Sprintf(string(topics.DaemonConfigChanged), deviceKey))
+
+	err := m.backend.Subscribe(changedTopic, func(r common.Result) error {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+
+		err := m.fetchAndApply(fetchCtx)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to apply the changed Docker daemon settings")
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to Docker daemon settings: %w", err)
+	}
+
+	return m.fetchAndApply(ctx)
+}
+
+func (m *Manager) fetchAndApply(ctx context.Context) error {
+	args := []interface{}{common.Dict{
+		"device_key": uint64(m.config.ReswarmConfig.DeviceKey),
+		"swarm_key":  uint64(m.config.ReswarmConfig.SwarmKey),
+	}}
+	res, err := m.backend.Call(ctx, topics.GetDaemonConfig, args, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch Docker daemon settings: %w", err)
+	}
+
+	var arg interface{}
+	if len(res.Arguments) > 0 {
+		arg = res.Arguments[0]
+	}
+	settings, err := parseSettings(arg)
+	if err != nil {
+		return err
+	}
+
+	// The fetch is bounded; a restart takes as long as it takes.
+	return m.Apply(context.Background(), settings)
+}
+
+// parseSettings reads the settings of the backend; none (nil) are the empty
+// settings.
+func parseSettings(arg interface{}) (Settings, error) {
+	var settings Settings
+	if arg == nil {
+		return settings, nil
+	}
+
+	data, err := json.Marshal(arg)
+	if err == nil {
+		err = json.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		return Settings{}, fmt.Errorf("invalid Docker daemon settings: %w", err)
+	}
+	return settings, nil
+}
+
+// Apply merges settings into daemon.json and reloads or restarts the daemon as
+// the changed keys need. The insecure registries of the device config are
+// always included.
+func (m *Manager) Apply(ctx context.Context, settings Settings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	settings.InsecureRegistries = mergeLists(splitList(m.config.ReswarmConfig.InsecureRegistries), settings.InsecureRegistries)
+
+	owned, err := m.readState()
+	if err != nil {
+		return err
+	}
+
+	fileMu.Lock()
+	cfg, previous, err := read(m.path)
+	if err != nil {
+		fileMu.Unlock()
+		return err
+	}
+
+	changed, err := merge(cfg, owned, settings.keys())
+	if err != nil || len(changed) == 0 {
+		fileMu.Unlock()
+		if err != nil {
+			return err
+		}
+		return m.writeState(owned)
+	}
+
+	data, err := marshal(cfg)
+	if err == nil {
+		err = m.validate(ctx, data)
+	}
+	if err == nil {
+		err = write(m.path, data)
+	}
+	fileMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	needsRestart := false
+	for _, key := range changed {
+		needsRestart = needsRestart || !reloadable[key]
+	}
+
+	if !needsRestart {
+		log.Info().Strs("keys", changed).Msg("reloading the Docker daemon to apply its new settings")
+		out, err := m.runCommand(ctx, "systemctl", "reload", "docker")
+		if err != nil {
+			log.Error().Err(err).Str("output", out).Msg("failed to reload the Docker daemon, its new settings apply on its next restart")
+		}
+		return m.writeState(owned)
+	}
+
+	log.Warn().Strs("keys", changed).Msg("restarting the Docker daemon to apply its new settings")
+	err = m.restart(ctx)
+	if err == nil {
+		return m.writeState(owned)
+	}
+
+	// Put the previous configuration back, so the device does not stay
+	// without a daemon.
+	log.Error().Err(err).Msg("the Docker daemon did not come up with its new settings, restoring the previous ones")
+	fileMu.Lock()
+	if previous == nil {
+		err = os.Remove(m.path)
+	} else {
+		err = write(m.path, previous)
+	}
+	fileMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to restore the previous Docker daemon settings: %w", err)
+	}
+
+	restoreErr := m.restart(ctx)
+	if restoreErr != nil {
+		return fmt.Errorf("the Docker daemon does not come up with the previous settings either: %w", restoreErr)
+	}
+	return errors.New("the Docker daemon did not come up with the new settings, the previous ones were restored")
+}
+
+// merge sets the keys of desired in cfg and records them as owned; a key
+// desired no longer is removed if it still has the value the agent wrote. It
+// returns the keys it changed.
+func merge(cfg map[string]interface{}, owned map[string]interface{}, desired map[string]interface{}) ([]string, error) {
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	changed := []string{}
+	for _, key := range keys {
+		current, present := cfg[key]
+
+		if desired[key] != nil {
+			value, err := normalize(desired[key])
+			if err != nil {
+				return nil, err
+			}
+
+			owned[key] = value
+			if !present || !equal(current, value) {
+				cfg[key] = value
+				changed = append(changed, key)
+			}
+			continue
+		}
+
+		wrote, ok := owned[key]
+		if !ok {
+			continue
+		}
+		delete(owned, key)
+		if present && equal(current, wrote) {
+			delete(cfg, key)
+			changed = append(changed, key)
+		}
+	}
+
+	// Released log settings fall back to the rotation every device gets.
+	for _, key := range []string{"log-driver", "log-opts"} {
+		if slices.Contains(changed, key) && cfg[key] == nil {
+			ensureLogRotation(cfg)
+			break
+		}
+	}
+
+	return changed, nil
+}
+
+// validate has the daemon check data as its configuration. Daemons without
+// `dockerd --validate` (before Docker 23) are not asked.
+func (m *Manager) validate(ctx context.Context, data []byte) error {
+	file := m.path + ".validate"
+	err := os.WriteFile(file, data, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	out, err := m.runCommand(ctx, "dockerd", "--validate", "--config-file", file)
+	if errors.Is(err, exec.ErrNotFound) || strings.Contains(out, "unknown flag") {
+		log.Debug().Msg("the Docker daemon cannot validate its configuration, applying it unchecked")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("the Docker daemon rejects the settings: %s", out)
+	}
+	return nil
+}
+
+// restart restarts the daemon, waits for it and has the apps reconciled.
+func (m *Manager) restart(ctx context.Context) error {
+	out, err := m.runCommand(ctx, "systemctl", "restart", "docker")
+	if err == nil {
+		err = m.docker.WaitForDaemon(restartTimeout)
+	} else if out != "" {
+		err = fmt.Errorf("%w: %s", err, out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if m.onRestart != nil {
+		m.onRestart()
+	}
+	return nil
+}
+
+func (m *Manager) runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	out, err := m.run(ctx, name, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// readState returns the keys the agent wrote into daemon.json, with the values
+// it wrote.
+func (m *Manager) readState() (map[string]interface{}, error) {
+	owned := map[string]interface{}{}
+
+	data, err := os.ReadFile(m.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return owned, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &owned)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", m.statePath, err)
+	}
+	return owned, nil
+}
+
+func (m *Manager) writeState(owned map[string]interface{}) error {
+	data, err := marshal(owned)
+	if err != nil {
+		return err
+	}
+	return write(m.statePath, data)
+}
+
+// splitList splits a comma separated list.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// mergeLists returns the values of both lists once, in order.
+func mergeLists(a, b []string) []string {
+	var merged []string
+	for _, value := range append(append([]string{}, a...), b...) {
+		if !slices.Contains(merged, value) {
+			merged = append(merged, value)
+		}
+	}
+	return merged
+}
@@ -30,13 +30,14 @@ package diskguard
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reagent/common"
 	"reagent/container"
+	"reagent/daemonconfig"
 	"reagent/safe"
 	"strings"
 	"sync"
@@ -86,6 +87,10 @@ var emergency atomic.Bool
 // IsEmergency reports whether the device is currently in a disk-emergency.
 func IsEmergency() bool { return emergency.Load() }
 
+// ErrEmergency is the cause builds are aborted with when the device enters a
+// disk-emergency.
+var ErrEmergency = errors.New("disk emergency: device is critically low on storage")
+
 // setEmergency stores v and returns true if the value changed.
 func setEmergency(v bool) bool { return emergency.Swap(v) != v }
 
@@ -98,7 +103,6 @@ const (
 	composeProjectLabel     = "com.docker.compose.project"
 	applianceComposeProject = "ironflock-appliance"
 
-	daemonJSONPath = "/etc/docker/daemon.json"
 	journaldDropin = "/etc/systemd/journald.conf.d/10-ironflock.conf"
 )
 
@@ -141,6 +145,9 @@ type Config struct {
 	// stages. Anything else under AppImageRegistry is a superseded leftover. An
 	// error means the wanted set is unknown — no app image is then touched.
 	WantedAppImages func() (map[string]bool, error)
+	// OnEmergency is called once when the device enters EMERGENCY, to abort the
+	// image builds in flight, which would only fill the disk further.
+	OnEmergency func()
 	// OnRecover is called once when the device leaves EMERGENCY, to reinstate the
 	// apps' previous requested states (which were stopped/blocked during it).
 	OnRecover func()
@@ -268,7 +275,10 @@ func (g *Guard) updateEmergency(free int64) {
 	case actEmergency:
 		if setEmergency(true) {
 			log.Error().Int64("free_mb", free>>20).
-				Msg("diskguard: ENTERING disk-emergency — failing new app start/build/download and stopping non-platform containers")
+				Msg("diskguard: ENTERING disk-emergency — failing new app start/build/download, aborting builds and stopping non-platform containers")
+			if g.cfg.OnEmergency != nil {
+				safe.Go(g.cfg.OnEmergency)
+			}
 		}
 		g.stopForeignContainers()
 	case actNone:
@@ -656,41 +666,14 @@ func EnsurePreventionConfig() {
 }
 
 func ensureDockerLogRotation() {
-	cfg := map[string]interface{}{}
-	if data, err := os.ReadFile(daemonJSONPath); err == nil && len(data) > 0 {
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			log.Error().Err(err).Msg("diskguard: daemon.json is not valid JSON; leaving it unchanged")
-			return
-		}
-	}
-
-	changed := false
-	if cfg["log-driver"] == nil {
-		cfg["log-driver"] = "json-file"
-		changed = true
-	}
-	if cfg["log-opts"] == nil {
-		cfg["log-opts"] = map[string]interface{}{"max-size": "10m", "max-file": "3"}
-		changed = true
-	}
-	if !changed {
-		return
-	}
-
-	out, err := json.MarshalIndent(cfg, "", "  ")
+	changed, err := daemonconfig.EnsureLogRotation(daemonconfig.Path)
 	if err != nil {
-		log.Error().Err(err).Msg("diskguard: failed to marshal daemon.json")
+		log.Error().Err(err).Msg("diskguard: failed to set Docker container-log rotation; leaving daemon.json unchanged")
 		return
 	}
-	if err := os.MkdirAll(filepath.Dir(daemonJSONPath), 0o755); err != nil {
-		log.Error().Err(err).Msg("diskguard: failed to ensure /etc/docker")
-		return
-	}
-	if err := os.WriteFile(daemonJSONPath, append(out, '\n'), 0o644); err != nil {
-		log.Error().Err(err).Msg("diskguard: failed to write daemon.json")
-		return
+	if changed {
+		log.Info().Msg("diskguard: set Docker container-log rotation in daemon.json (effective for containers created after the next Docker restart)")
 	}
-	log.Info().Msg("diskguard: set Docker container-log rotation in daemon.json (effective for containers created after the next Docker restart)")
 }
 
 func ensureJournaldCap() {
@@ -60,6 +60,35 @@ func TestUpdateEmergencyHysteresis(t *testing.T) {
 	}
 }
 
+func TestUpdateEmergencyCallbacks(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	recovered := make(chan struct{}, 2)
+	g := New(nil, Config{
+		OnEmergency: func() { entered <- struct{}{} },
+		OnRecover:   func() { recovered <- struct{}{} },
+	})
+	defer setEmergency(false)
+
+	const gb = int64(1 << 30)
+
+	g.updateEmergency(512 * 1024 * 1024)
+	g.updateEmergency(512 * 1024 * 1024) // still in it -> not called again
+	g.updateEmergency(3 * gb)
+
+	for _, ch := range []chan struct{}{entered, recovered} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("expected the callback to be called")
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(entered) != 0 || len(recovered) != 0 {
+		t.Fatal("expected each callback to be called once")
+	}
+}
+
 // fakeDocker implements the Docker interface for volume-pruning and
 // image-reclaim tests.
 type fakeDocker struct {
@@ -27,12 +27,17 @@ var classifiers = []errClassifier{
 	{"ContainerNotFound", ContainerNotFound, IsContainerNotFound},
 	{"ImageNotFound", ImageNotFound, IsImageNotFound},
 	{"InsufficientPrivileges", InsufficientPrivileges, IsInsufficientPrivileges},
+	{"RateLimited", RateLimited, IsRateLimited},
+	{"ConcurrencyLimitReached", ConcurrencyLimitReached, IsConcurrencyLimitReached},
+	{"PrivilegeCheckFailed", PrivilegeCheckFailed, IsPrivilegeCheckFailed},
+	{"TimedOut", TimedOut, IsTimedOut},
 	{"ContainerRemovalAlreadyInProgress", ContainerRemovalAlreadyInProgress, IsContainerRemovalAlreadyInProgress},
 	{"DockerfileCannotBeEmpty", DockerfileCannotBeEmpty, IsDockerfileCannotBeEmpty},
 	{"DockerfileIsMissing", DockerfileIsMissing, IsDockerfileIsMissing},
 	{"DockerBuildFilesNotFound", DockerBuildFilesNotFound, IsDockerBuildFilesNotFound},
 	{"DockerStreamCanceled", DockerStreamCanceled, IsDockerStreamCanceled},
 	{"DockerComposeNotSupported", DockerComposeNotSupported, IsDockerComposeNotSupported},
+	{"ImageSignatureInvalid", ImageSignatureInvalid, IsImageSignatureInvalid},
 }
 
 func TestConstructorWrapsAndPredicateMatches(t *testing.T) {
@@ -221,6 +226,7 @@ func TestCauseMatchesUnwrap(t *testing.T) {
 		{"DockerBuildFilesNotFound", DockerBuildFilesNotFound(cause)},
 		{"DockerStreamCanceled", DockerStreamCanceled(cause)},
 		{"DockerComposeNotSupported", DockerComposeNotSupported(cause)},
+		{"ImageSignatureInvalid", ImageSignatureInvalid(cause)},
 		{"InProgress", InProgress(cause)},
 	}
 
@@ -110,6 +110,86 @@ func InsufficientPrivileges(err error) error {
 
 /*------------*/
 
+type ErrRateLimited struct{ error }
+
+func (e ErrRateLimited) Cause() error {
+	return e.error
+}
+
+func (e ErrRateLimited) Unwrap() error {
+	return e.error
+}
+
+func RateLimited(err error) error {
+	if err == nil || IsRateLimited(err) {
+		return err
+	}
+
+	return ErrRateLimited{err}
+}
+
+/*------------*/
+
+type ErrConcurrencyLimitReached struct{ error }
+
+func (e ErrConcurrencyLimitReached) Cause() error {
+	return e.error
+}
+
+func (e ErrConcurrencyLimitReached) Unwrap() error {
+	return e.error
+}
+
+func ConcurrencyLimitReached(err error) error {
+	if err == nil || IsConcurrencyLimitReached(err) {
+		return err
+	}
+
+	return ErrConcurrencyLimitReached{err}
+}
+
+/*------------*/
+
+type ErrPrivilegeCheckFailed struct{ error }
+
+func (e ErrPrivilegeCheckFailed) Cause() error {
+	return e.error
+}
+
+func (e ErrPrivilegeCheckFailed) Unwrap() error {
+	return e.error
+}
+
+func PrivilegeCheckFailed(err error) error {
+	if err == nil || IsPrivilegeCheckFailed(err) {
+		return err
+	}
+
+	return ErrPrivilegeCheckFailed{err}
+}
+
+/*------------*/
+
+type ErrTimedOut struct{ error }
+
+func (e ErrTimedOut) Cause() error {
+	return e.error
+}
+
+func (e ErrTimedOut) Unwrap() error {
+	return e.error
+}
+
+func TimedOut(err error) error {
+	if err == nil || IsTimedOut(err) {
+		return err
+	}
+
+	return ErrTimedOut{err}
+}
+
+/*------------*/
+
 type ErrContainerRemovalAlreadyInProgress struct{ error }
 
 func (e ErrContainerRemovalAlreadyInProgress) Cause() error {
@@ -300,3 +380,25 @@ func DockerComposeNotSupported(err error) error {
 
 	return ErrDockerComposeNotSupported{err}
 }
+
+/*-----------*/
+
+type ErrImageSignatureInvalid struct {
+	error
+}
+
+func (e ErrImageSignatureInvalid) Cause() error {
+	return e.error
+}
+
+func (e ErrImageSignatureInvalid) Unwrap() error {
+	return e.error
+}
+
+func ImageSignatureInvalid(err error) error {
+	if err == nil || IsImageSignatureInvalid(err) {
+		return err
+	}
+
+	return ErrImageSignatureInvalid{err}
+}
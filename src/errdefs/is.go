@@ -50,6 +50,11 @@ func IsDockerComposeNotSupported(err error) bool {
 	return ok
 }
 
+func IsImageSignatureInvalid(err error) bool {
+	_, ok := err.(ErrImageSignatureInvalid)
+	return ok
+}
+
 func IsNoActionTransition(err error) bool {
 	_, ok := err.(ErrNoActionTransition)
 	return ok
@@ -69,3 +74,23 @@ func IsInsufficientPrivileges(err error) bool {
 	_, ok := err.(ErrInsufficientPrivileges)
 	return ok
 }
+
+func IsRateLimited(err error) bool {
+	_, ok := err.(ErrRateLimited)
+	return ok
+}
+
+func IsConcurrencyLimitReached(err error) bool {
+	_, ok := err.(ErrConcurrencyLimitReached)
+	return ok
+}
+
+func IsPrivilegeCheckFailed(err error) bool {
+	_, ok := err.(ErrPrivilegeCheckFailed)
+	return ok
+}
+
+func IsTimedOut(err error) bool {
+	_, ok := err.(ErrTimedOut)
+	return ok
+}
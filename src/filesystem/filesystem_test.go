@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -381,7 +382,7 @@ func TestDownloadURL(t *testing.T) {
 	dest := filepath.Join(t.TempDir(), "out.bin")
 
 	var lastProgress DownloadProgress
-	err := DownloadURL(dest, srv.URL, func(dp DownloadProgress) { lastProgress = dp })
+	err := DownloadURL(context.Background(), dest, srv.URL, func(dp DownloadProgress) { lastProgress = dp })
 	require.NoError(t, err)
 
 	got, err := os.ReadFile(dest)
@@ -410,7 +411,7 @@ func TestDownloadURLMissingContentLength(t *testing.T) {
 	defer srv.Close()
 
 	dest := filepath.Join(t.TempDir(), "out.bin")
-	err := DownloadURL(dest, srv.URL, nil)
+	err := DownloadURL(context.Background(), dest, srv.URL, nil)
 	require.Error(t, err, "missing Content-Length should error")
 
 	// The lock must still be released on the error path.
@@ -418,6 +419,29 @@ func TestDownloadURLMissingContentLength(t *testing.T) {
 	assert.False(t, locked, "download lock should be released even on error")
 }
 
+func TestDownloadURLCancel(t *testing.T) {
+	// Send the first half of the body, then stall until the client gives up.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20")
+		_, _ = w.Write([]byte("first-half"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "out.bin")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := DownloadURL(ctx, dest, srv.URL, func(dp DownloadProgress) { cancel() })
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, statErr := os.Stat(dest)
+	assert.True(t, os.IsNotExist(statErr), "the partial download should be removed")
+	_, locked := DownloadLocks[dest]
+	assert.False(t, locked, "download lock should be released after cancelling")
+}
+
 func TestGetRemoteFile(t *testing.T) {
 	payload := []byte("remote-file-body")
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
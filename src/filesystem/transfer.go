@@ -31,6 +31,7 @@ type FileChunk struct {
 	FileName      string
 	FilePath      string
 	Data          string
+	Binary        []byte // the chunk's data as bytes, used instead of Data when set
 	ContainerName string
 	Total         uint64
 }
@@ -74,7 +75,8 @@ func (fs *Filesystem) GetActiveTransfer(containerName string) *ActiveFileTransfe
 	return activeTransfer
 }
 
-// Write decodes hex encoded data chunks and writes to a file.
+// Write decodes hex encoded data chunks, or takes binary ones as they are, and
+// writes to a file.
 //
 // Matches implementation in file_transfer.ts (IronFlock Backend)
 func (fs *Filesystem) Write(chunk FileChunk) error {
@@ -154,9 +156,13 @@ func (fs *Filesystem) Write(chunk FileChunk) error {
 		return errors.New("active transfer has no open file handle")
 	}
 
-	data, err := hex.DecodeString(chunk.Data)
-	if err != nil {
-		return err
+	data := chunk.Binary
+	if data == nil {
+		var err error
+		data, err = hex.DecodeString(chunk.Data)
+		if err != nil {
+			return err
+		}
 	}
 
 	n, err := activeTransfer.File.Write(data)
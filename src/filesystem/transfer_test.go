@@ -72,6 +72,30 @@ func TestWriteMultipleChunks(t *testing.T) {
 	require.Equal(t, "first-part-second-part", string(got), "file content mismatch")
 }
 
+func TestWriteBinaryChunks(t *testing.T) {
+	dir := t.TempDir()
+	fSys := New()
+
+	container := "binary-app"
+	fileName := "app.tgz"
+	id := "transfer-bin"
+	part1 := []byte{0x1F, 0x8B, 0x00}
+	part2 := []byte("text")
+	total := uint64(len(part1) + len(part2))
+
+	binaryChunk := newTestChunk(container, fileName, dir, id, "", total)
+	binaryChunk.Binary = part1
+
+	require.NoError(t, fSys.Write(newTestChunk(container, fileName, dir, id, "BEGIN", total)))
+	require.NoError(t, fSys.Write(binaryChunk))
+	require.NoError(t, fSys.Write(newTestChunk(container, fileName, dir, id, hex.EncodeToString(part2), total)))
+	require.NoError(t, fSys.Write(newTestChunk(container, fileName, dir, id, "END", total)))
+
+	got, err := os.ReadFile(filepath.Join(dir, fileName))
+	require.NoError(t, err)
+	require.Equal(t, append(part1, part2...), got)
+}
+
 func TestWriteSecondTransferReplacesFirst(t *testing.T) {
 	dir := t.TempDir()
 	fSys := New()
@@ -3,6 +3,7 @@ package filesystem
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -129,8 +130,9 @@ func printCallBack(dp DownloadProgress) {
 	fmt.Printf("\rDownloading... %+v", dp)
 }
 
-// Downloads any data from a given URL to a given filePath. Progress is logged to CLI
-func DownloadURL(filePath string, url string, callback func(DownloadProgress)) error {
+// Downloads any data from a given URL to a given filePath. Progress is logged to CLI.
+// Cancelling ctx aborts the download and removes the partial file.
+func DownloadURL(ctx context.Context, filePath string, url string, callback func(DownloadProgress)) error {
 	var currentLock *semaphore.Weighted
 	if DownloadLocks[filePath] == nil {
 		currentLock = semaphore.NewWeighted(1)
@@ -172,11 +174,21 @@ func DownloadURL(filePath string, url string, callback func(DownloadProgress)) e
 		},
 	}
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
 
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			out.Close()
+			os.Remove(filePath)
+			return ctx.Err()
+		}
+		return err
+	}
+
 	defer resp.Body.Close()
 
 	size, err := strconv.Atoi(resp.Header.Get("Content-Length"))
@@ -187,6 +199,11 @@ func DownloadURL(filePath string, url string, callback func(DownloadProgress)) e
 	// copy the http body into the file
 	counter := &WriteCounter{callback: callback, Size: uint64(size), FilePath: filePath}
 	if _, err = io.Copy(out, io.TeeReader(resp.Body, counter)); err != nil {
+		if ctx.Err() != nil {
+			out.Close()
+			os.Remove(filePath)
+			return ctx.Err()
+		}
 		return err
 	}
 
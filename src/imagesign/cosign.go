@@ -0,0 +1,147 @@
+package imagesign
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reagent/oci"
+	"strings"
+)
+
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+)
+
+// simpleSigning is the payload cosign signs.
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifyCosign looks for a cosign signature of the digest the policy trusts
+// and returns its signer.
+func (p *Policy) verifyCosign(ctx context.Context, registry *oci.Client, digest string) (string, error) {
+	signatures, _, err := registry.Manifest(ctx, strings.Replace(digest, ":", "-", 1)+".sig")
+	if errors.Is(err, oci.ErrNotFound) {
+		return "", ErrUnsigned
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(signatures.Layers) == 0 {
+		return "", ErrUnsigned
+	}
+
+	lastErr := ErrUntrusted
+	for i, layer := range signatures.Layers {
+		if i == maxSignatures {
+			break
+		}
+
+		signer, err := p.verifyCosignLayer(ctx, registry, digest, layer)
+		if err == nil {
+			return signer, nil
+		}
+		lastErr = err
+	}
+
+	return "", lastErr
+}
+
+func (p *Policy) verifyCosignLayer(ctx context.Context, registry *oci.Client, digest string, layer oci.Descriptor) (string, error) {
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil || len(signature) == 0 {
+		return "", fmt.Errorf("%w: malformed cosign signature", ErrUntrusted)
+	}
+
+	payload, err := registry.Blob(ctx, layer.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	var signed simpleSigning
+	err = json.Unmarshal(payload, &signed)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed cosign payload", ErrUntrusted)
+	}
+
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return "", fmt.Errorf("%w: the signature covers %s", ErrUntrusted, signed.Critical.Image.DockerManifestDigest)
+	}
+
+	if certificate := layer.Annotations[cosignCertificateAnnotation]; certificate != "" {
+		leaf, intermediates, err := parseCertificateChain(certificate, layer.Annotations[cosignChainAnnotation])
+		if err != nil {
+			return "", err
+		}
+
+		err = p.verifyChain(leaf, intermediates)
+		if err == nil && verifySHA256Signature(leaf.PublicKey, payload, signature) {
+			return leaf.Subject.String(), nil
+		}
+	}
+
+	for _, key := range p.keys {
+		if verifySHA256Signature(key, payload, signature) {
+			return keyFingerprint(key), nil
+		}
+	}
+
+	return "", ErrUntrusted
+}
+
+// parseCertificateChain parses the PEM leaf certificate and chain cosign
+// attaches to a signature.
+func parseCertificateChain(leafPEM string, chainPEM string) (*x509.Certificate, []*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(leafPEM + "\n" + chainPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: malformed signing certificate", ErrUntrusted)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("%w: malformed signing certificate", ErrUntrusted)
+	}
+	return certs[0], certs[1:], nil
+}
+
+// verifySHA256Signature checks a signature the way cosign makes it: SHA-256
+// with ECDSA (ASN.1) or RSA PKCS #1 v1.5, or Ed25519 over the data itself.
+func verifySHA256Signature(key crypto.PublicKey, data []byte, signature []byte) bool {
+	hash := sha256.Sum256(data)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+// Package imagesign verifies that an app image was signed by a trusted
+// publisher before it is run, the counterpart for app images of what codesign
+// does for the agent binary.
+//
+// Two signature formats are understood, both read from the registry the image
+// lives in:
+//
+//   - cosign: simple signing payloads in the `sha256-<digest>.sig` tag, signed
+//     with a configured public key, or by a certificate that chains to a
+//     configured root
+//   - Notary v2 (notation): JWS envelopes attached to the image through the
+//     OCI referrers API (or its tag fallback), signed by a certificate that
+//     chains to a configured root
+//
+// A signature covers an image digest, never a tag. Callers verify the digest
+// the image is present as on the device and run it by that digest (Pin), so a
+// tag moved on the registry afterwards cannot swap what runs.
+//
+// Certificates are checked against the time of verification; there is no
+// transparency log, so short-lived keyless certificates do not verify.
+package imagesign
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reagent/common"
+	"reagent/oci"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrUnsigned: the registry holds no signature for the image digest.
+	ErrUnsigned = errors.New("the image is not signed")
+	// ErrUntrusted: the image is signed, but by no trusted key or root, or the
+	// signature does not cover its digest.
+	ErrUntrusted = errors.New("the image is not signed by a trusted key")
+)
+
+// Signature formats reported in common.ImageSignature.Format.
+const (
+	FormatCosign   = "cosign"
+	FormatNotation = "notation"
+)
+
+// registryTimeout bounds each request to a registry.
+const registryTimeout = 30 * time.Second
+
+// maxSignatures caps the signatures looked at per format and image.
+const maxSignatures = 16
+
+// Policy is the set of keys and roots app images must be signed with.
+type Policy struct {
+	keys  []crypto.PublicKey
+	roots *x509.CertPool
+
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewPolicy loads the PEM public keys and root certificates in the given
+// files. Without any file there is no policy: it returns nil, and app images
+// run unverified.
+func NewPolicy(keyFiles []string, rootFiles []string) (*Policy, error) {
+	if len(keyFiles) == 0 && len(rootFiles) == 0 {
+		return nil, nil
+	}
+
+	policy := &Policy{
+		roots:      x509.NewCertPool(),
+		httpClient: &http.Client{Timeout: registryTimeout},
+		now:        time.Now,
+	}
+
+	for _, file := range keyFiles {
+		blocks, err := readPEMBlocks(file, "PUBLIC KEY")
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			key, err := x509.ParsePKIXPublicKey(block)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key in %s: %w", file, err)
+			}
+			policy.keys = append(policy.keys, key)
+		}
+	}
+
+	for _, file := range rootFiles {
+		blocks, err := readPEMBlocks(file, "CERTIFICATE")
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			cert, err := x509.ParseCertificate(block)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate in %s: %w", file, err)
+			}
+			policy.roots.AddCert(cert)
+		}
+	}
+
+	log.Info().Msgf("app images must be signed by one of %d keys or under one of the roots in %s", len(policy.keys), strings.Join(rootFiles, ", "))
+	return policy, nil
+}
+
+func readPEMBlocks(file string, blockType string) ([][]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks [][]byte
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == blockType {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s holds no %s", file, blockType)
+	}
+
+	return blocks, nil
+}
+
+// Verify checks that the image, by the given digest, carries a signature the
+// policy trusts. credentials are the registry logins of the app, keyed by
+// registry host. The returned ImageSignature is filled in on failure too.
+func (p *Policy) Verify(ctx context.Context, image string, digest string, credentials map[string]common.DockerCredential) (common.ImageSignature, error) {
+	result := common.ImageSignature{Image: image, Digest: digest}
+
+	err := p.verify(ctx, &result, image, digest, credentials)
+	if err != nil {
+		result.Error = err.Error()
+		return result, fmt.Errorf("%s: %w", image, err)
+	}
+
+	result.Verified = true
+	return result, nil
+}
+
+func (p *Policy) verify(ctx context.Context, result *common.ImageSignature, image string, digest string, credentials map[string]common.DockerCredential) error {
+	registry, err := p.registryFor(image, credentials)
+	if err != nil {
+		return err
+	}
+
+	signer, cosignErr := p.verifyCosign(ctx, registry, digest)
+	if cosignErr == nil {
+		result.Format = FormatCosign
+		result.Signer = signer
+		return nil
+	}
+
+	signer, notationErr := p.verifyNotation(ctx, registry, digest)
+	if notationErr == nil {
+		result.Format = FormatNotation
+		result.Signer = signer
+		return nil
+	}
+
+	// Report the format the image is signed in, if any.
+	if !errors.Is(cosignErr, ErrUnsigned) {
+		return cosignErr
+	}
+	return notationErr
+}
+
+// Resolve returns the digest the image's tag points to on its registry.
+func (p *Policy) Resolve(ctx context.Context, image string, credentials map[string]common.DockerCredential) (string, error) {
+	registry, err := p.registryFor(image, credentials)
+	if err != nil {
+		return "", err
+	}
+
+	_, tag, err := SplitTag(image)
+	if err != nil {
+		return "", err
+	}
+
+	_, digest, err := registry.Manifest(ctx, tag)
+	return digest, err
+}
+
+func (p *Policy) registryFor(image string, credentials map[string]common.DockerCredential) (*oci.Client, error) {
+	return oci.NewClient(p.httpClient, image, credentials)
+}
+
+// Digest returns the digest an image reference pins, if it pins one.
+func Digest(image string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return "", false
+	}
+	return digested.Digest().String(), true
+}
+
+// SplitTag returns the repository and tag of an image reference, "latest"
+// when it has none.
+func SplitTag(image string) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", err
+	}
+
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return reference.FamiliarName(named), tag, nil
+}
+
+// RepoDigest returns the digest of the repoDigests entry, as docker reports an
+// image's, that belongs to the image's repository.
+func RepoDigest(image string, repoDigests []string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false
+	}
+
+	for _, repoDigest := range repoDigests {
+		candidate, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil || candidate.Name() != named.Name() {
+			continue
+		}
+		if digested, ok := candidate.(reference.Digested); ok {
+			return digested.Digest().String(), true
+		}
+	}
+
+	return "", false
+}
+
+// Pin returns the reference to the image by digest.
+func Pin(image string, digest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+
+	return reference.FamiliarName(named) + "@" + digest, nil
+}
+
+// keyFingerprint names a public key in ImageSignature.Signer.
+func keyFingerprint(key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "key"
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyChain checks that leaf chains to one of the policy's roots now.
+func (p *Policy) verifyChain(leaf *x509.Certificate, intermediates []*x509.Certificate) error {
+	pool := x509.NewCertPool()
+	for _, cert := range intermediates {
+		pool.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: pool,
+		CurrentTime:   p.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrusted, err)
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package imagesign
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"reagent/common"
+	"reagent/oci"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRepository = "apps/sensor"
+
+// fakeRegistry serves manifests and blobs of one repository behind bearer
+// token authentication.
+type fakeRegistry struct {
+	server    *httptest.Server
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	referrers bool
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+
+	registry := &fakeRegistry{manifests: make(map[string][]byte), blobs: make(map[string][]byte)}
+	registry.server = httptest.NewTLSServer(http.HandlerFunc(registry.serve))
+	t.Cleanup(registry.server.Close)
+	return registry
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/token" {
+		username, password, _ := request.BasicAuth()
+		if username != "device" || password != "secret" || request.URL.Query().Get("scope") != "repository:"+testRepository+":pull" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "t0k3n"})
+		return
+	}
+
+	if request.Header.Get("Authorization") != "Bearer t0k3n" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.server.URL+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + testRepository + "/"
+	path := strings.TrimPrefix(request.URL.Path, prefix)
+	switch {
+	case strings.HasPrefix(path, "manifests/"):
+		data, ok := r.manifests[strings.TrimPrefix(path, "manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case strings.HasPrefix(path, "blobs/"):
+		data, ok := r.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case strings.HasPrefix(path, "referrers/") && r.referrers:
+		data, ok := r.manifests[strings.Replace(strings.TrimPrefix(path, "referrers/"), ":", "-", 1)]
+		if !ok {
+			data = []byte(`{"schemaVersion":2,"manifests":[]}`)
+		}
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) image(tag string) string {
+	return strings.TrimPrefix(r.server.URL, "https://") + "/" + testRepository + ":" + tag
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// addManifest stores a manifest under its digest and the given tags.
+func (r *fakeRegistry) addManifest(t *testing.T, value any, tags ...string) string {
+	t.Helper()
+
+	data, err := json.Marshal(value)
+	require.NoError(t, err)
+	digest := digestOf(data)
+	r.manifests[digest] = data
+	for _, tag := range tags {
+		r.manifests[tag] = data
+	}
+	return digest
+}
+
+func (r *fakeRegistry) addBlob(data []byte) oci.Descriptor {
+	digest := digestOf(data)
+	r.blobs[digest] = data
+	return oci.Descriptor{Digest: digest, Size: int64(len(data))}
+}
+
+// addImage pushes an image manifest tagged 1.0 and returns its digest.
+func (r *fakeRegistry) addImage(t *testing.T) string {
+	t.Helper()
+	config := r.addBlob([]byte(`{}`))
+	config.MediaType = "application/vnd.oci.image.config.v1+json"
+	return r.addManifest(t, oci.Manifest{MediaType: oci.MediaTypeOCIManifest, Config: config}, "1.0")
+}
+
+// addCosignSignature attaches a cosign signature of digest, made with key and
+// optionally carrying a certificate.
+func (r *fakeRegistry) addCosignSignature(t *testing.T, digest string, signedDigest string, key *ecdsa.PrivateKey, certificate []byte) {
+	t.Helper()
+
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"` + testRepository + `"},"image":{"docker-manifest-digest":"` + signedDigest + `"},"type":"cosign container image signature"},"optional":null}`)
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+
+	layer := r.addBlob(payload)
+	layer.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	layer.Annotations = map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+	if certificate != nil {
+		layer.Annotations[cosignCertificateAnnotation] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}))
+	}
+
+	r.addManifest(t, oci.Manifest{MediaType: oci.MediaTypeOCIManifest, Layers: []oci.Descriptor{layer}}, strings.Replace(digest, ":", "-", 1)+".sig")
+}
+
+// addNotationSignature attaches a notation JWS signature of digest, made with
+// key under certificate, in the referrers tag fallback index.
+func (r *fakeRegistry) addNotationSignature(t *testing.T, digest string, key *ecdsa.PrivateKey, certificate []byte) {
+	t.Helper()
+
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","cty":"` + notationPayloadType + `","io.cncf.notary.signingScheme":"notary.x509","io.cncf.notary.signingTime":"2026-01-01T00:00:00Z"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"targetArtifact":{"mediaType":"` + oci.MediaTypeOCIManifest + `","digest":"` + digest + `","size":100}}`))
+
+	hash := sha256.Sum256([]byte(protected + "." + payload))
+	rInt, sInt, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+	signature := append(rInt.FillBytes(make([]byte, 32)), sInt.FillBytes(make([]byte, 32))...)
+
+	envelope, err := json.Marshal(map[string]any{
+		"payload":   payload,
+		"protected": protected,
+		"header":    map[string]any{"x5c": [][]byte{certificate}},
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+	require.NoError(t, err)
+
+	layer := r.addBlob(envelope)
+	layer.MediaType = notationJWSMediaType
+	config := r.addBlob([]byte(`{}`))
+	config.MediaType = notationArtifactType
+	signatureDigest := r.addManifest(t, oci.Manifest{MediaType: oci.MediaTypeOCIManifest, ArtifactType: notationArtifactType, Config: config, Layers: []oci.Descriptor{layer}})
+
+	r.addManifest(t, oci.Manifest{MediaType: oci.MediaTypeOCIIndex, Manifests: []oci.Descriptor{{
+		MediaType:    oci.MediaTypeOCIManifest,
+		ArtifactType: notationArtifactType,
+		Digest:       signatureDigest,
+	}}}, strings.Replace(digest, ":", "-", 1))
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+// newCertificate returns a DER certificate for key, self-signed when parent
+// is nil.
+func newCertificate(t *testing.T, name string, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey crypto.Signer) []byte {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	return der
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "trust.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o644))
+	return path
+}
+
+func newTestPolicy(t *testing.T, registry *fakeRegistry, keyFiles []string, rootFiles []string) *Policy {
+	t.Helper()
+	policy, err := NewPolicy(keyFiles, rootFiles)
+	require.NoError(t, err)
+	policy.httpClient = registry.server.Client()
+	return policy
+}
+
+func TestVerify(t *testing.T) {
+	credentials := func(registry *fakeRegistry) map[string]common.DockerCredential {
+		host := strings.TrimPrefix(registry.server.URL, "https://")
+		return map[string]common.DockerCredential{host + "/": {Username: "device", Password: "secret"}}
+	}
+
+	signingKey := newKey(t)
+	publicKey, err := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	require.NoError(t, err)
+	keyFile := writePEM(t, "PUBLIC KEY", publicKey)
+
+	rootKey := newKey(t)
+	rootDER := newCertificate(t, "Test Root", rootKey, nil, nil)
+	root, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+	rootFile := writePEM(t, "CERTIFICATE", rootDER)
+	leafKey := newKey(t)
+	leafDER := newCertificate(t, "Test Publisher", leafKey, root, rootKey)
+
+	t.Run("accepts a cosign signature by a configured key", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+		registry.addCosignSignature(t, digest, digest, signingKey, nil)
+
+		policy := newTestPolicy(t, registry, []string{keyFile}, nil)
+		result, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+		require.NoError(t, err)
+		assert.True(t, result.Verified)
+		assert.Equal(t, FormatCosign, result.Format)
+		assert.Equal(t, keyFingerprint(&signingKey.PublicKey), result.Signer)
+		assert.Equal(t, digest, result.Digest)
+	})
+
+	t.Run("accepts a cosign signature by a certificate under a root", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+		registry.addCosignSignature(t, digest, digest, leafKey, leafDER)
+
+		policy := newTestPolicy(t, registry, nil, []string{rootFile})
+		result, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+		require.NoError(t, err)
+		assert.Equal(t, "CN=Test Publisher", result.Signer)
+	})
+
+	for _, referrersAPI := range []bool{false, true} {
+		t.Run(fmt.Sprintf("accepts a notation signature under a root (referrers API: %v)", referrersAPI), func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			registry.referrers = referrersAPI
+			digest := registry.addImage(t)
+			registry.addNotationSignature(t, digest, leafKey, leafDER)
+
+			policy := newTestPolicy(t, registry, nil, []string{rootFile})
+			result, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+			require.NoError(t, err)
+			assert.Equal(t, FormatNotation, result.Format)
+			assert.Equal(t, "CN=Test Publisher", result.Signer)
+		})
+	}
+
+	t.Run("rejects an unsigned image", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+
+		policy := newTestPolicy(t, registry, []string{keyFile}, nil)
+		result, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+		assert.ErrorIs(t, err, ErrUnsigned)
+		assert.False(t, result.Verified)
+		assert.Equal(t, ErrUnsigned.Error(), result.Error)
+	})
+
+	t.Run("rejects a signature by another key", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+		registry.addCosignSignature(t, digest, digest, newKey(t), nil)
+
+		policy := newTestPolicy(t, registry, []string{keyFile}, nil)
+		_, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+		assert.ErrorIs(t, err, ErrUntrusted)
+	})
+
+	t.Run("rejects a signature of another digest", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+		registry.addCosignSignature(t, digest, digestOf([]byte("other image")), signingKey, nil)
+
+		policy := newTestPolicy(t, registry, []string{keyFile}, nil)
+		_, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+		assert.ErrorIs(t, err, ErrUntrusted)
+		assert.ErrorContains(t, err, "the signature covers")
+	})
+
+	t.Run("rejects a notation signature under a foreign root", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+		foreignKey := newKey(t)
+		registry.addNotationSignature(t, digest, foreignKey, newCertificate(t, "Foreign", foreignKey, nil, nil))
+
+		policy := newTestPolicy(t, registry, nil, []string{rootFile})
+		_, err := policy.Verify(context.Background(), registry.image("1.0"), digest, credentials(registry))
+		assert.ErrorIs(t, err, ErrUntrusted)
+	})
+
+	t.Run("fails without registry credentials", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+
+		policy := newTestPolicy(t, registry, []string{keyFile}, nil)
+		_, err := policy.Verify(context.Background(), registry.image("1.0"), digest, nil)
+		assert.ErrorContains(t, err, "token service")
+	})
+
+	t.Run("resolves a tag to its digest", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage(t)
+
+		policy := newTestPolicy(t, registry, []string{keyFile}, nil)
+		resolved, err := policy.Resolve(context.Background(), registry.image("1.0"), credentials(registry))
+		require.NoError(t, err)
+		assert.Equal(t, digest, resolved)
+	})
+}
+
+func TestNewPolicy(t *testing.T) {
+	policy, err := NewPolicy(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, policy, "no keys and roots, no policy")
+
+	_, err = NewPolicy([]string{writePEM(t, "CERTIFICATE", []byte("x"))}, nil)
+	assert.ErrorContains(t, err, "holds no PUBLIC KEY")
+}
+
+func TestReferences(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	pinned, err := Pin("registry.test/apps/sensor:1.0", digest)
+	require.NoError(t, err)
+	assert.Equal(t, "registry.test/apps/sensor@"+digest, pinned)
+
+	pinned, err = Pin("nginx:1.27", digest)
+	require.NoError(t, err)
+	assert.Equal(t, "nginx@"+digest, pinned)
+
+	found, ok := RepoDigest("nginx:1.27", []string{"registry.test/nginx@sha256:" + strings.Repeat("cd", 32), "nginx@" + digest})
+	assert.True(t, ok)
+	assert.Equal(t, digest, found)
+
+	_, ok = RepoDigest("registry.test/apps/sensor:1.0", nil)
+	assert.False(t, ok)
+
+	found, ok = Digest("nginx@" + digest)
+	assert.True(t, ok)
+	assert.Equal(t, digest, found)
+
+	name, tag, err := SplitTag("docker.io/library/nginx")
+	require.NoError(t, err)
+	assert.Equal(t, "nginx", name)
+	assert.Equal(t, "latest", tag)
+}
@@ -0,0 +1,204 @@
+package imagesign
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for crypto.Hash
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reagent/oci"
+	"time"
+)
+
+const (
+	notationArtifactType = "application/vnd.cncf.notary.signature"
+	notationJWSMediaType = "application/jose+json"
+	notationPayloadType  = "application/vnd.cncf.notary.payload.v1+json"
+	notationX509Scheme   = "notary.x509"
+)
+
+// jwsEnvelope is a notation signature in the JWS JSON serialization.
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		CertificateChain [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type jwsProtectedHeader struct {
+	Algorithm     string     `json:"alg"`
+	ContentType   string     `json:"cty"`
+	SigningScheme string     `json:"io.cncf.notary.signingScheme"`
+	Expiry        *time.Time `json:"io.cncf.notary.expiry,omitempty"`
+}
+
+type notationPayload struct {
+	TargetArtifact oci.Descriptor `json:"targetArtifact"`
+}
+
+// verifyNotation looks for a notation signature of the digest under the
+// policy's roots and returns its signer.
+func (p *Policy) verifyNotation(ctx context.Context, registry *oci.Client, digest string) (string, error) {
+	referrers, err := registry.Referrers(ctx, digest, notationArtifactType)
+	if err != nil {
+		return "", err
+	}
+
+	if len(referrers) == 0 {
+		return "", ErrUnsigned
+	}
+
+	var lastErr error = ErrUntrusted
+	for i, referrer := range referrers {
+		if i == maxSignatures {
+			break
+		}
+
+		signature, _, err := registry.Manifest(ctx, referrer.Digest)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, layer := range signature.Layers {
+			if layer.MediaType != notationJWSMediaType {
+				lastErr = fmt.Errorf("%w: unsupported signature envelope %s", ErrUntrusted, layer.MediaType)
+				continue
+			}
+
+			envelope, err := registry.Blob(ctx, layer.Digest)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			signer, err := p.verifyJWSEnvelope(envelope, digest)
+			if err == nil {
+				return signer, nil
+			}
+			lastErr = err
+		}
+	}
+
+	return "", lastErr
+}
+
+func (p *Policy) verifyJWSEnvelope(data []byte, digest string) (string, error) {
+	var envelope jwsEnvelope
+	err := json.Unmarshal(data, &envelope)
+	if err != nil || len(envelope.Header.CertificateChain) == 0 {
+		return "", fmt.Errorf("%w: malformed notation signature", ErrUntrusted)
+	}
+
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed notation signature", ErrUntrusted)
+	}
+
+	var protected jwsProtectedHeader
+	err = json.Unmarshal(protectedJSON, &protected)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed notation signature", ErrUntrusted)
+	}
+
+	if protected.ContentType != notationPayloadType || protected.SigningScheme != notationX509Scheme {
+		return "", fmt.Errorf("%w: unsupported notation signature %s (%s)", ErrUntrusted, protected.ContentType, protected.SigningScheme)
+	}
+
+	if protected.Expiry != nil && p.now().After(*protected.Expiry) {
+		return "", fmt.Errorf("%w: the signature expired on %s", ErrUntrusted, protected.Expiry.Format(time.RFC3339))
+	}
+
+	var certs []*x509.Certificate
+	for _, der := range envelope.Header.CertificateChain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", fmt.Errorf("%w: malformed signing certificate", ErrUntrusted)
+		}
+		certs = append(certs, cert)
+	}
+
+	leaf := certs[0]
+	err = p.verifyChain(leaf, certs[1:])
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed notation signature", ErrUntrusted)
+	}
+
+	err = verifyJWS(protected.Algorithm, leaf.PublicKey, []byte(envelope.Protected+"."+envelope.Payload), signature)
+	if err != nil {
+		return "", err
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed notation payload", ErrUntrusted)
+	}
+
+	var payload notationPayload
+	err = json.Unmarshal(payloadJSON, &payload)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed notation payload", ErrUntrusted)
+	}
+
+	if payload.TargetArtifact.Digest != digest {
+		return "", fmt.Errorf("%w: the signature covers %s", ErrUntrusted, payload.TargetArtifact.Digest)
+	}
+
+	return leaf.Subject.String(), nil
+}
+
+// verifyJWS checks a JWS signature made with one of the algorithms notation
+// signs with: RSASSA-PSS or ECDSA, over SHA-256, SHA-384 or SHA-512.
+func verifyJWS(algorithm string, key crypto.PublicKey, signingInput []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "PS256", "ES256":
+		hash = crypto.SHA256
+	case "PS384", "ES384":
+		hash = crypto.SHA384
+	case "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported signature algorithm %q", ErrUntrusted, algorithm)
+	}
+
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	sum := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm[0] != 'P' {
+			break
+		}
+		err := rsa.VerifyPSS(key, hash, sum, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if algorithm[0] != 'E' || len(signature)%2 != 0 {
+			break
+		}
+		// JWS encodes ECDSA signatures as r || s.
+		half := len(signature) / 2
+		r := new(big.Int).SetBytes(signature[:half])
+		s := new(big.Int).SetBytes(signature[half:])
+		if ecdsa.Verify(key, sum, r, s) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: the signature does not match", ErrUntrusted)
+}
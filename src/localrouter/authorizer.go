@@ -0,0 +1,45 @@
+package localrouter
+
+import (
+	"reagent/safe"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// authorizer lets every message through, but hands the publishes,
+// subscriptions and registrations apps make under the bridged prefixes to the
+// bridge on the way, which repeats them on the agent's cloud session.
+type authorizer struct {
+	bridge *Bridge
+}
+
+func (a authorizer) Authorize(session *wamp.Session, message wamp.Message) (bool, error) {
+	// the agent's own bridge session is not an app
+	if wamp.OptionString(session.Details, "authrole") != appRole {
+		return true, nil
+	}
+
+	sessionID := session.ID
+	authID := wamp.OptionString(session.Details, "authid")
+
+	switch msg := message.(type) {
+	case *wamp.Publish:
+		if a.bridge.Bridged(string(msg.Topic)) {
+			topic, args, kwargs := string(msg.Topic), msg.Arguments, msg.ArgumentsKw
+			// publishes are spooled in order, so they are not handed off
+			a.bridge.Publish(sessionID, authID, topic, args, kwargs)
+		}
+	case *wamp.Subscribe:
+		if a.bridge.Bridged(string(msg.Topic)) {
+			topic, options := string(msg.Topic), msg.Options
+			safe.Go(func() { a.bridge.Subscribe(sessionID, authID, topic, options) })
+		}
+	case *wamp.Register:
+		if a.bridge.Bridged(string(msg.Procedure)) {
+			procedure, options := string(msg.Procedure), msg.Options
+			safe.Go(func() { a.bridge.Register(sessionID, authID, procedure, options) })
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,490 @@
+package localrouter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// realm is the realm of the cloud router, served locally under the same
+	// name so apps only swap the router URL.
+	realm = "realm1"
+	// appRole is the role of the sessions authenticated with app
+	// credentials; every other session on the local router is the agent's.
+	appRole = "app"
+	// DefaultSpoolBytes bounds the publishes spooled per app while offline.
+	DefaultSpoolBytes = 16 * 1024 * 1024
+)
+
+var ErrNotConnected = errors.New("the agent's cloud session is not connected")
+
+// CredentialResolver returns the WAMP-CRA secret of an app credential authid,
+// or false if the authid does not belong to an app installed on the device.
+type CredentialResolver func(authID string) (secret string, ok bool)
+
+// Bridge connects the apps on the local router to the cloud through the
+// agent's own cloud session, so bridged traffic takes the endpoints, proxy
+// and TLS settings the agent connects with. The cloud sees the device, not
+// the app, which is why only the URIs under the bridged prefixes cross:
+//
+//   - publishes go up as they are made, and are spooled on disk per app while
+//     the session is down, to be replayed in order once it is back
+//   - subscriptions are mirrored once per topic, and the events published
+//     locally to just the apps that subscribed
+//   - calls to procedures no local app registered go up, registrations are
+//     mirrored so the cloud can call apps
+type Bridge struct {
+	prefixes   []string
+	spoolDir   string
+	spoolBytes int64
+	local      messenger.NexusClient
+
+	// publishMu keeps publishes behind the replay of the spools.
+	publishMu sync.Mutex
+
+	mu            sync.Mutex
+	cloud         messenger.Messenger
+	sessions      map[wamp.ID]string         // local session -> app authid
+	spools        map[string]*spool          // by file name
+	subscriptions map[string]map[string]bool // bridged topic -> subscribed app authids
+	subscribeOpts map[string]wamp.Dict       // bridged topic -> options of its first subscription
+	registrations map[string]string          // bridged procedure -> registering app authid
+}
+
+// NewBridge creates a bridge through the cloud session for the URIs under
+// prefixes, spooling offline publishes in spoolDir.
+func NewBridge(prefixes []string, spoolDir string, cloud messenger.Messenger) *Bridge {
+	return &Bridge{
+		prefixes:      prefixes,
+		spoolDir:      spoolDir,
+		spoolBytes:    DefaultSpoolBytes,
+		cloud:         cloud,
+		sessions:      make(map[wamp.ID]string),
+		spools:        make(map[string]*spool),
+		subscriptions: make(map[string]map[string]bool),
+		subscribeOpts: make(map[string]wamp.Dict),
+		registrations: make(map[string]string),
+	}
+}
+
+// ParsePrefixes splits a comma separated list of URI prefixes.
+func ParsePrefixes(list string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Start attaches the bridge to the local router through the agent's own
+// session on it.
+func (b *Bridge) Start(local messenger.NexusClient) error {
+	b.local = local
+
+	// calls no local app answers are taken up to the cloud
+	for _, prefix := range b.prefixes {
+		err := local.Register(prefix, b.forwardCall, wamp.Dict{"match": "prefix", "disclose_caller": true})
+		if err != nil {
+			return err
+		}
+	}
+
+	return local.Subscribe("wamp.session.on_leave", func(event *wamp.Event) {
+		if len(event.Arguments) > 0 {
+			b.sessionLeft(toID(event.Arguments[0]))
+		}
+	}, nil)
+}
+
+// SetMessenger replaces the cloud session, e.g. the offline messenger the
+// agent starts with by the connected one.
+func (b *Bridge) SetMessenger(cloud messenger.Messenger) {
+	b.mu.Lock()
+	b.cloud = cloud
+	b.mu.Unlock()
+}
+
+// Reattach replays the spooled publishes and mirrors the subscriptions and
+// registrations of the apps on a fresh cloud session. The agent calls it
+// after every (re)connect; the router dropped what the last session had.
+func (b *Bridge) Reattach() {
+	cloud := b.messenger()
+	if !cloud.Connected() {
+		return
+	}
+
+	b.replay(cloud)
+
+	b.mu.Lock()
+	subscriptions := make(map[string]wamp.Dict)
+	for topic, subscribers := range b.subscriptions {
+		if len(subscribers) > 0 {
+			subscriptions[topic] = b.subscribeOpts[topic]
+		}
+	}
+	var procedures []string
+	for procedure := range b.registrations {
+		procedures = append(procedures, procedure)
+	}
+	b.mu.Unlock()
+
+	for topic, options := range subscriptions {
+		if _, ok := cloud.SubscriptionID(topics.Topic(topic)); !ok {
+			b.subscribeCloud(cloud, topic, options)
+		}
+	}
+	for _, procedure := range procedures {
+		if _, ok := cloud.RegistrationID(topics.Topic(procedure)); !ok {
+			b.registerCloud(cloud, procedure)
+		}
+	}
+}
+
+// Bridged reports whether uri crosses to the cloud.
+func (b *Bridge) Bridged(uri string) bool {
+	for _, prefix := range b.prefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish takes a publish of an app session up to the cloud, or spools it
+// while the cloud session is down.
+func (b *Bridge) Publish(sessionID wamp.ID, authID string, topic string, args wamp.List, kwargs wamp.Dict) {
+	if !b.Bridged(topic) {
+		return
+	}
+
+	b.track(sessionID, authID)
+	spool := b.spoolFor(authID)
+
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	// behind what is spooled already, to stay in order
+	cloud := b.messenger()
+	if cloud.Connected() && spool.Len() == 0 {
+		err := cloud.Publish(topics.Topic(topic), args, common.Dict(kwargs), nil)
+		if err == nil {
+			return
+		}
+		log.Debug().Err(err).Str("authid", authID).Msg("Failed to publish to the cloud, spooling")
+	}
+
+	err := spool.Append(spooledPublish{Topic: topic, Args: args, Kwargs: kwargs, Time: time.Now()})
+	if err != nil {
+		log.Error().Err(err).Str("authid", authID).Str("topic", topic).Msg("Failed to spool publish, it is lost")
+	}
+}
+
+// Subscribe mirrors a subscription of an app session in the cloud.
+func (b *Bridge) Subscribe(sessionID wamp.ID, authID string, topic string, options wamp.Dict) {
+	if !b.Bridged(topic) {
+		return
+	}
+
+	b.track(sessionID, authID)
+
+	b.mu.Lock()
+	if b.subscriptions[topic] == nil {
+		b.subscriptions[topic] = make(map[string]bool)
+	}
+	first := len(b.subscriptions[topic]) == 0
+	b.subscriptions[topic][authID] = true
+	if first {
+		b.subscribeOpts[topic] = options
+	}
+	cloud := b.cloud
+	b.mu.Unlock()
+
+	if first && cloud.Connected() {
+		b.subscribeCloud(cloud, topic, options)
+	}
+}
+
+// Register mirrors a registration of an app session in the cloud.
+func (b *Bridge) Register(sessionID wamp.ID, authID string, procedure string, options wamp.Dict) {
+	if !b.Bridged(procedure) {
+		return
+	}
+
+	b.track(sessionID, authID)
+
+	b.mu.Lock()
+	if _, ok := b.registrations[procedure]; ok {
+		b.mu.Unlock()
+		return
+	}
+	b.registrations[procedure] = authID
+	cloud := b.cloud
+	b.mu.Unlock()
+
+	if cloud.Connected() {
+		b.registerCloud(cloud, procedure)
+	}
+}
+
+// Spooled is the number of publishes of an app waiting for the cloud session.
+func (b *Bridge) Spooled(authID string) int {
+	return b.spoolFor(authID).Len()
+}
+
+func (b *Bridge) messenger() messenger.Messenger {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cloud
+}
+
+func (b *Bridge) track(sessionID wamp.ID, authID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[sessionID] = authID
+}
+
+func (b *Bridge) spoolFor(authID string) *spool {
+	return b.spoolAt(spoolFileName(authID))
+}
+
+// spoolAt returns the spool in the file name, the same for every caller so
+// they share its lock.
+func (b *Bridge) spoolAt(name string) *spool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.spools[name]
+	if s == nil {
+		s = newSpool(filepath.Join(b.spoolDir, name), b.spoolBytes)
+		b.spools[name] = s
+	}
+	return s
+}
+
+// replay publishes what the apps spooled while the cloud session was down,
+// including the spools of apps that have not connected since the agent
+// restarted.
+func (b *Bridge) replay(cloud messenger.Messenger) {
+	entries, err := os.ReadDir(b.spoolDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Msg("Failed to read the publish spools")
+	}
+
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolFileSuffix) {
+			continue
+		}
+
+		replayed, err := b.spoolAt(name).Replay(func(publish spooledPublish) error {
+			return cloud.Publish(topics.Topic(publish.Topic), publish.Args, common.Dict(publish.Kwargs), nil)
+		})
+		if err != nil {
+			log.Error().Err(err).Str("spool", name).Msg("Failed to replay spooled publishes")
+		}
+		if replayed > 0 {
+			log.Info().Str("spool", name).Int("publishes", replayed).Msg("Replayed publishes spooled while the cloud session was down")
+		}
+	}
+}
+
+func (b *Bridge) subscribeCloud(cloud messenger.Messenger, topic string, options wamp.Dict) {
+	err := cloud.Subscribe(topics.Topic(topic), b.forwardEvent(topic), common.Dict(options))
+	if err != nil {
+		log.Error().Err(err).Str("topic", topic).Msg("Failed to mirror subscription in the cloud")
+	}
+}
+
+func (b *Bridge) registerCloud(cloud messenger.Messenger, procedure string) {
+	err := cloud.Register(topics.Topic(procedure), b.forwardInvocation(procedure), nil)
+	if err != nil {
+		log.Error().Err(err).Str("procedure", procedure).Msg("Failed to mirror registration in the cloud")
+	}
+}
+
+// sessionLeft drops the subscriptions and registrations of an app in the
+// cloud once its last local session is gone.
+func (b *Bridge) sessionLeft(sessionID wamp.ID) {
+	b.mu.Lock()
+	authID, ok := b.sessions[sessionID]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.sessions, sessionID)
+
+	for _, other := range b.sessions {
+		if other == authID {
+			b.mu.Unlock()
+			return
+		}
+	}
+
+	var unsubscribe, unregister []string
+	for topic, subscribers := range b.subscriptions {
+		if !subscribers[authID] {
+			continue
+		}
+		delete(subscribers, authID)
+		if len(subscribers) == 0 {
+			delete(b.subscriptions, topic)
+			delete(b.subscribeOpts, topic)
+			unsubscribe = append(unsubscribe, topic)
+		}
+	}
+	for procedure, owner := range b.registrations {
+		if owner == authID {
+			delete(b.registrations, procedure)
+			unregister = append(unregister, procedure)
+		}
+	}
+	cloud := b.cloud
+	b.mu.Unlock()
+
+	if len(unsubscribe) == 0 && len(unregister) == 0 || !cloud.Connected() {
+		return
+	}
+
+	log.Debug().Str("authid", authID).Msg("Last local session of the app left, dropping its subscriptions and registrations in the cloud")
+	for _, topic := range unsubscribe {
+		err := cloud.Unsubscribe(topics.Topic(topic))
+		if err != nil {
+			log.Debug().Err(err).Str("topic", topic).Msg("Failed to drop the mirrored subscription")
+		}
+	}
+	for _, procedure := range unregister {
+		err := cloud.Unregister(topics.Topic(procedure))
+		if err != nil {
+			log.Debug().Err(err).Str("procedure", procedure).Msg("Failed to drop the mirrored registration")
+		}
+	}
+}
+
+// subscribers are the apps subscribed to topic through the bridge.
+func (b *Bridge) subscribers(topic string) wamp.List {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var subscribers wamp.List
+	for subscriber := range b.subscriptions[topic] {
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers
+}
+
+// forwardCall answers a call under a bridged prefix that no local app
+// registered by calling the procedure in the cloud.
+func (b *Bridge) forwardCall(ctx context.Context, invocation *wamp.Invocation) client.InvokeResult {
+	procedure := wamp.OptionString(invocation.Details, "procedure")
+
+	cloud := b.messenger()
+	if !cloud.Connected() {
+		return errorResult(ErrNotConnected)
+	}
+
+	result, err := cloud.Call(ctx, topics.Topic(procedure), invocation.Arguments, common.Dict(invocation.ArgumentsKw), nil, nil)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	return client.InvokeResult{Args: result.Arguments, Kwargs: wamp.Dict(result.ArgumentsKw)}
+}
+
+// forwardEvent publishes a cloud event on the local router to just the apps
+// subscribed to it.
+func (b *Bridge) forwardEvent(topic string) func(messenger.Result) error {
+	return func(event messenger.Result) error {
+		subscribers := b.subscribers(topic)
+		if len(subscribers) == 0 {
+			return nil
+		}
+
+		eventTopic := topic
+		// pattern subscriptions carry the concrete topic in the details
+		if concrete, _ := event.Details["topic"].(string); concrete != "" {
+			eventTopic = concrete
+		}
+
+		err := b.local.Publish(eventTopic, wamp.Dict{"eligible_authid": subscribers}, event.Arguments, wamp.Dict(event.ArgumentsKw))
+		if err != nil {
+			log.Debug().Err(err).Str("topic", eventTopic).Msg("Failed to forward cloud event to the apps")
+		}
+		return nil
+	}
+}
+
+// forwardInvocation answers a cloud call by calling the app's procedure on
+// the local router.
+func (b *Bridge) forwardInvocation(procedure string) func(ctx context.Context, invocation messenger.Result) (*messenger.InvokeResult, error) {
+	return func(ctx context.Context, invocation messenger.Result) (*messenger.InvokeResult, error) {
+		result, err := b.local.Call(ctx, procedure, nil, invocation.Arguments, wamp.Dict(invocation.ArgumentsKw), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return &messenger.InvokeResult{Arguments: result.Arguments, ArgumentsKw: common.Dict(result.ArgumentsKw)}, nil
+	}
+}
+
+func errorResult(err error) client.InvokeResult {
+	return client.InvokeResult{
+		Err:  wamp.URI("wamp.error.canceled"),
+		Args: wamp.List{wamp.Dict{"error": err.Error()}},
+	}
+}
+
+const spoolFileSuffix = ".jsonl"
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func spoolFileName(authID string) string {
+	return unsafeFileChars.ReplaceAllString(authID, "_") + spoolFileSuffix
+}
+
+// toID converts a session id as serializers decode it.
+func toID(value interface{}) wamp.ID {
+	switch id := value.(type) {
+	case wamp.ID:
+		return id
+	case uint64:
+		return wamp.ID(id)
+	case int64:
+		return wamp.ID(id)
+	case int:
+		return wamp.ID(id)
+	case float64:
+		return wamp.ID(id)
+	case json.Number:
+		parsed, _ := id.Int64()
+		return wamp.ID(parsed)
+	}
+	return 0
+}
+
+// wampLogger sends the router's and the clients' logs to the agent's log.
+type wampLogger struct{}
+
+func (wampLogger) Print(v ...interface{})                 { log.Debug().Msg(strings.TrimSpace(fmt.Sprint(v...))) }
+func (wampLogger) Println(v ...interface{})               { log.Debug().Msg(strings.TrimSpace(fmt.Sprintln(v...))) }
+func (wampLogger) Printf(format string, v ...interface{}) { log.Debug().Msgf(format, v...) }
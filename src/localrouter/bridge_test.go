@@ -0,0 +1,261 @@
+package localrouter
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"strconv"
+	"testing"
+
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sensorsAuthID = "app-7-prod-e1@serial"
+	alertsAuthID  = "app-8-prod-e1@serial"
+)
+
+func bridgeHarness(t *testing.T) (*Bridge, *fakeClient, *fakeCloud) {
+	t.Helper()
+
+	cloud := newFakeCloud()
+	bridge := NewBridge([]string{"com.example."}, filepath.Join(t.TempDir(), "spool"), cloud)
+
+	local := newFakeClient()
+	require.NoError(t, bridge.Start(local))
+
+	return bridge, local, cloud
+}
+
+func TestBridgeGoesThroughTheCloudSession(t *testing.T) {
+	bridge, local, cloud := bridgeHarness(t)
+
+	assert.Equal(t, wamp.Dict{"match": "prefix", "disclose_caller": true}, local.options["com.example."])
+
+	bridge.Publish(1, sensorsAuthID, "com.example.temperature", wamp.List{21.5}, nil)
+	bridge.Publish(2, alertsAuthID, "com.example.alarm", wamp.List{"smoke"}, wamp.Dict{"level": 3})
+	bridge.Publish(1, sensorsAuthID, "local.only", wamp.List{1}, nil)
+
+	publishes := cloud.GetPublishCalls()
+	require.Len(t, publishes, 2)
+	assert.Equal(t, topics.Topic("com.example.temperature"), publishes[0].Topic)
+	assert.Equal(t, []interface{}{21.5}, publishes[0].Args)
+	assert.Equal(t, topics.Topic("com.example.alarm"), publishes[1].Topic)
+	assert.Equal(t, common.Dict{"level": 3}, publishes[1].Kwargs)
+}
+
+func TestBridgeSpoolsPublishesWhileOffline(t *testing.T) {
+	bridge, _, cloud := bridgeHarness(t)
+	cloud.SetConnected(false)
+
+	for _, value := range []float64{1, 2, 3} {
+		bridge.Publish(1, sensorsAuthID, "com.example.temperature", wamp.List{value}, wamp.Dict{"unit": "C"})
+	}
+	assert.Equal(t, 3, bridge.Spooled(sensorsAuthID))
+	assert.Empty(t, cloud.GetPublishCalls())
+
+	cloud.reconnect()
+	bridge.Reattach()
+
+	assert.Equal(t, 0, bridge.Spooled(sensorsAuthID))
+	publishes := cloud.GetPublishCalls()
+	require.Len(t, publishes, 3)
+	for i, publish := range publishes {
+		assert.Equal(t, topics.Topic("com.example.temperature"), publish.Topic)
+		assert.Equal(t, []interface{}{json.Number(strconv.Itoa(i + 1))}, publish.Args, "replayed in order")
+		assert.Equal(t, common.Dict{"unit": "C"}, publish.Kwargs)
+	}
+}
+
+func TestBridgeKeepsPublishesBehindTheSpool(t *testing.T) {
+	bridge, _, cloud := bridgeHarness(t)
+	cloud.SetConnected(false)
+	bridge.Publish(1, sensorsAuthID, "com.example.temperature", wamp.List{1}, nil)
+
+	// connected again, but not reattached yet
+	cloud.reconnect()
+	bridge.Publish(1, sensorsAuthID, "com.example.temperature", wamp.List{2}, nil)
+	assert.Empty(t, cloud.GetPublishCalls())
+	assert.Equal(t, 2, bridge.Spooled(sensorsAuthID))
+
+	bridge.Reattach()
+	publishes := cloud.GetPublishCalls()
+	require.Len(t, publishes, 2)
+	assert.Equal(t, []interface{}{json.Number("1")}, publishes[0].Args)
+	assert.Equal(t, []interface{}{json.Number("2")}, publishes[1].Args)
+}
+
+func TestBridgeReplaysTheSpoolsOfAnEarlierRun(t *testing.T) {
+	spoolDir := filepath.Join(t.TempDir(), "spool")
+
+	offline := newFakeCloud()
+	offline.SetConnected(false)
+	before := NewBridge([]string{"com.example."}, spoolDir, offline)
+	before.Publish(1, sensorsAuthID, "com.example.temperature", wamp.List{1}, nil)
+	before.Publish(2, alertsAuthID, "com.example.alarm", wamp.List{"smoke"}, nil)
+
+	// the apps have not reconnected since the agent restarted
+	cloud := newFakeCloud()
+	after := NewBridge([]string{"com.example."}, spoolDir, cloud)
+	after.Reattach()
+
+	assert.Len(t, cloud.GetPublishCalls(), 2)
+	assert.Equal(t, 0, after.Spooled(sensorsAuthID))
+	assert.Equal(t, 0, after.Spooled(alertsAuthID))
+}
+
+func TestBridgeForwardsCloudEventsToTheSubscribers(t *testing.T) {
+	bridge, local, cloud := bridgeHarness(t)
+
+	bridge.Subscribe(1, sensorsAuthID, "com.example.setpoint", nil)
+	bridge.Subscribe(2, alertsAuthID, "com.example.setpoint", nil)
+	assert.Equal(t, 1, cloud.subscribes(), "one subscription per topic")
+
+	delivered, err := cloud.Emit("com.example.setpoint", messenger.Result{Arguments: []interface{}{22}})
+	require.True(t, delivered)
+	require.NoError(t, err)
+
+	publishes := local.getPublishes()
+	require.Len(t, publishes, 1)
+	assert.Equal(t, "com.example.setpoint", publishes[0].Topic)
+	assert.ElementsMatch(t, wamp.List{sensorsAuthID, alertsAuthID}, publishes[0].Options["eligible_authid"], "only the subscribing apps get the event")
+	assert.Equal(t, wamp.List{22}, publishes[0].Args)
+}
+
+func TestBridgeForwardsCallsBothWays(t *testing.T) {
+	bridge, local, cloud := bridgeHarness(t)
+
+	// app -> cloud: an app calls a procedure no local app registered
+	cloud.SetCallResponse("com.example.calibrate", messenger.Result{Arguments: []interface{}{"calibrated"}}, nil)
+	result := local.registration("com.example.")(context.Background(), &wamp.Invocation{
+		Details:   wamp.Dict{"caller_authid": sensorsAuthID, "procedure": "com.example.calibrate"},
+		Arguments: wamp.List{1},
+	})
+	assert.Empty(t, result.Err)
+	assert.Equal(t, wamp.List{"calibrated"}, result.Args)
+
+	// while the session is down, the caller gets an error, not a hang
+	cloud.SetConnected(false)
+	result = local.registration("com.example.")(context.Background(), &wamp.Invocation{
+		Details: wamp.Dict{"caller_authid": sensorsAuthID, "procedure": "com.example.calibrate"},
+	})
+	assert.Equal(t, wamp.URI("wamp.error.canceled"), result.Err)
+	cloud.SetConnected(true)
+
+	// cloud -> app: the cloud calls a procedure an app registered locally
+	bridge.Register(1, sensorsAuthID, "com.example.read", nil)
+	handler := cloud.registration("com.example.read")
+	require.NotNil(t, handler)
+	local.callResult = func(call fakeCall) (*wamp.Result, error) {
+		return &wamp.Result{Arguments: wamp.List{21.5}}, nil
+	}
+
+	invokeResult, err := handler(context.Background(), messenger.Result{Arguments: []interface{}{"probe-1"}})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{21.5}, invokeResult.Arguments)
+	require.Len(t, local.getCalls(), 1)
+	assert.Equal(t, fakeCall{Procedure: "com.example.read", Args: wamp.List{"probe-1"}}, local.getCalls()[0])
+}
+
+func TestBridgeReattachesOnANewSession(t *testing.T) {
+	bridge, _, cloud := bridgeHarness(t)
+
+	// made while offline, mirrored once the session is back
+	cloud.SetConnected(false)
+	bridge.Subscribe(1, sensorsAuthID, "com.example.setpoint", nil)
+	bridge.Register(1, sensorsAuthID, "com.example.read", nil)
+	assert.Equal(t, 0, cloud.subscribes())
+
+	cloud.reconnect()
+	bridge.Reattach()
+	assert.Equal(t, 1, cloud.subscribes())
+	assert.NotNil(t, cloud.registration("com.example.read"))
+
+	// on the same session, nothing is mirrored twice
+	bridge.Reattach()
+	assert.Equal(t, 1, cloud.subscribes())
+
+	// a new session has lost them
+	cloud.reconnect()
+	bridge.Reattach()
+	assert.Equal(t, 2, cloud.subscribes())
+	assert.NotNil(t, cloud.registration("com.example.read"))
+}
+
+func TestBridgeDropsWhatAnAppLeftBehind(t *testing.T) {
+	bridge, local, cloud := bridgeHarness(t)
+
+	bridge.Subscribe(1, sensorsAuthID, "com.example.setpoint", nil)
+	bridge.Subscribe(2, sensorsAuthID, "com.example.setpoint", nil)
+	bridge.Subscribe(3, alertsAuthID, "com.example.alarm", nil)
+	bridge.Register(1, sensorsAuthID, "com.example.read", nil)
+
+	onLeave := local.subscription("wamp.session.on_leave")
+	require.NotNil(t, onLeave)
+
+	onLeave(&wamp.Event{Arguments: wamp.List{uint64(1)}})
+	assert.Empty(t, cloud.unsubscribed, "the app still has a session")
+	assert.Empty(t, cloud.unregistered)
+
+	onLeave(&wamp.Event{Arguments: wamp.List{uint64(2)}})
+	assert.Equal(t, []string{"com.example.setpoint"}, cloud.unsubscribed)
+	assert.Equal(t, []string{"com.example.read"}, cloud.unregistered)
+	assert.Empty(t, bridge.subscribers("com.example.setpoint"))
+	assert.Equal(t, wamp.List{alertsAuthID}, bridge.subscribers("com.example.alarm"))
+}
+
+func TestAuthorizerHandsAppTrafficToTheBridge(t *testing.T) {
+	bridge, _, cloud := bridgeHarness(t)
+	authz := authorizer{bridge: bridge}
+
+	agentSession := &wamp.Session{ID: 1, Details: wamp.Dict{"authrole": "trusted"}}
+	allowed, err := authz.Authorize(agentSession, &wamp.Publish{Topic: "com.example.temperature"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Empty(t, cloud.GetPublishCalls(), "the agent's own session is not bridged")
+
+	appSession := &wamp.Session{ID: 2, Details: wamp.Dict{"authrole": appRole, "authid": sensorsAuthID}}
+	allowed, err = authz.Authorize(appSession, &wamp.Publish{Topic: "com.example.temperature", Arguments: wamp.List{1}})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = authz.Authorize(appSession, &wamp.Publish{Topic: "local.only"})
+	require.NoError(t, err)
+	assert.True(t, allowed, "local traffic stays allowed")
+
+	publishes := cloud.GetPublishCalls()
+	require.Len(t, publishes, 1)
+	assert.Equal(t, topics.Topic("com.example.temperature"), publishes[0].Topic)
+}
+
+func TestKeyStoreResolvesAppCredentials(t *testing.T) {
+	ks := keyStore{resolve: func(authID string) (string, bool) { return "s3cret", authID == sensorsAuthID }}
+
+	key, err := ks.AuthKey(sensorsAuthID, "wampcra")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("s3cret"), key)
+
+	_, err = ks.AuthKey(alertsAuthID, "wampcra")
+	assert.ErrorIs(t, err, ErrUnknownApp)
+	_, err = ks.AuthKey(sensorsAuthID, "ticket")
+	assert.Error(t, err)
+
+	role, err := ks.AuthRole(sensorsAuthID)
+	require.NoError(t, err)
+	assert.Equal(t, appRole, role)
+}
+
+func TestParsePrefixes(t *testing.T) {
+	assert.Equal(t, []string{"com.example.", "com.other."}, ParsePrefixes(" com.example., ,com.other."))
+	assert.Empty(t, ParsePrefixes(""))
+}
+
+func TestListenHost(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", listenHost("10.0.0.1"))
+	assert.NotEqual(t, "0.0.0.0", listenHost(""), "not served to the network by default")
+	assert.NotEmpty(t, listenHost(""))
+}
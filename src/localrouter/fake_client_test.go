@@ -0,0 +1,283 @@
+package localrouter
+
+import (
+	"context"
+	"errors"
+	"reagent/common"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"reagent/testutil/fakes"
+	"sync"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+var errFakeDisconnected = errors.New("fake client disconnected")
+
+type fakePublish struct {
+	Topic   string
+	Options wamp.Dict
+	Args    wamp.List
+	Kwargs  wamp.Dict
+}
+
+type fakeCall struct {
+	Procedure string
+	Args      wamp.List
+	Kwargs    wamp.Dict
+}
+
+// fakeClient is a stateful stand-in for a nexus session: it records what is
+// published and called, and keeps the handlers so tests can deliver events
+// and invocations.
+type fakeClient struct {
+	mu            sync.Mutex
+	connected     bool
+	done          chan struct{}
+	publishes     []fakePublish
+	calls         []fakeCall
+	subscriptions map[string]client.EventHandler
+	registrations map[string]client.InvocationHandler
+	options       map[string]wamp.Dict
+	callResult    func(fakeCall) (*wamp.Result, error)
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		connected:     true,
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]client.EventHandler),
+		registrations: make(map[string]client.InvocationHandler),
+		options:       make(map[string]wamp.Dict),
+	}
+}
+
+// drop simulates the connection going away.
+func (c *fakeClient) drop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.connected {
+		c.connected = false
+		close(c.done)
+	}
+}
+
+func (c *fakeClient) Close() error {
+	c.drop()
+	return nil
+}
+
+func (c *fakeClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) Done() <-chan struct{} { return c.done }
+
+func (c *fakeClient) ID() wamp.ID { return 1 }
+
+func (c *fakeClient) Publish(topic string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		return errFakeDisconnected
+	}
+	c.publishes = append(c.publishes, fakePublish{Topic: topic, Options: options, Args: args, Kwargs: kwargs})
+	return nil
+}
+
+func (c *fakeClient) Subscribe(topic string, fn client.EventHandler, options wamp.Dict) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscriptions[topic] = fn
+	c.options[topic] = options
+	return nil
+}
+
+func (c *fakeClient) SubscriptionID(topic string) (wamp.ID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.subscriptions[topic]
+	return 1, ok
+}
+
+func (c *fakeClient) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.subscriptions, topic)
+	return nil
+}
+
+func (c *fakeClient) Call(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, progCb client.ProgressHandler) (*wamp.Result, error) {
+	call := fakeCall{Procedure: procedure, Args: args, Kwargs: kwargs}
+
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	callResult := c.callResult
+	c.mu.Unlock()
+
+	if callResult == nil {
+		return &wamp.Result{}, nil
+	}
+	return callResult(call)
+}
+
+func (c *fakeClient) Register(procedure string, fn client.InvocationHandler, options wamp.Dict) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.registrations[procedure] = fn
+	c.options[procedure] = options
+	return nil
+}
+
+func (c *fakeClient) SendProgress(ctx context.Context, args wamp.List, kwargs wamp.Dict) error {
+	return nil
+}
+
+func (c *fakeClient) RegistrationID(procedure string) (wamp.ID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.registrations[procedure]
+	return 1, ok
+}
+
+func (c *fakeClient) Unregister(procedure string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.registrations, procedure)
+	return nil
+}
+
+func (c *fakeClient) getPublishes() []fakePublish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakePublish(nil), c.publishes...)
+}
+
+func (c *fakeClient) getCalls() []fakeCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeCall(nil), c.calls...)
+}
+
+func (c *fakeClient) subscription(topic string) client.EventHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptions[topic]
+}
+
+func (c *fakeClient) registration(procedure string) client.InvocationHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registrations[procedure]
+}
+
+// fakeCloud is the agent's cloud session: unlike fakes.Messenger it fails
+// publishes while disconnected, keeps the invocation handlers and forgets its
+// subscriptions and registrations on a reconnect, as the router does.
+type fakeCloud struct {
+	*fakes.Messenger
+
+	mu             sync.Mutex
+	subscribed     map[string]bool
+	registrations  map[string]func(context.Context, messenger.Result) (*messenger.InvokeResult, error)
+	unsubscribed   []string
+	unregistered   []string
+	subscribeCalls int
+}
+
+func newFakeCloud() *fakeCloud {
+	return &fakeCloud{
+		Messenger:     fakes.NewMessenger(),
+		subscribed:    make(map[string]bool),
+		registrations: make(map[string]func(context.Context, messenger.Result) (*messenger.InvokeResult, error)),
+	}
+}
+
+// reconnect simulates a new session after the connection went away.
+func (c *fakeCloud) reconnect() {
+	c.mu.Lock()
+	c.subscribed = make(map[string]bool)
+	c.registrations = make(map[string]func(context.Context, messenger.Result) (*messenger.InvokeResult, error))
+	c.mu.Unlock()
+
+	c.SetConnected(true)
+}
+
+func (c *fakeCloud) Publish(topic topics.Topic, args []interface{}, kwargs common.Dict, options common.Dict) error {
+	if !c.Connected() {
+		return messenger.ErrNotConnected
+	}
+	return c.Messenger.Publish(topic, args, kwargs, options)
+}
+
+func (c *fakeCloud) Subscribe(topic topics.Topic, cb func(messenger.Result) error, options common.Dict) error {
+	c.mu.Lock()
+	c.subscribed[string(topic)] = true
+	c.subscribeCalls++
+	c.mu.Unlock()
+
+	return c.Messenger.Subscribe(topic, cb, options)
+}
+
+func (c *fakeCloud) SubscriptionID(topic topics.Topic) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return 1, c.subscribed[string(topic)]
+}
+
+func (c *fakeCloud) Unsubscribe(topic topics.Topic) error {
+	c.mu.Lock()
+	delete(c.subscribed, string(topic))
+	c.unsubscribed = append(c.unsubscribed, string(topic))
+	c.mu.Unlock()
+
+	return c.Messenger.Unsubscribe(topic)
+}
+
+func (c *fakeCloud) Register(topic topics.Topic, cb func(ctx context.Context, invocation messenger.Result) (*messenger.InvokeResult, error), options common.Dict) error {
+	c.mu.Lock()
+	c.registrations[string(topic)] = cb
+	c.mu.Unlock()
+
+	return c.Messenger.Register(topic, cb, options)
+}
+
+func (c *fakeCloud) RegistrationID(topic topics.Topic) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.registrations[string(topic)]
+	return 1, ok
+}
+
+func (c *fakeCloud) Unregister(topic topics.Topic) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.registrations, string(topic))
+	c.unregistered = append(c.unregistered, string(topic))
+	return nil
+}
+
+func (c *fakeCloud) registration(procedure string) func(context.Context, messenger.Result) (*messenger.InvokeResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registrations[procedure]
+}
+
+// subscribes is the number of subscriptions made in the cloud.
+func (c *fakeCloud) subscribes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscribeCalls
+}
@@ -0,0 +1,42 @@
+package localrouter
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrUnknownApp = errors.New("no app is installed with this credential")
+
+// keyStore authenticates apps on the local router with the same WAMP-CRA
+// credentials they would use against the cloud router.
+type keyStore struct {
+	resolve CredentialResolver
+}
+
+func (ks keyStore) AuthKey(authID, authMethod string) ([]byte, error) {
+	if authMethod != "wampcra" {
+		return nil, errors.New("unsupported authmethod " + authMethod)
+	}
+
+	secret, ok := ks.resolve(authID)
+	if !ok {
+		log.Debug().Str("authid", authID).Msg("Rejecting local router session with unknown app credential")
+		return nil, ErrUnknownApp
+	}
+
+	return []byte(secret), nil
+}
+
+// PasswordInfo reports that app secrets are used as is, not salted.
+func (keyStore) PasswordInfo(authID string) (string, int, int) {
+	return "", 0, 0
+}
+
+func (keyStore) Provider() string {
+	return "reagent"
+}
+
+func (keyStore) AuthRole(authID string) (string, error) {
+	return appRole, nil
+}
@@ -0,0 +1,185 @@
+package localrouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reagent/config"
+	"reagent/messenger"
+	"reagent/safe"
+	"time"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/router"
+	"github.com/gammazero/nexus/v3/router/auth"
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/rs/zerolog/log"
+)
+
+// SpoolDirName is the directory in the agent directory the bridge spools
+// offline publishes in.
+const SpoolDirName = "localrouter/spool"
+
+// bridgeInterface is the bridge of docker's default network.
+const bridgeInterface = "docker0"
+
+// challengeTimeout bounds how long an app may take to answer the CRA
+// challenge.
+const challengeTimeout = 10 * time.Second
+
+// LocalRouter is a WAMP router on the device for the app containers. Apps
+// authenticate with their app credentials and reach each other directly;
+// selected URIs are bridged to the cloud router.
+type LocalRouter struct {
+	port   uint
+	router router.Router
+	bridge *Bridge
+	local  *client.Client
+	server *http.Server
+}
+
+// URL is the address app containers reach a local router on port at.
+func URL(port uint) string {
+	return fmt.Sprintf("ws://host.docker.internal:%d/ws", port)
+}
+
+// New starts a local router on the port set with -localRouterPort,
+// authenticating apps with the credentials resolve returns and bridging them
+// to the cloud through the agent's session cloud.
+func New(generalConfig *config.Config, resolve CredentialResolver, cloud messenger.Messenger) (*LocalRouter, error) {
+	cliArgs := generalConfig.CommandLineArguments
+
+	bridge := NewBridge(
+		ParsePrefixes(cliArgs.LocalRouterBridge),
+		filepath.Join(cliArgs.AgentDir, filepath.FromSlash(SpoolDirName)),
+		cloud,
+	)
+
+	routerConfig := &router.Config{
+		RealmConfigs: []*router.RealmConfig{
+			{
+				URI:            wamp.URI(realm),
+				StrictURI:      false,
+				AnonymousAuth:  false,
+				AllowDisclose:  true,
+				Authenticators: []auth.Authenticator{auth.NewCRAuthenticator(keyStore{resolve: resolve}, challengeTimeout)},
+				Authorizer:     authorizer{bridge: bridge},
+			},
+		},
+		Debug: cliArgs.DebugMessaging,
+	}
+
+	nexusRouter, err := router.NewRouter(routerConfig, wampLogger{})
+	if err != nil {
+		return nil, err
+	}
+
+	// the agent's own session, used by the bridge to act on the local side
+	local, err := client.ConnectLocal(nexusRouter, client.Config{Realm: realm, Logger: wampLogger{}})
+	if err != nil {
+		nexusRouter.Close()
+		return nil, err
+	}
+
+	err = bridge.Start(local)
+	if err != nil {
+		_ = local.Close()
+		nexusRouter.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", router.NewWebsocketServer(nexusRouter))
+
+	address := net.JoinHostPort(listenHost(cliArgs.LocalRouterAddress), fmt.Sprint(cliArgs.LocalRouterPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		_ = local.Close()
+		nexusRouter.Close()
+		return nil, err
+	}
+
+	lr := &LocalRouter{
+		port:   cliArgs.LocalRouterPort,
+		router: nexusRouter,
+		bridge: bridge,
+		local:  local,
+		server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+	}
+
+	safe.Go(func() {
+		err := lr.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("local WAMP router stopped serving")
+		}
+	})
+
+	log.Info().Str("address", address).Strs("bridged", bridge.prefixes).Msg("Local WAMP router for apps started")
+
+	return lr, nil
+}
+
+// URL is the address app containers reach the router at.
+func (lr *LocalRouter) URL() string {
+	if lr == nil {
+		return ""
+	}
+	return URL(lr.port)
+}
+
+// SetMessenger hands the bridge the agent's connected cloud session.
+func (lr *LocalRouter) SetMessenger(cloud messenger.Messenger) {
+	if lr == nil {
+		return
+	}
+	lr.bridge.SetMessenger(cloud)
+}
+
+// Reattach restores the bridge on a fresh cloud session, see
+// Bridge.Reattach.
+func (lr *LocalRouter) Reattach() {
+	if lr == nil {
+		return
+	}
+	lr.bridge.Reattach()
+}
+
+// Close stops the router. Publishes still spooled are replayed the next time
+// the agent runs one.
+func (lr *LocalRouter) Close() error {
+	if lr == nil {
+		return nil
+	}
+
+	_ = lr.local.Close()
+	err := lr.server.Close()
+	lr.router.Close()
+	return err
+}
+
+// listenHost is the address the router listens on: the configured one, or
+// else the address of the docker0 bridge, which host.docker.internal resolves
+// to in the app containers. Where there is none, as under Docker Desktop,
+// which forwards host.docker.internal to the host's loopback, it is
+// localhost. The router is not served to the network either way.
+func listenHost(configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	if iface, err := net.InterfaceByName(bridgeInterface); err == nil {
+		addrs, err := iface.Addrs()
+		if err == nil {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+					return ipNet.IP.String()
+				}
+			}
+		}
+	}
+
+	log.Warn().Msgf("No %s bridge found, the local WAMP router only listens on localhost; set -localRouterAddress if the apps cannot reach it", bridgeInterface)
+	return "127.0.0.1"
+}
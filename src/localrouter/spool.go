@@ -0,0 +1,187 @@
+package localrouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// spooledPublish is a publish an app made while its cloud session was down.
+type spooledPublish struct {
+	Topic  string                 `json:"topic"`
+	Args   []interface{}          `json:"args,omitempty"`
+	Kwargs map[string]interface{} `json:"kwargs,omitempty"`
+	Time   time.Time              `json:"time"`
+}
+
+// spool is an on-disk FIFO of publishes, one JSON document per line. It is
+// bounded: once it grows past maxBytes the oldest publishes are dropped, so
+// an app that keeps publishing through a long outage cannot fill the disk.
+type spool struct {
+	path     string
+	maxBytes int64
+
+	mu sync.Mutex
+}
+
+func newSpool(path string, maxBytes int64) *spool {
+	return &spool{path: path, maxBytes: maxBytes}
+}
+
+// Append queues a publish behind the ones already spooled.
+func (s *spool) Append(publish spooledPublish) error {
+	line, err := json.Marshal(publish)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > s.maxBytes {
+		return s.trimLocked()
+	}
+
+	return nil
+}
+
+// Replay hands the spooled publishes to send, oldest first, and removes the
+// ones sent. It stops at the first one send fails on, keeping it and the
+// rest for the next replay.
+func (s *spool) Replay(send func(spooledPublish) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines, err := s.readLocked()
+	if err != nil || len(lines) == 0 {
+		return 0, err
+	}
+
+	for i, line := range lines {
+		var publish spooledPublish
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		// keep large integers intact on the way back out
+		decoder.UseNumber()
+		if decoder.Decode(&publish) != nil {
+			log.Warn().Str("spool", s.path).Msg("Dropping unreadable spooled publish")
+			continue
+		}
+
+		err = send(publish)
+		if err != nil {
+			return i, s.writeLocked(lines[i:])
+		}
+	}
+
+	return len(lines), s.writeLocked(nil)
+}
+
+// Len is the number of spooled publishes.
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines, _ := s.readLocked()
+	return len(lines)
+}
+
+func (s *spool) readLocked() ([][]byte, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxBytes)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+
+	return lines, scanner.Err()
+}
+
+func (s *spool) writeLocked(lines [][]byte) error {
+	if len(lines) == 0 {
+		err := os.Remove(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// write and rename, so a crash mid-write does not lose the spool
+	tmpPath := s.path + ".tmp"
+	err := os.WriteFile(tmpPath, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// trimLocked drops the oldest publishes until the spool is back under three
+// quarters of its limit, so it is not rewritten on every append.
+func (s *spool) trimLocked() error {
+	lines, err := s.readLocked()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+
+	dropped := 0
+	for size > s.maxBytes*3/4 && dropped < len(lines) {
+		size -= int64(len(lines[dropped])) + 1
+		dropped++
+	}
+
+	log.Warn().Str("spool", s.path).Int("dropped", dropped).Msg("Publish spool is full, dropping the oldest publishes")
+	return s.writeLocked(lines[dropped:])
+}
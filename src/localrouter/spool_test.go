@@ -0,0 +1,72 @@
+package localrouter
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	s := newSpool(filepath.Join(t.TempDir(), "spool", "app.jsonl"), DefaultSpoolBytes)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, s.Append(spooledPublish{Topic: "com.example.t", Args: []interface{}{i}, Time: time.Now()}))
+	}
+	assert.Equal(t, 3, s.Len())
+
+	// a failed send keeps it and everything after it
+	var sent []json.Number
+	replayed, err := s.Replay(func(publish spooledPublish) error {
+		if len(sent) == 2 {
+			return errors.New("connection lost")
+		}
+		sent = append(sent, publish.Args[0].(json.Number))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, []json.Number{"1", "2"}, sent)
+	assert.Equal(t, 1, s.Len())
+
+	replayed, err = s.Replay(func(publish spooledPublish) error {
+		sent = append(sent, publish.Args[0].(json.Number))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, []json.Number{"1", "2", "3"}, sent)
+
+	_, err = os.Stat(s.path)
+	assert.True(t, os.IsNotExist(err), "an empty spool leaves no file behind")
+}
+
+func TestSpoolDropsOldestWhenFull(t *testing.T) {
+	s := newSpool(filepath.Join(t.TempDir(), "app.jsonl"), 1024)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Append(spooledPublish{Topic: "com.example.t", Args: []interface{}{i}}))
+	}
+
+	info, err := os.Stat(s.path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(1024))
+
+	var first, last string
+	_, err = s.Replay(func(publish spooledPublish) error {
+		if first == "" {
+			first = publish.Args[0].(json.Number).String()
+		}
+		last = publish.Args[0].(json.Number).String()
+		return nil
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, "0", first, "the oldest publishes are dropped")
+	assert.Equal(t, strconv.Itoa(99), last, "the newest are kept")
+}
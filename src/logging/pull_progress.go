@@ -0,0 +1,266 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reagent/common"
+	"reagent/messenger/topics"
+	"reagent/safe"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/rs/zerolog/log"
+)
+
+// pullProgressInterval is how often a pull's progress is published at most.
+const pullProgressInterval = time.Second
+
+// maxPendingProgressBytes caps the unterminated tail of a pull stream kept to
+// find the next line in; a longer line is not a progress message.
+const maxPendingProgressBytes = 64 * 1024
+
+// pullRateSmoothing is the weight of the latest rate sample in the smoothed
+// download rate the ETA is computed from.
+const pullRateSmoothing = 0.3
+
+// composeLayerLine matches a layer line of `docker compose pull`, e.g.
+// " a803e7c4b030 Downloading [=>     ]  1.21MB/29.1MB". Newer versions put the
+// service name in front of the layer ID.
+var composeLayerLine = regexp.MustCompile(`(?:^|\s)([0-9a-f]{12})\s+(.+)$`)
+
+// composeLayerBytes matches the "1.21MB/29.1MB" of a compose layer line.
+var composeLayerBytes = regexp.MustCompile(`([0-9.]+\s?[kMGT]?B)/([0-9.]+\s?[kMGT]?B)`)
+
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// PullProgress aggregates the per-layer progress of an image pull into the
+// bytes, percentage and ETA of the app as a whole, which it publishes on the
+// app's log topic at most once a second. It outlives a pull that is retried,
+// so the layers an earlier attempt finished stay accounted for.
+type PullProgress struct {
+	publish func(common.Dict)
+	now     func() time.Time
+
+	mutex       sync.Mutex
+	layers      map[string]*layerProgress
+	attempt     int
+	lastPublish time.Time
+	lastBytes   int64
+	rate        float64
+}
+
+// NewPullProgress returns the progress of a pull published for containerName.
+func (lm *LogManager) NewPullProgress(containerName string) *PullProgress {
+	return newPullProgress(func(entry common.Dict) {
+		topic := fmt.Sprintf("reswarm.logs.%s.%s", lm.Messenger.GetConfig().ReswarmConfig.SerialNumber, containerName)
+		err := lm.Messenger.Publish(topics.Topic(topic), []interface{}{entry}, nil, nil)
+		if err != nil {
+			log.Debug().Err(err).Msgf("failed to publish the pull progress of %s", containerName)
+		}
+	})
+}
+
+func newPullProgress(publish func(common.Dict)) *PullProgress {
+	return &PullProgress{
+		publish: publish,
+		now:     time.Now,
+		layers:  make(map[string]*layerProgress),
+		attempt: 1,
+	}
+}
+
+// Reader follows the docker pull stream read through the returned reader.
+func (p *PullProgress) Reader(stream io.ReadCloser) io.ReadCloser {
+	return &pullProgressReader{ReadCloser: stream, progress: p}
+}
+
+// Lines follows the `docker compose pull` output passed through the returned
+// channel.
+func (p *PullProgress) Lines(lines chan string) chan string {
+	followed := make(chan string, cap(lines))
+	safe.Go(func() {
+		defer close(followed)
+		for line := range lines {
+			p.AddComposeLine(line)
+			followed <- line
+		}
+	})
+	return followed
+}
+
+// Retrying publishes that the pull is tried again, as the given attempt.
+func (p *PullProgress) Retrying(attempt int) {
+	p.mutex.Lock()
+	p.attempt = attempt
+	p.mutex.Unlock()
+
+	p.flush(true, false)
+}
+
+// Finish publishes the final progress of the pull.
+func (p *PullProgress) Finish() {
+	p.flush(true, true)
+}
+
+// AddDockerMessage takes a line of a docker pull stream.
+func (p *PullProgress) AddDockerMessage(line []byte) {
+	var message JSONMessage
+	err := json.Unmarshal(line, &message)
+	if err != nil || message.ID == "" {
+		return
+	}
+
+	var current, total int64
+	if message.Progress != nil {
+		current, total = message.Progress.Current, message.Progress.Total
+	}
+
+	p.update(message.ID, message.Status, current, total)
+}
+
+// AddComposeLine takes a line of `docker compose pull` output.
+func (p *PullProgress) AddComposeLine(line string) {
+	match := composeLayerLine.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+
+	var current, total int64
+	if sizes := composeLayerBytes.FindStringSubmatch(match[2]); sizes != nil {
+		current, _ = units.FromHumanSize(sizes[1])
+		total, _ = units.FromHumanSize(sizes[2])
+	}
+
+	p.update(match[1], match[2], current, total)
+}
+
+func (p *PullProgress) update(id string, status string, current int64, total int64) {
+	p.mutex.Lock()
+	layer := p.layers[id]
+	if layer == nil && !isLayerStatus(status) {
+		p.mutex.Unlock()
+		return
+	}
+	if layer == nil {
+		layer = &layerProgress{}
+		p.layers[id] = layer
+	}
+
+	switch {
+	case hasStatusPrefix(status, "Downloading"):
+		layer.current = current
+		if total > 0 {
+			layer.total = total
+		}
+		layer.done = false
+	case hasStatusPrefix(status, "Verifying Checksum", "Download complete", "Extracting", "Pull complete", "Already exists"):
+		layer.done = true
+	}
+	p.mutex.Unlock()
+
+	p.flush(false, false)
+}
+
+// isLayerStatus reports whether status is one a pull reports per layer, as
+// opposed to the ones about the image, which carry its tag as their ID.
+func isLayerStatus(status string) bool {
+	return hasStatusPrefix(status, "Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum",
+		"Download complete", "Extracting", "Pull complete", "Already exists")
+}
+
+func hasStatusPrefix(status string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(status, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush publishes the progress unless it was published less than
+// pullProgressInterval ago. force publishes it either way.
+func (p *PullProgress) flush(force bool, done bool) {
+	p.mutex.Lock()
+	now := p.now()
+	elapsed := now.Sub(p.lastPublish)
+	if !force && elapsed < pullProgressInterval {
+		p.mutex.Unlock()
+		return
+	}
+
+	var current, total int64
+	layersDone := 0
+	for _, layer := range p.layers {
+		total += layer.total
+		if layer.done {
+			current += layer.total
+			layersDone++
+		} else {
+			current += layer.current
+		}
+	}
+
+	// A retried layer starts over, the rate never goes negative.
+	if !p.lastPublish.IsZero() && elapsed > 0 {
+		sample := max(float64(current-p.lastBytes)/elapsed.Seconds(), 0)
+		if p.rate == 0 {
+			p.rate = sample
+		} else {
+			p.rate = pullRateSmoothing*sample + (1-pullRateSmoothing)*p.rate
+		}
+	}
+	p.lastPublish = now
+	p.lastBytes = current
+
+	entry := common.Dict{
+		"type":       "pullProgress",
+		"current":    current,
+		"total":      total,
+		"layers":     len(p.layers),
+		"layersDone": layersDone,
+		"rate":       int64(p.rate),
+		"attempt":    p.attempt,
+		"done":       done,
+	}
+	if total > 0 {
+		entry["percent"] = min(100, float64(current)*100/float64(total))
+	}
+	if p.rate > 0 && total > current && !done {
+		entry["eta"] = int64(float64(total-current) / p.rate)
+	}
+	p.mutex.Unlock()
+
+	p.publish(entry)
+}
+
+type pullProgressReader struct {
+	io.ReadCloser
+	progress *PullProgress
+	pending  []byte
+}
+
+func (r *pullProgressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.pending = append(r.pending, b[:n]...)
+	for {
+		i := bytes.IndexByte(r.pending, '\n')
+		if i < 0 {
+			break
+		}
+		r.progress.AddDockerMessage(r.pending[:i])
+		r.pending = r.pending[i+1:]
+	}
+	if len(r.pending) > maxPendingProgressBytes {
+		r.pending = nil
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"io"
+	"reagent/common"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPullProgress returns a PullProgress on a clock the test advances,
+// and the entries it published.
+func newTestPullProgress() (*PullProgress, *[]common.Dict, *time.Time) {
+	var published []common.Dict
+	now := time.Unix(1700000000, 0)
+	progress := newPullProgress(func(entry common.Dict) { published = append(published, entry) })
+	progress.now = func() time.Time { return now }
+	return progress, &published, &now
+}
+
+func TestPullProgressDocker(t *testing.T) {
+	progress, published, now := newTestPullProgress()
+
+	stream := strings.Join([]string{
+		`{"status":"Pulling from app","id":"1.0.0"}`,
+		`{"status":"Pulling fs layer","id":"aaa"}`,
+		`{"status":"Already exists","id":"bbb"}`,
+		`{"status":"Downloading","progressDetail":{"current":100,"total":1000},"progress":"[>   ]","id":"aaa"}`,
+		`{"status":"Downloading","progressDetail":{"current":500,"total":1000},"progress":"[==> ]","id":"aaa"}`,
+	}, "\n") + "\n"
+
+	reader := progress.Reader(io.NopCloser(strings.NewReader(stream)))
+	*now = now.Add(2 * time.Second)
+	_, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	// The first line was published straight away, later ones are throttled.
+	require.Len(t, *published, 1)
+
+	*now = now.Add(2 * time.Second)
+	progress.AddDockerMessage([]byte(`{"status":"Downloading","progressDetail":{"current":700,"total":1000},"id":"aaa"}`))
+	require.Len(t, *published, 2)
+
+	last := (*published)[1]
+	assert.Equal(t, int64(700), last["current"])
+	assert.Equal(t, int64(1000), last["total"])
+	assert.Equal(t, 70.0, last["percent"])
+	assert.Equal(t, 2, last["layers"], "the image's own status is no layer")
+	assert.Equal(t, 1, last["layersDone"])
+	assert.Equal(t, int64(350), last["rate"])
+	assert.Equal(t, int64(0), last["eta"])
+
+	progress.AddDockerMessage([]byte(`{"status":"Pull complete","id":"aaa"}`))
+	progress.Finish()
+	final := (*published)[len(*published)-1]
+	assert.Equal(t, true, final["done"])
+	assert.Equal(t, 100.0, final["percent"])
+	assert.NotContains(t, final, "eta")
+}
+
+func TestPullProgressETA(t *testing.T) {
+	progress, published, now := newTestPullProgress()
+
+	progress.update("aaa", "Downloading", 0, 10_000)
+	*now = now.Add(time.Second)
+	progress.update("aaa", "Downloading", 1_000, 10_000)
+
+	last := (*published)[len(*published)-1]
+	assert.Equal(t, int64(1000), last["rate"])
+	assert.Equal(t, int64(9), last["eta"])
+}
+
+func TestPullProgressCompose(t *testing.T) {
+	progress, published, _ := newTestPullProgress()
+
+	for _, line := range []string{
+		" web Pulling ",
+		" a803e7c4b030 Pulling fs layer ",
+		" web 5e0b8b5c7d2f Already exists ",
+		" a803e7c4b030 Downloading [=====>                ]  1.5MB/3MB",
+		" web Pulled ",
+	} {
+		progress.AddComposeLine(line)
+	}
+	progress.Finish()
+
+	last := (*published)[len(*published)-1]
+	assert.Equal(t, int64(1_500_000), last["current"])
+	assert.Equal(t, int64(3_000_000), last["total"])
+	assert.Equal(t, 2, last["layers"])
+	assert.Equal(t, 1, last["layersDone"])
+}
+
+func TestPullProgressRetry(t *testing.T) {
+	progress, published, _ := newTestPullProgress()
+
+	progress.update("aaa", "Downloading", 1000, 1000)
+	progress.update("aaa", "Download complete", 0, 0)
+	progress.update("bbb", "Downloading", 400, 1000)
+
+	// the retry finds the finished layer and starts the other one over
+	progress.Retrying(2)
+	progress.update("aaa", "Already exists", 0, 0)
+	progress.update("bbb", "Downloading", 0, 1000)
+	progress.Finish()
+
+	last := (*published)[len(*published)-1]
+	assert.Equal(t, 2, last["attempt"])
+	assert.Equal(t, int64(1000), last["current"])
+	assert.Equal(t, int64(2000), last["total"])
+}
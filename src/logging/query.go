@@ -57,6 +57,9 @@ type LogQueryRequest struct {
 	// streams afterwards carry no timestamps and the seam between the two would
 	// show. It does not affect OldestAvailable, which comes from its own probe.
 	NoTimestamps bool
+
+	// Service reads just one service of a compose app.
+	Service string
 }
 
 // LogQueryResult is one answer to a windowed read.
@@ -104,6 +107,7 @@ func (lm *LogManager) QueryLogs(ctx context.Context, request LogQueryRequest) (L
 		Timestamps: !request.NoTimestamps,
 		Since:      formatBound(request.Since),
 		Until:      formatBound(request.Until),
+		Service:    request.Service,
 	}
 
 	lines, source, err := lm.readWindow(ctx, request.ContainerName, query)
@@ -158,6 +162,16 @@ func (lm *LogManager) readWindow(
 	containerName string,
 	query container.LogQuery,
 ) ([]string, string, error) {
+	// Only a compose project has services, and the stored history cannot tell
+	// them apart.
+	if query.Service != "" {
+		reader, err := lm.Container.Compose().LogsByContainerName(containerName+"_compose", query)
+		if err != nil {
+			return nil, "", err
+		}
+		return scanLines(reader), sourceCompose, nil
+	}
+
 	reader, err := lm.Container.Logs(ctx, containerName, query.DockerOptions())
 	if err == nil {
 		return scanLines(reader), sourceDocker, nil
@@ -198,6 +198,19 @@ func TestQueryLogsFallback(t *testing.T) {
 		assert.Error(t, err)
 	})
 
+	t.Run("a service is only read from its compose project", func(t *testing.T) {
+		// Strict mock: neither the plain container nor the history is consulted,
+		// the history would answer with every service of the app.
+		lm, cont, _, db := newTestManager(t)
+		addApp(t, db, 1, "logapp", common.PROD)
+		require.NoError(t, db.UpsertLogHistory("logapp", 1, common.PROD, []string{"stored-1"}))
+		cont.EXPECT().Compose().Return(&container.Compose{})
+
+		_, err := lm.QueryLogs(context.Background(), LogQueryRequest{ContainerName: "prod_1_logapp", Service: "db"})
+
+		assert.Error(t, err)
+	})
+
 	t.Run("refuses an empty container name", func(t *testing.T) {
 		lm, _, _, _ := newTestManager(t)
 
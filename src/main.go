@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -9,8 +10,10 @@ import (
 
 	// "reagent/common"
 	"reagent/config"
+	"reagent/container"
 	"reagent/filesystem"
 	"reagent/logging"
+	"reagent/messenger"
 	"reagent/release"
 	"reagent/safe"
 
@@ -130,7 +133,22 @@ func runAgent(cliArgs *config.CommandLineArguments) (*Agent, error) {
 
 	startupLogChannel <- fmt.Sprintf("Starting... Reagent initialization sequence (OOS: %s, ARCH: %s)", runtime.GOOS, runtime.GOARCH)
 
-	err := filesystem.InitDirectories(cliArgs)
+	err := messenger.ValidateProxyURL(cliArgs.WampProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -wampProxy: %w", err)
+	}
+
+	err = messenger.ValidateSerialization(cliArgs.WampSerialization)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -wampSerialization: %w", err)
+	}
+
+	err = container.ValidateRuntime(cliArgs.ContainerRuntime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -containerRuntime: %w", err)
+	}
+
+	err = filesystem.InitDirectories(cliArgs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init reagent directories: %w", err)
 	}
@@ -148,7 +166,7 @@ func runAgent(cliArgs *config.CommandLineArguments) (*Agent, error) {
 	safe.Go((func() {
 		startupLogChannel <- "Checking for agent update in background..."
 
-		_, err := agent.System.UpdateSystem(nil, agent.Config.CommandLineArguments.ShouldUpdateAgent)
+		_, err := agent.System.UpdateSystem(context.Background(), nil, agent.Config.CommandLineArguments.ShouldUpdateAgent)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to update system")
 		}
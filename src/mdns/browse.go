@@ -0,0 +1,209 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// Instance is a service instance found on the LAN by Browse.
+type Instance struct {
+	Name  string // fully qualified instance name
+	Host  string // host name the instance runs on, e.g. "my-device.local."
+	Addrs []net.IP
+	Port  uint16
+	Text  []string
+}
+
+// TextValue returns the value of the key=value TXT entry key.
+func (i Instance) TextValue(key string) (string, bool) {
+	for _, entry := range i.Text {
+		if value, ok := strings.CutPrefix(entry, key+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Browse asks the LAN for the instances of a service type (e.g. "_http._tcp")
+// and returns those that answered within wait. The query is sent one-shot from
+// an ephemeral port, which responders answer unicast (RFC 6762 section 5.1),
+// so browsing works next to a Responder or a system responder on port 5353.
+func Browse(ctx context.Context, serviceType string, wait time.Duration) ([]Instance, error) {
+	typeName, err := dnsmessage.NewName(Service{Type: serviceType}.typeName())
+	if err != nil {
+		return nil, err
+	}
+
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32())},
+		Questions: []dnsmessage.Question{{Name: typeName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer udpConn.Close()
+
+	conn := ipv4.NewPacketConn(udpConn)
+	_ = conn.SetMulticastTTL(255)
+	// the responder of this very host answers too
+	_ = conn.SetMulticastLoopback(true)
+
+	ifaces := multicastInterfaces()
+	if len(ifaces) == 0 {
+		_, err = conn.WriteTo(packet, nil, mdnsGroup)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ifi := range ifaces {
+		ifi := ifi
+		if conn.SetMulticastInterface(&ifi) != nil {
+			continue
+		}
+		_, _ = conn.WriteTo(packet, nil, mdnsGroup)
+	}
+
+	deadline := time.Now().Add(wait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = udpConn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		_ = udpConn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	results := newBrowseResults(typeName)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+
+		results.add(buf[:n], src.IP)
+	}
+
+	return results.instances(), ctx.Err()
+}
+
+type browseSRV struct {
+	host string
+	port uint16
+	src  net.IP
+}
+
+// browseResults collects the records of the responses to a browse query and
+// puts the instances together once all arrived: a responder may send the
+// SRV, TXT and A records of an instance in other packets than its PTR.
+type browseResults struct {
+	typeName string
+	names    []string
+	srv      map[string]browseSRV
+	txt      map[string][]string
+	addrs    map[string][]net.IP
+}
+
+func newBrowseResults(typeName dnsmessage.Name) *browseResults {
+	return &browseResults{
+		typeName: strings.ToLower(typeName.String()),
+		srv:      make(map[string]browseSRV),
+		txt:      make(map[string][]string),
+		addrs:    make(map[string][]net.IP),
+	}
+}
+
+func (b *browseResults) add(packet []byte, src net.IP) {
+	var message dnsmessage.Message
+	if message.Unpack(packet) != nil || !message.Header.Response {
+		return
+	}
+
+	for _, section := range [][]dnsmessage.Resource{message.Answers, message.Additionals} {
+		for _, record := range section {
+			name := strings.ToLower(record.Header.Name.String())
+			switch body := record.Body.(type) {
+			case *dnsmessage.PTRResource:
+				instance := body.PTR.String()
+				if name == b.typeName && !containsFold(b.names, instance) {
+					b.names = append(b.names, instance)
+				}
+			case *dnsmessage.SRVResource:
+				b.srv[name] = browseSRV{host: strings.ToLower(body.Target.String()), port: body.Port, src: src}
+			case *dnsmessage.TXTResource:
+				b.txt[name] = body.TXT
+			case *dnsmessage.AResource:
+				ip := net.IP(append([]byte(nil), body.A[:]...))
+				if !containsIP(b.addrs[name], ip) {
+					b.addrs[name] = append(b.addrs[name], ip)
+				}
+			}
+		}
+	}
+}
+
+// instances returns the instances whose SRV record arrived. Hosts without an
+// A record are reached at the address that answered.
+func (b *browseResults) instances() []Instance {
+	instances := make([]Instance, 0, len(b.names))
+	for _, name := range b.names {
+		srv, ok := b.srv[strings.ToLower(name)]
+		if !ok || srv.port == 0 {
+			continue
+		}
+
+		addrs := b.addrs[srv.host]
+		if len(addrs) == 0 && srv.src != nil {
+			addrs = []net.IP{srv.src}
+		}
+
+		instances = append(instances, Instance{
+			Name:  name,
+			Host:  srv.host,
+			Addrs: addrs,
+			Port:  srv.port,
+			Text:  b.txt[strings.ToLower(name)],
+		})
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+	return instances
+}
+
+func containsFold(values []string, value string) bool {
+	for _, existing := range values {
+		if strings.EqualFold(existing, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,687 @@
+// Package mdns is a minimal multicast DNS responder (RFC 6762) with DNS-SD
+// service advertisement (RFC 6763). It lets a device be found on a LAN that
+// has no internet access — and therefore no cloud tunnel — by answering
+// queries for its own host name and for the services registered with it.
+//
+// It only implements the responder side, and only what browsers such as
+// avahi-browse, dns-sd and the macOS/Windows resolvers need: PTR/SRV/TXT/A
+// answers, unsolicited announcements on change and goodbye packets on
+// withdrawal. Name conflict probing is not implemented; the host name is
+// expected to be unique (it is derived from the device name).
+//
+// It coexists with a system responder (avahi, mDNSResponder) on the same
+// host: the socket is opened with address reuse, and each responder only
+// answers for the names it owns.
+package mdns
+
+import (
+	"errors"
+	"net"
+	"reagent/safe"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// hostTTL is used for records tied to the host (A, SRV), otherTTL for the
+	// rest, as recommended by RFC 6762 section 10.
+	hostTTL  = 120
+	otherTTL = 4500
+	// legacyUnicastTTL caps the TTL of answers to one-shot (non port 5353)
+	// queriers, which do not take part in the mDNS cache maintenance.
+	legacyUnicastTTL = 10
+
+	// cacheFlush marks unique records so receivers replace, not merge, their
+	// cached copy; unicastResponse is the same bit set on a question (QU).
+	cacheFlush      dnsmessage.Class = 1 << 15
+	unicastResponse dnsmessage.Class = 1 << 15
+
+	// maxLabelLength is the DNS limit for a single label.
+	maxLabelLength = 63
+	maxPacketSize  = 9000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const servicesEnumeration = "_services._dns-sd._udp.local."
+
+// Service is one DNS-SD service instance advertised by the responder.
+type Service struct {
+	Instance string   // human readable instance name, e.g. "grafana web"
+	Type     string   // service type, e.g. "_http._tcp"
+	Port     uint16   // port the service listens on
+	Text     []string // TXT record entries, usually key=value
+}
+
+func (s Service) instanceName() string {
+	return instanceLabel(s.Instance) + "." + s.typeName()
+}
+
+func (s Service) typeName() string {
+	return strings.Trim(s.Type, ".") + ".local."
+}
+
+// Responder answers mDNS queries for its host name and advertises the
+// registered services. Services are registered in groups (e.g. one per app)
+// so a caller can replace everything it owns in one call.
+type Responder struct {
+	hostname string
+
+	mu     sync.RWMutex
+	groups map[string][]Service
+
+	connMu sync.Mutex
+	conn   *ipv4.PacketConn
+	ifaces []net.Interface
+	// started gates announcements: nothing is sent before Start or after
+	// Close.
+	started bool
+
+	// addrs returns the IPv4 addresses the host name resolves to. Swappable
+	// for tests.
+	addrs func() []net.IP
+	// send delivers an unsolicited multicast packet. Swappable for tests.
+	send func(packet []byte)
+}
+
+// NewResponder creates a responder for host (without the .local suffix). It
+// does not touch the network until Start is called.
+func NewResponder(host string) *Responder {
+	r := &Responder{
+		hostname: HostLabel(host) + ".local.",
+		groups:   make(map[string][]Service),
+		addrs:    localIPv4Addrs,
+	}
+	r.send = r.sendMulticast
+
+	return r
+}
+
+// Hostname returns the fully qualified host name the responder answers for,
+// without the trailing dot (e.g. "my-device.local").
+func (r *Responder) Hostname() string {
+	return strings.TrimSuffix(r.hostname, ".")
+}
+
+// Start joins the mDNS multicast group on every multicast capable interface,
+// announces the registered services and starts answering queries.
+func (r *Responder) Start() error {
+	udpConn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+
+	conn := ipv4.NewPacketConn(udpConn)
+	_ = conn.SetMulticastTTL(255)
+	_ = conn.SetMulticastLoopback(true)
+
+	ifaces := multicastInterfaces()
+	joined := make([]net.Interface, 0, len(ifaces))
+	for _, ifi := range ifaces {
+		ifi := ifi
+		err := conn.JoinGroup(&ifi, mdnsGroup)
+		if err != nil {
+			// ListenMulticastUDP already joined on the default interface
+			log.Debug().Err(err).Msgf("mdns: could not join multicast group on %s", ifi.Name)
+		}
+		joined = append(joined, ifi)
+	}
+
+	r.connMu.Lock()
+	r.conn = conn
+	r.ifaces = joined
+	r.started = true
+	r.connMu.Unlock()
+
+	safe.Go(func() {
+		r.serve(conn)
+	})
+
+	r.announce(r.Services(), otherTTL)
+
+	return nil
+}
+
+// Close sends goodbye packets for every registered service and stops the
+// responder.
+func (r *Responder) Close() error {
+	r.announce(r.Services(), 0)
+
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+
+	r.started = false
+	if r.conn == nil {
+		return nil
+	}
+
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// SetServices replaces the services registered under group. Services that
+// disappeared are withdrawn with a goodbye packet, new or changed ones are
+// announced.
+func (r *Responder) SetServices(group string, services []Service) {
+	r.mu.Lock()
+	previous := r.groups[group]
+	if len(services) == 0 {
+		delete(r.groups, group)
+	} else {
+		r.groups[group] = append([]Service(nil), services...)
+	}
+	r.mu.Unlock()
+
+	removed := serviceDifference(previous, services)
+	added := serviceDifference(services, previous)
+
+	if len(removed) > 0 {
+		r.announce(removed, 0)
+	}
+
+	if len(added) > 0 {
+		r.announce(added, otherTTL)
+	}
+}
+
+// RemoveServices withdraws every service registered under group.
+func (r *Responder) RemoveServices(group string) {
+	r.SetServices(group, nil)
+}
+
+// Services returns all registered services, ordered by type and instance.
+func (r *Responder) Services() []Service {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	services := make([]Service, 0)
+	for _, groupServices := range r.groups {
+		services = append(services, groupServices...)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Type != services[j].Type {
+			return services[i].Type < services[j].Type
+		}
+		return services[i].Instance < services[j].Instance
+	})
+
+	return services
+}
+
+func (r *Responder) serve(conn *ipv4.PacketConn) {
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		n, _, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug().Err(err).Msg("mdns: failed to read packet")
+			continue
+		}
+
+		srcAddr, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		response, unicast := r.handleQuery(buf[:n], srcAddr.Port != mdnsGroup.Port)
+		if response == nil {
+			continue
+		}
+
+		if unicast {
+			_, err = conn.WriteTo(response, nil, srcAddr)
+			if err != nil {
+				log.Debug().Err(err).Msg("mdns: failed to send unicast response")
+			}
+			continue
+		}
+
+		r.send(response)
+	}
+}
+
+// handleQuery builds the response to a query packet. legacy is set for
+// one-shot queriers (source port other than 5353), which expect a
+// conventional unicast DNS response. The second return value reports whether
+// the response must be sent unicast to the querier.
+func (r *Responder) handleQuery(packet []byte, legacy bool) ([]byte, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil || header.Response || header.OpCode != 0 {
+		return nil, false
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil || len(questions) == 0 {
+		return nil, false
+	}
+
+	services := r.Services()
+	records := r.records(services, otherTTL)
+
+	var answers []dnsmessage.Resource
+	var answeredQuestions []dnsmessage.Question
+	unicast := legacy
+	for _, question := range questions {
+		matched := false
+		for _, record := range records {
+			if !questionMatches(question, record.Header) || containsResource(answers, record) {
+				continue
+			}
+
+			answers = append(answers, record)
+			matched = true
+		}
+
+		if matched {
+			answeredQuestions = append(answeredQuestions, question)
+			if question.Class&unicastResponse != 0 {
+				unicast = true
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil, false
+	}
+
+	var additionals []dnsmessage.Resource
+	for _, record := range r.additionalRecords(answers, records) {
+		if !containsResource(answers, record) && !containsResource(additionals, record) {
+			additionals = append(additionals, record)
+		}
+	}
+
+	message := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+
+	if legacy {
+		// RFC 6762 section 6.7: echo the ID and question, drop the cache
+		// flush bit and keep TTLs short.
+		message.Header.ID = header.ID
+		message.Questions = answeredQuestions
+		for _, section := range [][]dnsmessage.Resource{message.Answers, message.Additionals} {
+			for i := range section {
+				section[i].Header.Class &^= cacheFlush
+				if section[i].Header.TTL > legacyUnicastTTL {
+					section[i].Header.TTL = legacyUnicastTTL
+				}
+			}
+		}
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		log.Debug().Err(err).Msg("mdns: failed to pack response")
+		return nil, false
+	}
+
+	return response, unicast
+}
+
+// additionalRecords returns the records a querier will want next, e.g. the
+// SRV/TXT/A records for an instance it only asked the PTR for.
+func (r *Responder) additionalRecords(answers []dnsmessage.Resource, records []dnsmessage.Resource) []dnsmessage.Resource {
+	var additionals []dnsmessage.Resource
+
+	for _, answer := range answers {
+		var target dnsmessage.Name
+		var types []dnsmessage.Type
+
+		switch body := answer.Body.(type) {
+		case *dnsmessage.PTRResource:
+			target = body.PTR
+			types = []dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT}
+		case *dnsmessage.SRVResource:
+			target = body.Target
+			types = []dnsmessage.Type{dnsmessage.TypeA}
+		default:
+			continue
+		}
+
+		for _, record := range records {
+			if !strings.EqualFold(record.Header.Name.String(), target.String()) {
+				continue
+			}
+
+			for _, recordType := range types {
+				if record.Header.Type == recordType {
+					additionals = append(additionals, record)
+				}
+			}
+
+			if srv, ok := record.Body.(*dnsmessage.SRVResource); ok && record.Header.Type == dnsmessage.TypeSRV {
+				additionals = append(additionals, r.addressRecords(srv.Target, records)...)
+			}
+		}
+	}
+
+	return additionals
+}
+
+func (r *Responder) addressRecords(host dnsmessage.Name, records []dnsmessage.Resource) []dnsmessage.Resource {
+	var addresses []dnsmessage.Resource
+	for _, record := range records {
+		if record.Header.Type == dnsmessage.TypeA && strings.EqualFold(record.Header.Name.String(), host.String()) {
+			addresses = append(addresses, record)
+		}
+	}
+
+	return addresses
+}
+
+// records returns every record the responder is authoritative for: the A
+// records of the host name and the DNS-SD records of the given services.
+func (r *Responder) records(services []Service, ttl uint32) []dnsmessage.Resource {
+	hostName, err := dnsmessage.NewName(r.hostname)
+	if err != nil {
+		return nil
+	}
+
+	hostRecordTTL := uint32(hostTTL)
+	if ttl == 0 {
+		hostRecordTTL = 0
+	}
+
+	var records []dnsmessage.Resource
+	for _, ip := range r.addrs() {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			continue
+		}
+
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: hostName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | cacheFlush, TTL: hostRecordTTL},
+			Body:   &a,
+		})
+	}
+
+	enumeration := dnsmessage.MustNewName(servicesEnumeration)
+	for _, service := range services {
+		typeName, err := dnsmessage.NewName(service.typeName())
+		if err != nil {
+			log.Debug().Err(err).Msgf("mdns: invalid service type %s", service.Type)
+			continue
+		}
+
+		instanceName, err := dnsmessage.NewName(service.instanceName())
+		if err != nil {
+			log.Debug().Err(err).Msgf("mdns: invalid service instance %s", service.Instance)
+			continue
+		}
+
+		txt := service.Text
+		if len(txt) == 0 {
+			// a TXT record must hold at least one (empty) string
+			txt = []string{""}
+		}
+
+		records = append(records,
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: enumeration, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: typeName},
+			},
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: typeName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: instanceName},
+			},
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | cacheFlush, TTL: hostRecordTTL},
+				Body:   &dnsmessage.SRVResource{Target: hostName, Port: service.Port},
+			},
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | cacheFlush, TTL: ttl},
+				Body:   &dnsmessage.TXTResource{TXT: txt},
+			},
+		)
+	}
+
+	return records
+}
+
+// announce multicasts the records of services unsolicited. A ttl of 0 is a
+// goodbye: receivers drop the records from their caches. Announcements are
+// repeated once after a second, as RFC 6762 section 8.3 asks for.
+func (r *Responder) announce(services []Service, ttl uint32) {
+	r.connMu.Lock()
+	started := r.started
+	r.connMu.Unlock()
+
+	if !started || len(services) == 0 {
+		return
+	}
+
+	records := r.records(services, ttl)
+	if ttl == 0 {
+		// the host name stays valid while other services remain
+		records = withoutType(records, dnsmessage.TypeA)
+	}
+
+	message := dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: records,
+	}
+
+	packet, err := message.Pack()
+	if err != nil {
+		log.Debug().Err(err).Msg("mdns: failed to pack announcement")
+		return
+	}
+
+	r.send(packet)
+
+	if ttl == 0 {
+		return
+	}
+
+	safe.Go(func() {
+		time.Sleep(time.Second)
+		r.send(packet)
+	})
+}
+
+// sendMulticast sends packet to the mDNS group on every joined interface.
+func (r *Responder) sendMulticast(packet []byte) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+
+	if r.conn == nil {
+		return
+	}
+
+	if len(r.ifaces) == 0 {
+		_, err := r.conn.WriteTo(packet, nil, mdnsGroup)
+		if err != nil {
+			log.Debug().Err(err).Msg("mdns: failed to send multicast packet")
+		}
+		return
+	}
+
+	for _, ifi := range r.ifaces {
+		ifi := ifi
+		err := r.conn.SetMulticastInterface(&ifi)
+		if err != nil {
+			continue
+		}
+
+		_, err = r.conn.WriteTo(packet, nil, mdnsGroup)
+		if err != nil {
+			log.Debug().Err(err).Msgf("mdns: failed to send multicast packet on %s", ifi.Name)
+		}
+	}
+}
+
+func questionMatches(question dnsmessage.Question, header dnsmessage.ResourceHeader) bool {
+	if question.Type != header.Type && question.Type != dnsmessage.TypeALL {
+		return false
+	}
+
+	return strings.EqualFold(question.Name.String(), header.Name.String())
+}
+
+func containsResource(resources []dnsmessage.Resource, resource dnsmessage.Resource) bool {
+	for _, existing := range resources {
+		if existing.Header.Type == resource.Header.Type &&
+			strings.EqualFold(existing.Header.Name.String(), resource.Header.Name.String()) &&
+			existing.Body.GoString() == resource.Body.GoString() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func withoutType(records []dnsmessage.Resource, recordType dnsmessage.Type) []dnsmessage.Resource {
+	filtered := make([]dnsmessage.Resource, 0, len(records))
+	for _, record := range records {
+		if record.Header.Type != recordType {
+			filtered = append(filtered, record)
+		}
+	}
+
+	return filtered
+}
+
+// serviceDifference returns the services in a that are not in b.
+func serviceDifference(a, b []Service) []Service {
+	var difference []Service
+	for _, service := range a {
+		found := false
+		for _, other := range b {
+			if serviceEqual(service, other) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			difference = append(difference, service)
+		}
+	}
+
+	return difference
+}
+
+func serviceEqual(a, b Service) bool {
+	if a.Instance != b.Instance || a.Type != b.Type || a.Port != b.Port || len(a.Text) != len(b.Text) {
+		return false
+	}
+
+	for i := range a.Text {
+		if a.Text[i] != b.Text[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// instanceLabel makes name usable as a single DNS label. Instance names may
+// contain spaces and punctuation, but dots would split the label.
+func instanceLabel(name string) string {
+	label := strings.ReplaceAll(strings.TrimSpace(name), ".", "-")
+	if len(label) > maxLabelLength {
+		label = label[:maxLabelLength]
+	}
+
+	return label
+}
+
+// HostLabel turns a device name into a valid host name label: lower case
+// letters, digits and dashes only.
+func HostLabel(name string) string {
+	var b strings.Builder
+	lastDash := false
+
+	for _, c := range strings.ToLower(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+			lastDash = false
+		case !lastDash && b.Len() > 0:
+			b.WriteRune('-')
+			lastDash = true
+		}
+	}
+
+	label := strings.Trim(b.String(), "-")
+	if len(label) > maxLabelLength {
+		label = strings.Trim(label[:maxLabelLength], "-")
+	}
+
+	return label
+}
+
+// multicastInterfaces returns the interfaces mDNS is spoken on: up,
+// multicast capable, not loopback, and not a container bridge.
+func multicastInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var result []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		if isContainerInterface(ifi.Name) {
+			continue
+		}
+
+		result = append(result, ifi)
+	}
+
+	return result
+}
+
+// isContainerInterface reports interfaces created by Docker or libvirt, whose
+// addresses are not reachable from the LAN.
+func isContainerInterface(name string) bool {
+	for _, prefix := range []string{"docker", "br-", "veth", "virbr", "cni", "flannel"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func localIPv4Addrs() []net.IP {
+	var ips []net.IP
+	for _, ifi := range multicastInterfaces() {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			ips = append(ips, ipNet.IP.To4())
+		}
+	}
+
+	return ips
+}
@@ -0,0 +1,217 @@
+package mdns
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestResponder(t *testing.T) (*Responder, *[][]byte) {
+	t.Helper()
+
+	var mu sync.Mutex
+	sent := [][]byte{}
+
+	r := NewResponder("Line 3 Controller")
+	r.addrs = func() []net.IP { return []net.IP{net.IPv4(192, 168, 1, 20)} }
+	r.send = func(packet []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, packet)
+	}
+
+	return r, &sent
+}
+
+func query(t *testing.T, id uint16, name string, qtype dnsmessage.Type, class dnsmessage.Class) []byte {
+	t.Helper()
+
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: class}},
+	}
+
+	packet, err := message.Pack()
+	require.NoError(t, err)
+	return packet
+}
+
+func unpack(t *testing.T, packet []byte) dnsmessage.Message {
+	t.Helper()
+
+	var message dnsmessage.Message
+	require.NoError(t, message.Unpack(packet))
+	return message
+}
+
+func TestHostLabel(t *testing.T) {
+	assert.Equal(t, "line-3-controller", HostLabel("Line 3 Controller"))
+	assert.Equal(t, "my-device", HostLabel("--My_Device--"))
+	assert.Equal(t, "", HostLabel("???"))
+}
+
+func TestBrowseAnswersWithInstanceDetails(t *testing.T) {
+	r, _ := newTestResponder(t)
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40001, Text: []string{"app=grafana", "rule=web"}}})
+
+	response, unicast := r.handleQuery(query(t, 0, "_http._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), false)
+	require.NotNil(t, response)
+	assert.False(t, unicast)
+
+	message := unpack(t, response)
+	assert.True(t, message.Header.Response)
+	assert.True(t, message.Header.Authoritative)
+
+	require.Len(t, message.Answers, 1)
+	ptr := message.Answers[0].Body.(*dnsmessage.PTRResource)
+	assert.Equal(t, "grafana web._http._tcp.local.", ptr.PTR.String())
+
+	// SRV, TXT and the host address ride along so browsers need no second round trip
+	types := map[dnsmessage.Type]dnsmessage.Resource{}
+	for _, additional := range message.Additionals {
+		types[additional.Header.Type] = additional
+	}
+
+	require.Contains(t, types, dnsmessage.TypeSRV)
+	srv := types[dnsmessage.TypeSRV].Body.(*dnsmessage.SRVResource)
+	assert.Equal(t, uint16(40001), srv.Port)
+	assert.Equal(t, "line-3-controller.local.", srv.Target.String())
+
+	require.Contains(t, types, dnsmessage.TypeTXT)
+	assert.Equal(t, []string{"app=grafana", "rule=web"}, types[dnsmessage.TypeTXT].Body.(*dnsmessage.TXTResource).TXT)
+
+	require.Contains(t, types, dnsmessage.TypeA)
+	assert.Equal(t, [4]byte{192, 168, 1, 20}, types[dnsmessage.TypeA].Body.(*dnsmessage.AResource).A)
+}
+
+func TestHostAndEnumerationQueries(t *testing.T) {
+	r, _ := newTestResponder(t)
+	r.SetServices("device", []Service{{Instance: "Line 3", Type: "_device-info._tcp"}})
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40001}})
+
+	t.Run("host name is case insensitive", func(t *testing.T) {
+		response, _ := r.handleQuery(query(t, 0, "LINE-3-CONTROLLER.local.", dnsmessage.TypeA, dnsmessage.ClassINET), false)
+		require.NotNil(t, response)
+
+		message := unpack(t, response)
+		require.Len(t, message.Answers, 1)
+		assert.Equal(t, dnsmessage.ClassINET|cacheFlush, message.Answers[0].Header.Class)
+	})
+
+	t.Run("service types are enumerated", func(t *testing.T) {
+		response, _ := r.handleQuery(query(t, 0, servicesEnumeration, dnsmessage.TypePTR, dnsmessage.ClassINET), false)
+		require.NotNil(t, response)
+
+		var serviceTypes []string
+		for _, answer := range unpack(t, response).Answers {
+			serviceTypes = append(serviceTypes, answer.Body.(*dnsmessage.PTRResource).PTR.String())
+		}
+		assert.ElementsMatch(t, []string{"_device-info._tcp.local.", "_http._tcp.local."}, serviceTypes)
+	})
+
+	t.Run("foreign names are ignored", func(t *testing.T) {
+		response, _ := r.handleQuery(query(t, 0, "printer.local.", dnsmessage.TypeA, dnsmessage.ClassINET), false)
+		assert.Nil(t, response)
+	})
+
+	t.Run("QU questions are answered unicast", func(t *testing.T) {
+		_, unicast := r.handleQuery(query(t, 0, "_http._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET|unicastResponse), false)
+		assert.True(t, unicast)
+	})
+}
+
+func TestLegacyUnicastQuery(t *testing.T) {
+	r, _ := newTestResponder(t)
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40001}})
+
+	response, unicast := r.handleQuery(query(t, 4711, "_http._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), true)
+	require.NotNil(t, response)
+	assert.True(t, unicast)
+
+	message := unpack(t, response)
+	assert.Equal(t, uint16(4711), message.Header.ID)
+	require.Len(t, message.Questions, 1)
+
+	for _, record := range append(message.Answers, message.Additionals...) {
+		assert.LessOrEqual(t, record.Header.TTL, uint32(legacyUnicastTTL))
+		assert.Zero(t, record.Header.Class&cacheFlush)
+	}
+}
+
+func TestSetServicesAnnouncesChanges(t *testing.T) {
+	r, sent := newTestResponder(t)
+
+	// nothing goes out before the responder is started
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40001}})
+	assert.Empty(t, *sent)
+
+	r.started = true
+
+	// unchanged services are not re-announced
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40001}})
+	assert.Empty(t, *sent)
+
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40002}})
+	require.GreaterOrEqual(t, len(*sent), 2)
+
+	goodbye := unpack(t, (*sent)[0])
+	for _, record := range goodbye.Answers {
+		assert.Zero(t, record.Header.TTL)
+		assert.NotEqual(t, dnsmessage.TypeA, record.Header.Type, "the host name must survive a withdrawn service")
+	}
+
+	announcement := unpack(t, (*sent)[1])
+	var port uint16
+	for _, record := range announcement.Answers {
+		if srv, ok := record.Body.(*dnsmessage.SRVResource); ok {
+			port = srv.Port
+		}
+	}
+	assert.Equal(t, uint16(40002), port)
+
+	r.RemoveServices("app")
+	assert.Empty(t, r.Services())
+}
+
+func TestBrowseResultsAssembleInstances(t *testing.T) {
+	r, _ := newTestResponder(t)
+	r.SetServices("images", []Service{{Instance: "line 3 images", Type: "_ironflock-images._tcp", Port: 5380, Text: []string{"device_key=7"}}})
+
+	typeName := dnsmessage.MustNewName("_ironflock-images._tcp.local.")
+	response, unicast := r.handleQuery(query(t, 42, typeName.String(), dnsmessage.TypePTR, dnsmessage.ClassINET), true)
+	require.NotNil(t, response)
+	assert.True(t, unicast)
+
+	results := newBrowseResults(typeName)
+	results.add(response, net.IPv4(192, 168, 1, 99))
+	// a repeated answer, e.g. from a second interface, is not a second instance
+	results.add(response, net.IPv4(192, 168, 1, 99))
+
+	instances := results.instances()
+	require.Len(t, instances, 1)
+	assert.Equal(t, "line 3 images._ironflock-images._tcp.local.", instances[0].Name)
+	assert.Equal(t, "line-3-controller.local.", instances[0].Host)
+	assert.Equal(t, uint16(5380), instances[0].Port)
+	require.Len(t, instances[0].Addrs, 1)
+	assert.True(t, instances[0].Addrs[0].Equal(net.IPv4(192, 168, 1, 20)))
+
+	deviceKey, ok := instances[0].TextValue("device_key")
+	assert.True(t, ok)
+	assert.Equal(t, "7", deviceKey)
+}
+
+func TestBrowseResultsIgnoreOtherTypes(t *testing.T) {
+	r, _ := newTestResponder(t)
+	r.SetServices("app", []Service{{Instance: "grafana web", Type: "_http._tcp", Port: 40001}})
+
+	response, _ := r.handleQuery(query(t, 0, "_http._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), true)
+	require.NotNil(t, response)
+
+	results := newBrowseResults(dnsmessage.MustNewName("_ironflock-images._tcp.local."))
+	results.add(response, net.IPv4(192, 168, 1, 99))
+	assert.Empty(t, results.instances())
+}
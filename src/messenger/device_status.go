@@ -0,0 +1,74 @@
+package messenger
+
+import (
+	"fmt"
+	"reagent/common"
+	"reagent/config"
+	"reagent/diskguard"
+	"time"
+)
+
+// deviceStatusPayload is the device status reported with every heartbeat,
+// whatever the transport.
+func deviceStatusPayload(cfg *config.Config, status DeviceStatus, sessionID uint64, tunnelCapableFn func() bool) common.Dict {
+	// While the device is in a disk-emergency, report EMERGENCY in place of the
+	// healthy CONNECTED status so the cloud/UI can flag it (see package diskguard).
+	if status == CONNECTED && diskguard.IsEmergency() {
+		status = EMERGENCY
+	}
+
+	stats := common.GetStats()
+
+	payload := common.Dict{
+		"swarm_key":       cfg.ReswarmConfig.SwarmKey,
+		"device_key":      cfg.ReswarmConfig.DeviceKey,
+		"status":          string(status),
+		"wamp_session_id": sessionID,
+		"stats": common.Dict{
+			"cpu_count":           stats.CPUCount,
+			"cpu_usage":           stats.CPUUsagePercent,
+			"memory_total":        stats.MemoryTotal,
+			"memory_used":         stats.MemoryUsed,
+			"memory_available":    stats.MemoryAvailable,
+			"storage_total":       stats.StorageTotal,
+			"storage_used":        stats.StorageUsed,
+			"storage_free":        stats.StorageFree,
+			"docker_apps_total":   stats.DockerAppsTotal,
+			"docker_apps_used":    stats.DockerAppsUsed,
+			"docker_apps_free":    stats.DockerAppsFree,
+			"docker_apps_mounted": stats.DockerAppsMounted,
+		},
+	}
+
+	// Expiry of the device certificate, with a warning when it is close, so
+	// the backend knows to renew it (see renew_device_certificate).
+	for key, value := range certificateStatus(cfg.ReswarmConfig, time.Now()) {
+		payload[key] = value
+	}
+
+	// Carry per-device tunnel capability on the heartbeat so the UI reflects it
+	// live (~30s) without a dedicated get_agent_metadata call. The backend
+	// forwards it to the devices store verbatim.
+	if tunnelCapableFn != nil {
+		payload["tunnel_capable"] = tunnelCapableFn()
+	}
+
+	return payload
+}
+
+// applyDeviceStatusReply takes over what the backend answers a device status
+// update with.
+func applyDeviceStatusReply(cfg *config.Config, res Result) {
+	if len(res.Arguments) == 0 || res.Arguments[0] == nil {
+		return
+	}
+
+	args, ok := res.Arguments[0].(map[string]any)
+	if !ok {
+		return
+	}
+
+	if reswarmBaseURL := fmt.Sprint(args["reswarmBaseURL"]); reswarmBaseURL != "" {
+		cfg.ReswarmConfig.ReswarmBaseURL = reswarmBaseURL
+	}
+}
@@ -0,0 +1,114 @@
+package messenger
+
+import (
+	"reagent/config"
+	"sync"
+	"time"
+)
+
+// endpointBackoff is how long a device endpoint is passed over after its first
+// failure. It doubles with every further consecutive failure, up to
+// maxEndpointBackoff. The dial loop itself keeps its short reconnectBackoff
+// cadence; this only decides which endpoint it tries.
+const endpointBackoff = 5 * time.Second
+
+const maxEndpointBackoff = 5 * time.Minute
+
+// minHealthyConnection is how long a connection has to last for its endpoint
+// to count as healthy again. One that drops sooner counts as a failure, so an
+// endpoint that accepts connections but cannot keep them is failed over too.
+const minHealthyConnection = time.Minute
+
+// DeviceEndpoints returns the endpoints the device connects to, in order of
+// preference: device_endpoint_url first, then device_endpoint_urls.
+func DeviceEndpoints(reswarmConfig *config.ReswarmConfig) []string {
+	var endpoints []string
+	seen := make(map[string]bool)
+
+	for _, endpoint := range append([]string{reswarmConfig.DeviceEndpointURL}, reswarmConfig.DeviceEndpointURLs...) {
+		if endpoint == "" || seen[endpoint] {
+			continue
+		}
+		seen[endpoint] = true
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints
+}
+
+type endpointHealth struct {
+	failures int
+	retryAt  time.Time
+}
+
+// endpointPool picks the device endpoint to dial. It prefers the endpoints in
+// configured order, skipping those still backing off from recent failures, so
+// the device fails over to the next endpoint and returns to the preferred one
+// on the next reconnect once it is healthy again.
+type endpointPool struct {
+	mu     sync.Mutex
+	health map[string]*endpointHealth
+	now    func() time.Time
+}
+
+func newEndpointPool() *endpointPool {
+	return &endpointPool{health: make(map[string]*endpointHealth), now: time.Now}
+}
+
+// next returns the endpoint to dial. With every endpoint backing off, it is
+// the one whose backoff ends first.
+func (p *endpointPool) next(endpoints []string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	best := ""
+	var bestRetryAt time.Time
+	for _, endpoint := range endpoints {
+		health := p.health[endpoint]
+		if health == nil || !health.retryAt.After(now) {
+			return endpoint
+		}
+		if best == "" || health.retryAt.Before(bestRetryAt) {
+			best, bestRetryAt = endpoint, health.retryAt
+		}
+	}
+
+	return best
+}
+
+func (p *endpointPool) failed(endpoint string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := p.health[endpoint]
+	if health == nil {
+		health = &endpointHealth{}
+		p.health[endpoint] = health
+	}
+
+	health.failures++
+	backoff := endpointBackoff
+	for i := 1; i < health.failures && backoff < maxEndpointBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxEndpointBackoff {
+		backoff = maxEndpointBackoff
+	}
+	health.retryAt = p.now().Add(backoff)
+}
+
+func (p *endpointPool) succeeded(endpoint string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.health, endpoint)
+}
+
+// disconnected records the end of a connection to endpoint that lasted for
+// lasted.
+func (p *endpointPool) disconnected(endpoint string, lasted time.Duration) {
+	if lasted < minHealthyConnection {
+		p.failed(endpoint)
+	}
+}
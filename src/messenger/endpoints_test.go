@@ -0,0 +1,87 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"reagent/config"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceEndpoints(t *testing.T) {
+	endpoints := DeviceEndpoints(&config.ReswarmConfig{
+		DeviceEndpointURL:  "wss://a.example.com/ws",
+		DeviceEndpointURLs: []string{"wss://b.example.com/ws", "", "wss://a.example.com/ws", "wss://c.example.com/ws"},
+	})
+	assert.Equal(t, []string{"wss://a.example.com/ws", "wss://b.example.com/ws", "wss://c.example.com/ws"}, endpoints)
+
+	assert.Equal(t, []string{"wss://a.example.com/ws"}, DeviceEndpoints(&config.ReswarmConfig{DeviceEndpointURL: "wss://a.example.com/ws"}))
+}
+
+func TestEndpointPoolFailsOverAndBack(t *testing.T) {
+	now := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+	pool := newEndpointPool()
+	pool.now = func() time.Time { return now }
+	endpoints := []string{"primary", "backup"}
+
+	assert.Equal(t, "primary", pool.next(endpoints))
+
+	pool.failed("primary")
+	assert.Equal(t, "backup", pool.next(endpoints), "a failed endpoint is passed over")
+
+	pool.failed("backup")
+	assert.Equal(t, "primary", pool.next(endpoints), "with all backing off, the one ready first")
+
+	now = now.Add(endpointBackoff)
+	assert.Equal(t, "primary", pool.next(endpoints), "the preferred endpoint is back after its backoff")
+
+	// consecutive failures back off exponentially, up to the cap
+	for i := 0; i < 20; i++ {
+		pool.failed("primary")
+	}
+	assert.Equal(t, now.Add(maxEndpointBackoff), pool.health["primary"].retryAt)
+
+	pool.succeeded("primary")
+	assert.Equal(t, "primary", pool.next(endpoints))
+
+	pool.disconnected("primary", 10*time.Second)
+	assert.Equal(t, "backup", pool.next(endpoints), "connections that drop right away count as failures")
+	pool.succeeded("primary")
+	pool.disconnected("primary", time.Hour)
+	assert.Equal(t, "primary", pool.next(endpoints))
+}
+
+func TestWampSession_EndpointFailover(t *testing.T) {
+	cfg := testConfig()
+	cfg.ReswarmConfig.DeviceEndpointURL = "wss://primary.example.com/ws"
+	cfg.ReswarmConfig.DeviceEndpointURLs = []string{"wss://backup.example.com/ws"}
+
+	var mu sync.Mutex
+	var dialed []string
+	mockClient := NewMockClient()
+	provider := func(ctx context.Context, url string, cfg client.Config) (NexusClient, error) {
+		mu.Lock()
+		dialed = append(dialed, url)
+		mu.Unlock()
+		if url == "wss://primary.example.com/ws" {
+			return nil, errors.New("primary unreachable")
+		}
+		return mockClient.ConnectNet(ctx, url, cfg)
+	}
+
+	session, err := NewWampSession(cfg, &SocketConfig{ConnectionTimeout: 100 * time.Millisecond}, nil, provider)
+	require.NoError(t, err)
+	defer session.Close()
+
+	assert.True(t, session.Connected())
+	assert.Equal(t, "wss://backup.example.com/ws", session.Endpoint())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"wss://primary.example.com/ws", "wss://backup.example.com/ws"}, dialed)
+}
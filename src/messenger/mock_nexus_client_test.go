@@ -255,6 +255,10 @@ type MockNexusClient struct {
 
 	// Custom call handler for complex test scenarios
 	onCall func(procedure string) (*wamp.Result, error)
+
+	// Registered handlers and the progressive results they sent
+	handlers map[string]client.InvocationHandler
+	progress []wamp.List
 }
 
 // =============================================================================
@@ -355,6 +359,22 @@ func (m *MockNexusClient) RegisterCount() int {
 	return m.registerCount
 }
 
+// Invoke runs the handler registered for procedure like the router would.
+func (m *MockNexusClient) Invoke(ctx context.Context, procedure string, invocation *wamp.Invocation) client.InvokeResult {
+	m.mu.Lock()
+	handler := m.handlers[procedure]
+	m.mu.Unlock()
+
+	return handler(ctx, invocation)
+}
+
+// Progress returns the arguments of the progressive results sent.
+func (m *MockNexusClient) Progress() []wamp.List {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]wamp.List(nil), m.progress...)
+}
+
 // SubscribeCount returns the number of Subscribe operations made.
 func (m *MockNexusClient) SubscribeCount() int {
 	m.mu.Lock()
@@ -449,7 +469,22 @@ func (m *MockNexusClient) Register(procedure string, fn client.InvocationHandler
 	defer m.mu.Unlock()
 
 	m.registerCount++
-	return m.registerError
+	if m.registerError != nil {
+		return m.registerError
+	}
+	if m.handlers == nil {
+		m.handlers = make(map[string]client.InvocationHandler)
+	}
+	m.handlers[procedure] = fn
+	return nil
+}
+
+func (m *MockNexusClient) SendProgress(ctx context.Context, args wamp.List, kwargs wamp.Dict) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.progress = append(m.progress, args)
+	return nil
 }
 
 func (m *MockNexusClient) RegistrationID(procedure string) (wamp.ID, bool) {
@@ -0,0 +1,396 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reagent/safe"
+	"sync"
+	"time"
+)
+
+// writeTimeout bounds a single packet write, so a stalled broker cannot block
+// a publisher forever.
+const writeTimeout = 10 * time.Second
+
+var ErrClosed = errors.New("MQTT connection closed")
+
+// ErrNoSubscribers is returned by Publish at QoS 1 when the broker reports
+// that nobody is subscribed to the topic. Not every broker reports it.
+var ErrNoSubscribers = errors.New("no MQTT subscribers")
+
+// Options configure a client connection.
+type Options struct {
+	ClientID string
+	Username string
+	Password []byte
+	// KeepAlive is the interval of the client's PINGREQs. The connection is
+	// considered dead when nothing arrives from the broker for one and a half
+	// intervals. Zero turns keep alive off.
+	KeepAlive time.Duration
+	// Will is published by the broker when the connection is lost without the
+	// client closing it.
+	Will *Publish
+	// Properties are sent with CONNECT.
+	Properties Properties
+	// OnPublish is called with every message the broker delivers, in order,
+	// on the goroutine reading the connection. It must not block.
+	OnPublish func(*Publish)
+}
+
+// ConnectError is returned by NewClient when the broker refuses the connection.
+type ConnectError struct {
+	ReasonCode byte
+	Reason     string
+}
+
+func (e *ConnectError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("MQTT broker refused the connection (reason 0x%02X): %s", e.ReasonCode, e.Reason)
+	}
+	return fmt.Sprintf("MQTT broker refused the connection (reason 0x%02X)", e.ReasonCode)
+}
+
+// AckError is returned when the broker acknowledges a packet with a failure.
+type AckError struct {
+	Packet     PacketType
+	ReasonCode byte
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("MQTT broker rejected packet type %d (reason 0x%02X)", e.Packet, e.ReasonCode)
+}
+
+// Client is one connection to an MQTT broker.
+type Client struct {
+	conn   net.Conn
+	opts   Options
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	nextID     uint16
+	pending    map[uint16]chan Packet
+	err        error
+	disconnect *Disconnect
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClient speaks CONNECT over conn, which the caller has dialled, and
+// returns the client once the broker accepted it. ctx bounds the handshake.
+// On error, closing conn is up to the caller.
+func NewClient(ctx context.Context, conn net.Conn, opts Options) (*Client, *Connack, error) {
+	c := &Client{
+		conn:    conn,
+		opts:    opts,
+		reader:  bufio.NewReader(conn),
+		pending: make(map[uint16]chan Packet),
+		done:    make(chan struct{}),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	connect := &Connect{
+		ClientID:   opts.ClientID,
+		CleanStart: true,
+		KeepAlive:  uint16(opts.KeepAlive / time.Second),
+		Username:   opts.Username,
+		Password:   opts.Password,
+		Properties: opts.Properties,
+		Will:       opts.Will,
+	}
+	if err := WritePacket(conn, connect); err != nil {
+		return nil, nil, err
+	}
+
+	packet, err := ReadPacket(c.reader)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+	connack, ok := packet.(*Connack)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: expected CONNACK, got packet type %d", ErrMalformedPacket, packet.Type())
+	}
+	if connack.ReasonCode >= UnspecifiedError {
+		return nil, connack, &ConnectError{ReasonCode: connack.ReasonCode, Reason: connack.Properties.ReasonString}
+	}
+
+	if !stop() {
+		return nil, nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// the broker may override the keep alive
+	if connack.Properties.ServerKeepAlive != 0 {
+		c.opts.KeepAlive = time.Duration(connack.Properties.ServerKeepAlive) * time.Second
+	}
+
+	safe.Go(c.readLoop)
+	if c.opts.KeepAlive > 0 {
+		safe.Go(c.pingLoop)
+	}
+
+	return c, connack, nil
+}
+
+// Done is closed when the connection ended.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, or nil while it is up.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// ServerDisconnect returns the DISCONNECT the broker ended the connection
+// with, if it sent one.
+func (c *Client) ServerDisconnect() *Disconnect {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.disconnect
+}
+
+// Connected reports whether the connection is up.
+func (c *Client) Connected() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Close ends the connection with a normal DISCONNECT, so the broker discards
+// the will.
+func (c *Client) Close() error {
+	if c.Connected() {
+		_ = c.write(&Disconnect{ReasonCode: Success})
+	}
+	c.shutdown(ErrClosed)
+	return nil
+}
+
+// Drop ends the connection without a DISCONNECT, so the broker publishes the
+// will.
+func (c *Client) Drop() {
+	c.shutdown(ErrClosed)
+}
+
+// Publish sends p. With QoS 1 it waits until the broker acknowledged it.
+func (c *Client) Publish(ctx context.Context, p *Publish) error {
+	if p.QoS == 0 {
+		return c.write(p)
+	}
+
+	packet, err := c.request(ctx, func(id uint16) Packet {
+		p.PacketID = id
+		return p
+	})
+	if err != nil {
+		return err
+	}
+
+	if ack, ok := packet.(*Puback); ok {
+		switch {
+		case ack.ReasonCode == NoMatchingSubscribers:
+			return ErrNoSubscribers
+		case ack.ReasonCode >= UnspecifiedError:
+			return &AckError{Packet: PUBLISH, ReasonCode: ack.ReasonCode}
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the filters and waits for the broker to grant them.
+func (c *Client) Subscribe(ctx context.Context, subscriptions ...Subscription) error {
+	packet, err := c.request(ctx, func(id uint16) Packet {
+		return &Subscribe{PacketID: id, Subscriptions: subscriptions}
+	})
+	if err != nil {
+		return err
+	}
+
+	if ack, ok := packet.(*Suback); ok {
+		for _, reasonCode := range ack.ReasonCodes {
+			if reasonCode >= UnspecifiedError {
+				return &AckError{Packet: SUBSCRIBE, ReasonCode: reasonCode}
+			}
+		}
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscriptions to the filters.
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	packet, err := c.request(ctx, func(id uint16) Packet {
+		return &Unsubscribe{PacketID: id, Filters: filters}
+	})
+	if err != nil {
+		return err
+	}
+
+	if ack, ok := packet.(*Unsuback); ok {
+		for _, reasonCode := range ack.ReasonCodes {
+			if reasonCode >= UnspecifiedError {
+				return &AckError{Packet: UNSUBSCRIBE, ReasonCode: reasonCode}
+			}
+		}
+	}
+	return nil
+}
+
+// request sends the packet build returns for a fresh packet identifier and
+// waits for the broker's acknowledgement of it.
+func (c *Client) request(ctx context.Context, build func(id uint16) Packet) (Packet, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.allocateID()
+	ack := make(chan Packet, 1)
+	c.pending[id] = ack
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(build(id)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case packet := <-ack:
+		return packet, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// allocateID returns an unused packet identifier; c.mu must be held.
+func (c *Client) allocateID() uint16 {
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			continue
+		}
+		if _, taken := c.pending[c.nextID]; !taken {
+			return c.nextID
+		}
+	}
+}
+
+func (c *Client) write(packet Packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if !c.Connected() {
+		return c.Err()
+	}
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := WritePacket(c.conn, packet); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) readLoop() {
+	for {
+		if c.opts.KeepAlive > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive * 3 / 2))
+		}
+
+		packet, err := ReadPacket(c.reader)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		switch p := packet.(type) {
+		case *Publish:
+			if p.QoS > 0 {
+				if err := c.write(&Puback{PacketID: p.PacketID}); err != nil {
+					return
+				}
+			}
+			if c.opts.OnPublish != nil {
+				c.opts.OnPublish(p)
+			}
+		case *Puback:
+			c.acknowledge(p.PacketID, p)
+		case *Suback:
+			c.acknowledge(p.PacketID, p)
+		case *Unsuback:
+			c.acknowledge(p.PacketID, p)
+		case *Pingresp:
+		case *Disconnect:
+			c.mu.Lock()
+			c.disconnect = p
+			c.mu.Unlock()
+			c.shutdown(fmt.Errorf("MQTT broker closed the connection (reason 0x%02X)", p.ReasonCode))
+			return
+		default:
+			c.shutdown(fmt.Errorf("%w: unexpected packet type %d from the broker", ErrMalformedPacket, packet.Type()))
+			return
+		}
+	}
+}
+
+func (c *Client) acknowledge(id uint16, packet Packet) {
+	c.mu.Lock()
+	ack, ok := c.pending[id]
+	c.mu.Unlock()
+
+	if ok {
+		ack <- packet
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(&Pingreq{}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
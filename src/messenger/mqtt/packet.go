@@ -0,0 +1,696 @@
+// Package mqtt is a small MQTT 5 client, just what the agent's MQTT transport
+// (messenger.MqttSession) needs: QoS 0 and 1, the last will, and the request/
+// response properties (response topic and correlation data). QoS 2, topic
+// aliases, shared subscriptions and enhanced authentication are not
+// implemented. The packet codec is exported, so tests can run a broker on it
+// (see testutil/fakes.MQTTBroker).
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the protocol level of MQTT 5 in CONNECT.
+const ProtocolVersion = 5
+
+// MaxPacketSize bounds the packets ReadPacket accepts.
+const MaxPacketSize = 16 * 1024 * 1024
+
+type PacketType byte
+
+const (
+	CONNECT     PacketType = 1
+	CONNACK     PacketType = 2
+	PUBLISH     PacketType = 3
+	PUBACK      PacketType = 4
+	SUBSCRIBE   PacketType = 8
+	SUBACK      PacketType = 9
+	UNSUBSCRIBE PacketType = 10
+	UNSUBACK    PacketType = 11
+	PINGREQ     PacketType = 12
+	PINGRESP    PacketType = 13
+	DISCONNECT  PacketType = 14
+)
+
+// Reason codes used by the agent.
+const (
+	Success                   byte = 0x00
+	GrantedQoS1               byte = 0x01
+	DisconnectWithWillMessage byte = 0x04
+	NoMatchingSubscribers     byte = 0x10
+	UnspecifiedError          byte = 0x80
+	BadUsernameOrPassword     byte = 0x86
+	NotAuthorized             byte = 0x87
+	SessionTakenOver          byte = 0x8E
+)
+
+var ErrMalformedPacket = errors.New("malformed MQTT packet")
+
+// Packet is one of the packet types below.
+type Packet interface {
+	Type() PacketType
+}
+
+type UserProperty struct {
+	Key, Value string
+}
+
+// Properties are the MQTT 5 properties the agent uses. Zero values are not
+// sent; properties of other kinds are skipped when reading.
+type Properties struct {
+	MessageExpiry    uint32
+	ContentType      string
+	ResponseTopic    string
+	CorrelationData  []byte
+	SessionExpiry    uint32
+	AssignedClientID string
+	ServerKeepAlive  uint16
+	ReasonString     string
+	ReceiveMaximum   uint16
+	WillDelay        uint32
+	User             []UserProperty
+}
+
+// UserValue returns the first user property named key.
+func (p Properties) UserValue(key string) (string, bool) {
+	for _, property := range p.User {
+		if property.Key == key {
+			return property.Value, true
+		}
+	}
+	return "", false
+}
+
+type Connect struct {
+	ClientID   string
+	CleanStart bool
+	KeepAlive  uint16 // seconds
+	Username   string
+	Password   []byte
+	Properties Properties
+	// Will is published by the broker when the connection ends without a
+	// normal DISCONNECT.
+	Will *Publish
+}
+
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     Properties
+}
+
+type Publish struct {
+	Topic      string
+	QoS        byte
+	Retain     bool
+	Dup        bool
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+type Puback struct {
+	PacketID   uint16
+	ReasonCode byte
+}
+
+type Subscription struct {
+	Filter  string
+	QoS     byte
+	NoLocal bool
+}
+
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+}
+
+type Suback struct {
+	PacketID    uint16
+	ReasonCodes []byte
+}
+
+type Unsubscribe struct {
+	PacketID uint16
+	Filters  []string
+}
+
+type Unsuback struct {
+	PacketID    uint16
+	ReasonCodes []byte
+}
+
+type Pingreq struct{}
+
+type Pingresp struct{}
+
+type Disconnect struct {
+	ReasonCode byte
+	Properties Properties
+}
+
+func (*Connect) Type() PacketType     { return CONNECT }
+func (*Connack) Type() PacketType     { return CONNACK }
+func (*Publish) Type() PacketType     { return PUBLISH }
+func (*Puback) Type() PacketType      { return PUBACK }
+func (*Subscribe) Type() PacketType   { return SUBSCRIBE }
+func (*Suback) Type() PacketType      { return SUBACK }
+func (*Unsubscribe) Type() PacketType { return UNSUBSCRIBE }
+func (*Unsuback) Type() PacketType    { return UNSUBACK }
+func (*Pingreq) Type() PacketType     { return PINGREQ }
+func (*Pingresp) Type() PacketType    { return PINGRESP }
+func (*Disconnect) Type() PacketType  { return DISCONNECT }
+
+// WritePacket encodes packet onto w in a single Write.
+func WritePacket(w io.Writer, packet Packet) error {
+	var body encoder
+	var flags byte
+
+	switch p := packet.(type) {
+	case *Connect:
+		body.string("MQTT")
+		body.byte(ProtocolVersion)
+		var connectFlags byte
+		if p.Username != "" {
+			connectFlags |= 0x80
+		}
+		if p.Password != nil {
+			connectFlags |= 0x40
+		}
+		if p.Will != nil {
+			connectFlags |= 0x04 | p.Will.QoS<<3
+			if p.Will.Retain {
+				connectFlags |= 0x20
+			}
+		}
+		if p.CleanStart {
+			connectFlags |= 0x02
+		}
+		body.byte(connectFlags)
+		body.uint16(p.KeepAlive)
+		body.properties(p.Properties)
+		body.string(p.ClientID)
+		if p.Will != nil {
+			body.properties(p.Will.Properties)
+			body.string(p.Will.Topic)
+			body.binary(p.Will.Payload)
+		}
+		if p.Username != "" {
+			body.string(p.Username)
+		}
+		if p.Password != nil {
+			body.binary(p.Password)
+		}
+	case *Connack:
+		var ackFlags byte
+		if p.SessionPresent {
+			ackFlags = 1
+		}
+		body.byte(ackFlags)
+		body.byte(p.ReasonCode)
+		body.properties(p.Properties)
+	case *Publish:
+		flags = p.QoS << 1
+		if p.Dup {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+		body.string(p.Topic)
+		if p.QoS > 0 {
+			body.uint16(p.PacketID)
+		}
+		body.properties(p.Properties)
+		body.buf = append(body.buf, p.Payload...)
+	case *Puback:
+		body.uint16(p.PacketID)
+		if p.ReasonCode != Success {
+			body.byte(p.ReasonCode)
+		}
+	case *Subscribe:
+		flags = 0x02
+		body.uint16(p.PacketID)
+		body.properties(Properties{})
+		for _, subscription := range p.Subscriptions {
+			body.string(subscription.Filter)
+			options := subscription.QoS
+			if subscription.NoLocal {
+				options |= 0x04
+			}
+			body.byte(options)
+		}
+	case *Suback:
+		body.uint16(p.PacketID)
+		body.properties(Properties{})
+		body.buf = append(body.buf, p.ReasonCodes...)
+	case *Unsubscribe:
+		flags = 0x02
+		body.uint16(p.PacketID)
+		body.properties(Properties{})
+		for _, filter := range p.Filters {
+			body.string(filter)
+		}
+	case *Unsuback:
+		body.uint16(p.PacketID)
+		body.properties(Properties{})
+		body.buf = append(body.buf, p.ReasonCodes...)
+	case *Pingreq, *Pingresp:
+	case *Disconnect:
+		body.byte(p.ReasonCode)
+		body.properties(p.Properties)
+	default:
+		return fmt.Errorf("cannot encode MQTT packet %T", packet)
+	}
+
+	if len(body.buf) > MaxPacketSize {
+		return fmt.Errorf("MQTT packet of %d bytes exceeds the maximum of %d", len(body.buf), MaxPacketSize)
+	}
+
+	var packetBytes encoder
+	packetBytes.byte(byte(packet.Type())<<4 | flags)
+	packetBytes.varint(uint32(len(body.buf)))
+	packetBytes.buf = append(packetBytes.buf, body.buf...)
+
+	_, err := w.Write(packetBytes.buf)
+	return err
+}
+
+// ReadPacket reads the next packet from r.
+func ReadPacket(r *bufio.Reader) (Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxPacketSize {
+		return nil, fmt.Errorf("MQTT packet of %d bytes exceeds the maximum of %d", length, MaxPacketSize)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	body := &decoder{buf: buf}
+	flags := header & 0x0F
+
+	var packet Packet
+	switch PacketType(header >> 4) {
+	case CONNECT:
+		packet = decodeConnect(body)
+	case CONNACK:
+		p := &Connack{}
+		p.SessionPresent = body.byte()&0x01 != 0
+		p.ReasonCode = body.byte()
+		p.Properties = body.properties()
+		packet = p
+	case PUBLISH:
+		p := &Publish{QoS: flags >> 1 & 0x03, Dup: flags&0x08 != 0, Retain: flags&0x01 != 0}
+		p.Topic = body.string()
+		if p.QoS > 0 {
+			p.PacketID = body.uint16()
+		}
+		p.Properties = body.properties()
+		p.Payload = body.rest()
+		packet = p
+	case PUBACK:
+		p := &Puback{PacketID: body.uint16()}
+		if body.remaining() > 0 {
+			p.ReasonCode = body.byte()
+		}
+		packet = p
+	case SUBSCRIBE:
+		p := &Subscribe{PacketID: body.uint16()}
+		body.properties()
+		for body.err == nil && body.remaining() > 0 {
+			filter := body.string()
+			options := body.byte()
+			p.Subscriptions = append(p.Subscriptions, Subscription{Filter: filter, QoS: options & 0x03, NoLocal: options&0x04 != 0})
+		}
+		packet = p
+	case SUBACK:
+		p := &Suback{PacketID: body.uint16()}
+		body.properties()
+		p.ReasonCodes = body.rest()
+		packet = p
+	case UNSUBSCRIBE:
+		p := &Unsubscribe{PacketID: body.uint16()}
+		body.properties()
+		for body.err == nil && body.remaining() > 0 {
+			p.Filters = append(p.Filters, body.string())
+		}
+		packet = p
+	case UNSUBACK:
+		p := &Unsuback{PacketID: body.uint16()}
+		body.properties()
+		p.ReasonCodes = body.rest()
+		packet = p
+	case PINGREQ:
+		packet = &Pingreq{}
+	case PINGRESP:
+		packet = &Pingresp{}
+	case DISCONNECT:
+		p := &Disconnect{}
+		if body.remaining() > 0 {
+			p.ReasonCode = body.byte()
+		}
+		if body.remaining() > 0 {
+			p.Properties = body.properties()
+		}
+		packet = p
+	default:
+		return nil, fmt.Errorf("%w: unsupported packet type %d", ErrMalformedPacket, header>>4)
+	}
+
+	if body.err != nil {
+		return nil, body.err
+	}
+	return packet, nil
+}
+
+func decodeConnect(body *decoder) *Connect {
+	p := &Connect{}
+	if body.string() != "MQTT" || body.byte() != ProtocolVersion {
+		body.fail()
+		return p
+	}
+
+	connectFlags := body.byte()
+	p.CleanStart = connectFlags&0x02 != 0
+	p.KeepAlive = body.uint16()
+	p.Properties = body.properties()
+	p.ClientID = body.string()
+
+	if connectFlags&0x04 != 0 {
+		p.Will = &Publish{QoS: connectFlags >> 3 & 0x03, Retain: connectFlags&0x20 != 0}
+		p.Will.Properties = body.properties()
+		p.Will.Topic = body.string()
+		p.Will.Payload = body.binary()
+	}
+	if connectFlags&0x80 != 0 {
+		p.Username = body.string()
+	}
+	if connectFlags&0x40 != 0 {
+		p.Password = body.binary()
+	}
+	return p
+}
+
+// Property identifiers.
+const (
+	propPayloadFormat          = 0x01
+	propMessageExpiry          = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0B
+	propSessionExpiry          = 0x11
+	propAssignedClientID       = 0x12
+	propServerKeepAlive        = 0x13
+	propAuthenticationMethod   = 0x15
+	propAuthenticationData     = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelay              = 0x18
+	propRequestResponseInfo    = 0x19
+	propResponseInformation    = 0x1A
+	propServerReference        = 0x1C
+	propReasonString           = 0x1F
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propMaximumQoS             = 0x24
+	propRetainAvailable        = 0x25
+	propUser                   = 0x26
+	propMaximumPacketSize      = 0x27
+	propWildcardAvailable      = 0x28
+	propSubscriptionIDs        = 0x29
+	propSharedAvailable        = 0x2A
+)
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) byte(b byte) { e.buf = append(e.buf, b) }
+
+func (e *encoder) uint16(v uint16) { e.buf = binary.BigEndian.AppendUint16(e.buf, v) }
+
+func (e *encoder) uint32(v uint32) { e.buf = binary.BigEndian.AppendUint32(e.buf, v) }
+
+func (e *encoder) string(s string) { e.binary([]byte(s)) }
+
+func (e *encoder) binary(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) varint(v uint32) {
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		e.buf = append(e.buf, digit)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (e *encoder) properties(p Properties) {
+	var props encoder
+	if p.MessageExpiry != 0 {
+		props.byte(propMessageExpiry)
+		props.uint32(p.MessageExpiry)
+	}
+	if p.ContentType != "" {
+		props.byte(propContentType)
+		props.string(p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		props.byte(propResponseTopic)
+		props.string(p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		props.byte(propCorrelationData)
+		props.binary(p.CorrelationData)
+	}
+	if p.SessionExpiry != 0 {
+		props.byte(propSessionExpiry)
+		props.uint32(p.SessionExpiry)
+	}
+	if p.AssignedClientID != "" {
+		props.byte(propAssignedClientID)
+		props.string(p.AssignedClientID)
+	}
+	if p.ServerKeepAlive != 0 {
+		props.byte(propServerKeepAlive)
+		props.uint16(p.ServerKeepAlive)
+	}
+	if p.ReasonString != "" {
+		props.byte(propReasonString)
+		props.string(p.ReasonString)
+	}
+	if p.ReceiveMaximum != 0 {
+		props.byte(propReceiveMaximum)
+		props.uint16(p.ReceiveMaximum)
+	}
+	if p.WillDelay != 0 {
+		props.byte(propWillDelay)
+		props.uint32(p.WillDelay)
+	}
+	for _, user := range p.User {
+		props.byte(propUser)
+		props.string(user.Key)
+		props.string(user.Value)
+	}
+
+	e.varint(uint32(len(props.buf)))
+	e.buf = append(e.buf, props.buf...)
+}
+
+// decoder reads from a packet body. The first error sticks; later reads
+// return zero values.
+type decoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformedPacket
+	}
+}
+
+func (d *decoder) remaining() int { return len(d.buf) - d.pos }
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || d.remaining() < n {
+		d.fail()
+		return nil
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) binary() []byte {
+	b := d.take(int(d.uint16()))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) string() string { return string(d.binary()) }
+
+func (d *decoder) rest() []byte { return append([]byte{}, d.take(d.remaining())...) }
+
+func (d *decoder) varint() uint32 {
+	var value uint32
+	for i := 0; i < 4; i++ {
+		digit := d.byte()
+		value |= uint32(digit&0x7F) << (7 * i)
+		if digit&0x80 == 0 {
+			return value
+		}
+	}
+	d.fail()
+	return 0
+}
+
+func (d *decoder) properties() Properties {
+	var p Properties
+	length := int(d.varint())
+	props := &decoder{buf: d.take(length)}
+	if d.err != nil {
+		return p
+	}
+
+	for props.err == nil && props.remaining() > 0 {
+		switch id := props.varint(); id {
+		case propMessageExpiry:
+			p.MessageExpiry = props.uint32()
+		case propContentType:
+			p.ContentType = props.string()
+		case propResponseTopic:
+			p.ResponseTopic = props.string()
+		case propCorrelationData:
+			p.CorrelationData = props.binary()
+		case propSessionExpiry:
+			p.SessionExpiry = props.uint32()
+		case propAssignedClientID:
+			p.AssignedClientID = props.string()
+		case propServerKeepAlive:
+			p.ServerKeepAlive = props.uint16()
+		case propReasonString:
+			p.ReasonString = props.string()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = props.uint16()
+		case propWillDelay:
+			p.WillDelay = props.uint32()
+		case propUser:
+			key := props.string()
+			p.User = append(p.User, UserProperty{Key: key, Value: props.string()})
+		// skipped
+		case propPayloadFormat, propRequestProblemInfo, propRequestResponseInfo, propMaximumQoS,
+			propRetainAvailable, propWildcardAvailable, propSubscriptionIDs, propSharedAvailable:
+			props.byte()
+		case propTopicAliasMaximum, propTopicAlias:
+			props.uint16()
+		case propMaximumPacketSize:
+			props.uint32()
+		case propSubscriptionIdentifier:
+			props.varint()
+		case propAuthenticationMethod, propResponseInformation, propServerReference:
+			props.string()
+		case propAuthenticationData:
+			props.binary()
+		default:
+			props.fail()
+		}
+	}
+
+	if props.err != nil {
+		d.fail()
+	}
+	return p
+}
+
+func readVarint(r io.ByteReader) (uint32, error) {
+	var value uint32
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(digit&0x7F) << (7 * i)
+		if digit&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: remaining length exceeds four bytes", ErrMalformedPacket)
+}
+
+// MatchTopic reports whether topic matches the subscription filter, which may
+// contain the + (one level) and # (all remaining levels) wildcards.
+func MatchTopic(filter string, topic string) bool {
+	for {
+		filterLevel, filterRest, filterMore := cut(filter)
+		topicLevel, topicRest, topicMore := cut(topic)
+
+		switch {
+		case filterLevel == "#":
+			return true
+		case filterLevel != "+" && filterLevel != topicLevel:
+			return false
+		case !filterMore || !topicMore:
+			// "a/#" also matches "a"
+			return filterMore == topicMore || (!topicMore && filterRest == "#")
+		}
+		filter, topic = filterRest, topicRest
+	}
+}
+
+func cut(s string) (level string, rest string, more bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '/' {
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
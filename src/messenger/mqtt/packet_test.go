@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []Packet{
+		&Connect{
+			ClientID:   "serial-1",
+			CleanStart: true,
+			KeepAlive:  30,
+			Username:   "1-2",
+			Password:   []byte("secret"),
+			Properties: Properties{User: []UserProperty{{Key: "session_id", Value: "42"}}},
+			Will: &Publish{
+				Topic:      "event/testament",
+				QoS:        1,
+				Properties: Properties{ContentType: "application/json"},
+				Payload:    []byte(`{"args":[1]}`),
+			},
+		},
+		&Connect{ClientID: "anonymous"},
+		&Connack{SessionPresent: true, ReasonCode: BadUsernameOrPassword, Properties: Properties{ReasonString: "no", ServerKeepAlive: 10}},
+		&Publish{
+			Topic:    "rpc/reswarm.devices.update_device_status",
+			QoS:      1,
+			Retain:   true,
+			PacketID: 7,
+			Properties: Properties{
+				ResponseTopic:   "reply/serial-1",
+				CorrelationData: []byte{0, 1, 2},
+				MessageExpiry:   60,
+				User:            []UserProperty{{Key: "caller_authid", Value: "system"}, {Key: "caller_authid", Value: "again"}},
+			},
+			Payload: []byte("payload"),
+		},
+		&Publish{Topic: "event/x", Payload: []byte{}},
+		&Puback{PacketID: 7},
+		&Puback{PacketID: 8, ReasonCode: NoMatchingSubscribers},
+		&Subscribe{PacketID: 9, Subscriptions: []Subscription{{Filter: "rpc/a", QoS: 1}, {Filter: "event/#", NoLocal: true}}},
+		&Suback{PacketID: 9, ReasonCodes: []byte{GrantedQoS1, Success}},
+		&Unsubscribe{PacketID: 10, Filters: []string{"rpc/a", "event/#"}},
+		&Unsuback{PacketID: 10, ReasonCodes: []byte{Success, Success}},
+		&Pingreq{},
+		&Pingresp{},
+		&Disconnect{ReasonCode: SessionTakenOver, Properties: Properties{ReasonString: "taken over"}},
+	}
+
+	for _, packet := range packets {
+		var buf bytes.Buffer
+		require.NoError(t, WritePacket(&buf, packet))
+
+		decoded, err := ReadPacket(bufio.NewReader(&buf))
+		require.NoError(t, err)
+		assert.Equal(t, packet, decoded)
+	}
+}
+
+func TestReadPacketSkipsUnknownProperties(t *testing.T) {
+	// CONNACK with Maximum QoS (byte), Topic Alias Maximum (uint16) and
+	// Maximum Packet Size (uint32) before a reason string
+	body := []byte{0x00, 0x00, 0x0F,
+		0x24, 0x01,
+		0x22, 0x00, 0x0A,
+		0x27, 0x00, 0x01, 0x00, 0x00,
+		0x1F, 0x00, 0x02, 'o', 'k',
+	}
+	raw := append([]byte{byte(CONNACK) << 4, byte(len(body))}, body...)
+
+	packet, err := ReadPacket(bufio.NewReader(bytes.NewReader(raw)))
+	require.NoError(t, err)
+	assert.Equal(t, &Connack{Properties: Properties{ReasonString: "ok"}}, packet)
+}
+
+func TestReadPacketRejectsMalformedPackets(t *testing.T) {
+	for name, raw := range map[string][]byte{
+		"truncated string":       {byte(PUBLISH) << 4, 0x03, 0x00, 0x05, 'a'},
+		"unknown property":       {byte(CONNACK) << 4, 0x04, 0x00, 0x00, 0x01, 0x7F},
+		"wrong protocol":         {byte(CONNECT) << 4, 0x07, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04},
+		"unsupported packet":     {byte(15) << 4, 0x00},
+		"overlong length prefix": {byte(PINGREQ) << 4, 0xFF, 0xFF, 0xFF, 0xFF},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadPacket(bufio.NewReader(bytes.NewReader(raw)))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"rpc/reswarm.devices.x", "rpc/reswarm.devices.x", true},
+		{"rpc/reswarm.devices.x", "rpc/reswarm.devices.y", false},
+		{"rpc/+", "rpc/a", true},
+		{"rpc/+", "rpc/a/b", false},
+		{"event/#", "event/a/b", true},
+		{"event/#", "event", true},
+		{"#", "anything/at/all", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/b", "a", false},
+		{"a", "a/b", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, MatchTopic(tt.filter, tt.topic), "%s ~ %s", tt.filter, tt.topic)
+	}
+}
@@ -0,0 +1,924 @@
+package messenger
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"reagent/common"
+	"reagent/config"
+	"reagent/container"
+	"reagent/messenger/mqtt"
+	"reagent/messenger/topics"
+	"reagent/safe"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MQTT topic layout of the mqtt transport. WAMP URIs are used verbatim below
+// the prefixes; their dots are no level separators to MQTT.
+//
+//	rpc/<procedure>    calls of <procedure>, the registrant subscribes
+//	reply/<client id>  results of the calls of a client
+//	event/<topic>      publications to <topic>
+const (
+	mqttCallPrefix  = "rpc/"
+	mqttReplyPrefix = "reply/"
+	mqttEventPrefix = "event/"
+)
+
+// User properties of the mqtt transport. Calls carry the caller's details
+// (caller_authid, ...) as user properties, which become the invocation's
+// Details.
+const (
+	// mqttErrorProperty marks a result as error, holding its URI.
+	mqttErrorProperty = "error"
+	// mqttProgressProperty marks a result as progressive when "true".
+	mqttProgressProperty = "progress"
+	// mqttReceiveProgressProperty asks for progressive results when "true".
+	mqttReceiveProgressProperty = "receive_progress"
+	// mqttSessionProperty carries the session ID with CONNECT.
+	mqttSessionProperty = "session_id"
+)
+
+const mqttContentType = "application/json"
+
+// DefaultMQTTKeepAlive is the keep alive of the MQTT connection used when
+// SocketConfig.PingPongTimeout is zero.
+const DefaultMQTTKeepAlive = 30 * time.Second
+
+// mqttRequestTimeout bounds subscribing and the results of calls made without
+// deadline when SocketConfig.ResponseTimeout is zero.
+const mqttRequestTimeout = 30 * time.Second
+
+// mqttPayload is the JSON payload of calls, results and publications.
+type mqttPayload struct {
+	Args   []interface{} `json:"args,omitempty"`
+	Kwargs common.Dict   `json:"kwargs,omitempty"`
+}
+
+// CallError is the error a procedure called over MQTT failed with.
+type CallError struct {
+	URI         string
+	Arguments   []interface{}
+	ArgumentsKw common.Dict
+}
+
+func (e *CallError) Error() string {
+	if len(e.Arguments) == 0 {
+		return e.URI
+	}
+	if details, ok := e.Arguments[0].(map[string]interface{}); ok && details["error"] != nil {
+		return fmt.Sprintf("%s: %v", e.URI, details["error"])
+	}
+	return fmt.Sprintf("%s: %v", e.URI, e.Arguments)
+}
+
+type mqttRegistration struct {
+	id      uint64
+	handler func(ctx context.Context, invocation Result) (*InvokeResult, error)
+}
+
+type mqttSubscription struct {
+	id      uint64
+	handler func(Result) error
+}
+
+// mqttCall is a call waiting for its results.
+type mqttCall struct {
+	results chan *mqtt.Publish
+	done    chan struct{}
+}
+
+// MqttSession is the Messenger of the mqtt transport: MQTT 5 to the broker
+// at mqtt_broker_url. Registrations and calls map onto request/response
+// topics with correlation data, publications onto topics and the testament
+// onto the last will (see the topic layout above). Like WampSession it
+// reconnects until closed, and the agent registers again in OnConnect.
+type MqttSession struct {
+	agentConfig     *config.Config
+	socketConfig    *SocketConfig
+	container       container.Container
+	tunnelCapableFn func() bool
+	secretRotation  pendingSecretRotation
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	client        *mqtt.Client
+	sessionID     uint64
+	onConnect     func(reconnect bool)
+	reconnecting  bool
+	takeovers     int
+	nextID        uint64
+	registrations map[topics.Topic]*mqttRegistration
+	subscriptions map[topics.Topic]*mqttSubscription
+	calls         map[string]*mqttCall
+}
+
+// NewMqttSession creates a new MqttSession and establishes the initial
+// connection to the broker.
+func NewMqttSession(cfg *config.Config, socketConfig *SocketConfig, container container.Container) (*MqttSession, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	session := &MqttSession{
+		agentConfig:   cfg,
+		socketConfig:  socketConfig,
+		container:     container,
+		ctx:           ctx,
+		cancel:        cancel,
+		registrations: make(map[topics.Topic]*mqttRegistration),
+		subscriptions: make(map[topics.Topic]*mqttSubscription),
+		calls:         make(map[string]*mqttCall),
+	}
+
+	if err := session.connect(false); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// SetTunnelCapableFunc wires the per-device tunnel-capability getter into the
+// heartbeat payload.
+func (s *MqttSession) SetTunnelCapableFunc(fn func() bool) {
+	s.tunnelCapableFn = fn
+}
+
+func (s *MqttSession) SetOnConnect(cb func(reconnect bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onConnect = cb
+}
+
+// connect dials the broker until it succeeds or the session is closed, then
+// sets up the connection. Registrations and subscriptions of the previous
+// connection are gone with it, as with WAMP.
+func (s *MqttSession) connect(isReconnect bool) error {
+	c, sessionID, err := s.dial()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.client = c
+	s.sessionID = sessionID
+	s.registrations = make(map[topics.Topic]*mqttRegistration)
+	s.subscriptions = make(map[topics.Topic]*mqttSubscription)
+	cb := s.onConnect
+	s.mu.Unlock()
+
+	s.secretRotation.finish()
+
+	if err := s.setupConnection(c); err != nil && s.ctx.Err() == nil {
+		log.Error().Err(err).Msg("Failed to set up the MQTT connection, reconnecting")
+		c.Drop()
+	}
+
+	safe.Go(func() { s.watchDisconnect(c) })
+	safe.Go(func() { s.heartbeat(c) })
+
+	if isReconnect && cb != nil {
+		safe.Go(func() {
+			log.Info().Msg("Re-initializing after reconnection...")
+			cb(true)
+			log.Info().Msg("Successfully re-initialized after reconnection")
+		})
+	}
+
+	return nil
+}
+
+// setupConnection subscribes to the results of the session's calls and sets
+// up what WampSession.dial does for WAMP.
+func (s *MqttSession) setupConnection(c *mqtt.Client) error {
+	ctx, cancel := context.WithTimeout(s.ctx, mqttRequestTimeout)
+	defer cancel()
+
+	if err := c.Subscribe(ctx, mqtt.Subscription{Filter: s.replyTopic(), QoS: 1}); err != nil {
+		return err
+	}
+
+	connectionEstablished := common.BuildExternalApiTopic(s.agentConfig.ReswarmConfig.SerialNumber, "wamp_connection_established")
+	err := s.Register(topics.Topic(connectionEstablished), func(ctx context.Context, invocation Result) (*InvokeResult, error) {
+		return &InvokeResult{Arguments: []interface{}{"Hello :-)"}}, nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.Subscribe(topics.Topic(fmt.Sprintf("%s/ondestroy", topics.ReswarmDeviceList)), func(Result) error {
+		if s.container != nil {
+			s.container.PruneSystem(context.Background())
+		}
+		os.Exit(1)
+		return nil
+	}, nil)
+}
+
+// dial connects to the broker, retrying until it succeeds or the session is
+// closed.
+func (s *MqttSession) dial() (*mqtt.Client, uint64, error) {
+	if s.agentConfig.CommandLineArguments.Offline {
+		log.Warn().Msg("Started in offline mode, will not establish a socket connection!")
+		<-s.ctx.Done()
+		return nil, 0, s.ctx.Err()
+	}
+
+	log.Debug().Msg("Attempting to establish an MQTT connection...")
+
+	for attempt := 1; ; attempt++ {
+		if s.ctx.Err() != nil {
+			return nil, 0, s.ctx.Err()
+		}
+
+		brokerURL := s.agentConfig.ReswarmConfig.MQTTBrokerURL
+		requestStart := time.Now()
+
+		c, sessionID, err := s.dialOnce(brokerURL)
+		if err == nil {
+			log.Debug().Msgf("Successfully established an MQTT connection to %s (duration: %s)", brokerURL, time.Since(requestStart))
+			return c, sessionID, nil
+		}
+
+		var connectErr *mqtt.ConnectError
+		if errors.As(err, &connectErr) && (connectErr.ReasonCode == mqtt.BadUsernameOrPassword || connectErr.ReasonCode == mqtt.NotAuthorized) {
+			if s.secretRotation.revert() {
+				continue
+			}
+			log.Error().Msg("The IronFlock device connect authentication failed")
+			os.Exit(1)
+		}
+
+		log.Debug().Err(err).Msgf("Failed to establish an MQTT connection to %s (duration: %s, attempt #%d), reattempting in %s", brokerURL, time.Since(requestStart), attempt, reconnectBackoff)
+		if !sleepOrDone(s.ctx, reconnectBackoff) {
+			return nil, 0, s.ctx.Err()
+		}
+	}
+}
+
+func (s *MqttSession) dialOnce(brokerURL string) (*mqtt.Client, uint64, error) {
+	ctx := s.ctx
+	if s.socketConfig.ConnectionTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.socketConfig.ConnectionTimeout)
+		defer cancel()
+	}
+
+	conn, err := dialBroker(ctx, s.agentConfig.ReswarmConfig, brokerURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sessionID := newSessionID()
+	reswarmConfig := s.agentConfig.ReswarmConfig
+
+	keepAlive := s.socketConfig.PingPongTimeout
+	if keepAlive == 0 {
+		keepAlive = DefaultMQTTKeepAlive
+	}
+
+	options := mqtt.Options{
+		ClientID:  reswarmConfig.SerialNumber,
+		Username:  fmt.Sprintf("%d-%d", reswarmConfig.SwarmKey, reswarmConfig.DeviceKey),
+		Password:  []byte(reswarmConfig.Secret),
+		KeepAlive: keepAlive,
+		Properties: mqtt.Properties{
+			User: []mqtt.UserProperty{{Key: mqttSessionProperty, Value: fmt.Sprint(sessionID)}},
+		},
+		OnPublish: s.dispatch,
+	}
+
+	if s.socketConfig.SetupTestament {
+		will, err := s.testament(sessionID)
+		if err != nil {
+			_ = conn.Close()
+			return nil, 0, err
+		}
+		options.Will = will
+	}
+
+	c, _, err := mqtt.NewClient(ctx, conn, options)
+	if err != nil {
+		_ = conn.Close()
+		return nil, 0, err
+	}
+
+	return c, sessionID, nil
+}
+
+// dialBroker opens the connection to an mqtt:// (or tcp://) broker, or with
+// TLS to an mqtts:// (or ssl://, tls://) one, verified as configured for the
+// device endpoint.
+func dialBroker(ctx context.Context, reswarmConfig *config.ReswarmConfig, brokerURL string) (net.Conn, error) {
+	if brokerURL == "" {
+		return nil, errors.New("no mqtt_broker_url configured")
+	}
+
+	parsed, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var useTLS bool
+	defaultPort := "1883"
+	switch strings.ToLower(parsed.Scheme) {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		useTLS = true
+		defaultPort = "8883"
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker scheme %q, use mqtt:// or mqtts://", parsed.Scheme)
+	}
+
+	address := parsed.Host
+	if parsed.Port() == "" {
+		address = net.JoinHostPort(parsed.Hostname(), defaultPort)
+	}
+
+	if !useTLS {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	tlsConfig, err := buildTLSConfig(reswarmConfig, brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := tls.Dialer{Config: tlsConfig}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// testament is the last will: the device status the router would publish for
+// a WAMP testament (see WampSession.SetupTestament).
+func (s *MqttSession) testament(sessionID uint64) (*mqtt.Publish, error) {
+	cfg := s.agentConfig.ReswarmConfig
+	payload, err := json.Marshal(mqttPayload{Args: []interface{}{
+		common.Dict{
+			"swarm_key":       cfg.SwarmKey,
+			"device_key":      cfg.DeviceKey,
+			"serial_number":   cfg.SerialNumber,
+			"wamp_session_id": sessionID,
+		},
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	return &mqtt.Publish{
+		Topic:      mqttEventPrefix + string(topics.SetDeviceTestament),
+		QoS:        1,
+		Properties: mqtt.Properties{ContentType: mqttContentType},
+		Payload:    payload,
+	}, nil
+}
+
+// watchDisconnect reconnects once c is lost.
+func (s *MqttSession) watchDisconnect(c *mqtt.Client) {
+	select {
+	case <-c.Done():
+	case <-s.ctx.Done():
+		return
+	}
+
+	s.mu.Lock()
+	deliberate := s.reconnecting
+	s.reconnecting = false
+	s.client = nil
+	s.mu.Unlock()
+
+	if !deliberate {
+		log.Warn().Err(c.Err()).Msg("MQTT connection lost, reconnecting...")
+	}
+
+	// The broker hands the client ID over to the newest connection. A second
+	// device with this serial takes it back and forth with us indefinitely.
+	if disconnect := c.ServerDisconnect(); disconnect != nil && disconnect.ReasonCode == mqtt.SessionTakenOver {
+		s.mu.Lock()
+		s.takeovers++
+		takeovers := s.takeovers
+		s.mu.Unlock()
+
+		if takeovers >= maxDuplicateSerialAttempts {
+			log.Error().Msgf("an MQTT connection for %s already exists", s.agentConfig.ReswarmConfig.SerialNumber)
+			os.Exit(1)
+		}
+		log.Warn().Msgf("MQTT session taken over by another connection with this serial (%d/%d)", takeovers, maxDuplicateSerialAttempts)
+	} else {
+		s.mu.Lock()
+		s.takeovers = 0
+		s.mu.Unlock()
+	}
+
+	cancelContainerStreams(s.container)
+
+	if err := s.connect(true); err != nil {
+		log.Warn().Err(err).Msg("reconnect aborted")
+	}
+}
+
+// heartbeat periodically reports the device status. After two failed
+// reports it drops the connection to reconnect.
+func (s *MqttSession) heartbeat(c *mqtt.Client) {
+	heartbeatInterval := s.socketConfig.HeartbeatInterval
+	if heartbeatInterval == 0 {
+		heartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	consecutiveFailures := 0
+	const maxConsecutiveFailures = 2
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-time.After(heartbeatInterval):
+		}
+
+		if err := s.UpdateRemoteDeviceStatus(CONNECTED); err != nil {
+			consecutiveFailures++
+			log.Warn().Err(err).Msgf("Failed to send heartbeat (%d/%d failures), connection may be lost", consecutiveFailures, maxConsecutiveFailures)
+			if consecutiveFailures >= maxConsecutiveFailures {
+				log.Error().Msg("Connection appears to be broken (multiple heartbeat failures), signaling reconnection...")
+				c.Drop()
+				return
+			}
+			continue
+		}
+		consecutiveFailures = 0
+	}
+}
+
+// dispatch routes a message the broker delivered; it runs on the reader of
+// the connection, so nothing here may block on the broker.
+func (s *MqttSession) dispatch(p *mqtt.Publish) {
+	switch {
+	case strings.HasPrefix(p.Topic, mqttReplyPrefix):
+		s.deliverResult(p)
+	case strings.HasPrefix(p.Topic, mqttCallPrefix):
+		s.invoke(topics.Topic(strings.TrimPrefix(p.Topic, mqttCallPrefix)), p)
+	case strings.HasPrefix(p.Topic, mqttEventPrefix):
+		s.deliverEvent(topics.Topic(strings.TrimPrefix(p.Topic, mqttEventPrefix)), p)
+	}
+}
+
+func (s *MqttSession) deliverResult(p *mqtt.Publish) {
+	s.mu.Lock()
+	call, ok := s.calls[string(p.Properties.CorrelationData)]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case call.results <- p:
+	case <-call.done:
+	}
+}
+
+func (s *MqttSession) invoke(procedure topics.Topic, p *mqtt.Publish) {
+	s.mu.Lock()
+	registration, ok := s.registrations[procedure]
+	c := s.client
+	requestID := s.allocateID()
+	s.mu.Unlock()
+
+	safe.Go(func() {
+		var result *InvokeResult
+		var err error
+		if !ok {
+			err = &CallError{URI: "wamp.error.no_such_procedure"}
+		} else {
+			var payload mqttPayload
+			if err = json.Unmarshal(p.Payload, &payload); err == nil {
+				details := common.Dict{}
+				for _, property := range p.Properties.User {
+					details[property.Key] = property.Value
+				}
+
+				ctx := s.ctx
+				if receiveProgress, _ := p.Properties.UserValue(mqttReceiveProgressProperty); receiveProgress == "true" {
+					ctx = WithProgress(ctx, func(args []interface{}, kwargs common.Dict) error {
+						return s.reply(c, p, mqttPayload{Args: args, Kwargs: kwargs}, []mqtt.UserProperty{{Key: mqttProgressProperty, Value: "true"}})
+					})
+				}
+
+				result, err = registration.handler(ctx, Result{
+					Request:      requestID,
+					Registration: registration.id,
+					Details:      details,
+					Arguments:    payload.Args,
+					ArgumentsKw:  payload.Kwargs,
+				})
+			}
+		}
+
+		var payload mqttPayload
+		var properties []mqtt.UserProperty
+		if err != nil {
+			uri := "wamp.error.canceled"
+			var callErr *CallError
+			if errors.As(err, &callErr) {
+				uri = callErr.URI
+			} else {
+				log.Error().Stack().Err(err).Msgf("An error occured during invocation of %s", procedure)
+			}
+			properties = []mqtt.UserProperty{{Key: mqttErrorProperty, Value: uri}}
+			payload.Args = []interface{}{common.Dict{"error": err.Error()}}
+		} else if result != nil {
+			payload.Args, payload.Kwargs = result.Arguments, result.ArgumentsKw
+		}
+
+		if err := s.reply(c, p, payload, properties); err != nil {
+			log.Debug().Err(err).Msgf("Failed to send the result of %s", procedure)
+		}
+	})
+}
+
+// reply sends a result of the call p to the caller's response topic.
+func (s *MqttSession) reply(c *mqtt.Client, p *mqtt.Publish, payload mqttPayload, properties []mqtt.UserProperty) error {
+	if p.Properties.ResponseTopic == "" || c == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, mqttRequestTimeout)
+	defer cancel()
+	err = c.Publish(ctx, &mqtt.Publish{
+		Topic: p.Properties.ResponseTopic,
+		QoS:   1,
+		Properties: mqtt.Properties{
+			ContentType:     mqttContentType,
+			CorrelationData: p.Properties.CorrelationData,
+			User:            properties,
+		},
+		Payload: encoded,
+	})
+	if errors.Is(err, mqtt.ErrNoSubscribers) {
+		return nil
+	}
+	return err
+}
+
+func (s *MqttSession) deliverEvent(topic topics.Topic, p *mqtt.Publish) {
+	s.mu.Lock()
+	subscription, ok := s.subscriptions[topic]
+	publicationID := s.allocateID()
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	safe.Go(func() {
+		var payload mqttPayload
+		if err := json.Unmarshal(p.Payload, &payload); err != nil {
+			log.Error().Err(err).Msgf("Failed to decode a publication to %s", topic)
+			return
+		}
+
+		event := Result{
+			Subscription: subscription.id,
+			Publication:  publicationID,
+			Details:      common.Dict{},
+			Arguments:    payload.Args,
+			ArgumentsKw:  payload.Kwargs,
+		}
+		if err := subscription.handler(event); err != nil {
+			log.Error().Stack().Err(err).Msgf("An error occured during the subscribe result of %s", topic)
+		}
+	})
+}
+
+func (s *MqttSession) Call(
+	ctx context.Context,
+	topic topics.Topic,
+	args []interface{},
+	kwargs common.Dict,
+	options common.Dict,
+	progCb func(Result),
+) (Result, error) {
+	s.mu.Lock()
+	c := s.client
+	requestID := s.allocateID()
+	s.mu.Unlock()
+	if c == nil {
+		return Result{}, ErrNotConnected
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := s.socketConfig.ResponseTimeout
+		if timeout == 0 {
+			timeout = mqttRequestTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	payload, err := json.Marshal(mqttPayload{Args: args, Kwargs: kwargs})
+	if err != nil {
+		return Result{}, err
+	}
+
+	correlationID := make([]byte, 16)
+	_, _ = rand.Read(correlationID)
+	correlation := hex.EncodeToString(correlationID)
+
+	call := &mqttCall{results: make(chan *mqtt.Publish, 16), done: make(chan struct{})}
+	s.mu.Lock()
+	s.calls[correlation] = call
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.calls, correlation)
+		s.mu.Unlock()
+		close(call.done)
+	}()
+
+	request := &mqtt.Publish{
+		Topic: mqttCallPrefix + string(topic),
+		QoS:   1,
+		Properties: mqtt.Properties{
+			ContentType:     mqttContentType,
+			ResponseTopic:   s.replyTopic(),
+			CorrelationData: []byte(correlation),
+		},
+		Payload: payload,
+	}
+	if progCb != nil {
+		request.Properties.User = []mqtt.UserProperty{{Key: mqttReceiveProgressProperty, Value: "true"}}
+	}
+
+	err = c.Publish(ctx, request)
+	if errors.Is(err, mqtt.ErrNoSubscribers) {
+		return Result{}, &CallError{URI: "wamp.error.no_such_procedure"}
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	for {
+		select {
+		case p := <-call.results:
+			var payload mqttPayload
+			if err := json.Unmarshal(p.Payload, &payload); err != nil {
+				return Result{}, fmt.Errorf("failed to decode the result of %s: %w", topic, err)
+			}
+
+			if uri, ok := p.Properties.UserValue(mqttErrorProperty); ok {
+				return Result{}, &CallError{URI: uri, Arguments: payload.Args, ArgumentsKw: payload.Kwargs}
+			}
+
+			result := Result{Request: requestID, Details: common.Dict{}, Arguments: payload.Args, ArgumentsKw: payload.Kwargs}
+			if progress, _ := p.Properties.UserValue(mqttProgressProperty); progress == "true" {
+				if progCb != nil {
+					progCb(result)
+				}
+				continue
+			}
+			return result, nil
+		case <-c.Done():
+			return Result{}, ErrNotConnected
+		case <-ctx.Done():
+			return Result{}, ctx.Err()
+		}
+	}
+}
+
+func (s *MqttSession) Register(topic topics.Topic, cb func(ctx context.Context, invocation Result) (*InvokeResult, error), options common.Dict) error {
+	c := s.currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, mqttRequestTimeout)
+	defer cancel()
+	if err := c.Subscribe(ctx, mqtt.Subscription{Filter: mqttCallPrefix + string(topic), QoS: 1}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registrations[topic] = &mqttRegistration{id: s.allocateID(), handler: cb}
+	return nil
+}
+
+func (s *MqttSession) Unregister(topic topics.Topic) error {
+	c := s.currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+
+	s.mu.Lock()
+	delete(s.registrations, topic)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(s.ctx, mqttRequestTimeout)
+	defer cancel()
+	return c.Unsubscribe(ctx, mqttCallPrefix+string(topic))
+}
+
+func (s *MqttSession) Subscribe(topic topics.Topic, cb func(Result) error, options common.Dict) error {
+	c := s.currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, mqttRequestTimeout)
+	defer cancel()
+	if err := c.Subscribe(ctx, mqtt.Subscription{Filter: mqttEventPrefix + string(topic), QoS: 1}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[topic] = &mqttSubscription{id: s.allocateID(), handler: cb}
+	return nil
+}
+
+func (s *MqttSession) Unsubscribe(topic topics.Topic) error {
+	c := s.currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+
+	s.mu.Lock()
+	delete(s.subscriptions, topic)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(s.ctx, mqttRequestTimeout)
+	defer cancel()
+	return c.Unsubscribe(ctx, mqttEventPrefix+string(topic))
+}
+
+// Publish publishes at QoS 0: like a WAMP publication without acknowledge,
+// it does not wait for the broker.
+func (s *MqttSession) Publish(topic topics.Topic, args []interface{}, kwargs common.Dict, options common.Dict) error {
+	c := s.currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+
+	payload, err := json.Marshal(mqttPayload{Args: args, Kwargs: kwargs})
+	if err != nil {
+		return err
+	}
+
+	err = c.Publish(s.ctx, &mqtt.Publish{
+		Topic:      mqttEventPrefix + string(topic),
+		Properties: mqtt.Properties{ContentType: mqttContentType},
+		Payload:    payload,
+	})
+	if err != nil {
+		log.Debug().Err(err).Str("topic", string(topic)).Msg("Failed to publish to topic")
+	}
+	return err
+}
+
+func (s *MqttSession) SubscriptionID(topic topics.Topic) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription, ok := s.subscriptions[topic]
+	if !ok {
+		return 0, false
+	}
+	return subscription.id, true
+}
+
+func (s *MqttSession) RegistrationID(topic topics.Topic) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registration, ok := s.registrations[topic]
+	if !ok {
+		return 0, false
+	}
+	return registration.id, true
+}
+
+// SetupTestament has nothing left to do: the testament is the will of the
+// MQTT connection, which is given when connecting.
+func (s *MqttSession) SetupTestament() error {
+	if s.currentClient() == nil {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// GetSessionID returns the ID the session made up for the current
+// connection; it is sent with CONNECT and in the testament.
+func (s *MqttSession) GetSessionID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return 0
+	}
+	return s.sessionID
+}
+
+func (s *MqttSession) GetConfig() *config.Config {
+	return s.agentConfig
+}
+
+func (s *MqttSession) Connected() bool {
+	c := s.currentClient()
+	return c != nil && c.Connected()
+}
+
+// Reconnect closes the connection so the watcher dials a fresh one with the
+// live config, like WampSession.Reconnect. The connection is closed normally,
+// so the broker does not publish the testament.
+func (s *MqttSession) Reconnect() {
+	s.mu.Lock()
+	c := s.client
+	if c != nil {
+		s.reconnecting = true
+	}
+	s.mu.Unlock()
+
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// Endpoint returns the broker the session connects to.
+func (s *MqttSession) Endpoint() string {
+	return s.agentConfig.ReswarmConfig.MQTTBrokerURL
+}
+
+// RotateSecret arms a fallback for a device secret that was just changed in
+// the config. The caller reconnects to put the new secret to use.
+func (s *MqttSession) RotateSecret(rotation SecretRotation) {
+	s.secretRotation.set(rotation)
+}
+
+func (s *MqttSession) UpdateRemoteDeviceStatus(status DeviceStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	payload := deviceStatusPayload(s.GetConfig(), status, s.GetSessionID(), s.tunnelCapableFn)
+	res, err := s.Call(ctx, topics.UpdateDeviceStatus, []any{payload}, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	applyDeviceStatusReply(s.GetConfig(), res)
+	return nil
+}
+
+// Close cancels the reconnect loop and closes the connection. Safe to call
+// multiple times.
+func (s *MqttSession) Close() {
+	s.cancel()
+
+	s.mu.Lock()
+	c := s.client
+	s.client = nil
+	s.mu.Unlock()
+
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+func (s *MqttSession) currentClient() *mqtt.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+func (s *MqttSession) replyTopic() string {
+	return mqttReplyPrefix + s.agentConfig.ReswarmConfig.SerialNumber
+}
+
+// allocateID returns the next request, registration or subscription ID;
+// s.mu must be held.
+func (s *MqttSession) allocateID() uint64 {
+	s.nextID++
+	return s.nextID
+}
+
+// newSessionID returns a random session ID in the WAMP ID range [1, 2^53].
+func newSessionID() uint64 {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])>>11 + 1
+}
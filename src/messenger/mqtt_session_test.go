@@ -0,0 +1,363 @@
+package messenger_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"reagent/common"
+	"reagent/config"
+	"reagent/messenger"
+	"reagent/messenger/mqtt"
+	"reagent/messenger/topics"
+	"reagent/testutil/builders"
+	"reagent/testutil/fakes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSerial = "test-serial-001"
+
+func newMqttSession(t *testing.T, broker *fakes.MQTTBroker, cfg *config.Config) *messenger.MqttSession {
+	t.Helper()
+
+	cfg.ReswarmConfig.Transport = messenger.TransportMQTT
+	cfg.ReswarmConfig.MQTTBrokerURL = broker.URL()
+
+	session, err := messenger.NewMqttSession(cfg, &messenger.SocketConfig{
+		SetupTestament:    true,
+		ResponseTimeout:   2 * time.Second,
+		ConnectionTimeout: time.Second,
+		HeartbeatInterval: time.Hour,
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(session.Close)
+
+	return session
+}
+
+// backend connects a client playing the backend; every message it receives
+// is passed to onPublish.
+func backend(t *testing.T, broker *fakes.MQTTBroker, onPublish func(c *mqtt.Client, p *mqtt.Publish)) *mqtt.Client {
+	t.Helper()
+
+	var c *mqtt.Client
+	ready := make(chan struct{})
+	client, err := broker.Client(t.Context(), mqtt.Options{
+		ClientID: "backend",
+		OnPublish: func(p *mqtt.Publish) {
+			<-ready
+			go onPublish(c, p)
+		},
+	})
+	require.NoError(t, err)
+	c = client
+	close(ready)
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c
+}
+
+func payload(t *testing.T, args ...interface{}) []byte {
+	t.Helper()
+	encoded, err := json.Marshal(map[string]interface{}{"args": args})
+	require.NoError(t, err)
+	return encoded
+}
+
+func deviceConnects(broker *fakes.MQTTBroker) int {
+	count := 0
+	for _, connect := range broker.Connects() {
+		if connect.ClientID == testSerial {
+			count++
+		}
+	}
+	return count
+}
+
+func TestMqttSession_Connect(t *testing.T) {
+	broker := fakes.NewMQTTBroker()
+	defer broker.Close()
+	broker.SetUser("1-1", "test-secret")
+
+	session := newMqttSession(t, broker, builders.DefaultTestConfig())
+
+	assert.True(t, session.Connected())
+	assert.NotZero(t, session.GetSessionID())
+	assert.Equal(t, broker.URL(), session.Endpoint())
+
+	connects := broker.Connects()
+	require.Len(t, connects, 1)
+	connect := connects[0]
+	assert.Equal(t, testSerial, connect.ClientID)
+	assert.Equal(t, "1-1", connect.Username)
+
+	require.NotNil(t, connect.Will)
+	assert.Equal(t, "event/"+string(topics.SetDeviceTestament), connect.Will.Topic)
+	var will struct {
+		Args []map[string]interface{} `json:"args"`
+	}
+	require.NoError(t, json.Unmarshal(connect.Will.Payload, &will))
+	require.Len(t, will.Args, 1)
+	assert.Equal(t, float64(session.GetSessionID()), will.Args[0]["wamp_session_id"])
+	assert.Equal(t, testSerial, will.Args[0]["serial_number"])
+}
+
+func TestMqttSession_Register(t *testing.T) {
+	broker := fakes.NewMQTTBroker()
+	defer broker.Close()
+	session := newMqttSession(t, broker, builders.DefaultTestConfig())
+
+	require.NoError(t, session.Register("re.mote.echo", func(ctx context.Context, invocation messenger.Result) (*messenger.InvokeResult, error) {
+		if invocation.Arguments[0] == "fail" {
+			return nil, errors.New("it failed")
+		}
+		if err := messenger.SendProgress(ctx, []interface{}{"half way"}, nil); err != nil {
+			return nil, err
+		}
+		return &messenger.InvokeResult{Arguments: []interface{}{invocation.Arguments[0], invocation.Details["caller_authid"]}}, nil
+	}, nil))
+	_, ok := session.RegistrationID("re.mote.echo")
+	assert.True(t, ok)
+
+	results := make(chan *mqtt.Publish, 2)
+	c := backend(t, broker, func(c *mqtt.Client, p *mqtt.Publish) { results <- p })
+	require.NoError(t, c.Subscribe(t.Context(), mqtt.Subscription{Filter: "reply/backend", QoS: 1}))
+
+	next := func() *mqtt.Publish {
+		t.Helper()
+		select {
+		case p := <-results:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("no result")
+			return nil
+		}
+	}
+
+	call := func(arg string, correlation string, properties ...mqtt.UserProperty) *mqtt.Publish {
+		t.Helper()
+		require.NoError(t, c.Publish(t.Context(), &mqtt.Publish{
+			Topic: "rpc/re.mote.echo",
+			QoS:   1,
+			Properties: mqtt.Properties{
+				ResponseTopic:   "reply/backend",
+				CorrelationData: []byte(correlation),
+				User:            append([]mqtt.UserProperty{{Key: "caller_authid", Value: "999"}}, properties...),
+			},
+			Payload: payload(t, arg),
+		}))
+		return next()
+	}
+
+	result := call("hello", "c-1")
+	assert.Equal(t, []byte("c-1"), result.Properties.CorrelationData)
+	assert.JSONEq(t, `{"args":["hello","999"]}`, string(result.Payload))
+
+	failed := call("fail", "c-2")
+	assert.Equal(t, []byte("c-2"), failed.Properties.CorrelationData)
+	uri, ok := failed.Properties.UserValue("error")
+	assert.True(t, ok)
+	assert.Equal(t, "wamp.error.canceled", uri)
+	assert.JSONEq(t, `{"args":[{"error":"it failed"}]}`, string(failed.Payload))
+
+	// progressive results only go to callers that ask for them
+	progress := call("hello", "c-3", mqtt.UserProperty{Key: "receive_progress", Value: "true"})
+	assert.Equal(t, []byte("c-3"), progress.Properties.CorrelationData)
+	isProgress, _ := progress.Properties.UserValue("progress")
+	assert.Equal(t, "true", isProgress)
+	assert.JSONEq(t, `{"args":["half way"]}`, string(progress.Payload))
+	final := next()
+	_, ok = final.Properties.UserValue("progress")
+	assert.False(t, ok)
+	assert.JSONEq(t, `{"args":["hello","999"]}`, string(final.Payload))
+
+	require.NoError(t, session.Unregister("re.mote.echo"))
+	_, ok = session.RegistrationID("re.mote.echo")
+	assert.False(t, ok)
+	assert.False(t, broker.Subscribed(testSerial, "rpc/re.mote.echo"))
+}
+
+func TestMqttSession_Call(t *testing.T) {
+	broker := fakes.NewMQTTBroker()
+	defer broker.Close()
+	session := newMqttSession(t, broker, builders.DefaultTestConfig())
+
+	c := backend(t, broker, func(c *mqtt.Client, p *mqtt.Publish) {
+		var request struct {
+			Args []interface{} `json:"args"`
+		}
+		_ = json.Unmarshal(p.Payload, &request)
+
+		reply := func(properties []mqtt.UserProperty, body []byte) {
+			_ = c.Publish(context.Background(), &mqtt.Publish{
+				Topic:      p.Properties.ResponseTopic,
+				QoS:        1,
+				Properties: mqtt.Properties{CorrelationData: p.Properties.CorrelationData, User: properties},
+				Payload:    body,
+			})
+		}
+
+		switch p.Topic {
+		case "rpc/back.end.progress":
+			reply([]mqtt.UserProperty{{Key: "progress", Value: "true"}}, payload(t, "50%"))
+			reply(nil, payload(t, "done"))
+		case "rpc/back.end.fail":
+			reply([]mqtt.UserProperty{{Key: "error", Value: "wamp.error.invalid_argument"}}, payload(t, map[string]interface{}{"error": "bad"}))
+		default:
+			reply(nil, payload(t, request.Args...))
+		}
+	})
+	require.NoError(t, c.Subscribe(t.Context(), mqtt.Subscription{Filter: "rpc/#", QoS: 1}))
+
+	t.Run("returns the result", func(t *testing.T) {
+		result, err := session.Call(t.Context(), "back.end.echo", []interface{}{"hi", 2}, nil, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"hi", float64(2)}, result.Arguments)
+	})
+
+	t.Run("passes progressive results on", func(t *testing.T) {
+		var progress []interface{}
+		result, err := session.Call(t.Context(), "back.end.progress", nil, nil, nil, func(r messenger.Result) {
+			progress = append(progress, r.Arguments...)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"50%"}, progress)
+		assert.Equal(t, []interface{}{"done"}, result.Arguments)
+	})
+
+	t.Run("returns the error of the procedure", func(t *testing.T) {
+		_, err := session.Call(t.Context(), "back.end.fail", nil, nil, nil, nil)
+
+		var callErr *messenger.CallError
+		require.ErrorAs(t, err, &callErr)
+		assert.Equal(t, "wamp.error.invalid_argument", callErr.URI)
+		assert.Equal(t, "wamp.error.invalid_argument: bad", err.Error())
+	})
+
+	t.Run("fails fast when nobody registered the procedure", func(t *testing.T) {
+		require.NoError(t, c.Unsubscribe(t.Context(), "rpc/#"))
+
+		_, err := session.Call(t.Context(), "back.end.echo", nil, nil, nil, nil)
+
+		var callErr *messenger.CallError
+		require.ErrorAs(t, err, &callErr)
+		assert.Equal(t, "wamp.error.no_such_procedure", callErr.URI)
+	})
+}
+
+func TestMqttSession_PublishSubscribe(t *testing.T) {
+	broker := fakes.NewMQTTBroker()
+	defer broker.Close()
+	session := newMqttSession(t, broker, builders.DefaultTestConfig())
+
+	events := make(chan messenger.Result, 1)
+	require.NoError(t, session.Subscribe("some.topic", func(r messenger.Result) error {
+		events <- r
+		return nil
+	}, nil))
+
+	require.NoError(t, session.Publish("some.topic", []interface{}{"x"}, common.Dict{"k": "v"}, nil))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, []interface{}{"x"}, event.Arguments)
+		assert.Equal(t, common.Dict{"k": "v"}, event.ArgumentsKw)
+		id, ok := session.SubscriptionID("some.topic")
+		assert.True(t, ok)
+		assert.Equal(t, id, event.Subscription)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the publication never arrived")
+	}
+}
+
+func TestMqttSession_Testament(t *testing.T) {
+	broker := fakes.NewMQTTBroker()
+	defer broker.Close()
+	session := newMqttSession(t, broker, builders.DefaultTestConfig())
+
+	reconnected := make(chan bool, 2)
+	session.SetOnConnect(func(reconnect bool) { reconnected <- reconnect })
+
+	testaments := make(chan *mqtt.Publish, 2)
+	c := backend(t, broker, func(c *mqtt.Client, p *mqtt.Publish) { testaments <- p })
+	require.NoError(t, c.Subscribe(t.Context(), mqtt.Subscription{Filter: "event/" + string(topics.SetDeviceTestament), QoS: 1}))
+
+	awaitReconnect := func() {
+		t.Helper()
+		select {
+		case reconnect := <-reconnected:
+			assert.True(t, reconnect)
+		case <-time.After(5 * time.Second):
+			t.Fatal("never reconnected")
+		}
+	}
+
+	// a deliberate reconnect closes the connection normally
+	session.Reconnect()
+	awaitReconnect()
+	assert.Equal(t, 2, deviceConnects(broker))
+	select {
+	case <-testaments:
+		t.Fatal("the testament was published for a deliberate reconnect")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a lost connection makes the broker publish the testament
+	sessionID := session.GetSessionID()
+	require.True(t, broker.DropClient(testSerial))
+
+	select {
+	case p := <-testaments:
+		var will struct {
+			Args []map[string]interface{} `json:"args"`
+		}
+		require.NoError(t, json.Unmarshal(p.Payload, &will))
+		assert.Equal(t, float64(sessionID), will.Args[0]["wamp_session_id"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("the testament was not published")
+	}
+	awaitReconnect()
+	assert.True(t, session.Connected())
+}
+
+func TestMqttSession_RotateSecret(t *testing.T) {
+	broker := fakes.NewMQTTBroker()
+	defer broker.Close()
+	broker.SetUser("1-1", "old")
+
+	cfg := builders.DefaultTestConfig()
+	cfg.ReswarmConfig.Secret = "old"
+	session := newMqttSession(t, broker, cfg)
+
+	var mu sync.Mutex
+	finished := make(chan bool, 1)
+
+	// the broker does not know the new secret, so the session falls back
+	mu.Lock()
+	cfg.ReswarmConfig.Secret = "new"
+	mu.Unlock()
+	session.RotateSecret(messenger.SecretRotation{
+		Until: time.Now().Add(time.Minute),
+		Revert: func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			cfg.ReswarmConfig.Secret = "old"
+			return nil
+		},
+		Finished: func(rotated bool) { finished <- rotated },
+	})
+	session.Reconnect()
+
+	select {
+	case rotated := <-finished:
+		assert.False(t, rotated)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rotation never finished")
+	}
+	assert.True(t, session.Connected())
+}
@@ -27,6 +27,7 @@ type NexusClient interface {
 	// RPC
 	Call(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, progCb client.ProgressHandler) (*wamp.Result, error)
 	Register(procedure string, fn client.InvocationHandler, options wamp.Dict) error
+	SendProgress(ctx context.Context, args wamp.List, kwargs wamp.Dict) error
 	RegistrationID(procedure string) (regID wamp.ID, ok bool)
 	Unregister(procedure string) error
 }
@@ -0,0 +1,30 @@
+package messenger
+
+import (
+	"context"
+
+	"reagent/common"
+)
+
+// ProgressFunc sends a progressive result to the caller of an invocation.
+type ProgressFunc func(args []interface{}, kwargs common.Dict) error
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx through which the invocation's handler
+// reports progressive results with SendProgress. The sessions install it for
+// invocations whose caller asked for progressive results.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// SendProgress sends a progressive result to the caller of the invocation ctx
+// belongs to. It does nothing when the caller did not ask for progressive
+// results, so handlers report progress without checking.
+func SendProgress(ctx context.Context, args []interface{}, kwargs common.Dict) error {
+	fn, ok := ctx.Value(progressKey{}).(ProgressFunc)
+	if !ok {
+		return nil
+	}
+	return fn(args, kwargs)
+}
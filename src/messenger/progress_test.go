@@ -0,0 +1,64 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"reagent/common"
+
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendProgress(t *testing.T) {
+	t.Run("does nothing outside invocations", func(t *testing.T) {
+		assert.NoError(t, SendProgress(context.Background(), []interface{}{1}, nil))
+	})
+
+	t.Run("reaches the invocation's progress func through derived contexts", func(t *testing.T) {
+		var sent [][]interface{}
+		ctx := WithProgress(context.Background(), func(args []interface{}, kwargs common.Dict) error {
+			sent = append(sent, args)
+			return nil
+		})
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		require.NoError(t, SendProgress(ctx, []interface{}{"10%"}, nil))
+		assert.Equal(t, [][]interface{}{{"10%"}}, sent)
+	})
+}
+
+func TestWampSession_RegisterSendsProgress(t *testing.T) {
+	mockClient := NewMockClient()
+	session, err := NewWampSession(testConfig(), &SocketConfig{ConnectionTimeout: 100 * time.Millisecond}, nil, mockClient.ConnectNet)
+	require.NoError(t, err)
+	defer session.Close()
+
+	var handlerCtx context.Context
+	require.NoError(t, session.Register("re.mote.download", func(ctx context.Context, invocation Result) (*InvokeResult, error) {
+		handlerCtx = ctx
+		if err := SendProgress(ctx, []interface{}{"50%"}, nil); err != nil {
+			return nil, err
+		}
+		return &InvokeResult{Arguments: []interface{}{"done"}}, nil
+	}, nil))
+
+	c := mockClient.LastClient()
+
+	result := c.Invoke(context.Background(), "re.mote.download", &wamp.Invocation{Details: wamp.Dict{}})
+	assert.Equal(t, wamp.List{"done"}, result.Args)
+	assert.Empty(t, c.Progress(), "the caller did not ask for progressive results")
+
+	result = c.Invoke(context.Background(), "re.mote.download", &wamp.Invocation{Details: wamp.Dict{"receive_progress": true}})
+	assert.Equal(t, wamp.List{"done"}, result.Args)
+	assert.Equal(t, []wamp.List{{"50%"}}, c.Progress())
+
+	// a cancelled call cancels the handler's context
+	invocationCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Invoke(invocationCtx, "re.mote.download", &wamp.Invocation{Details: wamp.Dict{"receive_progress": true}})
+	assert.ErrorIs(t, handlerCtx.Err(), context.Canceled)
+}
@@ -0,0 +1,71 @@
+package messenger
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ValidateProxyURL checks a proxy given with -wampProxy. The websocket dialer
+// tunnels through http:// proxies with HTTP CONNECT, sending the credentials
+// of the URL as Basic auth, and speaks SOCKS5 to socks5:// ones.
+func ValidateProxyURL(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+		return fmt.Errorf("unsupported proxy scheme %q, use http:// or socks5://", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("proxy URL %q has no host", proxy)
+	}
+
+	return nil
+}
+
+// proxyFor returns the proxy to dial endpoint through, or "" to dial it
+// directly. A configured proxy wins; otherwise HTTPS_PROXY/HTTP_PROXY and
+// NO_PROXY decide, re-read on every dial like for the tunnel (see frp.go).
+func proxyFor(endpoint string, configured string) (string, error) {
+	if configured != "" {
+		return configured, ValidateProxyURL(configured)
+	}
+
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	// the proxy variables are keyed by the scheme of the request that
+	// upgrades to the websocket
+	switch strings.ToLower(target.Scheme) {
+	case "wss":
+		target.Scheme = "https"
+	case "ws":
+		target.Scheme = "http"
+	}
+
+	proxyURL, err := httpproxy.FromEnvironment().ProxyFunc()(target)
+	if err != nil || proxyURL == nil {
+		return "", err
+	}
+
+	return proxyURL.String(), nil
+}
+
+// redactProxy hides the password of a proxy URL for logging.
+func redactProxy(proxy string) string {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return "<invalid proxy URL>"
+	}
+	return proxyURL.Redacted()
+}
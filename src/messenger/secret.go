@@ -0,0 +1,93 @@
+package messenger
+
+import (
+	"reagent/safe"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SecretRotation describes a change of the device secret the messenger
+// authenticates with from its next connection on.
+type SecretRotation struct {
+	// Until is when the router rejecting the new secret stops being a reason
+	// to fall back to the previous one.
+	Until time.Time
+	// Revert restores the previous secret. It is called before redialling;
+	// an error leaves the new secret in place.
+	Revert func() error
+	// Finished is called once connected again, reporting whether the new
+	// secret was kept.
+	Finished func(rotated bool)
+
+	reverted bool
+}
+
+// RotateSecret arms a fallback for a device secret that was just changed in
+// the config. The caller reconnects to put the new secret to use.
+func (s *WampSession) RotateSecret(rotation SecretRotation) {
+	s.secretRotation.set(rotation)
+}
+
+// revertSecretRotation falls back to the previous secret after the router
+// rejected the new one, reporting whether the dial should retry.
+func (s *WampSession) revertSecretRotation() bool {
+	return s.secretRotation.revert()
+}
+
+// finishSecretRotation reports the outcome of a pending rotation once the
+// session is connected, so the report can reach the backend.
+func (s *WampSession) finishSecretRotation() {
+	s.secretRotation.finish()
+}
+
+// pendingSecretRotation is the device secret change pending until the next
+// connection of a messenger.
+type pendingSecretRotation struct {
+	mu       sync.Mutex
+	rotation *SecretRotation
+}
+
+func (p *pendingSecretRotation) set(rotation SecretRotation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rotation = &rotation
+}
+
+func (p *pendingSecretRotation) revert() bool {
+	p.mu.Lock()
+	rotation := p.rotation
+	if rotation == nil || rotation.reverted || time.Now().After(rotation.Until) {
+		p.mu.Unlock()
+		return false
+	}
+	rotation.reverted = true
+	p.mu.Unlock()
+
+	log.Warn().Msg("The router rejected the rotated device secret, falling back to the previous one")
+	err := rotation.Revert()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to fall back to the previous device secret")
+		p.mu.Lock()
+		rotation.reverted = false
+		p.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+func (p *pendingSecretRotation) finish() {
+	p.mu.Lock()
+	rotation := p.rotation
+	p.rotation = nil
+	p.mu.Unlock()
+
+	if rotation == nil {
+		return
+	}
+
+	safe.Go(func() {
+		rotation.Finished(!rotation.reverted)
+	})
+}
@@ -0,0 +1,125 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWampSession_RotateSecret(t *testing.T) {
+	// connect rejects every secret but the accepted one, like the router
+	connect := func(t *testing.T) (*WampSession, func(secret string, accepted string)) {
+		t.Helper()
+
+		cfg := testConfig()
+		cfg.ReswarmConfig.Secret = "old"
+		accepted := "old"
+
+		var mu sync.Mutex
+		mockClient := NewMockClient()
+		provider := func(ctx context.Context, url string, clientCfg client.Config) (NexusClient, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if cfg.ReswarmConfig.Secret != accepted {
+				return nil, errors.New("WAMP-CRA client signature is invalid")
+			}
+			return mockClient.ConnectNet(ctx, url, clientCfg)
+		}
+
+		session, err := NewWampSession(cfg, &SocketConfig{ConnectionTimeout: 100 * time.Millisecond}, nil, provider)
+		require.NoError(t, err)
+		t.Cleanup(session.Close)
+
+		update := func(secret string, acceptedSecret string) {
+			mu.Lock()
+			defer mu.Unlock()
+			cfg.ReswarmConfig.Secret = secret
+			accepted = acceptedSecret
+		}
+		return session, update
+	}
+
+	awaitFinished := func(t *testing.T, finished chan bool) bool {
+		t.Helper()
+		select {
+		case rotated := <-finished:
+			return rotated
+		case <-time.After(5 * time.Second):
+			t.Fatal("the rotation never finished")
+			return false
+		}
+	}
+
+	t.Run("keeps a secret the router accepts", func(t *testing.T) {
+		session, update := connect(t)
+
+		update("new", "new")
+		finished := make(chan bool, 1)
+		session.RotateSecret(SecretRotation{
+			Until: time.Now().Add(time.Minute),
+			Revert: func() error {
+				t.Error("the accepted secret must not be reverted")
+				return nil
+			},
+			Finished: func(rotated bool) { finished <- rotated },
+		})
+		session.Reconnect()
+
+		assert.True(t, awaitFinished(t, finished))
+	})
+
+	t.Run("falls back to the previous secret when it is rejected", func(t *testing.T) {
+		session, update := connect(t)
+
+		update("new", "old")
+		reverted := false
+		finished := make(chan bool, 1)
+		session.RotateSecret(SecretRotation{
+			Until: time.Now().Add(time.Minute),
+			Revert: func() error {
+				reverted = true
+				update("old", "old")
+				return nil
+			},
+			Finished: func(rotated bool) { finished <- rotated },
+		})
+		session.Reconnect()
+
+		assert.False(t, awaitFinished(t, finished))
+		assert.True(t, reverted)
+		assert.True(t, session.Connected())
+	})
+
+	t.Run("does not fall back after the grace window", func(t *testing.T) {
+		session, _ := connect(t)
+
+		session.RotateSecret(SecretRotation{
+			Until: time.Now().Add(-time.Second),
+			Revert: func() error {
+				t.Error("reverted after the grace window")
+				return nil
+			},
+			Finished: func(bool) {},
+		})
+
+		assert.False(t, session.revertSecretRotation())
+	})
+
+	t.Run("a fallback that fails is not one", func(t *testing.T) {
+		session, _ := connect(t)
+
+		session.RotateSecret(SecretRotation{
+			Until:    time.Now().Add(time.Minute),
+			Revert:   func() error { return errors.New("read-only file system") },
+			Finished: func(bool) {},
+		})
+
+		assert.False(t, session.revertSecretRotation())
+	})
+}
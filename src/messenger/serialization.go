@@ -0,0 +1,66 @@
+package messenger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gammazero/nexus/v3/transport/serialize"
+)
+
+// serializationNames are the values -wampSerialization accepts besides "auto".
+// JSON is the default: the routers of every device speak it, and a binary
+// serialization is only offered to the routers it is configured for.
+var serializationNames = map[string]serialize.Serialization{
+	"json":    serialize.JSON,
+	"msgpack": serialize.MSGPACK,
+	"cbor":    serialize.CBOR,
+}
+
+// autoSerializations is the order the opt-in "auto" tries serializations in:
+// the binary ones first, they carry bytes as they are and encode numbers and keys more
+// compactly, then JSON, which every router speaks. The binary ones decode an
+// integer to uint64 or int64 depending on the sender's encoder, so handlers read
+// numbers with common.ToUint64 rather than asserting one type.
+var autoSerializations = []serialize.Serialization{serialize.MSGPACK, serialize.CBOR, serialize.JSON}
+
+// ValidateSerialization checks a serialization given with -wampSerialization.
+func ValidateSerialization(setting string) error {
+	_, err := serializations(setting)
+	return err
+}
+
+// serializations returns the serializations to offer the router, in order of
+// preference. A serialization given explicitly is the only one offered.
+func serializations(setting string) ([]serialize.Serialization, error) {
+	if setting == "" {
+		return []serialize.Serialization{serialize.JSON}, nil
+	}
+	if setting == "auto" {
+		return autoSerializations, nil
+	}
+
+	serialization, ok := serializationNames[setting]
+	if !ok {
+		return nil, fmt.Errorf("unsupported serialization %q, use auto, msgpack, cbor or json", setting)
+	}
+
+	return []serialize.Serialization{serialization}, nil
+}
+
+// serializerRejected reports whether a dial failed because the router does not
+// speak the serialization offered: it refuses the websocket upgrade for the
+// subprotocol. A failure of any other cause, a DNS lookup, TLS or a timeout,
+// would fail with the next serialization just the same.
+func serializerRejected(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "bad handshake") || strings.Contains(message, "subprotocol")
+}
+
+func serializationName(serialization serialize.Serialization) string {
+	for name, s := range serializationNames {
+		if s == serialization {
+			return name
+		}
+	}
+	return "auto"
+}
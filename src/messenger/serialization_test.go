@@ -0,0 +1,109 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/transport/serialize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerializations(t *testing.T) {
+	for setting, expected := range map[string][]serialize.Serialization{
+		"":        {serialize.JSON},
+		"auto":    {serialize.MSGPACK, serialize.CBOR, serialize.JSON},
+		"msgpack": {serialize.MSGPACK},
+		"cbor":    {serialize.CBOR},
+		"json":    {serialize.JSON},
+	} {
+		offered, err := serializations(setting)
+		require.NoError(t, err, setting)
+		assert.Equal(t, expected, offered, setting)
+	}
+
+	assert.Error(t, ValidateSerialization("xml"))
+}
+
+func TestWampSession_SerializationFallback(t *testing.T) {
+	t.Run("speaks JSON unless configured otherwise", func(t *testing.T) {
+		session, offered := dialSerializations(t, "", nil, serialize.JSON, serialize.MSGPACK, serialize.CBOR)
+		assert.Equal(t, []serialize.Serialization{serialize.JSON}, offered)
+		assert.Equal(t, "json", session.Serialization())
+	})
+
+	t.Run("prefers MessagePack", func(t *testing.T) {
+		session, offered := dialSerializations(t, "auto", nil, serialize.JSON, serialize.MSGPACK, serialize.CBOR)
+		assert.Equal(t, []serialize.Serialization{serialize.MSGPACK}, offered)
+		assert.Equal(t, "msgpack", session.Serialization())
+	})
+
+	t.Run("falls back to JSON", func(t *testing.T) {
+		session, offered := dialSerializations(t, "auto", nil, serialize.JSON)
+		assert.Equal(t, []serialize.Serialization{serialize.MSGPACK, serialize.CBOR, serialize.JSON}, offered)
+		assert.Equal(t, "json", session.Serialization())
+	})
+
+	t.Run("offers only a serialization given explicitly", func(t *testing.T) {
+		session, offered := dialSerializations(t, "cbor", nil, serialize.JSON, serialize.MSGPACK, serialize.CBOR)
+		assert.Equal(t, []serialize.Serialization{serialize.CBOR}, offered)
+		assert.Equal(t, "cbor", session.Serialization())
+	})
+
+	t.Run("does not fall back when the dial fails for another reason", func(t *testing.T) {
+		failures := 1
+		network := func() error {
+			if failures > 0 {
+				failures--
+				return errors.New("dial tcp: lookup router.example.com: no such host")
+			}
+			return nil
+		}
+
+		session, offered := dialSerializations(t, "auto", network, serialize.JSON, serialize.MSGPACK)
+		assert.Equal(t, []serialize.Serialization{serialize.MSGPACK, serialize.MSGPACK}, offered)
+		assert.Equal(t, "msgpack", session.Serialization())
+	})
+}
+
+// dialSerializations connects a session to a router speaking the supported
+// serializations and returns the ones the session offered. A network error
+// fails a dial before the router sees the serialization.
+func dialSerializations(t *testing.T, setting string, network func() error, supported ...serialize.Serialization) (*WampSession, []serialize.Serialization) {
+	t.Helper()
+
+	cfg := testConfig()
+	cfg.CommandLineArguments.WampSerialization = setting
+
+	var mu sync.Mutex
+	var offered []serialize.Serialization
+	mockClient := NewMockClient()
+	provider := func(ctx context.Context, url string, clientCfg client.Config) (NexusClient, error) {
+		mu.Lock()
+		offered = append(offered, clientCfg.Serialization)
+		mu.Unlock()
+		if network != nil {
+			if err := network(); err != nil {
+				return nil, err
+			}
+		}
+		for _, serialization := range supported {
+			if clientCfg.Serialization == serialization {
+				return mockClient.ConnectNet(ctx, url, clientCfg)
+			}
+		}
+		return nil, errors.New("websocket: bad handshake")
+	}
+
+	session, err := NewWampSession(cfg, &SocketConfig{ConnectionTimeout: 100 * time.Millisecond}, nil, provider)
+	require.NoError(t, err)
+	t.Cleanup(session.Close)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return session, append([]serialize.Serialization(nil), offered...)
+}
@@ -0,0 +1,99 @@
+package messenger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reagent/config"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CertificateWarningWindow is how long before its expiry the device
+// certificate is reported as expiring in the device status.
+const CertificateWarningWindow = 30 * 24 * time.Hour
+
+var ErrNoCertificate = errors.New("no device certificate configured")
+
+// buildTLSConfig returns the TLS config to dial endpoint with, or nil for the
+// defaults (the system roots, no client certificate). The server certificate
+// is verified against the pinned CA bundle when the .flock carries one. The
+// device certificate is presented to legacy endpoints and, with mutual_tls,
+// to any endpoint.
+func buildTLSConfig(reswarmConfig *config.ReswarmConfig, endpoint string) (*tls.Config, error) {
+	authentication := reswarmConfig.Authentication
+	mutualTLS := authentication.MutualTLS || legacyEndpointRegex.MatchString(endpoint)
+
+	if !mutualTLS && authentication.CACertificate == "" && !authentication.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if authentication.CACertificate != "" {
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM([]byte(authentication.CACertificate)) {
+			return nil, errors.New("the pinned ca_certificate contains no PEM certificate")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if authentication.InsecureSkipVerify {
+		log.Warn().Msgf("Not verifying the certificate of %s (insecure_skip_verify)", endpoint)
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if mutualTLS {
+		clientCert, err := tls.X509KeyPair([]byte(authentication.Certificate), []byte(authentication.Key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid device certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// CertificateExpiry returns when the device certificate expires.
+func CertificateExpiry(reswarmConfig *config.ReswarmConfig) (time.Time, error) {
+	if reswarmConfig.Authentication.Certificate == "" {
+		return time.Time{}, ErrNoCertificate
+	}
+
+	block, _ := pem.Decode([]byte(reswarmConfig.Authentication.Certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, errors.New("the device certificate is not a PEM certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cert.NotAfter, nil
+}
+
+// certificateStatus is the device certificate part of the device status: its
+// expiry and, close to or past it, a warning. Empty without a certificate.
+func certificateStatus(reswarmConfig *config.ReswarmConfig, now time.Time) map[string]any {
+	notAfter, err := CertificateExpiry(reswarmConfig)
+	if err != nil {
+		if !errors.Is(err, ErrNoCertificate) {
+			log.Debug().Err(err).Msg("Failed to read the device certificate expiry")
+		}
+		return nil
+	}
+
+	status := map[string]any{"certificate_expires_at": notAfter.UTC().Format(time.RFC3339)}
+	switch {
+	case !now.Before(notAfter):
+		status["certificate_warning"] = "the device certificate has expired"
+	case notAfter.Sub(now) < CertificateWarningWindow:
+		status["certificate_warning"] = fmt.Sprintf("the device certificate expires in %d days", int(notAfter.Sub(now).Hours()/24))
+	}
+
+	return status
+}
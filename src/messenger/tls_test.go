@@ -0,0 +1,114 @@
+package messenger
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reagent/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedPEM returns a certificate and its key, valid until notAfter.
+func selfSignedPEM(t *testing.T, notAfter time.Time) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t, time.Now().Add(time.Hour))
+
+	t.Run("defaults without pinning or mTLS", func(t *testing.T) {
+		tlsConfig, err := buildTLSConfig(&config.ReswarmConfig{}, "wss://cbw.ironflock.com/ws")
+		require.NoError(t, err)
+		assert.Nil(t, tlsConfig)
+	})
+
+	t.Run("legacy endpoints verify the server and get the client certificate", func(t *testing.T) {
+		reswarmConfig := &config.ReswarmConfig{}
+		reswarmConfig.Authentication.Certificate = certPEM
+		reswarmConfig.Authentication.Key = keyPEM
+
+		tlsConfig, err := buildTLSConfig(reswarmConfig, "wss://devices.example.com:8080")
+		require.NoError(t, err)
+		require.NotNil(t, tlsConfig)
+		assert.False(t, tlsConfig.InsecureSkipVerify, "the server is authenticated")
+		assert.Len(t, tlsConfig.Certificates, 1)
+	})
+
+	t.Run("mTLS for any endpoint with a pinned CA", func(t *testing.T) {
+		reswarmConfig := &config.ReswarmConfig{}
+		reswarmConfig.Authentication.Certificate = certPEM
+		reswarmConfig.Authentication.Key = keyPEM
+		reswarmConfig.Authentication.CACertificate = certPEM
+		reswarmConfig.Authentication.MutualTLS = true
+
+		tlsConfig, err := buildTLSConfig(reswarmConfig, "wss://cbw.ironflock.com/ws")
+		require.NoError(t, err)
+		require.NotNil(t, tlsConfig.RootCAs)
+		assert.Len(t, tlsConfig.Certificates, 1)
+	})
+
+	t.Run("rejects a broken pin or key pair", func(t *testing.T) {
+		reswarmConfig := &config.ReswarmConfig{}
+		reswarmConfig.Authentication.CACertificate = "not a certificate"
+		_, err := buildTLSConfig(reswarmConfig, "wss://cbw.ironflock.com/ws")
+		assert.Error(t, err)
+
+		reswarmConfig = &config.ReswarmConfig{}
+		reswarmConfig.Authentication.MutualTLS = true
+		reswarmConfig.Authentication.Certificate = certPEM
+		_, err = buildTLSConfig(reswarmConfig, "wss://cbw.ironflock.com/ws")
+		assert.Error(t, err)
+	})
+
+	t.Run("verification is only skipped on request", func(t *testing.T) {
+		reswarmConfig := &config.ReswarmConfig{}
+		reswarmConfig.Authentication.InsecureSkipVerify = true
+
+		tlsConfig, err := buildTLSConfig(reswarmConfig, "wss://cbw.ironflock.com/ws")
+		require.NoError(t, err)
+		assert.True(t, tlsConfig.InsecureSkipVerify)
+	})
+}
+
+func TestCertificateStatus(t *testing.T) {
+	now := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, certificateStatus(&config.ReswarmConfig{}, now), "nothing to report without a certificate")
+
+	reswarmConfig := &config.ReswarmConfig{}
+	reswarmConfig.Authentication.Certificate, _ = selfSignedPEM(t, now.Add(90*24*time.Hour))
+	status := certificateStatus(reswarmConfig, now)
+	assert.Equal(t, "2026-07-30T12:00:00Z", status["certificate_expires_at"])
+	assert.NotContains(t, status, "certificate_warning")
+
+	reswarmConfig.Authentication.Certificate, _ = selfSignedPEM(t, now.Add(10*24*time.Hour))
+	assert.Equal(t, "the device certificate expires in 10 days", certificateStatus(reswarmConfig, now)["certificate_warning"])
+
+	reswarmConfig.Authentication.Certificate, _ = selfSignedPEM(t, now.Add(-time.Hour))
+	assert.Equal(t, "the device certificate has expired", certificateStatus(reswarmConfig, now)["certificate_warning"])
+}
@@ -12,12 +12,33 @@ const GetRegistryToken Topic = "reswarm.containers.get_registry_token"
 // derived (cross-app data access). Argument-free by design — the backend
 // resolves the device from the session authid.
 const GetAppCredKey Topic = "reswarm.devices.get_app_cred_key"
+
+// Key the devices of a swarm sign their requests for each other's app images
+// with (see peerimage). Argument-free like GetAppCredKey: the backend resolves
+// the device, and so its swarm, from the session authid.
+const GetPeerImageKey Topic = "reswarm.devices.get_peer_image_key"
 const UpdateDeviceStatus Topic = "reswarm.devices.update_device_status"
 const GetDeviceMetadata Topic = "reswarm.devices.read_device_metadata"
 
+// Signs the CSR of a device renewing its TLS client certificate and returns
+// the certificate (PEM).
+const SignDeviceCertificate Topic = "reswarm.devices.sign_device_certificate"
+
+// Confirms a device secret rotation to the backend, which then revokes the
+// previous secret, or reports that the device fell back to it.
+const ConfirmDeviceSecret Topic = "reswarm.devices.confirm_device_secret"
+
 // const UpdateDevice Topic = "reswarm.devices.update_device"
 const UpdateDeviceArchitecture Topic = "reswarm.devices.update_device_architecture"
 const CheckPrivilege Topic = "reswarm.devices.check_privilege"
+
+// Returns the signed privilege grants currently in effect for a device, used
+// to pre-warm its privilege cache on connect.
+const GetPrivilegeGrants Topic = "reswarm.devices.get_privilege_grants"
+
+// Returns the Docker daemon settings the backend manages for a device (see
+// daemonconfig.Settings), or none.
+const GetDaemonConfig Topic = "reswarm.devices.get_daemon_config"
 const SetDeviceTestament Topic = "reswarm.api.testament_device"
 
 // Immediate garbage collection of the appliance-local appstore registry
@@ -22,6 +22,12 @@ const QueryDeviceLogs Topic = "query_device_logs"
 
 const ListContainers Topic = "list_containers"
 
+// StartAppService, StopAppService and RestartAppService control a single
+// service of a compose app.
+const StartAppService Topic = "start_app_service"
+const StopAppService Topic = "stop_app_service"
+const RestartAppService Topic = "restart_app_service"
+
 const ListEthernetDevices Topic = "list_ethernet_devices"
 const UpdateIPv4Configuration Topic = "update_ipv4_config"
 
@@ -33,6 +39,12 @@ const SelectWiFiNetwork Topic = "select_wifi_network"
 const RestartWifi Topic = "restart_wifi"
 const GetIPv4Addresses Topic = "get_ipv4_addresses"
 
+const ListVPNConnections Topic = "list_vpn_connections"
+const ImportVPNConnection Topic = "import_vpn_connection"
+const ActivateVPNConnection Topic = "activate_vpn_connection"
+const DeactivateVPNConnection Topic = "deactivate_vpn_connection"
+const RemoveVPNConnection Topic = "remove_vpn_connection"
+
 const SystemReboot Topic = "system_reboot"
 const SystemShutdown Topic = "system_shutdown"
 const SystemRestartAgent Topic = "system_restart_agent"
@@ -42,6 +54,18 @@ const GetNetworkMetaData Topic = "get_network_metadata"
 
 const GetAgentMetaData Topic = "get_agent_metadata"
 
+// RenewDeviceCertificate is called by the backend to have the device rotate
+// its TLS client certificate.
+const RenewDeviceCertificate Topic = "renew_device_certificate"
+
+// RotateDeviceSecret is called by the backend to hand the device a new
+// WAMP-CRA secret, encrypted to it.
+const RotateDeviceSecret Topic = "rotate_device_secret"
+
+// QueryAuditLog returns the audit log of the remote operations executed on
+// the device.
+const QueryAuditLog Topic = "query_audit_log"
+
 const UpdateAgent Topic = "update_agent"
 
 const CmdExecutionPrefix Topic = "cmd_output"
@@ -1,3 +1,11 @@
 package topics
 
 const ReswarmDeviceList Topic = "reswarm.device.%d.list"
+
+// Signed privilege grants and revocations the backend pushes to the device
+// with the given device key.
+const PrivilegeGrants Topic = "reswarm.device.%d.privilege_grants"
+
+// Notice that the Docker daemon settings of the device with the given device
+// key changed; the device fetches them with GetDaemonConfig.
+const DaemonConfigChanged Topic = "reswarm.device.%d.daemon_config_changed"
@@ -0,0 +1,52 @@
+package messenger
+
+import (
+	"fmt"
+	"reagent/config"
+	"reagent/container"
+)
+
+// Transports selectable per device via ReswarmConfig.Transport.
+const (
+	TransportWAMP = "wamp"
+	TransportMQTT = "mqtt"
+)
+
+// Transport returns the transport configured for the device, defaulting to
+// WAMP.
+func Transport(cfg *config.Config) string {
+	if cfg.ReswarmConfig.Transport == "" {
+		return TransportWAMP
+	}
+
+	return cfg.ReswarmConfig.Transport
+}
+
+// Session is the agent's connection to the backend.
+type Session interface {
+	Messenger
+	EndpointReporter
+	SecretRotator
+	SetTunnelCapableFunc(fn func() bool)
+}
+
+// NewSession creates the session of the configured transport and establishes
+// its initial connection.
+func NewSession(cfg *config.Config, socketConfig *SocketConfig, container container.Container) (Session, error) {
+	switch Transport(cfg) {
+	case TransportWAMP:
+		session, err := NewWampSession(cfg, socketConfig, container, nil)
+		if err != nil {
+			return nil, err
+		}
+		return session, nil
+	case TransportMQTT:
+		session, err := NewMqttSession(cfg, socketConfig, container)
+		if err != nil {
+			return nil, err
+		}
+		return session, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %s", cfg.ReswarmConfig.Transport)
+	}
+}
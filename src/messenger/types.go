@@ -31,3 +31,15 @@ type Messenger interface {
 	SetOnConnect(cb func(reconnect bool))
 	Close()
 }
+
+// EndpointReporter is implemented by messengers that pick one of several
+// device endpoints to connect to.
+type EndpointReporter interface {
+	Endpoint() string
+}
+
+// SecretRotator is implemented by messengers that authenticate with the
+// device secret and can fall back to the previous one after it is rotated.
+type SecretRotator interface {
+	RotateSecret(rotation SecretRotation)
+}
@@ -2,7 +2,6 @@ package messenger
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"os"
@@ -15,11 +14,10 @@ import (
 	"reagent/common"
 	"reagent/config"
 	"reagent/container"
-	"reagent/diskguard"
 	"reagent/messenger/topics"
 
 	"github.com/gammazero/nexus/v3/client"
-	"github.com/gammazero/nexus/v3/transport"
+	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
 	"github.com/gammazero/nexus/v3/wamp/crsign"
 	"github.com/rs/zerolog"
@@ -66,10 +64,21 @@ type WampSession struct {
 	// agent so the heartbeat can carry it to the UI without a dedicated RPC.
 	// Nil until wired (the field is then omitted from the payload).
 	tunnelCapableFn func() bool
-
-	mu     sync.Mutex
-	ctx    context.Context
-	cancel context.CancelFunc
+	endpoints       *endpointPool
+	// secretRotation is the device secret change pending until the next
+	// connection; see RotateSecret.
+	secretRotation pendingSecretRotation
+
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	endpoint string // the device endpoint of the current connection
+	// serialization is the one the current connection negotiated.
+	serialization serialize.Serialization
+	connectedAt   time.Time // when the current connection was established
+	// reconnecting is set by Reconnect, so dropping the connection on purpose
+	// does not count against the endpoint's health.
+	reconnecting bool
 }
 
 // SetTunnelCapableFunc wires the per-device tunnel-capability getter into the
@@ -116,7 +125,7 @@ type ClientProvider func(ctx context.Context, url string, cfg client.Config) (Ne
 
 var legacyEndpointRegex = regexp.MustCompile(`devices.*\.(com|io):8080`)
 
-func createConnectConfig(cfg *config.Config, socketConfig *SocketConfig) (*client.Config, error) {
+func createConnectConfig(cfg *config.Config, socketConfig *SocketConfig, endpoint string) (*client.Config, error) {
 	reswarmConfig := cfg.ReswarmConfig
 
 	clientCfg := client.Config{
@@ -131,23 +140,22 @@ func createConnectConfig(cfg *config.Config, socketConfig *SocketConfig) (*clien
 		Logger: wampLogger{logger: &log.Logger},
 	}
 
-	if legacyEndpointRegex.Match([]byte(reswarmConfig.DeviceEndpointURL)) {
-		tlscert, err := tls.X509KeyPair([]byte(reswarmConfig.Authentication.Certificate), []byte(reswarmConfig.Authentication.Key))
-		if err != nil {
-			return nil, err
-		}
-		clientCfg.TlsCfg = &tls.Config{
-			Certificates:       []tls.Certificate{tlscert},
-			InsecureSkipVerify: true,
-		}
+	tlsConfig, err := buildTLSConfig(reswarmConfig, endpoint)
+	if err != nil {
+		return nil, err
 	}
+	clientCfg.TlsCfg = tlsConfig
 
 	if socketConfig.PingPongTimeout != 0 {
-		clientCfg.WsCfg = transport.WebsocketConfig{
-			KeepAlive: socketConfig.PingPongTimeout,
-		}
+		clientCfg.WsCfg.KeepAlive = socketConfig.PingPongTimeout
 	}
 
+	proxyURL, err := proxyFor(endpoint, cfg.CommandLineArguments.WampProxy)
+	if err != nil {
+		return nil, err
+	}
+	clientCfg.WsCfg.ProxyURL = proxyURL
+
 	if socketConfig.ResponseTimeout != 0 {
 		clientCfg.ResponseTimeout = socketConfig.ResponseTimeout
 	}
@@ -174,6 +182,7 @@ func NewWampSession(cfg *config.Config, socketConfig *SocketConfig, container co
 		socketConfig:   socketConfig,
 		container:      container,
 		clientProvider: clientProvider,
+		endpoints:      newEndpointPool(),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
@@ -209,6 +218,8 @@ func (s *WampSession) connect(isReconnect bool) error {
 	s.heartbeatDone = hbDone
 	s.mu.Unlock()
 
+	s.finishSecretRotation()
+
 	if s.socketConfig.SetupTestament {
 		if testErr := s.setupTestamentBounded(); testErr != nil {
 			if isReconnect {
@@ -279,6 +290,14 @@ func (s *WampSession) watchDisconnect(c NexusClient, hbDone chan struct{}) {
 		return
 	}
 
+	s.mu.Lock()
+	endpoint, connectedAt, deliberate := s.endpoint, s.connectedAt, s.reconnecting
+	s.reconnecting = false
+	s.mu.Unlock()
+	if !deliberate {
+		s.endpoints.disconnected(endpoint, time.Since(connectedAt))
+	}
+
 	s.cancelContainerStreams()
 
 	if err := s.connect(true); err != nil {
@@ -354,7 +373,11 @@ func (s *WampSession) startHeartbeat(hbDone chan struct{}) {
 // cancelContainerStreams runs container.CancelAllStreams in a bounded window
 // so a stuck Docker daemon cannot block reconnect.
 func (s *WampSession) cancelContainerStreams() {
-	if s.container == nil {
+	cancelContainerStreams(s.container)
+}
+
+func cancelContainerStreams(container container.Container) {
+	if container == nil {
 		return
 	}
 	done := make(chan error, 1)
@@ -364,7 +387,7 @@ func (s *WampSession) cancelContainerStreams() {
 				done <- fmt.Errorf("panic in CancelAllStreams: %+v", r)
 			}
 		}()
-		done <- s.container.CancelAllStreams()
+		done <- container.CancelAllStreams()
 	}()
 	select {
 	case err := <-done:
@@ -409,13 +432,25 @@ func (s *WampSession) dial() (NexusClient, error) {
 
 	log.Debug().Msg("Attempting to establish a socket connection...")
 
+	offered, err := serializations(s.agentConfig.CommandLineArguments.WampSerialization)
+	if err != nil {
+		log.Error().Err(err).Msg("falling back to JSON serialization")
+		offered = []serialize.Serialization{serialize.JSON}
+	}
+	// serializationIndex is the serialization to offer each endpoint next.
+	// A router that does not speak a binary serialization refuses the
+	// handshake, so such a dial moves on to the next one for that endpoint
+	// before the endpoint counts as failed.
+	serializationIndex := make(map[string]int)
+
 	dupRegisterFailures := 0
 	for attempt := 1; ; attempt++ {
 		if s.ctx.Err() != nil {
 			return nil, s.ctx.Err()
 		}
 
-		connectionConfig, err := createConnectConfig(s.agentConfig, s.socketConfig)
+		endpoint := s.endpoints.next(DeviceEndpoints(s.agentConfig.ReswarmConfig))
+		connectionConfig, err := createConnectConfig(s.agentConfig, s.socketConfig, endpoint)
 		if err != nil {
 			log.Error().Err(err).Msg("failed to create connect config")
 			if !s.sleepOrDone(reconnectBackoff) {
@@ -423,6 +458,8 @@ func (s *WampSession) dial() (NexusClient, error) {
 			}
 			continue
 		}
+		serialization := offered[serializationIndex[endpoint]]
+		connectionConfig.Serialization = serialization
 
 		dialCtx := s.ctx
 		var dialCancel context.CancelFunc
@@ -430,12 +467,16 @@ func (s *WampSession) dial() (NexusClient, error) {
 			dialCtx, dialCancel = context.WithTimeout(s.ctx, s.socketConfig.ConnectionTimeout)
 		}
 
+		if connectionConfig.WsCfg.ProxyURL != "" {
+			log.Debug().Msgf("Connecting to %s through proxy %s", endpoint, redactProxy(connectionConfig.WsCfg.ProxyURL))
+		}
+
 		requestStart := time.Now()
 		var c NexusClient
 		if s.clientProvider != nil {
-			c, err = s.clientProvider(dialCtx, s.agentConfig.ReswarmConfig.DeviceEndpointURL, *connectionConfig)
+			c, err = s.clientProvider(dialCtx, endpoint, *connectionConfig)
 		} else {
-			c, err = client.ConnectNet(dialCtx, s.agentConfig.ReswarmConfig.DeviceEndpointURL, *connectionConfig)
+			c, err = client.ConnectNet(dialCtx, endpoint, *connectionConfig)
 		}
 		if dialCancel != nil {
 			dialCancel()
@@ -443,10 +484,20 @@ func (s *WampSession) dial() (NexusClient, error) {
 
 		if err != nil {
 			if strings.Contains(err.Error(), "WAMP-CRA client signature is invalid") {
+				if s.revertSecretRotation() {
+					continue
+				}
 				fmt.Println("The IronFlock device connect authentication failed")
 				os.Exit(1)
 			}
-			log.Debug().Err(err).Msgf("Failed to establish a websocket connection (duration: %s, attempt #%d), reattempting in %s", time.Since(requestStart), attempt, reconnectBackoff)
+			if serializerRejected(err) && serializationIndex[endpoint] < len(offered)-1 {
+				serializationIndex[endpoint]++
+				log.Debug().Err(err).Msgf("Failed to connect to %s with %s serialization, trying %s", endpoint, serializationName(serialization), serializationName(offered[serializationIndex[endpoint]]))
+				continue
+			}
+			delete(serializationIndex, endpoint)
+			s.endpoints.failed(endpoint)
+			log.Debug().Err(err).Msgf("Failed to establish a websocket connection to %s (duration: %s, attempt #%d), reattempting in %s", endpoint, time.Since(requestStart), attempt, reconnectBackoff)
 			if !s.sleepOrDone(reconnectBackoff) {
 				return nil, s.ctx.Err()
 			}
@@ -491,7 +542,7 @@ func (s *WampSession) dial() (NexusClient, error) {
 
 		onDestroyListener := func(_ *wamp.Event) {
 			if s.container != nil {
-				s.container.PruneSystem()
+				s.container.PruneSystem(context.Background())
 			}
 			os.Exit(1)
 		}
@@ -499,7 +550,14 @@ func (s *WampSession) dial() (NexusClient, error) {
 			log.Debug().Err(subErr).Msg("ondestroy Subscribe failed (non-fatal)")
 		}
 
-		log.Debug().Msgf("Successfully established a connection (duration: %s)", time.Since(requestStart))
+		s.endpoints.succeeded(endpoint)
+		s.mu.Lock()
+		s.endpoint = endpoint
+		s.serialization = serialization
+		s.connectedAt = time.Now()
+		s.mu.Unlock()
+
+		log.Debug().Msgf("Successfully established a connection to %s with %s serialization (duration: %s)", endpoint, serializationName(serialization), time.Since(requestStart))
 		return c, nil
 	}
 }
@@ -507,12 +565,16 @@ func (s *WampSession) dial() (NexusClient, error) {
 // sleepOrDone sleeps for d, returning false if the session context is
 // cancelled before the sleep completes.
 func (s *WampSession) sleepOrDone(d time.Duration) bool {
+	return sleepOrDone(s.ctx, d)
+}
+
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
 	t := time.NewTimer(d)
 	defer t.Stop()
 	select {
 	case <-t.C:
 		return true
-	case <-s.ctx.Done():
+	case <-ctx.Done():
 		return false
 	}
 }
@@ -640,6 +702,11 @@ func (s *WampSession) GetSessionID() uint64 {
 }
 
 func (s *WampSession) Register(topic topics.Topic, cb func(ctx context.Context, invocation Result) (*InvokeResult, error), options common.Dict) error {
+	c := s.currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+
 	invocationHandler := func(ctx context.Context, invocation *wamp.Invocation) client.InvokeResult {
 		cbInvocationMap := Result{
 			Request:      uint64(invocation.Request),
@@ -649,7 +716,16 @@ func (s *WampSession) Register(topic topics.Topic, cb func(ctx context.Context,
 			ArgumentsKw:  common.Dict(invocation.ArgumentsKw),
 		}
 
-		resultMap, invokeErr := cb(ctx, cbInvocationMap)
+		// ctx is cancelled when the caller cancels the call. The client
+		// finds the invocation to send progressive results for by it.
+		handlerCtx := ctx
+		if receiveProgress, _ := invocation.Details["receive_progress"].(bool); receiveProgress {
+			handlerCtx = WithProgress(ctx, func(args []interface{}, kwargs common.Dict) error {
+				return c.SendProgress(ctx, args, wamp.Dict(kwargs))
+			})
+		}
+
+		resultMap, invokeErr := cb(handlerCtx, cbInvocationMap)
 		if invokeErr != nil {
 			log.Error().Stack().Err(invokeErr).Msgf("An error occured during invocation of %s", topic)
 			return client.InvokeResult{
@@ -663,11 +739,6 @@ func (s *WampSession) Register(topic topics.Topic, cb func(ctx context.Context,
 		return client.InvokeResult{Args: resultMap.Arguments, Kwargs: wamp.Dict(resultMap.ArgumentsKw)}
 	}
 
-	c := s.currentClient()
-	if c == nil {
-		return ErrNotConnected
-	}
-
 	return c.Register(string(topic), invocationHandler, wamp.Dict{"force_reregister": true})
 }
 
@@ -717,6 +788,9 @@ func (s *WampSession) SetupTestament() error {
 func (s *WampSession) Reconnect() {
 	s.mu.Lock()
 	c := s.client
+	if c != nil {
+		s.reconnecting = true
+	}
 	s.mu.Unlock()
 
 	if c == nil {
@@ -728,6 +802,22 @@ func (s *WampSession) Reconnect() {
 	_ = c.Close()
 }
 
+// Endpoint returns the device endpoint the session is connected to, or the
+// one it was last connected to while it reconnects.
+func (s *WampSession) Endpoint() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.endpoint
+}
+
+// Serialization returns the serialization of the current connection: msgpack,
+// cbor or json.
+func (s *WampSession) Serialization() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return serializationName(s.serialization)
+}
+
 // Close cancels the session's reconnect loop and closes the underlying
 // client. Safe to call multiple times.
 func (s *WampSession) Close() {
@@ -750,63 +840,18 @@ func clientAuthFunc(deviceSecret string) func(c *wamp.Challenge) (string, wamp.D
 }
 
 func (s *WampSession) UpdateRemoteDeviceStatus(status DeviceStatus) error {
-	cfg := s.GetConfig()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// While the device is in a disk-emergency, report EMERGENCY in place of the
-	// healthy CONNECTED status so the cloud/UI can flag it (see package diskguard).
-	if status == CONNECTED && diskguard.IsEmergency() {
-		status = EMERGENCY
-	}
-
-	stats := common.GetStats()
-
-	payload := common.Dict{
-		"swarm_key":       cfg.ReswarmConfig.SwarmKey,
-		"device_key":      cfg.ReswarmConfig.DeviceKey,
-		"status":          string(status),
-		"wamp_session_id": s.GetSessionID(),
-		"stats": common.Dict{
-			"cpu_count":           stats.CPUCount,
-			"cpu_usage":           stats.CPUUsagePercent,
-			"memory_total":        stats.MemoryTotal,
-			"memory_used":         stats.MemoryUsed,
-			"memory_available":    stats.MemoryAvailable,
-			"storage_total":       stats.StorageTotal,
-			"storage_used":        stats.StorageUsed,
-			"storage_free":        stats.StorageFree,
-			"docker_apps_total":   stats.DockerAppsTotal,
-			"docker_apps_used":    stats.DockerAppsUsed,
-			"docker_apps_free":    stats.DockerAppsFree,
-			"docker_apps_mounted": stats.DockerAppsMounted,
-		},
-	}
-
-	// Carry per-device tunnel capability on the heartbeat so the UI reflects it
-	// live (~30s) without a dedicated get_agent_metadata call. The backend
-	// forwards it to the devices store verbatim.
-	if s.tunnelCapableFn != nil {
-		payload["tunnel_capable"] = s.tunnelCapableFn()
-	}
-
+	payload := deviceStatusPayload(s.GetConfig(), status, s.GetSessionID(), s.tunnelCapableFn)
+	// lets the backend send write_data chunks as bytes and compare the
+	// traffic of devices per serialization
+	payload["serialization"] = s.Serialization()
 	res, err := s.Call(ctx, topics.UpdateDeviceStatus, []any{payload}, nil, nil, nil)
 	if err != nil {
 		return err
 	}
 
-	if res.Arguments == nil || res.Arguments[0] == nil {
-		return nil
-	}
-
-	args, ok := res.Arguments[0].(map[string]any)
-	if !ok {
-		return nil
-	}
-
-	if reswarmBaseURL := fmt.Sprint(args["reswarmBaseURL"]); reswarmBaseURL != "" {
-		s.agentConfig.ReswarmConfig.ReswarmBaseURL = reswarmBaseURL
-	}
-
+	applyDeviceStatusReply(s.GetConfig(), res)
 	return nil
 }
@@ -52,3 +52,23 @@ func (dw DummyNetwork) SetInfiniteAutoconnectRetries() error {
 func (dw DummyNetwork) Reload() error {
 	return nil
 }
+
+func (dw DummyNetwork) ListVPNConnections() ([]VPNConnection, error) {
+	return []VPNConnection{}, nil
+}
+
+func (dw DummyNetwork) ImportVPNConnection(configuration VPNConfiguration) (VPNConnection, error) {
+	return VPNConnection{}, nil
+}
+
+func (dw DummyNetwork) ActivateVPNConnection(uuid string) error {
+	return nil
+}
+
+func (dw DummyNetwork) DeactivateVPNConnection(uuid string) error {
+	return nil
+}
+
+func (dw DummyNetwork) RemoveVPNConnection(uuid string) error {
+	return nil
+}
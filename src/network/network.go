@@ -64,6 +64,11 @@ type Network interface {
 	AddWiFi(mac string, credentials WiFiCredentials) error
 	SetInfiniteAutoconnectRetries() error
 	Reload() error
+	ListVPNConnections() ([]VPNConnection, error)
+	ImportVPNConnection(configuration VPNConfiguration) (VPNConnection, error)
+	ActivateVPNConnection(uuid string) error
+	DeactivateVPNConnection(uuid string) error
+	RemoveVPNConnection(uuid string) error
 }
 
 var ErrDeviceNotFound = errors.New("device not found")
@@ -0,0 +1,351 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reagent/errdefs"
+	"reagent/networkmanager"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// nmcli reports the imported profile as: Connection 'name' (<uuid>) successfully added.
+var importedConnectionRegex = regexp.MustCompile(`\(([0-9a-fA-F-]{36})\)`)
+
+func (n NWMNetwork) ListVPNConnections() ([]VPNConnection, error) {
+	connections, err := n.settings.ListConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	activeConnections, err := n.getActiveConnectionsByUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	vpnConnections := []VPNConnection{}
+	for _, connection := range connections {
+		settings, err := connection.GetSettings()
+		if err != nil {
+			continue
+		}
+
+		vpnType := vpnTypeFromSettings(settings)
+		if vpnType == "" {
+			continue
+		}
+
+		vpnConnections = append(vpnConnections, n.toVPNConnection(settings, vpnType, activeConnections))
+	}
+
+	return vpnConnections, nil
+}
+
+func (n NWMNetwork) ImportVPNConnection(configuration VPNConfiguration) (VPNConnection, error) {
+	var connection networkmanager.Connection
+	var err error
+
+	switch configuration.Type {
+	case VPNTypeWireGuard:
+		var settings networkmanager.ConnectionSettings
+		settings, err = ParseWireGuardConfig(configuration.Name, configuration.Config)
+		if err != nil {
+			return VPNConnection{}, err
+		}
+
+		connection, err = n.settings.AddConnection(settings)
+	case VPNTypeOpenVPN:
+		connection, err = n.importOpenVPN(configuration)
+	default:
+		return VPNConnection{}, fmt.Errorf("%w: %s", ErrUnsupportedVPNType, configuration.Type)
+	}
+
+	if err != nil {
+		return VPNConnection{}, err
+	}
+
+	settings, err := connection.GetSettings()
+	if err != nil {
+		return VPNConnection{}, err
+	}
+
+	activeConnections, err := n.getActiveConnectionsByUUID()
+	if err != nil {
+		return VPNConnection{}, err
+	}
+
+	return n.toVPNConnection(settings, configuration.Type, activeConnections), nil
+}
+
+// importOpenVPN hands the .ovpn file to the NetworkManager OpenVPN plugin, which knows how to extract
+// inline certificates and keys, and then adjusts the imported profile to our needs.
+func (n NWMNetwork) importOpenVPN(configuration VPNConfiguration) (networkmanager.Connection, error) {
+	if configuration.Name == "" || configuration.Config == "" {
+		return nil, fmt.Errorf("%w: name and config are required", ErrInvalidVPNConfig)
+	}
+
+	tempDir, err := os.MkdirTemp("", "reagent-vpn")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	fileName := invalidInterfaceNameChars.ReplaceAllString(configuration.Name, "")
+	if fileName == "" {
+		fileName = "openvpn"
+	}
+
+	configPath := filepath.Join(tempDir, fileName+".ovpn")
+	err = os.WriteFile(configPath, []byte(configuration.Config), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := exec.Command("nmcli", "connection", "import", "type", "openvpn", "file", configPath).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidVPNConfig, strings.TrimSpace(string(output)))
+	}
+
+	matches := importedConnectionRegex.FindStringSubmatch(string(output))
+	if len(matches) < 2 {
+		return nil, fmt.Errorf("failed to parse imported connection from nmcli output: %s", strings.TrimSpace(string(output)))
+	}
+
+	connection, err := n.settings.GetConnectionByUUID(matches[1])
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := connection.GetSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	removeLegacyAddressSettings(settings)
+
+	settings["connection"]["id"] = configuration.Name
+	settings["connection"]["autoconnect"] = true
+	// keep the tunnel up across transient uplink outages (default would stop after 4 tries)
+	settings["connection"]["autoconnect-retries"] = int32(0)
+
+	if configuration.Username != "" {
+		data, _ := settings["vpn"]["data"].(map[string]string)
+		if data == nil {
+			data = make(map[string]string)
+		}
+
+		data["username"] = configuration.Username
+		switch data["connection-type"] {
+		case "tls":
+			data["connection-type"] = "password-tls"
+		case "":
+			data["connection-type"] = "password"
+		}
+
+		if configuration.Password != "" {
+			// Update replaces the profile including its secrets, keep the ones the plugin imported
+			secrets := make(map[string]string)
+			if existing, err := connection.GetSecrets("vpn"); err == nil && existing["vpn"] != nil {
+				if existingSecrets, ok := existing["vpn"]["secrets"].(map[string]string); ok {
+					for key, value := range existingSecrets {
+						secrets[key] = value
+					}
+				}
+			}
+
+			secrets["password"] = configuration.Password
+			data["password-flags"] = "0" // stored by NetworkManager, no agent required
+			settings["vpn"]["secrets"] = secrets
+		}
+
+		settings["vpn"]["data"] = data
+	}
+
+	err = connection.Update(settings)
+	if err != nil {
+		// don't leave a half configured profile behind
+		if deleteErr := connection.Delete(); deleteErr != nil {
+			log.Error().Err(deleteErr).Msgf("failed to remove imported vpn connection %s", configuration.Name)
+		}
+		return nil, err
+	}
+
+	return connection, nil
+}
+
+// ActivateVPNConnection brings the VPN up and marks it to autoconnect, so it is restored after reboots and uplink changes.
+func (n NWMNetwork) ActivateVPNConnection(uuid string) error {
+	connection, _, err := n.getVPNConnectionByUUID(uuid)
+	if err != nil {
+		return err
+	}
+
+	err = n.setAutoconnect(connection, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.nm.ActivateConnection(connection, nil, "/")
+	return err
+}
+
+// DeactivateVPNConnection takes the VPN down and disables autoconnect, so it stays down until activated again.
+func (n NWMNetwork) DeactivateVPNConnection(uuid string) error {
+	connection, _, err := n.getVPNConnectionByUUID(uuid)
+	if err != nil {
+		return err
+	}
+
+	err = n.setAutoconnect(connection, false)
+	if err != nil {
+		return err
+	}
+
+	activeConnections, err := n.getActiveConnectionsByUUID()
+	if err != nil {
+		return err
+	}
+
+	activeConnection := activeConnections[uuid]
+	if activeConnection == nil {
+		return nil
+	}
+
+	return n.nm.DeactivateConnection(activeConnection)
+}
+
+func (n NWMNetwork) RemoveVPNConnection(uuid string) error {
+	connection, _, err := n.getVPNConnectionByUUID(uuid)
+	if err != nil {
+		return err
+	}
+
+	// deleting an active profile tears the tunnel down as well
+	return connection.Delete()
+}
+
+func (n NWMNetwork) getVPNConnectionByUUID(uuid string) (networkmanager.Connection, VPNType, error) {
+	connection, err := n.settings.GetConnectionByUUID(uuid)
+	if err != nil {
+		return nil, "", errdefs.ErrNotFound
+	}
+
+	settings, err := connection.GetSettings()
+	if err != nil {
+		return nil, "", err
+	}
+
+	vpnType := vpnTypeFromSettings(settings)
+	if vpnType == "" {
+		// only VPN profiles can be managed through this API
+		return nil, "", errdefs.ErrNotFound
+	}
+
+	return connection, vpnType, nil
+}
+
+func (n NWMNetwork) setAutoconnect(connection networkmanager.Connection, autoconnect bool) error {
+	settings, err := connection.GetSettings()
+	if err != nil {
+		return err
+	}
+
+	if current, ok := settings["connection"]["autoconnect"].(bool); ok && current == autoconnect {
+		return nil
+	}
+
+	// autoconnect is omitted from the settings while it has its default value (true)
+	if _, ok := settings["connection"]["autoconnect"]; !ok && autoconnect {
+		return nil
+	}
+
+	removeLegacyAddressSettings(settings)
+	settings["connection"]["autoconnect"] = autoconnect
+	settings["connection"]["autoconnect-retries"] = int32(0)
+
+	return connection.Update(settings)
+}
+
+func (n NWMNetwork) getActiveConnectionsByUUID() (map[string]networkmanager.ActiveConnection, error) {
+	activeConnections, err := n.nm.GetPropertyActiveConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	activeConnectionsByUUID := make(map[string]networkmanager.ActiveConnection, len(activeConnections))
+	for _, activeConnection := range activeConnections {
+		uuid, err := activeConnection.GetPropertyUUID()
+		if err != nil {
+			continue
+		}
+
+		activeConnectionsByUUID[uuid] = activeConnection
+	}
+
+	return activeConnectionsByUUID, nil
+}
+
+func (n NWMNetwork) toVPNConnection(settings networkmanager.ConnectionSettings, vpnType VPNType, activeConnections map[string]networkmanager.ActiveConnection) VPNConnection {
+	connSettings := settings["connection"]
+
+	vpnConnection := VPNConnection{
+		UUID:        fmt.Sprint(connSettings["uuid"]),
+		Name:        fmt.Sprint(connSettings["id"]),
+		Type:        vpnType,
+		Autoconnect: true,
+		State:       "inactive",
+	}
+
+	if autoconnect, ok := connSettings["autoconnect"].(bool); ok {
+		vpnConnection.Autoconnect = autoconnect
+	}
+
+	activeConnection := activeConnections[vpnConnection.UUID]
+	if activeConnection == nil {
+		return vpnConnection
+	}
+
+	vpnConnection.Active = true
+
+	state, err := activeConnection.GetPropertyState()
+	if err == nil {
+		vpnConnection.State = activeConnectionStateName(state)
+	}
+
+	// plugin based VPNs (OpenVPN) expose a more detailed state and the server banner
+	if vpnType == VPNTypeOpenVPN {
+		vpn, err := networkmanager.NewVpnConnection(activeConnection.GetPath())
+		if err != nil {
+			return vpnConnection
+		}
+
+		vpnState, err := vpn.GetPropertyVpnState()
+		if err == nil {
+			vpnConnection.State = vpnConnectionStateName(vpnState)
+		}
+
+		banner, err := vpn.GetPropertyBanner()
+		if err == nil {
+			vpnConnection.Banner = banner
+		}
+	}
+
+	return vpnConnection
+}
+
+// removeLegacyAddressSettings drops the deprecated address/route properties, which don't survive
+// the round trip through GetSettings; NetworkManager rebuilds them from address-data and route-data.
+func removeLegacyAddressSettings(settings networkmanager.ConnectionSettings) {
+	for _, ipSetting := range []string{"ipv4", "ipv6"} {
+		if settings[ipSetting] == nil {
+			continue
+		}
+
+		delete(settings[ipSetting], "addresses")
+		delete(settings[ipSetting], "routes")
+	}
+}
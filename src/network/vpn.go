@@ -0,0 +1,334 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reagent/networkmanager"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type VPNType string
+
+const (
+	VPNTypeWireGuard VPNType = "wireguard"
+	VPNTypeOpenVPN   VPNType = "openvpn"
+)
+
+// NetworkManager connection types / VPN plugin used for the VPN profiles we manage
+const (
+	nmConnectionTypeWireGuard = "wireguard"
+	nmConnectionTypeVPN       = "vpn"
+	nmOpenVPNServiceType      = "org.freedesktop.NetworkManager.openvpn"
+)
+
+// VPNConnection is a VPN profile known to NetworkManager as reported to the backend.
+// It deliberately carries no key material or passwords.
+type VPNConnection struct {
+	UUID        string
+	Name        string
+	Type        VPNType
+	Autoconnect bool
+	Active      bool
+	State       string // activation state, e.g. "activated" or "activating"; "inactive" when not active
+	Banner      string // login banner pushed by the VPN server (OpenVPN only)
+}
+
+// VPNConfiguration is a VPN profile to import. Config holds the raw wg-quick (WireGuard) or .ovpn (OpenVPN) file.
+type VPNConfiguration struct {
+	Name     string
+	Type     VPNType
+	Config   string
+	Username string // optional, OpenVPN user/password authentication
+	Password string
+}
+
+var ErrUnsupportedVPNType = errors.New("unsupported vpn type")
+var ErrInvalidVPNConfig = errors.New("invalid vpn configuration")
+
+// interface names are limited to 15 characters (IFNAMSIZ - 1)
+const maxInterfaceNameLength = 15
+
+var invalidInterfaceNameChars = regexp.MustCompile(`[^a-zA-Z0-9_=+.-]`)
+
+// wireGuardInterfaceName derives a valid kernel interface name from the connection name
+func wireGuardInterfaceName(name string) string {
+	ifname := invalidInterfaceNameChars.ReplaceAllString(name, "")
+	if ifname == "" {
+		ifname = "wg0"
+	}
+
+	if len(ifname) > maxInterfaceNameLength {
+		ifname = ifname[:maxInterfaceNameLength]
+	}
+
+	return ifname
+}
+
+// ParseWireGuardConfig converts a wg-quick style configuration into NetworkManager connection settings.
+// See https://networkmanager.dev/docs/api/latest/settings-wireguard.html
+func ParseWireGuardConfig(name string, config string) (networkmanager.ConnectionSettings, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidVPNConfig)
+	}
+
+	wireguard := map[string]interface{}{
+		"private-key-flags": uint32(0),
+	}
+	ipv4 := map[string]interface{}{}
+	ipv6 := map[string]interface{}{}
+
+	var ipv4AddressData []map[string]interface{}
+	var ipv6AddressData []map[string]interface{}
+	var ipv4DNS []uint32
+	var dnsSearch []string
+	var peers []map[string]interface{}
+	var peer map[string]interface{}
+
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			switch section {
+			case "interface":
+			case "peer":
+				peer = map[string]interface{}{"preshared-key-flags": uint32(0)}
+				peers = append(peers, peer)
+			default:
+				return nil, fmt.Errorf("%w: unknown section [%s] on line %d", ErrInvalidVPNConfig, section, lineNumber)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%w: expected key = value on line %d", ErrInvalidVPNConfig, lineNumber)
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch section {
+		case "interface":
+			switch key {
+			case "privatekey":
+				wireguard["private-key"] = value
+			case "listenport":
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("%w: invalid ListenPort on line %d", ErrInvalidVPNConfig, lineNumber)
+				}
+				wireguard["listen-port"] = uint32(port)
+			case "mtu":
+				mtu, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%w: invalid MTU on line %d", ErrInvalidVPNConfig, lineNumber)
+				}
+				wireguard["mtu"] = uint32(mtu)
+			case "address":
+				for _, address := range splitList(value) {
+					ip, ipNet, err := net.ParseCIDR(address)
+					if err != nil {
+						ip = net.ParseIP(address)
+						if ip == nil {
+							return nil, fmt.Errorf("%w: invalid Address %s on line %d", ErrInvalidVPNConfig, address, lineNumber)
+						}
+					}
+
+					if ip.To4() != nil {
+						prefix := uint32(32)
+						if ipNet != nil {
+							ones, _ := ipNet.Mask.Size()
+							prefix = uint32(ones)
+						}
+						ipv4AddressData = append(ipv4AddressData, map[string]interface{}{"address": ip.String(), "prefix": prefix})
+					} else {
+						prefix := uint32(128)
+						if ipNet != nil {
+							ones, _ := ipNet.Mask.Size()
+							prefix = uint32(ones)
+						}
+						ipv6AddressData = append(ipv6AddressData, map[string]interface{}{"address": ip.String(), "prefix": prefix})
+					}
+				}
+			case "dns":
+				for _, entry := range splitList(value) {
+					ip := net.ParseIP(entry)
+					if ip == nil {
+						// wg-quick allows search domains in the DNS list
+						dnsSearch = append(dnsSearch, entry)
+						continue
+					}
+
+					if ip.To4() != nil {
+						ipv4DNS = append(ipv4DNS, ip2Long(entry))
+					}
+				}
+			case "table", "preup", "postup", "predown", "postdown", "saveconfig", "fwmark":
+				// wg-quick specific, no NetworkManager equivalent
+			default:
+				return nil, fmt.Errorf("%w: unknown key %s in [Interface] on line %d", ErrInvalidVPNConfig, key, lineNumber)
+			}
+		case "peer":
+			switch key {
+			case "publickey":
+				peer["public-key"] = value
+			case "presharedkey":
+				peer["preshared-key"] = value
+			case "endpoint":
+				peer["endpoint"] = value
+			case "allowedips":
+				peer["allowed-ips"] = splitList(value)
+			case "persistentkeepalive":
+				keepalive, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("%w: invalid PersistentKeepalive on line %d", ErrInvalidVPNConfig, lineNumber)
+				}
+				peer["persistent-keepalive"] = uint32(keepalive)
+			default:
+				return nil, fmt.Errorf("%w: unknown key %s in [Peer] on line %d", ErrInvalidVPNConfig, key, lineNumber)
+			}
+		default:
+			return nil, fmt.Errorf("%w: key outside of a section on line %d", ErrInvalidVPNConfig, lineNumber)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if wireguard["private-key"] == nil {
+		return nil, fmt.Errorf("%w: [Interface] PrivateKey is missing", ErrInvalidVPNConfig)
+	}
+
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%w: at least one [Peer] is required", ErrInvalidVPNConfig)
+	}
+
+	for i, p := range peers {
+		if p["public-key"] == nil {
+			return nil, fmt.Errorf("%w: PublicKey of peer %d is missing", ErrInvalidVPNConfig, i+1)
+		}
+	}
+
+	wireguard["peers"] = peers
+
+	if len(ipv4AddressData) > 0 {
+		ipv4["method"] = "manual"
+		ipv4["address-data"] = ipv4AddressData
+		if len(ipv4DNS) > 0 {
+			ipv4["dns"] = ipv4DNS
+		}
+		if len(dnsSearch) > 0 {
+			ipv4["dns-search"] = dnsSearch
+		}
+	} else {
+		ipv4["method"] = "disabled"
+	}
+
+	if len(ipv6AddressData) > 0 {
+		ipv6["method"] = "manual"
+		ipv6["address-data"] = ipv6AddressData
+	} else {
+		ipv6["method"] = "ignore"
+	}
+
+	settings := make(networkmanager.ConnectionSettings)
+	settings["connection"] = map[string]interface{}{
+		"id":             name,
+		"uuid":           uuid.NewString(),
+		"type":           nmConnectionTypeWireGuard,
+		"interface-name": wireGuardInterfaceName(name),
+		"autoconnect":    true,
+		// keep the tunnel up across transient uplink outages (default would stop after 4 tries)
+		"autoconnect-retries": int32(0),
+	}
+	settings["wireguard"] = wireguard
+	settings["ipv4"] = ipv4
+	settings["ipv6"] = ipv6
+
+	return settings, nil
+}
+
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// vpnTypeFromSettings returns the VPN type of a connection profile, or "" if it is not a VPN we manage
+func vpnTypeFromSettings(settings networkmanager.ConnectionSettings) VPNType {
+	connSettings := settings["connection"]
+	if connSettings == nil {
+		return ""
+	}
+
+	switch fmt.Sprint(connSettings["type"]) {
+	case nmConnectionTypeWireGuard:
+		return VPNTypeWireGuard
+	case nmConnectionTypeVPN:
+		if settings["vpn"] != nil && fmt.Sprint(settings["vpn"]["service-type"]) == nmOpenVPNServiceType {
+			return VPNTypeOpenVPN
+		}
+	}
+
+	return ""
+}
+
+func activeConnectionStateName(state networkmanager.NmActiveConnectionState) string {
+	switch state {
+	case networkmanager.NmActiveConnectionStateActivating:
+		return "activating"
+	case networkmanager.NmActiveConnectionStateActivated:
+		return "activated"
+	case networkmanager.NmActiveConnectionStateDeactivating:
+		return "deactivating"
+	case networkmanager.NmActiveConnectionStateDeactivated:
+		return "deactivated"
+	default:
+		return "unknown"
+	}
+}
+
+func vpnConnectionStateName(state networkmanager.NmVpnConnectionState) string {
+	switch state {
+	case networkmanager.NmVpnConnectionPrepare:
+		return "preparing"
+	case networkmanager.NmVpnConnectionNeedAuth:
+		return "need_auth"
+	case networkmanager.NmVpnConnectionConnect:
+		return "connecting"
+	case networkmanager.NmVpnConnectionIpConfigGet:
+		return "ip_config"
+	case networkmanager.NmVpnConnectionActivated:
+		return "activated"
+	case networkmanager.NmVpnConnectionFailed:
+		return "failed"
+	case networkmanager.NmVpnConnectionDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
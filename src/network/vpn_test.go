@@ -0,0 +1,113 @@
+package network
+
+import (
+	"errors"
+	"reagent/networkmanager"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const wireGuardConfig = `
+[Interface]
+# device address inside the site network
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.8.0.2/24, fd00::2/64
+DNS = 10.8.0.1, corp.example
+ListenPort = 51820
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = /UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=
+AllowedIPs = 10.8.0.0/24, 192.168.10.0/24
+Endpoint = vpn.example.com:51820
+PersistentKeepalive = 25
+`
+
+// ParseWireGuardConfig maps every wg-quick key onto its NetworkManager setting.
+func TestParseWireGuardConfig(t *testing.T) {
+	settings, err := ParseWireGuardConfig("site-vpn", wireGuardConfig)
+	require.NoError(t, err)
+
+	connection := settings["connection"]
+	assert.Equal(t, "site-vpn", connection["id"])
+	assert.Equal(t, "wireguard", connection["type"])
+	assert.Equal(t, "site-vpn", connection["interface-name"])
+	assert.Equal(t, true, connection["autoconnect"])
+	assert.Equal(t, int32(0), connection["autoconnect-retries"])
+	assert.NotEmpty(t, connection["uuid"])
+
+	wireguard := settings["wireguard"]
+	assert.Equal(t, "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", wireguard["private-key"])
+	assert.Equal(t, uint32(51820), wireguard["listen-port"])
+
+	peers := wireguard["peers"].([]map[string]interface{})
+	require.Len(t, peers, 1)
+	assert.Equal(t, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", peers[0]["public-key"])
+	assert.Equal(t, "/UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=", peers[0]["preshared-key"])
+	assert.Equal(t, "vpn.example.com:51820", peers[0]["endpoint"])
+	assert.Equal(t, []string{"10.8.0.0/24", "192.168.10.0/24"}, peers[0]["allowed-ips"])
+	assert.Equal(t, uint32(25), peers[0]["persistent-keepalive"])
+
+	ipv4 := settings["ipv4"]
+	assert.Equal(t, "manual", ipv4["method"])
+	assert.Equal(t, []map[string]interface{}{{"address": "10.8.0.2", "prefix": uint32(24)}}, ipv4["address-data"])
+	assert.Equal(t, []uint32{ip2Long("10.8.0.1")}, ipv4["dns"])
+	assert.Equal(t, []string{"corp.example"}, ipv4["dns-search"])
+
+	ipv6 := settings["ipv6"]
+	assert.Equal(t, "manual", ipv6["method"])
+	assert.Equal(t, []map[string]interface{}{{"address": "fd00::2", "prefix": uint32(64)}}, ipv6["address-data"])
+}
+
+func TestParseWireGuardConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"missing private key", "[Interface]\nAddress = 10.0.0.2/32\n[Peer]\nPublicKey = abc"},
+		{"missing peer", "[Interface]\nPrivateKey = abc"},
+		{"peer without public key", "[Interface]\nPrivateKey = abc\n[Peer]\nEndpoint = a:1"},
+		{"unknown section", "[Foo]\nBar = baz"},
+		{"key outside section", "PrivateKey = abc"},
+		{"unknown key", "[Interface]\nPrivateKey = abc\nFoo = bar\n[Peer]\nPublicKey = abc"},
+		{"invalid address", "[Interface]\nPrivateKey = abc\nAddress = nope\n[Peer]\nPublicKey = abc"},
+		{"invalid keepalive", "[Interface]\nPrivateKey = abc\n[Peer]\nPublicKey = abc\nPersistentKeepalive = x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseWireGuardConfig("wg", tt.config)
+			assert.True(t, errors.Is(err, ErrInvalidVPNConfig), "got %v", err)
+		})
+	}
+
+	_, err := ParseWireGuardConfig("", wireGuardConfig)
+	assert.ErrorIs(t, err, ErrInvalidVPNConfig)
+}
+
+// Interface names are capped at 15 characters and stripped of characters the kernel rejects.
+func TestWireGuardInterfaceName(t *testing.T) {
+	assert.Equal(t, "wg0", wireGuardInterfaceName("???"))
+	assert.Equal(t, "sitevpn", wireGuardInterfaceName("site vpn"))
+	assert.Equal(t, "a-very-long-int", wireGuardInterfaceName("a-very-long-interface-name"))
+}
+
+func TestVPNTypeFromSettings(t *testing.T) {
+	assert.Equal(t, VPNTypeWireGuard, vpnTypeFromSettings(networkmanager.ConnectionSettings{
+		"connection": {"type": "wireguard"},
+	}))
+	assert.Equal(t, VPNTypeOpenVPN, vpnTypeFromSettings(networkmanager.ConnectionSettings{
+		"connection": {"type": "vpn"},
+		"vpn":        {"service-type": "org.freedesktop.NetworkManager.openvpn"},
+	}))
+	assert.Equal(t, VPNType(""), vpnTypeFromSettings(networkmanager.ConnectionSettings{
+		"connection": {"type": "vpn"},
+		"vpn":        {"service-type": "org.freedesktop.NetworkManager.vpnc"},
+	}))
+	assert.Equal(t, VPNType(""), vpnTypeFromSettings(networkmanager.ConnectionSettings{
+		"connection": {"type": "802-11-wireless"},
+	}))
+}
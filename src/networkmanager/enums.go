@@ -171,18 +171,17 @@ const (
 	Nm80211ModeAp      Nm80211Mode = 3
 )
 
-//go:generate stringer -type=NmActiveConnectionState
 type NmVpnConnectionState uint32
 
 const (
-	NmVpnConnectionUnknown      = 0 //The state of the VPN connection is unknown.
-	NmVpnConnectionPrepare      = 1 //The VPN connection is preparing to connect.
-	NmVpnConnectionNeedAuth     = 2 //The VPN connection needs authorization credentials.
-	NmVpnConnectionConnect      = 3 //The VPN connection is being established.
-	NmVpnConnectionIpConfigGet  = 4 //The VPN connection is getting an IP address.
-	NmVpnConnectionActivated    = 5 //The VPN connection is active.
-	NmVpnConnectionFailed       = 6 //The VPN connection failed.
-	NmVpnConnectionDisconnected = 7 //The VPN connection is disconnected.
+	NmVpnConnectionUnknown      NmVpnConnectionState = 0 //The state of the VPN connection is unknown.
+	NmVpnConnectionPrepare      NmVpnConnectionState = 1 //The VPN connection is preparing to connect.
+	NmVpnConnectionNeedAuth     NmVpnConnectionState = 2 //The VPN connection needs authorization credentials.
+	NmVpnConnectionConnect      NmVpnConnectionState = 3 //The VPN connection is being established.
+	NmVpnConnectionIpConfigGet  NmVpnConnectionState = 4 //The VPN connection is getting an IP address.
+	NmVpnConnectionActivated    NmVpnConnectionState = 5 //The VPN connection is active.
+	NmVpnConnectionFailed       NmVpnConnectionState = 6 //The VPN connection failed.
+	NmVpnConnectionDisconnected NmVpnConnectionState = 7 //The VPN connection is disconnected.
 )
 
 //go:generate stringer -type=NmDeviceStateReason
@@ -0,0 +1,359 @@
+// Package oci is a small client of the registry HTTP API (the OCI
+// distribution spec): it reads the manifests and blobs of one repository and
+// checks every one against its digest. Pulls go through the container runtime;
+// this is for what the agent reads from registries itself, signatures and
+// images fetched from other devices.
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reagent/common"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIConfig      = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer       = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// maxManifestBytes caps manifests and the blobs read into memory.
+const maxManifestBytes = 4 << 20
+
+// ErrNotFound: the registry has no such manifest or blob.
+var ErrNotFound = errors.New("not found")
+
+// challengeParam matches a parameter of a WWW-Authenticate challenge, e.g.
+// realm="https://auth.example.com/token".
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is an image manifest or an index, as far as the agent needs it.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	ArtifactType  string       `json:"artifactType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	Manifests     []Descriptor `json:"manifests,omitempty"`
+}
+
+// IsIndex reports whether the manifest lists the manifests of other platforms
+// rather than describing an image.
+func (m *Manifest) IsIndex() bool {
+	return m.MediaType == MediaTypeOCIIndex || m.MediaType == MediaTypeDockerList || len(m.Manifests) > 0
+}
+
+// Client reads manifests and blobs of one repository, authenticating the way
+// docker does: with a bearer token from the registry's token service or with
+// basic auth.
+type Client struct {
+	HTTPClient *http.Client
+	Host       string
+	Repository string
+	Username   string
+	Password   string
+	// PlainHTTP talks http instead of https, to registries on the LAN.
+	PlainHTTP bool
+
+	authorization string
+}
+
+// NewClient returns a client of the repository of image. credentials are the
+// registry logins to pick from, keyed by registry as docker logins are.
+func NewClient(httpClient *http.Client, image string, credentials map[string]common.DockerCredential) (*Client, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %w", image, err)
+	}
+
+	domain := reference.Domain(named)
+	client := &Client{
+		HTTPClient: httpClient,
+		Host:       domain,
+		Repository: reference.Path(named),
+	}
+	if domain == "docker.io" {
+		client.Host = "registry-1.docker.io"
+	}
+
+	for server, credential := range credentials {
+		if RegistryHost(server) == domain {
+			client.Username = credential.Username
+			client.Password = credential.Password
+		}
+	}
+
+	return client, nil
+}
+
+// RegistryHost normalizes a registry as docker logins are keyed, e.g.
+// "registry.example.com/" or "https://index.docker.io/v1/".
+func RegistryHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ := strings.Cut(server, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+func (c *Client) get(ctx context.Context, path string, accept ...string) (*http.Response, error) {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	target := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, c.Host, c.Repository, path)
+
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", strings.Join(accept, ", "))
+		if c.authorization != "" {
+			request.Header.Set("Authorization", c.authorization)
+		}
+
+		response, err := c.HTTPClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := response.Header.Get("WWW-Authenticate")
+			response.Body.Close()
+
+			err = c.authenticate(ctx, challenge)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch {
+		case response.StatusCode == http.StatusNotFound:
+			response.Body.Close()
+			return nil, ErrNotFound
+		case response.StatusCode != http.StatusOK:
+			response.Body.Close()
+			return nil, fmt.Errorf("the registry %s answered %s for %s", c.Host, response.Status, path)
+		}
+
+		return response, nil
+	}
+}
+
+// authenticate answers a WWW-Authenticate challenge.
+func (c *Client) authenticate(ctx context.Context, challenge string) error {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "Basic") {
+		if c.Username == "" {
+			return fmt.Errorf("the registry %s requires a login", c.Host)
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+		return nil
+	}
+
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("the registry %s asks for unsupported %q authentication", c.Host, scheme)
+	}
+
+	params := make(map[string]string)
+	for _, match := range challengeParam.FindAllStringSubmatch(rest, -1) {
+		params[match[1]] = match[2]
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("the registry %s sent an invalid token realm", c.Host)
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", c.Repository))
+	realm.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Username != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the token service of %s answered %s", c.Host, response.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, maxManifestBytes)).Decode(&token)
+	if err != nil {
+		return err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// Manifest fetches the manifest at ref, a tag or a digest, and returns it with
+// its digest.
+func (c *Client) Manifest(ctx context.Context, ref string) (*Manifest, string, error) {
+	response, err := c.get(ctx, "manifests/"+ref, MediaTypeOCIManifest, MediaTypeOCIIndex, MediaTypeDockerManifest, MediaTypeDockerList)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxManifestBytes))
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest := digestOf(data)
+	if strings.HasPrefix(ref, "sha256:") && ref != digest {
+		return nil, "", fmt.Errorf("the registry %s served a manifest that does not match %s", c.Host, ref)
+	}
+
+	var parsed Manifest
+	err = json.Unmarshal(data, &parsed)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid manifest %s: %w", ref, err)
+	}
+
+	return &parsed, digest, nil
+}
+
+// Blob fetches a small blob, e.g. a config or a signature, and checks it
+// against its digest.
+func (c *Client) Blob(ctx context.Context, digest string) ([]byte, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest %s", digest)
+	}
+
+	response, err := c.get(ctx, "blobs/"+digest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxManifestBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	if digestOf(data) != digest {
+		return nil, fmt.Errorf("the blob %s does not match its digest", digest)
+	}
+
+	return data, nil
+}
+
+// CopyBlob streams a blob of any size to w and checks it against its digest.
+// What was written is only valid once it returns nil.
+func (c *Client) CopyBlob(ctx context.Context, digest string, w io.Writer) (int64, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return 0, fmt.Errorf("unsupported digest %s", digest)
+	}
+
+	response, err := c.get(ctx, "blobs/"+digest)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(w, hash), response.Body)
+	if err != nil {
+		return written, err
+	}
+
+	if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		return written, fmt.Errorf("the blob %s does not match its digest", digest)
+	}
+
+	return written, nil
+}
+
+// Referrers lists the manifests of artifactType attached to the digest, read
+// from the referrers API or, on registries without it, the
+// `sha256-<digest>` tag index.
+func (c *Client) Referrers(ctx context.Context, digest string, artifactType string) ([]Descriptor, error) {
+	var index Manifest
+
+	response, err := c.get(ctx, "referrers/"+digest+"?artifactType="+url.QueryEscape(artifactType), MediaTypeOCIIndex)
+	if err == nil {
+		defer response.Body.Close()
+		err = json.NewDecoder(io.LimitReader(response.Body, maxManifestBytes)).Decode(&index)
+		if err != nil {
+			return nil, err
+		}
+	} else if errors.Is(err, ErrNotFound) {
+		fallback, _, err := c.Manifest(ctx, strings.Replace(digest, ":", "-", 1))
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		index = *fallback
+	} else {
+		return nil, err
+	}
+
+	var matching []Descriptor
+	for _, referrer := range index.Manifests {
+		if referrer.ArtifactType == artifactType {
+			matching = append(matching, referrer)
+		}
+	}
+	return matching, nil
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
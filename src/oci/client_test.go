@@ -0,0 +1,72 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"reagent/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	credentials := map[string]common.DockerCredential{
+		"https://index.docker.io/v1/": {Username: "hub", Password: "hub-secret"},
+		"registry.test/":              {Username: "device", Password: "secret"},
+	}
+
+	client, err := NewClient(http.DefaultClient, "registry.test/apps/sensor:1.0", credentials)
+	require.NoError(t, err)
+	assert.Equal(t, "registry.test", client.Host)
+	assert.Equal(t, "apps/sensor", client.Repository)
+	assert.Equal(t, "device", client.Username)
+
+	client, err = NewClient(http.DefaultClient, "nginx", credentials)
+	require.NoError(t, err)
+	assert.Equal(t, "registry-1.docker.io", client.Host)
+	assert.Equal(t, "library/nginx", client.Repository)
+	assert.Equal(t, "hub", client.Username)
+
+	_, err = NewClient(http.DefaultClient, "Not A Reference", nil)
+	assert.Error(t, err)
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "docker.io", RegistryHost("https://index.docker.io/v1/"))
+	assert.Equal(t, "registry.test", RegistryHost("registry.test/"))
+	assert.Equal(t, "localhost:15001", RegistryHost("http://localhost:15001/"))
+}
+
+func TestCopyBlob(t *testing.T) {
+	blob := []byte("layer")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/v2/apps/sensor/blobs/" + digestOf(blob):
+			w.Write(blob)
+		case "/v2/apps/sensor/blobs/" + digestOf([]byte("other")):
+			w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := &Client{HTTPClient: server.Client(), Host: strings.TrimPrefix(server.URL, "http://"), Repository: "apps/sensor", PlainHTTP: true}
+
+	var buffer bytes.Buffer
+	written, err := client.CopyBlob(context.Background(), digestOf(blob), &buffer)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(blob)), written)
+	assert.Equal(t, blob, buffer.Bytes())
+
+	_, err = client.CopyBlob(context.Background(), digestOf([]byte("other")), &bytes.Buffer{})
+	assert.ErrorContains(t, err, "does not match its digest")
+
+	_, err = client.CopyBlob(context.Background(), digestOf([]byte("missing")), &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,144 @@
+package peerimage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The devices of a swarm share a key the backend hands each of them. A device
+// signs every request to a peer with it, and serves only requests signed so:
+// a device of another swarm, or anything else on the LAN, is turned away
+// before it learns which images the device has.
+//
+// A token signs the device key of the requesting device, the time and the
+// path asked for, so a token overheard on the LAN is only good for what its
+// request was already served, and for tokenMaxAge at that.
+//
+//	Authorization: PeerImage {device_key}.{unix seconds}.{base64url(HMAC-SHA256(key, "ironflock/peer-images/v1|{device_key}|{unix seconds}|{path}"))}
+const (
+	tokenScheme  = "PeerImage"
+	tokenPrefix  = "ironflock/peer-images/v1"
+	tokenMaxAge  = 5 * time.Minute
+	tokenMaxSkew = time.Minute
+)
+
+// errNoKey: the key of the swarm was not fetched from the backend yet.
+var errNoKey = errors.New("the peer image key of the swarm is not known yet")
+
+// Key is the key of the device's swarm, shared by its Server and Fetcher.
+// Until it is set, the server refuses every peer and the fetcher asks none.
+type Key struct {
+	mu    sync.RWMutex
+	value string
+}
+
+// Set replaces the key, e.g. with that of the swarm the device moved to.
+func (k *Key) Set(value string) {
+	k.mu.Lock()
+	k.value = value
+	k.mu.Unlock()
+}
+
+func (k *Key) get() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.value
+}
+
+// FetchKey fetches the peer image key of the device's swarm from the backend,
+// which mints it on the first call. Like the app credential key, the call
+// takes no arguments: the backend resolves the device, and so its swarm, from
+// the session's authid.
+func FetchKey(ctx context.Context, m messenger.Messenger) (string, error) {
+	resp, err := m.Call(ctx, topics.GetPeerImageKey, []interface{}{}, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Arguments) == 0 {
+		return "", errors.New("empty peer_image_key payload")
+	}
+
+	key, ok := resp.Arguments[0].(string)
+	if !ok || key == "" {
+		return "", errors.New("invalid peer_image_key payload")
+	}
+
+	return key, nil
+}
+
+func tokenSignature(key string, deviceKey int, unix int64, path string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s|%d|%d|%s", tokenPrefix, deviceKey, unix, path)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken returns the token of a request of the device with deviceKey for
+// path.
+func signToken(key string, deviceKey int, at time.Time, path string) string {
+	unix := at.Unix()
+	return fmt.Sprintf("%d.%d.%s", deviceKey, unix, tokenSignature(key, deviceKey, unix, path))
+}
+
+// verifyToken reports whether token was signed with key for path, recently
+// enough.
+func verifyToken(key string, token string, now time.Time, path string) bool {
+	parts := strings.Split(token, ".")
+	if key == "" || len(parts) != 3 {
+		return false
+	}
+
+	deviceKey, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tokenMaxAge || age < -tokenMaxSkew {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[2]), []byte(tokenSignature(key, deviceKey, unix, path)))
+}
+
+// authorized reports whether a request carries a valid token of the swarm.
+func authorized(key string, request *http.Request) bool {
+	scheme, token, ok := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !ok || scheme != tokenScheme {
+		return false
+	}
+	return verifyToken(key, token, time.Now(), request.URL.Path)
+}
+
+// signingTransport signs each request to a peer with the key of the swarm.
+type signingTransport struct {
+	key       *Key
+	deviceKey int
+	base      http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	key := t.key.get()
+	if key == "" {
+		return nil, errNoKey
+	}
+
+	signed := request.Clone(request.Context())
+	signed.Header.Set("Authorization", tokenScheme+" "+signToken(key, t.deviceKey, time.Now(), request.URL.Path))
+	return t.base.RoundTrip(signed)
+}
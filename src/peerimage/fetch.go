@@ -0,0 +1,381 @@
+package peerimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reagent/common"
+	"reagent/oci"
+	"reagent/safe"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// upstreamTimeout bounds each request to the upstream registry, which
+	// only serves manifests here.
+	upstreamTimeout = 30 * time.Second
+	// peerTimeout bounds a request to a peer without a response; the
+	// transfer of a layer itself may take as long as it takes.
+	peerTimeout = 10 * time.Second
+	// peersTTL is how long the peers found on the LAN are reused, e.g. for
+	// the other services of a compose app.
+	peersTTL = 30 * time.Second
+)
+
+// ErrNoPeer: no device on the LAN serves the image.
+var ErrNoPeer = errors.New("no device on the LAN has the image")
+
+// Loader is the subset of the container layer the fetcher needs.
+type Loader interface {
+	LoadImage(ctx context.Context, archive io.Reader) ([]string, error)
+}
+
+// Fetcher fetches images from the devices on the LAN, checked against the
+// upstream registry, and loads them into the daemon.
+type Fetcher struct {
+	docker  Loader
+	peers   func(ctx context.Context) ([]Peer, error)
+	tempDir string
+	key     *Key
+
+	httpClient *http.Client
+	peerClient *http.Client
+
+	mu         sync.Mutex
+	knownPeers []Peer
+	peersAt    time.Time
+}
+
+// NewFetcher returns a fetcher that asks peers for the devices to fetch from
+// (see Discover) and keeps the layers it fetches in tempDir until they are
+// loaded. It signs its requests as the device with deviceKey, with the key of
+// its swarm.
+func NewFetcher(docker Loader, peers func(ctx context.Context) ([]Peer, error), tempDir string, key *Key, deviceKey int) *Fetcher {
+	return &Fetcher{
+		docker:     docker,
+		peers:      peers,
+		tempDir:    tempDir,
+		key:        key,
+		httpClient: &http.Client{Timeout: upstreamTimeout},
+		peerClient: &http.Client{Transport: &signingTransport{
+			key:       key,
+			deviceKey: deviceKey,
+			base:      &http.Transport{ResponseHeaderTimeout: peerTimeout},
+		}},
+	}
+}
+
+// Fetch loads image, a reference by tag ("latest" if it has none), from a
+// device on the LAN and returns the device. credentials are the registry
+// logins of the app, which resolving the tag upstream needs. It fails with
+// ErrNoPeer when no device serves the image, or while the key of the swarm is
+// not known; callers then pull it from the registry.
+func (f *Fetcher) Fetch(ctx context.Context, image string, credentials map[string]common.DockerCredential) (Peer, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return Peer{}, err
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.Tagged)
+	if !ok {
+		return Peer{}, fmt.Errorf("%s has no tag to load it as", image)
+	}
+
+	if f.key.get() == "" {
+		return Peer{}, ErrNoPeer
+	}
+
+	peers, err := f.listPeers(ctx)
+	if err != nil {
+		return Peer{}, err
+	}
+	if len(peers) == 0 {
+		return Peer{}, ErrNoPeer
+	}
+
+	upstream, err := oci.NewClient(f.httpClient, image, credentials)
+	if err != nil {
+		return Peer{}, err
+	}
+
+	configs, err := f.configDigests(ctx, upstream, tagged.Tag())
+	if err != nil {
+		return Peer{}, fmt.Errorf("failed to resolve %s upstream: %w", image, err)
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+	lastErr := ErrNoPeer
+	for _, peer := range peers {
+		for _, configDigest := range configs {
+			err = f.fetchFrom(ctx, peer, upstream.Repository, configDigest, reference.FamiliarString(tagged))
+			if errors.Is(err, oci.ErrNotFound) {
+				continue
+			}
+			if err == nil {
+				return peer, nil
+			}
+			if ctx.Err() != nil {
+				return Peer{}, ctx.Err()
+			}
+
+			log.Warn().Err(err).Msgf("failed to fetch %s from %s", image, peer.Name)
+			lastErr = fmt.Errorf("%s: %w", peer.Name, err)
+			break
+		}
+	}
+
+	return Peer{}, lastErr
+}
+
+func (f *Fetcher) listPeers(ctx context.Context) ([]Peer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.knownPeers == nil || time.Since(f.peersAt) > peersTTL {
+		peers, err := f.peers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		f.knownPeers = append([]Peer{}, peers...)
+		f.peersAt = time.Now()
+	}
+
+	return append([]Peer(nil), f.knownPeers...), nil
+}
+
+// configDigests returns the configs the tag names upstream: that of its image,
+// or of each image of this device's architecture in its index.
+func (f *Fetcher) configDigests(ctx context.Context, upstream *oci.Client, tag string) ([]string, error) {
+	manifest, _, err := upstream.Manifest(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !manifest.IsIndex() {
+		return []string{manifest.Config.Digest}, nil
+	}
+
+	var configs []string
+	for _, descriptor := range manifest.Manifests {
+		if descriptor.Platform == nil || descriptor.Platform.OS != "linux" || descriptor.Platform.Architecture != runtime.GOARCH {
+			continue
+		}
+
+		platformManifest, _, err := upstream.Manifest(ctx, descriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, platformManifest.Config.Digest)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no image for linux/%s", runtime.GOARCH)
+	}
+	return configs, nil
+}
+
+// fetchFrom fetches the image of configDigest from peer and loads it as
+// image. It fails with oci.ErrNotFound when the peer does not have it.
+func (f *Fetcher) fetchFrom(ctx context.Context, peer Peer, repository string, configDigest string, image string) error {
+	client := &oci.Client{HTTPClient: f.peerClient, Host: peer.Addr, Repository: repository, PlainHTTP: true}
+
+	manifest, _, err := client.Manifest(ctx, configRef(configDigest))
+	if err != nil {
+		return err
+	}
+	if manifest.Config.Digest != configDigest {
+		return fmt.Errorf("served the manifest of %s instead", manifest.Config.Digest)
+	}
+
+	err = f.fetchImage(ctx, client, manifest, configDigest, image)
+	if errors.Is(err, oci.ErrNotFound) {
+		// not a peer without the image, one that lost it midway
+		return fmt.Errorf("the image went missing while it was served: %s", err)
+	}
+	return err
+}
+
+func (f *Fetcher) fetchImage(ctx context.Context, client *oci.Client, manifest *oci.Manifest, configDigest string, image string) error {
+	config, err := client.Blob(ctx, configDigest)
+	if err != nil {
+		return err
+	}
+
+	var imageConfig struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	err = json.Unmarshal(config, &imageConfig)
+	if err != nil {
+		return fmt.Errorf("invalid image config: %w", err)
+	}
+	if len(imageConfig.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("served %d layers for an image of %d", len(manifest.Layers), len(imageConfig.RootFS.DiffIDs))
+	}
+
+	dir, err := os.MkdirTemp(f.tempDir, "peer-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	layers := make([]string, 0, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		file := filepath.Join(dir, fmt.Sprintf("layer-%d", i))
+		err = fetchLayer(ctx, client, layer, imageConfig.RootFS.DiffIDs[i], file)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, file)
+	}
+
+	return f.load(ctx, image, configDigest, config, layers)
+}
+
+// fetchLayer downloads a layer into file and checks that it is the layer the
+// image config lists, by the digest of its uncompressed content.
+func fetchLayer(ctx context.Context, client *oci.Client, layer oci.Descriptor, diffID string, file string) error {
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CopyBlob(ctx, layer.Digest, out)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	uncompressed, err := uncompressedDigest(file, layer.MediaType)
+	if err != nil {
+		return err
+	}
+	if uncompressed != diffID {
+		return fmt.Errorf("the layer %s is not the layer %s of the image", layer.Digest, diffID)
+	}
+	return nil
+}
+
+func uncompressedDigest(file string, mediaType string) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	var content io.Reader = in
+	switch {
+	case mediaType == oci.MediaTypeOCILayer:
+	case strings.HasSuffix(mediaType, "gzip"):
+		gzipReader, err := gzip.NewReader(in)
+		if err != nil {
+			return "", err
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	default:
+		return "", fmt.Errorf("unsupported layer type %s", mediaType)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, content)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// load loads the fetched image into the daemon, tagged as image, from an
+// archive in the `docker save` format written on the fly.
+func (f *Fetcher) load(ctx context.Context, image string, configDigest string, config []byte, layers []string) error {
+	reader, writer := io.Pipe()
+	safe.Go(func() {
+		writer.CloseWithError(writeArchive(writer, image, configDigest, config, layers))
+	})
+
+	_, err := f.docker.LoadImage(ctx, reader)
+	reader.CloseWithError(err)
+	return err
+}
+
+func writeArchive(out io.Writer, image string, configDigest string, config []byte, layers []string) error {
+	archive := tar.NewWriter(out)
+
+	configName := strings.TrimPrefix(configDigest, "sha256:") + ".json"
+	err := writeArchiveEntry(archive, configName, int64(len(config)), bytes.NewReader(config))
+	if err != nil {
+		return err
+	}
+
+	layerNames := make([]string, 0, len(layers))
+	for i, layer := range layers {
+		name := fmt.Sprintf("%d/layer.tar", i)
+		err = writeArchiveFile(archive, name, layer)
+		if err != nil {
+			return err
+		}
+		layerNames = append(layerNames, name)
+	}
+
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": []string{image},
+		"Layers":   layerNames,
+	}})
+	if err != nil {
+		return err
+	}
+
+	err = writeArchiveEntry(archive, "manifest.json", int64(len(manifest)), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeArchiveEntry(archive, name, info.Size(), in)
+}
+
+func writeArchiveEntry(archive *tar.Writer, name string, size int64, content io.Reader) error {
+	err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archive, content)
+	return err
+}
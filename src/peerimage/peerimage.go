@@ -0,0 +1,68 @@
+// Package peerimage shares app images between the devices on one LAN, so a
+// fleet in one plant pulls an image over its uplink once rather than once per
+// device.
+//
+// A device that serves its images runs a small read-only registry (Server)
+// and advertises it over mDNS. It serves only images it has, and only by the
+// digest of their config, the image ID: a peer cannot be asked for a tag. A
+// device about to pull an image (Fetcher) resolves the tag on the upstream
+// registry first, which costs a manifest or two, and asks the peers on the LAN
+// for the config that manifest names. Everything a peer serves is checked
+// against that: the config by its digest, each layer by the uncompressed
+// digest the config lists. A peer can therefore make a fetch fail, but never
+// change what runs; a failed fetch falls back to the upstream registry.
+//
+// Only the devices of the same swarm are served: each request is signed with
+// a key the backend hands the devices of a swarm (see Key). Within the swarm,
+// knowing an image ID is what it takes to be served the image, private ones
+// included, and the transfers travel unencrypted over the LAN, which is why
+// serving is opt-in.
+package peerimage
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"reagent/mdns"
+)
+
+// ServiceType is the DNS-SD service type serving devices are advertised
+// under.
+const ServiceType = "_ironflock-images._tcp"
+
+// browseWait is how long Discover waits for the answers of the LAN.
+const browseWait = 1500 * time.Millisecond
+
+// Peer is a device on the LAN that serves its images.
+type Peer struct {
+	Name string // the device's .local host name
+	Addr string // host:port of its registry
+}
+
+// Discover returns a function that lists the devices on the LAN that serve
+// their images, leaving out the device with deviceKey, this one.
+func Discover(deviceKey int) func(ctx context.Context) ([]Peer, error) {
+	return func(ctx context.Context) ([]Peer, error) {
+		instances, err := mdns.Browse(ctx, ServiceType, browseWait)
+		if err != nil {
+			return nil, err
+		}
+
+		var peers []Peer
+		for _, instance := range instances {
+			key, _ := instance.TextValue("device_key")
+			if key == strconv.Itoa(deviceKey) || len(instance.Addrs) == 0 {
+				continue
+			}
+
+			peers = append(peers, Peer{
+				Name: instance.Host,
+				Addr: net.JoinHostPort(instance.Addrs[0].String(), strconv.Itoa(int(instance.Port))),
+			})
+		}
+
+		return peers, nil
+	}
+}
@@ -0,0 +1,375 @@
+package peerimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"reagent/container"
+	"reagent/oci"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRepository = "apps/sensor"
+
+// testDeviceKey is the device the test fetchers sign as.
+const testDeviceKey = 7
+
+// newTestKey returns the key of a swarm.
+func newTestKey(value string) *Key {
+	key := &Key{}
+	key.Set(value)
+	return key
+}
+
+// testImage is an image of two identical layers, as `docker save` exports it
+// in the legacy format: the second layer links to the first.
+type testImage struct {
+	layer        []byte
+	config       []byte
+	configDigest string
+}
+
+func newTestImage(layer []byte) testImage {
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{digestOf(layer), digestOf(layer)}},
+	})
+	return testImage{layer: layer, config: config, configDigest: digestOf(config)}
+}
+
+// archive returns the `docker save` archive of the image, holding layer as
+// its layers' content.
+func (i testImage) archive(t *testing.T, layer []byte) []byte {
+	t.Helper()
+
+	configName := strings.TrimPrefix(i.configDigest, "sha256:") + ".json"
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": []string{"registry.test/" + testRepository + ":1.0"},
+		"Layers":   []string{"a/layer.tar", "b/layer.tar"},
+	}})
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	archive := tar.NewWriter(&buffer)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{"a/layer.tar", layer}, {configName, i.config}, {"manifest.json", manifest}} {
+		require.NoError(t, archive.WriteHeader(&tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.data)), Typeflag: tar.TypeReg}))
+		_, err = archive.Write(entry.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.WriteHeader(&tar.Header{Name: "b/layer.tar", Linkname: "../a/layer.tar", Typeflag: tar.TypeSymlink}))
+	require.NoError(t, archive.Close())
+
+	return buffer.Bytes()
+}
+
+// fakeDocker has one image and records what is loaded into it.
+type fakeDocker struct {
+	images  []container.ImageResult
+	archive []byte
+
+	mu     sync.Mutex
+	saves  int
+	loaded [][]byte
+}
+
+func (d *fakeDocker) ListImages(ctx context.Context, options map[string]interface{}) ([]container.ImageResult, error) {
+	return d.images, nil
+}
+
+func (d *fakeDocker) SaveImage(ctx context.Context, images []string) (io.ReadCloser, error) {
+	d.mu.Lock()
+	d.saves++
+	d.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(d.archive)), nil
+}
+
+func (d *fakeDocker) LoadImage(ctx context.Context, archive io.Reader) ([]string, error) {
+	data, err := io.ReadAll(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.loaded = append(d.loaded, data)
+	d.mu.Unlock()
+	return []string{"loaded"}, nil
+}
+
+// newUpstream serves the manifest of the image tagged 1.0, as the registry
+// the image comes from.
+func newUpstream(t *testing.T, image testImage) *httptest.Server {
+	t.Helper()
+
+	manifest, err := json.Marshal(oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeOCIManifest,
+		Config:        oci.Descriptor{MediaType: oci.MediaTypeOCIConfig, Digest: image.configDigest, Size: int64(len(image.config))},
+	})
+	require.NoError(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/v2/"+testRepository+"/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(manifest)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newPeer serves docker's images as a peer of the swarm "swarm-key" would.
+func newPeer(t *testing.T, docker *fakeDocker) (*Server, Peer) {
+	t.Helper()
+
+	server, err := NewServer(docker, filepath.Join(t.TempDir(), "exports"), newTestKey("swarm-key"))
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	return server, Peer{Name: "peer.local.", Addr: strings.TrimPrefix(httpServer.URL, "http://")}
+}
+
+func newTestFetcher(t *testing.T, upstream *httptest.Server, loader Loader, peers ...Peer) *Fetcher {
+	t.Helper()
+
+	return newTestFetcherOf(t, newTestKey("swarm-key"), upstream, loader, peers...)
+}
+
+// newTestFetcherOf returns a fetcher of the swarm of key.
+func newTestFetcherOf(t *testing.T, key *Key, upstream *httptest.Server, loader Loader, peers ...Peer) *Fetcher {
+	t.Helper()
+
+	fetcher := NewFetcher(loader, func(ctx context.Context) ([]Peer, error) { return peers, nil }, t.TempDir(), key, testDeviceKey)
+	fetcher.httpClient = upstream.Client()
+	return fetcher
+}
+
+func upstreamImage(upstream *httptest.Server) string {
+	return strings.TrimPrefix(upstream.URL, "https://") + "/" + testRepository + ":1.0"
+}
+
+func TestFetch(t *testing.T) {
+	image := newTestImage([]byte("layer content"))
+
+	t.Run("loads the image verified against upstream", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+		peerDocker := &fakeDocker{
+			images:  []container.ImageResult{{ID: image.configDigest, RepoTags: []string{upstreamImage(upstream)}}},
+			archive: image.archive(t, image.layer),
+		}
+		_, peer := newPeer(t, peerDocker)
+
+		local := &fakeDocker{}
+		fetcher := newTestFetcher(t, upstream, local, peer)
+
+		from, err := fetcher.Fetch(context.Background(), upstreamImage(upstream), nil)
+		require.NoError(t, err)
+		assert.Equal(t, peer, from)
+
+		require.Len(t, local.loaded, 1)
+		files := readArchive(t, local.loaded[0])
+		assert.Equal(t, image.config, files[strings.TrimPrefix(image.configDigest, "sha256:")+".json"])
+		assert.Equal(t, image.layer, files["0/layer.tar"])
+		assert.Equal(t, image.layer, files["1/layer.tar"])
+
+		var manifest []struct {
+			Config   string
+			RepoTags []string
+			Layers   []string
+		}
+		require.NoError(t, json.Unmarshal(files["manifest.json"], &manifest))
+		require.Len(t, manifest, 1)
+		assert.Equal(t, []string{upstreamImage(upstream)}, manifest[0].RepoTags)
+		assert.Equal(t, []string{"0/layer.tar", "1/layer.tar"}, manifest[0].Layers)
+
+		// a second device is served from the same export
+		_, err = newTestFetcher(t, upstream, &fakeDocker{}, peer).Fetch(context.Background(), upstreamImage(upstream), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, peerDocker.saves)
+	})
+
+	t.Run("a peer without the image is skipped", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+		_, peer := newPeer(t, &fakeDocker{
+			images: []container.ImageResult{{ID: digestOf([]byte("other")), RepoTags: []string{upstreamImage(upstream)}}},
+		})
+
+		local := &fakeDocker{}
+		_, err := newTestFetcher(t, upstream, local, peer).Fetch(context.Background(), upstreamImage(upstream), nil)
+		assert.ErrorIs(t, err, ErrNoPeer)
+		assert.Empty(t, local.loaded)
+	})
+
+	t.Run("a tampered layer is not loaded", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+		_, peer := newPeer(t, &fakeDocker{
+			images:  []container.ImageResult{{ID: image.configDigest, RepoTags: []string{upstreamImage(upstream)}}},
+			archive: image.archive(t, []byte("tampered content")),
+		})
+
+		local := &fakeDocker{}
+		_, err := newTestFetcher(t, upstream, local, peer).Fetch(context.Background(), upstreamImage(upstream), nil)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrNoPeer)
+		assert.Contains(t, err.Error(), "is not the layer")
+		assert.Empty(t, local.loaded)
+	})
+
+	t.Run("without peers upstream is not asked", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+		upstream.Close()
+
+		_, err := newTestFetcher(t, upstream, &fakeDocker{}).Fetch(context.Background(), upstreamImage(upstream), nil)
+		assert.ErrorIs(t, err, ErrNoPeer)
+	})
+
+	t.Run("an untagged image cannot be loaded by name", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+
+		_, err := newTestFetcher(t, upstream, &fakeDocker{}).Fetch(context.Background(), "registry.test/apps/sensor@"+image.configDigest, nil)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrNoPeer)
+	})
+
+	t.Run("a device of another swarm is not served", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+		peerDocker := &fakeDocker{
+			images:  []container.ImageResult{{ID: image.configDigest, RepoTags: []string{upstreamImage(upstream)}}},
+			archive: image.archive(t, image.layer),
+		}
+		_, peer := newPeer(t, peerDocker)
+
+		local := &fakeDocker{}
+		_, err := newTestFetcherOf(t, newTestKey("other-swarm-key"), upstream, local, peer).Fetch(context.Background(), upstreamImage(upstream), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "403")
+		assert.Empty(t, local.loaded)
+		assert.Zero(t, peerDocker.saves)
+	})
+
+	t.Run("without the key of the swarm no peer is asked", func(t *testing.T) {
+		upstream := newUpstream(t, image)
+		upstream.Close()
+
+		_, err := newTestFetcherOf(t, &Key{}, upstream, &fakeDocker{}, Peer{Name: "peer.local.", Addr: "127.0.0.1:1"}).Fetch(context.Background(), upstreamImage(upstream), nil)
+		assert.ErrorIs(t, err, ErrNoPeer)
+	})
+}
+
+func TestServer(t *testing.T) {
+	image := newTestImage([]byte("layer content"))
+	docker := &fakeDocker{
+		images:  []container.ImageResult{{ID: image.configDigest, RepoTags: []string{"registry.test/" + testRepository + ":1.0"}}},
+		archive: image.archive(t, image.layer),
+	}
+	_, peer := newPeer(t, docker)
+
+	request := func(method string, path string, token string) int {
+		request, err := http.NewRequest(method, "http://"+peer.Addr+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			request.Header.Set("Authorization", tokenScheme+" "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	get := func(path string) int {
+		return request(http.MethodGet, path, signToken("swarm-key", testDeviceKey, time.Now(), path))
+	}
+
+	assert.Equal(t, http.StatusOK, get("/v2/"))
+	// tags are not served, and images only in their own repository
+	assert.Equal(t, http.StatusNotFound, get("/v2/"+testRepository+"/manifests/1.0"))
+	assert.Equal(t, http.StatusNotFound, get("/v2/apps/other/manifests/"+image.configDigest))
+	// blobs only once their image was asked for
+	assert.Equal(t, http.StatusNotFound, get("/v2/"+testRepository+"/blobs/"+digestOf(image.layer)))
+	assert.Equal(t, http.StatusOK, get("/v2/"+testRepository+"/manifests/"+configRef(image.configDigest)))
+	assert.Equal(t, http.StatusOK, get("/v2/"+testRepository+"/blobs/"+digestOf(image.layer)))
+
+	uploads := "/v2/" + testRepository + "/blobs/uploads/"
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodPost, uploads, signToken("swarm-key", testDeviceKey, time.Now(), uploads)))
+
+	// only devices of the swarm, with a token for the path, that is recent
+	blob := "/v2/" + testRepository + "/blobs/" + digestOf(image.layer)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, blob, ""))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, blob, signToken("other-swarm-key", testDeviceKey, time.Now(), blob)))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, blob, signToken("swarm-key", testDeviceKey, time.Now(), "/v2/")))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, blob, signToken("swarm-key", testDeviceKey, time.Now().Add(-tokenMaxAge-time.Second), blob)))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, blob, signToken("", testDeviceKey, time.Now(), blob)))
+}
+
+func TestServerWithoutKeyServesNobody(t *testing.T) {
+	server, err := NewServer(&fakeDocker{}, filepath.Join(t.TempDir(), "exports"), &Key{})
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	request.Header.Set("Authorization", tokenScheme+" "+signToken("", testDeviceKey, time.Now(), "/v2/"))
+	server.ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestServerListensOnTheAddressGiven(t *testing.T) {
+	server, err := NewServer(&fakeDocker{}, filepath.Join(t.TempDir(), "exports"), newTestKey("swarm-key"))
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := free.Addr().(*net.TCPAddr).Port
+	require.NoError(t, free.Close())
+
+	require.NoError(t, server.Start("127.0.0.1", uint(port)))
+
+	response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/v2/", port))
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	assert.Error(t, server.Start("256.0.0.1", uint(port)), "not an address")
+}
+
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		files[header.Name] = content
+	}
+}
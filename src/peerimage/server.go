@@ -0,0 +1,605 @@
+package peerimage
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reagent/container"
+	"reagent/diskguard"
+	"reagent/oci"
+	"reagent/safe"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxExports caps the images kept exported for peers at once; each is a
+	// full copy of the image on disk.
+	maxExports = 2
+	// maxTransfers caps the blobs served at once. Further peers are turned
+	// away and try another device, spreading the load over the LAN.
+	maxTransfers = 4
+	// exportTimeout bounds the `docker save` of an image.
+	exportTimeout = 10 * time.Minute
+
+	mediaTypeGzipLayer = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// configRefPrefix starts the references of manifests by config digest.
+	configRefPrefix = "config-"
+)
+
+// errImageNotFound: the device has no image of that ID in that repository.
+var errImageNotFound = errors.New("image not found")
+
+// Docker is the subset of the container layer the server needs.
+// *container.Docker satisfies it.
+type Docker interface {
+	ListImages(ctx context.Context, options map[string]interface{}) ([]container.ImageResult, error)
+	SaveImage(ctx context.Context, images []string) (io.ReadCloser, error)
+}
+
+// Server is the read-only registry a device serves its images to peers with.
+// It speaks just enough of the registry API for a Fetcher: manifests by config
+// digest (see configRef) and blobs. An image is exported from the daemon when
+// a peer first asks for it.
+type Server struct {
+	docker Docker
+	dir    string
+	key    *Key
+
+	transfers chan struct{}
+
+	mu      sync.Mutex
+	exports map[string]*export
+
+	httpServer *http.Server
+}
+
+// export is an image as exported for peers: its files in a directory of the
+// server's, and the manifest that lists them.
+type export struct {
+	ready chan struct{}
+	err   error
+
+	repository string
+	dir        string
+	manifest   []byte
+	blobs      map[string]string
+	lastUsed   time.Time
+}
+
+// NewServer returns a server exporting images into dir, which it owns: what
+// is in there is removed. It serves only the devices of its swarm, whose
+// requests are signed with key.
+func NewServer(docker Docker, dir string, key *Key) (*Server, error) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		docker:    docker,
+		dir:       dir,
+		key:       key,
+		transfers: make(chan struct{}, maxTransfers),
+		exports:   make(map[string]*export),
+	}, nil
+}
+
+// Start serves peers on port of address, every interface when it is empty:
+// the devices of the swarm are found on the LAN and reach the server at any
+// address mDNS advertises. Requests without a token of the swarm are refused.
+func (s *Server) Start(address string, port uint) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+
+	s.httpServer = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	safe.Go(func() {
+		err := s.httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("failed to serve images to peers")
+		}
+	})
+
+	return nil
+}
+
+// Close stops serving and removes the exported images. A nil server is valid.
+func (s *Server) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	if s.httpServer != nil {
+		err := s.httpServer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.exports = make(map[string]*export)
+	s.mu.Unlock()
+
+	return os.RemoveAll(s.dir)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if !authorized(s.key.get(), request) {
+		http.Error(w, "not a device of the swarm", http.StatusForbidden)
+		return
+	}
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Exports take disk space the device does not have to spare now.
+	if diskguard.IsEmergency() {
+		s.dropExports()
+		http.Error(w, "the device is low on disk space", http.StatusServiceUnavailable)
+		return
+	}
+
+	route := strings.TrimPrefix(request.URL.Path, "/v2/")
+	if route == "" || route == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+		return
+	}
+
+	if repository, ref, ok := cutLast(route, "/manifests/"); ok {
+		s.serveManifest(w, request, repository, ref)
+		return
+	}
+
+	if repository, digest, ok := cutLast(route, "/blobs/"); ok {
+		s.serveBlob(w, request, repository, digest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, request *http.Request, repository string, ref string) {
+	configDigest, ok := configDigestOf(ref)
+	if !ok {
+		// tags are for the upstream registry to resolve
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	export, err := s.export(repository, configDigest)
+	if errors.Is(err, errImageNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to export %s for a peer", configDigest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", oci.MediaTypeOCIManifest)
+	w.Header().Set("Docker-Content-Digest", digestOf(export.manifest))
+	if request.Method == http.MethodGet {
+		w.Write(export.manifest)
+	}
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, request *http.Request, repository string, digest string) {
+	file := s.blobFile(repository, digest)
+	if file == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	select {
+	case s.transfers <- struct{}{}:
+		defer func() { <-s.transfers }()
+	default:
+		http.Error(w, "too many transfers", http.StatusServiceUnavailable)
+		return
+	}
+
+	blob, err := os.Open(file)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer blob.Close()
+
+	info, err := blob.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, request, "", info.ModTime(), blob)
+}
+
+// blobFile returns the file of a blob of an exported image of repository.
+func (s *Server) blobFile(repository string, digest string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, export := range s.exports {
+		if export.repository != repository || export.blobs == nil {
+			continue
+		}
+		if file, ok := export.blobs[digest]; ok {
+			export.lastUsed = time.Now()
+			return file
+		}
+	}
+	return ""
+}
+
+// export returns the image exported for peers, exporting it first if need
+// be. Peers asking for an image while it is exported wait for that export.
+func (s *Server) export(repository string, configDigest string) (*export, error) {
+	key := repository + "@" + configDigest
+
+	s.mu.Lock()
+	existing := s.exports[key]
+	if existing != nil {
+		existing.lastUsed = time.Now()
+		s.mu.Unlock()
+
+		<-existing.ready
+		return existing, existing.err
+	}
+
+	created := &export{
+		ready:      make(chan struct{}),
+		repository: repository,
+		dir:        filepath.Join(s.dir, strings.TrimPrefix(digestOf([]byte(key)), "sha256:")),
+		lastUsed:   time.Now(),
+	}
+	s.exports[key] = created
+	s.evictLocked(key)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	manifest, blobs, err := s.save(ctx, created.dir, repository, configDigest)
+
+	s.mu.Lock()
+	created.err = err
+	if err == nil {
+		created.manifest = manifest
+		created.blobs = blobs
+	} else {
+		os.RemoveAll(created.dir)
+		if s.exports[key] == created {
+			delete(s.exports, key)
+		}
+	}
+	s.mu.Unlock()
+	close(created.ready)
+
+	return created, err
+}
+
+// evictLocked removes the least recently used exports beyond maxExports,
+// keeping keep.
+func (s *Server) evictLocked(keep string) {
+	if len(s.exports) <= maxExports {
+		return
+	}
+
+	keys := make([]string, 0, len(s.exports))
+	for key := range s.exports {
+		if key != keep {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.exports[keys[i]].lastUsed.Before(s.exports[keys[j]].lastUsed)
+	})
+
+	for _, key := range keys[:len(s.exports)-maxExports] {
+		export := s.exports[key]
+		delete(s.exports, key)
+		safe.Go(func() {
+			<-export.ready
+			os.RemoveAll(export.dir)
+		})
+	}
+}
+
+func (s *Server) dropExports() {
+	s.mu.Lock()
+	exports := s.exports
+	s.exports = make(map[string]*export)
+	s.mu.Unlock()
+
+	for _, export := range exports {
+		safe.Go(func() {
+			<-export.ready
+			os.RemoveAll(export.dir)
+		})
+	}
+}
+
+// save exports the image into dir and returns its manifest and where its
+// blobs are.
+func (s *Server) save(ctx context.Context, dir string, repository string, configDigest string) ([]byte, map[string]string, error) {
+	found, err := s.hasImage(ctx, repository, configDigest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, errImageNotFound
+	}
+
+	archive, err := s.docker.SaveImage(ctx, []string{configDigest})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer archive.Close()
+
+	files, err := extractArchive(archive, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buildManifest(files, configDigest)
+}
+
+// hasImage reports whether the image of configDigest is tagged in, or was
+// pulled from, repository.
+func (s *Server) hasImage(ctx context.Context, repository string, configDigest string) (bool, error) {
+	images, err := s.docker.ListImages(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	for _, image := range images {
+		if image.ID != configDigest {
+			continue
+		}
+		for _, ref := range append(append([]string(nil), image.RepoTags...), image.RepoDigests...) {
+			named, err := reference.ParseNormalizedNamed(ref)
+			if err == nil && reference.Path(named) == repository {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// archiveFiles are the files of a `docker save` archive by their name in it.
+type archiveFiles struct {
+	files    map[string]string
+	symlinks map[string]string
+}
+
+// resolve returns the extracted file of name, following symlinks: the
+// legacy format links layers that several images share.
+func (a *archiveFiles) resolve(name string) (string, bool) {
+	name = path.Clean(name)
+	for range 8 {
+		if file, ok := a.files[name]; ok {
+			return file, true
+		}
+		target, ok := a.symlinks[name]
+		if !ok {
+			return "", false
+		}
+		name = target
+	}
+	return "", false
+}
+
+// extractArchive writes the regular files of a `docker save` archive into
+// dir, under names of its own so that no entry can escape it.
+func extractArchive(archive io.Reader, dir string) (*archiveFiles, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	extracted := &archiveFiles{files: make(map[string]string), symlinks: make(map[string]string)}
+	reader := tar.NewReader(archive)
+	for i := 0; ; i++ {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return extracted, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(header.Name)
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			extracted.symlinks[name] = path.Join(path.Dir(name), header.Linkname)
+		case tar.TypeLink:
+			extracted.symlinks[name] = path.Clean(header.Linkname)
+		case tar.TypeReg:
+			file := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+			err = writeFile(file, reader)
+			if err != nil {
+				return nil, err
+			}
+			extracted.files[name] = file
+		}
+	}
+}
+
+func writeFile(file string, content io.Reader) error {
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, content)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// buildManifest puts together the manifest of the exported image: its config
+// and its layers as `docker save` wrote them, uncompressed or, from the
+// containerd image store, as pulled.
+func buildManifest(files *archiveFiles, configDigest string) ([]byte, map[string]string, error) {
+	manifestFile, ok := files.resolve("manifest.json")
+	if !ok {
+		return nil, nil, errors.New("the image archive has no manifest.json")
+	}
+
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []struct {
+		Config string
+		Layers []string
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil || len(entries) != 1 {
+		return nil, nil, errors.New("the image archive has an invalid manifest.json")
+	}
+
+	configFile, ok := files.resolve(entries[0].Config)
+	if !ok {
+		return nil, nil, errors.New("the image archive has no config")
+	}
+	configDescriptor, err := describe(configFile, oci.MediaTypeOCIConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if configDescriptor.Digest != configDigest {
+		return nil, nil, fmt.Errorf("the exported config is %s, not %s", configDescriptor.Digest, configDigest)
+	}
+
+	manifest := oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeOCIManifest,
+		Config:        configDescriptor,
+	}
+	blobs := map[string]string{configDigest: configFile}
+
+	for _, layer := range entries[0].Layers {
+		layerFile, ok := files.resolve(layer)
+		if !ok {
+			return nil, nil, fmt.Errorf("the image archive has no layer %s", layer)
+		}
+
+		mediaType := oci.MediaTypeOCILayer
+		compressed, err := isGzip(layerFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if compressed {
+			mediaType = mediaTypeGzipLayer
+		}
+
+		layerDescriptor, err := describe(layerFile, mediaType)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest.Layers = append(manifest.Layers, layerDescriptor)
+		blobs[layerDescriptor.Digest] = layerFile
+	}
+
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, blobs, nil
+}
+
+func describe(file string, mediaType string) (oci.Descriptor, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, in)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+
+	return oci.Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)), Size: size}, nil
+}
+
+func isGzip(file string) (bool, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	magic, err := bufio.NewReader(in).Peek(2)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// cutLast splits route around the last sep.
+func cutLast(route string, sep string) (string, string, bool) {
+	i := strings.LastIndex(route, sep)
+	if i <= 0 {
+		return "", "", false
+	}
+	return route[:i], route[i+len(sep):], true
+}
+
+// configRef is the reference a manifest is asked for by the digest of its
+// config; being a digest itself, the config's would not match the manifest.
+func configRef(configDigest string) string {
+	return configRefPrefix + strings.TrimPrefix(configDigest, "sha256:")
+}
+
+func configDigestOf(ref string) (string, bool) {
+	hexPart, ok := strings.CutPrefix(ref, configRefPrefix)
+	if !ok || len(hexPart) != 64 {
+		return "", false
+	}
+	_, err := hex.DecodeString(hexPart)
+	return "sha256:" + hexPart, err == nil
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
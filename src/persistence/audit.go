@@ -0,0 +1,250 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditOutcome is how a remote operation ended.
+type AuditOutcome string
+
+const (
+	AuditSuccess AuditOutcome = "SUCCESS"
+	AuditDenied  AuditOutcome = "DENIED"
+	AuditFailed  AuditOutcome = "FAILED"
+)
+
+// MaxAuditEntries bounds the audit log independently of its retention, so a
+// flood of operations cannot grow the database without limit.
+const MaxAuditEntries = 100000
+
+// pruneEvery is how many entries are recorded between retention passes.
+const pruneEvery = 100
+
+// AuditEntry is one remote operation executed on the device.
+type AuditEntry struct {
+	ID                  int64        `json:"id"`
+	Timestamp           time.Time    `json:"timestamp"`
+	Topic               string       `json:"topic"`
+	CallerAuthID        string       `json:"caller_authid"`
+	RequestorAccountKey uint64       `json:"requestor_account_key,omitempty"`
+	Privilege           string       `json:"privilege,omitempty"`
+	Arguments           string       `json:"arguments,omitempty"`
+	Outcome             AuditOutcome `json:"outcome"`
+	Error               string       `json:"error,omitempty"`
+	Duration            int64        `json:"duration_ms"`
+}
+
+// AuditQuery filters the audit log. Zero values match everything; Limit
+// defaults to 100.
+type AuditQuery struct {
+	Since               time.Time
+	Until               time.Time
+	Topic               string
+	RequestorAccountKey uint64
+	Outcome             AuditOutcome
+	Limit               int
+}
+
+// AuditLog is the append-only record of the remote operations executed on
+// the device, kept in the AuditLog table. Entries older than the retention,
+// and the oldest ones beyond MaxAuditEntries, are removed as new ones come in.
+// A nil *AuditLog records nothing.
+type AuditLog struct {
+	db         *sql.DB
+	retention  time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu       sync.Mutex
+	recorded int
+}
+
+// AuditLog returns the audit log kept in this database. A retention of 0
+// keeps entries until MaxAuditEntries pushes them out.
+func (sqlite *AppStateDatabase) AuditLog(retention time.Duration) *AuditLog {
+	return &AuditLog{db: sqlite.db, retention: retention, maxEntries: MaxAuditEntries, now: time.Now}
+}
+
+const queryInsertAuditEntry = `INSERT INTO AuditLog(timestamp, topic, caller_authid, requestor_account_key, privilege, arguments, outcome, error, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+const queryDeleteAuditEntriesBefore = `DELETE FROM AuditLog WHERE timestamp < ?`
+const queryDeleteAuditEntriesBeyond = `DELETE FROM AuditLog WHERE id <= (SELECT MAX(id) FROM AuditLog) - ?`
+const querySelectAuditEntries = `SELECT id, timestamp, topic, caller_authid, requestor_account_key, privilege, arguments, outcome, error, duration_ms FROM AuditLog`
+
+// Record appends entry to the audit log.
+func (audit *AuditLog) Record(entry AuditEntry) error {
+	if audit == nil {
+		return nil
+	}
+
+	_, err := audit.db.Exec(queryInsertAuditEntry, entry.Timestamp.UnixMilli(), entry.Topic, entry.CallerAuthID,
+		entry.RequestorAccountKey, entry.Privilege, entry.Arguments, string(entry.Outcome), entry.Error, entry.Duration)
+	if err != nil {
+		return err
+	}
+
+	audit.mu.Lock()
+	audit.recorded++
+	prune := audit.recorded%pruneEvery == 1
+	audit.mu.Unlock()
+
+	if prune {
+		return audit.prune()
+	}
+
+	return nil
+}
+
+func (audit *AuditLog) prune() error {
+	if audit.retention > 0 {
+		_, err := audit.db.Exec(queryDeleteAuditEntriesBefore, audit.now().Add(-audit.retention).UnixMilli())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := audit.db.Exec(queryDeleteAuditEntriesBeyond, audit.maxEntries)
+	return err
+}
+
+// Query returns the entries matching query, newest first.
+func (audit *AuditLog) Query(query AuditQuery) ([]AuditEntry, error) {
+	if audit == nil {
+		return []AuditEntry{}, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, query.Since.UnixMilli())
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, query.Until.UnixMilli())
+	}
+	if query.Topic != "" {
+		conditions = append(conditions, "topic = ?")
+		args = append(args, query.Topic)
+	}
+	if query.RequestorAccountKey != 0 {
+		conditions = append(conditions, "requestor_account_key = ?")
+		args = append(args, query.RequestorAccountKey)
+	}
+	if query.Outcome != "" {
+		conditions = append(conditions, "outcome = ?")
+		args = append(args, string(query.Outcome))
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	statement := querySelectAuditEntries
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := audit.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// AuditExport selects a page of the export of the audit log: the entries
+// after AfterID, oldest first, at most Limit of them (MaxAuditExportEntries
+// when 0) and only about MaxAuditExportBytes of JSON lines, so that every page
+// fits in a single message.
+type AuditExport struct {
+	AfterID int64
+	Limit   int
+}
+
+// MaxAuditExportEntries bounds the entries of one page of the export.
+const MaxAuditExportEntries = 1000
+
+// MaxAuditExportBytes is how much of JSON lines a page of the export fills
+// before it ends; a page holds at least one entry.
+const MaxAuditExportBytes = 512 * 1024
+
+// Export writes a page of the audit log to w as JSON lines, oldest first. It
+// returns the ID of the last entry written, which the
+// next page starts after, and whether entries remain after it.
+func (audit *AuditLog) Export(w io.Writer, export AuditExport) (int64, bool, error) {
+	if audit == nil {
+		return export.AfterID, false, nil
+	}
+
+	limit := export.Limit
+	if limit <= 0 || limit > MaxAuditExportEntries {
+		limit = MaxAuditExportEntries
+	}
+
+	// one more than the page holds tells whether another page follows
+	rows, err := audit.db.Query(querySelectAuditEntries+" WHERE id > ? ORDER BY id ASC LIMIT ?", export.AfterID, limit+1)
+	if err != nil {
+		return export.AfterID, false, err
+	}
+	defer rows.Close()
+
+	lastID := export.AfterID
+	written, size := 0, 0
+	for rows.Next() {
+		if written == limit || size >= MaxAuditExportBytes {
+			return lastID, true, nil
+		}
+
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return lastID, false, err
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return lastID, false, err
+		}
+
+		_, err = w.Write(append(line, '\n'))
+		if err != nil {
+			return lastID, false, err
+		}
+		written++
+		size += len(line) + 1
+		lastID = entry.ID
+	}
+
+	return lastID, false, rows.Err()
+}
+
+func scanAuditEntry(rows *sql.Rows) (AuditEntry, error) {
+	var entry AuditEntry
+	var timestamp int64
+	var outcome string
+	err := rows.Scan(&entry.ID, &timestamp, &entry.Topic, &entry.CallerAuthID, &entry.RequestorAccountKey,
+		&entry.Privilege, &entry.Arguments, &outcome, &entry.Error, &entry.Duration)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	entry.Timestamp = time.UnixMilli(timestamp).UTC()
+	entry.Outcome = AuditOutcome(outcome)
+	return entry, nil
+}
@@ -0,0 +1,161 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	base := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+	entryAt := func(offset time.Duration, topic string, account uint64, outcome AuditOutcome) AuditEntry {
+		return AuditEntry{
+			Timestamp:           base.Add(offset),
+			Topic:               topic,
+			CallerAuthID:        "system",
+			RequestorAccountKey: account,
+			Privilege:           "MAINTAIN",
+			Outcome:             outcome,
+			Duration:            3,
+		}
+	}
+
+	t.Run("records and queries newest first", func(t *testing.T) {
+		audit := newTestDB(t).AuditLog(0)
+		require.NoError(t, audit.Record(entryAt(0, "reboot", 12, AuditSuccess)))
+		require.NoError(t, audit.Record(entryAt(time.Minute, "execute_command", 12, AuditDenied)))
+		require.NoError(t, audit.Record(entryAt(2*time.Minute, "execute_command", 13, AuditFailed)))
+
+		entries, err := audit.Query(AuditQuery{})
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		assert.Equal(t, AuditFailed, entries[0].Outcome)
+		assert.Equal(t, base.Add(2*time.Minute), entries[0].Timestamp)
+		assert.Equal(t, "MAINTAIN", entries[0].Privilege)
+
+		entries, err = audit.Query(AuditQuery{Topic: "execute_command", RequestorAccountKey: 12})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, AuditDenied, entries[0].Outcome)
+
+		entries, err = audit.Query(AuditQuery{Since: base.Add(time.Minute), Until: base.Add(2 * time.Minute)})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "execute_command", entries[0].Topic)
+
+		entries, err = audit.Query(AuditQuery{Outcome: AuditSuccess, Limit: 5})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "reboot", entries[0].Topic)
+	})
+
+	t.Run("is append-only", func(t *testing.T) {
+		db := newTestDB(t)
+		require.NoError(t, db.AuditLog(0).Record(entryAt(0, "reboot", 12, AuditSuccess)))
+
+		_, err := db.db.Exec(`UPDATE AuditLog SET outcome = 'DENIED'`)
+		assert.ErrorContains(t, err, "append-only")
+	})
+
+	t.Run("drops entries past the retention", func(t *testing.T) {
+		audit := newTestDB(t).AuditLog(24 * time.Hour)
+		audit.now = func() time.Time { return base }
+
+		require.NoError(t, audit.Record(entryAt(-48*time.Hour, "reboot", 12, AuditSuccess)))
+		require.NoError(t, audit.prune())
+
+		entries, err := audit.Query(AuditQuery{})
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("keeps at most maxEntries", func(t *testing.T) {
+		audit := newTestDB(t).AuditLog(0)
+		audit.maxEntries = 2
+
+		for i := range 5 {
+			require.NoError(t, audit.Record(entryAt(time.Duration(i)*time.Second, "reboot", uint64(i), AuditSuccess)))
+		}
+		require.NoError(t, audit.prune())
+
+		entries, err := audit.Query(AuditQuery{})
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, uint64(4), entries[0].RequestorAccountKey)
+		assert.Equal(t, uint64(3), entries[1].RequestorAccountKey)
+	})
+
+	t.Run("exports JSON lines oldest first", func(t *testing.T) {
+		audit := newTestDB(t).AuditLog(0)
+		require.NoError(t, audit.Record(entryAt(0, "reboot", 12, AuditSuccess)))
+		require.NoError(t, audit.Record(entryAt(time.Minute, "write_file", 12, AuditSuccess)))
+
+		var export bytes.Buffer
+		lastID, more, err := audit.Export(&export, AuditExport{})
+		require.NoError(t, err)
+		assert.False(t, more)
+
+		lines := strings.Split(strings.TrimSpace(export.String()), "\n")
+		require.Len(t, lines, 2)
+		var first, last AuditEntry
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &last))
+		assert.Equal(t, "reboot", first.Topic)
+		assert.Equal(t, last.ID, lastID)
+	})
+
+	t.Run("exports a page at a time", func(t *testing.T) {
+		audit := newTestDB(t).AuditLog(0)
+		for i := range 5 {
+			require.NoError(t, audit.Record(entryAt(time.Duration(i)*time.Minute, fmt.Sprintf("topic-%d", i), 12, AuditSuccess)))
+		}
+
+		var topics []string
+		var afterID int64
+		pages := 0
+		for more := true; more; pages++ {
+			var export bytes.Buffer
+			var err error
+			afterID, more, err = audit.Export(&export, AuditExport{AfterID: afterID, Limit: 2})
+			require.NoError(t, err)
+
+			for _, line := range strings.Split(strings.TrimSpace(export.String()), "\n") {
+				var entry AuditEntry
+				require.NoError(t, json.Unmarshal([]byte(line), &entry))
+				topics = append(topics, entry.Topic)
+			}
+		}
+
+		assert.Equal(t, 3, pages)
+		assert.Equal(t, []string{"topic-0", "topic-1", "topic-2", "topic-3", "topic-4"}, topics)
+	})
+
+	t.Run("a page ends once it is full", func(t *testing.T) {
+		audit := newTestDB(t).AuditLog(0)
+		large := entryAt(0, "write_file", 12, AuditFailed)
+		large.Error = strings.Repeat("x", MaxAuditExportBytes/2)
+		for range 3 {
+			require.NoError(t, audit.Record(large))
+		}
+
+		var export bytes.Buffer
+		_, more, err := audit.Export(&export, AuditExport{})
+		require.NoError(t, err)
+		assert.True(t, more)
+		assert.Len(t, strings.Split(strings.TrimSpace(export.String()), "\n"), 2)
+	})
+
+	t.Run("a nil audit log records nothing", func(t *testing.T) {
+		var audit *AuditLog
+		assert.NoError(t, audit.Record(entryAt(0, "reboot", 12, AuditSuccess)))
+		entries, err := audit.Query(AuditQuery{})
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS "AuditLog" (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  timestamp INTEGER NOT NULL,
+  topic TEXT NOT NULL,
+  caller_authid TEXT NOT NULL,
+  requestor_account_key INTEGER NOT NULL DEFAULT 0,
+  privilege TEXT NOT NULL DEFAULT '',
+  arguments TEXT NOT NULL DEFAULT '',
+  outcome TEXT CHECK( outcome IN ('SUCCESS', 'DENIED', 'FAILED') ) NOT NULL,
+  error TEXT NOT NULL DEFAULT '',
+  duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_timestamp ON AuditLog(timestamp);
+
+-- append-only: entries are only ever removed by retention, never changed
+CREATE TRIGGER IF NOT EXISTS audit_log_append_only BEFORE UPDATE ON AuditLog
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;
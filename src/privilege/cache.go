@@ -0,0 +1,129 @@
+package privilege
+
+import (
+	"sync"
+	"time"
+)
+
+// grantTTL is how long a privilege the backend granted on a live check is
+// trusted without asking again. Denials are kept for a shorter time, so a
+// privilege granted in the meantime applies quickly.
+const grantTTL = 5 * time.Minute
+
+const denialTTL = 30 * time.Second
+
+// staleWindow is how long past its expiry a signed grant, one the backend
+// pushed or handed out on connect with a verified HMAC, still stands in when
+// the live check fails, so a slow or unreachable backend does not fail every
+// privileged operation. Decisions of live checks never stand in: their
+// revocation could not reach the device during the outage, and a revoked
+// privilege must stop working within minutes, not stay in effect until the
+// backend is back.
+const staleWindow = 10 * time.Minute
+
+type grantKey struct {
+	requestorAccountKey int
+	privilege           string
+}
+
+type cachedGrant struct {
+	granted   bool
+	expiresAt time.Time
+	// signed marks a grant whose signature was verified, the only kind that
+	// stands in once expired.
+	signed bool
+}
+
+// grantCache holds privilege decisions per requestor account and privilege.
+type grantCache struct {
+	mu     sync.Mutex
+	grants map[grantKey]cachedGrant
+	// sequences is the newest signed grant seen per requestor account and
+	// privilege. It outlives the decisions, so a replayed grant is rejected
+	// after its newer revocation expired from the cache too.
+	sequences map[grantKey]uint64
+}
+
+func newGrantCache() *grantCache {
+	return &grantCache{grants: make(map[grantKey]cachedGrant), sequences: make(map[grantKey]uint64)}
+}
+
+// lookup returns the cached decision, if there is one that is still valid at
+// now, or with stale set a signed one that expired within staleWindow.
+func (c *grantCache) lookup(requestorAccountKey int, privilege string, now time.Time, stale bool) (granted bool, ok bool) {
+	if c == nil {
+		return false, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	grant, ok := c.grants[grantKey{requestorAccountKey, privilege}]
+	if !ok {
+		return false, false
+	}
+
+	validUntil := grant.expiresAt
+	if stale {
+		if !grant.signed {
+			return false, false
+		}
+		validUntil = validUntil.Add(staleWindow)
+	}
+	if !now.Before(validUntil) {
+		return false, false
+	}
+
+	return grant.granted, true
+}
+
+// store caches the decision of a live check.
+func (c *grantCache) store(requestorAccountKey int, privilege string, granted bool, expiresAt time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.grants[grantKey{requestorAccountKey, privilege}] = cachedGrant{granted: granted, expiresAt: expiresAt}
+}
+
+// apply caches a signed grant the backend pushed, unless a grant with the same
+// or a newer sequence was seen for its requestor account and privilege. It
+// reports whether the grant was applied.
+func (c *grantCache) apply(grant Grant) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := grantKey{grant.RequestorAccountKey, grant.Privilege}
+	if seen, ok := c.sequences[key]; ok && grant.Sequence <= seen {
+		return false
+	}
+	c.sequences[key] = grant.Sequence
+	c.grants[key] = cachedGrant{granted: grant.Granted, expiresAt: grant.ExpiresAt, signed: true}
+	return true
+}
+
+// replace swaps the cached decisions for grants, e.g. the full set the
+// backend hands out when the device connects. The grants are signed ones.
+func (c *grantCache) replace(grants []Grant) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.grants = make(map[grantKey]cachedGrant, len(grants))
+	for _, grant := range grants {
+		key := grantKey{grant.RequestorAccountKey, grant.Privilege}
+		if grant.Sequence > c.sequences[key] {
+			c.sequences[key] = grant.Sequence
+		}
+		c.grants[key] = cachedGrant{granted: grant.Granted, expiresAt: grant.ExpiresAt, signed: true}
+	}
+}
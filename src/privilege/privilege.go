@@ -10,20 +10,34 @@ import (
 	"reagent/messenger/topics"
 	"strconv"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
+// CheckedDetailsKey is set in the details of an invocation to the privilege
+// checked for it, so the audit log can record which one the call used.
+const CheckedDetailsKey = "reagent_privilege"
+
 type Privilege struct {
 	messenger messenger.Messenger
 	config    *config.Config
+	grants    *grantCache
+	now       func() time.Time
 }
 
 func NewPrivilege(messenger messenger.Messenger, config *config.Config) Privilege {
-	return Privilege{messenger: messenger, config: config}
+	return Privilege{messenger: messenger, config: config, grants: newGrantCache(), now: time.Now}
 }
 
+// Check reports whether the caller in details holds privilege on this device.
+// Decisions are cached per requestor account and privilege (see grantCache);
+// the backend is only asked when there is no valid cached one. Every decision
+// is logged with its source for auditing.
 func (p *Privilege) Check(privilege string, details common.Dict) (bool, error) {
-	deviceKey := uint64(p.config.ReswarmConfig.DeviceKey)
-	swarmKey := uint64(p.config.ReswarmConfig.SwarmKey)
+	if details != nil {
+		details[CheckedDetailsKey] = privilege
+	}
+
 	caller_authid := fmt.Sprint(details["caller_authid"])
 
 	// if no requestor_account_id was passed, the caller_authid will remain system
@@ -36,12 +50,39 @@ func (p *Privilege) Check(privilege string, details common.Dict) (bool, error) {
 		return false, err
 	}
 
+	now := p.now()
+	if granted, ok := p.grants.lookup(requestorAccountKey, privilege, now, false); ok {
+		logDecision(requestorAccountKey, privilege, granted, "cache")
+		return granted, nil
+	}
+
+	granted, err := p.checkLive(requestorAccountKey, privilege)
+	if err != nil {
+		if granted, ok := p.grants.lookup(requestorAccountKey, privilege, now, true); ok {
+			log.Warn().Err(err).Msg("Privilege check failed, using the expired signed grant")
+			logDecision(requestorAccountKey, privilege, granted, "stale cache")
+			return granted, nil
+		}
+		return false, err
+	}
+
+	ttl := denialTTL
+	if granted {
+		ttl = grantTTL
+	}
+	p.grants.store(requestorAccountKey, privilege, granted, now.Add(ttl))
+	logDecision(requestorAccountKey, privilege, granted, "live")
+
+	return granted, nil
+}
+
+func (p *Privilege) checkLive(requestorAccountKey int, privilege string) (bool, error) {
 	payload := common.Dict{
 		"privilege":             privilege,
 		"entity":                "DEVICE",
-		"entity_key":            deviceKey,
+		"entity_key":            uint64(p.config.ReswarmConfig.DeviceKey),
 		"requestor_account_key": requestorAccountKey,
-		"swarm_key":             swarmKey,
+		"swarm_key":             uint64(p.config.ReswarmConfig.SwarmKey),
 	}
 
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*10)
@@ -52,6 +93,10 @@ func (p *Privilege) Check(privilege string, details common.Dict) (bool, error) {
 		return false, err
 	}
 
+	if len(res.Arguments) == 0 {
+		return false, errors.New("the privilege check returned no result")
+	}
+
 	isPrivilegedArgs, ok := res.Arguments[0].(bool)
 	if !ok {
 		return false, errors.New("type of argument is not bool")
@@ -59,3 +104,70 @@ func (p *Privilege) Check(privilege string, details common.Dict) (bool, error) {
 
 	return isPrivilegedArgs, nil
 }
+
+// Sync subscribes to the grants and revocations the backend pushes for this
+// device and pre-warms the cache with the current ones. Called on every
+// connect; the fetched set replaces whatever was cached while offline.
+func (p *Privilege) Sync(ctx context.Context) error {
+	deviceKey := uint64(p.config.ReswarmConfig.DeviceKey)
+	grantTopic := topics.Topic(fmt.Sprintf(string(topics.PrivilegeGrants), deviceKey))
+
+	err := p.messenger.Subscribe(grantTopic, func(r messenger.Result) error {
+		for _, arg := range r.Arguments {
+			grant, err := parseGrant(arg, p.config.ReswarmConfig.Secret, deviceKey)
+			if err != nil {
+				log.Warn().Err(err).Msg("Ignoring a pushed privilege grant")
+				continue
+			}
+
+			if !p.grants.apply(grant) {
+				log.Warn().Int("requestor_account_key", grant.RequestorAccountKey).Str("privilege", grant.Privilege).
+					Uint64("sequence", grant.Sequence).Msg("Ignoring a pushed privilege grant older than the newest one")
+				continue
+			}
+			log.Info().Int("requestor_account_key", grant.RequestorAccountKey).Str("privilege", grant.Privilege).
+				Bool("granted", grant.Granted).Time("expires_at", grant.ExpiresAt).Msg("Privilege grant pushed")
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to privilege grants: %w", err)
+	}
+
+	args := []interface{}{common.Dict{
+		"device_key": deviceKey,
+		"swarm_key":  uint64(p.config.ReswarmConfig.SwarmKey),
+	}}
+	res, err := p.messenger.Call(ctx, topics.GetPrivilegeGrants, args, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch privilege grants: %w", err)
+	}
+
+	var fetched []interface{}
+	if len(res.Arguments) > 0 {
+		fetched, _ = res.Arguments[0].([]interface{})
+	}
+
+	now := p.now()
+	grants := make([]Grant, 0, len(fetched))
+	for _, arg := range fetched {
+		grant, err := parseGrant(arg, p.config.ReswarmConfig.Secret, deviceKey)
+		if err != nil {
+			log.Warn().Err(err).Msg("Ignoring a fetched privilege grant")
+			continue
+		}
+		if grant.ExpiresAt.After(now) {
+			grants = append(grants, grant)
+		}
+	}
+
+	p.grants.replace(grants)
+	log.Info().Int("grants", len(grants)).Msg("Pre-warmed the privilege cache")
+
+	return nil
+}
+
+func logDecision(requestorAccountKey int, privilege string, granted bool, source string) {
+	log.Info().Int("requestor_account_key", requestorAccountKey).Str("privilege", privilege).
+		Bool("granted", granted).Str("source", source).Msg("Privilege decision")
+}
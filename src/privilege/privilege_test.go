@@ -0,0 +1,225 @@
+package privilege
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"reagent/common"
+	"reagent/messenger/topics"
+	"reagent/testutil/builders"
+	"reagent/testutil/fakes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "device secret"
+
+func newTestPrivilege(t *testing.T) (*Privilege, *fakes.Messenger, *time.Time) {
+	t.Helper()
+
+	cfg := builders.NewTestConfigBuilder().WithDeviceKey(7).Build()
+	cfg.ReswarmConfig.Secret = testSecret
+	m := fakes.NewMessengerWithConfig(cfg)
+
+	now := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+	p := NewPrivilege(m, cfg)
+	p.now = func() time.Time { return now }
+	return &p, m, &now
+}
+
+// signedGrant is a grant for device 7 signed like the backend does.
+func signedGrant(account int, privilege string, granted bool, expiresAt time.Time, sequence uint64) map[string]interface{} {
+	grant := Grant{RequestorAccountKey: account, Privilege: privilege, Granted: granted, ExpiresAt: expiresAt, Sequence: sequence}
+	return map[string]interface{}{
+		"requestor_account_key": float64(account),
+		"privilege":             privilege,
+		"granted":               granted,
+		"expires_at":            float64(expiresAt.Unix()),
+		"sequence":              float64(sequence),
+		"signature":             grantSignature(testSecret, 7, grant),
+	}
+}
+
+func caller(account int) common.Dict {
+	return common.Dict{"caller_authid": fmt.Sprint(account)}
+}
+
+func TestCheck(t *testing.T) {
+	t.Run("system callers need no check", func(t *testing.T) {
+		p, m, _ := newTestPrivilege(t)
+
+		granted, err := p.Check("MAINTAIN", common.Dict{"caller_authid": "system"})
+		require.NoError(t, err)
+		assert.True(t, granted)
+		assert.Zero(t, m.GetCallCount())
+	})
+
+	t.Run("caches live decisions per account and privilege", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{true}}, nil)
+
+		for range 3 {
+			granted, err := p.Check("MAINTAIN", caller(12))
+			require.NoError(t, err)
+			assert.True(t, granted)
+		}
+		assert.Equal(t, 1, m.GetCallCount(), "repeated checks are answered from the cache")
+
+		_, err := p.Check("READ", caller(12))
+		require.NoError(t, err)
+		_, err = p.Check("MAINTAIN", caller(13))
+		require.NoError(t, err)
+		assert.Equal(t, 3, m.GetCallCount())
+
+		*now = now.Add(grantTTL)
+		_, err = p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.Equal(t, 4, m.GetCallCount(), "expired grants are checked again")
+	})
+
+	t.Run("denials expire sooner", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{false}}, nil)
+
+		granted, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.False(t, granted)
+
+		*now = now.Add(denialTTL)
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{true}}, nil)
+		granted, err = p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.True(t, granted)
+	})
+
+	t.Run("falls back to a recently expired signed grant when the backend fails", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		m.SetCallResponse(string(topics.GetPrivilegeGrants), common.Result{Arguments: []interface{}{[]interface{}{
+			signedGrant(12, "MAINTAIN", true, now.Add(grantTTL), 1),
+		}}}, nil)
+		require.NoError(t, p.Sync(t.Context()))
+
+		m.SetCallError(string(topics.CheckPrivilege), errors.New("timeout"))
+		*now = now.Add(grantTTL + time.Minute)
+		granted, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.True(t, granted)
+
+		*now = now.Add(staleWindow)
+		_, err = p.Check("MAINTAIN", caller(12))
+		assert.Error(t, err, "too old to stand in")
+
+		_, err = p.Check("MAINTAIN", caller(13))
+		assert.Error(t, err, "nothing cached")
+	})
+
+	t.Run("a decision of a live check does not outlive its expiry", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{true}}, nil)
+		_, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+
+		m.SetCallError(string(topics.CheckPrivilege), errors.New("timeout"))
+		*now = now.Add(grantTTL + time.Second)
+		_, err = p.Check("MAINTAIN", caller(12))
+		assert.Error(t, err, "a revocation could not have reached the device")
+	})
+}
+
+func TestSync(t *testing.T) {
+	grantTopic := topics.Topic(fmt.Sprintf(string(topics.PrivilegeGrants), 7))
+
+	t.Run("pre-warms the cache with the signed grants", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		forged := signedGrant(14, "MAINTAIN", true, now.Add(time.Hour), 3)
+		forged["signature"] = "forged"
+		m.SetCallResponse(string(topics.GetPrivilegeGrants), common.Result{Arguments: []interface{}{[]interface{}{
+			signedGrant(12, "MAINTAIN", true, now.Add(time.Hour), 1),
+			signedGrant(13, "MAINTAIN", false, now.Add(time.Hour), 2),
+			forged,
+		}}}, nil)
+
+		require.NoError(t, p.Sync(t.Context()))
+
+		granted, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.True(t, granted)
+		granted, err = p.Check("MAINTAIN", caller(13))
+		require.NoError(t, err)
+		assert.False(t, granted)
+		assert.Equal(t, 1, m.GetCallCount(), "only the grant fetch went to the backend")
+
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{false}}, nil)
+		granted, err = p.Check("MAINTAIN", caller(14))
+		require.NoError(t, err)
+		assert.False(t, granted)
+		assert.Equal(t, topics.CheckPrivilege, m.CallCalls[1].Topic, "forged grants are not trusted")
+	})
+
+	t.Run("applies pushed grants and revocations", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		require.NoError(t, p.Sync(t.Context()))
+
+		delivered, err := m.Emit(grantTopic, common.Result{Arguments: []interface{}{signedGrant(12, "MAINTAIN", true, now.Add(time.Hour), 1)}})
+		require.NoError(t, err)
+		require.True(t, delivered)
+
+		granted, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.True(t, granted)
+
+		_, err = m.Emit(grantTopic, common.Result{Arguments: []interface{}{signedGrant(12, "MAINTAIN", false, now.Add(time.Hour), 2)}})
+		require.NoError(t, err)
+
+		granted, err = p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.False(t, granted, "revoked")
+		assert.Equal(t, 1, m.GetCallCount())
+	})
+
+	t.Run("a replayed grant does not undo a newer revocation", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		require.NoError(t, p.Sync(t.Context()))
+
+		grant := signedGrant(12, "MAINTAIN", true, now.Add(time.Hour), 1)
+		_, err := m.Emit(grantTopic, common.Result{Arguments: []interface{}{grant}})
+		require.NoError(t, err)
+		_, err = m.Emit(grantTopic, common.Result{Arguments: []interface{}{signedGrant(12, "MAINTAIN", false, now.Add(time.Hour), 2)}})
+		require.NoError(t, err)
+
+		_, err = m.Emit(grantTopic, common.Result{Arguments: []interface{}{grant}})
+		require.NoError(t, err)
+
+		granted, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.False(t, granted, "still revoked")
+
+		// nor once the revocation left the cache
+		*now = now.Add(2 * time.Hour)
+		_, err = m.Emit(grantTopic, common.Result{Arguments: []interface{}{signedGrant(12, "MAINTAIN", true, now.Add(time.Hour), 1)}})
+		require.NoError(t, err)
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{false}}, nil)
+		granted, err = p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.False(t, granted)
+		assert.Equal(t, topics.CheckPrivilege, m.CallCalls[len(m.CallCalls)-1].Topic, "checked live")
+	})
+
+	t.Run("a pushed grant must be signed for this device", func(t *testing.T) {
+		p, m, now := newTestPrivilege(t)
+		require.NoError(t, p.Sync(t.Context()))
+
+		otherDevice := signedGrant(12, "MAINTAIN", true, now.Add(time.Hour), 1)
+		otherDevice["signature"] = grantSignature(testSecret, 8, Grant{RequestorAccountKey: 12, Privilege: "MAINTAIN", Granted: true, ExpiresAt: now.Add(time.Hour), Sequence: 1})
+		_, err := m.Emit(grantTopic, common.Result{Arguments: []interface{}{otherDevice}})
+		require.NoError(t, err)
+
+		m.SetCallResponse(string(topics.CheckPrivilege), common.Result{Arguments: []interface{}{false}}, nil)
+		granted, err := p.Check("MAINTAIN", caller(12))
+		require.NoError(t, err)
+		assert.False(t, granted)
+	})
+}
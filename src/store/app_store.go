@@ -199,6 +199,19 @@ func (am *AppStore) UpdateRemoteAppState(ctx context.Context, app *common.App, s
 		"updateStatus":          app.UpdateStatus,
 	}}
 
+	app.StateLock.Lock()
+	if app.ImageSignatures != nil {
+		payload[0].(common.Dict)["image_signatures"] = app.ImageSignatures
+	}
+	if app.ServiceUpdates != nil {
+		// a copy: the update goes on changing them while this is sent
+		payload[0].(common.Dict)["service_updates"] = append([]common.ServiceUpdate(nil), app.ServiceUpdates...)
+	}
+	if app.Services != nil {
+		payload[0].(common.Dict)["services"] = app.Services
+	}
+	app.StateLock.Unlock()
+
 	_, err := am.Messenger.Call(ctx, topics.SetActualAppOnDeviceState, payload, nil, nil, nil)
 	if err != nil {
 		return err
@@ -0,0 +1,115 @@
+package system
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reagent/common"
+	"reagent/config"
+	"reagent/messenger/topics"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RenewDeviceCertificate rotates the device's TLS identity. It generates a
+// fresh key pair, has the backend sign a certificate for it and swaps both
+// into the .flock file in one write. The private key never leaves the device.
+// The new certificate is used from the next connection on.
+func (system *System) RenewDeviceCertificate(ctx context.Context) (time.Time, error) {
+	reswarmConfig := system.config.ReswarmConfig
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: reswarmConfig.SerialNumber},
+	}, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+
+	args := []interface{}{common.Dict{
+		"device_key": reswarmConfig.DeviceKey,
+		"csr":        string(csrPEM),
+	}}
+	res, err := system.messenger.Call(ctx, topics.SignDeviceCertificate, args, nil, nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if len(res.Arguments) == 0 {
+		return time.Time{}, errors.New("the backend returned no certificate")
+	}
+	certPEM := fmt.Sprint(res.Arguments[0])
+	if resultDict, ok := res.Arguments[0].(map[string]interface{}); ok {
+		certPEM = fmt.Sprint(resultDict["certificate"])
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	notAfter, err := verifyRenewedCertificate(reswarmConfig, []byte(certPEM), keyPEM, time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	// write a copy first: the running config only changes once the new
+	// identity is safely on disk
+	renewed := *reswarmConfig
+	renewed.Authentication.Certificate = certPEM
+	renewed.Authentication.Key = string(keyPEM)
+
+	err = config.SaveReswarmConfig(system.config.CommandLineArguments.ConfigFileLocation, &renewed)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	reswarmConfig.Authentication.Certificate = renewed.Authentication.Certificate
+	reswarmConfig.Authentication.Key = renewed.Authentication.Key
+
+	log.Info().Time("expires", notAfter).Msg("Renewed the device certificate")
+
+	return notAfter, nil
+}
+
+// verifyRenewedCertificate checks that a certificate the backend signed is
+// one the device can use: it belongs to the new key, is for this device and
+// is currently valid.
+func verifyRenewedCertificate(reswarmConfig *config.ReswarmConfig, certPEM []byte, keyPEM []byte, now time.Time) (time.Time, error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the signed certificate does not match the new key: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if cert.Subject.CommonName != reswarmConfig.SerialNumber {
+		return time.Time{}, fmt.Errorf("the signed certificate is for %q, not this device", cert.Subject.CommonName)
+	}
+
+	if now.Before(cert.NotBefore) || !now.Before(cert.NotAfter) {
+		return time.Time{}, fmt.Errorf("the signed certificate is not valid now (valid from %s until %s)", cert.NotBefore, cert.NotAfter)
+	}
+
+	return cert.NotAfter, nil
+}
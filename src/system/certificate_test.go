@@ -0,0 +1,150 @@
+package system
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"reagent/common"
+	"reagent/config"
+	"reagent/messenger/topics"
+	"reagent/testutil/builders"
+	"reagent/testutil/fakes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA signs device CSRs like the backend does.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test device CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) sign(t *testing.T, csrPEM string, commonName string, validity time.Duration) string {
+	t.Helper()
+
+	block, _ := pem.Decode([]byte(csrPEM))
+	require.NotNil(t, block)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+
+	if commonName == "" {
+		commonName = csr.Subject.CommonName
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestRenewDeviceCertificate(t *testing.T) {
+	newSystem := func(t *testing.T) (*System, *fakes.Messenger, *config.Config) {
+		t.Helper()
+		cfg := builders.NewTestConfigBuilder().WithSerialNumber("SN-1").WithDeviceKey(1).Build()
+		cfg.CommandLineArguments.ConfigFileLocation = filepath.Join(t.TempDir(), "device.flock")
+		cfg.ReswarmConfig.Authentication.Certificate = "old certificate"
+		cfg.ReswarmConfig.Authentication.Key = "old key"
+
+		msg := fakes.NewMessengerWithConfig(cfg)
+		sys := New(cfg, msg)
+		return &sys, msg, cfg
+	}
+
+	signWith := func(t *testing.T, ca *testCA, commonName string, validity time.Duration) func(args []interface{}) (common.Result, error) {
+		return func(args []interface{}) (common.Result, error) {
+			request := args[0].(common.Dict)
+			certPEM := ca.sign(t, request["csr"].(string), commonName, validity)
+			return common.Result{Arguments: []interface{}{map[string]interface{}{"certificate": certPEM}}}, nil
+		}
+	}
+
+	t.Run("rotates key and certificate together", func(t *testing.T) {
+		sys, msg, cfg := newSystem(t)
+		msg.SetCallHandler(string(topics.SignDeviceCertificate), signWith(t, newTestCA(t), "", 90*24*time.Hour))
+
+		notAfter, err := sys.RenewDeviceCertificate(t.Context())
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(90*24*time.Hour), notAfter, time.Minute)
+
+		assert.Contains(t, cfg.ReswarmConfig.Authentication.Certificate, "BEGIN CERTIFICATE")
+		assert.Contains(t, cfg.ReswarmConfig.Authentication.Key, "BEGIN EC PRIVATE KEY")
+
+		reloaded, err := config.LoadReswarmConfig(cfg.CommandLineArguments.ConfigFileLocation)
+		require.NoError(t, err)
+		assert.Equal(t, cfg.ReswarmConfig.Authentication.Certificate, reloaded.Authentication.Certificate)
+		assert.Equal(t, cfg.ReswarmConfig.Authentication.Key, reloaded.Authentication.Key)
+
+		request := msg.CallCalls[0].Args[0].(common.Dict)
+		assert.NotContains(t, request, "key", "the private key never leaves the device")
+	})
+
+	for _, tc := range []struct {
+		name       string
+		commonName string
+		validity   time.Duration
+	}{
+		{"rejects a certificate for another device", "SN-2", time.Hour},
+		{"rejects an expired certificate", "", -time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sys, msg, cfg := newSystem(t)
+			msg.SetCallHandler(string(topics.SignDeviceCertificate), signWith(t, newTestCA(t), tc.commonName, tc.validity))
+
+			_, err := sys.RenewDeviceCertificate(t.Context())
+			require.Error(t, err)
+			assert.Equal(t, "old certificate", cfg.ReswarmConfig.Authentication.Certificate, "the old identity is kept")
+			assert.Equal(t, "old key", cfg.ReswarmConfig.Authentication.Key)
+			assert.NoFileExists(t, cfg.CommandLineArguments.ConfigFileLocation)
+		})
+	}
+
+	t.Run("keeps the old identity when the backend fails", func(t *testing.T) {
+		sys, msg, cfg := newSystem(t)
+		msg.SetCallError(string(topics.SignDeviceCertificate), errors.New("signing service down"))
+
+		_, err := sys.RenewDeviceCertificate(t.Context())
+		require.Error(t, err)
+		assert.Equal(t, "old certificate", cfg.ReswarmConfig.Authentication.Certificate)
+	})
+}
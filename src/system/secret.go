@@ -0,0 +1,179 @@
+package system
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"reagent/common"
+	"reagent/config"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SecretRotationGrace is how long after a rotation the device falls back to
+// its previous secret when the router rejects the new one.
+const SecretRotationGrace = 10 * time.Minute
+
+// secretRotationInfo binds the key the backend encrypts a new secret with to
+// its purpose.
+const secretRotationInfo = "reagent device secret rotation"
+
+// RotateDeviceSecret switches the device to the new WAMP-CRA secret the
+// backend encrypted to it. The config file is rewritten in one step after
+// backing up the current one next to it (<config>.bak). The new secret is put
+// to use on the next connection; if the router rejects it within
+// SecretRotationGrace, the previous secret is restored. The
+// outcome is confirmed to the backend once connected again.
+func (system *System) RotateDeviceSecret(encryptedSecret string) error {
+	rotator, ok := system.messenger.(messenger.SecretRotator)
+	if !ok {
+		return errors.New("the messenger cannot rotate the device secret")
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	reswarmConfig := system.config.ReswarmConfig
+	secret, err := decryptDeviceSecret(reswarmConfig, encryptedSecret)
+	if err != nil {
+		return err
+	}
+
+	if secret == reswarmConfig.Secret {
+		return errors.New("the new device secret is the current one")
+	}
+
+	configPath := system.config.CommandLineArguments.ConfigFileLocation
+	backupPath := configPath + ".bak"
+
+	// SaveReswarmConfig keeps the backup readable by its owner only, like
+	// the config itself: it holds the current secret.
+	err = config.SaveReswarmConfig(backupPath, reswarmConfig)
+	if err != nil {
+		return fmt.Errorf("failed to back up the config: %w", err)
+	}
+
+	rotated := *reswarmConfig
+	rotated.Secret = secret
+
+	err = config.SaveReswarmConfig(configPath, &rotated)
+	if err != nil {
+		os.Remove(backupPath)
+		return err
+	}
+
+	previous := reswarmConfig.Secret
+	reswarmConfig.Secret = secret
+
+	rotator.RotateSecret(messenger.SecretRotation{
+		Until: time.Now().Add(SecretRotationGrace),
+		Revert: func() error {
+			configMu.Lock()
+			defer configMu.Unlock()
+
+			// Only the secret is put back: the config may have changed
+			// otherwise since (a renewed certificate, say), which the
+			// backup does not have.
+			reverted := *reswarmConfig
+			reverted.Secret = previous
+
+			err := config.SaveReswarmConfig(configPath, &reverted)
+			if err != nil {
+				return fmt.Errorf("failed to restore the config with the previous device secret: %w", err)
+			}
+
+			reswarmConfig.Secret = previous
+			os.Remove(backupPath)
+			return nil
+		},
+		Finished: func(rotated bool) {
+			if rotated {
+				// the backup holds the secret that is about to be revoked
+				os.Remove(backupPath)
+				log.Info().Msg("Rotated the device secret")
+			}
+
+			system.confirmDeviceSecret(rotated)
+		},
+	})
+
+	return nil
+}
+
+func (system *System) confirmDeviceSecret(rotated bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	args := []interface{}{common.Dict{
+		"device_key": system.config.ReswarmConfig.DeviceKey,
+		"rotated":    rotated,
+	}}
+	_, err := system.messenger.Call(ctx, topics.ConfirmDeviceSecret, args, nil, nil, nil)
+	if err != nil {
+		log.Error().Err(err).Bool("rotated", rotated).Msg("Failed to confirm the device secret rotation")
+	}
+}
+
+// decryptDeviceSecret opens a new secret sealed with AES-256-GCM under a key
+// derived from the current secret with HKDF-SHA256. The device's authid
+// ("<swarm_key>-<device_key>") is the additional data, so a secret sealed for
+// one device cannot be replayed to another. The payload is the base64 of the
+// nonce followed by the ciphertext.
+func decryptDeviceSecret(reswarmConfig *config.ReswarmConfig, encryptedSecret string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encryptedSecret)
+	if err != nil {
+		return "", fmt.Errorf("the encrypted secret is not base64: %w", err)
+	}
+
+	aead, err := deviceSecretAEAD(reswarmConfig)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("the encrypted secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(deviceAuthID(reswarmConfig)))
+	if err != nil {
+		return "", errors.New("the encrypted secret was not sealed for this device")
+	}
+
+	if len(plaintext) == 0 {
+		return "", errors.New("the new device secret is empty")
+	}
+
+	return string(plaintext), nil
+}
+
+func deviceSecretAEAD(reswarmConfig *config.ReswarmConfig) (cipher.AEAD, error) {
+	if reswarmConfig.Secret == "" {
+		return nil, errors.New("the device has no secret to rotate")
+	}
+
+	key, err := hkdf.Key(sha256.New, []byte(reswarmConfig.Secret), nil, secretRotationInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func deviceAuthID(reswarmConfig *config.ReswarmConfig) string {
+	return fmt.Sprintf("%d-%d", reswarmConfig.SwarmKey, reswarmConfig.DeviceKey)
+}
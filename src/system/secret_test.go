@@ -0,0 +1,184 @@
+package system
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"reagent/common"
+	"reagent/config"
+	"reagent/messenger"
+	"reagent/messenger/topics"
+	"reagent/testutil/builders"
+	"reagent/testutil/fakes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatingMessenger records the rotation the system arms on the messenger.
+type rotatingMessenger struct {
+	*fakes.Messenger
+	rotation *messenger.SecretRotation
+}
+
+func (m *rotatingMessenger) RotateSecret(rotation messenger.SecretRotation) {
+	m.rotation = &rotation
+}
+
+// sealSecret encrypts a new secret to the device like the backend does.
+func sealSecret(t *testing.T, currentSecret string, authID string, secret string) string {
+	t.Helper()
+
+	key, err := hkdf.Key(sha256.New, []byte(currentSecret), nil, secretRotationInfo, 32)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), []byte(authID)))
+}
+
+func TestRotateDeviceSecret(t *testing.T) {
+	newSystem := func(t *testing.T) (*System, *rotatingMessenger, *config.Config) {
+		t.Helper()
+		cfg := builders.NewTestConfigBuilder().WithDeviceKey(7).Build()
+		cfg.ReswarmConfig.SwarmKey = 3
+		cfg.ReswarmConfig.Secret = "old secret"
+		cfg.CommandLineArguments.ConfigFileLocation = filepath.Join(t.TempDir(), "device.flock")
+		require.NoError(t, config.SaveReswarmConfig(cfg.CommandLineArguments.ConfigFileLocation, cfg.ReswarmConfig))
+
+		msg := &rotatingMessenger{Messenger: fakes.NewMessengerWithConfig(cfg)}
+		sys := New(cfg, msg)
+		return &sys, msg, cfg
+	}
+
+	loadSecret := func(t *testing.T, path string) string {
+		t.Helper()
+		reloaded, err := config.LoadReswarmConfig(path)
+		require.NoError(t, err)
+		return reloaded.Secret
+	}
+
+	t.Run("switches to the new secret and confirms it", func(t *testing.T) {
+		sys, msg, cfg := newSystem(t)
+		configPath := cfg.CommandLineArguments.ConfigFileLocation
+
+		err := sys.RotateDeviceSecret(sealSecret(t, "old secret", "3-7", "new secret"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "new secret", cfg.ReswarmConfig.Secret)
+		assert.Equal(t, "new secret", loadSecret(t, configPath))
+		assert.Equal(t, "old secret", loadSecret(t, configPath+".bak"))
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(configPath + ".bak")
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "the backup holds a secret too")
+		}
+		require.NotNil(t, msg.rotation)
+
+		msg.rotation.Finished(true)
+		assert.NoFileExists(t, configPath+".bak", "the revoked secret does not linger on disk")
+
+		require.Len(t, msg.CallCalls, 1)
+		assert.Equal(t, topics.ConfirmDeviceSecret, msg.CallCalls[0].Topic)
+		assert.Equal(t, common.Dict{"device_key": 7, "rotated": true}, msg.CallCalls[0].Args[0])
+	})
+
+	t.Run("restores the previous secret when it is rejected", func(t *testing.T) {
+		sys, msg, cfg := newSystem(t)
+		configPath := cfg.CommandLineArguments.ConfigFileLocation
+
+		require.NoError(t, sys.RotateDeviceSecret(sealSecret(t, "old secret", "3-7", "new secret")))
+
+		require.NoError(t, msg.rotation.Revert())
+		assert.Equal(t, "old secret", cfg.ReswarmConfig.Secret)
+		assert.Equal(t, "old secret", loadSecret(t, configPath))
+		assert.NoFileExists(t, configPath+".bak")
+
+		msg.rotation.Finished(false)
+		require.Len(t, msg.CallCalls, 1)
+		assert.Equal(t, false, msg.CallCalls[0].Args[0].(common.Dict)["rotated"])
+	})
+
+	t.Run("a revert keeps what changed in the config since", func(t *testing.T) {
+		sys, msg, cfg := newSystem(t)
+		configPath := cfg.CommandLineArguments.ConfigFileLocation
+
+		require.NoError(t, sys.RotateDeviceSecret(sealSecret(t, "old secret", "3-7", "new secret")))
+
+		// a certificate renewed while the new secret is on trial
+		cfg.ReswarmConfig.Authentication.Certificate = "renewed"
+		require.NoError(t, config.SaveReswarmConfig(configPath, cfg.ReswarmConfig))
+
+		require.NoError(t, msg.rotation.Revert())
+		reloaded, err := config.LoadReswarmConfig(configPath)
+		require.NoError(t, err)
+		assert.Equal(t, "old secret", reloaded.Secret)
+		assert.Equal(t, "renewed", reloaded.Authentication.Certificate)
+	})
+
+	t.Run("reports a revert it could not save", func(t *testing.T) {
+		sys, msg, cfg := newSystem(t)
+		configPath := cfg.CommandLineArguments.ConfigFileLocation
+
+		require.NoError(t, sys.RotateDeviceSecret(sealSecret(t, "old secret", "3-7", "new secret")))
+
+		// the config cannot be replaced: its temporary file is in the way
+		require.NoError(t, os.MkdirAll(filepath.Join(configPath+".tmp", "in-the-way"), 0o755))
+
+		assert.Error(t, msg.rotation.Revert())
+		assert.Equal(t, "new secret", cfg.ReswarmConfig.Secret)
+		assert.Equal(t, "old secret", loadSecret(t, configPath+".bak"), "the backup is kept")
+	})
+
+	for _, tc := range []struct {
+		name      string
+		encrypted func(t *testing.T) string
+	}{
+		{"rejects a secret sealed for another device", func(t *testing.T) string {
+			return sealSecret(t, "old secret", "3-8", "new secret")
+		}},
+		{"rejects a secret sealed with another key", func(t *testing.T) string {
+			return sealSecret(t, "leaked secret", "3-7", "new secret")
+		}},
+		{"rejects a payload that is not base64", func(t *testing.T) string {
+			return "not base64!"
+		}},
+		{"rejects the current secret", func(t *testing.T) string {
+			return sealSecret(t, "old secret", "3-7", "old secret")
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sys, msg, cfg := newSystem(t)
+			configPath := cfg.CommandLineArguments.ConfigFileLocation
+
+			require.Error(t, sys.RotateDeviceSecret(tc.encrypted(t)))
+			assert.Equal(t, "old secret", cfg.ReswarmConfig.Secret)
+			assert.Equal(t, "old secret", loadSecret(t, configPath))
+			assert.NoFileExists(t, configPath+".bak")
+			assert.Nil(t, msg.rotation)
+		})
+	}
+
+	t.Run("needs a messenger that can fall back", func(t *testing.T) {
+		cfg := builders.NewTestConfigBuilder().Build()
+		cfg.ReswarmConfig.Secret = "old secret"
+		sys := New(cfg, fakes.NewMessengerWithConfig(cfg))
+
+		require.Error(t, sys.RotateDeviceSecret(sealSecret(t, "old secret", "0-0", "new secret")))
+		assert.Equal(t, "old secret", cfg.ReswarmConfig.Secret)
+	})
+}
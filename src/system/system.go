@@ -37,6 +37,11 @@ type System struct {
 	messenger messenger.Messenger
 }
 
+// configMu serializes the changes of the device config: each copies the
+// running config, saves the copy and applies it, and two at once would each
+// save over the other's change.
+var configMu sync.Mutex
+
 type UpdateResult struct {
 	CurrentVersion  string
 	LatestVersion   string
@@ -86,7 +91,7 @@ func buildBinaryDownloadURL(base, bucketName, goos, arch, versionString, fileNam
 	return url
 }
 
-func (sys *System) downloadBinary(fileName string, bucketName string, versionString string, includeVersionString bool, progressCallback func(filesystem.DownloadProgress)) error {
+func (sys *System) downloadBinary(ctx context.Context, fileName string, bucketName string, versionString string, includeVersionString bool, progressCallback func(filesystem.DownloadProgress)) error {
 	isWindows := runtime.GOOS == "windows"
 	agentHomedir := sys.config.CommandLineArguments.AgentDir
 	agentURL := buildBinaryDownloadURL(sys.updateBaseURL(), bucketName, runtime.GOOS, release.GetBuildArch(), versionString, fileName)
@@ -104,7 +109,7 @@ func (sys *System) downloadBinary(fileName string, bucketName string, versionStr
 
 	tmpFilePath := sys.config.CommandLineArguments.DownloadDir + "/" + fileName + "-v" + versionString
 	log.Debug().Msgf("Attempting to download latest %s binary at %s", fileName, agentURL)
-	err := filesystem.DownloadURL(tmpFilePath, agentURL, progressCallback)
+	err := filesystem.DownloadURL(ctx, tmpFilePath, agentURL, progressCallback)
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to download from URL: %s", agentURL)
 		return err
@@ -273,8 +278,9 @@ func getOSUpdateTags() (string, string, error) {
 
 // ------------------------------------------------------------------------- //
 
-// GetOSUpdate downloads the actual update-bundle to the device
-func GetOSUpdate(progressCallback func(filesystem.DownloadProgress)) error {
+// GetOSUpdate downloads the actual update-bundle to the device. Cancelling ctx
+// aborts the download.
+func GetOSUpdate(ctx context.Context, progressCallback func(filesystem.DownloadProgress)) error {
 
 	// find release tags from update file regularly updated by the system
 	updateURL, updateFile, err := getOSUpdateTags()
@@ -285,7 +291,7 @@ func GetOSUpdate(progressCallback func(filesystem.DownloadProgress)) error {
 	log.Debug().Msg("Starting to download ReswarmOS bundle from " + updateURL + " to /tmp/" + updateFile)
 
 	// download update bundle at given URL
-	err = filesystem.DownloadURL("/tmp/"+updateFile, updateURL, progressCallback)
+	err = filesystem.DownloadURL(ctx, "/tmp/"+updateFile, updateURL, progressCallback)
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to download from URL: %s", updateURL)
 		return err
@@ -365,7 +371,7 @@ func (system *System) compareVersion(currentVersion string, latestVersion string
 	return shouldUpdate, errors, nil
 }
 
-func (system *System) DownloadFrpIfNotExists() error {
+func (system *System) DownloadFrpIfNotExists(ctx context.Context) error {
 	frpcPath := filesystem.GetTunnelBinaryPath(system.config, "frpc")
 
 	// Skip when the on-disk frpc already matches the pinned version.
@@ -400,7 +406,7 @@ func (system *System) DownloadFrpIfNotExists() error {
 	// binary. It rides the existing re-agent bucket + appliance /dl proxy via
 	// the "re-agent/frpc" sub-path. The download lands at frpcPath exactly.
 	log.Info().Msgf("Downloading frpc v%s to %s", embedded.FRP_VERSION, frpcPath)
-	err = system.downloadBinary("frpc", "re-agent/frpc", embedded.FRP_VERSION, false, nil)
+	err = system.downloadBinary(ctx, "frpc", "re-agent/frpc", embedded.FRP_VERSION, false, nil)
 	if err != nil {
 		return fmt.Errorf("failed to download frpc: %w", err)
 	}
@@ -408,11 +414,11 @@ func (system *System) DownloadFrpIfNotExists() error {
 	return nil
 }
 
-func (system *System) updateFrpIfRequired(progressCallback func(filesystem.DownloadProgress)) (UpdateResult, error) {
+func (system *System) updateFrpIfRequired(ctx context.Context, progressCallback func(filesystem.DownloadProgress)) (UpdateResult, error) {
 	// frpc is pinned to embedded.FRP_VERSION; ensure the on-disk binary is
 	// present and current (extracted from the embed on Linux/macOS, downloaded
 	// on Windows).
-	err := system.DownloadFrpIfNotExists()
+	err := system.DownloadFrpIfNotExists(ctx)
 	if err != nil {
 		return UpdateResult{}, err
 	}
@@ -489,6 +495,9 @@ func (system *System) UpdateDeviceMetadata() (swarmChanged bool, err error) {
 		return false, fmt.Errorf("swarm_key has invalid type %T", resultPayload["swarm_key"])
 	}
 
+	configMu.Lock()
+	defer configMu.Unlock()
+
 	swarmChanged = system.config.ReswarmConfig.SwarmKey != int(swarmKey)
 
 	system.config.ReswarmConfig.Name = deviceName
@@ -501,7 +510,10 @@ func (system *System) UpdateDeviceMetadata() (swarmChanged bool, err error) {
 	return swarmChanged, err
 }
 
-func (system *System) UpdateSystem(progressCallback func(filesystem.DownloadProgress), updateAgent bool) (UpdateResult, error) {
+// UpdateSystem brings frpc and, with updateAgent, the agent up to date,
+// reporting the combined download progress. Cancelling ctx aborts the
+// downloads.
+func (system *System) UpdateSystem(ctx context.Context, progressCallback func(filesystem.DownloadProgress), updateAgent bool) (UpdateResult, error) {
 	var wg sync.WaitGroup
 
 	progressChan := make(chan filesystem.DownloadProgress)
@@ -522,7 +534,7 @@ func (system *System) UpdateSystem(progressCallback func(filesystem.DownloadProg
 
 		defer wg.Done()
 
-		updateResult, err := system.updateFrpIfRequired(progressFunction)
+		updateResult, err := system.updateFrpIfRequired(ctx, progressFunction)
 		if err != nil {
 			log.Error().Stack().Err(err).Msgf("Failed to update frpc.. continuing...")
 		}
@@ -540,7 +552,7 @@ func (system *System) UpdateSystem(progressCallback func(filesystem.DownloadProg
 
 			defer wg.Done()
 
-			updateResult, err := system.updateAgentIfRequired(progressFunction)
+			updateResult, err := system.updateAgentIfRequired(ctx, progressFunction)
 			if err != nil {
 				log.Error().Stack().Err(err).Msgf("Failed to update.. continuing...")
 			}
@@ -612,6 +624,11 @@ func (system *System) UpdateSystem(progressCallback func(filesystem.DownloadProg
 	// final before acting on it.
 	wg.Wait()
 
+	// a cancelled update leaves a finished download unused
+	if err := ctx.Err(); err != nil {
+		return UpdateResult{}, err
+	}
+
 	if didAgentUpdate {
 		// On Windows service installs this swaps the new binary into place
 		// and schedules a restart; everywhere else it is a no-op (Linux
@@ -628,7 +645,7 @@ func (system *System) UpdateSystem(progressCallback func(filesystem.DownloadProg
 	}, nil
 }
 
-func (system *System) updateAgentIfRequired(progressCallback func(filesystem.DownloadProgress)) (UpdateResult, error) {
+func (system *System) updateAgentIfRequired(ctx context.Context, progressCallback func(filesystem.DownloadProgress)) (UpdateResult, error) {
 	latestVersion, err := system.GetLatestVersion("re-agent")
 	if err != nil {
 		return UpdateResult{}, err
@@ -653,7 +670,7 @@ func (system *System) updateAgentIfRequired(progressCallback func(filesystem.Dow
 	}
 
 	log.Info().Msgf("Agent not up to date, downloading: %s", latestVersion)
-	err = system.downloadBinary("reagent", "re-agent", latestVersion, true, progressCallback)
+	err = system.downloadBinary(ctx, "reagent", "re-agent", latestVersion, true, progressCallback)
 	if err != nil {
 		if errdefs.IsInProgress(err) {
 			return UpdateResult{
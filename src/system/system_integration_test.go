@@ -3,6 +3,7 @@
 package system
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"runtime"
@@ -104,7 +105,7 @@ func TestFrpcExtractAndVersion_Integration(t *testing.T) {
 	require.Error(t, verErr, "GetFrpCurrentVersion must error when frpc is absent")
 
 	// Extract the embedded binary for real.
-	require.NoError(t, sys.DownloadFrpIfNotExists())
+	require.NoError(t, sys.DownloadFrpIfNotExists(context.Background()))
 	t.Cleanup(func() { _ = os.Remove(frpcPath) })
 
 	exists, err = filesystem.PathExists(frpcPath)
@@ -128,7 +129,7 @@ func TestFrpcExtractAndVersion_Integration(t *testing.T) {
 		"running frpc --version should report the embedded FRP_VERSION")
 
 	// A second extract call should be a no-op (version matches) and stay green.
-	require.NoError(t, sys.DownloadFrpIfNotExists())
+	require.NoError(t, sys.DownloadFrpIfNotExists(context.Background()))
 }
 
 // TestGetLatestVersion_Integration performs a real network fetch of the
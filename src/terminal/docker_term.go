@@ -124,12 +124,12 @@ func (tm *TerminalManager) registerResizeTopic(termSess *TerminalSession) error
 		heightKw := payload["height"]
 		widthKw := payload["width"]
 
-		height, ok := heightKw.(uint64)
+		height, ok := common.ToUint64(heightKw)
 		if !ok {
 			return nil, errors.New("failed to parse height")
 		}
 
-		width, ok := widthKw.(uint64)
+		width, ok := common.ToUint64(widthKw)
 		if !ok {
 			return nil, errors.New("failed to parse width")
 		}
@@ -15,6 +15,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"reagent/container"
 	"reagent/testutil/builders"
 	"reagent/testutil/fakes"
@@ -38,12 +39,12 @@ const (
 // newDockerOrSkip builds a real Docker client and pings the daemon. It skips the
 // test (rather than failing) when no daemon is reachable, so the suite stays
 // green on machines without Docker.
-func newDockerOrSkip(t *testing.T) *container.Docker {
+func newDockerOrSkip(t *testing.T) container.Container {
 	t.Helper()
 
-	cfg := builders.DefaultTestConfig()
+	cfg := builders.NewTestConfigBuilder().WithContainerRuntime(os.Getenv("REAGENT_TEST_RUNTIME")).Build()
 
-	docker, err := container.NewDocker(cfg)
+	docker, err := container.New(cfg)
 	if err != nil {
 		t.Skipf("skipping: cannot create docker client (no daemon?): %v", err)
 	}
@@ -60,7 +61,7 @@ func newDockerOrSkip(t *testing.T) *container.Docker {
 
 // ensureImageOrSkip makes sure the throwaway image is present locally, pulling
 // it if necessary. Skips on pull failure (e.g. no network in this env).
-func ensureImageOrSkip(t *testing.T, docker *container.Docker) {
+func ensureImageOrSkip(t *testing.T, docker container.Container) {
 	t.Helper()
 
 	ctx, cancel := context.WithTimeout(context.Background(), containerOpsTimeout)
@@ -87,7 +88,7 @@ func ensureImageOrSkip(t *testing.T, docker *container.Docker) {
 
 // startThrowawayContainer creates and starts a long-lived alpine container and
 // registers cleanup to force-remove it. Returns the container name.
-func startThrowawayContainer(t *testing.T, docker *container.Docker) string {
+func startThrowawayContainer(t *testing.T, docker container.Container) string {
 	t.Helper()
 
 	name := fmt.Sprintf("reagent-term-it-%s", uuid.NewString()[:8])
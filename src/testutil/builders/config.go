@@ -84,6 +84,12 @@ func (b *TestConfigBuilder) WithAgentDir(dir string) *TestConfigBuilder {
 	return b
 }
 
+// WithContainerRuntime sets the container runtime (auto, docker or podman).
+func (b *TestConfigBuilder) WithContainerRuntime(runtime string) *TestConfigBuilder {
+	b.config.CommandLineArguments.ContainerRuntime = runtime
+	return b
+}
+
 // WithDebug sets debug mode.
 func (b *TestConfigBuilder) WithDebug(debug bool) *TestConfigBuilder {
 	b.config.CommandLineArguments.Debug = debug
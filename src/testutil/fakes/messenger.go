@@ -35,6 +35,9 @@ type Messenger struct {
 	// Configurable responses
 	CallResponses map[string]CallResponse
 	CallErrors    map[string]error
+	CallHandlers  map[string]func(args []interface{}) (messenger.Result, error)
+
+	subscriptions map[topics.Topic]func(messenger.Result) error
 }
 
 // PublishCall records a Publish call.
@@ -113,9 +116,26 @@ func (m *Messenger) Subscribe(topic topics.Topic, cb func(messenger.Result) erro
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.SubscribeCalls = append(m.SubscribeCalls, SubscribeCall{Topic: topic, Options: options})
+	if m.subscriptions == nil {
+		m.subscriptions = make(map[topics.Topic]func(messenger.Result) error)
+	}
+	m.subscriptions[topic] = cb
 	return nil
 }
 
+// Emit delivers an event to the callback subscribed to topic, as if it was
+// published by the backend. It reports false when nothing is subscribed.
+func (m *Messenger) Emit(topic topics.Topic, event messenger.Result) (bool, error) {
+	m.mu.RLock()
+	cb, ok := m.subscriptions[topic]
+	m.mu.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, cb(event)
+}
+
 func (m *Messenger) Call(ctx context.Context, topic topics.Topic, args []interface{}, kwargs common.Dict, options common.Dict, progCb func(messenger.Result)) (messenger.Result, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -132,6 +152,11 @@ func (m *Messenger) Call(ctx context.Context, topic topics.Topic, args []interfa
 		return messenger.Result{}, err
 	}
 
+	// Check for a handler answering from the arguments
+	if handler, ok := m.CallHandlers[string(topic)]; ok {
+		return handler(args)
+	}
+
 	// Check for configured response
 	if resp, ok := m.CallResponses[string(topic)]; ok {
 		return resp.Result, resp.Err
@@ -153,6 +178,9 @@ func (m *Messenger) Unregister(topic topics.Topic) error {
 }
 
 func (m *Messenger) Unsubscribe(topic topics.Topic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subscriptions, topic)
 	return nil
 }
 
@@ -240,6 +268,18 @@ func (m *Messenger) SetCallResponse(topic string, result messenger.Result, err e
 	m.CallResponses[topic] = CallResponse{Result: result, Err: err}
 }
 
+// SetCallHandler configures a function computing the result of Call for a
+// topic from its arguments, for backends that answer what they are sent. It
+// runs under the fake's lock, so it must not call back into the fake.
+func (m *Messenger) SetCallHandler(topic string, handler func(args []interface{}) (messenger.Result, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.CallHandlers == nil {
+		m.CallHandlers = make(map[string]func(args []interface{}) (messenger.Result, error))
+	}
+	m.CallHandlers[topic] = handler
+}
+
 // SetCallError configures an error for a specific topic.
 func (m *Messenger) SetCallError(topic string, err error) {
 	m.mu.Lock()
@@ -0,0 +1,297 @@
+package fakes
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"reagent/messenger/mqtt"
+)
+
+// MQTTBroker is an in-process MQTT 5 broker on 127.0.0.1 speaking the
+// reagent/messenger/mqtt codec, for testing the MQTT transport end to end. It
+// routes publications at QoS 0 and 1, publishes wills and takes sessions over
+// by client ID. It keeps no retained messages and no sessions across
+// connections.
+type MQTTBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	users    map[string]string
+	clients  map[string]*brokerClient
+	connects []*mqtt.Connect
+	closed   bool
+}
+
+type brokerClient struct {
+	connect *mqtt.Connect
+	conn    net.Conn
+
+	writeMu sync.Mutex
+	// guarded by MQTTBroker.mu
+	subscriptions map[string]mqtt.Subscription
+	nextID        uint16
+}
+
+// NewMQTTBroker starts a broker accepting any credentials until SetUser is
+// called.
+func NewMQTTBroker() *MQTTBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	b := &MQTTBroker{
+		listener: listener,
+		users:    make(map[string]string),
+		clients:  make(map[string]*brokerClient),
+	}
+	go b.accept()
+
+	return b
+}
+
+// URL is the mqtt:// URL of the broker.
+func (b *MQTTBroker) URL() string {
+	return "mqtt://" + b.listener.Addr().String()
+}
+
+// SetUser makes the broker require credentials, accepting password for
+// username.
+func (b *MQTTBroker) SetUser(username string, password string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users[username] = password
+}
+
+// Connects returns the CONNECT packets the broker accepted, oldest first.
+func (b *MQTTBroker) Connects() []*mqtt.Connect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*mqtt.Connect{}, b.connects...)
+}
+
+// Connected reports whether a client with clientID is connected.
+func (b *MQTTBroker) Connected(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.clients[clientID]
+	return ok
+}
+
+// Subscribed reports whether the client with clientID subscribed to filter.
+func (b *MQTTBroker) Subscribed(clientID string, filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	client, ok := b.clients[clientID]
+	if !ok {
+		return false
+	}
+	_, ok = client.subscriptions[filter]
+	return ok
+}
+
+// DropClient cuts the connection of clientID as if the network failed, so
+// its will is published.
+func (b *MQTTBroker) DropClient(clientID string) bool {
+	b.mu.Lock()
+	client, ok := b.clients[clientID]
+	b.mu.Unlock()
+
+	if ok {
+		_ = client.conn.Close()
+	}
+	return ok
+}
+
+func (b *MQTTBroker) Close() {
+	b.mu.Lock()
+	b.closed = true
+	clients := make([]*brokerClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		clients = append(clients, client)
+	}
+	b.mu.Unlock()
+
+	_ = b.listener.Close()
+	for _, client := range clients {
+		_ = client.conn.Close()
+	}
+}
+
+func (b *MQTTBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *MQTTBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet, err := mqtt.ReadPacket(reader)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*mqtt.Connect)
+	if !ok {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	b.mu.Lock()
+	password, known := b.users[connect.Username]
+	if len(b.users) > 0 && (!known || password != string(connect.Password)) {
+		b.mu.Unlock()
+		_ = mqtt.WritePacket(conn, &mqtt.Connack{ReasonCode: mqtt.BadUsernameOrPassword})
+		return
+	}
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+
+	client := &brokerClient{connect: connect, conn: conn, subscriptions: make(map[string]mqtt.Subscription)}
+	previous := b.clients[connect.ClientID]
+	b.clients[connect.ClientID] = client
+	b.connects = append(b.connects, connect)
+	b.mu.Unlock()
+
+	if previous != nil {
+		previous.send(&mqtt.Disconnect{ReasonCode: mqtt.SessionTakenOver})
+		_ = previous.conn.Close()
+	}
+
+	client.send(&mqtt.Connack{ReasonCode: mqtt.Success})
+
+	normal := false
+	defer func() {
+		b.mu.Lock()
+		if b.clients[connect.ClientID] == client {
+			delete(b.clients, connect.ClientID)
+		}
+		b.mu.Unlock()
+
+		if !normal && connect.Will != nil {
+			b.route(client, connect.Will)
+		}
+	}()
+
+	for {
+		if connect.KeepAlive > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Duration(connect.KeepAlive) * time.Second * 3 / 2))
+		}
+
+		packet, err := mqtt.ReadPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch p := packet.(type) {
+		case *mqtt.Publish:
+			delivered := b.route(client, p)
+			if p.QoS > 0 {
+				ack := &mqtt.Puback{PacketID: p.PacketID}
+				if delivered == 0 {
+					ack.ReasonCode = mqtt.NoMatchingSubscribers
+				}
+				client.send(ack)
+			}
+		case *mqtt.Subscribe:
+			ack := &mqtt.Suback{PacketID: p.PacketID}
+			b.mu.Lock()
+			for _, subscription := range p.Subscriptions {
+				client.subscriptions[subscription.Filter] = subscription
+				ack.ReasonCodes = append(ack.ReasonCodes, subscription.QoS)
+			}
+			b.mu.Unlock()
+			client.send(ack)
+		case *mqtt.Unsubscribe:
+			ack := &mqtt.Unsuback{PacketID: p.PacketID}
+			b.mu.Lock()
+			for _, filter := range p.Filters {
+				delete(client.subscriptions, filter)
+				ack.ReasonCodes = append(ack.ReasonCodes, mqtt.Success)
+			}
+			b.mu.Unlock()
+			client.send(ack)
+		case *mqtt.Pingreq:
+			client.send(&mqtt.Pingresp{})
+		case *mqtt.Disconnect:
+			normal = p.ReasonCode != mqtt.DisconnectWithWillMessage
+			return
+		}
+	}
+}
+
+// route delivers p to every matching subscription, returning to how many.
+func (b *MQTTBroker) route(sender *brokerClient, p *mqtt.Publish) int {
+	type delivery struct {
+		client  *brokerClient
+		publish *mqtt.Publish
+	}
+	var deliveries []delivery
+
+	b.mu.Lock()
+	for _, client := range b.clients {
+		for _, subscription := range client.subscriptions {
+			if !mqtt.MatchTopic(subscription.Filter, p.Topic) || (subscription.NoLocal && client == sender) {
+				continue
+			}
+
+			publish := &mqtt.Publish{
+				Topic:      p.Topic,
+				QoS:        min(p.QoS, subscription.QoS),
+				Properties: p.Properties,
+				Payload:    p.Payload,
+			}
+			if publish.QoS > 0 {
+				client.nextID++
+				if client.nextID == 0 {
+					client.nextID++
+				}
+				publish.PacketID = client.nextID
+			}
+			deliveries = append(deliveries, delivery{client, publish})
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.client.send(d.publish)
+	}
+	return len(deliveries)
+}
+
+func (c *brokerClient) send(packet mqtt.Packet) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := mqtt.WritePacket(c.conn, packet); err != nil {
+		_ = c.conn.Close()
+	}
+}
+
+// Client connects a client to the broker, for the test to play the backend.
+func (b *MQTTBroker) Client(ctx context.Context, options mqtt.Options) (*mqtt.Client, error) {
+	conn, err := net.Dial("tcp", b.listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	client, _, err := mqtt.NewClient(ctx, conn, options)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,339 @@
+package fakes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"reagent/tunnel/relay"
+
+	"golang.org/x/net/websocket"
+)
+
+// pendingTimeout is how long an accepted client waits for the device to open
+// its data connection.
+const pendingTimeout = 10 * time.Second
+
+// Relay is an in-process tunnel relay speaking the reagent/tunnel/relay
+// protocol, for testing the native tunnel backend end to end. Every proxy the
+// device registers gets a public listener on 127.0.0.1, whatever its type;
+// only tcp proxies report its port as remote port, as a real relay would.
+type Relay struct {
+	Secret     string
+	BaseDomain string
+
+	server *httptest.Server
+
+	mu       sync.Mutex
+	control  *websocket.Conn
+	writeMu  sync.Mutex
+	proxies  map[string]*relayProxy
+	pending  map[string]*pendingConn
+	nextID   int
+	sessions int
+}
+
+type relayProxy struct {
+	proxy    relay.Proxy
+	listener net.Listener
+}
+
+type pendingConn struct {
+	client net.Conn
+	claim  chan struct{}
+}
+
+// NewRelay starts a relay accepting devices that sign with secret.
+func NewRelay(secret string) *Relay {
+	r := &Relay{
+		Secret:     secret,
+		BaseDomain: "tunnel.test",
+		proxies:    make(map[string]*relayProxy),
+		pending:    make(map[string]*pendingConn),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(relay.ControlPath, websocket.Server{Handler: r.serveControl})
+	mux.Handle(relay.DataPath, websocket.Server{Handler: r.serveData})
+	r.server = httptest.NewServer(mux)
+
+	return r
+}
+
+// URL is the ws:// URL to configure as TunnelRelayURL.
+func (r *Relay) URL() string {
+	return "ws" + strings.TrimPrefix(r.server.URL, "http")
+}
+
+func (r *Relay) Close() {
+	r.DropConnection()
+	r.server.Close()
+}
+
+// Connected reports whether a device holds an authenticated control
+// connection.
+func (r *Relay) Connected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.control != nil
+}
+
+// DropConnection closes the device's control connection, as a relay restart
+// or a network outage would.
+func (r *Relay) DropConnection() {
+	r.mu.Lock()
+	control := r.control
+	r.mu.Unlock()
+
+	if control != nil {
+		control.Close()
+	}
+}
+
+// Sessions counts successful handshakes, i.e. (re)connects.
+func (r *Relay) Sessions() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions
+}
+
+// Proxies returns the proxies currently registered, sorted by name.
+func (r *Relay) Proxies() []relay.Proxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.statusLocked()
+}
+
+// PublicAddr is the address clients dial to reach the named proxy, or "" if
+// it is not registered.
+func (r *Relay) PublicAddr(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.proxies[name]
+	if p == nil {
+		return ""
+	}
+	return p.listener.Addr().String()
+}
+
+func (r *Relay) serveControl(conn *websocket.Conn) {
+	nonceBytes := make([]byte, 16)
+	_, _ = rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+
+	if websocket.JSON.Send(conn, relay.Message{Type: relay.TypeChallenge, Nonce: nonce}) != nil {
+		return
+	}
+
+	var hello relay.Message
+	if websocket.JSON.Receive(conn, &hello) != nil {
+		return
+	}
+
+	if hello.Type != relay.TypeHello || !relay.Verify(r.Secret, nonce, hello.DeviceKey, hello.Signature) {
+		_ = websocket.JSON.Send(conn, relay.Message{Type: relay.TypeError, Error: "authentication failed"})
+		return
+	}
+
+	r.mu.Lock()
+	if r.control != nil {
+		r.control.Close()
+	}
+	r.control = conn
+	r.sessions++
+	r.mu.Unlock()
+
+	defer r.disconnect(conn)
+
+	if r.send(conn, relay.Message{Type: relay.TypeWelcome, BaseDomain: r.BaseDomain}) != nil {
+		return
+	}
+
+	for {
+		var message relay.Message
+		if websocket.JSON.Receive(conn, &message) != nil {
+			return
+		}
+
+		switch message.Type {
+		case relay.TypeRegister:
+			r.mu.Lock()
+			r.reconcileLocked(message.Proxies)
+			status := r.statusLocked()
+			r.mu.Unlock()
+
+			_ = r.send(conn, relay.Message{Type: relay.TypeStatus, Proxies: status})
+		case relay.TypePing:
+			_ = r.send(conn, relay.Message{Type: relay.TypePong})
+		case relay.TypeError:
+			r.mu.Lock()
+			pending := r.pending[message.ConnectionID]
+			delete(r.pending, message.ConnectionID)
+			r.mu.Unlock()
+
+			if pending != nil {
+				pending.client.Close()
+			}
+		}
+	}
+}
+
+// disconnect tears down everything the device registered, like a relay does
+// when a device goes away.
+func (r *Relay) disconnect(conn *websocket.Conn) {
+	conn.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.control != conn {
+		return
+	}
+
+	r.control = nil
+	r.reconcileLocked(nil)
+}
+
+func (r *Relay) reconcileLocked(desired []relay.Proxy) {
+	wanted := make(map[string]relay.Proxy, len(desired))
+	for _, proxy := range desired {
+		wanted[proxy.Name] = proxy
+	}
+
+	for name, p := range r.proxies {
+		if _, ok := wanted[name]; !ok {
+			p.listener.Close()
+			delete(r.proxies, name)
+		}
+	}
+
+	for name, proxy := range wanted {
+		if r.proxies[name] != nil {
+			continue
+		}
+
+		proxy.Status = relay.StatusRunning
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			proxy.Status = relay.StatusError
+			proxy.Error = err.Error()
+			r.proxies[name] = &relayProxy{proxy: proxy, listener: closedListener{}}
+			continue
+		}
+
+		if proxy.Type == "tcp" {
+			proxy.RemotePort = uint64(listener.Addr().(*net.TCPAddr).Port)
+		}
+
+		r.proxies[name] = &relayProxy{proxy: proxy, listener: listener}
+		go r.accept(name, listener)
+	}
+}
+
+func (r *Relay) statusLocked() []relay.Proxy {
+	status := make([]relay.Proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		status = append(status, p.proxy)
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+func (r *Relay) send(conn *websocket.Conn, message relay.Message) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return websocket.JSON.Send(conn, message)
+}
+
+func (r *Relay) accept(name string, listener net.Listener) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		r.nextID++
+		id := strconv.Itoa(r.nextID)
+		pending := &pendingConn{client: client, claim: make(chan struct{})}
+		r.pending[id] = pending
+		control := r.control
+		r.mu.Unlock()
+
+		if control == nil || r.send(control, relay.Message{Type: relay.TypeConnect, ConnectionID: id, Proxy: name, ClientAddr: client.RemoteAddr().String()}) != nil {
+			r.abandon(id)
+			continue
+		}
+
+		go func() {
+			select {
+			case <-pending.claim:
+			case <-time.After(pendingTimeout):
+				r.abandon(id)
+			}
+		}()
+	}
+}
+
+func (r *Relay) abandon(id string) {
+	r.mu.Lock()
+	pending := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+
+	if pending != nil {
+		pending.client.Close()
+	}
+}
+
+// serveData splices a device data connection to the client it was opened
+// for. The connection is closed when the handler returns, so it blocks until
+// either side is done.
+func (r *Relay) serveData(conn *websocket.Conn) {
+	id := conn.Request().URL.Query().Get("id")
+
+	r.mu.Lock()
+	pending := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+
+	if pending == nil {
+		return
+	}
+	close(pending.claim)
+
+	conn.PayloadType = websocket.BinaryFrame
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(conn, pending.client)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(pending.client, conn)
+		done <- struct{}{}
+	}()
+
+	<-done
+	pending.client.Close()
+	conn.Close()
+	<-done
+}
+
+// closedListener stands in for the listener of a proxy the relay failed to
+// open.
+type closedListener struct{}
+
+func (closedListener) Accept() (net.Conn, error) { return nil, net.ErrClosed }
+func (closedListener) Close() error              { return nil }
+func (closedListener) Addr() net.Addr            { return &net.TCPAddr{} }
@@ -192,6 +192,52 @@ func (_c *Container_Build_Call) RunAndReturn(run func(ctx context.Context, pathT
 	return _c
 }
 
+// Buildx provides a mock function for the type Container
+func (_mock *Container) Buildx() *container.Buildx {
+	ret := _mock.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Buildx")
+	}
+
+	var r0 *container.Buildx
+	if returnFunc, ok := ret.Get(0).(func() *container.Buildx); ok {
+		r0 = returnFunc()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*container.Buildx)
+		}
+	}
+	return r0
+}
+
+// Container_Buildx_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Buildx'
+type Container_Buildx_Call struct {
+	*mock.Call
+}
+
+// Buildx is a helper method to define mock.On call
+func (_e *Container_Expecter) Buildx() *Container_Buildx_Call {
+	return &Container_Buildx_Call{Call: _e.mock.On("Buildx")}
+}
+
+func (_c *Container_Buildx_Call) Run(run func()) *Container_Buildx_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *Container_Buildx_Call) Return(buildx *container.Buildx) *Container_Buildx_Call {
+	_c.Call.Return(buildx)
+	return _c
+}
+
+func (_c *Container_Buildx_Call) RunAndReturn(run func() *container.Buildx) *Container_Buildx_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // CancelAllStreams provides a mock function for the type Container
 func (_mock *Container) CancelAllStreams() error {
 	ret := _mock.Called()
@@ -1456,6 +1502,74 @@ func (_c *Container_ListenForContainerEvents_Call) RunAndReturn(run func(ctx con
 	return _c
 }
 
+// LoadImage provides a mock function for the type Container
+func (_mock *Container) LoadImage(ctx context.Context, archive io.Reader) ([]string, error) {
+	ret := _mock.Called(ctx, archive)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadImage")
+	}
+
+	var r0 []string
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, io.Reader) ([]string, error)); ok {
+		return returnFunc(ctx, archive)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context, io.Reader) []string); ok {
+		r0 = returnFunc(ctx, archive)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context, io.Reader) error); ok {
+		r1 = returnFunc(ctx, archive)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Container_LoadImage_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadImage'
+type Container_LoadImage_Call struct {
+	*mock.Call
+}
+
+// LoadImage is a helper method to define mock.On call
+//   - ctx context.Context
+//   - archive io.Reader
+func (_e *Container_Expecter) LoadImage(ctx any, archive any) *Container_LoadImage_Call {
+	return &Container_LoadImage_Call{Call: _e.mock.On("LoadImage", ctx, archive)}
+}
+
+func (_c *Container_LoadImage_Call) Run(run func(ctx context.Context, archive io.Reader)) *Container_LoadImage_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 io.Reader
+		if args[1] != nil {
+			arg1 = args[1].(io.Reader)
+		}
+		run(
+			arg0,
+			arg1,
+		)
+	})
+	return _c
+}
+
+func (_c *Container_LoadImage_Call) Return(strings []string, err error) *Container_LoadImage_Call {
+	_c.Call.Return(strings, err)
+	return _c
+}
+
+func (_c *Container_LoadImage_Call) RunAndReturn(run func(ctx context.Context, archive io.Reader) ([]string, error)) *Container_LoadImage_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Login provides a mock function for the type Container
 func (_mock *Container) Login(ctx context.Context, serverAddress string, username string, password string) (string, error) {
 	ret := _mock.Called(ctx, serverAddress, username, password)
@@ -1975,8 +2089,8 @@ func (_c *Container_PruneImages_Call) RunAndReturn(run func(ctx context.Context,
 }
 
 // PruneSystem provides a mock function for the type Container
-func (_mock *Container) PruneSystem() (string, error) {
-	ret := _mock.Called()
+func (_mock *Container) PruneSystem(ctx context.Context) (string, error) {
+	ret := _mock.Called(ctx)
 
 	if len(ret) == 0 {
 		panic("no return value specified for PruneSystem")
@@ -1984,16 +2098,16 @@ func (_mock *Container) PruneSystem() (string, error) {
 
 	var r0 string
 	var r1 error
-	if returnFunc, ok := ret.Get(0).(func() (string, error)); ok {
-		return returnFunc()
+	if returnFunc, ok := ret.Get(0).(func(context.Context) (string, error)); ok {
+		return returnFunc(ctx)
 	}
-	if returnFunc, ok := ret.Get(0).(func() string); ok {
-		r0 = returnFunc()
+	if returnFunc, ok := ret.Get(0).(func(context.Context) string); ok {
+		r0 = returnFunc(ctx)
 	} else {
 		r0 = ret.Get(0).(string)
 	}
-	if returnFunc, ok := ret.Get(1).(func() error); ok {
-		r1 = returnFunc()
+	if returnFunc, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = returnFunc(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -2006,13 +2120,20 @@ type Container_PruneSystem_Call struct {
 }
 
 // PruneSystem is a helper method to define mock.On call
-func (_e *Container_Expecter) PruneSystem() *Container_PruneSystem_Call {
-	return &Container_PruneSystem_Call{Call: _e.mock.On("PruneSystem")}
+//   - ctx context.Context
+func (_e *Container_Expecter) PruneSystem(ctx any) *Container_PruneSystem_Call {
+	return &Container_PruneSystem_Call{Call: _e.mock.On("PruneSystem", ctx)}
 }
 
-func (_c *Container_PruneSystem_Call) Run(run func()) *Container_PruneSystem_Call {
+func (_c *Container_PruneSystem_Call) Run(run func(ctx context.Context)) *Container_PruneSystem_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run()
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		run(
+			arg0,
+		)
 	})
 	return _c
 }
@@ -2022,7 +2143,7 @@ func (_c *Container_PruneSystem_Call) Return(s string, err error) *Container_Pru
 	return _c
 }
 
-func (_c *Container_PruneSystem_Call) RunAndReturn(run func() (string, error)) *Container_PruneSystem_Call {
+func (_c *Container_PruneSystem_Call) RunAndReturn(run func(ctx context.Context) (string, error)) *Container_PruneSystem_Call {
 	_c.Call.Return(run)
 	return _c
 }
@@ -2616,6 +2737,74 @@ func (_c *Container_ResizeExecContainer_Call) RunAndReturn(run func(ctx context.
 	return _c
 }
 
+// SaveImage provides a mock function for the type Container
+func (_mock *Container) SaveImage(ctx context.Context, images []string) (io.ReadCloser, error) {
+	ret := _mock.Called(ctx, images)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SaveImage")
+	}
+
+	var r0 io.ReadCloser
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, []string) (io.ReadCloser, error)); ok {
+		return returnFunc(ctx, images)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context, []string) io.ReadCloser); ok {
+		r0 = returnFunc(ctx, images)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = returnFunc(ctx, images)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Container_SaveImage_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SaveImage'
+type Container_SaveImage_Call struct {
+	*mock.Call
+}
+
+// SaveImage is a helper method to define mock.On call
+//   - ctx context.Context
+//   - images []string
+func (_e *Container_Expecter) SaveImage(ctx any, images any) *Container_SaveImage_Call {
+	return &Container_SaveImage_Call{Call: _e.mock.On("SaveImage", ctx, images)}
+}
+
+func (_c *Container_SaveImage_Call) Run(run func(ctx context.Context, images []string)) *Container_SaveImage_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 []string
+		if args[1] != nil {
+			arg1 = args[1].([]string)
+		}
+		run(
+			arg0,
+			arg1,
+		)
+	})
+	return _c
+}
+
+func (_c *Container_SaveImage_Call) Return(readCloser io.ReadCloser, err error) *Container_SaveImage_Call {
+	_c.Call.Return(readCloser, err)
+	return _c
+}
+
+func (_c *Container_SaveImage_Call) RunAndReturn(run func(ctx context.Context, images []string) (io.ReadCloser, error)) *Container_SaveImage_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // StartContainer provides a mock function for the type Container
 func (_mock *Container) StartContainer(ctx context.Context, containerID string) error {
 	ret := _mock.Called(ctx, containerID)
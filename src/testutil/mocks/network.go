@@ -38,6 +38,57 @@ func (_m *Network) EXPECT() *Network_Expecter {
 	return &Network_Expecter{mock: &_m.Mock}
 }
 
+// ActivateVPNConnection provides a mock function for the type Network
+func (_mock *Network) ActivateVPNConnection(uuid string) error {
+	ret := _mock.Called(uuid)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ActivateVPNConnection")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(string) error); ok {
+		r0 = returnFunc(uuid)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// Network_ActivateVPNConnection_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ActivateVPNConnection'
+type Network_ActivateVPNConnection_Call struct {
+	*mock.Call
+}
+
+// ActivateVPNConnection is a helper method to define mock.On call
+//   - uuid string
+func (_e *Network_Expecter) ActivateVPNConnection(uuid any) *Network_ActivateVPNConnection_Call {
+	return &Network_ActivateVPNConnection_Call{Call: _e.mock.On("ActivateVPNConnection", uuid)}
+}
+
+func (_c *Network_ActivateVPNConnection_Call) Run(run func(uuid string)) *Network_ActivateVPNConnection_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 string
+		if args[0] != nil {
+			arg0 = args[0].(string)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *Network_ActivateVPNConnection_Call) Return(err error) *Network_ActivateVPNConnection_Call {
+	_c.Call.Return(err)
+	return _c
+}
+
+func (_c *Network_ActivateVPNConnection_Call) RunAndReturn(run func(uuid string) error) *Network_ActivateVPNConnection_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // ActivateWiFi provides a mock function for the type Network
 func (_mock *Network) ActivateWiFi(mac string, ssid string) error {
 	ret := _mock.Called(mac, ssid)
@@ -152,6 +203,57 @@ func (_c *Network_AddWiFi_Call) RunAndReturn(run func(mac string, credentials ne
 	return _c
 }
 
+// DeactivateVPNConnection provides a mock function for the type Network
+func (_mock *Network) DeactivateVPNConnection(uuid string) error {
+	ret := _mock.Called(uuid)
+
+	if len(ret) == 0 {
+		panic("no return value specified for DeactivateVPNConnection")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(string) error); ok {
+		r0 = returnFunc(uuid)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// Network_DeactivateVPNConnection_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'DeactivateVPNConnection'
+type Network_DeactivateVPNConnection_Call struct {
+	*mock.Call
+}
+
+// DeactivateVPNConnection is a helper method to define mock.On call
+//   - uuid string
+func (_e *Network_Expecter) DeactivateVPNConnection(uuid any) *Network_DeactivateVPNConnection_Call {
+	return &Network_DeactivateVPNConnection_Call{Call: _e.mock.On("DeactivateVPNConnection", uuid)}
+}
+
+func (_c *Network_DeactivateVPNConnection_Call) Run(run func(uuid string)) *Network_DeactivateVPNConnection_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 string
+		if args[0] != nil {
+			arg0 = args[0].(string)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *Network_DeactivateVPNConnection_Call) Return(err error) *Network_DeactivateVPNConnection_Call {
+	_c.Call.Return(err)
+	return _c
+}
+
+func (_c *Network_DeactivateVPNConnection_Call) RunAndReturn(run func(uuid string) error) *Network_DeactivateVPNConnection_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // EnableDHCP provides a mock function for the type Network
 func (_mock *Network) EnableDHCP(mac string, interfaceName string) error {
 	ret := _mock.Called(mac, interfaceName)
@@ -272,6 +374,66 @@ func (_c *Network_GetActiveWirelessDeviceConfig_Call) RunAndReturn(run func() ([
 	return _c
 }
 
+// ImportVPNConnection provides a mock function for the type Network
+func (_mock *Network) ImportVPNConnection(configuration network.VPNConfiguration) (network.VPNConnection, error) {
+	ret := _mock.Called(configuration)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ImportVPNConnection")
+	}
+
+	var r0 network.VPNConnection
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(network.VPNConfiguration) (network.VPNConnection, error)); ok {
+		return returnFunc(configuration)
+	}
+	if returnFunc, ok := ret.Get(0).(func(network.VPNConfiguration) network.VPNConnection); ok {
+		r0 = returnFunc(configuration)
+	} else {
+		r0 = ret.Get(0).(network.VPNConnection)
+	}
+	if returnFunc, ok := ret.Get(1).(func(network.VPNConfiguration) error); ok {
+		r1 = returnFunc(configuration)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Network_ImportVPNConnection_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ImportVPNConnection'
+type Network_ImportVPNConnection_Call struct {
+	*mock.Call
+}
+
+// ImportVPNConnection is a helper method to define mock.On call
+//   - configuration network.VPNConfiguration
+func (_e *Network_Expecter) ImportVPNConnection(configuration any) *Network_ImportVPNConnection_Call {
+	return &Network_ImportVPNConnection_Call{Call: _e.mock.On("ImportVPNConnection", configuration)}
+}
+
+func (_c *Network_ImportVPNConnection_Call) Run(run func(configuration network.VPNConfiguration)) *Network_ImportVPNConnection_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 network.VPNConfiguration
+		if args[0] != nil {
+			arg0 = args[0].(network.VPNConfiguration)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *Network_ImportVPNConnection_Call) Return(vPNConnection network.VPNConnection, err error) *Network_ImportVPNConnection_Call {
+	_c.Call.Return(vPNConnection, err)
+	return _c
+}
+
+func (_c *Network_ImportVPNConnection_Call) RunAndReturn(run func(configuration network.VPNConfiguration) (network.VPNConnection, error)) *Network_ImportVPNConnection_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // ListEthernetDevices provides a mock function for the type Network
 func (_mock *Network) ListEthernetDevices() ([]network.EthernetDevice, error) {
 	ret := _mock.Called()
@@ -327,6 +489,61 @@ func (_c *Network_ListEthernetDevices_Call) RunAndReturn(run func() ([]network.E
 	return _c
 }
 
+// ListVPNConnections provides a mock function for the type Network
+func (_mock *Network) ListVPNConnections() ([]network.VPNConnection, error) {
+	ret := _mock.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for ListVPNConnections")
+	}
+
+	var r0 []network.VPNConnection
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func() ([]network.VPNConnection, error)); ok {
+		return returnFunc()
+	}
+	if returnFunc, ok := ret.Get(0).(func() []network.VPNConnection); ok {
+		r0 = returnFunc()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]network.VPNConnection)
+		}
+	}
+	if returnFunc, ok := ret.Get(1).(func() error); ok {
+		r1 = returnFunc()
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Network_ListVPNConnections_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ListVPNConnections'
+type Network_ListVPNConnections_Call struct {
+	*mock.Call
+}
+
+// ListVPNConnections is a helper method to define mock.On call
+func (_e *Network_Expecter) ListVPNConnections() *Network_ListVPNConnections_Call {
+	return &Network_ListVPNConnections_Call{Call: _e.mock.On("ListVPNConnections")}
+}
+
+func (_c *Network_ListVPNConnections_Call) Run(run func()) *Network_ListVPNConnections_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *Network_ListVPNConnections_Call) Return(vPNConnections []network.VPNConnection, err error) *Network_ListVPNConnections_Call {
+	_c.Call.Return(vPNConnections, err)
+	return _c
+}
+
+func (_c *Network_ListVPNConnections_Call) RunAndReturn(run func() ([]network.VPNConnection, error)) *Network_ListVPNConnections_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // ListWifiNetworks provides a mock function for the type Network
 func (_mock *Network) ListWifiNetworks() ([]network.WiFi, error) {
 	ret := _mock.Called()
@@ -426,6 +643,57 @@ func (_c *Network_Reload_Call) RunAndReturn(run func() error) *Network_Reload_Ca
 	return _c
 }
 
+// RemoveVPNConnection provides a mock function for the type Network
+func (_mock *Network) RemoveVPNConnection(uuid string) error {
+	ret := _mock.Called(uuid)
+
+	if len(ret) == 0 {
+		panic("no return value specified for RemoveVPNConnection")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(string) error); ok {
+		r0 = returnFunc(uuid)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// Network_RemoveVPNConnection_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'RemoveVPNConnection'
+type Network_RemoveVPNConnection_Call struct {
+	*mock.Call
+}
+
+// RemoveVPNConnection is a helper method to define mock.On call
+//   - uuid string
+func (_e *Network_Expecter) RemoveVPNConnection(uuid any) *Network_RemoveVPNConnection_Call {
+	return &Network_RemoveVPNConnection_Call{Call: _e.mock.On("RemoveVPNConnection", uuid)}
+}
+
+func (_c *Network_RemoveVPNConnection_Call) Run(run func(uuid string)) *Network_RemoveVPNConnection_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 string
+		if args[0] != nil {
+			arg0 = args[0].(string)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *Network_RemoveVPNConnection_Call) Return(err error) *Network_RemoveVPNConnection_Call {
+	_c.Call.Return(err)
+	return _c
+}
+
+func (_c *Network_RemoveVPNConnection_Call) RunAndReturn(run func(uuid string) error) *Network_RemoveVPNConnection_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // RemoveWifi provides a mock function for the type Network
 func (_mock *Network) RemoveWifi(ssid string) error {
 	ret := _mock.Called(ssid)
@@ -6,6 +6,7 @@ package mocks
 
 import (
 	"reagent/common"
+	"reagent/messenger"
 	"reagent/tunnel"
 
 	mock "github.com/stretchr/testify/mock"
@@ -507,6 +508,46 @@ func (_c *TunnelManager_SaveRemotePorts_Call) RunAndReturn(run func(payload comm
 	return _c
 }
 
+// SetMessenger provides a mock function for the type TunnelManager
+func (_mock *TunnelManager) SetMessenger(messenger messenger.Messenger) {
+	_mock.Called(messenger)
+	return
+}
+
+// TunnelManager_SetMessenger_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SetMessenger'
+type TunnelManager_SetMessenger_Call struct {
+	*mock.Call
+}
+
+// SetMessenger is a helper method to define mock.On call
+//   - messenger messenger.Messenger
+func (_e *TunnelManager_Expecter) SetMessenger(messenger any) *TunnelManager_SetMessenger_Call {
+	return &TunnelManager_SetMessenger_Call{Call: _e.mock.On("SetMessenger", messenger)}
+}
+
+func (_c *TunnelManager_SetMessenger_Call) Run(run func(messenger messenger.Messenger)) *TunnelManager_SetMessenger_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 messenger.Messenger
+		if args[0] != nil {
+			arg0 = args[0].(messenger.Messenger)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *TunnelManager_SetMessenger_Call) Return() *TunnelManager_SetMessenger_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *TunnelManager_SetMessenger_Call) RunAndReturn(run func(messenger messenger.Messenger)) *TunnelManager_SetMessenger_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Start provides a mock function for the type TunnelManager
 func (_mock *TunnelManager) Start() error {
 	ret := _mock.Called()
@@ -0,0 +1,651 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reagent/common"
+	"reagent/safe"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// accessTokenParam carries the token of a share link.
+	accessTokenParam = "access_token"
+	// accessCookie keeps a share link's token after the first request, so
+	// the app's own links and assets work without the query parameter.
+	accessCookie = "ironflock_access"
+	// proxyHeaderTimeout bounds reading the PROXY header of a connection.
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+var ErrAccessExpired = errors.New("tunnel access has expired")
+
+// AccessExpiry returns when a policy stops granting access altogether: its
+// ExpiresAt, or for a policy that only admits token holders, the expiry of
+// the last token. ok is false for policies that never expire.
+func AccessExpiry(policy *common.PortAccessPolicy) (expiry time.Time, ok bool) {
+	if policy == nil {
+		return time.Time{}, false
+	}
+
+	if policy.ExpiresAt != nil {
+		expiry, ok = *policy.ExpiresAt, true
+	}
+
+	if policy.BasicAuth == nil && len(policy.AllowedCIDRs) == 0 && len(policy.Tokens) > 0 {
+		var last time.Time
+		for _, token := range policy.Tokens {
+			if token.ExpiresAt == nil {
+				// a token without expiry keeps the link alive
+				return expiry, ok
+			}
+			if token.ExpiresAt.After(last) {
+				last = *token.ExpiresAt
+			}
+		}
+
+		if !ok || last.Before(expiry) {
+			expiry, ok = last, true
+		}
+	}
+
+	return expiry, ok
+}
+
+// AccessExpired reports whether a policy no longer grants anyone access, in
+// which case the rule's tunnel must not exist.
+func AccessExpired(policy *common.PortAccessPolicy, now time.Time) bool {
+	expiry, ok := AccessExpiry(policy)
+	return ok && !now.Before(expiry)
+}
+
+func policyEmpty(policy *common.PortAccessPolicy) bool {
+	return policy == nil || (policy.BasicAuth == nil && len(policy.AllowedCIDRs) == 0 && len(policy.Tokens) == 0)
+}
+
+// AccessGuard enforces the access policies of port rules.
+//
+// Basic auth alone on an http tunnel is left to the tunnel server (frpc
+// httpUser/httpPassword). Everything else needs the client address or more
+// than one credential, so the tunnel is pointed at a guard listening on
+// loopback instead of the app: an authenticating reverse proxy for http, a
+// source address filter for tcp and https. The guard learns the client
+// address from a PROXY protocol header the tunnel client prefixes every
+// connection with, or for frp http proxies from the X-Forwarded-For entry
+// frps appends (frps pools its connections to frpc across clients, so a
+// per-connection header would be wrong there).
+//
+// The guard also tears tunnels down when their policy expires, through the
+// expire callback, and fronts metered tunnels to count their traffic for the
+// TrafficMeter.
+type AccessGuard struct {
+	mu       sync.Mutex
+	guards   map[string]*guardedTunnel
+	timers   map[string]*time.Timer
+	owners   map[string]string // tunnel id -> app
+	onExpire func(tunnelID string)
+	meter    *TrafficMeter
+	now      func() time.Time
+}
+
+type guardedTunnel struct {
+	protocol     Protocol
+	target       string
+	forwardedFor bool
+	policy       atomic.Pointer[accessPolicy]
+	listener     net.Listener
+	server       *http.Server
+	now          func() time.Time
+}
+
+// accessPolicy is a PortAccessPolicy parsed for checking requests.
+type accessPolicy struct {
+	basicAuth *common.BasicAuthCredentials
+	networks  []*net.IPNet
+	tokens    []common.AccessToken
+}
+
+// NewAccessGuard creates a guard calling onExpire with the tunnel id once a
+// policy expired.
+func NewAccessGuard(onExpire func(tunnelID string)) *AccessGuard {
+	return &AccessGuard{
+		guards:   make(map[string]*guardedTunnel),
+		timers:   make(map[string]*time.Timer),
+		owners:   make(map[string]string),
+		onExpire: onExpire,
+		now:      time.Now,
+	}
+}
+
+// SetTrafficMeter has the guard count the traffic of metered tunnels.
+func (ag *AccessGuard) SetTrafficMeter(meter *TrafficMeter) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	ag.meter = meter
+}
+
+// Apply enforces policy on the tunnel about to be added with config and
+// returns the config to add instead. metered fronts the tunnel even without
+// a policy, so its traffic can be counted; udp tunnels cannot be fronted and
+// stay unmetered. backend is the tunnel backend in use, see Backend.
+// Policies the protocol cannot enforce are refused rather than exposing the
+// port unprotected.
+func (ag *AccessGuard) Apply(stage common.Stage, appKey uint64, policy *common.PortAccessPolicy, metered bool, config TunnelConfig, backend string) (TunnelConfig, error) {
+	tunnelID := CreateTunnelID(config.Subdomain, string(config.Protocol))
+	metered = metered && config.Protocol != UDP
+
+	if policyEmpty(policy) && (policy == nil || policy.ExpiresAt == nil) && !metered {
+		ag.Release(tunnelID)
+		return config, nil
+	}
+
+	if AccessExpired(policy, ag.now()) {
+		ag.Release(tunnelID)
+		return TunnelConfig{}, ErrAccessExpired
+	}
+
+	parsed, err := parseAccessPolicy(policy)
+	if err != nil {
+		return TunnelConfig{}, err
+	}
+
+	if config.Protocol == UDP && !policyEmpty(policy) {
+		return TunnelConfig{}, errors.New("access policies are not supported on udp tunnels")
+	}
+
+	if config.Protocol != HTTP && (parsed.basicAuth != nil || len(parsed.tokens) > 0) {
+		return TunnelConfig{}, fmt.Errorf("basic auth and tokens require an http tunnel, not %s", config.Protocol)
+	}
+
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	ag.owners[tunnelID] = appOwnerKey(stage, appKey)
+	ag.scheduleExpiryLocked(tunnelID, policy)
+
+	if len(parsed.networks) == 0 && len(parsed.tokens) == 0 && !metered {
+		ag.releaseGuardLocked(tunnelID)
+
+		if parsed.basicAuth != nil {
+			config.HTTPUser = parsed.basicAuth.Username
+			config.HTTPPassword = parsed.basicAuth.Password
+		}
+
+		return config, nil
+	}
+
+	localIP := config.LocalIP
+	if localIP == "" {
+		localIP = "127.0.0.1"
+	}
+
+	target := net.JoinHostPort(localIP, strconv.FormatUint(config.LocalPort, 10))
+	forwardedFor := config.Protocol == HTTP && backend == BackendFrp
+
+	guard := ag.guards[tunnelID]
+	if guard == nil || guard.target != target || guard.protocol != config.Protocol || guard.forwardedFor != forwardedFor {
+		ag.releaseGuardLocked(tunnelID)
+
+		guard, err = ag.startGuard(tunnelID, config.Protocol, target, forwardedFor)
+		if err != nil {
+			return TunnelConfig{}, err
+		}
+		ag.guards[tunnelID] = guard
+	}
+	guard.policy.Store(parsed)
+
+	config.LocalIP = "127.0.0.1"
+	config.LocalPort = uint64(guard.listener.Addr().(*net.TCPAddr).Port)
+	config.ProxyProtocol = !forwardedFor
+
+	return config, nil
+}
+
+// Release stops guarding a tunnel, e.g. because it was removed.
+func (ag *AccessGuard) Release(tunnelID string) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	ag.releaseLocked(tunnelID)
+}
+
+// ReleaseApp stops guarding all tunnels of an app.
+func (ag *AccessGuard) ReleaseApp(stage common.Stage, appKey uint64) {
+	owner := appOwnerKey(stage, appKey)
+
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	for tunnelID, tunnelOwner := range ag.owners {
+		if tunnelOwner == owner {
+			ag.releaseLocked(tunnelID)
+		}
+	}
+}
+
+func (ag *AccessGuard) releaseLocked(tunnelID string) {
+	ag.releaseGuardLocked(tunnelID)
+
+	if timer := ag.timers[tunnelID]; timer != nil {
+		timer.Stop()
+		delete(ag.timers, tunnelID)
+	}
+	delete(ag.owners, tunnelID)
+}
+
+func (ag *AccessGuard) releaseGuardLocked(tunnelID string) {
+	guard := ag.guards[tunnelID]
+	if guard == nil {
+		return
+	}
+
+	delete(ag.guards, tunnelID)
+	if guard.server != nil {
+		guard.server.Close()
+	} else {
+		guard.listener.Close()
+	}
+}
+
+func (ag *AccessGuard) scheduleExpiryLocked(tunnelID string, policy *common.PortAccessPolicy) {
+	if timer := ag.timers[tunnelID]; timer != nil {
+		timer.Stop()
+		delete(ag.timers, tunnelID)
+	}
+
+	expiry, ok := AccessExpiry(policy)
+	if !ok {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(expiry.Sub(ag.now()), func() {
+		ag.mu.Lock()
+		current := ag.timers[tunnelID] == timer
+		if current {
+			ag.releaseLocked(tunnelID)
+		}
+		ag.mu.Unlock()
+
+		if current && ag.onExpire != nil {
+			log.Info().Str("tunnelID", tunnelID).Msg("Tunnel access expired, tearing the tunnel down")
+			ag.onExpire(tunnelID)
+		}
+	})
+	ag.timers[tunnelID] = timer
+}
+
+func (ag *AccessGuard) startGuard(tunnelID string, protocol Protocol, target string, forwardedFor bool) (*guardedTunnel, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the tunnel access guard: %w", err)
+	}
+
+	if ag.meter != nil {
+		listener = meteredListener{Listener: listener, meter: ag.meter, tunnelID: tunnelID}
+	}
+
+	guard := &guardedTunnel{
+		protocol:     protocol,
+		target:       target,
+		forwardedFor: forwardedFor,
+		now:          ag.now,
+	}
+
+	if !forwardedFor {
+		listener = proxyProtocolListener{Listener: listener}
+	}
+	guard.listener = listener
+
+	if protocol == HTTP {
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target})
+		guard.server = &http.Server{
+			Handler:           guard.authenticate(proxy),
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+		safe.Go(func() {
+			_ = guard.server.Serve(listener)
+		})
+	} else {
+		safe.Go(guard.acceptConnections)
+	}
+
+	return guard, nil
+}
+
+func parseAccessPolicy(policy *common.PortAccessPolicy) (*accessPolicy, error) {
+	if policy == nil {
+		return &accessPolicy{}, nil
+	}
+
+	parsed := &accessPolicy{basicAuth: policy.BasicAuth, tokens: policy.Tokens}
+
+	if parsed.basicAuth != nil && parsed.basicAuth.Username == "" {
+		return nil, errors.New("basic auth requires a username")
+	}
+
+	for _, token := range parsed.tokens {
+		if token.Token == "" {
+			return nil, errors.New("access tokens must not be empty")
+		}
+	}
+
+	for _, cidr := range policy.AllowedCIDRs {
+		// a plain address allows just that address
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed cidr %s: %w", cidr, err)
+		}
+		parsed.networks = append(parsed.networks, network)
+	}
+
+	return parsed, nil
+}
+
+func (p *accessPolicy) allows(ip net.IP) bool {
+	if len(p.networks) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *accessPolicy) validToken(token string, now time.Time) (common.AccessToken, bool) {
+	for _, candidate := range p.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate.Token), []byte(token)) != 1 {
+			continue
+		}
+
+		if candidate.ExpiresAt != nil && !now.Before(*candidate.ExpiresAt) {
+			return common.AccessToken{}, false
+		}
+
+		return candidate, true
+	}
+
+	return common.AccessToken{}, false
+}
+
+func (p *accessPolicy) validBasicAuth(r *http.Request) bool {
+	if p.basicAuth == nil {
+		return false
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(p.basicAuth.Username)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(p.basicAuth.Password)) == 1
+	return usernameMatch && passwordMatch
+}
+
+// authenticate admits requests from allowed networks that carry the basic
+// auth credentials or a valid token, and strips the token before passing the
+// request on to the app.
+func (g *guardedTunnel) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := g.policy.Load()
+		now := g.now()
+
+		if !policy.allows(g.clientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if policy.basicAuth == nil && len(policy.tokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A share link: trade the query parameter for a cookie and send the
+		// browser to the clean URL, so the token does not linger in the
+		// address bar or leak through the Referer header.
+		if token := r.URL.Query().Get(accessTokenParam); token != "" {
+			accessToken, ok := policy.validToken(token, now)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			cookie := &http.Cookie{Name: accessCookie, Value: token, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode}
+			if accessToken.ExpiresAt != nil {
+				cookie.Expires = *accessToken.ExpiresAt
+			}
+			http.SetCookie(w, cookie)
+
+			query := r.URL.Query()
+			query.Del(accessTokenParam)
+			redirect := *r.URL
+			redirect.RawQuery = query.Encode()
+			http.Redirect(w, r, redirect.RequestURI(), http.StatusSeeOther)
+			return
+		}
+
+		authenticated := policy.validBasicAuth(r)
+		if !authenticated {
+			if cookie, err := r.Cookie(accessCookie); err == nil {
+				_, authenticated = policy.validToken(cookie.Value, now)
+			}
+		}
+		if !authenticated {
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				_, authenticated = policy.validToken(bearer, now)
+			}
+		}
+
+		if !authenticated {
+			if policy.basicAuth != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ironflock", charset="UTF-8"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		removeAccessCookie(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the address the request came from on the internet side of the
+// tunnel.
+func (g *guardedTunnel) clientIP(r *http.Request) net.IP {
+	if g.forwardedFor {
+		// only the last entry was added by frps, the ones before are the
+		// client's say
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) == 0 {
+			return nil
+		}
+
+		hops := strings.Split(forwarded[len(forwarded)-1], ",")
+		return net.ParseIP(strings.TrimSpace(hops[len(hops)-1]))
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+func removeAccessCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != accessCookie {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// acceptConnections filters tcp connections by source address and splices
+// the allowed ones to the app.
+func (g *guardedTunnel) acceptConnections() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		safe.Go(func() {
+			g.forward(conn)
+		})
+	}
+}
+
+func (g *guardedTunnel) forward(conn net.Conn) {
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+
+	if !g.policy.Load().allows(ip) {
+		log.Debug().Str("client", conn.RemoteAddr().String()).Str("target", g.target).Msg("Tunnel access denied")
+		conn.Close()
+		return
+	}
+
+	local, err := net.DialTimeout("tcp", g.target, localDialTimeout)
+	if err != nil {
+		log.Debug().Err(err).Str("target", g.target).Msg("Tunnel access guard failed to reach the app")
+		conn.Close()
+		return
+	}
+
+	splice(conn, local)
+}
+
+// proxyProtocolHeader builds the PROXY protocol v1 header announcing a
+// connection from src to dst (both host:port).
+func proxyProtocolHeader(src string, dst string) string {
+	srcAddr, srcErr := net.ResolveTCPAddr("tcp", src)
+	dstAddr, dstErr := net.ResolveTCPAddr("tcp", dst)
+	if srcErr != nil || dstErr != nil || (srcAddr.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	family := "TCP4"
+	if srcAddr.IP.To4() == nil {
+		family = "TCP6"
+	}
+
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+}
+
+// proxyProtocolListener accepts connections prefixed with a PROXY protocol v1
+// header and reports the announced client as their remote address.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the header is read lazily, so a slow client cannot stall Accept
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		// connections without a valid header have no known client, which
+		// allow lists reject
+		c.source = &net.TCPAddr{}
+
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "PROXY" {
+			c.err = errors.New("missing PROXY protocol header")
+			return
+		}
+
+		if fields[1] == "UNKNOWN" || len(fields) != 6 {
+			return
+		}
+
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.Atoi(fields[4])
+		if ip == nil || err != nil {
+			return
+		}
+
+		c.source = &net.TCPAddr{IP: ip, Port: port}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.source
+}
+
+// WriteTo keeps io.Copy from bypassing the buffered reader.
+func (c *proxyProtocolConn) WriteTo(w io.Writer) (int64, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.WriteTo(w)
+}
@@ -0,0 +1,295 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reagent/common"
+	"reagent/testutil/fakes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func timeIn(d time.Duration) *time.Time {
+	t := time.Now().Add(d)
+	return &t
+}
+
+func httpTunnelConfig(localPort uint64) TunnelConfig {
+	return TunnelConfig{Subdomain: CreateSubdomain(HTTP, 42, "grafana", 3000), AppName: "grafana", Protocol: HTTP, LocalPort: localPort}
+}
+
+func tcpTunnelConfig(localPort uint64) TunnelConfig {
+	return TunnelConfig{Subdomain: CreateSubdomain(TCP, 42, "plc-bridge", 502), AppName: "plc-bridge", Protocol: TCP, LocalPort: localPort}
+}
+
+func TestAccessExpiry(t *testing.T) {
+	soon, later := timeIn(time.Hour), timeIn(2*time.Hour)
+
+	_, ok := AccessExpiry(nil)
+	assert.False(t, ok)
+
+	expiry, ok := AccessExpiry(&common.PortAccessPolicy{ExpiresAt: soon})
+	assert.True(t, ok)
+	assert.Equal(t, *soon, expiry)
+
+	expiry, ok = AccessExpiry(&common.PortAccessPolicy{Tokens: []common.AccessToken{{Token: "a", ExpiresAt: soon}, {Token: "b", ExpiresAt: later}}})
+	assert.True(t, ok)
+	assert.Equal(t, *later, expiry, "a share link lives as long as its last token")
+
+	_, ok = AccessExpiry(&common.PortAccessPolicy{Tokens: []common.AccessToken{{Token: "a", ExpiresAt: soon}, {Token: "b"}}})
+	assert.False(t, ok, "a token without expiry keeps the link alive")
+
+	_, ok = AccessExpiry(&common.PortAccessPolicy{
+		BasicAuth: &common.BasicAuthCredentials{Username: "customer", Password: "pw"},
+		Tokens:    []common.AccessToken{{Token: "a", ExpiresAt: soon}},
+	})
+	assert.False(t, ok, "basic auth still grants access after the tokens expired")
+
+	assert.True(t, AccessExpired(&common.PortAccessPolicy{ExpiresAt: timeIn(-time.Minute)}, time.Now()))
+	assert.False(t, AccessExpired(&common.PortAccessPolicy{ExpiresAt: soon}, time.Now()))
+}
+
+func TestAccessGuardApply(t *testing.T) {
+	ag := NewAccessGuard(nil)
+
+	t.Run("no policy leaves the tunnel alone", func(t *testing.T) {
+		config, err := ag.Apply(common.PROD, 1, nil, false, httpTunnelConfig(40000), BackendFrp)
+		require.NoError(t, err)
+		assert.Equal(t, httpTunnelConfig(40000), config)
+	})
+
+	t.Run("basic auth alone is left to the tunnel server", func(t *testing.T) {
+		policy := &common.PortAccessPolicy{BasicAuth: &common.BasicAuthCredentials{Username: "customer", Password: "pw"}}
+
+		config, err := ag.Apply(common.PROD, 1, policy, false, httpTunnelConfig(40000), BackendFrp)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(40000), config.LocalPort)
+		assert.Equal(t, "customer", config.HTTPUser)
+		assert.Equal(t, "pw", config.HTTPPassword)
+		assert.False(t, config.ProxyProtocol)
+	})
+
+	t.Run("allow lists point the tunnel at the guard", func(t *testing.T) {
+		policy := &common.PortAccessPolicy{AllowedCIDRs: []string{"10.0.0.0/8"}}
+
+		config, err := ag.Apply(common.PROD, 1, policy, false, tcpTunnelConfig(40001), BackendFrp)
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1", config.LocalIP)
+		assert.NotEqual(t, uint64(40001), config.LocalPort)
+		assert.True(t, config.ProxyProtocol)
+
+		again, err := ag.Apply(common.PROD, 1, policy, false, tcpTunnelConfig(40001), BackendFrp)
+		require.NoError(t, err)
+		assert.Equal(t, config.LocalPort, again.LocalPort, "the guard is kept across syncs")
+
+		ag.ReleaseApp(common.PROD, 1)
+		_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatUint(config.LocalPort, 10)))
+		assert.Error(t, err, "the guard is closed with the app")
+	})
+
+	t.Run("policies the protocol cannot enforce are refused", func(t *testing.T) {
+		_, err := ag.Apply(common.PROD, 1, &common.PortAccessPolicy{Tokens: []common.AccessToken{{Token: "t"}}}, false, tcpTunnelConfig(40001), BackendFrp)
+		assert.Error(t, err)
+
+		udpConfig := TunnelConfig{Subdomain: CreateSubdomain(UDP, 42, "syslog", 514), Protocol: UDP, LocalPort: 40002}
+		_, err = ag.Apply(common.PROD, 1, &common.PortAccessPolicy{AllowedCIDRs: []string{"10.0.0.0/8"}}, false, udpConfig, BackendFrp)
+		assert.Error(t, err)
+
+		_, err = ag.Apply(common.PROD, 1, &common.PortAccessPolicy{AllowedCIDRs: []string{"10.0.0.0/33"}}, false, tcpTunnelConfig(40001), BackendFrp)
+		assert.Error(t, err)
+
+		_, err = ag.Apply(common.PROD, 1, &common.PortAccessPolicy{ExpiresAt: timeIn(-time.Minute)}, false, tcpTunnelConfig(40001), BackendFrp)
+		assert.ErrorIs(t, err, ErrAccessExpired)
+	})
+}
+
+func TestAccessGuardHTTP(t *testing.T) {
+	var seenCookies []string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenCookies = append(seenCookies, r.Header.Get("Cookie"))
+		fmt.Fprintf(w, "app %s", r.URL.Path)
+	}))
+	defer app.Close()
+
+	appPort, _ := strconv.ParseUint(app.URL[strings.LastIndex(app.URL, ":")+1:], 10, 64)
+
+	ag := NewAccessGuard(nil)
+	defer ag.ReleaseApp(common.PROD, 1)
+
+	policy := &common.PortAccessPolicy{
+		BasicAuth:    &common.BasicAuthCredentials{Username: "customer", Password: "pw"},
+		AllowedCIDRs: []string{"203.0.113.0/24"},
+		Tokens: []common.AccessToken{
+			{Token: "share-me", ExpiresAt: timeIn(time.Hour)},
+			{Token: "stale", ExpiresAt: timeIn(-time.Hour)},
+		},
+	}
+
+	config, err := ag.Apply(common.PROD, 1, policy, false, httpTunnelConfig(appPort), BackendFrp)
+	require.NoError(t, err)
+	assert.False(t, config.ProxyProtocol, "frps reports the client in X-Forwarded-For")
+	assert.Empty(t, config.HTTPUser, "the guard checks the credentials itself")
+
+	guardURL := fmt.Sprintf("http://127.0.0.1:%d", config.LocalPort)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	request := func(path string, forwardedFor string, prepare func(*http.Request)) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, guardURL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		if prepare != nil {
+			prepare(req)
+		}
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("clients outside the allow list are forbidden", func(t *testing.T) {
+		resp := request("/", "198.51.100.1", func(r *http.Request) { r.SetBasicAuth("customer", "pw") })
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		// only the entry frps appended counts
+		resp = request("/", "203.0.113.7, 198.51.100.1", func(r *http.Request) { r.SetBasicAuth("customer", "pw") })
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("credentials are required", func(t *testing.T) {
+		resp := request("/", "203.0.113.7", nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+		resp = request("/", "203.0.113.7", func(r *http.Request) { r.SetBasicAuth("customer", "wrong") })
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = request("/dashboard", "1.2.3.4, 203.0.113.7", func(r *http.Request) { r.SetBasicAuth("customer", "pw") })
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "app /dashboard", string(body))
+	})
+
+	t.Run("share links trade the token for a cookie", func(t *testing.T) {
+		resp := request("/dashboard?access_token=share-me&tab=2", "203.0.113.7", nil)
+		require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, "/dashboard?tab=2", resp.Header.Get("Location"))
+
+		var cookie *http.Cookie
+		for _, c := range resp.Cookies() {
+			if c.Name == accessCookie {
+				cookie = c
+			}
+		}
+		require.NotNil(t, cookie)
+		assert.True(t, cookie.HttpOnly)
+
+		seenCookies = nil
+		resp = request("/dashboard?tab=2", "203.0.113.7", func(r *http.Request) {
+			r.AddCookie(cookie)
+			r.AddCookie(&http.Cookie{Name: "session", Value: "app-owned"})
+		})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, seenCookies, 1)
+		assert.Equal(t, "session=app-owned", seenCookies[0], "the access cookie is not passed to the app")
+
+		resp = request("/", "203.0.113.7", func(r *http.Request) { r.Header.Set("Authorization", "Bearer share-me") })
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("expired and unknown tokens are rejected", func(t *testing.T) {
+		resp := request("/?access_token=stale", "203.0.113.7", nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = request("/", "203.0.113.7", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: accessCookie, Value: "guess"}) })
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestAccessGuardTCPFiltersBySource(t *testing.T) {
+	ag := NewAccessGuard(nil)
+	defer ag.ReleaseApp(common.PROD, 1)
+
+	config, err := ag.Apply(common.PROD, 1, &common.PortAccessPolicy{AllowedCIDRs: []string{"10.0.0.0/8", "192.0.2.1"}}, false, tcpTunnelConfig(echoServer(t)), BackendFrp)
+	require.NoError(t, err)
+
+	guardAddr := net.JoinHostPort("127.0.0.1", strconv.FormatUint(config.LocalPort, 10))
+
+	dial := func(header string) (string, error) {
+		conn, err := net.Dial("tcp", guardAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, header+"hello\n")
+		require.NoError(t, err)
+
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	reply, err := dial(proxyProtocolHeader("10.1.2.3:5000", "127.0.0.1:80"))
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello\n", reply)
+
+	reply, err = dial(proxyProtocolHeader("192.0.2.1:5000", "127.0.0.1:80"))
+	require.NoError(t, err, "plain addresses allow just that address")
+	assert.Equal(t, "echo: hello\n", reply)
+
+	_, err = dial(proxyProtocolHeader("192.0.2.2:5000", "127.0.0.1:80"))
+	assert.Error(t, err, "clients outside the allow list are cut off")
+
+	_, err = dial("")
+	assert.Error(t, err, "connections without a PROXY header have no known client")
+}
+
+func TestAccessGuardTearsDownExpiredTunnels(t *testing.T) {
+	expired := make(chan string, 1)
+	ag := NewAccessGuard(func(tunnelID string) { expired <- tunnelID })
+
+	config := tcpTunnelConfig(echoServer(t))
+	policy := &common.PortAccessPolicy{AllowedCIDRs: []string{"10.0.0.0/8"}, ExpiresAt: timeIn(50 * time.Millisecond)}
+
+	guarded, err := ag.Apply(common.PROD, 1, policy, false, config, BackendFrp)
+	require.NoError(t, err)
+
+	select {
+	case tunnelID := <-expired:
+		assert.Equal(t, CreateTunnelID(config.Subdomain, string(TCP)), tunnelID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expiry callback not called")
+	}
+
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatUint(guarded.LocalPort, 10)))
+	assert.Error(t, err, "the guard is closed on expiry")
+}
+
+func TestAccessGuardBehindNativeTunnel(t *testing.T) {
+	relay := fakes.NewRelay("s3cret")
+	defer relay.Close()
+
+	tm, err := startNative(t, relay, "s3cret")
+	require.NoError(t, err)
+
+	ag := NewAccessGuard(nil)
+	defer ag.ReleaseApp(common.PROD, 1)
+
+	// the native backend announces the client the relay saw, here loopback
+	config, err := ag.Apply(common.PROD, 1, &common.PortAccessPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}}, false, tcpTunnelConfig(echoServer(t)), BackendNative)
+	require.NoError(t, err)
+	require.True(t, config.ProxyProtocol)
+
+	added, err := tm.AddTunnel(config)
+	require.NoError(t, err)
+	assert.Equal(t, "echo: through\n", roundTrip(t, relay.PublicAddr(added.Name), "through"))
+}
@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"fmt"
+	"reagent/config"
+	"reagent/messenger"
+)
+
+// Tunnel backends selectable per device via ReswarmConfig.TunnelBackend.
+const (
+	BackendFrp    = "frp"
+	BackendNative = "native"
+)
+
+// Backend returns the tunnel backend configured for the device, defaulting to
+// frp.
+func Backend(config *config.Config) string {
+	if config.ReswarmConfig.TunnelBackend == "" {
+		return BackendFrp
+	}
+
+	return config.ReswarmConfig.TunnelBackend
+}
+
+// NewTunnelManager creates the TunnelManager of the configured backend.
+func NewTunnelManager(messenger messenger.Messenger, config *config.Config) (TunnelManager, error) {
+	switch Backend(config) {
+	case BackendFrp:
+		return NewFrpTunnelManager(messenger, config)
+	case BackendNative:
+		return NewNativeTunnelManager(messenger, config)
+	default:
+		return nil, fmt.Errorf("unknown tunnel backend %s", config.ReswarmConfig.TunnelBackend)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"reagent/common"
 	"reagent/config"
 	"reagent/messenger"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -43,6 +44,18 @@ type TunnelConfig struct {
 	// from Subdomain instead, so callers building a config to add need not set
 	// it.
 	Name string
+	// HTTPUser and HTTPPassword protect an http tunnel with basic auth,
+	// enforced by the tunnel server.
+	HTTPUser     string
+	HTTPPassword string
+	// ProxyProtocol prefixes every connection to the local port with a PROXY
+	// protocol v1 header carrying the client address, for the AccessGuard
+	// listening there.
+	ProxyProtocol bool
+	// BandwidthLimit caps the tunnel's throughput in frp notation, e.g.
+	// "512KB" (per second, see ParseBandwidthLimit). Enforced by the tunnel
+	// client.
+	BandwidthLimit string
 }
 
 // YAML config structures matching frp v0.65.0 format
@@ -99,19 +112,33 @@ type LogConfig struct {
 }
 
 type ProxyConfig struct {
-	Name       string          `yaml:"name"`
-	Type       string          `yaml:"type"`
-	LocalIP    string          `yaml:"localIP,omitempty"`
-	LocalPort  int             `yaml:"localPort"`
-	RemotePort int             `yaml:"remotePort,omitempty"`
-	SubDomain  string          `yaml:"subdomain,omitempty"`
-	Transport  *ProxyTransport `yaml:"transport,omitempty"`
+	Name       string `yaml:"name"`
+	Type       string `yaml:"type"`
+	LocalIP    string `yaml:"localIP,omitempty"`
+	LocalPort  int    `yaml:"localPort"`
+	RemotePort int    `yaml:"remotePort,omitempty"`
+	SubDomain  string `yaml:"subdomain,omitempty"`
+	// HTTPUser/HTTPPassword make frps demand basic auth on http proxies.
+	HTTPUser     string          `yaml:"httpUser,omitempty"`
+	HTTPPassword string          `yaml:"httpPassword,omitempty"`
+	Transport    *ProxyTransport `yaml:"transport,omitempty"`
 }
 
 type ProxyTransport struct {
-	UseEncryption bool `yaml:"useEncryption,omitempty"`
+	UseEncryption        bool   `yaml:"useEncryption,omitempty"`
+	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
+	BandwidthLimit       string `yaml:"bandwidthLimit,omitempty"`
+	BandwidthLimitMode   string `yaml:"bandwidthLimitMode,omitempty"`
 }
 
+// proxyProtocolVersion is the PROXY protocol version frpc announces client
+// addresses with; the AccessGuard parses v1.
+const proxyProtocolVersion = "v1"
+
+// bandwidthLimitClient has frpc rather than frps enforce bandwidth limits, so
+// they apply whichever server the device talks to.
+const bandwidthLimitClient = "client"
+
 type TunnelConfigBuilder struct {
 	yamlConfig    *FrpcYamlConfig
 	appConfig     *config.Config
@@ -181,65 +208,7 @@ func initialize(cfg *config.Config) TunnelConfigBuilder {
 		frpcLogPath = filepath.Join(cfg.CommandLineArguments.AgentDir, "frpc.log")
 	}
 
-	// Extract server address. Order of precedence:
-	//   1. ReswarmConfig.ApplianceDomain (set on appliance installs from
-	//      APPLIANCE_DOMAIN — the operator's tunnel domain, already correct).
-	//   2. device_endpoint_url with the leading subdomain replaced by "app"
-	//      (cloud case: api.ironflock.com -> app.ironflock.com). This rewrite
-	//      is skipped when the hostname is an IP literal, since splitting on
-	//      "." would mangle e.g. 192.168.0.21 into "app.168.0.21".
-	//   3. Environment-based default.
-	serverAddr := PROD_SERVER_ADDR // Default fallback
-
-	if cfg.ReswarmConfig.ApplianceDomain != "" {
-		serverAddr = cfg.ReswarmConfig.ApplianceDomain
-		log.Debug().Msgf("Using tunnel server address from appliance_domain: %s", serverAddr)
-	} else if cfg.ReswarmConfig.DeviceEndpointURL != "" {
-		parsedURL, err := url.Parse(cfg.ReswarmConfig.DeviceEndpointURL)
-		if err != nil {
-			log.Warn().Err(err).Msgf("Failed to parse device_endpoint_url, using default: %s", serverAddr)
-		} else {
-			// Extract hostname (without port)
-			hostname := parsedURL.Hostname()
-			if hostname != "" {
-				switch {
-				case hostname == "localhost" || hostname == "127.0.0.1":
-					serverAddr = hostname
-				case hostname == "host.docker.internal":
-					// The agent itself runs inside a container on a dev
-					// machine; the name means "the machine hosting the dev
-					// stack" (frps included) and must not be subdomain-
-					// rewritten (app.docker.internal does not exist).
-					serverAddr = hostname
-				case net.ParseIP(hostname) != nil:
-					// IP literal — no subdomain to replace; use as-is.
-					serverAddr = hostname
-				default:
-					// Replace subdomain with "app"
-					// e.g., "api.ironflock.com" -> "app.ironflock.com"
-					parts := strings.Split(hostname, ".")
-					if len(parts) >= 2 {
-						parts[0] = "app"
-						serverAddr = strings.Join(parts, ".")
-					} else {
-						serverAddr = hostname
-					}
-				}
-				log.Debug().Msgf("Using tunnel server address from device_endpoint_url: %s", serverAddr)
-			}
-		}
-	} else {
-		// Fallback to environment-based configuration
-		switch cfg.ReswarmConfig.Environment {
-		case string(common.PRODUCTION):
-			serverAddr = PROD_SERVER_ADDR
-		case string(common.TEST):
-			serverAddr = TEST_SERVER_ADDR
-		case string(common.LOCAL):
-			serverAddr = "localhost"
-		}
-		log.Debug().Msgf("Using tunnel server address from environment: %s", serverAddr)
-	}
+	serverAddr := resolveTunnelServerAddr(cfg)
 
 	port := pickAdminPort()
 	log.Debug().Msgf("Using port %d for Frp webserver", port)
@@ -322,6 +291,72 @@ func initialize(cfg *config.Config) TunnelConfigBuilder {
 	return configBuilder
 }
 
+// resolveTunnelServerAddr picks the host of the tunnel server (frps, or the
+// relay of the native backend) this device tunnels through.
+func resolveTunnelServerAddr(cfg *config.Config) string {
+	// Order of precedence:
+	//   1. ReswarmConfig.ApplianceDomain (set on appliance installs from
+	//      APPLIANCE_DOMAIN — the operator's tunnel domain, already correct).
+	//   2. device_endpoint_url with the leading subdomain replaced by "app"
+	//      (cloud case: api.ironflock.com -> app.ironflock.com). This rewrite
+	//      is skipped when the hostname is an IP literal, since splitting on
+	//      "." would mangle e.g. 192.168.0.21 into "app.168.0.21".
+	//   3. Environment-based default.
+	serverAddr := PROD_SERVER_ADDR // Default fallback
+
+	if cfg.ReswarmConfig.ApplianceDomain != "" {
+		serverAddr = cfg.ReswarmConfig.ApplianceDomain
+		log.Debug().Msgf("Using tunnel server address from appliance_domain: %s", serverAddr)
+	} else if cfg.ReswarmConfig.DeviceEndpointURL != "" {
+		parsedURL, err := url.Parse(cfg.ReswarmConfig.DeviceEndpointURL)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to parse device_endpoint_url, using default: %s", serverAddr)
+		} else {
+			// Extract hostname (without port)
+			hostname := parsedURL.Hostname()
+			if hostname != "" {
+				switch {
+				case hostname == "localhost" || hostname == "127.0.0.1":
+					serverAddr = hostname
+				case hostname == "host.docker.internal":
+					// The agent itself runs inside a container on a dev
+					// machine; the name means "the machine hosting the dev
+					// stack" (frps included) and must not be subdomain-
+					// rewritten (app.docker.internal does not exist).
+					serverAddr = hostname
+				case net.ParseIP(hostname) != nil:
+					// IP literal — no subdomain to replace; use as-is.
+					serverAddr = hostname
+				default:
+					// Replace subdomain with "app"
+					// e.g., "api.ironflock.com" -> "app.ironflock.com"
+					parts := strings.Split(hostname, ".")
+					if len(parts) >= 2 {
+						parts[0] = "app"
+						serverAddr = strings.Join(parts, ".")
+					} else {
+						serverAddr = hostname
+					}
+				}
+				log.Debug().Msgf("Using tunnel server address from device_endpoint_url: %s", serverAddr)
+			}
+		}
+	} else {
+		// Fallback to environment-based configuration
+		switch cfg.ReswarmConfig.Environment {
+		case string(common.PRODUCTION):
+			serverAddr = PROD_SERVER_ADDR
+		case string(common.TEST):
+			serverAddr = TEST_SERVER_ADDR
+		case string(common.LOCAL):
+			serverAddr = "localhost"
+		}
+		log.Debug().Msgf("Using tunnel server address from environment: %s", serverAddr)
+	}
+
+	return serverAddr
+}
+
 func (builder *TunnelConfigBuilder) GetTunnelConfig() ([]TunnelConfig, error) {
 	tunnelConfigs := make([]TunnelConfig, 0)
 
@@ -345,6 +380,13 @@ func (builder *TunnelConfigBuilder) GetTunnelConfig() ([]TunnelConfig, error) {
 			LocalIP:      proxy.LocalIP,
 			Subdomain:    subdomain,
 			DeclaredPort: uint64(proxy.LocalPort),
+			HTTPUser:     proxy.HTTPUser,
+			HTTPPassword: proxy.HTTPPassword,
+		}
+
+		if proxy.Transport != nil {
+			tunnelConfig.ProxyProtocol = proxy.Transport.ProxyProtocolVersion != ""
+			tunnelConfig.BandwidthLimit = proxy.Transport.BandwidthLimit
 		}
 
 		result := subdomainRegex.FindStringSubmatch(subdomain)
@@ -377,9 +419,25 @@ func (builder *TunnelConfigBuilder) AddTunnelConfig(conf TunnelConfig) {
 		proxyConfig.LocalIP = conf.LocalIP
 	}
 
+	if conf.ProxyProtocol || conf.BandwidthLimit != "" {
+		proxyConfig.Transport = &ProxyTransport{}
+		if conf.ProxyProtocol {
+			proxyConfig.Transport.ProxyProtocolVersion = proxyProtocolVersion
+		}
+		if conf.BandwidthLimit != "" {
+			proxyConfig.Transport.BandwidthLimit = conf.BandwidthLimit
+			proxyConfig.Transport.BandwidthLimitMode = bandwidthLimitClient
+		}
+	}
+
 	// subdomain is only valid for HTTP/HTTPS protocols
 	if conf.Protocol == HTTP || conf.Protocol == HTTPS {
 		proxyConfig.SubDomain = conf.Subdomain
+		// basic auth is only enforced by frps on http proxies
+		if conf.Protocol == HTTP {
+			proxyConfig.HTTPUser = conf.HTTPUser
+			proxyConfig.HTTPPassword = conf.HTTPPassword
+		}
 	} else {
 		// For TCP/UDP, use remotePort instead
 		proxyConfig.RemotePort = int(conf.RemotePort)
@@ -393,7 +451,9 @@ func (builder *TunnelConfigBuilder) AddTunnelConfig(conf TunnelConfig) {
 			continue
 		}
 
-		if proxy.LocalPort == proxyConfig.LocalPort && proxy.LocalIP == proxyConfig.LocalIP {
+		if proxy.LocalPort == proxyConfig.LocalPort && proxy.LocalIP == proxyConfig.LocalIP &&
+			proxy.HTTPUser == proxyConfig.HTTPUser && proxy.HTTPPassword == proxyConfig.HTTPPassword &&
+			reflect.DeepEqual(proxy.Transport, proxyConfig.Transport) {
 			log.Debug().Str("tunnelID", tunnelID).Msg("Tunnel already exists in config, skipping add")
 			return
 		}
@@ -546,11 +606,14 @@ func (builder *TunnelConfigBuilder) SaveConfig() {
 		return
 	}
 
-	err = os.WriteFile(builder.ConfigPath, data, 0644)
+	// Owner-only: the file holds the tunnel proof and basic auth credentials.
+	// WriteFile keeps the mode of an existing file, hence the Chmod.
+	err = os.WriteFile(builder.ConfigPath, data, 0600)
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to write frpc config to %s", builder.ConfigPath)
 		return
 	}
+	_ = os.Chmod(builder.ConfigPath, 0600)
 
 	log.Debug().Msgf("Saved frpc config to %s", builder.ConfigPath)
 }
@@ -0,0 +1,304 @@
+package tunnel
+
+import (
+	"fmt"
+	"reagent/common"
+	"reagent/config"
+	"reagent/mdns"
+	"reagent/peerimage"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DNS-SD service types the app ports are advertised under. tcp/udp rules
+// carry arbitrary protocols, so they get a vendor type browsers can filter on.
+const (
+	lanServiceHTTP   = "_http._tcp"
+	lanServiceHTTPS  = "_https._tcp"
+	lanServiceTCP    = "_ironflock-app._tcp"
+	lanServiceUDP    = "_ironflock-app._udp"
+	lanServiceDevice = "_device-info._tcp"
+)
+
+// LANEndpoint is an app port reachable on the local network through the host
+// port it is published on, independent of the cloud tunnel.
+type LANEndpoint struct {
+	AppName  string   `json:"app_name"`
+	RuleName string   `json:"rule_name"`
+	Protocol Protocol `json:"protocol"`
+	Port     uint64   `json:"port"` // the declared port, as in TunnelState
+	HostPort uint64   `json:"host_port"`
+	URL      string   `json:"url"`
+}
+
+type lanApp struct {
+	running   bool
+	endpoints []LANEndpoint
+}
+
+// LANAdvertiser advertises the device and the published ports of its running
+// apps over mDNS/DNS-SD, so users on a factory LAN without internet can find
+// them. A nil advertiser is valid and does nothing, which is what devices
+// started with -mdns=false get.
+type LANAdvertiser struct {
+	responder *mdns.Responder
+	config    *config.Config
+
+	mu   sync.Mutex
+	apps map[string]*lanApp
+}
+
+func NewLANAdvertiser(config *config.Config) *LANAdvertiser {
+	return &LANAdvertiser{
+		responder: mdns.NewResponder(lanHostname(config)),
+		config:    config,
+		apps:      make(map[string]*lanApp),
+	}
+}
+
+// lanHostname derives the mDNS host name from the device name, falling back
+// to the device key for names without any usable character.
+func lanHostname(config *config.Config) string {
+	hostname := mdns.HostLabel(config.ReswarmConfig.Name)
+	if hostname == "" {
+		hostname = fmt.Sprintf("ironflock-%d", config.ReswarmConfig.DeviceKey)
+	}
+
+	return hostname
+}
+
+// Start advertises the device itself and starts answering mDNS queries.
+func (la *LANAdvertiser) Start() error {
+	if la == nil {
+		return nil
+	}
+
+	reswarmConfig := la.config.ReswarmConfig
+	la.responder.SetServices("device", []mdns.Service{{
+		Instance: reswarmConfig.Name,
+		Type:     lanServiceDevice,
+		Text: []string{
+			"serial=" + reswarmConfig.SerialNumber,
+			"device_key=" + strconv.Itoa(reswarmConfig.DeviceKey),
+			"swarm=" + reswarmConfig.SwarmName,
+			"model=" + reswarmConfig.Board.Model,
+		},
+	}})
+
+	return la.responder.Start()
+}
+
+func (la *LANAdvertiser) Close() error {
+	if la == nil {
+		return nil
+	}
+
+	return la.responder.Close()
+}
+
+// Hostname is the .local name the device answers to.
+func (la *LANAdvertiser) Hostname() string {
+	if la == nil {
+		return ""
+	}
+
+	return la.responder.Hostname()
+}
+
+// AdvertiseImages advertises the registry the device serves its images to
+// the devices around it on (see peerimage).
+func (la *LANAdvertiser) AdvertiseImages(port uint16) {
+	if la == nil {
+		return
+	}
+
+	la.responder.SetServices("images", []mdns.Service{{
+		Instance: fmt.Sprintf("images (%s)", la.Hostname()),
+		Type:     peerimage.ServiceType,
+		Port:     port,
+		Text: []string{
+			"device_key=" + strconv.Itoa(la.config.ReswarmConfig.DeviceKey),
+			"device=" + la.config.ReswarmConfig.Name,
+		},
+	}})
+}
+
+// SetAppEndpoints replaces the published ports known for an app. They are
+// only advertised while the app is running.
+func (la *LANAdvertiser) SetAppEndpoints(stage common.Stage, appKey uint64, running bool, endpoints []LANEndpoint) {
+	if la == nil {
+		return
+	}
+
+	key := appOwnerKey(stage, appKey)
+
+	la.mu.Lock()
+	if len(endpoints) == 0 {
+		delete(la.apps, key)
+	} else {
+		resolved := make([]LANEndpoint, 0, len(endpoints))
+		for _, endpoint := range endpoints {
+			endpoint.URL = la.buildLANURL(endpoint.Protocol, endpoint.HostPort)
+			resolved = append(resolved, endpoint)
+		}
+		la.apps[key] = &lanApp{running: running, endpoints: resolved}
+	}
+	la.mu.Unlock()
+
+	la.publish(key)
+}
+
+// SetAppRunning shows or hides the app's endpoints as it starts and stops,
+// without needing its port rules again.
+func (la *LANAdvertiser) SetAppRunning(stage common.Stage, appKey uint64, running bool) {
+	if la == nil {
+		return
+	}
+
+	key := appOwnerKey(stage, appKey)
+
+	la.mu.Lock()
+	app := la.apps[key]
+	if app == nil || app.running == running {
+		la.mu.Unlock()
+		return
+	}
+	app.running = running
+	la.mu.Unlock()
+
+	la.publish(key)
+}
+
+// RemoveApp forgets an app's endpoints, e.g. when it was uninstalled.
+func (la *LANAdvertiser) RemoveApp(stage common.Stage, appKey uint64) {
+	if la == nil {
+		return
+	}
+
+	key := appOwnerKey(stage, appKey)
+
+	la.mu.Lock()
+	delete(la.apps, key)
+	la.mu.Unlock()
+
+	la.publish(key)
+}
+
+// Endpoints returns the endpoints currently advertised, i.e. those of running
+// apps.
+func (la *LANAdvertiser) Endpoints() []LANEndpoint {
+	if la == nil {
+		return nil
+	}
+
+	la.mu.Lock()
+	defer la.mu.Unlock()
+
+	endpoints := make([]LANEndpoint, 0)
+	for _, app := range la.apps {
+		if app.running {
+			endpoints = append(endpoints, app.endpoints...)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].AppName != endpoints[j].AppName {
+			return endpoints[i].AppName < endpoints[j].AppName
+		}
+		return endpoints[i].Port < endpoints[j].Port
+	})
+
+	return endpoints
+}
+
+// ApplyLANURLs adds the LAN URL to the tunnel state of every advertised
+// port, and appends a state for advertised ports that have no tunnel (tunnel
+// inactive or tunnels unavailable). Those carry no status since frpc knows
+// nothing about them.
+func (la *LANAdvertiser) ApplyLANURLs(states []TunnelState) []TunnelState {
+	if la == nil {
+		return states
+	}
+
+	for _, endpoint := range la.Endpoints() {
+		matched := false
+		for i := range states {
+			if states[i].AppName == endpoint.AppName && states[i].Port == endpoint.Port &&
+				(states[i].Status == nil || states[i].Status.Protocol == endpoint.Protocol) {
+				states[i].LanURL = endpoint.URL
+				matched = true
+			}
+		}
+
+		if !matched {
+			states = append(states, TunnelState{
+				AppName: endpoint.AppName,
+				Port:    endpoint.Port,
+				LanURL:  endpoint.URL,
+			})
+		}
+	}
+
+	return states
+}
+
+func (la *LANAdvertiser) publish(key string) {
+	la.mu.Lock()
+	app := la.apps[key]
+	var services []mdns.Service
+	if app != nil && app.running {
+		for _, endpoint := range app.endpoints {
+			services = append(services, la.toService(endpoint))
+		}
+	}
+	la.mu.Unlock()
+
+	la.responder.SetServices(key, services)
+}
+
+func (la *LANAdvertiser) toService(endpoint LANEndpoint) mdns.Service {
+	ruleName := endpoint.RuleName
+	if ruleName == "" {
+		ruleName = strconv.FormatUint(endpoint.Port, 10)
+	}
+
+	serviceType := lanServiceTCP
+	switch endpoint.Protocol {
+	case HTTP:
+		serviceType = lanServiceHTTP
+	case HTTPS:
+		serviceType = lanServiceHTTPS
+	case UDP:
+		serviceType = lanServiceUDP
+	}
+
+	text := []string{
+		"app=" + endpoint.AppName,
+		"rule=" + endpoint.RuleName,
+		"port=" + strconv.FormatUint(endpoint.Port, 10),
+		"device=" + la.config.ReswarmConfig.Name,
+	}
+	if endpoint.Protocol == HTTP || endpoint.Protocol == HTTPS {
+		text = append(text, "path=/")
+	}
+
+	return mdns.Service{
+		// instance names must be unique on the LAN, not just on this device
+		Instance: fmt.Sprintf("%s %s (%s)", endpoint.AppName, ruleName, la.Hostname()),
+		Type:     serviceType,
+		Port:     uint16(endpoint.HostPort),
+		Text:     text,
+	}
+}
+
+// buildLANURL is the LAN counterpart of FrpTunnelManager.buildURL: the app
+// is reached directly on its host port, so http stays http.
+func (la *LANAdvertiser) buildLANURL(protocol Protocol, hostPort uint64) string {
+	return fmt.Sprintf("%s://%s:%d", string(protocol), la.Hostname(), hostPort)
+}
+
+// appOwnerKey identifies the app state kept per app, here and in AccessGuard.
+func appOwnerKey(stage common.Stage, appKey uint64) string {
+	return fmt.Sprintf("%s-%d", stage, appKey)
+}
@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"reagent/common"
+	"reagent/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lanConfig() *config.Config {
+	return &config.Config{
+		CommandLineArguments: &config.CommandLineArguments{},
+		ReswarmConfig:        &config.ReswarmConfig{Name: "Line 3 Controller", DeviceKey: 42},
+	}
+}
+
+func TestLANHostname(t *testing.T) {
+	assert.Equal(t, "line-3-controller", lanHostname(lanConfig()))
+
+	cfg := lanConfig()
+	cfg.ReswarmConfig.Name = "???"
+	assert.Equal(t, "ironflock-42", lanHostname(cfg), "falls back to the device key")
+}
+
+func TestLANAdvertiserEndpoints(t *testing.T) {
+	la := NewLANAdvertiser(lanConfig())
+
+	la.SetAppEndpoints(common.PROD, 1, false, []LANEndpoint{
+		{AppName: "grafana", RuleName: "web", Protocol: HTTP, Port: 3000, HostPort: 40000},
+		{AppName: "grafana", RuleName: "", Protocol: UDP, Port: 9000, HostPort: 40001},
+	})
+	assert.Empty(t, la.Endpoints(), "apps that do not run are not advertised")
+
+	la.SetAppRunning(common.PROD, 1, true)
+	endpoints := la.Endpoints()
+	require.Len(t, endpoints, 2)
+	assert.Equal(t, "http://line-3-controller.local:40000", endpoints[0].URL)
+	assert.Equal(t, "udp://line-3-controller.local:40001", endpoints[1].URL)
+
+	services := la.responder.Services()
+	require.Len(t, services, 2)
+	assert.Equal(t, "_http._tcp", services[0].Type)
+	assert.Equal(t, "grafana web (line-3-controller.local)", services[0].Instance)
+	assert.Equal(t, uint16(40000), services[0].Port)
+	assert.Contains(t, services[0].Text, "app=grafana")
+	assert.Contains(t, services[0].Text, "rule=web")
+	assert.Equal(t, "_ironflock-app._udp", services[1].Type)
+	assert.Equal(t, "grafana 9000 (line-3-controller.local)", services[1].Instance, "unnamed rules fall back to the port")
+
+	la.RemoveApp(common.PROD, 1)
+	assert.Empty(t, la.Endpoints())
+	assert.Empty(t, la.responder.Services())
+}
+
+func TestLANAdvertiserImages(t *testing.T) {
+	la := NewLANAdvertiser(lanConfig())
+	la.AdvertiseImages(5380)
+
+	services := la.responder.Services()
+	require.Len(t, services, 1)
+	assert.Equal(t, "_ironflock-images._tcp", services[0].Type)
+	assert.Equal(t, "images (line-3-controller.local)", services[0].Instance)
+	assert.Equal(t, uint16(5380), services[0].Port)
+	assert.Contains(t, services[0].Text, "device_key=42")
+
+	var nilAdvertiser *LANAdvertiser
+	nilAdvertiser.AdvertiseImages(5380)
+}
+
+func TestApplyLANURLs(t *testing.T) {
+	la := NewLANAdvertiser(lanConfig())
+	la.SetAppEndpoints(common.PROD, 1, true, []LANEndpoint{
+		{AppName: "grafana", RuleName: "web", Protocol: HTTP, Port: 3000, HostPort: 40000},
+		{AppName: "grafana", RuleName: "ssh", Protocol: TCP, Port: 22, HostPort: 40001},
+	})
+
+	states := la.ApplyLANURLs([]TunnelState{{
+		Status:  &TunnelStatus{Name: "42-grafana-3000-http", Protocol: HTTP},
+		AppName: "grafana",
+		Port:    3000,
+		Active:  true,
+		URL:     "https://42-grafana-3000.app.ironflock.com",
+	}})
+
+	require.Len(t, states, 2)
+	assert.Equal(t, "http://line-3-controller.local:40000", states[0].LanURL)
+	assert.Equal(t, "https://42-grafana-3000.app.ironflock.com", states[0].URL, "the tunnel URL is kept")
+
+	// no tunnel for the ssh port, it is only reachable on the LAN
+	assert.Nil(t, states[1].Status)
+	assert.False(t, states[1].Active)
+	assert.Equal(t, uint64(22), states[1].Port)
+	assert.Equal(t, "tcp://line-3-controller.local:40001", states[1].LanURL)
+
+	var nilAdvertiser *LANAdvertiser
+	assert.Empty(t, nilAdvertiser.ApplyLANURLs(nil), "a disabled advertiser changes nothing")
+}
@@ -0,0 +1,901 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reagent/common"
+	"reagent/config"
+	"reagent/errdefs"
+	"reagent/messenger"
+	"reagent/safe"
+	"reagent/tunnel/relay"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// relayDialTimeout bounds dialing and handshaking one relay connection.
+	relayDialTimeout = 10 * time.Second
+	// relayKeepaliveInterval is how often the control connection is pinged;
+	// three missed intervals count as a dead connection.
+	relayKeepaliveInterval = 20 * time.Second
+	// relayRegisterTimeout bounds how long AddTunnel waits for the relay to
+	// confirm a new proxy.
+	relayRegisterTimeout = 10 * time.Second
+	// localDialTimeout bounds dialing the app's local port for a connection.
+	localDialTimeout = 5 * time.Second
+)
+
+var errRelayNotConnected = errors.New("not connected to the tunnel relay")
+
+// NativeTunnelManager is an in-process reverse tunnel to a relay: no external
+// process to download, spawn and supervise, and therefore nothing for an
+// antivirus to quarantine. It speaks the relay package protocol over a
+// WebSocket, which passes through the same proxies and firewalls the WAMP
+// connection does.
+//
+// Tunnels are kept in memory only: syncPortState re-adds them on the first
+// sync after a restart, exactly as it does for a missing frpc proxy. UDP is
+// not supported.
+type NativeTunnelManager struct {
+	TunnelManager
+	config    *config.Config
+	messenger messenger.Messenger
+	relayURL  string
+
+	tunnelsLock   sync.RWMutex
+	tunnels       map[string]*Tunnel
+	statuses      map[string]relay.Proxy
+	statusSignal  chan struct{}
+	baseTunnelURL string
+
+	// startMu serializes connecting, so a reconnect and a Reload-triggered
+	// supervisor never race two control connections.
+	startMu sync.Mutex
+	connMu  sync.Mutex
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	supervising  atomic.Bool
+	stopped      atomic.Bool
+	monitorOnce  sync.Once
+	capability   atomic.Int32
+	capabilityMu sync.Mutex
+	lastErr      string
+}
+
+func NewNativeTunnelManager(messenger messenger.Messenger, config *config.Config) (*NativeTunnelManager, error) {
+	relayURL := config.ReswarmConfig.TunnelRelayURL
+	serverAddr := resolveTunnelServerAddr(config)
+	if relayURL == "" {
+		relayURL = "wss://" + serverAddr
+	}
+
+	parsedURL, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel relay url %s: %w", relayURL, err)
+	}
+
+	if parsedURL.Scheme != "ws" && parsedURL.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid tunnel relay url %s: scheme must be ws or wss", relayURL)
+	}
+
+	return &NativeTunnelManager{
+		config:        config,
+		messenger:     messenger,
+		relayURL:      relayURL,
+		tunnels:       make(map[string]*Tunnel),
+		statuses:      make(map[string]relay.Proxy),
+		statusSignal:  make(chan struct{}),
+		baseTunnelURL: serverAddr,
+	}, nil
+}
+
+func (ntm *NativeTunnelManager) SetMessenger(messenger messenger.Messenger) {
+	ntm.messenger = messenger
+}
+
+// TunnelCapable follows the same rule as the frp backend: capable unless
+// tunnels are definitively unavailable.
+func (ntm *NativeTunnelManager) TunnelCapable() bool {
+	return TunnelCapability(ntm.capability.Load()) != CapabilityUnavailable
+}
+
+func (ntm *NativeTunnelManager) MarkUnavailable(reason string) {
+	ntm.setCapability(CapabilityUnavailable, errors.New(reason))
+}
+
+// Capability returns the current capability and the last error string.
+func (ntm *NativeTunnelManager) Capability() (TunnelCapability, string) {
+	ntm.capabilityMu.Lock()
+	defer ntm.capabilityMu.Unlock()
+	return TunnelCapability(ntm.capability.Load()), ntm.lastErr
+}
+
+func (ntm *NativeTunnelManager) setCapability(c TunnelCapability, err error) {
+	ntm.capabilityMu.Lock()
+	prev := TunnelCapability(ntm.capability.Load())
+	ntm.capability.Store(int32(c))
+	if err != nil {
+		ntm.lastErr = err.Error()
+	} else if c == CapabilityAvailable {
+		ntm.lastErr = ""
+	}
+	ntm.capabilityMu.Unlock()
+
+	if prev != c && (c == CapabilityAvailable || c == CapabilityUnavailable) {
+		safe.Go(func() {
+			pubErr := ntm.PublishTunnelState()
+			if pubErr != nil {
+				log.Debug().Err(pubErr).Msg("failed to publish tunnel state on capability change")
+			}
+		})
+	}
+}
+
+// Start connects to the relay, authenticates and registers every known
+// tunnel. The connection is re-established in the background when it drops.
+func (ntm *NativeTunnelManager) Start() error {
+	ntm.startMu.Lock()
+	defer ntm.startMu.Unlock()
+
+	log.Debug().Str("relay", ntm.relayURL).Msg("Starting native tunnel client")
+
+	ntm.stopped.Store(false)
+
+	ntm.closeConn()
+	ntm.setCapability(CapabilityStarting, nil)
+
+	conn, baseDomain, err := ntm.connect()
+	if err != nil {
+		ntm.setCapability(CapabilityUnavailable, err)
+		return err
+	}
+
+	ntm.tunnelsLock.Lock()
+	if baseDomain != "" {
+		ntm.baseTunnelURL = baseDomain
+	}
+	ntm.tunnelsLock.Unlock()
+
+	ntm.connMu.Lock()
+	ntm.conn = conn
+	ntm.connMu.Unlock()
+
+	done := make(chan struct{})
+	safe.Go(func() {
+		defer close(done)
+		ntm.readLoop(conn)
+	})
+	safe.Go(func() {
+		ntm.keepalive(conn, done)
+	})
+
+	// Self-heal after SuperviseStart gave up, e.g. a relay that was down for
+	// longer than its backoff.
+	ntm.monitorOnce.Do(func() {
+		safe.Go(ntm.monitorConnection)
+	})
+
+	err = ntm.register()
+	if err != nil {
+		ntm.closeConn()
+		ntm.setCapability(CapabilityUnavailable, err)
+		return err
+	}
+
+	ntm.setCapability(CapabilityAvailable, nil)
+	return nil
+}
+
+// SuperviseStart connects with bounded exponential backoff, like the frp
+// backend does for frpc.
+func (ntm *NativeTunnelManager) SuperviseStart() {
+	if !ntm.supervising.CompareAndSwap(false, true) {
+		log.Debug().Msg("tunnel client supervisor already running, skipping")
+		return
+	}
+	defer ntm.supervising.Store(false)
+
+	const maxAttempts = 6
+	backoff := 2 * time.Second
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := ntm.Start()
+		if err == nil {
+			log.Info().Msg("native tunnel client connected to relay")
+			return
+		}
+
+		log.Warn().Err(err).Msgf("native tunnel client start attempt %d/%d failed", attempt, maxAttempts)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			if backoff < 32*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+
+	ntm.setCapability(CapabilityUnavailable, errors.New("tunnel relay unreachable after repeated attempts"))
+	log.Error().Msg("giving up connecting to the tunnel relay; tunnels are unavailable on this device")
+}
+
+func (ntm *NativeTunnelManager) monitorConnection() {
+	ticker := time.NewTicker(capabilityProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ntm.connMu.Lock()
+		connected := ntm.conn != nil
+		ntm.connMu.Unlock()
+
+		if !connected && !ntm.stopped.Load() {
+			ntm.SuperviseStart()
+		}
+	}
+}
+
+// Stop closes the relay connection; the relay tears the proxies down.
+func (ntm *NativeTunnelManager) Stop() error {
+	ntm.startMu.Lock()
+	defer ntm.startMu.Unlock()
+
+	ntm.stopped.Store(true)
+	ntm.closeConn()
+	return nil
+}
+
+func (ntm *NativeTunnelManager) closeConn() {
+	ntm.connMu.Lock()
+	conn := ntm.conn
+	ntm.conn = nil
+	ntm.connMu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// connect dials the control connection and runs the challenge handshake.
+func (ntm *NativeTunnelManager) connect() (*websocket.Conn, string, error) {
+	conn, err := ntm.dialRelay(relay.ControlPath, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(relayDialTimeout))
+
+	var challenge relay.Message
+	err = websocket.JSON.Receive(conn, &challenge)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to receive relay challenge: %w", err)
+	}
+
+	if challenge.Type != relay.TypeChallenge {
+		conn.Close()
+		return nil, "", fmt.Errorf("unexpected relay message %s, expected challenge", challenge.Type)
+	}
+
+	reswarmConfig := ntm.config.ReswarmConfig
+	err = websocket.JSON.Send(conn, relay.Message{
+		Type:         relay.TypeHello,
+		DeviceKey:    reswarmConfig.DeviceKey,
+		SerialNumber: reswarmConfig.SerialNumber,
+		Signature:    relay.Sign(reswarmConfig.Secret, challenge.Nonce, reswarmConfig.DeviceKey),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	var welcome relay.Message
+	err = websocket.JSON.Receive(conn, &welcome)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to receive relay welcome: %w", err)
+	}
+
+	if welcome.Type != relay.TypeWelcome {
+		conn.Close()
+		return nil, "", fmt.Errorf("relay rejected the device: %s", welcome.Error)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, welcome.BaseDomain, nil
+}
+
+// dialRelay opens a WebSocket to the relay, through the HTTPS_PROXY/HTTP_PROXY
+// from the environment when one applies.
+func (ntm *NativeTunnelManager) dialRelay(path string, query string) (*websocket.Conn, error) {
+	target, err := url.Parse(ntm.relayURL)
+	if err != nil {
+		return nil, err
+	}
+
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+	target.RawQuery = query
+
+	origin := &url.URL{Scheme: "http", Host: target.Host}
+	defaultPort := "80"
+	if target.Scheme == "wss" {
+		origin.Scheme = "https"
+		defaultPort = "443"
+	}
+
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), defaultPort)
+	}
+
+	wsConfig, err := websocket.NewConfig(target.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialThroughProxy(&url.URL{Scheme: origin.Scheme, Host: address}, address)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(relayDialTimeout))
+
+	if target.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: target.Hostname()})
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return ws, nil
+}
+
+// dialThroughProxy dials address directly or, when the environment names a
+// proxy for it, through an HTTP CONNECT tunnel. Same semantics as the wss
+// transport of the frp backend (see initialize in frp.go).
+func dialThroughProxy(target *url.URL, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: relayDialTimeout}
+
+	proxyURL, err := httpproxy.FromEnvironment().ProxyFunc()(target)
+	if err != nil || proxyURL == nil {
+		return dialer.Dial("tcp", address)
+	}
+
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	conn, err := dialer.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(relayDialTimeout))
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	err = connectReq.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyURL.Redacted(), address, resp.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (ntm *NativeTunnelManager) send(message relay.Message) error {
+	ntm.connMu.Lock()
+	conn := ntm.conn
+	ntm.connMu.Unlock()
+
+	if conn == nil {
+		return errRelayNotConnected
+	}
+
+	ntm.writeMu.Lock()
+	defer ntm.writeMu.Unlock()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(relayDialTimeout))
+	return websocket.JSON.Send(conn, message)
+}
+
+func (ntm *NativeTunnelManager) readLoop(conn *websocket.Conn) {
+	defer func() {
+		ntm.connMu.Lock()
+		current := ntm.conn == conn
+		if current {
+			ntm.conn = nil
+		}
+		ntm.connMu.Unlock()
+
+		conn.Close()
+
+		// Only a connection that was not replaced or stopped on purpose
+		// needs re-establishing.
+		if current {
+			log.Warn().Msg("connection to the tunnel relay lost, reconnecting")
+			ntm.setCapability(CapabilityStarting, nil)
+			safe.Go(ntm.SuperviseStart)
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(3 * relayKeepaliveInterval))
+
+		var message relay.Message
+		err := websocket.JSON.Receive(conn, &message)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debug().Err(err).Msg("failed to read from tunnel relay")
+			}
+			return
+		}
+
+		switch message.Type {
+		case relay.TypeStatus:
+			ntm.updateStatuses(message.Proxies)
+		case relay.TypeConnect:
+			safe.Go(func() {
+				ntm.handleConnect(message)
+			})
+		case relay.TypeError:
+			log.Error().Msgf("tunnel relay error: %s", message.Error)
+		case relay.TypePong:
+		default:
+			log.Debug().Msgf("ignoring unknown tunnel relay message %s", message.Type)
+		}
+	}
+}
+
+func (ntm *NativeTunnelManager) keepalive(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(relayKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ntm.connMu.Lock()
+			current := ntm.conn == conn
+			ntm.connMu.Unlock()
+
+			if !current {
+				return
+			}
+
+			err := ntm.send(relay.Message{Type: relay.TypePing})
+			if err != nil {
+				// the read loop notices the dead connection and reconnects
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (ntm *NativeTunnelManager) updateStatuses(proxies []relay.Proxy) {
+	ntm.tunnelsLock.Lock()
+	ntm.statuses = make(map[string]relay.Proxy, len(proxies))
+	for _, proxy := range proxies {
+		ntm.statuses[proxy.Name] = proxy
+
+		if tunnel := ntm.tunnels[proxy.Name]; tunnel != nil {
+			tunnel.Error = proxy.Error
+			if proxy.RemotePort != 0 {
+				tunnel.Config.RemotePort = proxy.RemotePort
+			}
+		}
+	}
+
+	// wake everyone waiting for a registration to be confirmed
+	close(ntm.statusSignal)
+	ntm.statusSignal = make(chan struct{})
+	ntm.tunnelsLock.Unlock()
+
+	safe.Go(func() {
+		err := ntm.PublishTunnelState()
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to publish tunnel state change")
+		}
+	})
+}
+
+// handleConnect serves one client connection: it dials the app locally and
+// splices it to a fresh data connection to the relay.
+func (ntm *NativeTunnelManager) handleConnect(message relay.Message) {
+	tunnel := ntm.Get(message.Proxy)
+	if tunnel == nil {
+		ntm.rejectConnection(message.ConnectionID, fmt.Sprintf("unknown proxy %s", message.Proxy))
+		return
+	}
+
+	localIP := tunnel.Config.LocalIP
+	if localIP == "" {
+		localIP = "127.0.0.1"
+	}
+
+	localAddress := net.JoinHostPort(localIP, strconv.FormatUint(tunnel.Config.LocalPort, 10))
+	local, err := net.DialTimeout("tcp", localAddress, localDialTimeout)
+	if err != nil {
+		log.Debug().Err(err).Msgf("tunnel %s: failed to reach %s", message.Proxy, localAddress)
+		ntm.rejectConnection(message.ConnectionID, err.Error())
+		return
+	}
+
+	if tunnel.Config.ProxyProtocol {
+		_, err = io.WriteString(local, proxyProtocolHeader(message.ClientAddr, local.RemoteAddr().String()))
+		if err != nil {
+			local.Close()
+			ntm.rejectConnection(message.ConnectionID, err.Error())
+			return
+		}
+	}
+
+	data, err := ntm.dialRelay(relay.DataPath, url.Values{"id": {message.ConnectionID}}.Encode())
+	if err != nil {
+		log.Debug().Err(err).Msgf("tunnel %s: failed to open relay data connection", message.Proxy)
+		local.Close()
+		return
+	}
+	data.PayloadType = websocket.BinaryFrame
+
+	// the relay knows nothing of bandwidth limits, so they are enforced here
+	if bytesPerSecond, err := ParseBandwidthLimit(tunnel.Config.BandwidthLimit); err == nil {
+		splice(newThrottledConn(local, bytesPerSecond), newThrottledConn(data, bytesPerSecond))
+		return
+	}
+
+	splice(local, data)
+}
+
+func (ntm *NativeTunnelManager) rejectConnection(connectionID string, reason string) {
+	err := ntm.send(relay.Message{Type: relay.TypeError, ConnectionID: connectionID, Error: reason})
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to reject tunnel connection")
+	}
+}
+
+// splice copies in both directions until either side is done, then closes
+// both.
+func splice(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	safe.Go(func() {
+		defer wg.Done()
+		_, _ = io.Copy(a, b)
+		once.Do(closeBoth)
+	})
+	safe.Go(func() {
+		defer wg.Done()
+		_, _ = io.Copy(b, a)
+		once.Do(closeBoth)
+	})
+	wg.Wait()
+}
+
+// register sends the full set of tunnels to the relay.
+func (ntm *NativeTunnelManager) register() error {
+	ntm.tunnelsLock.RLock()
+	proxies := make([]relay.Proxy, 0, len(ntm.tunnels))
+	for name, tunnel := range ntm.tunnels {
+		proxy := relay.Proxy{Name: name, Type: string(tunnel.Config.Protocol), RemotePort: tunnel.Config.RemotePort}
+		if tunnel.Config.Protocol == HTTP || tunnel.Config.Protocol == HTTPS {
+			proxy.Subdomain = tunnel.Config.Subdomain
+			proxy.RemotePort = 0
+		}
+		if tunnel.Config.Protocol == HTTP {
+			proxy.HTTPUser = tunnel.Config.HTTPUser
+			proxy.HTTPPassword = tunnel.Config.HTTPPassword
+		}
+		proxies = append(proxies, proxy)
+	}
+	ntm.tunnelsLock.RUnlock()
+
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Name < proxies[j].Name })
+
+	return ntm.send(relay.Message{Type: relay.TypeRegister, Proxies: proxies})
+}
+
+// registerAndWait registers the tunnels and waits until the relay reports
+// the named one.
+func (ntm *NativeTunnelManager) registerAndWait(name string) (relay.Proxy, error) {
+	deadline := time.After(relayRegisterTimeout)
+
+	ntm.tunnelsLock.RLock()
+	signal := ntm.statusSignal
+	ntm.tunnelsLock.RUnlock()
+
+	err := ntm.register()
+	if err != nil {
+		return relay.Proxy{}, err
+	}
+
+	for {
+		select {
+		case <-signal:
+		case <-deadline:
+			return relay.Proxy{}, fmt.Errorf("tunnel relay did not confirm proxy %s", name)
+		}
+
+		ntm.tunnelsLock.RLock()
+		status, ok := ntm.statuses[name]
+		signal = ntm.statusSignal
+		ntm.tunnelsLock.RUnlock()
+
+		if ok {
+			return status, nil
+		}
+	}
+}
+
+func (ntm *NativeTunnelManager) AddTunnel(config TunnelConfig) (TunnelConfig, error) {
+	log.Debug().Str("subdomain", config.Subdomain).Str("protocol", string(config.Protocol)).Msg("AddTunnel called")
+
+	if config.Protocol == UDP {
+		return TunnelConfig{}, errors.New("udp tunnels are not supported by the native tunnel backend")
+	}
+
+	tunnelID := CreateTunnelID(config.Subdomain, string(config.Protocol))
+	config.Name = tunnelID
+	if config.DeclaredPort == 0 {
+		config.DeclaredPort = declaredPortFromSubdomain(config.Subdomain)
+	}
+
+	ntm.tunnelsLock.Lock()
+	if ntm.tunnels[tunnelID] != nil {
+		ntm.tunnelsLock.Unlock()
+		return TunnelConfig{}, errors.New("tunnel already exists")
+	}
+	ntm.tunnels[tunnelID] = &Tunnel{Config: config}
+	ntm.tunnelsLock.Unlock()
+
+	status, err := ntm.registerAndWait(tunnelID)
+	if errors.Is(err, errRelayNotConnected) {
+		// registered with the rest once the connection is (re-)established
+		log.Debug().Str("tunnelID", tunnelID).Msg("Not connected to the tunnel relay, deferring registration")
+		return config, nil
+	}
+
+	if err != nil {
+		ntm.tunnelsLock.Lock()
+		delete(ntm.tunnels, tunnelID)
+		ntm.tunnelsLock.Unlock()
+		return TunnelConfig{}, err
+	}
+
+	if status.Status == relay.StatusError {
+		ntm.tunnelsLock.Lock()
+		delete(ntm.tunnels, tunnelID)
+		ntm.tunnelsLock.Unlock()
+
+		_ = ntm.register()
+		return TunnelConfig{}, fmt.Errorf("tunnel relay rejected proxy %s: %s", tunnelID, status.Error)
+	}
+
+	if status.RemotePort != 0 && config.Protocol == TCP {
+		config.RemotePort = status.RemotePort
+	}
+
+	return config, nil
+}
+
+func (ntm *NativeTunnelManager) RemoveTunnel(conf TunnelConfig) error {
+	log.Debug().Str("subdomain", conf.Subdomain).Str("protocol", string(conf.Protocol)).Msg("RemoveTunnel called")
+	tunnelID := CreateTunnelID(conf.Subdomain, string(conf.Protocol))
+
+	ntm.tunnelsLock.Lock()
+	delete(ntm.tunnels, tunnelID)
+	ntm.tunnelsLock.Unlock()
+
+	err := ntm.register()
+	if errors.Is(err, errRelayNotConnected) {
+		return nil
+	}
+
+	return err
+}
+
+// Reload re-sends the tunnel set to the relay, reconnecting when there is no
+// connection.
+func (ntm *NativeTunnelManager) Reload() error {
+	err := ntm.register()
+	if errors.Is(err, errRelayNotConnected) {
+		safe.Go(ntm.SuperviseStart)
+	}
+
+	return err
+}
+
+func (ntm *NativeTunnelManager) Get(tunnelID string) *Tunnel {
+	ntm.tunnelsLock.RLock()
+	defer ntm.tunnelsLock.RUnlock()
+
+	return ntm.tunnels[tunnelID]
+}
+
+func (ntm *NativeTunnelManager) GetTunnelConfig() ([]TunnelConfig, error) {
+	ntm.tunnelsLock.RLock()
+	defer ntm.tunnelsLock.RUnlock()
+
+	tunnelConfigs := make([]TunnelConfig, 0, len(ntm.tunnels))
+	for _, tunnel := range ntm.tunnels {
+		tunnelConfigs = append(tunnelConfigs, tunnel.Config)
+	}
+
+	sort.Slice(tunnelConfigs, func(i, j int) bool { return tunnelConfigs[i].Name < tunnelConfigs[j].Name })
+
+	return tunnelConfigs, nil
+}
+
+// GetState reports the tunnels the relay knows about. Like the frp backend it
+// reports nothing while there is no connection to ask.
+func (ntm *NativeTunnelManager) GetState() ([]TunnelState, error) {
+	ntm.connMu.Lock()
+	connected := ntm.conn != nil
+	ntm.connMu.Unlock()
+
+	tunnelStates := make([]TunnelState, 0)
+	if !connected {
+		return tunnelStates, nil
+	}
+
+	tunnelConfigs, err := ntm.GetTunnelConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ntm.tunnelsLock.RLock()
+	defer ntm.tunnelsLock.RUnlock()
+
+	for _, tunnelConfig := range tunnelConfigs {
+		proxy, ok := ntm.statuses[tunnelConfig.Name]
+		if !ok {
+			continue
+		}
+
+		tunnelStatus := TunnelStatus{
+			Name:       proxy.Name,
+			Status:     proxy.Status,
+			LocalAddr:  net.JoinHostPort(localIPOrLoopback(tunnelConfig.LocalIP), strconv.FormatUint(tunnelConfig.LocalPort, 10)),
+			RemotePort: proxy.RemotePort,
+			Error:      proxy.Error,
+			Protocol:   tunnelConfig.Protocol,
+		}
+		if proxy.RemotePort != 0 {
+			tunnelStatus.RemoteAddr = fmt.Sprintf(":%d", proxy.RemotePort)
+		}
+
+		tunnelStates = append(tunnelStates, TunnelState{
+			Status:       &tunnelStatus,
+			Port:         tunnelConfig.DeclaredPort,
+			AppName:      tunnelConfig.AppName,
+			Error:        proxy.Error != "",
+			ErrorMessage: proxy.Error,
+			Active:       proxy.Status == relay.StatusRunning,
+			URL:          buildTunnelURL(ntm.baseTunnelURL, tunnelConfig.Protocol, tunnelConfig.Subdomain, proxy.RemotePort),
+		})
+	}
+
+	return tunnelStates, nil
+}
+
+func (ntm *NativeTunnelManager) GetStateById(tunnelID string) (TunnelState, error) {
+	states, err := ntm.GetState()
+	if err != nil {
+		return TunnelState{}, err
+	}
+
+	for _, state := range states {
+		if state.Status.Name == tunnelID {
+			return state, nil
+		}
+	}
+
+	return TunnelState{}, errdefs.ErrNotFound
+}
+
+func (ntm *NativeTunnelManager) Status(tunnelID string) (TunnelStatus, error) {
+	state, err := ntm.GetStateById(tunnelID)
+	if err != nil {
+		return TunnelStatus{}, err
+	}
+
+	return *state.Status, nil
+}
+
+func (ntm *NativeTunnelManager) PublishTunnelState() error {
+	tunnelStates, err := ntm.GetState()
+	if err != nil {
+		return err
+	}
+
+	return publishTunnelState(ntm.messenger, ntm.config, tunnelStates)
+}
+
+func (ntm *NativeTunnelManager) SaveRemotePorts(payload common.TransitionPayload) error {
+	return saveRemotePorts(ntm.messenger, ntm.config, payload)
+}
+
+func localIPOrLoopback(localIP string) string {
+	if localIP == "" {
+		return "127.0.0.1"
+	}
+
+	return localIP
+}
+
+// declaredPortFromSubdomain recovers the declared port from a subdomain built
+// by CreateSubdomain.
+func declaredPortFromSubdomain(subdomain string) uint64 {
+	matches := subdomainRegex.FindStringSubmatch(subdomain)
+	if len(matches) < 3 {
+		return 0
+	}
+
+	port, err := strconv.ParseUint(matches[2], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return port
+}
@@ -0,0 +1,221 @@
+package tunnel
+
+import (
+	"bufio"
+	"net"
+	"reagent/config"
+	"reagent/testutil/fakes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nativeConfig(relayURL string, secret string) *config.Config {
+	return &config.Config{
+		CommandLineArguments: &config.CommandLineArguments{},
+		ReswarmConfig: &config.ReswarmConfig{
+			DeviceKey:      42,
+			SerialNumber:   "serial-42",
+			Secret:         secret,
+			TunnelBackend:  BackendNative,
+			TunnelRelayURL: relayURL,
+		},
+	}
+}
+
+func startNative(t *testing.T, relay *fakes.Relay, secret string) (*NativeTunnelManager, error) {
+	t.Helper()
+
+	tm, err := NewNativeTunnelManager(fakes.NewMessenger(), nativeConfig(relay.URL(), secret))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tm.Stop() })
+
+	return tm, tm.Start()
+}
+
+// echoServer is the app behind the tunnel: it answers every line with
+// "echo: <line>".
+func echoServer(t *testing.T) uint64 {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = conn.Write([]byte("echo: " + scanner.Text() + "\n"))
+				}
+			}()
+		}
+	}()
+
+	return uint64(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func roundTrip(t *testing.T, addr string, line string) string {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(line + "\n"))
+	require.NoError(t, err)
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return reply
+}
+
+func TestNewTunnelManagerSelectsBackend(t *testing.T) {
+	cfg := nativeConfig("ws://127.0.0.1:1", "secret")
+
+	tm, err := NewTunnelManager(nil, cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &NativeTunnelManager{}, tm)
+
+	cfg.ReswarmConfig.TunnelBackend = ""
+	tm, err = NewTunnelManager(nil, cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &FrpTunnelManager{}, tm, "frp stays the default")
+
+	cfg.ReswarmConfig.TunnelBackend = "carrier-pigeon"
+	_, err = NewTunnelManager(nil, cfg)
+	assert.Error(t, err)
+
+	cfg.ReswarmConfig.TunnelBackend = BackendNative
+	cfg.ReswarmConfig.TunnelRelayURL = "https://relay.example.com"
+	_, err = NewTunnelManager(nil, cfg)
+	assert.Error(t, err, "the relay is only reachable over a websocket")
+}
+
+func TestNativeTunnelHandshake(t *testing.T) {
+	relay := fakes.NewRelay("s3cret")
+	defer relay.Close()
+
+	t.Run("a device with the right secret is welcomed", func(t *testing.T) {
+		tm, err := startNative(t, relay, "s3cret")
+		require.NoError(t, err)
+		assert.True(t, relay.Connected())
+
+		capability, _ := tm.Capability()
+		assert.Equal(t, CapabilityAvailable, capability)
+	})
+
+	t.Run("a device with the wrong secret is rejected", func(t *testing.T) {
+		tm, err := startNative(t, relay, "wrong")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "authentication failed")
+
+		capability, lastErr := tm.Capability()
+		assert.Equal(t, CapabilityUnavailable, capability)
+		assert.NotEmpty(t, lastErr)
+	})
+}
+
+func TestNativeTunnelForwardsConnections(t *testing.T) {
+	relay := fakes.NewRelay("s3cret")
+	defer relay.Close()
+
+	tm, err := startNative(t, relay, "s3cret")
+	require.NoError(t, err)
+
+	localPort := echoServer(t)
+	subdomain := CreateSubdomain(TCP, 42, "plc-bridge", 502)
+
+	added, err := tm.AddTunnel(TunnelConfig{Subdomain: subdomain, AppName: "plc-bridge", Protocol: TCP, LocalPort: localPort})
+	require.NoError(t, err)
+	assert.Equal(t, CreateTunnelID(subdomain, string(TCP)), added.Name)
+	assert.Equal(t, uint64(502), added.DeclaredPort)
+	assert.NotZero(t, added.RemotePort, "tcp proxies get their remote port from the relay")
+
+	publicAddr := relay.PublicAddr(added.Name)
+	require.NotEmpty(t, publicAddr)
+	assert.Equal(t, "echo: hello\n", roundTrip(t, publicAddr, "hello"))
+	assert.Equal(t, "echo: again\n", roundTrip(t, publicAddr, "again"), "every client gets its own connection")
+
+	states, err := tm.GetState()
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.True(t, states[0].Active)
+	assert.Equal(t, "plc-bridge", states[0].AppName)
+	assert.Equal(t, uint64(502), states[0].Port)
+	assert.Equal(t, "tcp://"+subdomain+".tunnel.test:"+strconv.FormatUint(added.RemotePort, 10), states[0].URL)
+
+	_, err = tm.AddTunnel(TunnelConfig{Subdomain: subdomain, AppName: "plc-bridge", Protocol: TCP, LocalPort: localPort})
+	assert.Error(t, err, "tunnels are unique per subdomain and protocol")
+
+	require.NoError(t, tm.RemoveTunnel(added))
+	assert.Eventually(t, func() bool { return relay.PublicAddr(added.Name) == "" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNativeTunnelRejectsUDP(t *testing.T) {
+	tm, err := NewNativeTunnelManager(fakes.NewMessenger(), nativeConfig("ws://127.0.0.1:1", "s3cret"))
+	require.NoError(t, err)
+
+	_, err = tm.AddTunnel(TunnelConfig{Subdomain: CreateSubdomain(UDP, 42, "syslog", 514), Protocol: UDP, LocalPort: 514})
+	assert.Error(t, err)
+}
+
+func TestNativeTunnelDefersRegistrationUntilConnected(t *testing.T) {
+	relay := fakes.NewRelay("s3cret")
+	defer relay.Close()
+
+	tm, err := NewNativeTunnelManager(fakes.NewMessenger(), nativeConfig(relay.URL(), "s3cret"))
+	require.NoError(t, err)
+	defer tm.Stop()
+
+	subdomain := CreateSubdomain(HTTP, 42, "grafana", 3000)
+	_, err = tm.AddTunnel(TunnelConfig{Subdomain: subdomain, AppName: "grafana", Protocol: HTTP, LocalPort: echoServer(t)})
+	require.NoError(t, err, "tunnels added while offline are kept")
+
+	states, err := tm.GetState()
+	require.NoError(t, err)
+	assert.Empty(t, states, "nothing to report without a relay connection")
+
+	require.NoError(t, tm.Start())
+
+	assert.Eventually(t, func() bool {
+		proxies := relay.Proxies()
+		return len(proxies) == 1 && proxies[0].Subdomain == subdomain
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		states, _ := tm.GetState()
+		return len(states) == 1 && states[0].URL == "https://"+subdomain+".tunnel.test"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNativeTunnelReconnects(t *testing.T) {
+	relay := fakes.NewRelay("s3cret")
+	defer relay.Close()
+
+	tm, err := startNative(t, relay, "s3cret")
+	require.NoError(t, err)
+
+	added, err := tm.AddTunnel(TunnelConfig{Subdomain: CreateSubdomain(TCP, 42, "ssh", 22), AppName: "ssh", Protocol: TCP, LocalPort: echoServer(t)})
+	require.NoError(t, err)
+
+	relay.DropConnection()
+
+	// the relay forgot the proxy with the connection; the device re-registers it
+	assert.Eventually(t, func() bool {
+		return relay.Sessions() == 2 && relay.PublicAddr(added.Name) != ""
+	}, 10*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, "echo: back\n", roundTrip(t, relay.PublicAddr(added.Name), "back"))
+}
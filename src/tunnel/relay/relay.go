@@ -0,0 +1,97 @@
+// Package relay defines the wire protocol between the agent's native tunnel
+// backend (tunnel.NativeTunnelManager) and a tunnel relay.
+//
+// The device keeps one WebSocket control connection to the relay at
+// ControlPath, exchanging JSON Messages:
+//
+//	relay  -> device  challenge {nonce}
+//	device -> relay   hello     {device_key, serial_number, signature}
+//	relay  -> device  welcome   {base_domain}            (or error)
+//	device -> relay   register  {proxies}                full desired set, after every change
+//	relay  -> device  status    {proxies}                full actual set, with status/remote_port
+//	relay  -> device  connect   {connection_id, proxy, client_addr}
+//	                                                     a client connected to a proxy
+//	device -> relay   error     {connection_id, error}   the local service could not be reached
+//	device -> relay   ping, relay -> device pong         keepalive
+//
+// For every connect the device opens a second WebSocket at
+// DataPath?id=<connection_id> and splices it, as raw binary frames, to the
+// app's local port. Connections never share a socket, so no multiplexing is
+// needed and a slow client cannot stall another.
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+)
+
+const (
+	ControlPath = "/tunnel/control"
+	DataPath    = "/tunnel/data"
+)
+
+type MessageType string
+
+const (
+	TypeChallenge MessageType = "challenge"
+	TypeHello     MessageType = "hello"
+	TypeWelcome   MessageType = "welcome"
+	TypeRegister  MessageType = "register"
+	TypeStatus    MessageType = "status"
+	TypeConnect   MessageType = "connect"
+	TypeError     MessageType = "error"
+	TypePing      MessageType = "ping"
+	TypePong      MessageType = "pong"
+)
+
+// Proxy statuses reported by the relay; the same values frpc reports, so
+// tunnel states look alike for every backend.
+const (
+	StatusRunning = "running"
+	StatusError   = "error"
+)
+
+// Proxy is one exposed app port. The device fills in the desired fields; the
+// relay echoes them back with Status, RemotePort and Error set.
+type Proxy struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"` // http, https or tcp
+	Subdomain  string `json:"subdomain,omitempty"`
+	RemotePort uint64 `json:"remote_port,omitempty"`
+	// HTTPUser/HTTPPassword make the relay demand basic auth on http proxies.
+	HTTPUser     string `json:"http_user,omitempty"`
+	HTTPPassword string `json:"http_password,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type Message struct {
+	Type         MessageType `json:"type"`
+	Nonce        string      `json:"nonce,omitempty"`
+	DeviceKey    int         `json:"device_key,omitempty"`
+	SerialNumber string      `json:"serial_number,omitempty"`
+	Signature    string      `json:"signature,omitempty"`
+	BaseDomain   string      `json:"base_domain,omitempty"`
+	Proxies      []Proxy     `json:"proxies,omitempty"`
+	ConnectionID string      `json:"connection_id,omitempty"`
+	Proxy        string      `json:"proxy,omitempty"`
+	ClientAddr   string      `json:"client_addr,omitempty"` // host:port of the client, on connect
+	Error        string      `json:"error,omitempty"`
+}
+
+// Sign answers a relay challenge: base64url(HMAC-SHA256(secret,
+// "tunnel-relay:v1:" + nonce + ":" + deviceKey)), keyed by the device's own
+// CRA secret. Domain-separated so it can never be replayed as a WAMP-CRA
+// response or as the frps tunnel_proof derived from the same secret.
+func Sign(secret string, nonce string, deviceKey int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("tunnel-relay:v1:" + nonce + ":" + strconv.Itoa(deviceKey)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a hello signature in constant time.
+func Verify(secret string, nonce string, deviceKey int, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, nonce, deviceKey)), []byte(signature))
+}
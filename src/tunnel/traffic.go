@@ -0,0 +1,603 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reagent/common"
+	"reagent/safe"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// TrafficFileName is the file in the agent directory the traffic
+	// counters are persisted to.
+	TrafficFileName = "tunnel-traffic.json"
+	// trafficFlushInterval bounds how much accounting a crash loses; it is
+	// also how late a month rollover is noticed.
+	trafficFlushInterval = time.Minute
+	// trafficMonthLayout keys the monthly counters.
+	trafficMonthLayout = "2006-01"
+)
+
+var ErrQuotaExceeded = errors.New("monthly traffic quota exceeded")
+
+// TunnelTraffic is the traffic that passed a metered tunnel. In is what
+// clients sent to the app, Out what the app answered.
+type TunnelTraffic struct {
+	// Month is the calendar month (UTC, "2006-01") BytesIn and BytesOut
+	// count.
+	Month         string `json:"month"`
+	BytesIn       uint64 `json:"bytes_in"`
+	BytesOut      uint64 `json:"bytes_out"`
+	TotalBytesIn  uint64 `json:"total_bytes_in"`
+	TotalBytesOut uint64 `json:"total_bytes_out"`
+	MonthlyQuota  uint64 `json:"monthly_quota,omitempty"`
+	QuotaExceeded bool   `json:"quota_exceeded,omitempty"`
+}
+
+type trafficOwner struct {
+	stage  common.Stage
+	appKey uint64
+}
+
+// meteredTunnel is a TunnelTraffic with the rule it belongs to, as persisted.
+type meteredTunnel struct {
+	TunnelTraffic
+	Stage   common.Stage `json:"stage"`
+	AppKey  uint64       `json:"app_key"`
+	AppName string       `json:"app_name"`
+	Port    uint64       `json:"port"`
+}
+
+// TrafficMeter counts the bytes passing metered tunnels and enforces their
+// monthly quotas.
+//
+// frpc's admin API reports proxy status but no traffic, which only frps
+// keeps. The bytes are therefore counted on the device where they pass the
+// agent: metered tunnels are fronted by the AccessGuard's forwarder, which
+// reports every read and write here. Counters are persisted to a file in the
+// agent directory, so they survive restarts and the quota holds across them.
+type TrafficMeter struct {
+	path string
+
+	mu      sync.Mutex
+	tunnels map[string]*meteredTunnel
+	dirty   bool
+	// lifted are the apps whose quota block a new month lifted, until
+	// rollover hands them to onQuotaReset
+	lifted []trafficOwner
+
+	onQuotaExceeded func(tunnelID string)
+	onQuotaReset    func(stage common.Stage, appKey uint64)
+	now             func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTrafficMeter creates a meter persisting to path, picking up the counters
+// saved there by a previous run.
+func NewTrafficMeter(path string) *TrafficMeter {
+	tm := &TrafficMeter{
+		path:    path,
+		tunnels: make(map[string]*meteredTunnel),
+		now:     time.Now,
+		stop:    make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error().Err(err).Str("path", path).Msg("failed to read tunnel traffic counters, starting from zero")
+		}
+		return tm
+	}
+
+	err = json.Unmarshal(data, &tm.tunnels)
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("failed to parse tunnel traffic counters, starting from zero")
+		tm.tunnels = make(map[string]*meteredTunnel)
+	}
+
+	return tm
+}
+
+// SetQuotaCallbacks wires what happens when a tunnel exceeds its quota, and
+// when a new month lifts it again for the rule of the given app.
+func (tm *TrafficMeter) SetQuotaCallbacks(exceeded func(tunnelID string), reset func(stage common.Stage, appKey uint64)) {
+	if tm == nil {
+		return
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.onQuotaExceeded = exceeded
+	tm.onQuotaReset = reset
+}
+
+// Start periodically persists the counters and rolls them over into a new
+// month.
+func (tm *TrafficMeter) Start() {
+	safe.Go(func() {
+		ticker := time.NewTicker(trafficFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-tm.stop:
+				return
+			case <-ticker.C:
+				tm.rollover()
+
+				err := tm.Flush()
+				if err != nil {
+					log.Error().Err(err).Msg("failed to persist tunnel traffic counters")
+				}
+			}
+		}
+	})
+}
+
+// Close stops the meter and persists the counters one last time.
+func (tm *TrafficMeter) Close() error {
+	if tm == nil {
+		return nil
+	}
+
+	tm.stopOnce.Do(func() { close(tm.stop) })
+	return tm.Flush()
+}
+
+// Track meters the tunnel of an app's port rule with the given monthly
+// quota (0 for none). Counters of a tunnel tracked before are kept.
+func (tm *TrafficMeter) Track(stage common.Stage, appKey uint64, tunnelID string, appName string, port uint64, quota uint64) {
+	if tm == nil {
+		return
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	metered := tm.tunnels[tunnelID]
+	if metered == nil {
+		metered = &meteredTunnel{}
+		tm.tunnels[tunnelID] = metered
+	}
+
+	tm.rollMonthLocked(metered)
+
+	if metered.Stage != stage || metered.AppKey != appKey || metered.AppName != appName ||
+		metered.Port != port || metered.MonthlyQuota != quota {
+		tm.dirty = true
+	}
+
+	metered.Stage = stage
+	metered.AppKey = appKey
+	metered.AppName = appName
+	metered.Port = port
+	metered.MonthlyQuota = quota
+	// a raised quota lifts the block right away
+	metered.QuotaExceeded = quota > 0 && metered.BytesIn+metered.BytesOut >= quota
+}
+
+// Untrack stops metering a tunnel and forgets its counters, e.g. because the
+// app was uninstalled.
+func (tm *TrafficMeter) Untrack(tunnelID string) {
+	if tm == nil {
+		return
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.tunnels[tunnelID] != nil {
+		delete(tm.tunnels, tunnelID)
+		tm.dirty = true
+	}
+}
+
+// UntrackApp forgets the counters of all tunnels of an app.
+func (tm *TrafficMeter) UntrackApp(stage common.Stage, appKey uint64) {
+	if tm == nil {
+		return
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for tunnelID, metered := range tm.tunnels {
+		if metered.Stage == stage && metered.AppKey == appKey {
+			delete(tm.tunnels, tunnelID)
+			tm.dirty = true
+		}
+	}
+}
+
+// Metered reports whether the tunnel is tracked.
+func (tm *TrafficMeter) Metered(tunnelID string) bool {
+	if tm == nil {
+		return false
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return tm.tunnels[tunnelID] != nil
+}
+
+// QuotaExceeded reports whether the tunnel used up its quota for the month.
+func (tm *TrafficMeter) QuotaExceeded(tunnelID string) bool {
+	if tm == nil {
+		return false
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	metered := tm.tunnels[tunnelID]
+	if metered == nil {
+		return false
+	}
+
+	tm.rollMonthLocked(metered)
+	return metered.QuotaExceeded
+}
+
+// Add counts bytes received from (in) and sent to (out) the clients of a
+// tunnel, and reports whether the tunnel exceeded its quota. Bytes of
+// untracked tunnels are ignored.
+func (tm *TrafficMeter) Add(tunnelID string, in uint64, out uint64) (exceeded bool) {
+	tm.mu.Lock()
+
+	metered := tm.tunnels[tunnelID]
+	if metered == nil {
+		tm.mu.Unlock()
+		return false
+	}
+
+	tm.rollMonthLocked(metered)
+	metered.BytesIn += in
+	metered.BytesOut += out
+	metered.TotalBytesIn += in
+	metered.TotalBytesOut += out
+	tm.dirty = true
+
+	justExceeded := false
+	if metered.MonthlyQuota > 0 && !metered.QuotaExceeded && metered.BytesIn+metered.BytesOut >= metered.MonthlyQuota {
+		metered.QuotaExceeded = true
+		justExceeded = true
+	}
+	exceeded = metered.QuotaExceeded
+	onQuotaExceeded := tm.onQuotaExceeded
+	tm.mu.Unlock()
+
+	if justExceeded {
+		log.Warn().Str("tunnelID", tunnelID).Msg("Tunnel exceeded its monthly traffic quota, disabling it")
+		if onQuotaExceeded != nil {
+			safe.Go(func() { onQuotaExceeded(tunnelID) })
+		}
+	}
+
+	return exceeded
+}
+
+// Traffic returns the traffic of a tunnel, if it is metered.
+func (tm *TrafficMeter) Traffic(tunnelID string) (TunnelTraffic, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	metered := tm.tunnels[tunnelID]
+	if metered == nil {
+		return TunnelTraffic{}, false
+	}
+
+	tm.rollMonthLocked(metered)
+	return metered.TunnelTraffic, true
+}
+
+// ApplyTraffic fills in the traffic of the metered tunnels in states, and
+// adds an error state for tunnels disabled by their quota, so the backend
+// learns why they are gone.
+func (tm *TrafficMeter) ApplyTraffic(states []TunnelState) []TunnelState {
+	if tm == nil {
+		return states
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	reported := make(map[string]bool)
+	for i := range states {
+		if states[i].Status == nil {
+			continue
+		}
+
+		metered := tm.tunnels[states[i].Status.Name]
+		if metered == nil {
+			continue
+		}
+
+		tm.rollMonthLocked(metered)
+		traffic := metered.TunnelTraffic
+		states[i].Traffic = &traffic
+		reported[states[i].Status.Name] = true
+	}
+
+	for _, tunnelID := range tm.sortedIDsLocked() {
+		metered := tm.tunnels[tunnelID]
+		if reported[tunnelID] || !metered.QuotaExceeded {
+			continue
+		}
+
+		traffic := metered.TunnelTraffic
+		states = append(states, TunnelState{
+			AppName:      metered.AppName,
+			Port:         metered.Port,
+			Error:        true,
+			ErrorMessage: ErrQuotaExceeded.Error(),
+			Traffic:      &traffic,
+		})
+	}
+
+	return states
+}
+
+// Flush persists the counters if they changed since the last flush.
+func (tm *TrafficMeter) Flush() error {
+	tm.mu.Lock()
+	if !tm.dirty {
+		tm.mu.Unlock()
+		return nil
+	}
+
+	data, err := json.MarshalIndent(tm.tunnels, "", "  ")
+	tm.dirty = false
+	tm.mu.Unlock()
+
+	if err == nil {
+		err = tm.write(data)
+	}
+	if err != nil {
+		// keep the counters due, so the next flush tries again
+		tm.mu.Lock()
+		tm.dirty = true
+		tm.mu.Unlock()
+	}
+	return err
+}
+
+// write and rename, so a crash mid-write does not lose all counters
+func (tm *TrafficMeter) write(data []byte) error {
+	tmpPath := tm.path + ".tmp"
+	err := os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, tm.path)
+}
+
+// ServeHTTP exposes the counters in the Prometheus text format.
+func (tm *TrafficMeter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tm.mu.Lock()
+	ids := tm.sortedIDsLocked()
+	tunnels := make([]meteredTunnel, 0, len(ids))
+	for _, tunnelID := range ids {
+		tm.rollMonthLocked(tm.tunnels[tunnelID])
+		tunnels = append(tunnels, *tm.tunnels[tunnelID])
+	}
+	tm.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(metered meteredTunnel) uint64
+	}{
+		{"reagent_tunnel_received_bytes_total", "counter", "Bytes received from tunnel clients.", func(m meteredTunnel) uint64 { return m.TotalBytesIn }},
+		{"reagent_tunnel_sent_bytes_total", "counter", "Bytes sent to tunnel clients.", func(m meteredTunnel) uint64 { return m.TotalBytesOut }},
+		{"reagent_tunnel_month_received_bytes", "gauge", "Bytes received from tunnel clients this month.", func(m meteredTunnel) uint64 { return m.BytesIn }},
+		{"reagent_tunnel_month_sent_bytes", "gauge", "Bytes sent to tunnel clients this month.", func(m meteredTunnel) uint64 { return m.BytesOut }},
+		{"reagent_tunnel_monthly_quota_bytes", "gauge", "Monthly traffic quota of the tunnel, 0 for none.", func(m meteredTunnel) uint64 { return m.MonthlyQuota }},
+		{"reagent_tunnel_quota_exceeded", "gauge", "1 if the tunnel is disabled for exceeding its monthly quota.", func(m meteredTunnel) uint64 {
+			if m.QuotaExceeded {
+				return 1
+			}
+			return 0
+		}},
+	}
+
+	var sb strings.Builder
+	for _, metric := range metrics {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, metered := range tunnels {
+			fmt.Fprintf(&sb, "%s{tunnel=%q,app=%q,port=\"%d\"} %d\n", metric.name, ids[i], metered.AppName, metered.Port, metric.value(metered))
+		}
+	}
+
+	_, _ = io.WriteString(w, sb.String())
+}
+
+func (tm *TrafficMeter) sortedIDsLocked() []string {
+	ids := make([]string, 0, len(tm.tunnels))
+	for tunnelID := range tm.tunnels {
+		ids = append(ids, tunnelID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// rollMonthLocked starts a new month on a tunnel whose counters are from an
+// earlier one, noting its app if that lifted its quota block.
+func (tm *TrafficMeter) rollMonthLocked(metered *meteredTunnel) {
+	month := tm.now().UTC().Format(trafficMonthLayout)
+	if metered.Month == month {
+		return
+	}
+
+	if metered.QuotaExceeded {
+		tm.lifted = append(tm.lifted, trafficOwner{metered.Stage, metered.AppKey})
+	}
+
+	metered.Month = month
+	metered.BytesIn = 0
+	metered.BytesOut = 0
+	metered.QuotaExceeded = false
+	tm.dirty = true
+}
+
+// rollover starts the new month on all tunnels and has the ones that were
+// blocked by their quota re-created.
+func (tm *TrafficMeter) rollover() {
+	tm.mu.Lock()
+	for _, metered := range tm.tunnels {
+		tm.rollMonthLocked(metered)
+	}
+	lifted := tm.lifted
+	tm.lifted = nil
+	onQuotaReset := tm.onQuotaReset
+	tm.mu.Unlock()
+
+	if onQuotaReset == nil {
+		return
+	}
+
+	seen := make(map[trafficOwner]bool)
+	for _, app := range lifted {
+		if seen[app] {
+			continue
+		}
+		seen[app] = true
+
+		log.Info().Str("stage", string(app.stage)).Uint64("appKey", app.appKey).Msg("New month, re-enabling tunnels disabled by their traffic quota")
+		onQuotaReset(app.stage, app.appKey)
+	}
+}
+
+// ParseBandwidthLimit parses a bandwidth limit in frp notation, a positive
+// integer with a KB or MB suffix, into bytes per second.
+func ParseBandwidthLimit(limit string) (uint64, error) {
+	var unit uint64
+	var number string
+	switch {
+	case strings.HasSuffix(limit, "MB"):
+		unit, number = 1024*1024, strings.TrimSuffix(limit, "MB")
+	case strings.HasSuffix(limit, "KB"):
+		unit, number = 1024, strings.TrimSuffix(limit, "KB")
+	default:
+		return 0, fmt.Errorf("invalid bandwidth limit %q: expected a KB or MB suffix", limit)
+	}
+
+	value, err := strconv.ParseUint(number, 10, 64)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("invalid bandwidth limit %q: expected a positive integer before the unit", limit)
+	}
+
+	return value * unit, nil
+}
+
+// meteredListener reports the traffic of the connections it accepts to the
+// meter, and turns clients away once the tunnel exceeded its quota.
+type meteredListener struct {
+	net.Listener
+	meter    *TrafficMeter
+	tunnelID string
+}
+
+func (l meteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.meter.QuotaExceeded(l.tunnelID) {
+			conn.Close()
+			continue
+		}
+
+		return &meteredConn{Conn: conn, meter: l.meter, tunnelID: l.tunnelID}, nil
+	}
+}
+
+type meteredConn struct {
+	net.Conn
+	meter    *TrafficMeter
+	tunnelID string
+}
+
+// Read and Write cut the connection once the quota is used up, so a running
+// stream does not outlive it.
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.meter.Add(c.tunnelID, uint64(n), 0) {
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.meter.Add(c.tunnelID, 0, uint64(n)) {
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// throttledConn paces writes to bytesPerSecond, for tunnel backends that have
+// no bandwidth limit of their own.
+type throttledConn struct {
+	io.ReadWriteCloser
+	bytesPerSecond uint64
+	start          time.Time
+	written        uint64
+}
+
+func newThrottledConn(conn io.ReadWriteCloser, bytesPerSecond uint64) *throttledConn {
+	return &throttledConn{ReadWriteCloser: conn, bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		// write at most a tenth of a second's worth at a time, so bursts
+		// stay short
+		chunk := len(b) - written
+		if limit := int(c.bytesPerSecond / 10); limit > 0 && chunk > limit {
+			chunk = limit
+		}
+
+		n, err := c.ReadWriteCloser.Write(b[written : written+chunk])
+		written += n
+		c.written += uint64(n)
+		if err != nil {
+			return written, err
+		}
+
+		due := c.start.Add(time.Duration(float64(c.written) / float64(c.bytesPerSecond) * float64(time.Second)))
+		wait := time.Until(due)
+		if wait > 0 {
+			time.Sleep(wait)
+		} else if wait < -time.Second {
+			// the connection was idle; idle time must not save up a burst
+			c.start = time.Now()
+			c.written = 0
+		}
+	}
+
+	return written, nil
+}
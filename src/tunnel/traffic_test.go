@@ -0,0 +1,263 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reagent/common"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMeter(t *testing.T) *TrafficMeter {
+	t.Helper()
+
+	tm := NewTrafficMeter(filepath.Join(t.TempDir(), TrafficFileName))
+	t.Cleanup(func() { _ = tm.Close() })
+	return tm
+}
+
+func TestParseBandwidthLimit(t *testing.T) {
+	limit, err := ParseBandwidthLimit("512KB")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(512*1024), limit)
+
+	limit, err = ParseBandwidthLimit("2MB")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2*1024*1024), limit)
+
+	for _, invalid := range []string{"", "512", "1GB", "0KB", "-1MB", "1.5MB", "KB"} {
+		_, err = ParseBandwidthLimit(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTrafficMeterPersistsCounters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), TrafficFileName)
+
+	tm := NewTrafficMeter(path)
+	tm.Track(common.PROD, 7, "grafana-http", "grafana", 3000, 0)
+	tm.Add("grafana-http", 100, 2000)
+	tm.Add("unmetered-http", 5, 5)
+	require.NoError(t, tm.Close())
+
+	restarted := NewTrafficMeter(path)
+	traffic, ok := restarted.Traffic("grafana-http")
+	require.True(t, ok)
+	assert.Equal(t, uint64(100), traffic.BytesIn)
+	assert.Equal(t, uint64(2000), traffic.BytesOut)
+	assert.Equal(t, uint64(2100), traffic.TotalBytesIn+traffic.TotalBytesOut)
+	assert.Equal(t, time.Now().UTC().Format(trafficMonthLayout), traffic.Month)
+
+	assert.False(t, restarted.Metered("unmetered-http"), "only tracked tunnels are counted")
+}
+
+func TestTrafficMeterRetriesFailedFlush(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "agent")
+	path := filepath.Join(dir, TrafficFileName)
+
+	// the directory is missing, so the write fails
+	tm := NewTrafficMeter(path)
+	tm.Track(common.PROD, 7, "grafana-http", "grafana", 3000, 0)
+	tm.Add("grafana-http", 100, 2000)
+	require.Error(t, tm.Flush())
+
+	require.NoError(t, os.MkdirAll(dir, 0o700))
+	require.NoError(t, tm.Flush())
+
+	restarted := NewTrafficMeter(path)
+	traffic, ok := restarted.Traffic("grafana-http")
+	require.True(t, ok)
+	assert.Equal(t, uint64(100), traffic.BytesIn)
+}
+
+func TestTrafficMeterEnforcesQuota(t *testing.T) {
+	tm := newTestMeter(t)
+
+	exceeded := make(chan string, 1)
+	tm.SetQuotaCallbacks(func(tunnelID string) { exceeded <- tunnelID }, nil)
+
+	tm.Track(common.PROD, 7, "cam-http", "cam", 8080, 1000)
+	assert.False(t, tm.Add("cam-http", 100, 800))
+	assert.False(t, tm.QuotaExceeded("cam-http"))
+
+	assert.True(t, tm.Add("cam-http", 0, 100))
+	assert.True(t, tm.QuotaExceeded("cam-http"))
+
+	select {
+	case tunnelID := <-exceeded:
+		assert.Equal(t, "cam-http", tunnelID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("quota callback not called")
+	}
+
+	tm.Track(common.PROD, 7, "cam-http", "cam", 8080, 2000)
+	assert.False(t, tm.QuotaExceeded("cam-http"), "raising the quota lifts the block")
+}
+
+func TestTrafficMeterRollsOverMonthly(t *testing.T) {
+	tm := newTestMeter(t)
+
+	now := time.Date(2026, time.March, 31, 23, 59, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+
+	type owner struct {
+		stage  common.Stage
+		appKey uint64
+	}
+	var reset []owner
+	tm.SetQuotaCallbacks(nil, func(stage common.Stage, appKey uint64) { reset = append(reset, owner{stage, appKey}) })
+
+	tm.Track(common.PROD, 7, "cam-http", "cam", 8080, 1000)
+	tm.Track(common.PROD, 7, "cam-tcp", "cam", 554, 1000)
+	tm.Add("cam-http", 600, 600)
+	tm.Add("cam-tcp", 600, 600)
+	require.True(t, tm.QuotaExceeded("cam-http"))
+
+	tm.rollover()
+	assert.Empty(t, reset, "still the same month")
+
+	now = now.Add(2 * time.Minute)
+	tm.rollover()
+	assert.Equal(t, []owner{{common.PROD, 7}}, reset, "the app is restored once")
+
+	traffic, _ := tm.Traffic("cam-http")
+	assert.False(t, traffic.QuotaExceeded)
+	assert.Equal(t, "2026-04", traffic.Month)
+	assert.Zero(t, traffic.BytesIn+traffic.BytesOut)
+	assert.Equal(t, uint64(1200), traffic.TotalBytesIn+traffic.TotalBytesOut, "totals are kept")
+}
+
+func TestTrafficMeterAppliesTrafficToStates(t *testing.T) {
+	tm := newTestMeter(t)
+	tm.Track(common.PROD, 7, "grafana-http", "grafana", 3000, 0)
+	tm.Track(common.PROD, 7, "cam-http", "cam", 8080, 10)
+	tm.Add("grafana-http", 1, 2)
+	tm.Add("cam-http", 10, 10)
+
+	states := tm.ApplyTraffic([]TunnelState{
+		{Status: &TunnelStatus{Name: "grafana-http"}, AppName: "grafana", Port: 3000, Active: true},
+		{Status: &TunnelStatus{Name: "other-http"}, AppName: "other", Port: 80, Active: true},
+	})
+
+	require.Len(t, states, 3)
+	require.NotNil(t, states[0].Traffic)
+	assert.Equal(t, uint64(2), states[0].Traffic.BytesOut)
+	assert.Nil(t, states[1].Traffic)
+
+	assert.Equal(t, "cam", states[2].AppName, "tunnels disabled by their quota are still reported")
+	assert.Equal(t, uint64(8080), states[2].Port)
+	assert.True(t, states[2].Error)
+	assert.Equal(t, ErrQuotaExceeded.Error(), states[2].ErrorMessage)
+	assert.True(t, states[2].Traffic.QuotaExceeded)
+
+	var none *TrafficMeter
+	assert.Len(t, none.ApplyTraffic(states[:1]), 1)
+}
+
+func TestTrafficMeterServesMetrics(t *testing.T) {
+	tm := newTestMeter(t)
+	tm.Track(common.PROD, 7, "grafana-http", "grafana", 3000, 5000)
+	tm.Add("grafana-http", 10, 20)
+
+	recorder := httptest.NewRecorder()
+	tm.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	assert.Contains(t, body, "# TYPE reagent_tunnel_received_bytes_total counter\n")
+	assert.Contains(t, body, `reagent_tunnel_received_bytes_total{tunnel="grafana-http",app="grafana",port="3000"} 10`+"\n")
+	assert.Contains(t, body, `reagent_tunnel_sent_bytes_total{tunnel="grafana-http",app="grafana",port="3000"} 20`+"\n")
+	assert.Contains(t, body, `reagent_tunnel_monthly_quota_bytes{tunnel="grafana-http",app="grafana",port="3000"} 5000`+"\n")
+	assert.Contains(t, body, `reagent_tunnel_quota_exceeded{tunnel="grafana-http",app="grafana",port="3000"} 0`+"\n")
+}
+
+func TestAccessGuardMetersTraffic(t *testing.T) {
+	tm := newTestMeter(t)
+	exceeded := make(chan string, 1)
+	tm.SetQuotaCallbacks(func(tunnelID string) { exceeded <- tunnelID }, nil)
+
+	ag := NewAccessGuard(nil)
+	ag.SetTrafficMeter(tm)
+	defer ag.ReleaseApp(common.PROD, 1)
+
+	config := tcpTunnelConfig(echoServer(t))
+	tunnelID := CreateTunnelID(config.Subdomain, string(TCP))
+	tm.Track(common.PROD, 1, tunnelID, "plc-bridge", 502, 200)
+
+	guarded, err := ag.Apply(common.PROD, 1, nil, true, config, BackendFrp)
+	require.NoError(t, err)
+	require.NotEqual(t, config.LocalPort, guarded.LocalPort, "metered tunnels are fronted without a policy")
+	require.True(t, guarded.ProxyProtocol)
+
+	guardAddr := net.JoinHostPort("127.0.0.1", strconv.FormatUint(guarded.LocalPort, 10))
+	header := proxyProtocolHeader("203.0.113.7:5000", "127.0.0.1:80")
+
+	conn, err := net.Dial("tcp", guardAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = io.WriteString(conn, header+"hello\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	reply, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello\n", reply)
+
+	assert.Eventually(t, func() bool {
+		traffic, _ := tm.Traffic(tunnelID)
+		return traffic.BytesIn == uint64(len(header)+len("hello\n")) && traffic.BytesOut == uint64(len(reply))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// keep streaming until the quota cuts the connection
+	for i := 0; i < 100; i++ {
+		if _, err = io.WriteString(conn, "more\n"); err != nil {
+			break
+		}
+		if _, err = reader.ReadString('\n'); err != nil {
+			break
+		}
+	}
+	assert.Error(t, err, "the connection is cut once the quota is used up")
+
+	select {
+	case id := <-exceeded:
+		assert.Equal(t, tunnelID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("quota callback not called")
+	}
+
+	refused, err := net.Dial("tcp", guardAddr)
+	require.NoError(t, err)
+	defer refused.Close()
+	_ = refused.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(refused, header+"hello\n")
+	_, err = bufio.NewReader(refused).ReadString('\n')
+	assert.Error(t, err, "new clients are turned away")
+}
+
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestThrottledConnPacesWrites(t *testing.T) {
+	var buf bytes.Buffer
+	conn := newThrottledConn(nopCloser{&buf}, 10*1024)
+
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 3*1024))
+	require.NoError(t, err)
+	assert.Equal(t, 3*1024, n)
+	assert.Equal(t, 3*1024, buf.Len())
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond, "3KB at 10KB/s take about 300ms")
+}
@@ -248,6 +248,7 @@ type TunnelManager interface {
 	// MarkUnavailable records that tunnels cannot run (e.g. an unsupported
 	// platform), so the device degrades cleanly instead of retrying.
 	MarkUnavailable(reason string)
+	SetMessenger(messenger messenger.Messenger)
 }
 
 type TunnelStatus struct {
@@ -279,6 +280,11 @@ type TunnelState struct {
 	Error        bool          `json:"error"`
 	ErrorMessage string        `json:"error_message"`
 	URL          string        `json:"url"`
+	// LanURL reaches the app directly on its host port via the device's mDNS
+	// name, for clients on the same network (see LANAdvertiser).
+	LanURL string `json:"lan_url,omitempty"`
+	// Traffic is set for metered tunnels (see TrafficMeter).
+	Traffic *TunnelTraffic `json:"traffic,omitempty"`
 }
 
 func parseProxyStatus(text string) ([]TunnelStatus, error) {
@@ -911,18 +917,24 @@ func (frpTm *FrpTunnelManager) waitForLogin() {
 }
 
 func (frpTm *FrpTunnelManager) PublishTunnelState() error {
-	updateTopic := common.BuildTunnelStateUpdate(frpTm.config.ReswarmConfig.SerialNumber)
 	tunnelStates, err := frpTm.GetState()
 	if err != nil {
 		return err
 	}
 
+	return publishTunnelState(frpTm.messenger, frpTm.config, tunnelStates)
+}
+
+// publishTunnelState nudges the cloud with the device's current tunnel states.
+func publishTunnelState(messenger messenger.Messenger, config *config.Config, tunnelStates []TunnelState) error {
+	updateTopic := common.BuildTunnelStateUpdate(config.ReswarmConfig.SerialNumber)
+
 	var args []interface{}
 	for _, tunnelState := range tunnelStates {
 		args = append(args, tunnelState)
 	}
 
-	return frpTm.messenger.Publish(topics.Topic(updateTopic), args, nil, nil)
+	return messenger.Publish(topics.Topic(updateTopic), args, nil, nil)
 }
 
 func NewFrpTunnelManager(messenger messenger.Messenger, config *config.Config) (*FrpTunnelManager, error) {
@@ -975,7 +987,7 @@ func (frpTm *FrpTunnelManager) reserveRemotePort(port uint64, protocol Protocol)
 	}
 
 	remotePortKw := payload["remote_port"]
-	remotePort, ok := remotePortKw.(uint64)
+	remotePort, ok := common.ToUint64(remotePortKw)
 	if !ok {
 		return 0, errors.New("failed to parse port")
 	}
@@ -1016,10 +1028,15 @@ func (frpTm *FrpTunnelManager) Get(tunnelID string) *Tunnel {
 }
 
 func (frpTm *FrpTunnelManager) buildURL(protocol Protocol, subdomain string, remotePort uint64) string {
+	return buildTunnelURL(frpTm.configBuilder.BaseTunnelURL, protocol, subdomain, remotePort)
+}
+
+// buildTunnelURL is the public URL of a tunnel, shared by all backends.
+func buildTunnelURL(baseTunnelURL string, protocol Protocol, subdomain string, remotePort uint64) string {
 	protocolString := string(protocol)
 
 	if remotePort != 0 && protocol != HTTP && protocol != HTTPS {
-		return fmt.Sprintf("%s://%s.%s:%d", protocolString, subdomain, frpTm.configBuilder.BaseTunnelURL, remotePort)
+		return fmt.Sprintf("%s://%s.%s:%d", protocolString, subdomain, baseTunnelURL, remotePort)
 	}
 
 	// we always have HTTPS since we tunnel to our HTTPS service
@@ -1027,7 +1044,7 @@ func (frpTm *FrpTunnelManager) buildURL(protocol Protocol, subdomain string, rem
 		protocolString = "https"
 	}
 
-	return fmt.Sprintf("%s://%s.%s", protocolString, subdomain, frpTm.configBuilder.BaseTunnelURL)
+	return fmt.Sprintf("%s://%s.%s", protocolString, subdomain, baseTunnelURL)
 }
 
 func (frpTm *FrpTunnelManager) GetState() ([]TunnelState, error) {
@@ -1278,12 +1295,18 @@ func (frpTm *FrpTunnelManager) RemoveTunnel(conf TunnelConfig) error {
 }
 
 func (frpTm *FrpTunnelManager) SaveRemotePorts(payload common.TransitionPayload) error {
+	return saveRemotePorts(frpTm.messenger, frpTm.config, payload)
+}
+
+// saveRemotePorts persists an app's port rules, including the remote ports
+// the tunnel backend assigned, in the backend.
+func saveRemotePorts(messenger messenger.Messenger, config *config.Config, payload common.TransitionPayload) error {
 	// log.Debug().Str("app_key", fmt.Sprintf("%v", payload.AppKey)).Interface("payload", payload).Msg("SaveRemotePort called")
 
 	update := []interface{}{common.Dict{
 		"app_key":    payload.AppKey,
-		"device_key": frpTm.config.ReswarmConfig.DeviceKey,
-		"swarm_key":  frpTm.config.ReswarmConfig.SwarmKey,
+		"device_key": config.ReswarmConfig.DeviceKey,
+		"swarm_key":  config.ReswarmConfig.SwarmKey,
 		"stage":      payload.Stage,
 		"ports":      payload.Ports,
 	}}
@@ -1291,7 +1314,7 @@ func (frpTm *FrpTunnelManager) SaveRemotePorts(payload common.TransitionPayload)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
-	_, err := frpTm.messenger.Call(ctx, topics.SetActualAppOnDeviceState, update, nil, nil, nil)
+	_, err := messenger.Call(ctx, topics.SetActualAppOnDeviceState, update, nil, nil, nil)
 	if err != nil {
 		log.Error().Stack().Err(err).Msg("Failed to save remote port")
 		return err
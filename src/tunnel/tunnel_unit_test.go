@@ -565,6 +565,78 @@ func TestConfigBuilderAddTunnelConfigDeduplicates(t *testing.T) {
 	assert.Len(t, configs, 1)
 }
 
+func TestConfigBuilderMapsAccessOptions(t *testing.T) {
+	cfg := builderConfig(t, &config.ReswarmConfig{Environment: string(common.PRODUCTION)})
+	builder := NewTunnelConfigBuilder(cfg)
+
+	httpConf := TunnelConfig{
+		Subdomain:    CreateSubdomain(HTTP, 9, "web", 8080),
+		Protocol:     HTTP,
+		LocalPort:    8080,
+		HTTPUser:     "customer",
+		HTTPPassword: "hunter2",
+	}
+	tcpConf := TunnelConfig{
+		Subdomain:     CreateSubdomain(TCP, 9, "ssh", 22),
+		Protocol:      TCP,
+		LocalPort:     22,
+		RemotePort:    30022,
+		ProxyProtocol: true,
+	}
+
+	builder.AddTunnelConfig(httpConf)
+	builder.AddTunnelConfig(tcpConf)
+
+	assert.Equal(t, "customer", builder.yamlConfig.Proxies[0].HTTPUser)
+	assert.Equal(t, "hunter2", builder.yamlConfig.Proxies[0].HTTPPassword)
+	assert.Nil(t, builder.yamlConfig.Proxies[0].Transport)
+	require.NotNil(t, builder.yamlConfig.Proxies[1].Transport)
+	assert.Equal(t, "v1", builder.yamlConfig.Proxies[1].Transport.ProxyProtocolVersion)
+
+	configs := mustConfigs(t, &builder)
+	require.Len(t, configs, 2)
+	assert.Equal(t, "customer", configs[0].HTTPUser)
+	assert.True(t, configs[1].ProxyProtocol)
+
+	// new credentials update the proxy in place
+	httpConf.HTTPPassword = "correct horse"
+	builder.AddTunnelConfig(httpConf)
+	assert.Equal(t, "correct horse", builder.yamlConfig.Proxies[0].HTTPPassword)
+
+	info, err := os.Stat(builder.ConfigPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "frpc.yaml holds credentials")
+}
+
+func TestConfigBuilderMapsBandwidthLimit(t *testing.T) {
+	cfg := builderConfig(t, &config.ReswarmConfig{Environment: string(common.PRODUCTION)})
+	builder := NewTunnelConfigBuilder(cfg)
+
+	conf := TunnelConfig{
+		Subdomain:      CreateSubdomain(HTTP, 9, "cam", 8080),
+		Protocol:       HTTP,
+		LocalPort:      8080,
+		BandwidthLimit: "512KB",
+	}
+	builder.AddTunnelConfig(conf)
+
+	transport := builder.yamlConfig.Proxies[0].Transport
+	require.NotNil(t, transport)
+	assert.Equal(t, "512KB", transport.BandwidthLimit)
+	assert.Equal(t, "client", transport.BandwidthLimitMode, "frpc enforces the limit, whichever frps is in use")
+	assert.Empty(t, transport.ProxyProtocolVersion)
+
+	configs := mustConfigs(t, &builder)
+	require.Len(t, configs, 1)
+	assert.Equal(t, "512KB", configs[0].BandwidthLimit)
+
+	// a changed limit updates the proxy in place
+	conf.BandwidthLimit = "1MB"
+	builder.AddTunnelConfig(conf)
+	require.Len(t, builder.yamlConfig.Proxies, 1)
+	assert.Equal(t, "1MB", builder.yamlConfig.Proxies[0].Transport.BandwidthLimit)
+}
+
 func TestConfigBuilderRemoveTunnelConfig(t *testing.T) {
 	cfg := builderConfig(t, &config.ReswarmConfig{Environment: string(common.PRODUCTION)})
 	builder := NewTunnelConfigBuilder(cfg)